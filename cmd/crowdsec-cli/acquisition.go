@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/cursors"
+	pluginacquisition "github.com/crowdsecurity/crowdsec/pkg/acquisition/modules/plugin"
+	"github.com/crowdsecurity/crowdsec/pkg/csconfig"
+	"github.com/olekukonko/tablewriter"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var cursorsStore *cursors.FileStore
+
+func NewAcquisitionCmd() *cobra.Command {
+	var cmdAcquisition = &cobra.Command{
+		Use:               "acquisition [action]",
+		Short:             "Manage acquisition",
+		Args:              cobra.MinimumNArgs(1),
+		Aliases:           []string{"acquis"},
+		DisableAutoGenTag: true,
+	}
+
+	var cmdCursors = &cobra.Command{
+		Use:   "cursors [action]",
+		Short: "Inspect or reset the position saved by the datasources",
+		Long: `Datasources save their position (ie. the offset in a tailed file), to resume where they stopped after a restart.
+Note: Reset cursors while crowdsec is stopped, or they will be saved again on shutdown.`,
+		Args:              cobra.MinimumNArgs(1),
+		DisableAutoGenTag: true,
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			var err error
+			if err := csConfig.LoadConfigurationPaths(); err != nil {
+				log.Fatalf(err.Error())
+			}
+			if csConfig.Crowdsec == nil {
+				log.Fatal("crowdsec agent is disabled, there is no cursor to manage")
+			}
+			cursorsPath := csConfig.Crowdsec.AcquisitionCursorsPath
+			if cursorsPath == "" {
+				cursorsPath = filepath.Join(csConfig.ConfigPaths.DataDir, csconfig.DEFAULT_ACQUISITION_CURSORS_FILE)
+			}
+			cursorsStore, err = cursors.NewFileStore(cursorsPath)
+			if err != nil {
+				log.Fatalf("unable to load cursors: %s", err)
+			}
+		},
+	}
+	cmdAcquisition.AddCommand(cmdCursors)
+
+	var cmdCursorsList = &cobra.Command{
+		Use:               "list",
+		Short:             "List cursors",
+		Example:           `cscli acquisition cursors list`,
+		Args:              cobra.ExactArgs(0),
+		DisableAutoGenTag: true,
+		Run: func(cmd *cobra.Command, arg []string) {
+			all := cursorsStore.List()
+			type cursorItem struct {
+				Datasource string    `json:"datasource"`
+				Key        string    `json:"key"`
+				Value      string    `json:"value"`
+				UpdatedAt  time.Time `json:"updated_at"`
+			}
+			items := []cursorItem{}
+			for datasource, sourceCursors := range all {
+				for key, cursor := range sourceCursors {
+					items = append(items, cursorItem{Datasource: datasource, Key: key, Value: cursor.Value, UpdatedAt: cursor.UpdatedAt})
+				}
+			}
+			sort.Slice(items, func(i, j int) bool {
+				if items[i].Datasource != items[j].Datasource {
+					return items[i].Datasource < items[j].Datasource
+				}
+				return items[i].Key < items[j].Key
+			})
+			if csConfig.Cscli.Output == "human" {
+				table := tablewriter.NewWriter(os.Stdout)
+				table.SetCenterSeparator("")
+				table.SetColumnSeparator("")
+
+				table.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
+				table.SetAlignment(tablewriter.ALIGN_LEFT)
+				table.SetHeader([]string{"Datasource", "Key", "Cursor", "Last update"})
+				for _, item := range items {
+					table.Append([]string{item.Datasource, item.Key, item.Value, item.UpdatedAt.Format(time.RFC3339)})
+				}
+				table.Render()
+			} else if csConfig.Cscli.Output == "json" {
+				x, err := json.MarshalIndent(items, "", " ")
+				if err != nil {
+					log.Fatalf("failed to marshal cursors: %s", err)
+				}
+				fmt.Printf("%s", string(x))
+			} else if csConfig.Cscli.Output == "raw" {
+				csvwriter := csv.NewWriter(os.Stdout)
+				err := csvwriter.Write([]string{"datasource", "key", "cursor", "updated_at"})
+				if err != nil {
+					log.Fatalf("failed to write raw header: %s", err)
+				}
+				for _, item := range items {
+					err := csvwriter.Write([]string{item.Datasource, item.Key, item.Value, item.UpdatedAt.Format(time.RFC3339)})
+					if err != nil {
+						log.Fatalf("failed to write raw: %s", err)
+					}
+				}
+				csvwriter.Flush()
+			}
+		},
+	}
+	cmdCursors.AddCommand(cmdCursorsList)
+
+	var cmdCursorsReset = &cobra.Command{
+		Use:   "reset datasource [key]",
+		Short: "Reset the cursors of a datasource",
+		Long:  `Reset all the cursors of a datasource, or only the one of key`,
+		Example: `cscli acquisition cursors reset file
+cscli acquisition cursors reset file /var/log/auth.log`,
+		Args:              cobra.RangeArgs(1, 2),
+		DisableAutoGenTag: true,
+		Run: func(cmd *cobra.Command, args []string) {
+			key := ""
+			if len(args) > 1 {
+				key = args[1]
+			}
+			deleted, err := cursorsStore.Delete(args[0], key)
+			if err != nil {
+				log.Fatalf("unable to reset cursors: %s", err)
+			}
+			log.Infof("%d cursor(s) reset", deleted)
+		},
+	}
+	cmdCursors.AddCommand(cmdCursorsReset)
+
+	var testLines int
+	var testTimeout time.Duration
+	var cmdTest = &cobra.Command{
+		Use:   "test [acquisition_file]...",
+		Short: "Dry-run datasources",
+		Long: `Start the datasources of the given acquisition files (or of the configured ones), print the lines they read,
+and report the errors they ran into. Nothing is sent to the parsers.
+Datasources stop after reading --lines lines or after --timeout: push datasources (ie. syslog) only read what is sent to them during this time.`,
+		Example: `cscli acquisition test
+cscli acquisition test /etc/crowdsec/acquis.d/nginx.yaml --lines 5 --timeout 30s`,
+		DisableAutoGenTag: true,
+		Run: func(cmd *cobra.Command, args []string) {
+			acquisFiles := args
+			if len(acquisFiles) == 0 {
+				if err := csConfig.LoadCrowdsec(); err != nil {
+					log.Fatalf("unable to load crowdsec configuration: %s", err)
+				}
+				if csConfig.Crowdsec == nil {
+					log.Fatal("crowdsec agent is disabled, there is no datasource to test")
+				}
+				acquisFiles = csConfig.Crowdsec.AcquisitionFiles
+			} else if err := csConfig.LoadConfigurationPaths(); err != nil {
+				log.Fatalf(err.Error())
+			}
+			if testLines <= 0 {
+				log.Fatal("--lines must be positive")
+			}
+			pluginacquisition.SetPluginConfig(csConfig.ConfigPaths.PluginDir, csConfig.PluginConfig)
+			results := []acquisition.DryRunResult{}
+			failed := false
+			for _, acquisFile := range acquisFiles {
+				sources, err := acquisition.LoadAcquisitionFromFile(&csconfig.CrowdsecServiceCfg{AcquisitionFiles: []string{acquisFile}})
+				if err != nil {
+					log.Errorf("%s", err)
+					failed = true
+					continue
+				}
+				for _, source := range sources {
+					log.Infof("testing %s datasource from %s", source.GetName(), acquisFile)
+					result := acquisition.DryRun(source, testLines, testTimeout)
+					if result.Error != "" {
+						failed = true
+					}
+					results = append(results, result)
+				}
+			}
+			printDryRunResults(results)
+			if failed {
+				os.Exit(1)
+			}
+		},
+	}
+	cmdTest.Flags().IntVarP(&testLines, "lines", "n", 10, "Number of lines to read from each datasource")
+	cmdTest.Flags().DurationVar(&testTimeout, "timeout", 10*time.Second, "How long to wait for lines from each datasource")
+	cmdAcquisition.AddCommand(cmdTest)
+
+	var cmdPause = &cobra.Command{
+		Use:   "pause name",
+		Short: "Pause a running datasource",
+		Long: `Stop reading from a running datasource until it is resumed, without restarting crowdsec.
+Datasources reading at their own pace (ie. file, journalctl) resume where they were paused. Push datasources (ie. syslog) can't hold what is sent to them while they are paused.
+A paused datasource starts again when crowdsec restarts or reloads its acquisition file.
+The name is the one of the datasource in the acquisition file, or <acquisition file>:<position> if it has none (see cscli metrics).
+Datasources can only be paused if acquisition_control_socket is set in the crowdsec_service configuration, cscli must run as the same user as crowdsec.`,
+		Example:           `cscli acquisition pause nginx`,
+		Args:              cobra.ExactArgs(1),
+		DisableAutoGenTag: true,
+		Run: func(cmd *cobra.Command, args []string) {
+			changed, err := controlDatasource("pause", args[0])
+			if err != nil {
+				log.Fatalf("unable to pause %s: %s", args[0], err)
+			}
+			if changed == 0 {
+				log.Infof("%s is already paused", args[0])
+				return
+			}
+			log.Infof("%s paused", args[0])
+		},
+	}
+	cmdAcquisition.AddCommand(cmdPause)
+
+	var cmdResume = &cobra.Command{
+		Use:               "resume name",
+		Short:             "Resume a paused datasource",
+		Example:           `cscli acquisition resume nginx`,
+		Args:              cobra.ExactArgs(1),
+		DisableAutoGenTag: true,
+		Run: func(cmd *cobra.Command, args []string) {
+			changed, err := controlDatasource("resume", args[0])
+			if err != nil {
+				log.Fatalf("unable to resume %s: %s", args[0], err)
+			}
+			if changed == 0 {
+				log.Infof("%s is not paused", args[0])
+				return
+			}
+			log.Infof("%s resumed", args[0])
+		},
+	}
+	cmdAcquisition.AddCommand(cmdResume)
+
+	return cmdAcquisition
+}
+
+// controlClient returns a http client talking to crowdsec on its acquisition control socket
+func controlClient() (*http.Client, error) {
+	if csConfig.Crowdsec == nil || csConfig.Crowdsec.AcquisitionControlSocket == "" {
+		return nil, fmt.Errorf("acquisition_control_socket is not set, crowdsec can't be reached")
+	}
+	socket := csConfig.Crowdsec.AcquisitionControlSocket
+	return &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		},
+	}, nil
+}
+
+// datasourcesHealth returns the status of the running datasources, with their last error
+func datasourcesHealth() ([]acquisition.DataSourceHealth, error) {
+	client, err := controlClient()
+	if err != nil {
+		return nil, err
+	}
+	//the host is not used, the request always goes to the socket
+	resp, err := client.Get("http://crowdsec/acquisition/sources")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status from crowdsec: %s", resp.Status)
+	}
+	ret := []acquisition.DataSourceHealth{}
+	if err := json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+		return nil, fmt.Errorf("invalid response from crowdsec: %s", err)
+	}
+	return ret, nil
+}
+
+// controlDatasource sends action (pause or resume) for the datasource name to crowdsec, on its acquisition control socket
+func controlDatasource(action string, name string) (int, error) {
+	client, err := controlClient()
+	if err != nil {
+		return 0, err
+	}
+	adminURL := fmt.Sprintf("http://crowdsec/acquisition/%s?name=%s", action, url.QueryEscape(name))
+	resp, err := client.Post(adminURL, "application/json", nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%s", strings.TrimSpace(string(body)))
+	}
+	result := map[string]int{}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return 0, fmt.Errorf("invalid response from crowdsec: %s", err)
+	}
+	return result["changed"], nil
+}
+
+func printDryRunResults(results []acquisition.DryRunResult) {
+	firstLine := func(result acquisition.DryRunResult) string {
+		if len(result.Lines) == 0 {
+			return "-"
+		}
+		return result.FirstLine.Round(time.Millisecond).String()
+	}
+	if csConfig.Cscli.Output == "human" {
+		for _, result := range results {
+			for _, line := range result.Lines {
+				labels := []string{}
+				for k, v := range line.Labels {
+					labels = append(labels, k+":"+v)
+				}
+				sort.Strings(labels)
+				fmt.Printf("%s | %s | %s | %s\n", result.Name, line.Src, strings.Join(labels, ","), line.Raw)
+			}
+		}
+		table := tablewriter.NewWriter(os.Stdout)
+		table.SetCenterSeparator("")
+		table.SetColumnSeparator("")
+
+		table.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
+		table.SetAlignment(tablewriter.ALIGN_LEFT)
+		table.SetHeader([]string{"Name", "Datasource", "Mode", "State", "Lines", "First line", "Error"})
+		for _, result := range results {
+			table.Append([]string{result.Name, result.Datasource, result.Mode, result.State, fmt.Sprintf("%d", len(result.Lines)), firstLine(result), result.Error})
+		}
+		table.Render()
+	} else if csConfig.Cscli.Output == "json" {
+		x, err := json.MarshalIndent(results, "", " ")
+		if err != nil {
+			log.Fatalf("failed to marshal results: %s", err)
+		}
+		fmt.Printf("%s", string(x))
+	} else if csConfig.Cscli.Output == "raw" {
+		csvwriter := csv.NewWriter(os.Stdout)
+		err := csvwriter.Write([]string{"name", "datasource", "mode", "state", "lines", "first_line", "error"})
+		if err != nil {
+			log.Fatalf("failed to write raw header: %s", err)
+		}
+		for _, result := range results {
+			err := csvwriter.Write([]string{result.Name, result.Datasource, result.Mode, result.State, fmt.Sprintf("%d", len(result.Lines)), firstLine(result), result.Error})
+			if err != nil {
+				log.Fatalf("failed to write raw: %s", err)
+			}
+		}
+		csvwriter.Flush()
+	}
+}
@@ -11,9 +11,11 @@ import (
 	"os"
 
 	"github.com/crowdsecurity/crowdsec/pkg/apiclient"
+	"github.com/crowdsecurity/crowdsec/pkg/apiserver"
 	"github.com/crowdsecurity/crowdsec/pkg/csconfig"
 	"github.com/crowdsecurity/crowdsec/pkg/cwhub"
 	"github.com/crowdsecurity/crowdsec/pkg/cwversion"
+	"github.com/crowdsecurity/crowdsec/pkg/database"
 	"github.com/crowdsecurity/crowdsec/pkg/types"
 	"github.com/enescakir/emoji"
 	"github.com/go-openapi/strfmt"
@@ -134,11 +136,11 @@ After running this command your will need to validate the enrollment in the weba
 		Example: "enable tainted",
 		Long: `
 Enable given information push to the central API. Allows to empower the console`,
-		ValidArgs:         csconfig.CONSOLE_CONFIGS,
+		ValidArgs:         append(csconfig.CONSOLE_CONFIGS, csconfig.METRICS_CONFIGS...),
 		DisableAutoGenTag: true,
 		Run: func(cmd *cobra.Command, args []string) {
 			if enableAll {
-				SetConsoleOpts(csconfig.CONSOLE_CONFIGS, true)
+				SetConsoleOpts(append(csconfig.CONSOLE_CONFIGS, csconfig.METRICS_CONFIGS...), true)
 				log.Infof("All features have been enabled successfully")
 			} else {
 				if len(args) == 0 {
@@ -162,12 +164,12 @@ Enable given information push to the central API. Allows to empower the console`
 		Example: "disable tainted",
 		Long: `
 Disable given information push to the central API.`,
-		ValidArgs:         csconfig.CONSOLE_CONFIGS,
+		ValidArgs:         append(csconfig.CONSOLE_CONFIGS, csconfig.METRICS_CONFIGS...),
 		Args:              cobra.MinimumNArgs(1),
 		DisableAutoGenTag: true,
 		Run: func(cmd *cobra.Command, args []string) {
 			if disableAll {
-				SetConsoleOpts(csconfig.CONSOLE_CONFIGS, false)
+				SetConsoleOpts(append(csconfig.CONSOLE_CONFIGS, csconfig.METRICS_CONFIGS...), false)
 			} else {
 				SetConsoleOpts(args, false)
 			}
@@ -199,7 +201,7 @@ Disable given information push to the central API.`,
 				table.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
 				table.SetAlignment(tablewriter.ALIGN_LEFT)
 				table.SetHeader([]string{"Option Name", "Activated", "Description"})
-				for _, option := range csconfig.CONSOLE_CONFIGS {
+				for _, option := range append(csconfig.CONSOLE_CONFIGS, csconfig.METRICS_CONFIGS...) {
 					switch option {
 					case csconfig.SEND_CUSTOM_SCENARIOS:
 						activated := string(emoji.CrossMark)
@@ -219,6 +221,18 @@ Disable given information push to the central API.`,
 							activated = string(emoji.CheckMarkButton)
 						}
 						table.Append([]string{option, activated, "Send alerts from tainted scenarios to the console"})
+					case csconfig.SEND_MACHINES_METRICS:
+						activated := string(emoji.CrossMark)
+						if *csConfig.API.Server.ConsoleConfig.ShareMachinesMetrics {
+							activated = string(emoji.CheckMarkButton)
+						}
+						table.Append([]string{option, activated, "Send machines name and version in usage metrics"})
+					case csconfig.SEND_BOUNCERS_METRICS:
+						activated := string(emoji.CrossMark)
+						if *csConfig.API.Server.ConsoleConfig.ShareBouncersMetrics {
+							activated = string(emoji.CheckMarkButton)
+						}
+						table.Append([]string{option, activated, "Send bouncers name, type and version in usage metrics"})
 					}
 				}
 				table.Render()
@@ -239,6 +253,8 @@ Disable given information push to the central API.`,
 					{"share_manual_decisions", fmt.Sprintf("%t", *csConfig.API.Server.ConsoleConfig.ShareManualDecisions)},
 					{"share_custom", fmt.Sprintf("%t", *csConfig.API.Server.ConsoleConfig.ShareCustomScenarios)},
 					{"share_tainted", fmt.Sprintf("%t", *csConfig.API.Server.ConsoleConfig.ShareTaintedScenarios)},
+					{"share_machines_metrics", fmt.Sprintf("%t", *csConfig.API.Server.ConsoleConfig.ShareMachinesMetrics)},
+					{"share_bouncers_metrics", fmt.Sprintf("%t", *csConfig.API.Server.ConsoleConfig.ShareBouncersMetrics)},
 				}
 				for _, row := range rows {
 					err = csvwriter.Write(row)
@@ -252,6 +268,35 @@ Disable given information push to the central API.`,
 	}
 
 	cmdConsole.AddCommand(cmdConsoleStatus)
+
+	cmdConsoleMetrics := &cobra.Command{
+		Use:               "metrics",
+		Short:             "Shows the usage metrics payload that is sent to the central API",
+		Example:           "metrics",
+		Args:              cobra.ExactArgs(0),
+		DisableAutoGenTag: true,
+		Run: func(cmd *cobra.Command, args []string) {
+			var err error
+			if err := csConfig.LoadDBConfig(); err != nil {
+				log.Fatalf(err.Error())
+			}
+			dbClient, err = database.NewClient(csConfig.DbConfig)
+			if err != nil {
+				log.Fatalf("unable to create new database client: %s", err)
+			}
+			metrics, err := apiserver.BuildMetrics(dbClient, csConfig.API.Server.ConsoleConfig)
+			if err != nil {
+				log.Fatalf("unable to build metrics: %s", err)
+			}
+			data, err := json.MarshalIndent(metrics, "", "  ")
+			if err != nil {
+				log.Fatalf("failed to marshal metrics: %s", err)
+			}
+			fmt.Printf("%s\n", string(data))
+		},
+	}
+
+	cmdConsole.AddCommand(cmdConsoleMetrics)
 	return cmdConsole
 }
 
@@ -297,6 +342,32 @@ func SetConsoleOpts(args []string, wanted bool) {
 				log.Infof("%s set to %t", csconfig.SEND_MANUAL_SCENARIOS, wanted)
 				csConfig.API.Server.ConsoleConfig.ShareManualDecisions = types.BoolPtr(wanted)
 			}
+		case csconfig.SEND_MACHINES_METRICS:
+			/*for each flag check if it's already set before setting it*/
+			if csConfig.API.Server.ConsoleConfig.ShareMachinesMetrics != nil {
+				if *csConfig.API.Server.ConsoleConfig.ShareMachinesMetrics == wanted {
+					log.Infof("%s already set to %t", csconfig.SEND_MACHINES_METRICS, wanted)
+				} else {
+					log.Infof("%s set to %t", csconfig.SEND_MACHINES_METRICS, wanted)
+					*csConfig.API.Server.ConsoleConfig.ShareMachinesMetrics = wanted
+				}
+			} else {
+				log.Infof("%s set to %t", csconfig.SEND_MACHINES_METRICS, wanted)
+				csConfig.API.Server.ConsoleConfig.ShareMachinesMetrics = types.BoolPtr(wanted)
+			}
+		case csconfig.SEND_BOUNCERS_METRICS:
+			/*for each flag check if it's already set before setting it*/
+			if csConfig.API.Server.ConsoleConfig.ShareBouncersMetrics != nil {
+				if *csConfig.API.Server.ConsoleConfig.ShareBouncersMetrics == wanted {
+					log.Infof("%s already set to %t", csconfig.SEND_BOUNCERS_METRICS, wanted)
+				} else {
+					log.Infof("%s set to %t", csconfig.SEND_BOUNCERS_METRICS, wanted)
+					*csConfig.API.Server.ConsoleConfig.ShareBouncersMetrics = wanted
+				}
+			} else {
+				log.Infof("%s set to %t", csconfig.SEND_BOUNCERS_METRICS, wanted)
+				csConfig.API.Server.ConsoleConfig.ShareBouncersMetrics = types.BoolPtr(wanted)
+			}
 		default:
 			log.Fatalf("unknown flag %s", arg)
 		}
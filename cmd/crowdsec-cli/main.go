@@ -187,6 +187,7 @@ It is meant to allow you to manage bans, parsers/scenarios/etc, api and generall
 	rootCmd.AddCommand(NewExplainCmd())
 	rootCmd.AddCommand(NewHubTestCmd())
 	rootCmd.AddCommand(NewNotificationsCmd())
+	rootCmd.AddCommand(NewAcquisitionCmd())
 
 	if err := rootCmd.Execute(); err != nil {
 		if bincoverTesting != "" {
@@ -88,6 +88,18 @@ func metricsToTable(table *tablewriter.Table, stats map[string]map[string]int, k
 	return nil
 }
 
+type datasourceHealth struct {
+	State     string    `json:"state" yaml:"state"`
+	LastEvent time.Time `json:"last_event" yaml:"last_event"`
+	Error     string    `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+type datasourceVolume struct {
+	Lines           int     `json:"lines" yaml:"lines"`
+	Bytes           int64   `json:"bytes" yaml:"bytes"`
+	EventsPerSecond float64 `json:"events_per_second" yaml:"events_per_second"`
+}
+
 /*This is a complete rip from prom2json*/
 func ShowPrometheus(url string) {
 	mfChan := make(chan *dto.MetricFamily, 1024)
@@ -119,6 +131,8 @@ func ShowPrometheus(url string) {
 		Empty    int
 	}{}
 	acquis_stats := map[string]map[string]int{}
+	acquis_health_stats := map[string]datasourceHealth{}
+	acquis_volume_stats := map[string]datasourceVolume{}
 	parsers_stats := map[string]map[string]int{}
 	buckets_stats := map[string]map[string]int{}
 	lapi_stats := map[string]map[string]int{}
@@ -254,12 +268,69 @@ func ShowPrometheus(url string) {
 					x.NonEmpty += ival
 				}
 				lapi_decisions_stats[bouncer] = x
+				/*acquis health*/
+			case "cs_acquisition_datasource_status":
+				//only the current state is set
+				if ival != 1 {
+					continue
+				}
+				key := metric.Labels["datasource"] + ":" + name
+				x := acquis_health_stats[key]
+				x.State = metric.Labels["state"]
+				acquis_health_stats[key] = x
+			case "cs_acquisition_datasource_last_event_timestamp":
+				key := metric.Labels["datasource"] + ":" + name
+				//parse again, float32 is not precise enough for a timestamp
+				ts, err := strconv.ParseFloat(value, 64)
+				if err != nil {
+					log.Errorf("Unexpected timestamp value %s : %s", value, err)
+					continue
+				}
+				x := acquis_health_stats[key]
+				x.LastEvent = time.Unix(int64(ts), 0)
+				acquis_health_stats[key] = x
+				/*acquis volume*/
+			case "cs_acquisition_lines_read_total":
+				key := metric.Labels["datasource"] + ":" + name
+				x := acquis_volume_stats[key]
+				x.Lines += ival
+				acquis_volume_stats[key] = x
+			case "cs_acquisition_bytes_read_total":
+				key := metric.Labels["datasource"] + ":" + name
+				//parse again, float32 is not precise enough for large volumes
+				bytes, err := strconv.ParseFloat(value, 64)
+				if err != nil {
+					log.Errorf("Unexpected bytes value %s : %s", value, err)
+					continue
+				}
+				x := acquis_volume_stats[key]
+				x.Bytes += int64(bytes)
+				acquis_volume_stats[key] = x
+			case "cs_acquisition_events_per_second":
+				key := metric.Labels["datasource"] + ":" + name
+				x := acquis_volume_stats[key]
+				x.EventsPerSecond += fval
+				acquis_volume_stats[key] = x
 			default:
 				continue
 			}
 
 		}
 	}
+	//the errors are not in the metrics, they are only available on the acquisition control socket
+	if len(acquis_health_stats) > 0 && csConfig.Crowdsec != nil && csConfig.Crowdsec.AcquisitionControlSocket != "" {
+		sources, err := datasourcesHealth()
+		if err != nil {
+			log.Warningf("unable to get the errors of the datasources : %s", err)
+		}
+		for _, source := range sources {
+			key := source.Datasource + ":" + source.Name
+			if x, ok := acquis_health_stats[key]; ok {
+				x.Error = source.Error
+				acquis_health_stats[key] = x
+			}
+		}
+	}
 	if csConfig.Cscli.Output == "human" {
 
 		acquisTable := tablewriter.NewWriter(os.Stdout)
@@ -268,6 +339,40 @@ func ShowPrometheus(url string) {
 		if err := metricsToTable(acquisTable, acquis_stats, keys); err != nil {
 			log.Warningf("while collecting acquis stats : %s", err)
 		}
+		acquisHealthTable := tablewriter.NewWriter(os.Stdout)
+		acquisHealthTable.SetHeader([]string{"Source", "State", "Last event", "Error"})
+		sortedKeys := []string{}
+		for akey := range acquis_health_stats {
+			sortedKeys = append(sortedKeys, akey)
+		}
+		sort.Strings(sortedKeys)
+		for _, source := range sortedKeys {
+			health := acquis_health_stats[source]
+			lastEvent := "-"
+			if !health.LastEvent.IsZero() {
+				lastEvent = fmt.Sprintf("%s ago", time.Since(health.LastEvent).Round(time.Second))
+			}
+			errDetails := "-"
+			if health.Error != "" {
+				errDetails = health.Error
+			}
+			acquisHealthTable.Append([]string{source, health.State, lastEvent, errDetails})
+		}
+		acquisVolumeTable := tablewriter.NewWriter(os.Stdout)
+		acquisVolumeTable.SetHeader([]string{"Source", "Lines read", "Bytes read", "Avg line size", "Events/s"})
+		sortedKeys = []string{}
+		for akey := range acquis_volume_stats {
+			sortedKeys = append(sortedKeys, akey)
+		}
+		sort.Strings(sortedKeys)
+		for _, source := range sortedKeys {
+			volume := acquis_volume_stats[source]
+			avgSize := "-"
+			if volume.Lines > 0 {
+				avgSize = fmt.Sprintf("%d", volume.Bytes/int64(volume.Lines))
+			}
+			acquisVolumeTable.Append([]string{source, fmt.Sprintf("%d", volume.Lines), fmt.Sprintf("%d", volume.Bytes), avgSize, fmt.Sprintf("%.2f", volume.EventsPerSecond)})
+		}
 		bucketsTable := tablewriter.NewWriter(os.Stdout)
 		bucketsTable.SetHeader([]string{"Bucket", "Current Count", "Overflows", "Instantiated", "Poured", "Expired"})
 		keys = []string{"curr_count", "overflow", "instanciation", "pour", "underflow"}
@@ -308,7 +413,7 @@ func ShowPrometheus(url string) {
 		/*unfortunately, we can't reuse metricsToTable as the structure is too different :/*/
 		lapiTable := tablewriter.NewWriter(os.Stdout)
 		lapiTable.SetHeader([]string{"Route", "Method", "Hits"})
-		sortedKeys := []string{}
+		sortedKeys = []string{}
 		for akey := range lapi_stats {
 			sortedKeys = append(sortedKeys, akey)
 		}
@@ -339,6 +444,16 @@ func ShowPrometheus(url string) {
 			acquisTable.SetAlignment(tablewriter.ALIGN_LEFT)
 			acquisTable.Render()
 		}
+		if acquisHealthTable.NumLines() > 0 {
+			log.Printf("Acquisition Health:")
+			acquisHealthTable.SetAlignment(tablewriter.ALIGN_LEFT)
+			acquisHealthTable.Render()
+		}
+		if acquisVolumeTable.NumLines() > 0 {
+			log.Printf("Acquisition Volume:")
+			acquisVolumeTable.SetAlignment(tablewriter.ALIGN_LEFT)
+			acquisVolumeTable.Render()
+		}
 		if parsersTable.NumLines() > 0 {
 			log.Printf("Parser Metrics:")
 			parsersTable.SetAlignment(tablewriter.ALIGN_LEFT)
@@ -367,7 +482,7 @@ func ShowPrometheus(url string) {
 		}
 
 	} else if csConfig.Cscli.Output == "json" {
-		for _, val := range []interface{}{acquis_stats, parsers_stats, buckets_stats, lapi_stats, lapi_bouncer_stats, lapi_machine_stats, lapi_decisions_stats} {
+		for _, val := range []interface{}{acquis_stats, acquis_health_stats, acquis_volume_stats, parsers_stats, buckets_stats, lapi_stats, lapi_bouncer_stats, lapi_machine_stats, lapi_decisions_stats} {
 			x, err := json.MarshalIndent(val, "", " ")
 			if err != nil {
 				log.Fatalf("failed to unmarshal metrics : %v", err)
@@ -375,7 +490,7 @@ func ShowPrometheus(url string) {
 			fmt.Printf("%s\n", string(x))
 		}
 	} else if csConfig.Cscli.Output == "raw" {
-		for _, val := range []interface{}{acquis_stats, parsers_stats, buckets_stats, lapi_stats, lapi_bouncer_stats, lapi_machine_stats, lapi_decisions_stats} {
+		for _, val := range []interface{}{acquis_stats, acquis_health_stats, acquis_volume_stats, parsers_stats, buckets_stats, lapi_stats, lapi_bouncer_stats, lapi_machine_stats, lapi_decisions_stats} {
 			x, err := yaml.Marshal(val)
 			if err != nil {
 				log.Fatalf("failed to unmarshal metrics : %v", err)
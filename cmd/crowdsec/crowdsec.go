@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"sync"
+	"sync/atomic"
 
 	"path/filepath"
 
@@ -19,6 +20,9 @@ import (
 	"gopkg.in/yaml.v2"
 )
 
+// parserShardBufferSize is the number of events that can wait for a given parser routine when sharding by source
+const parserShardBufferSize = 128
+
 func initCrowdsec(cConfig *csconfig.Config) (*parser.Parsers, error) {
 	err := exprhelpers.Init()
 	if err != nil {
@@ -43,21 +47,60 @@ func initCrowdsec(cConfig *csconfig.Config) (*parser.Parsers, error) {
 	if err := LoadAcquisition(cConfig); err != nil {
 		return &parser.Parsers{}, fmt.Errorf("Error while loading acquisition config : %s", err)
 	}
+	checkParserRouting(csParsers)
+
+	if err := LoadDeadLetterQueue(cConfig); err != nil {
+		return &parser.Parsers{}, fmt.Errorf("Error while loading dead letter queue : %s", err)
+	}
 	return csParsers, nil
 }
 
+// checkParserRouting warns about the datasources routed to parsers that are not installed, their events would go through
+// all the parsers of the stage
+func checkParserRouting(parsers *parser.Parsers) {
+	installed := make(map[string]bool)
+	for _, node := range parsers.Nodes {
+		installed[node.Name] = true
+	}
+	for _, source := range dataSources {
+		for _, name := range acquisition.GetParserRouting(source.GetUuid()) {
+			if !installed[name] {
+				log.Warningf("%s datasource is routed to parser %s, which is not installed", source.GetName(), name)
+			}
+		}
+	}
+}
+
 func runCrowdsec(cConfig *csconfig.Config, parsers *parser.Parsers) error {
 	inputLineChan := make(chan types.Event)
 	inputEventChan := make(chan types.Event)
 
+	//events left by a previous pipeline that didn't drain are lost
+	atomic.StoreInt64(&pendingEvents, 0)
 	//start go-routines for parsing, buckets pour and outputs.
 	parserWg := &sync.WaitGroup{}
 	parsersTomb.Go(func() error {
 		parserWg.Add(1)
+		var shards []chan types.Event
+		if cConfig.Crowdsec.ParserSharding {
+			log.Infof("dispatching events to %d parser routines by source", cConfig.Crowdsec.ParserRoutinesCount)
+			shards = make([]chan types.Event, cConfig.Crowdsec.ParserRoutinesCount)
+			for i := range shards {
+				shards[i] = make(chan types.Event, parserShardBufferSize)
+			}
+			parsersTomb.Go(func() error {
+				defer types.CatchPanic("crowdsec/dispatchParse")
+				return dispatchParse(inputLineChan, shards)
+			})
+		}
 		for i := 0; i < cConfig.Crowdsec.ParserRoutinesCount; i++ {
+			input := inputLineChan
+			if shards != nil {
+				input = shards[i]
+			}
 			parsersTomb.Go(func() error {
 				defer types.CatchPanic("crowdsec/runParse")
-				if err := runParse(inputLineChan, inputEventChan, *parsers.Ctx, parsers.Nodes); err != nil { //this error will never happen as parser.Parse is not able to return errors
+				if err := runParse(input, inputEventChan, *parsers.Ctx, parsers.Nodes, shards != nil); err != nil { //this error will never happen as parser.Parse is not able to return errors
 					log.Fatalf("starting parse error : %s", err)
 					return err
 				}
@@ -123,8 +166,35 @@ func runCrowdsec(cConfig *csconfig.Config, parsers *parser.Parsers) error {
 		}
 
 	}
+	acquisition.SetPauseControl(false)
+	if cConfig.Crowdsec.AcquisitionControlSocket != "" && flags.OneShotDSN == "" {
+		var err error
+		acquisControl, err = acquisition.ListenControl(cConfig.Crowdsec.AcquisitionControlSocket)
+		if err != nil {
+			return errors.Wrap(err, "while listening for acquisition control")
+		}
+		acquisition.SetPauseControl(true)
+		log.Infof("datasources can be paused on %s", cConfig.Crowdsec.AcquisitionControlSocket)
+	}
 	log.Warningf("Starting processing data")
 
+	acquisWatcher = nil
+	if cConfig.Crowdsec.AcquisitionHotReload && flags.OneShotDSN == "" {
+		var err error
+		acquisWatcher, err = acquisition.NewAcquisitionWatcher(cConfig.Crowdsec, dataSources)
+		if err != nil {
+			return errors.Wrap(err, "while setting up acquisition hot reload")
+		}
+		if cConfig.Prometheus != nil && cConfig.Prometheus.Enabled {
+			acquisWatcher.EnableMetrics(cConfig.Prometheus.Level == "aggregated")
+		}
+		if err := acquisWatcher.Run(inputLineChan, &acquisTomb); err != nil {
+			log.Fatalf("starting acquisition error : %s", err)
+			return err
+		}
+		return nil
+	}
+
 	if err := acquisition.StartAcquisition(dataSources, inputLineChan, &acquisTomb); err != nil {
 		log.Fatalf("starting acquisition error : %s", err)
 		return err
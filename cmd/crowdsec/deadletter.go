@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/csconfig"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// deadLetters captures the lines that exit the parsers unparsed, nil if disabled
+var deadLetters *deadLetterQueue
+
+type deadLetter struct {
+	Time   time.Time         `json:"time"`
+	Source string            `json:"source"`
+	Module string            `json:"module"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Raw    string            `json:"raw"`
+}
+
+// how many dead letters can wait to be written, the next ones are dropped rather than slowing the parsers down
+const deadLetterQueueSize = 1024
+
+// deadLetterQueue writes the unparsed lines as json, one per line, to a rotated file. The parsers only queue them,
+// they are written by a dedicated routine
+type deadLetterQueue struct {
+	writer  io.WriteCloser
+	types   map[string]bool
+	letters chan deadLetter
+	done    chan struct{} //closed once the queued letters are written
+}
+
+func newDeadLetterQueue(config *csconfig.DeadLetterQueueCfg) (*deadLetterQueue, error) {
+	//create the file beforehand with restricted permissions, cf. https://github.com/natefinch/lumberjack/issues/82
+	if _, err := os.Stat(config.Path); os.IsNotExist(err) {
+		file, err := os.OpenFile(config.Path, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, errors.Wrapf(err, "while creating dead letter queue %s", config.Path)
+		}
+		file.Close()
+	}
+	writer := &lumberjack.Logger{
+		Filename:   config.Path,
+		MaxSize:    config.MaxSize,
+		MaxBackups: config.MaxFiles,
+	}
+	return startDeadLetterQueue(writer, config.Types), nil
+}
+
+func startDeadLetterQueue(writer io.WriteCloser, logTypes []string) *deadLetterQueue {
+	d := &deadLetterQueue{
+		writer:  writer,
+		letters: make(chan deadLetter, deadLetterQueueSize),
+		done:    make(chan struct{}),
+	}
+	if len(logTypes) > 0 {
+		d.types = make(map[string]bool, len(logTypes))
+		for _, logType := range logTypes {
+			d.types[logType] = true
+		}
+	}
+	go d.run()
+	return d
+}
+
+func LoadDeadLetterQueue(cConfig *csconfig.Config) error {
+	var err error
+
+	if cConfig.Crowdsec.DeadLetterQueue == nil || !cConfig.Crowdsec.DeadLetterQueue.Enabled {
+		deadLetters = nil
+		return nil
+	}
+	deadLetters, err = newDeadLetterQueue(cConfig.Crowdsec.DeadLetterQueue)
+	if err != nil {
+		return err
+	}
+	log.Infof("unparsed lines will be written to %s", cConfig.Crowdsec.DeadLetterQueue.Path)
+	return nil
+}
+
+// push queues the line of an unparsed event, it never blocks
+func (d *deadLetterQueue) push(evt types.Event) {
+	if d.types != nil && !d.types[evt.Line.Labels["type"]] {
+		return
+	}
+	letter := deadLetter{
+		Time:   evt.Line.Time,
+		Source: evt.Line.Src,
+		Module: evt.Line.Module,
+		Labels: evt.Line.Labels,
+		Raw:    evt.Line.Raw,
+	}
+	select {
+	case d.letters <- letter:
+	default:
+		globalParserDeadLettersDropped.WithLabelValues(evt.Line.Src, evt.Line.Module).Inc()
+	}
+}
+
+func (d *deadLetterQueue) run() {
+	defer types.CatchPanic("crowdsec/deadLetterQueue")
+	defer close(d.done)
+	for letter := range d.letters {
+		content, err := json.Marshal(letter)
+		if err != nil {
+			log.Errorf("unable to marshal dead letter : %s", err)
+			continue
+		}
+		//a single Write keeps the line whole when the file is rotated
+		if _, err := d.writer.Write(append(content, '\n')); err != nil {
+			log.Errorf("unable to write dead letter : %s", err)
+			continue
+		}
+		globalParserDeadLetters.WithLabelValues(letter.Source, letter.Module).Inc()
+	}
+}
+
+// Close writes the queued letters and closes the file. Nothing can be pushed afterwards
+func (d *deadLetterQueue) Close() error {
+	close(d.letters)
+	<-d.done
+	return d.writer.Close()
+}
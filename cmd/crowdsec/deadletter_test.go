@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/csconfig"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func unparsedEvent(src string, logType string, raw string) types.Event {
+	return types.Event{Line: types.Line{
+		Src:    src,
+		Module: "file",
+		Labels: map[string]string{"type": logType},
+		Raw:    raw,
+		Time:   time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC),
+	}}
+}
+
+func TestDeadLetterQueue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "unparsed.log")
+	d, err := newDeadLetterQueue(&csconfig.DeadLetterQueueCfg{
+		Enabled: true,
+		Path:    path,
+		Types:   []string{"nginx"},
+	})
+	require.NoError(t, err)
+	d.push(unparsedEvent("/var/log/nginx/access.log", "nginx", "first"))
+	d.push(unparsedEvent("/var/log/auth.log", "syslog", "not a nginx line"))
+	d.push(unparsedEvent("/var/log/nginx/access.log", "nginx", "second"))
+	require.NoError(t, d.Close())
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	require.Len(t, lines, 2)
+	for i, raw := range []string{"first", "second"} {
+		letter := deadLetter{}
+		require.NoError(t, json.Unmarshal([]byte(lines[i]), &letter))
+		assert.Equal(t, raw, letter.Raw)
+		assert.Equal(t, "/var/log/nginx/access.log", letter.Source)
+		assert.Equal(t, "file", letter.Module)
+		assert.Equal(t, "nginx", letter.Labels["type"])
+	}
+}
+
+func TestDeadLetterQueueRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "unparsed.log")
+	d, err := newDeadLetterQueue(&csconfig.DeadLetterQueueCfg{
+		Enabled:  true,
+		Path:     path,
+		MaxSize:  1,
+		MaxFiles: 1,
+	})
+	require.NoError(t, err)
+	//a bit more than 1MB of letters
+	raw := strings.Repeat("x", 2048)
+	for i := 0; i < 600; i++ {
+		d.push(unparsedEvent("/var/log/app.log", "app", raw))
+	}
+	require.NoError(t, d.Close())
+
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, files, 2)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.True(t, info.Size() < 1024*1024)
+}
+
+// blockingWriter holds the writes until it is released
+type blockingWriter struct {
+	release chan struct{}
+	lock    sync.Mutex
+	buf     bytes.Buffer
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	<-w.release
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.buf.Write(p)
+}
+
+func (w *blockingWriter) Close() error {
+	return nil
+}
+
+func TestDeadLetterQueueFull(t *testing.T) {
+	src := "/var/log/slow-disk.log"
+	writer := &blockingWriter{release: make(chan struct{})}
+	d := startDeadLetterQueue(writer, nil)
+	droppedBefore := testutil.ToFloat64(globalParserDeadLettersDropped.WithLabelValues(src, "file"))
+
+	pushed := deadLetterQueueSize + 10
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < pushed; i++ {
+			d.push(unparsedEvent(src, "syslog", "line"))
+		}
+		close(done)
+	}()
+	//the parsers must not wait for the disk
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("push blocked on a full queue")
+	}
+
+	close(writer.release)
+	require.NoError(t, d.Close())
+	dropped := int(testutil.ToFloat64(globalParserDeadLettersDropped.WithLabelValues(src, "file")) - droppedBefore)
+	//the queue and the letter held by the writer are kept, the rest is dropped
+	assert.True(t, dropped >= 9 && dropped <= 10, "dropped %d letters", dropped)
+	assert.Equal(t, pushed-dropped, strings.Count(writer.buf.String(), "\n"))
+}
@@ -3,14 +3,17 @@ package main
 import (
 	"flag"
 	"fmt"
+	"net"
 	"os"
 	"sort"
 	"strings"
 
-	_ "net/http/pprof"
 	"time"
 
 	"github.com/crowdsecurity/crowdsec/pkg/acquisition"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/cursors"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/limits"
+	pluginacquisition "github.com/crowdsecurity/crowdsec/pkg/acquisition/modules/plugin"
 	"github.com/crowdsecurity/crowdsec/pkg/csconfig"
 	"github.com/crowdsecurity/crowdsec/pkg/csplugin"
 	"github.com/crowdsecurity/crowdsec/pkg/cwhub"
@@ -39,7 +42,10 @@ var (
 	flags *Flags
 
 	/*the state of acquisition*/
-	dataSources []acquisition.DataSource
+	dataSources   []acquisition.DataSource
+	acquisWatcher *acquisition.AcquisitionWatcher //set when acquisition files are hot reloaded
+	acquisControl net.Listener                    //set when the datasources can be paused
+	cursorsStore  *cursors.FileStore
 	/*the state of the buckets*/
 	holders         []leaky.BucketFactory
 	buckets         *leaky.Buckets
@@ -60,6 +66,7 @@ type Flags struct {
 	SingleFileType string
 	Labels         map[string]string
 	OneShotDSN     string
+	ReplaySpeed    string
 	TestMode       bool
 	DisableAgent   bool
 	DisableAPI     bool
@@ -150,10 +157,33 @@ func LoadAcquisition(cConfig *csconfig.Config) error {
 			return errors.Wrapf(err, "failed to configure datasource for %s", flags.OneShotDSN)
 		}
 	} else {
+		//datasource plugins are looked for when their configuration is loaded
+		pluginacquisition.SetPluginConfig(cConfig.ConfigPaths.PluginDir, cConfig.PluginConfig)
 		dataSources, err = acquisition.LoadAcquisitionFromFile(cConfig.Crowdsec)
 		if err != nil {
 			return errors.Wrap(err, "while loading acquisition configuration")
 		}
+		if cConfig.Crowdsec.AcquisitionCursorsPath != "" {
+			cursorsStore, err = cursors.NewFileStore(cConfig.Crowdsec.AcquisitionCursorsPath)
+			if err != nil {
+				return errors.Wrap(err, "while loading acquisition cursors")
+			}
+			cursors.SetStore(cursorsStore)
+		}
+	}
+	if limitsCfg := cConfig.Crowdsec.AcquisitionLimits; limitsCfg != nil {
+		quantum := limits.DefaultTailerQuantum
+		if limitsCfg.TailerQuantum != nil {
+			quantum = *limitsCfg.TailerQuantum
+		}
+		limits.SetMaxTailers(limitsCfg.MaxActiveTailers, quantum)
+		limits.SetMaxReadRate(limitsCfg.MaxReadRate, limitsCfg.ReadBurst)
+		if limitsCfg.MaxActiveTailers > 0 {
+			log.Infof("at most %d files or containers are read at the same time (quantum: %s)", limitsCfg.MaxActiveTailers, quantum)
+		}
+		if limitsCfg.MaxReadRate > 0 {
+			log.Infof("datasources read at most %v lines per second together", limitsCfg.MaxReadRate)
+		}
 	}
 
 	return nil
@@ -186,6 +216,7 @@ func (f *Flags) Parse() {
 	flag.StringVar(&f.OneShotDSN, "dsn", "", "Process a single data source in time-machine")
 	flag.StringVar(&f.SingleFileType, "type", "", "Labels.type for file in time-machine")
 	flag.Var(&labels, "label", "Additional Labels for file in time-machine")
+	flag.StringVar(&f.ReplaySpeed, "speed", "unlimited", "Speed of the time-machine replay : realtime, <N>x (eg. 10x) or unlimited")
 	flag.BoolVar(&f.TestMode, "t", false, "only test configs")
 	flag.BoolVar(&f.DisableAgent, "no-cs", false, "disable crowdsec agent")
 	flag.BoolVar(&f.DisableAPI, "no-api", false, "disable local API")
@@ -216,6 +247,10 @@ func LoadConfig(cConfig *csconfig.Config) error {
 		}
 	}
 
+	if err := cConfig.LoadPrometheus(); err != nil {
+		return err
+	}
+
 	if !cConfig.DisableAgent && (cConfig.API == nil || cConfig.API.Client == nil || cConfig.API.Client.Credentials == nil) {
 		log.Fatalf("missing local API credentials for crowdsec agent, abort")
 	}
@@ -253,6 +288,12 @@ func LoadConfig(cConfig *csconfig.Config) error {
 		log.Infof("single file mode : log_media=%s daemonize=%t", cConfig.Common.LogMedia, cConfig.Common.Daemonize)
 	}
 
+	speed, err := parseReplaySpeed(flags.ReplaySpeed)
+	if err != nil {
+		return err
+	}
+	replay = newReplayPacer(speed)
+
 	if cConfig.Common.PidDir != "" {
 		log.Warn("Deprecation warning: the pid_dir config can be safely removed and is not required")
 	}
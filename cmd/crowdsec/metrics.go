@@ -40,6 +40,37 @@ var globalParserHitsKo = prometheus.NewCounterVec(
 	[]string{"source", "type"},
 )
 
+var globalParserDeadLetters = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cs_parser_dead_letters_total",
+		Help: "Total unparsed events written to the dead letter queue.",
+	},
+	[]string{"source", "type"},
+)
+
+var globalParserDeadLettersDropped = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cs_parser_dead_letters_dropped_total",
+		Help: "Total unparsed events not written to the dead letter queue because it was full.",
+	},
+	[]string{"source", "type"},
+)
+
+var globalParserWorkerHits = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cs_parser_worker_hits_total",
+		Help: "Total events dispatched to each parser routine.",
+	},
+	[]string{"worker"},
+)
+var globalParserWorkerQueue = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "cs_parser_worker_queue_size",
+		Help: "Number of events waiting to be parsed by each parser routine.",
+	},
+	[]string{"worker"},
+)
+
 var globalBucketPourKo = prometheus.NewCounter(
 	prometheus.CounterOpts{
 		Name: "cs_bucket_pour_ko_total",
@@ -62,6 +93,17 @@ var globalCsInfo = prometheus.NewGauge(
 	},
 )
 
+// newMetricsMux returns the handlers of the metrics listener. It doesn't use the default mux, which gets the pprof
+// endpoints as soon as net/http/pprof is imported.
+func newMetricsMux(config *csconfig.PrometheusCfg) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	if config.Profiling != nil && config.Profiling.Enabled {
+		registerProfiling(mux, config)
+	}
+	return mux
+}
+
 func registerPrometheus(config *csconfig.PrometheusCfg) {
 	if !config.Enabled {
 		return
@@ -80,22 +122,26 @@ func registerPrometheus(config *csconfig.PrometheusCfg) {
 	/*If in aggregated mode, do not register events associated to a source, keeps cardinality low*/
 	if config.Level == "aggregated" {
 		log.Infof("Loading aggregated prometheus collectors")
-		prometheus.MustRegister(globalParserHits, globalParserHitsOk, globalParserHitsKo,
+		prometheus.MustRegister(globalParserHits, globalParserHitsOk, globalParserHitsKo, globalParserDeadLetters, globalParserDeadLettersDropped,
+			globalParserWorkerHits, globalParserWorkerQueue,
 			globalCsInfo,
 			leaky.BucketsUnderflow, leaky.BucketsCanceled, leaky.BucketsInstanciation, leaky.BucketsOverflow,
 			v1.LapiRouteHits,
 			leaky.BucketsCurrentCount)
 	} else {
 		log.Infof("Loading prometheus collectors")
-		prometheus.MustRegister(globalParserHits, globalParserHitsOk, globalParserHitsKo,
+		prometheus.MustRegister(globalParserHits, globalParserHitsOk, globalParserHitsKo, globalParserDeadLetters, globalParserDeadLettersDropped,
 			parser.NodesHits, parser.NodesHitsOk, parser.NodesHitsKo,
+			globalParserWorkerHits, globalParserWorkerQueue,
 			globalCsInfo,
 			v1.LapiRouteHits, v1.LapiMachineHits, v1.LapiBouncerHits, v1.LapiNilDecisions, v1.LapiNonNilDecisions,
 			leaky.BucketsPour, leaky.BucketsUnderflow, leaky.BucketsCanceled, leaky.BucketsInstanciation, leaky.BucketsOverflow, leaky.BucketsCurrentCount)
 
 	}
-	http.Handle("/metrics", promhttp.Handler())
-	if err := http.ListenAndServe(fmt.Sprintf("%s:%d", config.ListenAddr, config.ListenPort), nil); err != nil {
+	if config.Profiling != nil && config.Profiling.Enabled && config.Profiling.SnapshotDir != "" {
+		go runProfilingSnapshots(config.Profiling)
+	}
+	if err := http.ListenAndServe(fmt.Sprintf("%s:%d", config.ListenAddr, config.ListenPort), newMetricsMux(config)); err != nil {
 		log.Warningf("prometheus: %s", err)
 	}
 }
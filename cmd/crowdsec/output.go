@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/crowdsecurity/crowdsec/pkg/apiclient"
@@ -148,6 +149,8 @@ LOOP:
 			}
 			if event.Overflow.Reprocess {
 				log.Debugf("Overflow being reprocessed.")
+				//it goes through the buckets again
+				atomic.AddInt64(&pendingEvents, 1)
 				input <- event
 			}
 			/* process post overflow parser nodes */
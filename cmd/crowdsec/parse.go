@@ -2,6 +2,9 @@ package main
 
 import (
 	"errors"
+	"hash/fnv"
+	"strconv"
+	"sync/atomic"
 
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
@@ -10,7 +13,9 @@ import (
 	"github.com/crowdsecurity/crowdsec/pkg/types"
 )
 
-func runParse(input chan types.Event, output chan types.Event, parserCTX parser.UnixParserCtx, nodes []parser.Node) error {
+// runParse parses the events of input and sends the ones to pour to output. dispatched is set when input is fed by
+// dispatchParse, which already counted the events as pending
+func runParse(input chan types.Event, output chan types.Event, parserCTX parser.UnixParserCtx, nodes []parser.Node, dispatched bool) error {
 
 LOOP:
 	for {
@@ -19,29 +24,45 @@ LOOP:
 			log.Infof("Killing parser routines")
 			break LOOP
 		case event := <-input:
+			if !dispatched {
+				atomic.AddInt64(&pendingEvents, 1)
+			}
 			if !event.Process {
+				atomic.AddInt64(&pendingEvents, -1)
 				continue
 			}
 			if event.Line.Module == "" {
 				log.Errorf("empty event.Line.Module field, the acquisition module must set it ! : %+v", event.Line)
+				atomic.AddInt64(&pendingEvents, -1)
 				continue
 			}
-			globalParserHits.With(prometheus.Labels{"source": event.Line.Src, "type": event.Line.Module}).Inc()
+			//WithLabelValues avoids building a prometheus.Labels map for every event
+			globalParserHits.WithLabelValues(event.Line.Src, event.Line.Module).Inc()
 
 			/* parse the log using magic */
 			parsed, error := parser.Parse(parserCTX, event, nodes)
 			if error != nil {
 				log.Errorf("failed parsing : %v\n", error)
+				atomic.AddInt64(&pendingEvents, -1)
 				return errors.New("parsing failed :/")
 			}
 			if !parsed.Process {
-				globalParserHitsKo.With(prometheus.Labels{"source": event.Line.Src, "type": event.Line.Module}).Inc()
-				log.Debugf("Discarding line %+v", parsed)
+				globalParserHitsKo.WithLabelValues(event.Line.Src, event.Line.Module).Inc()
+				if deadLetters != nil {
+					deadLetters.push(event)
+				}
+				if log.IsLevelEnabled(log.DebugLevel) {
+					log.Debugf("Discarding line %+v", parsed)
+				}
+				types.ReleaseEvent(&parsed)
+				atomic.AddInt64(&pendingEvents, -1)
 				continue
 			}
-			globalParserHitsOk.With(prometheus.Labels{"source": event.Line.Src, "type": event.Line.Module}).Inc()
+			globalParserHitsOk.WithLabelValues(event.Line.Src, event.Line.Module).Inc()
 			if parsed.Whitelisted {
 				log.Debugf("event whitelisted, discard")
+				types.ReleaseEvent(&parsed)
+				atomic.AddInt64(&pendingEvents, -1)
 				continue
 			}
 			output <- parsed
@@ -49,3 +70,40 @@ LOOP:
 	}
 	return nil
 }
+
+// shardIndex returns the parser routine in charge of the events of a given source
+func shardIndex(src string, count int) int {
+	h := fnv.New32a()
+	h.Write([]byte(src))
+	return int(h.Sum32() % uint32(count))
+}
+
+// dispatchParse spreads events over the parser routines, keyed by source : all the events of a given source
+// are handled by the same routine, in the order they were read
+func dispatchParse(input chan types.Event, shards []chan types.Event) error {
+	//resolve the per-worker metrics once instead of on every event
+	hits := make([]prometheus.Counter, len(shards))
+	queues := make([]prometheus.Gauge, len(shards))
+	for idx := range shards {
+		worker := strconv.Itoa(idx)
+		hits[idx] = globalParserWorkerHits.With(prometheus.Labels{"worker": worker})
+		queues[idx] = globalParserWorkerQueue.With(prometheus.Labels{"worker": worker})
+	}
+	for {
+		select {
+		case <-parsersTomb.Dying():
+			log.Infof("Killing parser dispatcher")
+			return nil
+		case event := <-input:
+			atomic.AddInt64(&pendingEvents, 1)
+			idx := shardIndex(event.Line.Src, len(shards))
+			hits[idx].Inc()
+			select {
+			case shards[idx] <- event:
+			case <-parsersTomb.Dying():
+				return nil
+			}
+			queues[idx].Set(float64(len(shards[idx])))
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/tomb.v2"
+)
+
+func TestShardIndex(t *testing.T) {
+	used := map[int]bool{}
+	for i := 0; i < 100; i++ {
+		src := fmt.Sprintf("/var/log/nginx/access-%d.log", i)
+		idx := shardIndex(src, 4)
+		assert.True(t, idx >= 0 && idx < 4)
+		//a source always goes to the same routine
+		assert.Equal(t, idx, shardIndex(src, 4))
+		used[idx] = true
+	}
+	assert.Len(t, used, 4)
+	assert.Equal(t, 0, shardIndex("/var/log/auth.log", 1))
+}
+
+func queued(shards []chan types.Event) int {
+	ret := 0
+	for _, shard := range shards {
+		ret += len(shard)
+	}
+	return ret
+}
+
+func TestDispatchParse(t *testing.T) {
+	parsersTomb = tomb.Tomb{}
+	input := make(chan types.Event)
+	shards := []chan types.Event{make(chan types.Event, 100), make(chan types.Event, 100), make(chan types.Event, 100)}
+	parsersTomb.Go(func() error {
+		return dispatchParse(input, shards)
+	})
+	sources := []string{"a.log", "b.log", "c.log", "d.log"}
+	for i := 0; i < 25; i++ {
+		for _, src := range sources {
+			input <- types.Event{Line: types.Line{Src: src, Raw: fmt.Sprintf("%d", i)}}
+		}
+	}
+	//the last event may still be on its way to its shard
+	deadline := time.Now().Add(5 * time.Second)
+	for queued(shards) < 100 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	parsersTomb.Kill(nil)
+	require.NoError(t, parsersTomb.Wait())
+
+	//each source is in a single shard, in the order it was read
+	received := map[string][]string{}
+	for idx, shard := range shards {
+		close(shard)
+		for evt := range shard {
+			assert.Equal(t, shardIndex(evt.Line.Src, len(shards)), idx)
+			received[evt.Line.Src] = append(received[evt.Line.Src], evt.Line.Raw)
+		}
+	}
+	for _, src := range sources {
+		require.Len(t, received[src], 25)
+		for i, raw := range received[src] {
+			assert.Equal(t, fmt.Sprintf("%d", i), raw)
+		}
+	}
+}
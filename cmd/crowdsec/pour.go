@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/crowdsecurity/crowdsec/pkg/csconfig"
@@ -22,6 +23,12 @@ func runPour(input chan types.Event, holders []leaky.BucketFactory, buckets *lea
 			return nil
 		case parsed := <-input:
 			count++
+			if replay != nil && parsed.ExpectMode == leaky.TIMEMACHINE && parsed.MarshaledTime != "" {
+				var eventTime time.Time
+				if err := eventTime.UnmarshalText([]byte(parsed.MarshaledTime)); err == nil {
+					replay.wait(eventTime, bucketsTomb.Dying())
+				}
+			}
 			if count%5000 == 0 {
 				log.Infof("%d existing buckets", leaky.LeakyRoutineCount)
 				//when in forensics mode, garbage collect buckets
@@ -33,6 +40,7 @@ func runPour(input chan types.Event, holders []leaky.BucketFactory, buckets *lea
 						} else {
 							log.Warningf("Starting buckets garbage collection ...")
 							if err = leaky.GarbageCollectBuckets(*z, buckets); err != nil {
+								atomic.AddInt64(&pendingEvents, -1)
 								return fmt.Errorf("failed to start bucket GC : %s", err)
 							}
 						}
@@ -43,6 +51,7 @@ func runPour(input chan types.Event, holders []leaky.BucketFactory, buckets *lea
 			poured, err := leaky.PourItemToHolders(parsed, holders, buckets)
 			if err != nil {
 				log.Errorf("bucketify failed for: %v", parsed)
+				atomic.AddInt64(&pendingEvents, -1)
 				return fmt.Errorf("process of event failed : %v", err)
 			}
 			if poured {
@@ -55,6 +64,11 @@ func runPour(input chan types.Event, holders []leaky.BucketFactory, buckets *lea
 					log.Warningf("failed to unmarshal time from event : %s", err)
 				}
 			}
+			//no bucket holds a reference to the event, its maps can be reused
+			if !poured {
+				types.ReleaseEvent(&parsed)
+			}
+			atomic.AddInt64(&pendingEvents, -1)
 		}
 	}
 }
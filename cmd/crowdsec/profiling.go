@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	"runtime"
+	runtimepprof "runtime/pprof"
+	"sort"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/csconfig"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// registerProfiling exposes the pprof (and runtime trace) endpoints on the mux of the metrics listener
+func registerProfiling(mux *http.ServeMux, config *csconfig.PrometheusCfg) {
+	log.Warningf("profiling endpoints are enabled on http://%s:%d/debug/pprof/, they can leak sensitive information and must not be exposed", config.ListenAddr, config.ListenPort)
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+// isUnderHighLoad tells if the process exceeds one of the configured thresholds
+func isUnderHighLoad(config *csconfig.ProfilingCfg) (bool, string) {
+	goroutines := runtime.NumGoroutine()
+	if goroutines > config.GoroutinesThreshold {
+		return true, fmt.Sprintf("%d goroutines", goroutines)
+	}
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	if heap := mem.HeapInuse / 1024 / 1024; heap > config.HeapThresholdMB {
+		return true, fmt.Sprintf("%d MB of heap in use", heap)
+	}
+	return false, ""
+}
+
+func writeProfile(dir string, name string, prefix string) error {
+	fd, err := os.Create(filepath.Join(dir, fmt.Sprintf("%s-%s.pprof", prefix, name)))
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	return runtimepprof.Lookup(name).WriteTo(fd, 0)
+}
+
+func takeSnapshot(config *csconfig.ProfilingCfg) error {
+	prefix := time.Now().UTC().Format("20060102-150405")
+	for _, name := range []string{"heap", "goroutine"} {
+		if err := writeProfile(config.SnapshotDir, name, prefix); err != nil {
+			return fmt.Errorf("while writing %s profile: %w", name, err)
+		}
+	}
+	fd, err := os.Create(filepath.Join(config.SnapshotDir, fmt.Sprintf("%s-cpu.pprof", prefix)))
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	if err := runtimepprof.StartCPUProfile(fd); err != nil {
+		//most likely, a profile is already being taken through the http endpoint
+		return fmt.Errorf("while starting cpu profile: %w", err)
+	}
+	time.Sleep(*config.SnapshotCPUDuration)
+	runtimepprof.StopCPUProfile()
+	return nil
+}
+
+// cleanupSnapshots only keeps the files of the last MaxSnapshots snapshots
+func cleanupSnapshots(config *csconfig.ProfilingCfg) error {
+	files, err := filepath.Glob(filepath.Join(config.SnapshotDir, "*-cpu.pprof"))
+	if err != nil {
+		return err
+	}
+	if len(files) <= config.MaxSnapshots {
+		return nil
+	}
+	sort.Strings(files)
+	for _, file := range files[:len(files)-config.MaxSnapshots] {
+		prefix := file[:len(file)-len("-cpu.pprof")]
+		for _, suffix := range []string{"-cpu.pprof", "-heap.pprof", "-goroutine.pprof"} {
+			if err := os.Remove(prefix + suffix); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// runProfilingSnapshots periodically dumps profiles to disk while the process is under high load
+func runProfilingSnapshots(config *csconfig.ProfilingCfg) {
+	defer types.CatchPanic("crowdsec/runProfilingSnapshots")
+	if err := os.MkdirAll(config.SnapshotDir, 0700); err != nil {
+		log.Errorf("profiling: can't create snapshot directory %s: %s", config.SnapshotDir, err)
+		return
+	}
+	log.Infof("profiling: snapshots will be written to %s under high load", config.SnapshotDir)
+	ticker := time.NewTicker(*config.SnapshotInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		highLoad, reason := isUnderHighLoad(config)
+		if !highLoad {
+			continue
+		}
+		log.Warningf("profiling: high load detected (%s), taking a snapshot", reason)
+		if err := takeSnapshot(config); err != nil {
+			log.Errorf("profiling: snapshot failed: %s", err)
+			continue
+		}
+		if err := cleanupSnapshots(config); err != nil {
+			log.Errorf("profiling: while removing old snapshots: %s", err)
+		}
+	}
+}
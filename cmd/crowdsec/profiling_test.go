@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/crowdsecurity/crowdsec/pkg/csconfig"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsMuxProfiling(t *testing.T) {
+	tests := []struct {
+		profiling    *csconfig.ProfilingCfg
+		expectedCode int
+	}{
+		{
+			profiling:    nil,
+			expectedCode: http.StatusNotFound,
+		},
+		{
+			profiling:    &csconfig.ProfilingCfg{Enabled: false},
+			expectedCode: http.StatusNotFound,
+		},
+		{
+			profiling:    &csconfig.ProfilingCfg{Enabled: true},
+			expectedCode: http.StatusOK,
+		},
+	}
+	for _, test := range tests {
+		mux := newMetricsMux(&csconfig.PrometheusCfg{ListenAddr: "127.0.0.1", ListenPort: 6060, Profiling: test.profiling})
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil))
+		assert.Equal(t, test.expectedCode, rec.Code)
+	}
+}
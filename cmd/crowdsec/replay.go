@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// replay paces the time-machine events when a replay speed is set, nil means they are processed as fast as possible
+var replay *replayPacer
+
+// replayPacer delays the events so that they are poured with the same intervals as in the logs, divided by speed
+type replayPacer struct {
+	speed     float64
+	lock      sync.Mutex
+	started   time.Time //when the first event was poured
+	firstTime time.Time //timestamp of the first event
+}
+
+// parseReplaySpeed reads the -speed flag : realtime, <N>x (eg. 10x, 0.5x) or unlimited
+func parseReplaySpeed(speed string) (float64, error) {
+	switch speed {
+	case "", "unlimited":
+		return 0, nil
+	case "realtime":
+		return 1, nil
+	}
+	factor, err := strconv.ParseFloat(strings.TrimSuffix(speed, "x"), 64)
+	if err != nil || !strings.HasSuffix(speed, "x") || factor <= 0 {
+		return 0, fmt.Errorf("invalid replay speed '%s', expected realtime, unlimited or a positive factor like 10x", speed)
+	}
+	return factor, nil
+}
+
+func newReplayPacer(speed float64) *replayPacer {
+	if speed == 0 {
+		return nil
+	}
+	return &replayPacer{speed: speed}
+}
+
+// wait blocks until it's time to pour an event with the given timestamp, or dying is closed
+func (r *replayPacer) wait(eventTime time.Time, dying <-chan struct{}) {
+	r.lock.Lock()
+	if r.started.IsZero() {
+		r.started = time.Now()
+		r.firstTime = eventTime
+	}
+	due := r.started.Add(time.Duration(float64(eventTime.Sub(r.firstTime)) / r.speed))
+	r.lock.Unlock()
+	delay := time.Until(due)
+	if delay <= 0 {
+		return
+	}
+	select {
+	case <-dying:
+	case <-time.After(delay):
+	}
+}
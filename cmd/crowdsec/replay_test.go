@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseReplaySpeed(t *testing.T) {
+	tests := []struct {
+		speed       string
+		expected    float64
+		expectedErr string
+	}{
+		{speed: "", expected: 0},
+		{speed: "unlimited", expected: 0},
+		{speed: "realtime", expected: 1},
+		{speed: "10x", expected: 10},
+		{speed: "0.5x", expected: 0.5},
+		{speed: "10", expectedErr: "invalid replay speed '10'"},
+		{speed: "0x", expectedErr: "invalid replay speed '0x'"},
+		{speed: "-2x", expectedErr: "invalid replay speed '-2x'"},
+		{speed: "fastx", expectedErr: "invalid replay speed 'fastx'"},
+	}
+	for _, test := range tests {
+		speed, err := parseReplaySpeed(test.speed)
+		if test.expectedErr != "" {
+			assert.ErrorContains(t, err, test.expectedErr)
+			continue
+		}
+		assert.NoError(t, err, test.speed)
+		assert.Equal(t, test.expected, speed, test.speed)
+	}
+}
+
+func TestReplayPacer(t *testing.T) {
+	assert.Nil(t, newReplayPacer(0))
+
+	//one second in the logs lasts 100ms
+	pacer := newReplayPacer(10)
+	dying := make(chan struct{})
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	began := time.Now()
+	pacer.wait(start, dying)
+	assert.True(t, time.Since(began) < 50*time.Millisecond, "the first event is not delayed")
+	pacer.wait(start.Add(1*time.Second), dying)
+	elapsed := time.Since(began)
+	assert.True(t, elapsed >= 100*time.Millisecond && elapsed < 500*time.Millisecond, "waited %s", elapsed)
+	//events older than the pace are not delayed
+	before := time.Now()
+	pacer.wait(start.Add(500*time.Millisecond), dying)
+	assert.True(t, time.Since(before) < 50*time.Millisecond)
+
+	//stopping doesn't wait for the pace
+	close(dying)
+	before = time.Now()
+	pacer.wait(start.Add(1*time.Hour), dying)
+	assert.True(t, time.Since(before) < 50*time.Millisecond)
+}
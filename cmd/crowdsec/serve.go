@@ -3,7 +3,10 @@ package main
 import (
 	"fmt"
 	"os"
+	"os/exec"
 	"os/signal"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -37,8 +40,58 @@ func debugHandler(sig os.Signal, cConfig *csconfig.Config) error {
 	return nil
 }
 
-func reloadHandler(sig os.Signal, cConfig *csconfig.Config) error {
-	var tmpFile string
+// crowdsecBinary returns the binary used to test the configuration before a reload
+var crowdsecBinary = os.Executable
+
+// validateReloadConfig loads the configuration from disk and checks it by running crowdsec in test mode in a separate
+// process, so that a broken configuration is detected before the running pipeline is stopped
+func validateReloadConfig() (*csconfig.Config, error) {
+	bin, err := crowdsecBinary()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to find crowdsec binary")
+	}
+	args := []string{"-c", flags.ConfigFile, "-t"}
+	if flags.DisableAgent {
+		args = append(args, "-no-cs")
+	}
+	if flags.DisableAPI {
+		args = append(args, "-no-api")
+	}
+	if out, err := exec.Command(bin, args...).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("configuration test failed (%s) : %s", err, strings.TrimSpace(string(out)))
+	}
+
+	newConfig, err := csconfig.NewConfig(flags.ConfigFile, flags.DisableAgent, flags.DisableAPI)
+	if err != nil {
+		return nil, err
+	}
+	if err := LoadConfig(newConfig); err != nil {
+		return nil, err
+	}
+	return newConfig, nil
+}
+
+// dumpBucketsForReload serializes the buckets of a stopped pipeline so that they can be restored by the new one
+func dumpBucketsForReload(cConfig *csconfig.Config) string {
+	if cConfig.DisableAgent || buckets == nil {
+		return ""
+	}
+	dumpDir := cConfig.Crowdsec.BucketStateDumpDir
+	if dumpDir == "" {
+		dumpDir = os.TempDir()
+	}
+	tmpFile, err := leaky.DumpBucketsStateAt(time.Now().UTC(), dumpDir, buckets)
+	if err != nil {
+		log.Warningf("Failed dumping bucket state, buckets will be lost : %s", err)
+		return ""
+	}
+	if err := leaky.ShutdownAllBuckets(buckets); err != nil {
+		log.Warningf("while shutting down buckets : %s", err)
+	}
+	return tmpFile
+}
+
+func reloadHandler(sig os.Signal, cConfig *csconfig.Config, tmpFile string) error {
 	var err error
 	/*
 	 re-init tombs
@@ -51,18 +104,10 @@ func reloadHandler(sig os.Signal, cConfig *csconfig.Config) error {
 	crowdsecTomb = tomb.Tomb{}
 	pluginTomb = tomb.Tomb{}
 
-	cConfig, err = csconfig.NewConfig(flags.ConfigFile, flags.DisableAgent, flags.DisableAPI)
-	if err != nil {
-		log.Fatalf(err.Error())
-	}
-
-	if err := LoadConfig(cConfig); err != nil {
-		log.Fatalf(err.Error())
-	}
 	// Configure logging
 	if err = types.SetDefaultLoggerConfig(cConfig.Common.LogMedia, cConfig.Common.LogDir, *cConfig.Common.LogLevel,
 		cConfig.Common.LogMaxSize, cConfig.Common.LogMaxFiles, cConfig.Common.LogMaxAge, cConfig.Common.CompressLogs); err != nil {
-		log.Fatal(err.Error())
+		return err
 	}
 
 	if !cConfig.DisableAPI {
@@ -77,12 +122,19 @@ func reloadHandler(sig os.Signal, cConfig *csconfig.Config) error {
 	if !cConfig.DisableAgent {
 		csParsers, err := initCrowdsec(cConfig)
 		if err != nil {
+			if !cConfig.DisableAPI {
+				if err := shutdownAPI(); err != nil {
+					log.Errorf("Failed to shut down api routines: %s", err)
+				}
+			}
 			return fmt.Errorf("unable to init crowdsec: %s", err)
 		}
-		//restore bucket state
+		//restore bucket state before the pipeline starts, so that the state file can be removed afterwards
 		if tmpFile != "" {
-			log.Warningf("we are now using %s as a state file", tmpFile)
-			cConfig.Crowdsec.BucketStateFile = tmpFile
+			log.Warningf("Restoring buckets state from %s", tmpFile)
+			if err := leaky.LoadBucketsState(tmpFile, buckets, holders); err != nil {
+				log.Errorf("unable to restore buckets : %s", err)
+			}
 		}
 		//reload the simulation state
 		if err := cConfig.LoadSimulation(); err != nil {
@@ -92,20 +144,70 @@ func reloadHandler(sig os.Signal, cConfig *csconfig.Config) error {
 	}
 
 	log.Printf("Reload is finished")
-	//delete the tmp file, it's safe now :)
-	if tmpFile != "" {
+	return nil
+}
+
+// reload validates the configuration on disk, stops the running pipeline once it is drained, and starts a new one.
+// If the new configuration is invalid the current one is kept, and if it fails to start the previous one is restored.
+// It returns the configuration in use afterwards.
+func reload(sig os.Signal, cConfig *csconfig.Config) *csconfig.Config {
+	newConfig, err := validateReloadConfig()
+	if err != nil {
+		log.Errorf("Invalid configuration, keeping the current one : %s", err)
+		return cConfig
+	}
+	if err := shutdown(sig, cConfig); err != nil {
+		log.Fatalf("failed shutdown : %s", err)
+	}
+	tmpFile := dumpBucketsForReload(cConfig)
+	//delete the tmp file once the buckets are restored, it's safe then :)
+	defer func() {
+		if tmpFile == "" {
+			return
+		}
 		if err := os.Remove(tmpFile); err != nil {
 			log.Warningf("Failed to delete temp file (%s) : %s", tmpFile, err)
 		}
+	}()
+
+	if err := reloadHandler(sig, newConfig, tmpFile); err != nil {
+		log.Errorf("Reload failed, restoring the previous configuration : %s", err)
+		if err := reloadHandler(sig, cConfig, tmpFile); err != nil {
+			log.Fatalf("Reload handler failure : %s", err)
+		}
+		return cConfig
 	}
-	return nil
+	return newConfig
+}
+
+// pendingEvents counts the events taken from the acquisition (or reprocessed) that are not yet dropped by the
+// parsers or poured to the buckets
+var pendingEvents int64
+
+// waitForParsersDrain gives the parser and bucket routines a chance to handle the events they already took from the
+// acquisition, whether the parsers are sharded or not
+func waitForParsersDrain(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if atomic.LoadInt64(&pendingEvents) <= 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	log.Warningf("%d events are still being parsed or poured after %s, they are lost", atomic.LoadInt64(&pendingEvents), timeout)
 }
 
 func ShutdownCrowdsecRoutines() error {
 	var reterr error
 
 	log.Debugf("Shutting down crowdsec sub-routines")
-	if len(dataSources) > 0 {
+	if acquisControl != nil {
+		if err := acquisControl.Close(); err != nil {
+			log.Warningf("unable to close acquisition control : %s", err)
+		}
+		acquisControl = nil
+	}
+	if len(dataSources) > 0 || acquisWatcher != nil {
 		acquisTomb.Kill(nil)
 		log.Debugf("waiting for acquisition to finish")
 		if err := acquisTomb.Wait(); err != nil {
@@ -113,13 +215,24 @@ func ShutdownCrowdsecRoutines() error {
 			reterr = err
 		}
 	}
+	if cursorsStore != nil {
+		if err := cursorsStore.Flush(); err != nil {
+			log.Warningf("unable to save acquisition cursors : %s", err)
+		}
+	}
 	log.Debugf("acquisition is finished, wait for parser/bucket/ouputs.")
+	waitForParsersDrain(5 * time.Second)
 	parsersTomb.Kill(nil)
 	if err := parsersTomb.Wait(); err != nil {
 		log.Warningf("Parsers returned error : %s", err)
 		reterr = err
 	}
 	log.Debugf("parsers is done")
+	if deadLetters != nil {
+		if err := deadLetters.Close(); err != nil {
+			log.Warningf("unable to close dead letter queue : %s", err)
+		}
+	}
 	time.Sleep(1 * time.Second) //ugly workaround for now to ensure PourItemtoholders are finished
 	bucketsTomb.Kill(nil)
 	if err := bucketsTomb.Wait(); err != nil {
@@ -194,12 +307,7 @@ func HandleSignals(cConfig *csconfig.Config) int {
 			// kill -SIGHUP XXXX
 			case syscall.SIGHUP:
 				log.Warningf("SIGHUP received, reloading")
-				if err := shutdown(s, cConfig); err != nil {
-					log.Fatalf("failed shutdown : %s", err)
-				}
-				if err := reloadHandler(s, cConfig); err != nil {
-					log.Fatalf("Reload handler failure : %s", err)
-				}
+				cConfig = reload(s, cConfig)
 			// ctrl+C, kill -SIGINT XXXX, kill -SIGTERM XXXX
 			case os.Interrupt, syscall.SIGTERM:
 				log.Warningf("SIGTERM received, shutting down")
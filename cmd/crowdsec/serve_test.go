@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/csconfig"
+	"github.com/crowdsecurity/crowdsec/pkg/parser"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/tomb.v2"
+)
+
+// fakeCrowdsec replaces the binary testing the configuration by a script that records its arguments and exits with code
+func fakeCrowdsec(t *testing.T, code int) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake crowdsec binary is a shell script")
+	}
+	dir := t.TempDir()
+	argsFile := filepath.Join(dir, "args")
+	script := "#!/bin/sh\necho \"$@\" > " + argsFile + "\necho 'invalid parser'\nexit " + strconv.Itoa(code) + "\n"
+	bin := filepath.Join(dir, "crowdsec")
+	require.NoError(t, ioutil.WriteFile(bin, []byte(script), 0755))
+	previous := crowdsecBinary
+	crowdsecBinary = func() (string, error) { return bin, nil }
+	t.Cleanup(func() { crowdsecBinary = previous })
+	return argsFile
+}
+
+func TestValidateReloadConfig(t *testing.T) {
+	previousFlags := flags
+	defer func() { flags = previousFlags }()
+	flags = &Flags{ConfigFile: filepath.Join(t.TempDir(), "config.yaml"), DisableAgent: true}
+
+	argsFile := fakeCrowdsec(t, 1)
+	_, err := validateReloadConfig()
+	assert.ErrorContains(t, err, "configuration test failed")
+	assert.ErrorContains(t, err, "invalid parser")
+	args, err := ioutil.ReadFile(argsFile)
+	require.NoError(t, err)
+	assert.Equal(t, "-c "+flags.ConfigFile+" -t -no-cs\n", string(args))
+
+	//the test passed, the configuration is loaded
+	fakeCrowdsec(t, 0)
+	_, err = validateReloadConfig()
+	assert.Error(t, err)
+	assert.NotContains(t, err.Error(), "configuration test failed")
+}
+
+func TestReloadInvalidConfig(t *testing.T) {
+	previousFlags := flags
+	defer func() { flags = previousFlags }()
+	flags = &Flags{ConfigFile: filepath.Join(t.TempDir(), "config.yaml")}
+	fakeCrowdsec(t, 1)
+
+	crowdsecTomb = tomb.Tomb{}
+	crowdsecTomb.Go(func() error {
+		<-crowdsecTomb.Dying()
+		return nil
+	})
+	defer func() {
+		crowdsecTomb.Kill(nil)
+		crowdsecTomb.Wait()
+	}()
+	cConfig := &csconfig.Config{}
+	//the running pipeline and its configuration are kept
+	assert.Same(t, cConfig, reload(syscall.SIGHUP, cConfig))
+	assert.True(t, crowdsecTomb.Alive())
+}
+
+func TestWaitForParsersDrain(t *testing.T) {
+	parsersTomb = tomb.Tomb{}
+	atomic.StoreInt64(&pendingEvents, 0)
+	input := make(chan types.Event)
+	shards := []chan types.Event{make(chan types.Event, 10), make(chan types.Event, 10)}
+	parsersTomb.Go(func() error {
+		return dispatchParse(input, shards)
+	})
+	for i := 0; i < 10; i++ {
+		//not to be processed, the parsers drop them
+		input <- types.Event{Line: types.Line{Src: strconv.Itoa(i)}}
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		waitForParsersDrain(5 * time.Second)
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		t.Fatalf("drained before the parsers took the events")
+	case <-time.After(100 * time.Millisecond):
+	}
+	for _, shard := range shards {
+		shard := shard
+		parsersTomb.Go(func() error {
+			return runParse(shard, nil, parser.UnixParserCtx{}, nil, true)
+		})
+	}
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("not drained")
+	}
+	assert.Equal(t, int64(0), atomic.LoadInt64(&pendingEvents))
+	parsersTomb.Kill(nil)
+	assert.NoError(t, parsersTomb.Wait())
+}
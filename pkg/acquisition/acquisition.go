@@ -4,18 +4,50 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 
+	"github.com/antonmedv/expr"
+	"github.com/antonmedv/expr/vm"
 	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/limits"
+	amqpacquisition "github.com/crowdsecurity/crowdsec/pkg/acquisition/modules/amqp"
+	azureblobacquisition "github.com/crowdsecurity/crowdsec/pkg/acquisition/modules/azureblob"
 	cloudwatchacquisition "github.com/crowdsecurity/crowdsec/pkg/acquisition/modules/cloudwatch"
 	dockeracquisition "github.com/crowdsecurity/crowdsec/pkg/acquisition/modules/docker"
+	ebpfacquisition "github.com/crowdsecurity/crowdsec/pkg/acquisition/modules/ebpf"
+	elasticsearchacquisition "github.com/crowdsecurity/crowdsec/pkg/acquisition/modules/elasticsearch"
+	eventhubacquisition "github.com/crowdsecurity/crowdsec/pkg/acquisition/modules/eventhub"
 	fileacquisition "github.com/crowdsecurity/crowdsec/pkg/acquisition/modules/file"
+	fluentforwardacquisition "github.com/crowdsecurity/crowdsec/pkg/acquisition/modules/fluentforward"
+	gcsacquisition "github.com/crowdsecurity/crowdsec/pkg/acquisition/modules/gcs"
+	gelfacquisition "github.com/crowdsecurity/crowdsec/pkg/acquisition/modules/gelf"
+	httpacquisition "github.com/crowdsecurity/crowdsec/pkg/acquisition/modules/http"
 	journalctlacquisition "github.com/crowdsecurity/crowdsec/pkg/acquisition/modules/journalctl"
+	kafkaacquisition "github.com/crowdsecurity/crowdsec/pkg/acquisition/modules/kafka"
 	kinesisacquisition "github.com/crowdsecurity/crowdsec/pkg/acquisition/modules/kinesis"
+	kubernetesacquisition "github.com/crowdsecurity/crowdsec/pkg/acquisition/modules/kubernetes"
+	kubernetesauditacquisition "github.com/crowdsecurity/crowdsec/pkg/acquisition/modules/kubernetesaudit"
+	mqttacquisition "github.com/crowdsecurity/crowdsec/pkg/acquisition/modules/mqtt"
+	natsacquisition "github.com/crowdsecurity/crowdsec/pkg/acquisition/modules/nats"
+	netflowacquisition "github.com/crowdsecurity/crowdsec/pkg/acquisition/modules/netflow"
+	otlpacquisition "github.com/crowdsecurity/crowdsec/pkg/acquisition/modules/otlp"
+	pluginacquisition "github.com/crowdsecurity/crowdsec/pkg/acquisition/modules/plugin"
+	pubsubacquisition "github.com/crowdsecurity/crowdsec/pkg/acquisition/modules/pubsub"
+	pulsaracquisition "github.com/crowdsecurity/crowdsec/pkg/acquisition/modules/pulsar"
+	redisacquisition "github.com/crowdsecurity/crowdsec/pkg/acquisition/modules/redis"
+	s3acquisition "github.com/crowdsecurity/crowdsec/pkg/acquisition/modules/s3"
+	socketacquisition "github.com/crowdsecurity/crowdsec/pkg/acquisition/modules/socket"
+	splunkacquisition "github.com/crowdsecurity/crowdsec/pkg/acquisition/modules/splunk"
+	sqsacquisition "github.com/crowdsecurity/crowdsec/pkg/acquisition/modules/sqs"
 	syslogacquisition "github.com/crowdsecurity/crowdsec/pkg/acquisition/modules/syslog"
+	victorialogsacquisition "github.com/crowdsecurity/crowdsec/pkg/acquisition/modules/victorialogs"
 	wineventlogacquisition "github.com/crowdsecurity/crowdsec/pkg/acquisition/modules/wineventlog"
 	"github.com/crowdsecurity/crowdsec/pkg/csconfig"
+	"github.com/crowdsecurity/crowdsec/pkg/exprhelpers"
 	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/google/uuid"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
@@ -35,6 +67,8 @@ type DataSource interface {
 	OneShotAcquisition(chan types.Event, *tomb.Tomb) error      // Start one shot acquisition(eg, cat a file)
 	StreamingAcquisition(chan types.Event, *tomb.Tomb) error    // Start live acquisition (eg, tail a file)
 	CanRun() error                                              // Whether the datasource can run or not (eg, journalctl on BSD is a non-sense)
+	Health() configuration.DataSourceStatus                     // Get the status of the datasource (state, last event and error details)
+	GetUuid() string                                            // Get the unique identifier of the datasource, set when loaded from the acquisition files
 	Dump() interface{}
 }
 
@@ -70,8 +104,114 @@ var AcquisitionSources = []struct {
 		name:  "wineventlog",
 		iface: func() DataSource { return &wineventlogacquisition.WinEventLogSource{} },
 	},
+	{
+		name:  "plugin",
+		iface: func() DataSource { return &pluginacquisition.PluginSource{} },
+	},
+	{
+		name:  "elasticsearch",
+		iface: func() DataSource { return &elasticsearchacquisition.ElasticsearchSource{} },
+	},
+	{
+		name:  "victorialogs",
+		iface: func() DataSource { return &victorialogsacquisition.VictoriaLogsSource{} },
+	},
+	{
+		name:  "splunk",
+		iface: func() DataSource { return &splunkacquisition.SplunkSource{} },
+	},
+	{
+		name:  "gelf",
+		iface: func() DataSource { return &gelfacquisition.GelfSource{} },
+	},
+	{
+		name:  "fluentforward",
+		iface: func() DataSource { return &fluentforwardacquisition.ForwardSource{} },
+	},
+	{
+		name:  "otlp",
+		iface: func() DataSource { return &otlpacquisition.OTLPSource{} },
+	},
+	{
+		name:  "nats",
+		iface: func() DataSource { return &natsacquisition.NatsSource{} },
+	},
+	{
+		name:  "pulsar",
+		iface: func() DataSource { return &pulsaracquisition.PulsarSource{} },
+	},
+	{
+		name:  "mqtt",
+		iface: func() DataSource { return &mqttacquisition.MqttSource{} },
+	},
+	{
+		name:  "amqp",
+		iface: func() DataSource { return &amqpacquisition.AmqpSource{} },
+	},
+	{
+		name:  "redis",
+		iface: func() DataSource { return &redisacquisition.RedisSource{} },
+	},
+	{
+		name:  "eventhub",
+		iface: func() DataSource { return &eventhubacquisition.EventHubSource{} },
+	},
+	{
+		name:  "azureblob",
+		iface: func() DataSource { return &azureblobacquisition.AzureBlobSource{} },
+	},
+	{
+		name:  "pubsub",
+		iface: func() DataSource { return &pubsubacquisition.PubSubSource{} },
+	},
+	{
+		name:  "gcs",
+		iface: func() DataSource { return &gcsacquisition.GCSSource{} },
+	},
+	{
+		name:  "sqs",
+		iface: func() DataSource { return &sqsacquisition.SQSSource{} },
+	},
+	{
+		name:  "s3",
+		iface: func() DataSource { return &s3acquisition.S3Source{} },
+	},
+	{
+		name:  "kafka",
+		iface: func() DataSource { return &kafkaacquisition.KafkaSource{} },
+	},
+	{
+		name:  "kubernetes",
+		iface: func() DataSource { return &kubernetesacquisition.KubernetesSource{} },
+	},
+	{
+		name:  "k8s-audit",
+		iface: func() DataSource { return &kubernetesauditacquisition.KubernetesAuditSource{} },
+	},
+	{
+		name:  "http",
+		iface: func() DataSource { return &httpacquisition.HTTPSource{} },
+	},
+	{
+		name:  "socket",
+		iface: func() DataSource { return &socketacquisition.SocketSource{} },
+	},
+	{
+		name:  "netflow",
+		iface: func() DataSource { return &netflowacquisition.NetflowSource{} },
+	},
+	{
+		name:  "ebpf",
+		iface: func() DataSource { return &ebpfacquisition.EbpfSource{} },
+	},
 }
 
+// transformRuntimes holds the compiled transform expressions, by datasource unique id
+var transformRuntimes = map[string]*vm.Program{}
+
+// sourceFiles holds the acquisition file each datasource was loaded from, by datasource unique id
+var sourceFiles = map[string]string{}
+
 func GetDataSourceIface(dataSourceType string) DataSource {
 	for _, source := range AcquisitionSources {
 		if source.name == dataSourceType {
@@ -134,6 +274,15 @@ func detectBackwardCompatAcquis(sub configuration.DataSourceCommonCfg) string {
 	return ""
 }
 
+// dsnAliases maps the DSN schemes that are not the name of a datasource to the datasource handling them
+var dsnAliases = map[string]string{
+	"journald":   "journalctl",
+	"opensearch": "elasticsearch",
+	"k8s":        "kubernetes",
+	"pulsar+ssl": "pulsar",
+	"tls":        "nats",
+}
+
 func LoadAcquisitionFromDSN(dsn string, labels map[string]string) ([]DataSource, error) {
 	var sources []DataSource
 
@@ -141,7 +290,11 @@ func LoadAcquisitionFromDSN(dsn string, labels map[string]string) ([]DataSource,
 	if len(frags) == 1 {
 		return nil, fmt.Errorf("%s isn't valid dsn (no protocol)", dsn)
 	}
-	dataSrc := GetDataSourceIface(frags[0])
+	scheme := frags[0]
+	if alias, ok := dsnAliases[scheme]; ok {
+		scheme = alias
+	}
+	dataSrc := GetDataSourceIface(scheme)
 	if dataSrc == nil {
 		return nil, fmt.Errorf("no acquisition for protocol %s://", frags[0])
 	}
@@ -167,95 +320,481 @@ func LoadAcquisitionFromFile(config *csconfig.CrowdsecServiceCfg) ([]DataSource,
 	var sources []DataSource
 
 	for _, acquisFile := range config.AcquisitionFiles {
-		log.Infof("loading acquisition file : %s", acquisFile)
-		yamlFile, err := os.Open(acquisFile)
+		fileSources, err := loadAcquisitionFile(acquisFile)
 		if err != nil {
-			return nil, errors.Wrapf(err, "can't open %s", acquisFile)
-		}
-		dec := yaml.NewDecoder(yamlFile)
-		dec.SetStrict(true)
-		for {
-			var sub configuration.DataSourceCommonCfg
-			var idx int
-			err = dec.Decode(&sub)
-			if err != nil {
-				if err == io.EOF {
-					log.Tracef("End of yaml file")
-					break
-				}
-				return nil, errors.Wrapf(err, "failed to yaml decode %s", acquisFile)
+			return nil, err
+		}
+		sources = append(sources, fileSources...)
+	}
+	return sources, nil
+}
+
+// loadAcquisitionFile configures the datasources of a single acquisition file
+func loadAcquisitionFile(acquisFile string) ([]DataSource, error) {
+	var sources []DataSource
+
+	log.Infof("loading acquisition file : %s", acquisFile)
+	yamlFile, err := os.Open(acquisFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't open %s", acquisFile)
+	}
+	defer yamlFile.Close()
+	dec := yaml.NewDecoder(yamlFile)
+	dec.SetStrict(true)
+	idx := 0
+	for {
+		var sub configuration.DataSourceCommonCfg
+		err = dec.Decode(&sub)
+		if err != nil {
+			if err == io.EOF {
+				log.Tracef("End of yaml file")
+				break
 			}
+			return nil, errors.Wrapf(err, "failed to yaml decode %s", acquisFile)
+		}
 
-			//for backward compat ('type' was not mandatory, detect it)
-			if guessType := detectBackwardCompatAcquis(sub); guessType != "" {
-				sub.Source = guessType
+		//for backward compat ('type' was not mandatory, detect it)
+		if guessType := detectBackwardCompatAcquis(sub); guessType != "" {
+			sub.Source = guessType
+		}
+		//it's an empty item, skip it
+		if len(sub.Labels) == 0 {
+			if sub.Source == "" {
+				log.Debugf("skipping empty item in %s", acquisFile)
+				idx += 1
+				continue
 			}
-			//it's an empty item, skip it
-			if len(sub.Labels) == 0 {
-				if sub.Source == "" {
-					log.Debugf("skipping empty item in %s", acquisFile)
-					idx += 1
-					continue
-				}
-				return nil, fmt.Errorf("missing labels in %s (position: %d)", acquisFile, idx)
+			return nil, fmt.Errorf("missing labels in %s (position: %d)", acquisFile, idx)
+		}
+		if sub.Source == "" {
+			return nil, fmt.Errorf("data source type is empty ('source') in %s (position: %d)", acquisFile, idx)
+		}
+		if GetDataSourceIface(sub.Source) == nil {
+			return nil, fmt.Errorf("unknown data source %s in %s (position: %d)", sub.Source, acquisFile, idx)
+		}
+		uniqueId := uuid.NewString()
+		sub.UniqueId = uniqueId
+		sourceFiles[uniqueId] = acquisFile
+		src, err := DataSourceConfigure(sub)
+		if err != nil {
+			return nil, errors.Wrapf(err, "while configuring datasource of type %s from %s (position: %d)", sub.Source, acquisFile, idx)
+		}
+		if sub.TransformExpr != "" {
+			transformRuntime, err := expr.Compile(sub.TransformExpr, expr.Env(exprhelpers.GetExprEnv(map[string]interface{}{"evt": &types.Event{}})))
+			if err != nil {
+				return nil, errors.Wrapf(err, "while compiling transform expression '%s' for datasource %s in %s (position: %d)", sub.TransformExpr, sub.Source, acquisFile, idx)
 			}
-			if sub.Source == "" {
-				return nil, fmt.Errorf("data source type is empty ('source') in %s (position: %d)", acquisFile, idx)
+			transformRuntimes[uniqueId] = transformRuntime
+		}
+		if sub.Multiline != nil {
+			aggregator, err := newMultilineAggregator(sub.Multiline)
+			if err != nil {
+				return nil, errors.Wrapf(err, "while configuring multiline for datasource %s in %s (position: %d)", sub.Source, acquisFile, idx)
+			}
+			multilineAggregators[uniqueId] = aggregator
+		}
+		//identifies the datasource in the metrics of the acquisition stages
+		sourceName := sub.Name
+		if sourceName == "" {
+			sourceName = fmt.Sprintf("%s:%d", filepath.Base(acquisFile), idx)
+		}
+		sourceNames[uniqueId] = sourceName
+		if sub.Buffer != nil {
+			buffer, err := newEventBuffer(sourceName, sub.Buffer)
+			if err != nil {
+				return nil, errors.Wrapf(err, "while configuring buffer for datasource %s in %s (position: %d)", sub.Source, acquisFile, idx)
+			}
+			eventBuffers[uniqueId] = buffer
+		}
+		if sub.Filter != nil {
+			filter, err := newDropFilter(sourceName, sub.Filter)
+			if err != nil {
+				return nil, errors.Wrapf(err, "while configuring filter for datasource %s in %s (position: %d)", sub.Source, acquisFile, idx)
+			}
+			dropFilters[uniqueId] = filter
+		}
+		if sub.Sampling != nil {
+			sampler, err := newEventSampler(sourceName, sub.Sampling)
+			if err != nil {
+				return nil, errors.Wrapf(err, "while configuring sampling for datasource %s in %s (position: %d)", sub.Source, acquisFile, idx)
+			}
+			eventSamplers[uniqueId] = sampler
+		}
+		if sub.RateLimit != nil {
+			limiter, err := newRateLimiter(sourceName, sub.RateLimit)
+			if err != nil {
+				return nil, errors.Wrapf(err, "while configuring rate limit for datasource %s in %s (position: %d)", sub.Source, acquisFile, idx)
+			}
+			rateLimiters[uniqueId] = limiter
+		}
+		if sub.Reorder != nil {
+			reorder, err := newReorderBuffer(sourceName, sub.Reorder)
+			if err != nil {
+				return nil, errors.Wrapf(err, "while configuring reorder for datasource %s in %s (position: %d)", sub.Source, acquisFile, idx)
+			}
+			reorderBuffers[uniqueId] = reorder
+		}
+		if sub.Timezone != "" {
+			location, err := loadTimezone(sub.Timezone)
+			if err != nil {
+				return nil, errors.Wrapf(err, "while configuring timezone for datasource %s in %s (position: %d)", sub.Source, acquisFile, idx)
 			}
-			if GetDataSourceIface(sub.Source) == nil {
-				return nil, fmt.Errorf("unknown data source %s in %s (position: %d)", sub.Source, acquisFile, idx)
+			sourceTimezones[uniqueId] = location
+		}
+		if sub.MaxLineSize != nil {
+			limiter, err := newLineSizeLimiter(sourceName, sub.MaxLineSize)
+			if err != nil {
+				return nil, errors.Wrapf(err, "while configuring max line size for datasource %s in %s (position: %d)", sub.Source, acquisFile, idx)
 			}
-			src, err := DataSourceConfigure(sub)
+			lineSizeLimiters[uniqueId] = limiter
+		}
+		if sub.Encoding != "" {
+			decoder, err := newLineDecoder(sub.Encoding)
 			if err != nil {
-				return nil, errors.Wrapf(err, "while configuring datasource of type %s from %s (position: %d)", sub.Source, acquisFile, idx)
+				return nil, errors.Wrapf(err, "while configuring encoding for datasource %s in %s (position: %d)", sub.Source, acquisFile, idx)
 			}
-			sources = append(sources, *src)
-			idx += 1
+			lineDecoders[uniqueId] = decoder
+		}
+		if len(sub.ParserRouting) > 0 {
+			sourceParserRouting[uniqueId] = sub.ParserRouting
 		}
+		sources = append(sources, *src)
+		idx += 1
 	}
 	return sources, nil
 }
 
+// forgetSource drops what was loaded alongside a datasource that is not used anymore
+func forgetSource(uniqueId string) {
+	delete(sourceFiles, uniqueId)
+	delete(transformRuntimes, uniqueId)
+	delete(multilineAggregators, uniqueId)
+	delete(eventBuffers, uniqueId)
+	delete(dropFilters, uniqueId)
+	delete(eventSamplers, uniqueId)
+	delete(rateLimiters, uniqueId)
+	delete(reorderBuffers, uniqueId)
+	delete(sourceTimezones, uniqueId)
+	delete(sourceParserRouting, uniqueId)
+	delete(lineSizeLimiters, uniqueId)
+	delete(lineDecoders, uniqueId)
+	delete(sourceNames, uniqueId)
+	forgetSourceHealth(uniqueId)
+}
+
 func GetMetrics(sources []DataSource, aggregated bool) error {
-	var metrics []prometheus.Collector
+	for _, metric := range []prometheus.Collector{LinesRead, BytesRead, ThroughputCollector, BufferFill, BufferDropped, FilterDropped, SampledOut, SamplingRate, RateLimited, GlobalRateLimited, ReorderLate, OversizedLines, HealthCollector,
+		limits.ActiveTailers, limits.WaitingTailers} {
+		if err := prometheus.Register(metric); err != nil {
+			if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+				return errors.Wrap(err, "could not register acquisition metrics")
+			}
+		}
+	}
 	for i := 0; i < len(sources); i++ {
-		if aggregated {
-			metrics = sources[i].GetMetrics()
-		} else {
-			metrics = sources[i].GetAggregMetrics()
+		if err := registerSourceMetrics(sources[i], aggregated); err != nil {
+			return err
 		}
-		for _, metric := range metrics {
+	}
+	return nil
+}
+
+// registeredMetrics counts the started datasources using each collector : the datasources of a type share theirs
+var registeredMetrics = map[prometheus.Collector]int{}
+var registeredMetricsLock sync.Mutex
+
+func sourceMetrics(source DataSource, aggregated bool) []prometheus.Collector {
+	if aggregated {
+		return source.GetMetrics()
+	}
+	return source.GetAggregMetrics()
+}
+
+func registerSourceMetrics(source DataSource, aggregated bool) error {
+	registeredMetricsLock.Lock()
+	defer registeredMetricsLock.Unlock()
+	for _, metric := range sourceMetrics(source, aggregated) {
+		if registeredMetrics[metric] == 0 {
 			if err := prometheus.Register(metric); err != nil {
 				if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
-					return errors.Wrapf(err, "could not register metrics for datasource %s", sources[i].GetName())
+					return errors.Wrapf(err, "could not register metrics for datasource %s", source.GetName())
 				}
 				//ignore the error
 			}
 		}
-
+		registeredMetrics[metric]++
 	}
 	return nil
 }
 
-func StartAcquisition(sources []DataSource, output chan types.Event, AcquisTomb *tomb.Tomb) error {
-	for i := 0; i < len(sources); i++ {
-		subsrc := sources[i] //ensure its a copy
-		log.Debugf("starting one source %d/%d ->> %T", i, len(sources), subsrc)
+// unregisterSourceMetrics unregisters the collectors of a stopped datasource that no other datasource uses
+func unregisterSourceMetrics(source DataSource, aggregated bool) {
+	registeredMetricsLock.Lock()
+	defer registeredMetricsLock.Unlock()
+	for _, metric := range sourceMetrics(source, aggregated) {
+		if registeredMetrics[metric] == 0 {
+			continue
+		}
+		registeredMetrics[metric]--
+		if registeredMetrics[metric] == 0 {
+			delete(registeredMetrics, metric)
+			prometheus.Unregister(metric)
+		}
+	}
+}
 
-		AcquisTomb.Go(func() error {
-			defer types.CatchPanic("crowdsec/acquis")
-			var err error
-			if subsrc.GetMode() == configuration.TAIL_MODE {
-				err = subsrc.StreamingAcquisition(output, AcquisTomb)
-			} else {
-				err = subsrc.OneShotAcquisition(output, AcquisTomb)
+// sendEvent hands evt to the next stage. The parsers read the acquisition output until the tomb is dead, so the
+// stages keep forwarding (and reading their input, which unblocks the datasources) while it is dying
+func sendEvent(output chan types.Event, evt types.Event, AcquisTomb *tomb.Tomb) {
+	select {
+	case output <- evt:
+	case <-AcquisTomb.Dead():
+	}
+}
+
+// transform applies the transform expression of a datasource to its events before handing them to the parsers.
+// The expression can return a string, that replaces the raw line, or a list of strings, each one becoming an event.
+func transform(transformChan chan types.Event, output chan types.Event, AcquisTomb *tomb.Tomb, transformRuntime *vm.Program, logger *log.Entry) {
+	defer types.CatchPanic("crowdsec/acquis/transform")
+	logger.Infof("transformer started")
+	for {
+		select {
+		case <-AcquisTomb.Dead():
+			logger.Debugf("transformer is dead")
+			return
+		case evt, ok := <-transformChan:
+			if !ok {
+				return
 			}
+			logger.Tracef("Received event %s", evt.Line.Raw)
+			out, err := expr.Run(transformRuntime, exprhelpers.GetExprEnv(map[string]interface{}{"evt": &evt}))
 			if err != nil {
-				//if one of the acqusition returns an error, we kill the others to properly shutdown
-				AcquisTomb.Kill(err)
+				logger.Errorf("Got error while running transform expression: %s", err)
+				logger.Debugf("Transform expression: %s", transformRuntime.Source.Content())
+				sendEvent(output, evt, AcquisTomb)
+				continue
+			}
+			switch v := out.(type) {
+			case string:
+				logger.Tracef("transform expression returned %s", v)
+				evt.Line.Raw = v
+				sendEvent(output, evt, AcquisTomb)
+			case []string:
+				logger.Tracef("transform expression returned %v", v)
+				for _, line := range v {
+					newEvt := evt
+					newEvt.Line.Raw = line
+					sendEvent(output, newEvt, AcquisTomb)
+				}
+			case []interface{}:
+				logger.Tracef("transform expression returned %v", v)
+				for _, line := range v {
+					l, ok := line.(string)
+					if !ok {
+						logger.Errorf("transform expression returned a list with a non-string element (%T), skipping it", line)
+						continue
+					}
+					newEvt := evt
+					newEvt.Line.Raw = l
+					sendEvent(output, newEvt, AcquisTomb)
+				}
+			default:
+				logger.Errorf("transform expression returned an invalid type %T, sending event as-is", out)
+				sendEvent(output, evt, AcquisTomb)
 			}
-			return nil
+		}
+	}
+}
+
+// startSource runs a datasource and its optional stages in AcquisTomb
+func startSource(subsrc DataSource, output chan types.Event, AcquisTomb *tomb.Tomb) {
+	/*
+		events go through the optional stages before reaching output :
+		datasource -> pause -> global rate limit -> encoding -> multiline -> max line size -> routing -> timezone -> reorder -> filter -> sampling -> buffer -> rate limit -> transform -> output
+		the datasource runs in its own tomb : once it is over (cat mode) or stopped, the datasource channel is closed, and
+		the stages forward and flush what they hold before AcquisTomb can be dead
+	*/
+	outChan := output
+	stages := &sync.WaitGroup{}
+	startStage := func(stage func(chan types.Event, chan types.Event)) {
+		in := make(chan types.Event)
+		out := outChan
+		stages.Add(1)
+		go func() {
+			defer stages.Done()
+			stage(in, out)
+			if out != output {
+				close(out)
+			}
+		}()
+		outChan = in
+	}
+	if transformRuntime, ok := transformRuntimes[subsrc.GetUuid()]; ok {
+		transformLogger := log.WithFields(log.Fields{
+			"component":  "transform",
+			"datasource": subsrc.GetName(),
+		})
+		startStage(func(in chan types.Event, out chan types.Event) {
+			transform(in, out, AcquisTomb, transformRuntime, transformLogger)
+		})
+	}
+	if limiter, ok := rateLimiters[subsrc.GetUuid()]; ok {
+		rateLimitLogger := log.WithFields(log.Fields{
+			"component":  "rate_limit",
+			"datasource": subsrc.GetName(),
+		})
+		startStage(func(in chan types.Event, out chan types.Event) {
+			limiter.run(in, out, AcquisTomb, subsrc.GetName(), rateLimitLogger)
+		})
+	}
+	if buffer, ok := eventBuffers[subsrc.GetUuid()]; ok {
+		bufferLogger := log.WithFields(log.Fields{
+			"component":  "buffer",
+			"datasource": subsrc.GetName(),
 		})
+		startStage(func(in chan types.Event, out chan types.Event) {
+			buffer.run(in, out, AcquisTomb, subsrc.GetName(), bufferLogger)
+		})
+	}
+	if sampler, ok := eventSamplers[subsrc.GetUuid()]; ok {
+		samplingLogger := log.WithFields(log.Fields{
+			"component":  "sampling",
+			"datasource": subsrc.GetName(),
+		})
+		startStage(func(in chan types.Event, out chan types.Event) {
+			sampler.run(in, out, AcquisTomb, subsrc.GetName(), samplingLogger)
+		})
+	}
+	if filter, ok := dropFilters[subsrc.GetUuid()]; ok {
+		filterLogger := log.WithFields(log.Fields{
+			"component":  "filter",
+			"datasource": subsrc.GetName(),
+		})
+		startStage(func(in chan types.Event, out chan types.Event) {
+			filter.run(in, out, AcquisTomb, subsrc.GetName(), filterLogger)
+		})
+	}
+	if reorder, ok := reorderBuffers[subsrc.GetUuid()]; ok {
+		reorderLogger := log.WithFields(log.Fields{
+			"component":  "reorder",
+			"datasource": subsrc.GetName(),
+		})
+		startStage(func(in chan types.Event, out chan types.Event) {
+			reorder.run(in, out, AcquisTomb, subsrc.GetName(), reorderLogger)
+		})
+	}
+	if location, ok := sourceTimezones[subsrc.GetUuid()]; ok {
+		timezoneLogger := log.WithFields(log.Fields{
+			"component":  "timezone",
+			"datasource": subsrc.GetName(),
+		})
+		startStage(func(in chan types.Event, out chan types.Event) {
+			setTimezone(in, out, AcquisTomb, location, timezoneLogger)
+		})
+	}
+	if parsers, ok := sourceParserRouting[subsrc.GetUuid()]; ok {
+		routingLogger := log.WithFields(log.Fields{
+			"component":  "routing",
+			"datasource": subsrc.GetName(),
+		})
+		startStage(func(in chan types.Event, out chan types.Event) {
+			setParserRouting(in, out, AcquisTomb, parsers, routingLogger)
+		})
+	}
+	if limiter, ok := lineSizeLimiters[subsrc.GetUuid()]; ok {
+		lineSizeLogger := log.WithFields(log.Fields{
+			"component":  "max_line_size",
+			"datasource": subsrc.GetName(),
+		})
+		startStage(func(in chan types.Event, out chan types.Event) {
+			limiter.run(in, out, AcquisTomb, subsrc.GetName(), lineSizeLogger)
+		})
+	}
+	//multiline events are put together before the stages looking at them, max_line_size applies to the whole event
+	if aggregator, ok := multilineAggregators[subsrc.GetUuid()]; ok {
+		multilineLogger := log.WithFields(log.Fields{
+			"component":  "multiline",
+			"datasource": subsrc.GetName(),
+		})
+		startStage(func(in chan types.Event, out chan types.Event) {
+			aggregator.run(in, out, AcquisTomb, multilineLogger)
+		})
+	}
+	//lines are transcoded before the stages looking at their content
+	if decoder, ok := lineDecoders[subsrc.GetUuid()]; ok {
+		encodingLogger := log.WithFields(log.Fields{
+			"component":  "encoding",
+			"datasource": subsrc.GetName(),
+		})
+		startStage(func(in chan types.Event, out chan types.Event) {
+			decoder.run(in, out, AcquisTomb, encodingLogger)
+		})
+	}
+	throughputName := sourceNames[subsrc.GetUuid()]
+	if throughputName == "" {
+		throughputName = subsrc.GetName()
+	}
+	countLines(subsrc, throughputName)
+	if limits.ReadRateLimited() {
+		globalRateLimitLogger := log.WithFields(log.Fields{
+			"component":  "global_rate_limit",
+			"datasource": subsrc.GetName(),
+		})
+		startStage(func(in chan types.Event, out chan types.Event) {
+			globalRateLimit(in, out, AcquisTomb, subsrc.GetName(), throughputName, globalRateLimitLogger)
+		})
+	}
+	var gate *pauseGate
+	if pauseControl {
+		gate = newPauseGate()
+		pauseLogger := log.WithFields(log.Fields{
+			"component":  "pause",
+			"datasource": subsrc.GetName(),
+		})
+		startStage(func(in chan types.Event, out chan types.Event) {
+			gate.run(in, out, AcquisTomb, pauseLogger)
+		})
+	}
+	srcChan := outChan
+
+	registerSourceHealth(subsrc, gate)
+	AcquisTomb.Go(func() error {
+		defer types.CatchPanic("crowdsec/acquis")
+		setSourceState(subsrc, configuration.STATUS_RUNNING, nil)
+		srcTomb := &tomb.Tomb{}
+		srcTomb.Go(func() error {
+			defer types.CatchPanic("crowdsec/acquis")
+			if subsrc.GetMode() == configuration.TAIL_MODE {
+				return subsrc.StreamingAcquisition(srcChan, srcTomb)
+			}
+			return subsrc.OneShotAcquisition(srcChan, srcTomb)
+		})
+		select {
+		case <-AcquisTomb.Dying():
+			srcTomb.Kill(nil)
+		case <-srcTomb.Dead():
+		}
+		//the datasource does not send anything anymore
+		err := srcTomb.Wait()
+		if srcChan != output {
+			close(srcChan)
+			stages.Wait()
+		}
+		if err != nil {
+			setSourceState(subsrc, configuration.STATUS_ERRORED, err)
+			//if one of the acqusition returns an error, we kill the others to properly shutdown
+			AcquisTomb.Kill(err)
+		} else if subsrc.GetMode() != configuration.TAIL_MODE {
+			setSourceState(subsrc, configuration.STATUS_STOPPED, nil)
+		}
+		return nil
+	})
+}
+
+func StartAcquisition(sources []DataSource, output chan types.Event, AcquisTomb *tomb.Tomb) error {
+	for i := 0; i < len(sources); i++ {
+		log.Debugf("starting one source %d/%d ->> %T", i, len(sources), sources[i])
+		startSource(sources[i], output, AcquisTomb)
 	}
 	// Don't wait if we have no sources, as it will hang forever
 	if len(sources) > 0 {
@@ -3,12 +3,15 @@ package acquisition
 import (
 	"fmt"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/antonmedv/expr"
 	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
 	"github.com/crowdsecurity/crowdsec/pkg/csconfig"
 	"github.com/crowdsecurity/crowdsec/pkg/cstest"
+	"github.com/crowdsecurity/crowdsec/pkg/exprhelpers"
 	"github.com/crowdsecurity/crowdsec/pkg/types"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
@@ -19,6 +22,7 @@ import (
 )
 
 type MockSource struct {
+	configuration.HealthTracker
 	configuration.DataSourceCommonCfg `yaml:",inline"`
 	Toto                              string `yaml:"toto"`
 	logger                            *log.Entry
@@ -44,10 +48,11 @@ func (f *MockSource) GetMode() string                                         {
 func (f *MockSource) OneShotAcquisition(chan types.Event, *tomb.Tomb) error   { return nil }
 func (f *MockSource) StreamingAcquisition(chan types.Event, *tomb.Tomb) error { return nil }
 func (f *MockSource) CanRun() error                                           { return nil }
-func (f *MockSource) GetMetrics() []prometheus.Collector                      { return nil }
-func (f *MockSource) GetAggregMetrics() []prometheus.Collector                { return nil }
+func (f *MockSource) GetMetrics() []prometheus.Collector                      { return mockSourceMetrics }
+func (f *MockSource) GetAggregMetrics() []prometheus.Collector                { return mockSourceMetrics }
 func (f *MockSource) Dump() interface{}                                       { return f }
 func (f *MockSource) GetName() string                                         { return "mock" }
+func (f *MockSource) GetUuid() string                                         { return f.UniqueId }
 func (f *MockSource) ConfigureByDSN(string, map[string]string, *log.Entry) error {
 	return fmt.Errorf("not supported")
 }
@@ -60,6 +65,13 @@ type MockSourceCantRun struct {
 func (f *MockSourceCantRun) CanRun() error   { return fmt.Errorf("can't run bro") }
 func (f *MockSourceCantRun) GetName() string { return "mock_cant_run" }
 
+// shared by the mock datasources, as the real datasources of a type share their metrics
+var mockSourceHits = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "test_mock_source_hits_total",
+	Help: "Hits of the mock datasources.",
+})
+var mockSourceMetrics = []prometheus.Collector{mockSourceHits}
+
 //appendMockSource is only used to add mock source for tests
 func appendMockSource() {
 	if GetDataSourceIface("mock") == nil {
@@ -308,6 +320,7 @@ func TestLoadAcquisitionFromFile(t *testing.T) {
 */
 
 type MockCat struct {
+	configuration.HealthTracker
 	configuration.DataSourceCommonCfg `yaml:",inline"`
 	logger                            *log.Entry
 }
@@ -323,6 +336,7 @@ func (f *MockCat) Configure(cfg []byte, logger *log.Entry) error {
 	return nil
 }
 func (f *MockCat) GetName() string { return "mock_cat" }
+func (f *MockCat) GetUuid() string { return f.UniqueId }
 func (f *MockCat) GetMode() string { return "cat" }
 func (f *MockCat) OneShotAcquisition(out chan types.Event, tomb *tomb.Tomb) error {
 	for i := 0; i < 10; i++ {
@@ -346,6 +360,7 @@ func (f *MockCat) ConfigureByDSN(string, map[string]string, *log.Entry) error {
 //----
 
 type MockTail struct {
+	configuration.HealthTracker
 	configuration.DataSourceCommonCfg `yaml:",inline"`
 	logger                            *log.Entry
 }
@@ -361,6 +376,7 @@ func (f *MockTail) Configure(cfg []byte, logger *log.Entry) error {
 	return nil
 }
 func (f *MockTail) GetName() string { return "mock_tail" }
+func (f *MockTail) GetUuid() string { return f.UniqueId }
 func (f *MockTail) GetMode() string { return "tail" }
 func (f *MockTail) OneShotAcquisition(out chan types.Event, tomb *tomb.Tomb) error {
 	return fmt.Errorf("can't run in cat mode")
@@ -412,6 +428,59 @@ READLOOP:
 	}
 }
 
+func TestTransform(t *testing.T) {
+	tests := []struct {
+		TestName string
+		Expr     string
+		Line     string
+		Expected []string
+	}{
+		{
+			TestName: "replace line",
+			Expr:     `JsonExtract(evt.Line.Raw, "log")`,
+			Line:     `{"log": "foobar"}`,
+			Expected: []string{"foobar"},
+		},
+		{
+			TestName: "split line",
+			Expr:     `Split(evt.Line.Raw, ",")`,
+			Line:     "foo,bar,baz",
+			Expected: []string{"foo", "bar", "baz"},
+		},
+		{
+			TestName: "invalid return type",
+			Expr:     `len(evt.Line.Raw)`,
+			Line:     "foobar",
+			Expected: []string{"foobar"},
+		},
+	}
+
+	for _, test := range tests {
+		program, err := expr.Compile(test.Expr, expr.Env(exprhelpers.GetExprEnv(map[string]interface{}{"evt": &types.Event{}})))
+		if err != nil {
+			t.Fatalf("%s : unexpected compile error : %s", test.TestName, err)
+		}
+		in := make(chan types.Event)
+		out := make(chan types.Event, len(test.Expected)+1)
+		acquisTomb := tomb.Tomb{}
+		go transform(in, out, &acquisTomb, program, log.WithField("test", test.TestName))
+		evt := types.Event{}
+		evt.Line.Raw = test.Line
+		evt.Line.Src = "test"
+		in <- evt
+		for _, expected := range test.Expected {
+			select {
+			case res := <-out:
+				assert.Equal(t, expected, res.Line.Raw)
+				assert.Equal(t, "test", res.Line.Src)
+			case <-time.After(1 * time.Second):
+				t.Fatalf("%s : timeout waiting for '%s'", test.TestName, expected)
+			}
+		}
+		acquisTomb.Kill(nil)
+	}
+}
+
 func TestStartAcquisitionTail(t *testing.T) {
 	sources := []DataSource{
 		&MockTail{},
@@ -493,7 +562,59 @@ READLOOP:
 	}
 }
 
+// MockBusyTail sends as fast as it can, without looking at the tomb while sending
+type MockBusyTail struct {
+	MockTail
+	sent int64
+}
+
+func (f *MockBusyTail) StreamingAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	t.Go(func() error {
+		for t.Alive() {
+			evt := types.Event{}
+			evt.Line.Src = "test"
+			out <- evt
+			atomic.AddInt64(&f.sent, 1)
+		}
+		return nil
+	})
+	return nil
+}
+
+func TestStopBusySource(t *testing.T) {
+	busy := &MockBusyTail{}
+	busy.UniqueId = "busy-tail"
+	buffer, err := newEventBuffer("busy", &configuration.BufferCfg{Size: 5})
+	assert.NilError(t, err)
+	eventBuffers[busy.UniqueId] = buffer
+	defer forgetSource(busy.UniqueId)
+
+	out := make(chan types.Event)
+	acquisTomb := tomb.Tomb{}
+	startSource(busy, out, &acquisTomb)
+	for i := 0; i < 100; i++ {
+		<-out
+	}
+	acquisTomb.Kill(nil)
+	//the parsers keep reading until the acquisition is dead : nothing is lost on the way
+	received := int64(100)
+	timeout := time.After(5 * time.Second)
+READLOOP:
+	for {
+		select {
+		case <-out:
+			received++
+		case <-acquisTomb.Dead():
+			break READLOOP
+		case <-timeout:
+			t.Fatalf("acquisition did not stop")
+		}
+	}
+	assert.Equal(t, atomic.LoadInt64(&busy.sent), received)
+}
+
 type MockSourceByDSN struct {
+	configuration.HealthTracker
 	configuration.DataSourceCommonCfg `yaml:",inline"`
 	Toto                              string `yaml:"toto"`
 	logger                            *log.Entry
@@ -508,6 +629,7 @@ func (f *MockSourceByDSN) GetMetrics() []prometheus.Collector
 func (f *MockSourceByDSN) GetAggregMetrics() []prometheus.Collector                { return nil }
 func (f *MockSourceByDSN) Dump() interface{}                                       { return f }
 func (f *MockSourceByDSN) GetName() string                                         { return "mockdsn" }
+func (f *MockSourceByDSN) GetUuid() string                                         { return "" }
 func (f *MockSourceByDSN) ConfigureByDSN(dsn string, labels map[string]string, logger *log.Entry) error {
 	dsn = strings.TrimPrefix(dsn, "mockdsn://")
 	if dsn != "test_expect" {
@@ -538,6 +660,22 @@ func TestConfigureByDSN(t *testing.T) {
 			dsn:           "mockdsn://bad",
 			ExpectedError: "unexpected value",
 		},
+		{
+			dsn:            "journald://filters=_UID=42",
+			ExpectedResLen: 1,
+		},
+		{
+			dsn:            "k8s://default?api_server=https://127.0.0.1:6443",
+			ExpectedResLen: 1,
+		},
+		{
+			dsn:            "pulsar+ssl://localhost:6651?topic=logs",
+			ExpectedResLen: 1,
+		},
+		{
+			dsn:            "tls://localhost:4222?stream=logs",
+			ExpectedResLen: 1,
+		},
 	}
 
 	if GetDataSourceIface("mockdsn") == nil {
@@ -0,0 +1,136 @@
+package acquisition
+
+import (
+	"fmt"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	tomb "gopkg.in/tomb.v2"
+)
+
+const (
+	BUFFER_POLICY_BLOCK       = "block"
+	BUFFER_POLICY_DROP_OLDEST = "drop_oldest"
+	BUFFER_POLICY_SAMPLE      = "sample"
+
+	DEFAULT_BUFFER_SAMPLE_RATE = 10
+)
+
+var BufferFill = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "cs_acquisition_buffer_fill",
+		Help: "Number of events waiting in the buffer of a datasource.",
+	},
+	[]string{"datasource", "name"},
+)
+
+var BufferDropped = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cs_acquisition_buffer_dropped_total",
+		Help: "Total events dropped because the buffer of a datasource was full.",
+	},
+	[]string{"datasource", "name"},
+)
+
+// eventBuffers holds the buffer configuration of the datasources, by datasource unique id
+var eventBuffers = map[string]*eventBuffer{}
+
+// eventBuffer decouples a datasource from the parsers : events are queued in a ring of fixed size,
+// and the overflow policy decides what happens when the parsers don't keep up
+type eventBuffer struct {
+	name       string
+	size       int
+	policy     string
+	sampleRate int
+}
+
+func newEventBuffer(name string, config *configuration.BufferCfg) (*eventBuffer, error) {
+	if config.Size <= 0 {
+		return nil, fmt.Errorf("buffer: size must be positive")
+	}
+	b := &eventBuffer{
+		name:       name,
+		size:       config.Size,
+		policy:     config.Policy,
+		sampleRate: DEFAULT_BUFFER_SAMPLE_RATE,
+	}
+	switch b.policy {
+	case "":
+		b.policy = BUFFER_POLICY_BLOCK
+	case BUFFER_POLICY_BLOCK, BUFFER_POLICY_DROP_OLDEST, BUFFER_POLICY_SAMPLE:
+	default:
+		return nil, fmt.Errorf("buffer: unknown policy '%s' (must be %s, %s or %s)", b.policy, BUFFER_POLICY_BLOCK, BUFFER_POLICY_DROP_OLDEST, BUFFER_POLICY_SAMPLE)
+	}
+	if config.SampleRate < 0 {
+		return nil, fmt.Errorf("buffer: sample_rate must be positive")
+	}
+	if config.SampleRate > 0 {
+		b.sampleRate = config.SampleRate
+	}
+	return b, nil
+}
+
+/*
+run moves the events from input to output through the ring. When the ring is full :
+  - block stops reading input, so the datasource waits for the parsers (same as without buffer)
+  - drop_oldest discards the oldest queued event to make room for the new one
+  - sample keeps one new event out of sample_rate (replacing the oldest queued one) and discards the others
+
+In cat mode, input is closed at the end of the acquisition and the queued events are all sent before returning.
+*/
+func (b *eventBuffer) run(input chan types.Event, output chan types.Event, AcquisTomb *tomb.Tomb, datasource string, logger *log.Entry) {
+	defer types.CatchPanic("crowdsec/acquis/buffer")
+	fill := BufferFill.WithLabelValues(datasource, b.name)
+	dropped := BufferDropped.WithLabelValues(datasource, b.name)
+	ring := make([]types.Event, b.size)
+	head, count := 0, 0
+	overflows := 0
+	logger.Infof("buffer started (size: %d, policy: %s)", b.size, b.policy)
+	for {
+		var sendChan chan types.Event
+		var next types.Event
+		if count > 0 {
+			sendChan = output
+			next = ring[head]
+		}
+		recvChan := input
+		if recvChan != nil && count == b.size && b.policy == BUFFER_POLICY_BLOCK {
+			recvChan = nil
+		}
+		if input == nil && count == 0 {
+			return
+		}
+		select {
+		case <-AcquisTomb.Dead():
+			logger.Debugf("buffer is dead")
+			return
+		case evt, ok := <-recvChan:
+			if !ok {
+				//drain what is left and return
+				input = nil
+				continue
+			}
+			if count == b.size {
+				overflows++
+				if b.policy == BUFFER_POLICY_SAMPLE && overflows%b.sampleRate != 0 {
+					dropped.Inc()
+					continue
+				}
+				//make room by discarding the oldest event
+				ring[head] = types.Event{}
+				head = (head + 1) % b.size
+				count--
+				dropped.Inc()
+			}
+			ring[(head+count)%b.size] = evt
+			count++
+		case sendChan <- next:
+			ring[head] = types.Event{}
+			head = (head + 1) % b.size
+			count--
+		}
+		fill.Set(float64(count))
+	}
+}
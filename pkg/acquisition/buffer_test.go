@@ -0,0 +1,93 @@
+package acquisition
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	log "github.com/sirupsen/logrus"
+	tomb "gopkg.in/tomb.v2"
+	"gotest.tools/v3/assert"
+)
+
+func TestBufferConfig(t *testing.T) {
+	tests := []struct {
+		TestName      string
+		Config        configuration.BufferCfg
+		ExpectedError string
+	}{
+		{
+			TestName:      "missing size",
+			Config:        configuration.BufferCfg{},
+			ExpectedError: "buffer: size must be positive",
+		},
+		{
+			TestName:      "unknown policy",
+			Config:        configuration.BufferCfg{Size: 10, Policy: "foobar"},
+			ExpectedError: "buffer: unknown policy 'foobar' (must be block, drop_oldest or sample)",
+		},
+		{
+			TestName: "default policy",
+			Config:   configuration.BufferCfg{Size: 10},
+		},
+	}
+	for _, test := range tests {
+		b, err := newEventBuffer("test", &test.Config)
+		if test.ExpectedError != "" {
+			assert.Error(t, err, test.ExpectedError, test.TestName)
+			continue
+		}
+		assert.NilError(t, err, test.TestName)
+		assert.Equal(t, BUFFER_POLICY_BLOCK, b.policy)
+	}
+}
+
+// fillBuffer pushes count events while nobody reads output, then reads everything that was kept
+func fillBuffer(t *testing.T, config configuration.BufferCfg, count int) []string {
+	b, err := newEventBuffer("test", &config)
+	assert.NilError(t, err)
+	in := make(chan types.Event)
+	out := make(chan types.Event)
+	acquisTomb := tomb.Tomb{}
+	done := make(chan bool)
+	go func() {
+		b.run(in, out, &acquisTomb, "test", log.WithField("test", config.Policy))
+		close(done)
+	}()
+	sent := 0
+	for i := 0; i < count; i++ {
+		evt := types.Event{}
+		evt.Line.Raw = fmt.Sprintf("%d", i)
+		select {
+		case in <- evt:
+			sent++
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	close(in)
+	lines := []string{}
+	for {
+		select {
+		case evt := <-out:
+			lines = append(lines, evt.Line.Raw)
+		case <-done:
+			return lines
+		}
+	}
+}
+
+func TestBufferPolicies(t *testing.T) {
+	//block : the buffer stops reading once full
+	lines := fillBuffer(t, configuration.BufferCfg{Size: 3, Policy: BUFFER_POLICY_BLOCK}, 5)
+	assert.DeepEqual(t, []string{"0", "1", "2"}, lines)
+
+	//drop_oldest : the latest events are kept
+	lines = fillBuffer(t, configuration.BufferCfg{Size: 3, Policy: BUFFER_POLICY_DROP_OLDEST}, 6)
+	assert.DeepEqual(t, []string{"3", "4", "5"}, lines)
+
+	//sample : one overflowing event out of 2 is kept
+	lines = fillBuffer(t, configuration.BufferCfg{Size: 3, Policy: BUFFER_POLICY_SAMPLE, SampleRate: 2}, 7)
+	assert.DeepEqual(t, []string{"2", "4", "6"}, lines)
+}
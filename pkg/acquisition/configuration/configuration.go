@@ -1,6 +1,8 @@
 package configuration
 
 import (
+	"time"
+
 	log "github.com/sirupsen/logrus"
 )
 
@@ -11,9 +13,114 @@ type DataSourceCommonCfg struct {
 	Source         string                 `yaml:"source,omitempty"`
 	Name           string                 `yaml:"name,omitempty"`
 	UseTimeMachine bool                   `yaml:"use_time_machine,omitempty"`
-	Config         map[string]interface{} `yaml:",inline"` //to keep the datasource-specific configuration directives
+	UniqueId       string                 `yaml:"unique_id,omitempty"`
+	TransformExpr  string                 `yaml:"transform,omitempty"`
+	Multiline      *MultilineCfg          `yaml:"multiline,omitempty"`
+	Buffer         *BufferCfg             `yaml:"buffer,omitempty"`
+	Filter         *FilterCfg             `yaml:"filter,omitempty"`
+	RateLimit      *RateLimitCfg          `yaml:"rate_limit,omitempty"`
+	Reorder        *ReorderCfg            `yaml:"reorder,omitempty"`
+	Sampling       *SamplingCfg           `yaml:"sampling,omitempty"`
+	Retry          *RetryCfg              `yaml:"retry,omitempty"`
+	MaxLineSize    *MaxLineSizeCfg        `yaml:"max_line_size,omitempty"`
+	ParserRouting  []string               `yaml:"parser_routing,omitempty"` //only run these parsers, in the stages they belong to
+	Timezone       string                 `yaml:"timezone,omitempty"`       //timezone of the logs timestamps that don't have one, eg. Europe/Paris
+	Encoding       string                 `yaml:"encoding,omitempty"`       //character encoding of the lines, eg. utf-16 or iso-8859-1, transcoded to utf-8
+	Config         map[string]interface{} `yaml:",inline"`                  //to keep the datasource-specific configuration directives
+}
+
+// MultilineCfg describes how continuation lines are merged with the line that started them
+type MultilineCfg struct {
+	Preset       string         `yaml:"preset,omitempty"`        //built-in continuation patterns (ie. stacktrace), instead of start_pattern
+	StartPattern string         `yaml:"start_pattern,omitempty"` //a line matching this regexp starts a new event
+	MaxLines     int            `yaml:"max_lines,omitempty"`     //flush the event once it reaches this number of lines
+	FlushTimeout *time.Duration `yaml:"flush_timeout,omitempty"` //flush the event if no new line was received in this delay
+}
+
+// UnmarshalYAML allows the short form `multiline: <preset>`
+func (m *MultilineCfg) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var preset string
+	if err := unmarshal(&preset); err == nil {
+		*m = MultilineCfg{Preset: preset}
+		return nil
+	}
+	type rawMultilineCfg MultilineCfg
+	return unmarshal((*rawMultilineCfg)(m))
+}
+
+// MaxLineSizeCfg describes what happens to the lines longer than a given size
+type MaxLineSizeCfg struct {
+	Size   int    `yaml:"size"`             //in bytes
+	Policy string `yaml:"policy,omitempty"` //truncate the lines to size, or drop them
+}
+
+// UnmarshalYAML allows the short form `max_line_size: <size>`
+func (m *MaxLineSizeCfg) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var size int
+	if err := unmarshal(&size); err == nil {
+		*m = MaxLineSizeCfg{Size: size}
+		return nil
+	}
+	type rawMaxLineSizeCfg MaxLineSizeCfg
+	return unmarshal((*rawMaxLineSizeCfg)(m))
+}
+
+// BufferCfg describes the queue between a datasource and the parsers
+type BufferCfg struct {
+	Size       int    `yaml:"size"`                  //number of events the buffer can hold
+	Policy     string `yaml:"policy,omitempty"`      //what to do when the buffer is full : block, drop_oldest or sample
+	SampleRate int    `yaml:"sample_rate,omitempty"` //with the sample policy, keep one event out of sample_rate when the buffer is full
+}
+
+// FilterCfg describes the lines that are dropped before reaching the parsers
+type FilterCfg struct {
+	Regexps []string `yaml:"regexp,omitempty"` //drop the lines matching any of these regexps
+	Expr    string   `yaml:"expr,omitempty"`   //drop the lines for which this expression is true
+}
+
+// RateLimitCfg describes how many lines per second a datasource can hand to the parsers
+type RateLimitCfg struct {
+	Rate   float64 `yaml:"rate"`             //lines per second
+	Burst  int     `yaml:"burst,omitempty"`  //lines allowed above the rate in a burst
+	Policy string  `yaml:"policy,omitempty"` //what to do with the lines above the limit : throttle (wait) or drop
+}
+
+// ReorderCfg describes how long the events of a datasource are held to be delivered in chronological order
+type ReorderCfg struct {
+	Window    *time.Duration `yaml:"window,omitempty"`     //how late an event can arrive and still be delivered in order
+	MaxEvents int            `yaml:"max_events,omitempty"` //deliver the oldest events early once the buffer holds this many events
+}
+
+// SamplingCfg describes how a datasource discards lines rather than falling behind under a flood
+type SamplingCfg struct {
+	Mode         string         `yaml:"mode,omitempty"`          //fixed (always keep one line out of rate) or adaptive
+	Rate         int            `yaml:"rate,omitempty"`          //keep one line out of rate (fixed), or at least one out of rate (adaptive)
+	Interval     *time.Duration `yaml:"interval,omitempty"`      //adaptive : how often the sampling rate is adjusted
+	HighPressure *float64       `yaml:"high_pressure,omitempty"` //adaptive : sample more when this ratio of the lines had to wait to be sent
+	LowPressure  *float64       `yaml:"low_pressure,omitempty"`  //adaptive : sample less when the ratio drops below this one
+}
+
+// RetryCfg describes how the network datasources retry a failed call to their backend
+type RetryCfg struct {
+	MaxAttempts int            `yaml:"max_attempts,omitempty"` //give up after this many attempts, 0 to retry forever
+	Base        *time.Duration `yaml:"base,omitempty"`         //delay before the first retry
+	Backoff     float64        `yaml:"backoff,omitempty"`      //multiplier applied to the delay after each retry
+	MaxDelay    *time.Duration `yaml:"max_delay,omitempty"`    //upper bound of the delay
+	Jitter      *float64       `yaml:"jitter,omitempty"`       //randomize the delay by up to this ratio, to avoid retrying in sync
+	RetryOn     []string       `yaml:"retry_on,omitempty"`     //only retry these error codes (eg. ThrottlingException, 503), all errors if empty
 }
 
 var TAIL_MODE = "tail"
 var CAT_MODE = "cat"
 var SERVER_MODE = "server" // No difference with tail, just a bit more verbose
+
+// ParseTime reads the since/until of the datasources : a RFC3339 date, or a duration before now (eg. 1h)
+func ParseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if duration, err := time.ParseDuration(value); err == nil {
+		return time.Now().UTC().Add(-duration), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
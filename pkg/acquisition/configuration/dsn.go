@@ -0,0 +1,93 @@
+package configuration
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// DSN is the datasource name given on the command line for one shot acquisition : <scheme>://<target>?<params>
+type DSN struct {
+	Scheme string
+	Target string
+	Params url.Values
+}
+
+// ParseDSN splits dsn, whose scheme must be one of schemes. The first scheme is the name of the datasource, the
+// others are aliases
+func ParseDSN(dsn string, schemes ...string) (*DSN, error) {
+	ret := &DSN{}
+	for _, scheme := range schemes {
+		if strings.HasPrefix(dsn, scheme+"://") {
+			ret.Scheme = scheme
+			break
+		}
+	}
+	if ret.Scheme == "" {
+		return nil, fmt.Errorf("invalid DSN %s for %s source, must start with %s://", dsn, schemes[0], schemes[0])
+	}
+	ret.Target = strings.TrimPrefix(dsn, ret.Scheme+"://")
+	query := ""
+	if idx := strings.Index(ret.Target, "?"); idx >= 0 {
+		ret.Target, query = ret.Target[:idx], ret.Target[idx+1:]
+	}
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s DSN : %s", schemes[0], err)
+	}
+	ret.Params = params
+	return ret, nil
+}
+
+// Param returns the value of the parameter key, or an empty string if it is not set
+func (d *DSN) Param(key string) (string, error) {
+	values := d.Params[key]
+	switch len(values) {
+	case 0:
+		return "", nil
+	case 1:
+		return values[0], nil
+	default:
+		return "", fmt.Errorf("expected zero or one value for '%s'", key)
+	}
+}
+
+// CheckParams returns an error if a parameter is not one of keys. log_level is always allowed
+func (d *DSN) CheckParams(keys ...string) error {
+	for key := range d.Params {
+		if key == "log_level" {
+			continue
+		}
+		known := false
+		for _, k := range keys {
+			if key == k {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("unsupported key %s in %s DSN", key, d.Scheme)
+		}
+	}
+	return nil
+}
+
+// SetLogLevel sets the level of logger from the log_level parameter, if any
+func (d *DSN) SetLogLevel(logger *log.Entry) error {
+	if _, ok := d.Params["log_level"]; !ok {
+		return nil
+	}
+	value, err := d.Param("log_level")
+	if err != nil {
+		return err
+	}
+	lvl, err := log.ParseLevel(value)
+	if err != nil {
+		return errors.Wrapf(err, "unknown level %s", value)
+	}
+	logger.Logger.SetLevel(lvl)
+	return nil
+}
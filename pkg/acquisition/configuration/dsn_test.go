@@ -0,0 +1,70 @@
+package configuration
+
+import (
+	"testing"
+
+	"github.com/crowdsecurity/crowdsec/pkg/cstest"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDSN(t *testing.T) {
+	tests := []struct {
+		dsn            string
+		keys           []string
+		expectedErr    string
+		expectedScheme string
+		expectedTarget string
+	}{
+		{
+			dsn:         "asd://foo",
+			expectedErr: "invalid DSN asd://foo for journalctl source, must start with journalctl://",
+		},
+		{
+			dsn:         "journalctl://foo?%ZZ",
+			expectedErr: "could not parse journalctl DSN : invalid URL escape \"%ZZ\"",
+		},
+		{
+			dsn:         "journalctl://foo?bar=42",
+			expectedErr: "unsupported key bar in journalctl DSN",
+		},
+		{
+			dsn:         "journald://foo?since=1h&since=2h",
+			keys:        []string{"since"},
+			expectedErr: "expected zero or one value for 'since'",
+		},
+		{
+			dsn:         "journalctl://foo?log_level=foobar",
+			expectedErr: "unknown level foobar: not a valid logrus Level:",
+		},
+		{
+			dsn:            "journald://foo/bar?since=1h&log_level=warn",
+			keys:           []string{"since"},
+			expectedScheme: "journald",
+			expectedTarget: "foo/bar",
+		},
+		{
+			dsn:            "journalctl://",
+			expectedScheme: "journalctl",
+		},
+	}
+	logger := log.WithField("type", "test")
+	for _, test := range tests {
+		d, err := ParseDSN(test.dsn, "journalctl", "journald")
+		if err == nil {
+			err = d.CheckParams(test.keys...)
+		}
+		if err == nil {
+			_, err = d.Param("since")
+		}
+		if err == nil {
+			err = d.SetLogLevel(logger)
+		}
+		cstest.AssertErrorContains(t, err, test.expectedErr)
+		if test.expectedErr != "" {
+			continue
+		}
+		assert.Equal(t, test.expectedScheme, d.Scheme)
+		assert.Equal(t, test.expectedTarget, d.Target)
+	}
+}
@@ -0,0 +1,82 @@
+package configuration
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	STATUS_STOPPED      = "stopped"
+	STATUS_RUNNING      = "running"
+	STATUS_RECONNECTING = "reconnecting"
+	STATUS_ERRORED      = "errored"
+	STATUS_PAUSED       = "paused"
+)
+
+// DataSourceStatus is the health of a datasource, as returned by Health()
+type DataSourceStatus struct {
+	State     string    `json:"state" yaml:"state"`
+	LastEvent time.Time `json:"last_event,omitempty" yaml:"last_event,omitempty"`
+	Error     string    `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// HealthTracker keeps the status of a datasource. Datasources embed it to implement Health(),
+// report their state changes with SetState, and call EventSeen for each event they read, before sending it
+type HealthTracker struct {
+	lock      sync.Mutex
+	state     string
+	err       string
+	lastEvent int64  //unix nano, updated without the lock as it is set for each event
+	seq       uint64 //lines seen
+	lines     prometheus.Counter
+	bytes     prometheus.Counter
+}
+
+func (h *HealthTracker) Health() DataSourceStatus {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	status := DataSourceStatus{State: h.state, Error: h.err}
+	if status.State == "" {
+		status.State = STATUS_STOPPED
+	}
+	if lastEvent := atomic.LoadInt64(&h.lastEvent); lastEvent != 0 {
+		status.LastEvent = time.Unix(0, lastEvent)
+	}
+	return status
+}
+
+// SetState changes the state of the datasource, err is kept as the error details (nil clears them)
+func (h *HealthTracker) SetState(state string, err error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.state = state
+	h.err = ""
+	if err != nil {
+		h.err = err.Error()
+	}
+}
+
+// CountLines makes EventSeen count the lines and their bytes. It is called before the datasource is started
+func (h *HealthTracker) CountLines(lines prometheus.Counter, bytes prometheus.Counter) {
+	h.lines = lines
+	h.bytes = bytes
+}
+
+// EventSeen numbers line (Line.Seq) and counts it, as read by the datasource
+func (h *HealthTracker) EventSeen(line *types.Line) {
+	line.Seq = atomic.AddUint64(&h.seq, 1)
+	if h.lines != nil {
+		h.lines.Inc()
+		h.bytes.Add(float64(len(line.Raw)))
+	}
+	atomic.StoreInt64(&h.lastEvent, time.Now().UnixNano())
+}
+
+// LinesSeen returns how many lines went through EventSeen
+func (h *HealthTracker) LinesSeen() uint64 {
+	return atomic.LoadUint64(&h.seq)
+}
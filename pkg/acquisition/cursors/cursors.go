@@ -0,0 +1,191 @@
+package cursors
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Store persists the position reached by the datasources (file offsets, journald cursors ...),
+// so that they can resume where they stopped after a restart
+type Store interface {
+	SaveCursor(datasource string, key string, value string) error
+	LoadCursor(datasource string, key string) (string, error) //returns an empty string if there is no cursor
+}
+
+type Cursor struct {
+	Value     string    `json:"value"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// FileStore keeps the cursors in memory and writes them to a json file.
+// Writes to disk are throttled, Flush must be called on shutdown to persist the latest positions
+type FileStore struct {
+	lock          sync.Mutex
+	path          string
+	cursors       map[string]map[string]Cursor
+	dirty         bool
+	lastFlush     time.Time
+	FlushInterval time.Duration
+}
+
+var DefaultFlushInterval = 5 * time.Second
+
+func NewFileStore(path string) (*FileStore, error) {
+	s := &FileStore{
+		path:          path,
+		cursors:       make(map[string]map[string]Cursor),
+		FlushInterval: DefaultFlushInterval,
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, errors.Wrapf(err, "while reading cursors file %s", path)
+	}
+	if len(content) == 0 {
+		return s, nil
+	}
+	if err := json.Unmarshal(content, &s.cursors); err != nil {
+		return nil, errors.Wrapf(err, "while parsing cursors file %s", path)
+	}
+	return s, nil
+}
+
+func (s *FileStore) SaveCursor(datasource string, key string, value string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.cursors[datasource]; !ok {
+		s.cursors[datasource] = make(map[string]Cursor)
+	}
+	s.cursors[datasource][key] = Cursor{Value: value, UpdatedAt: time.Now().UTC()}
+	s.dirty = true
+	if time.Since(s.lastFlush) < s.FlushInterval {
+		return nil
+	}
+	return s.flush()
+}
+
+func (s *FileStore) LoadCursor(datasource string, key string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.cursors[datasource][key].Value, nil
+}
+
+// List returns a copy of all the known cursors, by datasource and key
+func (s *FileStore) List() map[string]map[string]Cursor {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ret := make(map[string]map[string]Cursor, len(s.cursors))
+	for datasource, cursors := range s.cursors {
+		ret[datasource] = make(map[string]Cursor, len(cursors))
+		for key, cursor := range cursors {
+			ret[datasource][key] = cursor
+		}
+	}
+	return ret
+}
+
+// Delete removes the cursor of key, or all the cursors of datasource if key is empty.
+// It returns the number of deleted cursors
+func (s *FileStore) Delete(datasource string, key string) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	cursors, ok := s.cursors[datasource]
+	if !ok {
+		return 0, nil
+	}
+	deleted := 0
+	if key == "" {
+		deleted = len(cursors)
+		delete(s.cursors, datasource)
+	} else if _, ok := cursors[key]; ok {
+		deleted = 1
+		delete(cursors, key)
+		if len(cursors) == 0 {
+			delete(s.cursors, datasource)
+		}
+	}
+	if deleted > 0 {
+		s.dirty = true
+	}
+	return deleted, s.flush()
+}
+
+// Flush writes the cursors to disk if they changed since the last write
+func (s *FileStore) Flush() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.flush()
+}
+
+func (s *FileStore) flush() error {
+	if !s.dirty {
+		return nil
+	}
+	content, err := json.MarshalIndent(s.cursors, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "while marshaling cursors")
+	}
+	//write to a temporary file and rename it, to never leave a truncated file behind
+	tmpFile, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return errors.Wrap(err, "while creating temporary cursors file")
+	}
+	if _, err := tmpFile.Write(content); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return errors.Wrapf(err, "while writing %s", tmpFile.Name())
+	}
+	if err := tmpFile.Close(); err != nil {
+		os.Remove(tmpFile.Name())
+		return errors.Wrapf(err, "while closing %s", tmpFile.Name())
+	}
+	if err := os.Rename(tmpFile.Name(), s.path); err != nil {
+		os.Remove(tmpFile.Name())
+		return errors.Wrapf(err, "while renaming %s to %s", tmpFile.Name(), s.path)
+	}
+	s.dirty = false
+	s.lastFlush = time.Now()
+	log.Tracef("cursors written to %s", s.path)
+	return nil
+}
+
+var (
+	storeLock sync.RWMutex
+	store     Store
+)
+
+// SetStore sets the store used by the datasources, a nil store disables cursors
+func SetStore(s Store) {
+	storeLock.Lock()
+	defer storeLock.Unlock()
+	store = s
+}
+
+// SaveCursor saves the position of a datasource in the configured store, if any
+func SaveCursor(datasource string, key string, value string) error {
+	storeLock.RLock()
+	defer storeLock.RUnlock()
+	if store == nil {
+		return nil
+	}
+	return store.SaveCursor(datasource, key, value)
+}
+
+// LoadCursor returns the saved position of a datasource, or an empty string if there is none (or no configured store)
+func LoadCursor(datasource string, key string) (string, error) {
+	storeLock.RLock()
+	defer storeLock.RUnlock()
+	if store == nil {
+		return "", nil
+	}
+	return store.LoadCursor(datasource, key)
+}
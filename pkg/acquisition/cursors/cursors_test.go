@@ -0,0 +1,96 @@
+package cursors
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cursors")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cursors.json")
+
+	s, err := NewFileStore(path)
+	require.NoError(t, err)
+	value, err := s.LoadCursor("file", "/var/log/auth.log")
+	require.NoError(t, err)
+	assert.Equal(t, "", value)
+
+	s.FlushInterval = 0
+	require.NoError(t, s.SaveCursor("file", "/var/log/auth.log", "42"))
+	require.NoError(t, s.SaveCursor("file", "/var/log/syslog", "12"))
+	require.NoError(t, s.SaveCursor("journalctl", "journalctl-_SYSTEMD_UNIT=ssh.service", "s=abc"))
+
+	//reload from disk
+	s, err = NewFileStore(path)
+	require.NoError(t, err)
+	value, err = s.LoadCursor("file", "/var/log/auth.log")
+	require.NoError(t, err)
+	assert.Equal(t, "42", value)
+	assert.Len(t, s.List(), 2)
+	assert.Len(t, s.List()["file"], 2)
+
+	deleted, err := s.Delete("file", "/var/log/syslog")
+	require.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+	deleted, err = s.Delete("journalctl", "")
+	require.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+	deleted, err = s.Delete("docker", "")
+	require.NoError(t, err)
+	assert.Equal(t, 0, deleted)
+
+	s, err = NewFileStore(path)
+	require.NoError(t, err)
+	assert.Len(t, s.List(), 1)
+	assert.Len(t, s.List()["file"], 1)
+}
+
+func TestFileStoreThrottle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cursors")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cursors.json")
+
+	s, err := NewFileStore(path)
+	require.NoError(t, err)
+	require.NoError(t, s.SaveCursor("file", "/var/log/auth.log", "1"))
+	//the first save is written right away, the next ones wait for the flush interval
+	require.NoError(t, s.SaveCursor("file", "/var/log/auth.log", "2"))
+
+	reloaded, err := NewFileStore(path)
+	require.NoError(t, err)
+	value, _ := reloaded.LoadCursor("file", "/var/log/auth.log")
+	assert.Equal(t, "1", value)
+
+	require.NoError(t, s.Flush())
+	reloaded, err = NewFileStore(path)
+	require.NoError(t, err)
+	value, _ = reloaded.LoadCursor("file", "/var/log/auth.log")
+	assert.Equal(t, "2", value)
+}
+
+func TestGlobalStore(t *testing.T) {
+	value, err := LoadCursor("file", "foo")
+	require.NoError(t, err)
+	assert.Equal(t, "", value)
+	require.NoError(t, SaveCursor("file", "foo", "1"))
+
+	dir, err := ioutil.TempDir("", "cursors")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	s, err := NewFileStore(filepath.Join(dir, "cursors.json"))
+	require.NoError(t, err)
+	SetStore(s)
+	defer SetStore(nil)
+	require.NoError(t, SaveCursor("file", "foo", "1"))
+	value, err = LoadCursor("file", "foo")
+	require.NoError(t, err)
+	assert.Equal(t, "1", value)
+}
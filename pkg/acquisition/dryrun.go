@@ -0,0 +1,97 @@
+package acquisition
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	tomb "gopkg.in/tomb.v2"
+)
+
+// how long a dry-run waits for a datasource to stop once it's over
+var dryRunStopTimeout = 5 * time.Second
+
+// DryRunResult is what a datasource did during a dry-run
+type DryRunResult struct {
+	Datasource string        `json:"datasource"`
+	Name       string        `json:"name"`
+	Mode       string        `json:"mode"`
+	Lines      []types.Line  `json:"lines"`
+	FirstLine  time.Duration `json:"first_line"` //how long it took to read the first line
+	State      string        `json:"state"`
+	Error      string        `json:"error,omitempty"`
+}
+
+// DryRun starts a datasource with its acquisition stages, and stops it once it has read maxLines lines, the timeout
+// elapsed, or it's over (cat mode). Push datasources (ie. syslog) don't read anything unless something is sent to them,
+// the dry-run then only checks they could be started
+func DryRun(source DataSource, maxLines int, timeout time.Duration) DryRunResult {
+	result := DryRunResult{
+		Datasource: source.GetName(),
+		Name:       sourceNames[source.GetUuid()],
+		Mode:       source.GetMode(),
+		Lines:      []types.Line{},
+		State:      configuration.STATUS_STOPPED,
+	}
+	if result.Name == "" {
+		result.Name = source.GetName()
+	}
+	if err := source.CanRun(); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	output := make(chan types.Event)
+	dryRunTomb := tomb.Tomb{}
+	start := time.Now()
+	startSource(source, output, &dryRunTomb)
+	//in cat mode, the tomb is dead once the datasource has read everything
+	done := make(chan struct{})
+	go func() {
+		dryRunTomb.Wait()
+		close(done)
+	}()
+	deadline := time.After(timeout)
+READ:
+	for len(result.Lines) < maxLines {
+		select {
+		case evt := <-output:
+			if len(result.Lines) == 0 {
+				result.FirstLine = time.Since(start)
+			}
+			result.Lines = append(result.Lines, evt.Line)
+		case <-done:
+			break READ
+		case <-deadline:
+			break READ
+		}
+	}
+	health := source.Health()
+	result.State = health.State
+	if health.Error != "" {
+		result.Error = health.Error
+	}
+	dryRunTomb.Kill(nil)
+	//the datasource and the stages may be blocked sending an event
+	go func() {
+		for {
+			select {
+			case <-output:
+			case <-done:
+				return
+			}
+		}
+	}()
+	select {
+	case <-done:
+		if err := dryRunTomb.Err(); err != nil && result.Error == "" {
+			result.Error = err.Error()
+		}
+	case <-time.After(dryRunStopTimeout):
+		if result.Error == "" {
+			result.Error = fmt.Sprintf("datasource did not stop within %s", dryRunStopTimeout)
+		}
+	}
+	forgetSourceHealth(source.GetUuid())
+	return result
+}
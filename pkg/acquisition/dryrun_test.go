@@ -0,0 +1,49 @@
+package acquisition
+
+import (
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"gotest.tools/v3/assert"
+)
+
+func TestDryRun(t *testing.T) {
+	//cat : the dry-run is over once everything is read
+	cat := &MockCat{}
+	cat.UniqueId = "dryrun-cat"
+	sourceNames[cat.UniqueId] = "dryrun_cat"
+	defer forgetSource(cat.UniqueId)
+	result := DryRun(cat, 100, 10*time.Second)
+	assert.Equal(t, "mock_cat", result.Datasource)
+	assert.Equal(t, "dryrun_cat", result.Name)
+	assert.Equal(t, 10, len(result.Lines))
+	assert.Equal(t, "test", result.Lines[0].Src)
+	assert.Equal(t, configuration.STATUS_STOPPED, result.State)
+	assert.Equal(t, "", result.Error)
+
+	//tail : the dry-run stops after the requested lines
+	tail := &MockTail{}
+	tail.UniqueId = "dryrun-tail"
+	defer forgetSource(tail.UniqueId)
+	result = DryRun(tail, 3, 10*time.Second)
+	assert.Equal(t, "mock_tail", result.Name)
+	assert.Equal(t, 3, len(result.Lines))
+	assert.Assert(t, result.FirstLine > 0)
+	assert.Equal(t, configuration.STATUS_RUNNING, result.State)
+	assert.Equal(t, "", result.Error)
+
+	//the errors of the datasource are reported
+	failing := &MockFailingTail{}
+	failing.UniqueId = "dryrun-failing"
+	defer forgetSource(failing.UniqueId)
+	result = DryRun(failing, 3, 10*time.Second)
+	assert.Equal(t, 0, len(result.Lines))
+	assert.Equal(t, configuration.STATUS_ERRORED, result.State)
+	assert.Equal(t, "connection refused", result.Error)
+
+	//sources that can't run are not started
+	cantRun := &MockSourceCantRun{}
+	result = DryRun(cantRun, 3, 10*time.Second)
+	assert.Equal(t, "can't run bro", result.Error)
+}
@@ -0,0 +1,133 @@
+package acquisition
+
+import (
+	"bytes"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	tomb "gopkg.in/tomb.v2"
+)
+
+var (
+	utf8BOM    = []byte{0xEF, 0xBB, 0xBF}
+	utf16LEBOM = []byte{0xFF, 0xFE}
+	utf16BEBOM = []byte{0xFE, 0xFF}
+)
+
+// lineDecoders holds the decoder of the datasources that have an encoding configured, by datasource unique id
+var lineDecoders = map[string]*lineDecoder{}
+
+// lineDecoder transcodes the lines of a datasource to utf-8, so that the parsers regexps can match them
+type lineDecoder struct {
+	encoding string //canonical name of the encoding, ie. utf-16le or windows-1252
+	decoder  *encoding.Decoder
+	detected map[string]string //encoding given by the BOM at the start of each source (file, container ...)
+}
+
+func newLineDecoder(name string) (*lineDecoder, error) {
+	//the labels are the ones of the WHATWG encoding standard : utf-16 is little endian, latin1 is windows-1252 ...
+	enc, err := htmlindex.Get(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unknown encoding %s", name)
+	}
+	canonical, err := htmlindex.Name(enc)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unknown encoding %s", name)
+	}
+	return &lineDecoder{
+		encoding: canonical,
+		decoder:  enc.NewDecoder(),
+		detected: map[string]string{},
+	}, nil
+}
+
+func (d *lineDecoder) isUTF16() bool {
+	return d.encoding == "utf-16le" || d.encoding == "utf-16be"
+}
+
+// decodeUTF16 decodes a line that was split on the '\n' byte : the other byte of the utf-16 newline was left at the
+// start of the next line in little endian, and at the end of the line in big endian
+func decodeUTF16(line []byte, bigEndian bool) string {
+	if len(line)%2 == 1 {
+		if !bigEndian && line[0] == 0 {
+			line = line[1:]
+		} else {
+			line = line[:len(line)-1]
+		}
+	}
+	units := make([]uint16, len(line)/2)
+	for i := range units {
+		if bigEndian {
+			units[i] = uint16(line[2*i])<<8 | uint16(line[2*i+1])
+		} else {
+			units[i] = uint16(line[2*i]) | uint16(line[2*i+1])<<8
+		}
+	}
+	return strings.TrimRight(string(utf16.Decode(units)), "\r")
+}
+
+// decode transcodes a line read from src. A BOM at the start of the line sets the encoding of the lines that follow
+// from the same src, until the next BOM
+func (d *lineDecoder) decode(src string, raw string) (string, error) {
+	line := []byte(raw)
+	switch {
+	case bytes.HasPrefix(line, utf8BOM):
+		d.detected[src] = "utf-8"
+		line = line[len(utf8BOM):]
+	case d.isUTF16() && bytes.HasPrefix(line, utf16LEBOM):
+		d.detected[src] = "utf-16le"
+		line = line[len(utf16LEBOM):]
+	case d.isUTF16() && bytes.HasPrefix(line, utf16BEBOM):
+		d.detected[src] = "utf-16be"
+		line = line[len(utf16BEBOM):]
+	}
+	enc, ok := d.detected[src]
+	if !ok {
+		enc = d.encoding
+	}
+	switch enc {
+	case "utf-8":
+		return string(line), nil
+	case "utf-16le":
+		return decodeUTF16(line, false), nil
+	case "utf-16be":
+		return decodeUTF16(line, true), nil
+	}
+	ret, err := d.decoder.Bytes(line)
+	if err != nil {
+		return raw, err
+	}
+	return string(ret), nil
+}
+
+// run transcodes the lines from input to utf-8 and forwards them to output
+func (d *lineDecoder) run(input chan types.Event, output chan types.Event, AcquisTomb *tomb.Tomb, logger *log.Entry) {
+	defer types.CatchPanic("crowdsec/acquis/encoding")
+	logger.Debugf("transcoding lines from %s", d.encoding)
+	for {
+		select {
+		case <-AcquisTomb.Dead():
+			logger.Debugf("encoding is dead")
+			return
+		case evt, ok := <-input:
+			if !ok {
+				return
+			}
+			line, err := d.decode(evt.Line.Src, evt.Line.Raw)
+			if err != nil {
+				logger.Debugf("cannot transcode line from %s, keeping it as is : %s", evt.Line.Src, err)
+			}
+			//like the datasources, skip the empty lines : in utf-16, they were not empty before decoding
+			if line == "" {
+				continue
+			}
+			evt.Line.Raw = line
+			sendEvent(output, evt, AcquisTomb)
+		}
+	}
+}
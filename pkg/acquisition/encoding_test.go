@@ -0,0 +1,92 @@
+package acquisition
+
+import (
+	"bytes"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	log "github.com/sirupsen/logrus"
+	tomb "gopkg.in/tomb.v2"
+	"gotest.tools/v3/assert"
+)
+
+// encodeUTF16 encodes s the way it is written in a file, with a BOM
+func encodeUTF16(s string, bigEndian bool) []byte {
+	ret := []byte{0xFF, 0xFE}
+	if bigEndian {
+		ret = []byte{0xFE, 0xFF}
+	}
+	for _, unit := range utf16.Encode([]rune(s)) {
+		if bigEndian {
+			ret = append(ret, byte(unit>>8), byte(unit))
+		} else {
+			ret = append(ret, byte(unit), byte(unit>>8))
+		}
+	}
+	return ret
+}
+
+// splitLines splits data on the '\n' byte, like the datasources do
+func splitLines(data []byte) []string {
+	ret := []string{}
+	for _, line := range bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n")) {
+		ret = append(ret, string(line))
+	}
+	return ret
+}
+
+func runDecoder(t *testing.T, d *lineDecoder, src string, lines []string) []string {
+	in := make(chan types.Event)
+	out := make(chan types.Event, len(lines))
+	acquisTomb := tomb.Tomb{}
+	done := make(chan bool)
+	go func() {
+		d.run(in, out, &acquisTomb, log.WithField("test", "encoding"))
+		close(done)
+	}()
+	for _, line := range lines {
+		in <- types.Event{Line: types.Line{Raw: line, Src: src}}
+	}
+	close(in)
+	<-done
+	close(out)
+	ret := []string{}
+	for evt := range out {
+		ret = append(ret, evt.Line.Raw)
+	}
+	return ret
+}
+
+func TestEncodingConfig(t *testing.T) {
+	_, err := newLineDecoder("klingon")
+	assert.ErrorContains(t, err, "unknown encoding klingon")
+
+	d, err := newLineDecoder("UTF-16")
+	assert.NilError(t, err)
+	assert.Equal(t, "utf-16le", d.encoding)
+}
+
+func TestEncodingUTF16(t *testing.T) {
+	//empty lines are skipped, as they are by the datasources
+	expected := []string{"first line", "été \U0001F600", "last line"}
+	d, err := newLineDecoder("utf-16")
+	assert.NilError(t, err)
+	//the byte order is given by the BOM, for each source
+	le := splitLines(encodeUTF16("first line\r\nété \U0001F600\r\n\r\nlast line\r\n", false))
+	be := splitLines(encodeUTF16("first line\nété \U0001F600\n\nlast line\n", true))
+	assert.DeepEqual(t, expected, runDecoder(t, d, "le.log", le))
+	assert.DeepEqual(t, expected, runDecoder(t, d, "be.log", be))
+	//without BOM, the configured byte order is used
+	d, err = newLineDecoder("utf-16be")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, expected, runDecoder(t, d, "nobom.log", splitLines(encodeUTF16("first line\nété \U0001F600\n\nlast line\n", true)[2:])))
+}
+
+func TestEncodingLatin1(t *testing.T) {
+	d, err := newLineDecoder("iso-8859-1")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{"café", "naïve"}, runDecoder(t, d, "latin1.log", []string{"caf\xe9", "na\xefve"}))
+	//a utf-8 BOM switches the source to utf-8
+	assert.DeepEqual(t, []string{"café", "naïve"}, runDecoder(t, d, "utf8.log", []string{"\xef\xbb\xbfcafé", "naïve"}))
+}
@@ -0,0 +1,103 @@
+package acquisition
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/antonmedv/expr"
+	"github.com/antonmedv/expr/vm"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/exprhelpers"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	tomb "gopkg.in/tomb.v2"
+)
+
+var FilterDropped = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cs_acquisition_filtered_total",
+		Help: "Total lines dropped by the filter of a datasource.",
+	},
+	[]string{"datasource", "name"},
+)
+
+// dropFilters holds the filters of the datasources, by datasource unique id
+var dropFilters = map[string]*dropFilter{}
+
+// dropFilter discards the noisy lines (health checks, debug logs ...) read by a datasource, before they are parsed
+type dropFilter struct {
+	name    string
+	regexps []*regexp.Regexp
+	program *vm.Program
+}
+
+func newDropFilter(name string, config *configuration.FilterCfg) (*dropFilter, error) {
+	if len(config.Regexps) == 0 && config.Expr == "" {
+		return nil, fmt.Errorf("filter: regexp or expr is required")
+	}
+	f := &dropFilter{name: name}
+	for _, pattern := range config.Regexps {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "filter: invalid regexp '%s'", pattern)
+		}
+		f.regexps = append(f.regexps, re)
+	}
+	if config.Expr != "" {
+		program, err := expr.Compile(config.Expr, expr.Env(exprhelpers.GetExprEnv(map[string]interface{}{"evt": &types.Event{}})))
+		if err != nil {
+			return nil, errors.Wrapf(err, "filter: invalid expr '%s'", config.Expr)
+		}
+		f.program = program
+	}
+	return f, nil
+}
+
+func (f *dropFilter) drop(evt *types.Event, logger *log.Entry) bool {
+	for _, re := range f.regexps {
+		if re.MatchString(evt.Line.Raw) {
+			return true
+		}
+	}
+	if f.program == nil {
+		return false
+	}
+	output, err := expr.Run(f.program, exprhelpers.GetExprEnv(map[string]interface{}{"evt": evt}))
+	if err != nil {
+		logger.Errorf("while running filter expression : %s", err)
+		return false
+	}
+	switch out := output.(type) {
+	case bool:
+		return out
+	default:
+		logger.Errorf("filter expression returned %T instead of bool", output)
+		return false
+	}
+}
+
+// run forwards the events from input to output, except the ones matching the filter
+func (f *dropFilter) run(input chan types.Event, output chan types.Event, AcquisTomb *tomb.Tomb, datasource string, logger *log.Entry) {
+	defer types.CatchPanic("crowdsec/acquis/filter")
+	dropped := FilterDropped.WithLabelValues(datasource, f.name)
+	logger.Infof("filter started")
+	for {
+		select {
+		case <-AcquisTomb.Dead():
+			logger.Debugf("filter is dead")
+			return
+		case evt, ok := <-input:
+			if !ok {
+				return
+			}
+			if f.drop(&evt, logger) {
+				logger.Tracef("dropping %s", evt.Line.Raw)
+				dropped.Inc()
+				continue
+			}
+			sendEvent(output, evt, AcquisTomb)
+		}
+	}
+}
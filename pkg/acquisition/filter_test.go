@@ -0,0 +1,84 @@
+package acquisition
+
+import (
+	"testing"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	log "github.com/sirupsen/logrus"
+	tomb "gopkg.in/tomb.v2"
+	"gotest.tools/v3/assert"
+)
+
+func TestFilterConfig(t *testing.T) {
+	tests := []struct {
+		TestName      string
+		Config        configuration.FilterCfg
+		ExpectedError string
+	}{
+		{
+			TestName:      "empty filter",
+			Config:        configuration.FilterCfg{},
+			ExpectedError: "filter: regexp or expr is required",
+		},
+		{
+			TestName:      "invalid regexp",
+			Config:        configuration.FilterCfg{Regexps: []string{"[a-"}},
+			ExpectedError: "filter: invalid regexp '[a-'",
+		},
+		{
+			TestName:      "invalid expr",
+			Config:        configuration.FilterCfg{Expr: "evt.Line.Raw contains"},
+			ExpectedError: "filter: invalid expr 'evt.Line.Raw contains'",
+		},
+	}
+	for _, test := range tests {
+		_, err := newDropFilter("test", &test.Config)
+		assert.ErrorContains(t, err, test.ExpectedError, test.TestName)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	f, err := newDropFilter("test", &configuration.FilterCfg{
+		Regexps: []string{`GET /health`},
+		Expr:    `evt.Line.Labels.type == "nginx" && evt.Line.Raw contains "DEBUG"`,
+	})
+	assert.NilError(t, err)
+
+	tests := []struct {
+		Line     string
+		LogType  string
+		Expected bool
+	}{
+		{Line: `1.2.3.4 - - "GET /health HTTP/1.1" 200`, LogType: "nginx", Expected: true},
+		{Line: `1.2.3.4 - - "GET /login HTTP/1.1" 200`, LogType: "nginx", Expected: false},
+		{Line: `DEBUG something happened`, LogType: "nginx", Expected: true},
+		{Line: `DEBUG something happened`, LogType: "syslog", Expected: false},
+	}
+	logger := log.WithField("test", "filter")
+	for _, test := range tests {
+		evt := types.Event{}
+		evt.Line.Raw = test.Line
+		evt.Line.Labels = map[string]string{"type": test.LogType}
+		assert.Equal(t, test.Expected, f.drop(&evt, logger), test.Line)
+	}
+
+	//only the events that are not dropped reach output
+	in := make(chan types.Event)
+	out := make(chan types.Event, len(tests))
+	acquisTomb := tomb.Tomb{}
+	done := make(chan bool)
+	go func() {
+		f.run(in, out, &acquisTomb, "test", logger)
+		close(done)
+	}()
+	for _, test := range tests {
+		evt := types.Event{}
+		evt.Line.Raw = test.Line
+		evt.Line.Labels = map[string]string{"type": test.LogType}
+		in <- evt
+	}
+	close(in)
+	<-done
+	assert.Equal(t, 2, len(out))
+}
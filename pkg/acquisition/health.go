@@ -0,0 +1,125 @@
+package acquisition
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var datasourceStatusDesc = prometheus.NewDesc(
+	"cs_acquisition_datasource_status",
+	"State of a datasource (1 for the current state, 0 for the others). The last error is in cscli metrics or the health json.",
+	[]string{"datasource", "name", "state"},
+	nil,
+)
+
+var datasourceLastEventDesc = prometheus.NewDesc(
+	"cs_acquisition_datasource_last_event_timestamp",
+	"Timestamp of the last event read by a datasource.",
+	[]string{"datasource", "name"},
+	nil,
+)
+
+var datasourceStates = []string{configuration.STATUS_RUNNING, configuration.STATUS_RECONNECTING, configuration.STATUS_ERRORED, configuration.STATUS_STOPPED, configuration.STATUS_PAUSED}
+
+// sourceNames holds the name identifying the datasources in the metrics, by datasource unique id
+var sourceNames = map[string]string{}
+
+type startedSource struct {
+	source DataSource
+	name   string
+	gate   *pauseGate
+	since  time.Time
+}
+
+// startedSources holds the datasources reported by the health metrics, by datasource unique id.
+// It is read by the prometheus handler, so it is protected by startedSourcesLock
+var (
+	startedSources     = map[string]startedSource{}
+	startedSourcesLock sync.Mutex
+)
+
+// healthReporter is implemented by the datasources embedding configuration.HealthTracker
+type healthReporter interface {
+	SetState(string, error)
+}
+
+func setSourceState(source DataSource, state string, err error) {
+	if reporter, ok := source.(healthReporter); ok {
+		reporter.SetState(state, err)
+	}
+}
+
+func registerSourceHealth(source DataSource, gate *pauseGate) {
+	name, ok := sourceNames[source.GetUuid()]
+	if !ok {
+		name = source.GetName()
+	}
+	startedSourcesLock.Lock()
+	defer startedSourcesLock.Unlock()
+	startedSources[source.GetUuid()] = startedSource{source: source, name: name, gate: gate, since: time.Now()}
+}
+
+func forgetSourceHealth(uniqueId string) {
+	startedSourcesLock.Lock()
+	defer startedSourcesLock.Unlock()
+	delete(startedSources, uniqueId)
+}
+
+// DataSourceHealth is the status of a started datasource, as reported by GetHealth
+type DataSourceHealth struct {
+	Datasource string `json:"datasource"`
+	Name       string `json:"name"`
+	configuration.DataSourceStatus
+}
+
+// GetHealth returns the status of the started datasources, sorted by name
+func GetHealth() []DataSourceHealth {
+	startedSourcesLock.Lock()
+	ret := make([]DataSourceHealth, 0, len(startedSources))
+	for _, started := range startedSources {
+		status := started.source.Health()
+		//the datasource doesn't know it is paused, it is only blocked
+		if started.gate != nil && started.gate.isPaused() && status.State == configuration.STATUS_RUNNING {
+			status.State = configuration.STATUS_PAUSED
+		}
+		ret = append(ret, DataSourceHealth{
+			Datasource:       started.source.GetName(),
+			Name:             started.name,
+			DataSourceStatus: status,
+		})
+	}
+	startedSourcesLock.Unlock()
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
+
+// healthCollector exposes the status of the started datasources, computed when the metrics are scraped
+type healthCollector struct{}
+
+var HealthCollector prometheus.Collector = healthCollector{}
+
+func (c healthCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- datasourceStatusDesc
+	ch <- datasourceLastEventDesc
+}
+
+func (c healthCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, health := range GetHealth() {
+		for _, state := range datasourceStates {
+			value := 0.0
+			if state == health.State {
+				value = 1.0
+			}
+			ch <- prometheus.MustNewConstMetric(datasourceStatusDesc, prometheus.GaugeValue, value, health.Datasource, health.Name, state)
+		}
+		if !health.LastEvent.IsZero() {
+			ch <- prometheus.MustNewConstMetric(datasourceLastEventDesc, prometheus.GaugeValue, float64(health.LastEvent.Unix()), health.Datasource, health.Name)
+		}
+	}
+}
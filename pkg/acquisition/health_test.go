@@ -0,0 +1,120 @@
+package acquisition
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	tomb "gopkg.in/tomb.v2"
+	"gotest.tools/v3/assert"
+)
+
+type MockFailingTail struct {
+	MockTail
+}
+
+func (f *MockFailingTail) StreamingAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	return fmt.Errorf("connection refused")
+}
+
+func TestHealthTracker(t *testing.T) {
+	h := configuration.HealthTracker{}
+	status := h.Health()
+	assert.Equal(t, status.State, configuration.STATUS_STOPPED)
+	assert.Assert(t, status.LastEvent.IsZero())
+
+	h.SetState(configuration.STATUS_RECONNECTING, fmt.Errorf("connection refused"))
+	h.EventSeen(&types.Line{})
+	status = h.Health()
+	assert.Equal(t, status.State, configuration.STATUS_RECONNECTING)
+	assert.Equal(t, status.Error, "connection refused")
+	assert.Assert(t, time.Since(status.LastEvent) < time.Minute)
+
+	h.SetState(configuration.STATUS_RUNNING, nil)
+	status = h.Health()
+	assert.Equal(t, status.State, configuration.STATUS_RUNNING)
+	assert.Equal(t, status.Error, "")
+}
+
+func findHealth(name string) *DataSourceHealth {
+	for _, health := range GetHealth() {
+		if health.Name == name {
+			return &health
+		}
+	}
+	return nil
+}
+
+// collectStatus returns the value of the status metric of a datasource for each state
+func collectStatus(t *testing.T, name string) map[string]float64 {
+	ch := make(chan prometheus.Metric, 100)
+	HealthCollector.Collect(ch)
+	close(ch)
+	ret := map[string]float64{}
+	for metric := range ch {
+		if metric.Desc() != datasourceStatusDesc {
+			continue
+		}
+		m := dto.Metric{}
+		if err := metric.Write(&m); err != nil {
+			t.Fatalf("unexpected error : %s", err)
+		}
+		labels := map[string]string{}
+		for _, label := range m.GetLabel() {
+			labels[label.GetName()] = label.GetValue()
+		}
+		//free-form errors would make the cardinality explode
+		if _, ok := labels["error"]; ok {
+			t.Fatalf("unexpected error label in %v", labels)
+		}
+		if labels["name"] == name {
+			ret[labels["state"]] = m.GetGauge().GetValue()
+		}
+	}
+	return ret
+}
+
+func TestHealthStartAcquisition(t *testing.T) {
+	tail := &MockTail{}
+	tail.UniqueId = "health-tail"
+	sourceNames[tail.UniqueId] = "health_tail"
+	failing := &MockFailingTail{}
+	failing.UniqueId = "health-failing"
+	sourceNames[failing.UniqueId] = "health_failing"
+	defer forgetSource(tail.UniqueId)
+	defer forgetSource(failing.UniqueId)
+
+	out := make(chan types.Event)
+	acquisTomb := tomb.Tomb{}
+	startSource(tail, out, &acquisTomb)
+	for i := 0; i < 10; i++ {
+		<-out
+	}
+	health := findHealth("health_tail")
+	assert.Assert(t, health != nil)
+	assert.Equal(t, health.Datasource, "mock_tail")
+	assert.Equal(t, health.State, configuration.STATUS_RUNNING)
+	assert.DeepEqual(t, collectStatus(t, "health_tail"), map[string]float64{
+		configuration.STATUS_RUNNING:      1,
+		configuration.STATUS_RECONNECTING: 0,
+		configuration.STATUS_ERRORED:      0,
+		configuration.STATUS_STOPPED:      0,
+		configuration.STATUS_PAUSED:       0,
+	})
+
+	//a failing datasource kills the acquisition, and reports why
+	startSource(failing, out, &acquisTomb)
+	assert.Error(t, acquisTomb.Wait(), "connection refused")
+	health = findHealth("health_failing")
+	assert.Assert(t, health != nil)
+	assert.Equal(t, health.State, configuration.STATUS_ERRORED)
+	assert.Equal(t, health.Error, "connection refused")
+
+	//forgotten datasources are not reported anymore
+	forgetSource(failing.UniqueId)
+	assert.Assert(t, findHealth("health_failing") == nil)
+}
@@ -0,0 +1,183 @@
+package limits
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/time/rate"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// the tailers holding a slot give it back after this long if others are waiting for one
+var DefaultTailerQuantum = 1 * time.Minute
+
+var ActiveTailers = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "cs_acquisition_active_tailers",
+		Help: "Number of tailers (files, containers) currently holding a slot.",
+	},
+)
+
+var WaitingTailers = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "cs_acquisition_waiting_tailers",
+		Help: "Number of tailers (files, containers) waiting for a slot.",
+	},
+)
+
+// tailerSlots bounds the number of tailers (files, containers ...) reading at the same time, across all the
+// datasources. The slots are handed out in the order they were asked for, so that every tailer gets its turn
+type tailerSlots struct {
+	lock    sync.Mutex
+	max     int
+	quantum time.Duration
+	active  int
+	waiting *list.List //of chan struct{}, closed when the slot is handed to the waiter
+}
+
+var slots = &tailerSlots{quantum: DefaultTailerQuantum, waiting: list.New()}
+
+// SetMaxTailers sets the number of tailers allowed to read at the same time (0 means no limit), and how long a
+// tailer keeps its slot when others are waiting for one
+func SetMaxTailers(max int, quantum time.Duration) {
+	slots.lock.Lock()
+	defer slots.lock.Unlock()
+	slots.max = max
+	slots.quantum = quantum
+	if slots.quantum <= 0 {
+		slots.quantum = DefaultTailerQuantum
+	}
+	//a raised limit lets waiters in
+	for slots.waiting.Len() > 0 && (slots.max == 0 || slots.active < slots.max) {
+		slots.handOver()
+	}
+}
+
+// TailerQuantum returns how long a tailer keeps its slot when others are waiting, 0 if tailers are not limited
+func TailerQuantum() time.Duration {
+	slots.lock.Lock()
+	defer slots.lock.Unlock()
+	if slots.max == 0 {
+		return 0
+	}
+	return slots.quantum
+}
+
+// handOver gives a slot to the first waiter, with the lock held
+func (s *tailerSlots) handOver() {
+	first := s.waiting.Front()
+	s.waiting.Remove(first)
+	close(first.Value.(chan struct{}))
+	s.active++
+	ActiveTailers.Set(float64(s.active))
+	WaitingTailers.Set(float64(s.waiting.Len()))
+}
+
+// AcquireTailer waits for a slot, and returns false if dying is closed first. Every successful call must be
+// followed by a call to ReleaseTailer
+func AcquireTailer(dying <-chan struct{}) bool {
+	slots.lock.Lock()
+	if slots.waiting.Len() == 0 && (slots.max == 0 || slots.active < slots.max) {
+		slots.active++
+		ActiveTailers.Set(float64(slots.active))
+		slots.lock.Unlock()
+		return true
+	}
+	ready := make(chan struct{})
+	elem := slots.waiting.PushBack(ready)
+	WaitingTailers.Set(float64(slots.waiting.Len()))
+	slots.lock.Unlock()
+
+	select {
+	case <-ready:
+		return true
+	case <-dying:
+		slots.lock.Lock()
+		defer slots.lock.Unlock()
+		select {
+		case <-ready:
+			//the slot was handed over in the meantime, give it to the next one
+			slots.release()
+		default:
+			slots.waiting.Remove(elem)
+			WaitingTailers.Set(float64(slots.waiting.Len()))
+		}
+		return false
+	}
+}
+
+// ReleaseTailer gives back a slot obtained with AcquireTailer
+func ReleaseTailer() {
+	slots.lock.Lock()
+	defer slots.lock.Unlock()
+	slots.release()
+}
+
+func (s *tailerSlots) release() {
+	s.active--
+	ActiveTailers.Set(float64(s.active))
+	if s.waiting.Len() > 0 && (s.max == 0 || s.active < s.max) {
+		s.handOver()
+	}
+}
+
+// TailersWaiting returns true if some tailers are waiting for a slot
+func TailersWaiting() bool {
+	slots.lock.Lock()
+	defer slots.lock.Unlock()
+	return slots.waiting.Len() > 0
+}
+
+// readLimiter is the token bucket shared by all the datasources. Each datasource waits for its own token before
+// reading its next line, and tokens are granted in the order they were asked for : busy datasources get an equal
+// share of the rate, whatever their volume
+var readLimiter struct {
+	lock    sync.Mutex
+	limiter *rate.Limiter
+}
+
+// SetMaxReadRate sets the number of lines per second read by all the datasources together (0 means no limit)
+func SetMaxReadRate(linesPerSecond float64, burst int) {
+	readLimiter.lock.Lock()
+	defer readLimiter.lock.Unlock()
+	if linesPerSecond <= 0 {
+		readLimiter.limiter = nil
+		return
+	}
+	//a bucket needs room for at least one token
+	if burst <= 0 {
+		burst = 1
+	}
+	readLimiter.limiter = rate.NewLimiter(rate.Limit(linesPerSecond), burst)
+}
+
+// ReadRateLimited returns true if the datasources share a read rate
+func ReadRateLimited() bool {
+	readLimiter.lock.Lock()
+	defer readLimiter.lock.Unlock()
+	return readLimiter.limiter != nil
+}
+
+// WaitRead waits for the turn of a line under the shared read rate. It returns how long it waited, and false if
+// dying was closed first
+func WaitRead(dying <-chan struct{}) (time.Duration, bool) {
+	readLimiter.lock.Lock()
+	limiter := readLimiter.limiter
+	readLimiter.lock.Unlock()
+	if limiter == nil {
+		return 0, true
+	}
+	delay := limiter.Reserve().Delay()
+	if delay <= 0 {
+		return 0, true
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return delay, true
+	case <-dying:
+		return delay, false
+	}
+}
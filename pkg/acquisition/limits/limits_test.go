@@ -0,0 +1,112 @@
+package limits
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTailerSlots(t *testing.T) {
+	SetMaxTailers(2, time.Second)
+	defer SetMaxTailers(0, 0)
+	if TailerQuantum() != time.Second {
+		t.Fatalf("unexpected quantum %s", TailerQuantum())
+	}
+	dying := make(chan struct{})
+	if !AcquireTailer(dying) || !AcquireTailer(dying) {
+		t.Fatal("expected the first two tailers to get a slot")
+	}
+	if TailersWaiting() {
+		t.Fatal("no tailer should be waiting")
+	}
+
+	//the waiting tailers get the released slots in turn
+	order := make(chan int, 2)
+	for i := 1; i <= 2; i++ {
+		go func(i int) {
+			if AcquireTailer(dying) {
+				order <- i
+			}
+		}(i)
+		for !waiting(i) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	ReleaseTailer()
+	if first := <-order; first != 1 {
+		t.Fatalf("expected tailer 1 to get the slot first, got %d", first)
+	}
+	ReleaseTailer()
+	if second := <-order; second != 2 {
+		t.Fatalf("expected tailer 2 to get the slot, got %d", second)
+	}
+
+	//a tailer that stops waiting leaves the queue
+	stopped := make(chan struct{})
+	result := make(chan bool)
+	go func() {
+		result <- AcquireTailer(stopped)
+	}()
+	for !waiting(1) {
+		time.Sleep(time.Millisecond)
+	}
+	close(stopped)
+	if <-result {
+		t.Fatal("expected the stopped tailer to get no slot")
+	}
+	if TailersWaiting() {
+		t.Fatal("no tailer should be waiting")
+	}
+	ReleaseTailer()
+	ReleaseTailer()
+	if slots.active != 0 {
+		t.Fatalf("expected no active tailer, got %d", slots.active)
+	}
+}
+
+func waiting(n int) bool {
+	slots.lock.Lock()
+	defer slots.lock.Unlock()
+	return slots.waiting.Len() == n
+}
+
+func TestUnlimitedTailers(t *testing.T) {
+	SetMaxTailers(0, 0)
+	if TailerQuantum() != 0 {
+		t.Fatalf("unexpected quantum %s", TailerQuantum())
+	}
+	for i := 0; i < 100; i++ {
+		if !AcquireTailer(nil) {
+			t.Fatal("expected a slot")
+		}
+	}
+	for i := 0; i < 100; i++ {
+		ReleaseTailer()
+	}
+}
+
+func TestReadRate(t *testing.T) {
+	SetMaxReadRate(0, 0)
+	if ReadRateLimited() {
+		t.Fatal("expected no read rate")
+	}
+	if delay, ok := WaitRead(nil); delay != 0 || !ok {
+		t.Fatalf("unexpected wait (%s, %t)", delay, ok)
+	}
+
+	SetMaxReadRate(10, 1)
+	defer SetMaxReadRate(0, 0)
+	if !ReadRateLimited() {
+		t.Fatal("expected a read rate")
+	}
+	if delay, ok := WaitRead(nil); delay != 0 || !ok {
+		t.Fatalf("unexpected wait for the first line (%s, %t)", delay, ok)
+	}
+	if delay, ok := WaitRead(nil); delay <= 0 || !ok {
+		t.Fatalf("expected the second line to wait (%s, %t)", delay, ok)
+	}
+	dying := make(chan struct{})
+	close(dying)
+	if _, ok := WaitRead(dying); ok {
+		t.Fatal("expected the wait to be interrupted")
+	}
+}
@@ -0,0 +1,90 @@
+package acquisition
+
+import (
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	tomb "gopkg.in/tomb.v2"
+)
+
+const (
+	MAX_LINE_SIZE_POLICY_TRUNCATE = "truncate"
+	MAX_LINE_SIZE_POLICY_DROP     = "drop"
+)
+
+var OversizedLines = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cs_acquisition_oversized_lines_total",
+		Help: "Total lines above the max_line_size of a datasource, truncated or dropped.",
+	},
+	[]string{"datasource", "name", "policy"},
+)
+
+// lineSizeLimiters holds the max line size configuration of the datasources, by datasource unique id
+var lineSizeLimiters = map[string]*lineSizeLimiter{}
+
+// lineSizeLimiter keeps huge lines (ie. single-line json blobs) away from the parsers, whose regexps may choke on them
+type lineSizeLimiter struct {
+	name   string
+	size   int
+	policy string
+}
+
+func newLineSizeLimiter(name string, config *configuration.MaxLineSizeCfg) (*lineSizeLimiter, error) {
+	if config.Size <= 0 {
+		return nil, fmt.Errorf("max_line_size: size must be positive")
+	}
+	l := &lineSizeLimiter{
+		name:   name,
+		size:   config.Size,
+		policy: config.Policy,
+	}
+	switch l.policy {
+	case "":
+		l.policy = MAX_LINE_SIZE_POLICY_TRUNCATE
+	case MAX_LINE_SIZE_POLICY_TRUNCATE, MAX_LINE_SIZE_POLICY_DROP:
+	default:
+		return nil, fmt.Errorf("max_line_size: unknown policy '%s' (must be %s or %s)", l.policy, MAX_LINE_SIZE_POLICY_TRUNCATE, MAX_LINE_SIZE_POLICY_DROP)
+	}
+	return l, nil
+}
+
+// truncate cuts line to at most size bytes, without splitting a multi-byte character
+func (l *lineSizeLimiter) truncate(line string) string {
+	cut := l.size
+	for cut > 0 && !utf8.RuneStart(line[cut]) {
+		cut--
+	}
+	return line[:cut]
+}
+
+// run forwards the events from input to output, truncating or dropping the lines above the size
+func (l *lineSizeLimiter) run(input chan types.Event, output chan types.Event, AcquisTomb *tomb.Tomb, datasource string, logger *log.Entry) {
+	defer types.CatchPanic("crowdsec/acquis/linesize")
+	oversized := OversizedLines.WithLabelValues(datasource, l.name, l.policy)
+	for {
+		select {
+		case <-AcquisTomb.Dead():
+			logger.Debugf("max line size is dead")
+			return
+		case evt, ok := <-input:
+			if !ok {
+				return
+			}
+			if len(evt.Line.Raw) > l.size {
+				oversized.Inc()
+				if l.policy == MAX_LINE_SIZE_POLICY_DROP {
+					logger.Debugf("dropping a line of %d bytes from %s", len(evt.Line.Raw), evt.Line.Src)
+					continue
+				}
+				logger.Debugf("truncating a line of %d bytes from %s", len(evt.Line.Raw), evt.Line.Src)
+				evt.Line.Raw = l.truncate(evt.Line.Raw)
+			}
+			sendEvent(output, evt, AcquisTomb)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package acquisition
+
+import (
+	"testing"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	log "github.com/sirupsen/logrus"
+	tomb "gopkg.in/tomb.v2"
+	"gopkg.in/yaml.v2"
+	"gotest.tools/v3/assert"
+)
+
+func TestLineSizeConfig(t *testing.T) {
+	_, err := newLineSizeLimiter("test", &configuration.MaxLineSizeCfg{})
+	assert.ErrorContains(t, err, "size must be positive")
+	_, err = newLineSizeLimiter("test", &configuration.MaxLineSizeCfg{Size: 10, Policy: "split"})
+	assert.ErrorContains(t, err, "unknown policy 'split'")
+
+	cfg := configuration.DataSourceCommonCfg{}
+	assert.NilError(t, yaml.Unmarshal([]byte("max_line_size: 1024"), &cfg))
+	l, err := newLineSizeLimiter("test", cfg.MaxLineSize)
+	assert.NilError(t, err)
+	assert.Equal(t, 1024, l.size)
+	assert.Equal(t, MAX_LINE_SIZE_POLICY_TRUNCATE, l.policy)
+
+	assert.NilError(t, yaml.Unmarshal([]byte("max_line_size:\n  size: 10\n  policy: drop"), &cfg))
+	assert.DeepEqual(t, &configuration.MaxLineSizeCfg{Size: 10, Policy: MAX_LINE_SIZE_POLICY_DROP}, cfg.MaxLineSize)
+}
+
+func runLineSize(t *testing.T, l *lineSizeLimiter, lines []string) []string {
+	in := make(chan types.Event)
+	out := make(chan types.Event, len(lines))
+	acquisTomb := tomb.Tomb{}
+	done := make(chan bool)
+	go func() {
+		l.run(in, out, &acquisTomb, "mock", log.WithField("test", "linesize"))
+		close(done)
+	}()
+	for _, line := range lines {
+		in <- types.Event{Line: types.Line{Raw: line}}
+	}
+	close(in)
+	<-done
+	close(out)
+	ret := []string{}
+	for evt := range out {
+		ret = append(ret, evt.Line.Raw)
+	}
+	return ret
+}
+
+func TestLineSize(t *testing.T) {
+	l, err := newLineSizeLimiter("linesize_truncate", &configuration.MaxLineSizeCfg{Size: 5})
+	assert.NilError(t, err)
+	//multi-byte characters are not split
+	assert.DeepEqual(t, []string{"short", "trunc", "héh"}, runLineSize(t, l, []string{"short", "truncated", "héhé"}))
+	assert.Equal(t, float64(2), testutil.ToFloat64(OversizedLines.WithLabelValues("mock", "linesize_truncate", MAX_LINE_SIZE_POLICY_TRUNCATE)))
+
+	l, err = newLineSizeLimiter("linesize_drop", &configuration.MaxLineSizeCfg{Size: 5, Policy: MAX_LINE_SIZE_POLICY_DROP})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{"short"}, runLineSize(t, l, []string{"short", "dropped"}))
+	assert.Equal(t, float64(1), testutil.ToFloat64(OversizedLines.WithLabelValues("mock", "linesize_drop", MAX_LINE_SIZE_POLICY_DROP)))
+}
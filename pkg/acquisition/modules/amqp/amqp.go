@@ -0,0 +1,338 @@
+package amqpacquisition
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/retry"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/secrets"
+	leaky "github.com/crowdsecurity/crowdsec/pkg/leakybucket"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	amqp "github.com/rabbitmq/amqp091-go"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/tomb.v2"
+	"gopkg.in/yaml.v2"
+)
+
+var linesRead = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cs_amqpsource_hits_total",
+		Help: "Total messages that were read from AMQP queues.",
+	},
+	[]string{"queue"})
+
+var (
+	defaultTimeout   = 10 * time.Second
+	defaultHeartbeat = 30 * time.Second
+)
+
+const (
+	defaultURL           = "amqp://127.0.0.1:5672/"
+	defaultPrefetchCount = 100
+	defaultMaxMessageLen = 1024 * 1024
+)
+
+type AmqpTLSConfiguration struct {
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"` //client certificate, also used to authenticate if no username is set
+	KeyFile            string `yaml:"key_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+type AmqpConfiguration struct {
+	configuration.DataSourceCommonCfg `yaml:",inline"`
+	URL                               string                `yaml:"url"`             //eg. amqp://localhost:5672/vhost, or amqps:// for TLS
+	Queue                             string                `yaml:"queue"`           //queue to consume, it must exist
+	PrefetchCount                     int                   `yaml:"prefetch_count"`  //messages delivered before being acked
+	ConsumerTag                       string                `yaml:"consumer_tag"`    //generated by the server if empty
+	Exclusive                         bool                  `yaml:"exclusive"`       //no other consumer of the queue is allowed
+	Heartbeat                         *time.Duration        `yaml:"heartbeat"`       //the lowest of this one and the one of the server is used, 0 to use the one of the server
+	Timeout                           *time.Duration        `yaml:"timeout"`         //to connect, and for the answers of the server
+	MaxMessageLen                     int                   `yaml:"max_message_len"` //larger messages are skipped
+	Username                          string                `yaml:"username"`        //overrides the one of the url
+	Password                          string                `yaml:"password"`        //can be an env://, file:// or vault:// reference
+	TLS                               *AmqpTLSConfiguration `yaml:"tls"`
+}
+
+// AmqpSource consumes a queue of an AMQP 0-9-1 server (eg. RabbitMQ). The messages are acked once they were handed
+// to crowdsec : the server delivers again the ones that were not acked when the connection is lost
+type AmqpSource struct {
+	configuration.HealthTracker
+	config     AmqpConfiguration
+	logger     *log.Entry
+	url        string //only used for the host and port, the credentials and vhost are in amqpConfig
+	amqpConfig amqp.Config
+	password   *secrets.Secret //of the configuration, resolved again on each connection
+	dial       func() (consumer, error)
+	retrier    *retry.Retrier
+	server     string //url without the credentials, for the logs
+}
+
+func (a *AmqpSource) GetMetrics() []prometheus.Collector {
+	return []prometheus.Collector{linesRead}
+}
+
+func (a *AmqpSource) GetAggregMetrics() []prometheus.Collector {
+	return []prometheus.Collector{linesRead}
+}
+
+func (a *AmqpSource) Configure(yamlConfig []byte, logger *log.Entry) error {
+	a.logger = logger
+	config := AmqpConfiguration{}
+	config.Mode = configuration.TAIL_MODE
+	if err := yaml.UnmarshalStrict(yamlConfig, &config); err != nil {
+		return errors.Wrap(err, "Cannot parse amqp datasource configuration")
+	}
+	if config.Mode != configuration.TAIL_MODE {
+		return fmt.Errorf("unsupported mode %s for amqp datasource", config.Mode)
+	}
+	if config.URL == "" {
+		config.URL = defaultURL
+	}
+	serverURL, err := url.Parse(config.URL)
+	if err != nil {
+		//the error holds the url, which can hold the password
+		return fmt.Errorf("invalid url")
+	}
+	if serverURL.Scheme != "amqp" && serverURL.Scheme != "amqps" {
+		return fmt.Errorf("invalid url %s : scheme must be amqp or amqps", serverURL.Redacted())
+	}
+	if config.Queue == "" {
+		return fmt.Errorf("queue is mandatory")
+	}
+	if len(config.Queue) > 255 || len(config.ConsumerTag) > 255 {
+		return fmt.Errorf("queue and consumer_tag must be shorter than 256 bytes")
+	}
+	if config.PrefetchCount == 0 {
+		config.PrefetchCount = defaultPrefetchCount
+	}
+	if config.PrefetchCount < 0 || config.PrefetchCount > 65535 {
+		return fmt.Errorf("invalid prefetch_count %d", config.PrefetchCount)
+	}
+	if config.Heartbeat == nil {
+		config.Heartbeat = &defaultHeartbeat
+	}
+	if *config.Heartbeat != 0 && (*config.Heartbeat < time.Second || *config.Heartbeat > 65535*time.Second) {
+		return fmt.Errorf("invalid heartbeat %s", *config.Heartbeat)
+	}
+	if config.Timeout == nil {
+		config.Timeout = &defaultTimeout
+	}
+	if config.MaxMessageLen == 0 {
+		config.MaxMessageLen = defaultMaxMessageLen
+	}
+	if config.MaxMessageLen < 0 {
+		return fmt.Errorf("invalid max_message_len %d", config.MaxMessageLen)
+	}
+	//an empty path is the default vhost, the other ones are escaped (eg. %2f for /)
+	vhost := strings.TrimPrefix(serverURL.Path, "/")
+	if vhost == "" {
+		vhost = "/"
+	}
+	a.amqpConfig = amqp.Config{
+		Vhost: vhost,
+		//like the other clients, the lowest heartbeat wins, 0 leaving the choice to the server
+		Heartbeat:  *config.Heartbeat,
+		Properties: amqp.Table{"product": "crowdsec", "platform": "Go"},
+		Locale:     "en_US",
+		Dial:       amqp.DefaultDial(*config.Timeout),
+	}
+	if config.TLS != nil && serverURL.Scheme != "amqps" {
+		return fmt.Errorf("the tls section requires an amqps:// url")
+	}
+	if serverURL.Scheme == "amqps" {
+		if config.TLS == nil {
+			config.TLS = &AmqpTLSConfiguration{}
+		}
+		if err := a.configureTLS(config.TLS); err != nil {
+			return err
+		}
+	}
+	if err := a.configureAuth(config, serverURL); err != nil {
+		return err
+	}
+	a.url = config.URL
+	a.server = serverURL.Redacted()
+	a.dial = a.dialConsumer
+	a.retrier, err = retry.New(config.Retry, a.logger)
+	if err != nil {
+		return err
+	}
+	a.retrier.Notify = a.notifyRetry
+	a.config = config
+	return nil
+}
+
+// configureAuth picks the credentials : the ones of the configuration, else the ones of the url, else the client
+// certificate, else the guest account like the other clients
+func (a *AmqpSource) configureAuth(config AmqpConfiguration, serverURL *url.URL) error {
+	password, err := secrets.NewSecret(config.Password, a.logger)
+	if err != nil {
+		return errors.Wrap(err, "invalid password")
+	}
+	switch {
+	case config.Username != "":
+		a.password = password
+		a.amqpConfig.SASL = []amqp.Authentication{&amqp.PlainAuth{Username: config.Username, Password: password.Get()}}
+	case password.Get() != "":
+		return fmt.Errorf("password requires a username")
+	case serverURL.User != nil:
+		urlPassword, _ := serverURL.User.Password()
+		a.amqpConfig.SASL = []amqp.Authentication{&amqp.PlainAuth{Username: serverURL.User.Username(), Password: urlPassword}}
+	case config.TLS != nil && config.TLS.CertFile != "":
+		a.amqpConfig.SASL = []amqp.Authentication{&amqp.ExternalAuth{}}
+	default:
+		a.amqpConfig.SASL = []amqp.Authentication{&amqp.PlainAuth{Username: "guest", Password: "guest"}}
+	}
+	return nil
+}
+
+func (a *AmqpSource) configureTLS(config *AmqpTLSConfiguration) error {
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify, MinVersion: tls.VersionTLS12}
+	if config.CAFile != "" {
+		pem, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return errors.Wrapf(err, "while reading tls.ca_file %s", config.CAFile)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in tls.ca_file %s", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		return fmt.Errorf("tls.cert_file and tls.key_file must be set together")
+	}
+	if config.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return errors.Wrap(err, "could not load client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	a.amqpConfig.TLSClientConfig = tlsConfig
+	return nil
+}
+
+// notifyRetry reports the failing connections in the health of the datasource
+func (a *AmqpSource) notifyRetry(err error) {
+	if err != nil {
+		a.SetState(configuration.STATUS_RECONNECTING, err)
+	} else {
+		a.SetState(configuration.STATUS_RUNNING, nil)
+	}
+}
+
+func (a *AmqpSource) ConfigureByDSN(dsn string, labels map[string]string, logger *log.Entry) error {
+	return fmt.Errorf("amqp datasource does not support one shot acquisition")
+}
+
+func (a *AmqpSource) GetMode() string {
+	return a.config.Mode
+}
+
+func (a *AmqpSource) GetName() string {
+	return "amqp"
+}
+
+func (a *AmqpSource) GetUuid() string {
+	return a.config.UniqueId
+}
+
+func (a *AmqpSource) OneShotAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	return fmt.Errorf("amqp datasource does not support one shot acquisition")
+}
+
+func (a *AmqpSource) CanRun() error {
+	return nil
+}
+
+func (a *AmqpSource) Dump() interface{} {
+	return a
+}
+
+// handle hands a message to crowdsec. It returns false if dying was closed meanwhile
+func (a *AmqpSource) handle(d amqp.Delivery, out chan types.Event, dying <-chan struct{}, expectMode int) bool {
+	if len(d.Body) > a.config.MaxMessageLen {
+		a.logger.Warningf("skipping message %d : %d bytes is larger than %d bytes", d.DeliveryTag, len(d.Body), a.config.MaxMessageLen)
+		return true
+	}
+	l := types.Line{}
+	l.Raw = string(d.Body)
+	//the routing key is the queue name for the messages published on the default exchange
+	l.Src = d.RoutingKey
+	if l.Src == "" {
+		l.Src = a.config.Queue
+	}
+	l.Time = time.Now().UTC()
+	l.Labels = a.config.Labels
+	l.Process = true
+	l.Module = a.GetName()
+	linesRead.With(prometheus.Labels{"queue": a.config.Queue}).Inc()
+	a.EventSeen(&l)
+	select {
+	case out <- types.Event{Line: l, Process: true, Type: types.LOG, ExpectMode: expectMode}:
+		return true
+	case <-dying:
+		return false
+	}
+}
+
+// consume reads the queue, until the connection fails or dying is closed
+func (a *AmqpSource) consume(out chan types.Event, dying <-chan struct{}, expectMode int) error {
+	c, err := a.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	a.logger.Infof("consuming queue %s", a.config.Queue)
+	a.SetState(configuration.STATUS_RUNNING, nil)
+	deliveries := c.Deliveries()
+	for {
+		select {
+		case <-dying:
+			return nil
+		case d, ok := <-deliveries:
+			if !ok {
+				return c.Err()
+			}
+			if !a.handle(d, out, dying, expectMode) {
+				//not acked, the server will deliver the message again
+				return nil
+			}
+			if err := d.Ack(false); err != nil {
+				return errors.Wrap(err, "while acking message")
+			}
+		}
+	}
+}
+
+func (a *AmqpSource) StreamingAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	expectMode := leaky.LIVE
+	if a.config.UseTimeMachine {
+		expectMode = leaky.TIMEMACHINE
+	}
+	t.Go(func() error {
+		defer types.CatchPanic("crowdsec/acquis/amqp/live")
+		a.logger.Infof("connecting to %s", a.server)
+		err := a.retrier.Do(t.Dying(), func() error {
+			return a.consume(out, t.Dying(), expectMode)
+		})
+		if err == retry.ErrDying || err == nil {
+			a.logger.Infof("amqp datasource stopping")
+			return nil
+		}
+		err = errors.Wrapf(err, "while consuming queue %s", a.config.Queue)
+		a.SetState(configuration.STATUS_ERRORED, err)
+		return err
+	})
+	return nil
+}
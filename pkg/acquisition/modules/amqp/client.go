@@ -0,0 +1,117 @@
+package amqpacquisition
+
+import (
+	"fmt"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/retry"
+	"github.com/pkg/errors"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// consumer is the part of an amqp091-go connection used by the datasource : a channel consuming the queue with
+// manual acks
+type consumer interface {
+	// Deliveries is closed when the connection or the channel is closed
+	Deliveries() <-chan amqp.Delivery
+	// Err tells why Deliveries was closed
+	Err() error
+	// Close closes the connection, the server then requeues the deliveries that were not acked
+	Close() error
+}
+
+// amqpError is a connection or channel closed by the server, its reply code (eg. 403 ACCESS_REFUSED, 404 NOT_FOUND)
+// can be matched in retry_on
+type amqpError struct {
+	Code int
+	Text string
+}
+
+func (e *amqpError) Error() string {
+	return fmt.Sprintf("%s (code %d)", e.Text, e.Code)
+}
+
+func (e *amqpError) StatusCode() int {
+	return e.Code
+}
+
+// wrapError turns the errors of the server into amqpError, the ones coming from the configuration (access refused,
+// unknown queue or vhost) are not retried
+func wrapError(err error) error {
+	var serverErr *amqp.Error
+	if !errors.As(err, &serverErr) {
+		return err
+	}
+	ret := &amqpError{Code: serverErr.Code, Text: serverErr.Reason}
+	if ret.Code == amqp.AccessRefused || ret.Code == amqp.NotFound || ret.Code == amqp.NotAllowed {
+		return retry.Permanent(ret)
+	}
+	return ret
+}
+
+type amqpConsumer struct {
+	conn       *amqp.Connection
+	deliveries <-chan amqp.Delivery
+	closed     chan *amqp.Error
+	cancelled  chan string
+}
+
+// dialConsumer connects to the server, and starts consuming the queue
+func (a *AmqpSource) dialConsumer() (consumer, error) {
+	config := a.amqpConfig
+	if config.TLSClientConfig != nil {
+		//the client sets the server name of the tls configuration it is given
+		config.TLSClientConfig = config.TLSClientConfig.Clone()
+	}
+	if a.password != nil {
+		config.SASL = []amqp.Authentication{&amqp.PlainAuth{Username: a.config.Username, Password: a.password.Get()}}
+	}
+	conn, err := amqp.DialConfig(a.url, config)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(wrapError(err), "while opening channel")
+	}
+	c := &amqpConsumer{
+		conn: conn,
+		//the reason is sent before the deliveries are closed
+		closed:    ch.NotifyClose(make(chan *amqp.Error, 1)),
+		cancelled: ch.NotifyCancel(make(chan string, 1)),
+	}
+	if err := ch.Qos(a.config.PrefetchCount, 0, false); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(wrapError(err), "while setting prefetch count")
+	}
+	c.deliveries, err = ch.Consume(a.config.Queue, a.config.ConsumerTag, false, a.config.Exclusive, false, false, nil)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrapf(wrapError(err), "while consuming queue %s", a.config.Queue)
+	}
+	return c, nil
+}
+
+func (c *amqpConsumer) Deliveries() <-chan amqp.Delivery {
+	return c.deliveries
+}
+
+func (c *amqpConsumer) Err() error {
+	select {
+	case err := <-c.closed:
+		if err != nil {
+			return wrapError(err)
+		}
+	default:
+	}
+	select {
+	case <-c.cancelled:
+		return fmt.Errorf("consumer cancelled by the server, was the queue deleted ?")
+	default:
+	}
+	return fmt.Errorf("connection closed")
+}
+
+func (c *amqpConsumer) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,84 @@
+package azureblobacquisition
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/retry"
+	"github.com/pkg/errors"
+)
+
+// imdsEndpoint is the token endpoint of the instance metadata service of the Azure VMs
+var imdsEndpoint = "http://169.254.169.254/metadata/identity/oauth2/token"
+
+const (
+	storageResource = "https://storage.azure.com/"
+	//the tokens are renewed a bit before they expire, so that a request doesn't fail with an expired one
+	tokenRefreshMargin = 5 * time.Minute
+)
+
+// managedIdentity gets the tokens of the managed identity of the host from the instance metadata service, and keeps
+// them until they are about to expire
+type managedIdentity struct {
+	client   *http.Client
+	clientID string //of a user assigned identity, the system assigned one is used if empty
+	lock     sync.Mutex
+	token    string
+	expires  time.Time
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   string `json:"expires_in"` //seconds
+}
+
+func (m *managedIdentity) Token() (string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.token != "" && time.Now().Before(m.expires) {
+		return m.token, nil
+	}
+	params := url.Values{}
+	params.Set("api-version", "2018-02-01")
+	params.Set("resource", storageResource)
+	if m.clientID != "" {
+		params.Set("client_id", m.clientID)
+	}
+	req, err := http.NewRequest(http.MethodGet, imdsEndpoint+"?"+params.Encode(), nil)
+	if err != nil {
+		return "", retry.Permanent(err)
+	}
+	req.Header.Set("Metadata", "true")
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "while requesting a token of the managed identity")
+	}
+	defer resp.Body.Close()
+	if err := retry.CheckResponse(resp); err != nil {
+		return "", errors.Wrap(err, "while requesting a token of the managed identity")
+	}
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", errors.Wrap(err, "while reading token response")
+	}
+	ret := tokenResponse{}
+	if err := json.Unmarshal(content, &ret); err != nil {
+		return "", errors.Wrap(err, "invalid token response")
+	}
+	if ret.AccessToken == "" {
+		return "", fmt.Errorf("no access_token in token response")
+	}
+	expiresIn, err := strconv.Atoi(ret.ExpiresIn)
+	if err != nil {
+		return "", fmt.Errorf("invalid expires_in '%s' in token response", ret.ExpiresIn)
+	}
+	m.token = ret.AccessToken
+	m.expires = time.Now().Add(time.Duration(expiresIn)*time.Second - tokenRefreshMargin)
+	return m.token, nil
+}
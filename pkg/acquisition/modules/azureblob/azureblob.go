@@ -0,0 +1,669 @@
+package azureblobacquisition
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/cursors"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/retry"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/secrets"
+	leaky "github.com/crowdsecurity/crowdsec/pkg/leakybucket"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/tomb.v2"
+	"gopkg.in/yaml.v2"
+)
+
+var linesRead = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cs_azureblobsource_hits_total",
+		Help: "Total lines that were read from Azure Storage blobs.",
+	},
+	[]string{"container"})
+
+var (
+	defaultPollInterval = time.Minute
+	defaultTimeout      = 30 * time.Second
+)
+
+const (
+	FORMAT_LINES   = "lines"
+	FORMAT_RECORDS = "records"
+	//version of the storage REST API, the bearer tokens require 2017-11-09 or later
+	storageVersion = "2020-10-02"
+)
+
+type AzureBlobConfiguration struct {
+	configuration.DataSourceCommonCfg `yaml:",inline"`
+	AccountName                       string         `yaml:"account_name"`
+	AccountURL                        string         `yaml:"account_url"` //https://<account_name>.blob.core.windows.net by default, for the other clouds or azurite
+	Container                         string         `yaml:"container"`   //eg. insights-logs-networksecuritygroupflowevent, or $logs for the storage analytics logs
+	Prefix                            string         `yaml:"prefix"`
+	Format                            string         `yaml:"format"`    //lines (default) : one event by line, records : one event by element of the records array (NSG flow logs)
+	SASToken                          string         `yaml:"sas_token"` //can be an env://, file:// or vault:// reference. Without it, the managed identity of the host is used
+	ClientID                          string         `yaml:"client_id"` //of the user assigned managed identity to use
+	PollInterval                      *time.Duration `yaml:"poll_interval"`
+	Timeout                           *time.Duration `yaml:"timeout"`
+	Since                             string         `yaml:"since"` //RFC3339 date, or duration before now (eg. 1h). Blobs modified before are skipped
+	Until                             string         `yaml:"until"` //cat mode only
+}
+
+// AzureBlobSource reads the blobs of a container. In tail mode, the container is polled, the new blobs are read and
+// the ones which grew (append blobs, hourly logs) are read from where they were left. The bytes read of each blob are
+// saved as a cursor
+type AzureBlobSource struct {
+	configuration.HealthTracker
+	config    AzureBlobConfiguration
+	logger    *log.Entry
+	client    *http.Client
+	retrier   *retry.Retrier
+	baseURL   *url.URL
+	sasToken  *secrets.Secret  //nil with the managed identity, resolved again for the requests
+	identity  *managedIdentity //nil with a SAS token
+	from      time.Time
+	until     time.Time
+	positions map[string]int64 //bytes already read, by blob name
+	cursorId  string           //prefix of the cursors of the blobs
+}
+
+type blobItem struct {
+	Name       string `xml:"Name"`
+	Properties struct {
+		LastModified  string `xml:"Last-Modified"`
+		ContentLength int64  `xml:"Content-Length"`
+		BlobType      string `xml:"BlobType"`
+	} `xml:"Properties"`
+}
+
+type listBlobsResponse struct {
+	Blobs      []blobItem `xml:"Blobs>Blob"`
+	NextMarker string     `xml:"NextMarker"`
+}
+
+func (a *AzureBlobSource) GetMetrics() []prometheus.Collector {
+	return []prometheus.Collector{linesRead}
+}
+
+func (a *AzureBlobSource) GetAggregMetrics() []prometheus.Collector {
+	return []prometheus.Collector{linesRead}
+}
+
+func (a *AzureBlobSource) Configure(yamlConfig []byte, logger *log.Entry) error {
+	a.logger = logger
+	config := AzureBlobConfiguration{}
+	if err := yaml.UnmarshalStrict(yamlConfig, &config); err != nil {
+		return errors.Wrap(err, "Cannot parse azureblob datasource configuration")
+	}
+	if config.Mode == "" {
+		config.Mode = configuration.TAIL_MODE
+	}
+	return a.configure(config)
+}
+
+// configure checks the configuration and sets the defaults, for Configure and ConfigureByDSN
+func (a *AzureBlobSource) configure(config AzureBlobConfiguration) error {
+	if config.Mode != configuration.CAT_MODE && config.Mode != configuration.TAIL_MODE {
+		return fmt.Errorf("unsupported mode %s for azureblob datasource", config.Mode)
+	}
+	if config.AccountName == "" && config.AccountURL == "" {
+		return fmt.Errorf("account_name or account_url is mandatory")
+	}
+	if config.AccountURL == "" {
+		config.AccountURL = "https://" + config.AccountName + ".blob.core.windows.net"
+	}
+	baseURL, err := url.Parse(strings.TrimSuffix(config.AccountURL, "/"))
+	if err != nil {
+		return errors.Wrapf(err, "invalid account_url %s", config.AccountURL)
+	}
+	if baseURL.Scheme != "http" && baseURL.Scheme != "https" || baseURL.Host == "" {
+		return fmt.Errorf("invalid account_url %s : must be a http(s) url", config.AccountURL)
+	}
+	a.baseURL = baseURL
+	if config.Container == "" {
+		return fmt.Errorf("container is mandatory")
+	}
+	if config.Format == "" {
+		config.Format = FORMAT_LINES
+	}
+	if config.Format != FORMAT_LINES && config.Format != FORMAT_RECORDS {
+		return fmt.Errorf("invalid format %s (must be %s or %s)", config.Format, FORMAT_LINES, FORMAT_RECORDS)
+	}
+	if config.PollInterval == nil {
+		config.PollInterval = &defaultPollInterval
+	}
+	if *config.PollInterval <= 0 {
+		return fmt.Errorf("poll_interval must be positive")
+	}
+	if config.Timeout == nil {
+		config.Timeout = &defaultTimeout
+	}
+	if a.from, err = configuration.ParseTime(config.Since); err != nil {
+		return errors.Wrap(err, "invalid since")
+	}
+	if a.until, err = configuration.ParseTime(config.Until); err != nil {
+		return errors.Wrap(err, "invalid until")
+	}
+	if !a.until.IsZero() && config.Mode == configuration.TAIL_MODE {
+		return fmt.Errorf("until is only supported in %s mode", configuration.CAT_MODE)
+	}
+	//the whole download of a blob can take longer than the timeout, it only bounds the wait for the responses
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = *config.Timeout
+	a.client = &http.Client{Transport: transport}
+	if err := a.configureAuth(config); err != nil {
+		return err
+	}
+	a.retrier, err = retry.New(config.Retry, a.logger)
+	if err != nil {
+		return err
+	}
+	a.retrier.Notify = a.notifyRetry
+	a.cursorId = a.baseURL.Host + a.baseURL.Path + "/" + config.Container
+	a.positions = map[string]int64{}
+	a.config = config
+	return nil
+}
+
+func (a *AzureBlobSource) configureAuth(config AzureBlobConfiguration) error {
+	if config.SASToken == "" {
+		a.identity = &managedIdentity{client: &http.Client{Timeout: *config.Timeout}, clientID: config.ClientID}
+		return nil
+	}
+	if config.ClientID != "" {
+		return fmt.Errorf("client_id is only used with the managed identity, without sas_token")
+	}
+	sasToken, err := secrets.NewSecret(config.SASToken, a.logger)
+	if err != nil {
+		return errors.Wrap(err, "invalid sas_token")
+	}
+	if _, err := parseSASToken(sasToken.Get()); err != nil {
+		return err
+	}
+	a.sasToken = sasToken
+	return nil
+}
+
+// parseSASToken returns the parameters of a SAS token, that can be copied with the leading ? of the portal
+func parseSASToken(sasToken string) (url.Values, error) {
+	params, err := url.ParseQuery(strings.TrimPrefix(sasToken, "?"))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid sas_token")
+	}
+	if params.Get("sig") == "" {
+		return nil, fmt.Errorf("invalid sas_token : no signature (sig)")
+	}
+	return params, nil
+}
+
+// notifyRetry reports the failing requests in the health of the datasource
+func (a *AzureBlobSource) notifyRetry(err error) {
+	if err != nil {
+		a.SetState(configuration.STATUS_RECONNECTING, err)
+	} else {
+		a.SetState(configuration.STATUS_RUNNING, nil)
+	}
+}
+
+func (a *AzureBlobSource) ConfigureByDSN(dsn string, labels map[string]string, logger *log.Entry) error {
+	a.logger = logger
+	//format for the DSN is : azureblob://account/container[/prefix]?sas_token=...&format=...&since=...&until=...
+	parsed, err := configuration.ParseDSN(dsn, "azureblob")
+	if err != nil {
+		return err
+	}
+	parts := strings.SplitN(parsed.Target, "/", 3)
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("azureblob DSN must contain account and container : azureblob://account/container[/prefix]")
+	}
+	if err := parsed.CheckParams("account_url", "sas_token", "client_id", "format", "since", "until"); err != nil {
+		return err
+	}
+	if err := parsed.SetLogLevel(a.logger); err != nil {
+		return err
+	}
+	config := AzureBlobConfiguration{}
+	config.Mode = configuration.CAT_MODE
+	config.Labels = labels
+	config.AccountName = parts[0]
+	config.Container = parts[1]
+	if len(parts) == 3 {
+		config.Prefix = parts[2]
+	}
+	for key, value := range map[string]*string{
+		"account_url": &config.AccountURL,
+		"sas_token":   &config.SASToken,
+		"client_id":   &config.ClientID,
+		"format":      &config.Format,
+		"since":       &config.Since,
+		"until":       &config.Until,
+	} {
+		if *value, err = parsed.Param(key); err != nil {
+			return err
+		}
+	}
+	return a.configure(config)
+}
+
+func (a *AzureBlobSource) GetMode() string {
+	return a.config.Mode
+}
+
+func (a *AzureBlobSource) GetName() string {
+	return "azureblob"
+}
+
+func (a *AzureBlobSource) GetUuid() string {
+	return a.config.UniqueId
+}
+
+func (a *AzureBlobSource) CanRun() error {
+	return nil
+}
+
+func (a *AzureBlobSource) Dump() interface{} {
+	return a
+}
+
+// newRequest returns a request on the container, or on one of its blobs, with the credentials of the datasource
+func (a *AzureBlobSource) newRequest(blob string, params url.Values) (*http.Request, error) {
+	u := *a.baseURL
+	u.Path += "/" + a.config.Container
+	if blob != "" {
+		u.Path += "/" + blob
+	}
+	query := url.Values{}
+	for key, values := range params {
+		query[key] = values
+	}
+	if a.sasToken != nil {
+		sasToken, err := parseSASToken(a.sasToken.Get())
+		if err != nil {
+			return nil, retry.Permanent(err)
+		}
+		for key, values := range sasToken {
+			query[key] = values
+		}
+	}
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, retry.Permanent(err)
+	}
+	req.Header.Set("x-ms-version", storageVersion)
+	if a.identity != nil {
+		token, err := a.identity.Token()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req, nil
+}
+
+// listBlobs returns the blobs of the container whose name starts with the prefix, in the order of their names
+func (a *AzureBlobSource) listBlobs(dying <-chan struct{}) ([]blobItem, error) {
+	ret := []blobItem{}
+	marker := ""
+	for {
+		page := listBlobsResponse{}
+		err := a.retrier.Do(dying, func() error {
+			params := url.Values{}
+			params.Set("restype", "container")
+			params.Set("comp", "list")
+			if a.config.Prefix != "" {
+				params.Set("prefix", a.config.Prefix)
+			}
+			if marker != "" {
+				params.Set("marker", marker)
+			}
+			req, err := a.newRequest("", params)
+			if err != nil {
+				return err
+			}
+			resp, err := a.client.Do(req)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			if err := retry.CheckResponse(resp); err != nil {
+				return err
+			}
+			content, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				return errors.Wrap(err, "while reading blobs list")
+			}
+			page = listBlobsResponse{}
+			if err := xml.Unmarshal(content, &page); err != nil {
+				return retry.Permanent(errors.Wrap(err, "invalid blobs list"))
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, page.Blobs...)
+		if page.NextMarker == "" {
+			return ret, nil
+		}
+		marker = page.NextMarker
+	}
+}
+
+// inRange tells if the blob was modified between since and until
+func (a *AzureBlobSource) inRange(blob blobItem) bool {
+	modified, err := http.ParseTime(blob.Properties.LastModified)
+	if err != nil {
+		a.logger.Warningf("invalid last modification date %s of %s : %s", blob.Properties.LastModified, blob.Name, err)
+		return true
+	}
+	if !a.from.IsZero() && modified.Before(a.from) {
+		return false
+	}
+	if !a.until.IsZero() && !modified.Before(a.until) {
+		return false
+	}
+	return true
+}
+
+func (a *AzureBlobSource) send(out chan types.Event, dying <-chan struct{}, blob string, raw string, expectMode int) bool {
+	l := types.Line{}
+	l.Raw = raw
+	l.Src = a.config.Container + "/" + blob
+	l.Time = time.Now().UTC()
+	l.Labels = a.config.Labels
+	l.Process = true
+	l.Module = a.GetName()
+	linesRead.With(prometheus.Labels{"container": a.config.Container}).Inc()
+	a.EventSeen(&l)
+	select {
+	case out <- types.Event{Line: l, Process: true, Type: types.LOG, ExpectMode: expectMode}:
+		return true
+	case <-dying:
+		return false
+	}
+}
+
+// readLines sends the lines of body, which starts at offset in the blob, and returns the offset reached. The last
+// line is only sent if final is set, else it may not be complete yet
+func (a *AzureBlobSource) readLines(out chan types.Event, dying <-chan struct{}, blob string, body io.Reader, offset int64, final bool, expectMode int) (int64, error) {
+	reader := bufio.NewReader(body)
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF && !final {
+			return offset, nil
+		}
+		if err != nil && err != io.EOF {
+			return offset, errors.Wrapf(err, "while reading %s", blob)
+		}
+		if raw := strings.TrimRight(line, "\r\n"); raw != "" {
+			if !a.send(out, dying, blob, raw, expectMode) {
+				return offset, nil
+			}
+		}
+		offset += int64(len(line))
+		if err == io.EOF {
+			return offset, nil
+		}
+	}
+}
+
+// recordsStart returns the offset of the first record in a {"records": [...]} document
+func recordsStart(content []byte) (int64, error) {
+	dec := json.NewDecoder(bytes.NewReader(content))
+	for _, expected := range []interface{}{json.Delim('{'), "records", json.Delim('[')} {
+		token, err := dec.Token()
+		if err != nil {
+			return 0, errors.Wrap(err, "invalid records document")
+		}
+		if token != expected {
+			return 0, fmt.Errorf("invalid records document : expected %v, got %v", expected, token)
+		}
+	}
+	return dec.InputOffset(), nil
+}
+
+// readRecords sends the records of content, which starts at offset in the blob, after the last record read. It
+// returns the offset of the end of the last record sent
+func (a *AzureBlobSource) readRecords(out chan types.Event, dying <-chan struct{}, blob string, content []byte, offset int64, expectMode int) (int64, error) {
+	pos := int64(0)
+	if offset == 0 {
+		var err error
+		if pos, err = recordsStart(content); err != nil {
+			return offset, errors.Wrapf(err, "while reading %s", blob)
+		}
+	}
+	for {
+		//the records are separated by commas, and followed by the end of the document
+		rest := bytes.TrimLeft(content[pos:], " \t\r\n,")
+		if len(rest) == 0 || rest[0] == ']' {
+			return offset + pos, nil
+		}
+		pos = int64(len(content) - len(rest))
+		dec := json.NewDecoder(bytes.NewReader(rest))
+		record := json.RawMessage{}
+		if err := dec.Decode(&record); err != nil {
+			return offset + pos, errors.Wrapf(err, "invalid record at offset %d of %s", offset+pos, blob)
+		}
+		buf := bytes.Buffer{}
+		if err := json.Compact(&buf, record); err != nil {
+			return offset + pos, errors.Wrapf(err, "invalid record at offset %d of %s", offset+pos, blob)
+		}
+		if !a.send(out, dying, blob, buf.String(), expectMode) {
+			return offset + pos, nil
+		}
+		pos += dec.InputOffset()
+	}
+}
+
+// readBlob sends the content of a blob after offset, and returns the offset reached
+func (a *AzureBlobSource) readBlob(out chan types.Event, dying <-chan struct{}, blob string, offset int64, final bool, expectMode int) (int64, error) {
+	err := a.retrier.Do(dying, func() error {
+		req, err := a.newRequest(blob, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("x-ms-range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+		resp, err := a.client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if err := retry.CheckResponse(resp); err != nil {
+			return err
+		}
+		if a.config.Format == FORMAT_LINES {
+			offset, err = a.readLines(out, dying, blob, resp.Body, offset, final, expectMode)
+			return err
+		}
+		content, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return errors.Wrapf(err, "while reading %s", blob)
+		}
+		//a malformed blob doesn't stop the datasource, it is tried again when it changes
+		if offset, err = a.readRecords(out, dying, blob, content, offset, expectMode); err != nil {
+			a.logger.Warning(err)
+		}
+		return nil
+	})
+	if err == retry.ErrDying {
+		return offset, nil
+	}
+	return offset, err
+}
+
+// notFound tells if a blob was deleted after it was listed
+func notFound(err error) bool {
+	statusErr := &retry.StatusError{}
+	return errors.As(err, &statusErr) && statusErr.Status == http.StatusNotFound
+}
+
+func (a *AzureBlobSource) OneShotAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	a.logger.Infof("reading container %s of %s", a.config.Container, a.baseURL.Host)
+	blobs, err := a.listBlobs(t.Dying())
+	if err == retry.ErrDying {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "while listing container %s", a.config.Container)
+	}
+	for _, blob := range blobs {
+		if blob.Properties.BlobType == "PageBlob" || blob.Properties.ContentLength == 0 || !a.inRange(blob) {
+			continue
+		}
+		a.logger.Debugf("reading %s", blob.Name)
+		if _, err := a.readBlob(out, t.Dying(), blob.Name, 0, true, leaky.TIMEMACHINE); err != nil {
+			if notFound(err) {
+				a.logger.Warningf("blob %s was deleted before it was read", blob.Name)
+				continue
+			}
+			return errors.Wrapf(err, "while reading blob %s", blob.Name)
+		}
+	}
+	t.Kill(nil)
+	return nil
+}
+
+func (a *AzureBlobSource) saveCursor(key string, value string) {
+	if err := cursors.SaveCursor(a.GetName(), a.cursorId+"/"+key, value); err != nil {
+		a.logger.Warningf("unable to save cursor of %s : %s", key, err)
+	}
+}
+
+func (a *AzureBlobSource) loadCursor(key string) string {
+	value, err := cursors.LoadCursor(a.GetName(), a.cursorId+"/"+key)
+	if err != nil {
+		a.logger.Warningf("unable to load cursor of %s : %s", key, err)
+	}
+	return value
+}
+
+// pollCursor is the key of the cursor of the last poll, which is not a blob name
+func (a *AzureBlobSource) pollCursor() string {
+	return "?prefix=" + a.config.Prefix
+}
+
+// position returns the bytes of a blob already read. The blobs met for the first time are read from their start,
+// unless they were modified before since, or before the start of crowdsec
+func (a *AzureBlobSource) position(blob blobItem) int64 {
+	pos, ok := a.positions[blob.Name]
+	if !ok {
+		if value := a.loadCursor(blob.Name); value != "" {
+			var err error
+			if pos, err = strconv.ParseInt(value, 10, 64); err != nil {
+				a.logger.Warningf("invalid cursor %s for %s : %s", value, blob.Name, err)
+				pos = 0
+			}
+			ok = true
+		}
+	}
+	if !ok && !a.inRange(blob) {
+		a.logger.Debugf("skipping %s, which was modified before %s", blob.Name, a.from)
+		a.saveCursor(blob.Name, strconv.FormatInt(blob.Properties.ContentLength, 10))
+		return blob.Properties.ContentLength
+	}
+	if pos > blob.Properties.ContentLength {
+		a.logger.Infof("%s was replaced, reading it again", blob.Name)
+		return 0
+	}
+	return pos
+}
+
+// poll reads the new content of the blobs. It returns false if the datasource was stopped meanwhile
+func (a *AzureBlobSource) poll(out chan types.Event, dying <-chan struct{}, expectMode int) (bool, error) {
+	start := time.Now().UTC()
+	blobs, err := a.listBlobs(dying)
+	if err == retry.ErrDying {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "while listing container %s", a.config.Container)
+	}
+	a.SetState(configuration.STATUS_RUNNING, nil)
+	positions := make(map[string]int64, len(blobs))
+	for _, blob := range blobs {
+		if blob.Properties.BlobType == "PageBlob" {
+			continue
+		}
+		pos := a.position(blob)
+		if pos < blob.Properties.ContentLength {
+			a.logger.Debugf("reading %s from offset %d", blob.Name, pos)
+			newPos, err := a.readBlob(out, dying, blob.Name, pos, false, expectMode)
+			if newPos != pos {
+				a.saveCursor(blob.Name, strconv.FormatInt(newPos, 10))
+			}
+			pos = newPos
+			switch {
+			case err != nil && notFound(err):
+				a.logger.Debugf("blob %s was deleted before it was read", blob.Name)
+				continue
+			case err != nil:
+				return false, errors.Wrapf(err, "while reading blob %s", blob.Name)
+			}
+		}
+		positions[blob.Name] = pos
+		select {
+		case <-dying:
+			return false, nil
+		default:
+		}
+	}
+	//the deleted blobs are forgotten
+	a.positions = positions
+	a.saveCursor(a.pollCursor(), start.Format(time.RFC3339Nano))
+	return true, nil
+}
+
+func (a *AzureBlobSource) StreamingAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	//without since, the content of the blobs modified before the last poll of the previous run (or else before now)
+	//was already read
+	if a.from.IsZero() {
+		a.from = time.Now().UTC()
+		if value := a.loadCursor(a.pollCursor()); value != "" {
+			if last, err := time.Parse(time.RFC3339Nano, value); err == nil {
+				a.from = last
+			} else {
+				a.logger.Warningf("invalid cursor %s of the last poll : %s", value, err)
+			}
+		}
+	}
+	expectMode := leaky.LIVE
+	if a.config.UseTimeMachine {
+		expectMode = leaky.TIMEMACHINE
+	}
+	t.Go(func() error {
+		defer types.CatchPanic("crowdsec/acquis/azureblob/live")
+		a.logger.Infof("polling container %s of %s every %s", a.config.Container, a.baseURL.Host, *a.config.PollInterval)
+		ticker := time.NewTicker(*a.config.PollInterval)
+		defer ticker.Stop()
+		for {
+			ok, err := a.poll(out, t.Dying(), expectMode)
+			if err != nil {
+				a.SetState(configuration.STATUS_ERRORED, err)
+				return err
+			}
+			if !ok {
+				return nil
+			}
+			select {
+			case <-t.Dying():
+				a.logger.Infof("azureblob datasource stopping")
+				return nil
+			case <-ticker.C:
+			}
+		}
+	})
+	return nil
+}
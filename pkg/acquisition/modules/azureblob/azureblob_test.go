@@ -0,0 +1,391 @@
+package azureblobacquisition
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/cursors"
+	"github.com/crowdsecurity/crowdsec/pkg/cstest"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/tomb.v2"
+)
+
+func TestConfigure(t *testing.T) {
+	tests := []struct {
+		config      string
+		expectedErr string
+	}{
+		{
+			config:      `foobar: bla`,
+			expectedErr: "field foobar not found in type azureblobacquisition.AzureBlobConfiguration",
+		},
+		{
+			config:      `container: logs`,
+			expectedErr: "account_name or account_url is mandatory",
+		},
+		{
+			config:      `account_name: crowdsec`,
+			expectedErr: "container is mandatory",
+		},
+		{
+			config: `
+source: azureblob
+account_name: crowdsec
+container: $logs
+sas_token: "?sv=2020-10-02&ss=b&srt=co&sp=rl&sig=c2lnbmF0dXJl"`,
+			expectedErr: "",
+		},
+		{
+			config: `
+source: azureblob
+account_name: crowdsec
+container: insights-logs-networksecuritygroupflowevent
+format: records
+client_id: 00000000-0000-0000-0000-000000000000`,
+			expectedErr: "",
+		},
+		{
+			config: `
+account_url: ftp://crowdsec.blob.core.windows.net
+container: logs`,
+			expectedErr: "invalid account_url ftp://crowdsec.blob.core.windows.net : must be a http(s) url",
+		},
+		{
+			config: `
+account_name: crowdsec
+container: logs
+mode: server`,
+			expectedErr: "unsupported mode server for azureblob datasource",
+		},
+		{
+			config: `
+account_name: crowdsec
+container: logs
+format: csv`,
+			expectedErr: "invalid format csv (must be lines or records)",
+		},
+		{
+			config: `
+account_name: crowdsec
+container: logs
+sas_token: sv=2020-10-02&ss=b`,
+			expectedErr: "invalid sas_token : no signature (sig)",
+		},
+		{
+			config: `
+account_name: crowdsec
+container: logs
+sas_token: sig=c2lnbmF0dXJl
+client_id: 00000000-0000-0000-0000-000000000000`,
+			expectedErr: "client_id is only used with the managed identity, without sas_token",
+		},
+		{
+			config: `
+account_name: crowdsec
+container: logs
+poll_interval: 0s`,
+			expectedErr: "poll_interval must be positive",
+		},
+		{
+			config: `
+account_name: crowdsec
+container: logs
+until: 1h`,
+			expectedErr: "until is only supported in cat mode",
+		},
+	}
+	subLogger := log.WithFields(log.Fields{
+		"type": "azureblob",
+	})
+	for _, test := range tests {
+		a := AzureBlobSource{}
+		err := a.Configure([]byte(test.config), subLogger)
+		cstest.AssertErrorContains(t, err, test.expectedErr)
+	}
+}
+
+func TestConfigureByDSN(t *testing.T) {
+	tests := []struct {
+		dsn         string
+		expectedErr string
+	}{
+		{
+			dsn:         "azureblob://crowdsec",
+			expectedErr: "azureblob DSN must contain account and container",
+		},
+		{
+			dsn:         "azureblob://crowdsec/logs?foo=bar",
+			expectedErr: "unsupported key foo in azureblob DSN",
+		},
+		{
+			dsn:         "azureblob://crowdsec/logs/2022/06?sas_token=sig%3Dc2lnbmF0dXJl&format=records&since=2022-06-01T00:00:00Z",
+			expectedErr: "",
+		},
+	}
+	for _, test := range tests {
+		a := AzureBlobSource{}
+		err := a.ConfigureByDSN(test.dsn, map[string]string{"type": "nsg"}, log.WithField("type", "azureblob"))
+		cstest.AssertErrorContains(t, err, test.expectedErr)
+	}
+	a := AzureBlobSource{}
+	require.NoError(t, a.ConfigureByDSN("azureblob://crowdsec/logs/2022/06", nil, log.WithField("type", "azureblob")))
+	assert.Equal(t, "https://crowdsec.blob.core.windows.net", a.baseURL.String())
+	assert.Equal(t, "logs", a.config.Container)
+	assert.Equal(t, "2022/06", a.config.Prefix)
+	assert.Equal(t, "cat", a.config.Mode)
+}
+
+type fakeBlob struct {
+	content  string
+	modified time.Time
+	kind     string
+}
+
+// fakeStorage is a storage account with a container, which lists its blobs by pages of two
+type fakeStorage struct {
+	lock     sync.Mutex
+	blobs    map[string]*fakeBlob
+	auth     func(r *http.Request) bool
+	requests []string
+}
+
+func newFakeStorage(auth func(r *http.Request) bool) *fakeStorage {
+	return &fakeStorage{blobs: map[string]*fakeBlob{}, auth: auth}
+}
+
+func (s *fakeStorage) put(name string, content string, modified time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.blobs[name] = &fakeBlob{content: content, modified: modified, kind: "AppendBlob"}
+}
+
+func (s *fakeStorage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.requests = append(s.requests, r.URL.Path+" "+r.Header.Get("x-ms-range"))
+	if !s.auth(r) || r.Header.Get("x-ms-version") == "" {
+		http.Error(w, "AuthenticationFailed", http.StatusForbidden)
+		return
+	}
+	if r.URL.Path == "/logs" {
+		names := []string{}
+		for name := range s.blobs {
+			if strings.HasPrefix(name, r.URL.Query().Get("prefix")) && name > r.URL.Query().Get("marker") {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		next := ""
+		if len(names) > 2 {
+			names, next = names[:2], names[1]
+		}
+		fmt.Fprint(w, `<?xml version="1.0" encoding="utf-8"?><EnumerationResults ContainerName="logs"><Blobs>`)
+		for _, name := range names {
+			blob := s.blobs[name]
+			fmt.Fprintf(w, "<Blob><Name>%s</Name><Properties><Last-Modified>%s</Last-Modified><Content-Length>%d</Content-Length><BlobType>%s</BlobType></Properties></Blob>",
+				name, blob.modified.Format(http.TimeFormat), len(blob.content), blob.kind)
+		}
+		fmt.Fprintf(w, "</Blobs><NextMarker>%s</NextMarker></EnumerationResults>", next)
+		return
+	}
+	blob, ok := s.blobs[strings.TrimPrefix(r.URL.Path, "/logs/")]
+	if !ok {
+		http.Error(w, "BlobNotFound", http.StatusNotFound)
+		return
+	}
+	offset, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(r.Header.Get("x-ms-range"), "bytes="), "-"))
+	if err != nil || offset >= len(blob.content) {
+		http.Error(w, "InvalidRange", http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	w.WriteHeader(http.StatusPartialContent)
+	fmt.Fprint(w, blob.content[offset:])
+}
+
+func (s *fakeStorage) history() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string{}, s.requests...)
+}
+
+func sasAuth(r *http.Request) bool {
+	return r.URL.Query().Get("sig") == "secret"
+}
+
+func readEvents(t *testing.T, out chan types.Event, expected []string) {
+	for _, line := range expected {
+		select {
+		case evt := <-out:
+			assert.Equal(t, line, evt.Line.Raw)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout waiting for %s", line)
+		}
+	}
+}
+
+func TestOneShotAcquisition(t *testing.T) {
+	storage := newFakeStorage(sasAuth)
+	server := httptest.NewServer(storage)
+	defer server.Close()
+	day := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	storage.put("blob/2022/05/31/2300/000000.log", "1.0;old\n", day.Add(-time.Hour))
+	storage.put("blob/2022/06/01/0000/000000.log", "1.0;line 1\n1.0;line 2\n", day.Add(time.Minute))
+	storage.put("blob/2022/06/01/0000/000001.log", "", day.Add(time.Minute))
+	storage.put("blob/2022/06/01/0100/000000.log", "1.0;line 3\r\n\n1.0;line 4", day.Add(time.Hour))
+	storage.put("table/2022/06/01/0000/000000.log", "1.0;other\n", day.Add(time.Minute))
+	storage.put("blob/2022/06/01/0100/000001.log", "page", day.Add(time.Hour))
+	storage.blobs["blob/2022/06/01/0100/000001.log"].kind = "PageBlob"
+
+	a := AzureBlobSource{}
+	require.NoError(t, a.Configure([]byte(`
+source: azureblob
+mode: cat
+account_url: `+server.URL+`
+container: logs
+prefix: blob/
+since: 2022-06-01T00:00:00Z
+sas_token: sv=2020-10-02&sig=secret`), log.WithField("type", "azureblob")))
+	out := make(chan types.Event, 10)
+	tmb := tomb.Tomb{}
+	require.NoError(t, a.OneShotAcquisition(out, &tmb))
+	close(out)
+	lines := []string{}
+	for evt := range out {
+		lines = append(lines, evt.Line.Raw)
+		assert.True(t, strings.HasPrefix(evt.Line.Src, "logs/blob/2022/06/01/"))
+	}
+	//the last line of a blob is read in cat mode, even without newline
+	assert.Equal(t, []string{"1.0;line 1", "1.0;line 2", "1.0;line 3", "1.0;line 4"}, lines)
+	assert.Equal(t, []string{
+		"/logs ",
+		"/logs ",
+		"/logs ",
+		"/logs/blob/2022/06/01/0000/000000.log bytes=0-",
+		"/logs/blob/2022/06/01/0100/000000.log bytes=0-",
+	}, storage.history())
+}
+
+func TestStreamingAcquisition(t *testing.T) {
+	dir, err := ioutil.TempDir("", "azureblob-cursors")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store, err := cursors.NewFileStore(filepath.Join(dir, "cursors.json"))
+	require.NoError(t, err)
+	cursors.SetStore(store)
+	defer cursors.SetStore(nil)
+
+	storage := newFakeStorage(sasAuth)
+	server := httptest.NewServer(storage)
+	defer server.Close()
+	storage.put("old.log", "old line\n", time.Now().Add(-time.Hour))
+
+	config := []byte(`
+account_url: ` + server.URL + `
+container: logs
+poll_interval: 50ms
+sas_token: sig=secret`)
+	a := AzureBlobSource{}
+	require.NoError(t, a.Configure(config, log.WithField("type", "azureblob")))
+	out := make(chan types.Event)
+	tmb := tomb.Tomb{}
+	require.NoError(t, a.StreamingAcquisition(out, &tmb))
+	//the content of the blobs modified before the start was already read, the partial line is read once complete
+	storage.put("new.log", "line 1\nline", time.Now().Add(time.Second))
+	readEvents(t, out, []string{"line 1"})
+	storage.put("old.log", "old line\nline 2\n", time.Now().Add(time.Second))
+	storage.put("new.log", "line 1\nline 3\n", time.Now().Add(time.Second))
+	readEvents(t, out, []string{"line 3", "line 2"})
+	tmb.Kill(nil)
+	require.NoError(t, tmb.Wait())
+
+	//a restart resumes where the blobs were left, the blobs created meanwhile are read from their start
+	storage.put("new.log", "line 1\nline 3\nline 4\n", time.Now().Add(time.Second))
+	storage.put("other.log", "line 5\n", time.Now().Add(time.Second))
+	a = AzureBlobSource{}
+	require.NoError(t, a.Configure(config, log.WithField("type", "azureblob")))
+	tmb = tomb.Tomb{}
+	require.NoError(t, a.StreamingAcquisition(out, &tmb))
+	readEvents(t, out, []string{"line 4", "line 5"})
+	tmb.Kill(nil)
+	require.NoError(t, tmb.Wait())
+	assert.Contains(t, storage.history(), "/logs/new.log bytes=14-")
+}
+
+func TestRecords(t *testing.T) {
+	storage := newFakeStorage(sasAuth)
+	server := httptest.NewServer(storage)
+	defer server.Close()
+
+	a := AzureBlobSource{}
+	require.NoError(t, a.Configure([]byte(`
+account_url: `+server.URL+`
+container: logs
+format: records
+poll_interval: 50ms
+sas_token: sig=secret`), log.WithField("type", "azureblob")))
+	out := make(chan types.Event)
+	tmb := tomb.Tomb{}
+	require.NoError(t, a.StreamingAcquisition(out, &tmb))
+	//the NSG flow logs blocks are inserted before the end of the document
+	storage.put("PT1H.json", `{"records":[{"time": "10:00", "flows": [{"rule": "allow"}]}]}`, time.Now().Add(time.Second))
+	readEvents(t, out, []string{`{"time":"10:00","flows":[{"rule":"allow"}]}`})
+	storage.put("PT1H.json", `{"records":[{"time": "10:00", "flows": [{"rule": "allow"}]}
+,{"time": "10:01"},{"time": "10:02"}]}`, time.Now().Add(time.Second))
+	readEvents(t, out, []string{`{"time":"10:01"}`, `{"time":"10:02"}`})
+	tmb.Kill(nil)
+	require.NoError(t, tmb.Wait())
+	assert.Contains(t, storage.history(), "/logs/PT1H.json bytes=59-")
+}
+
+func TestManagedIdentity(t *testing.T) {
+	tokens := int32(0)
+	imds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata") != "true" || r.URL.Query().Get("resource") != "https://storage.azure.com/" ||
+			r.URL.Query().Get("client_id") != "crowdsec-id" {
+			http.Error(w, `{"error": "invalid_request"}`, http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, `{"access_token": "token%d", "expires_in": "3599", "token_type": "Bearer"}`, atomic.AddInt32(&tokens, 1))
+	}))
+	defer imds.Close()
+	defer func(endpoint string) { imdsEndpoint = endpoint }(imdsEndpoint)
+	imdsEndpoint = imds.URL
+
+	storage := newFakeStorage(func(r *http.Request) bool {
+		return r.Header.Get("Authorization") == "Bearer token1"
+	})
+	server := httptest.NewServer(storage)
+	defer server.Close()
+	storage.put("a.log", "line 1\n", time.Now())
+	storage.put("b.log", "line 2\n", time.Now())
+
+	a := AzureBlobSource{}
+	require.NoError(t, a.ConfigureByDSN("azureblob://crowdsec/logs?client_id=crowdsec-id&account_url="+server.URL, nil,
+		log.WithField("type", "azureblob")))
+	out := make(chan types.Event, 10)
+	tmb := tomb.Tomb{}
+	require.NoError(t, a.OneShotAcquisition(out, &tmb))
+	assert.Len(t, out, 2)
+	//the token is used until it expires
+	assert.Equal(t, int32(1), atomic.LoadInt32(&tokens))
+
+	a = AzureBlobSource{}
+	require.NoError(t, a.ConfigureByDSN("azureblob://crowdsec/logs?client_id=unknown&account_url="+server.URL, nil,
+		log.WithField("type", "azureblob")))
+	err := a.OneShotAcquisition(out, &tomb.Tomb{})
+	cstest.AssertErrorContains(t, err, "while listing container logs: request failed with status 400")
+}
@@ -3,7 +3,6 @@ package cloudwatchacquisition
 import (
 	"context"
 	"fmt"
-	"net/url"
 	"os"
 	"regexp"
 	"strings"
@@ -11,8 +10,11 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/retry"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/secrets"
 	leaky "github.com/crowdsecurity/crowdsec/pkg/leakybucket"
 	"github.com/crowdsecurity/crowdsec/pkg/parser"
 	"github.com/crowdsecurity/crowdsec/pkg/types"
@@ -45,11 +47,14 @@ var linesRead = prometheus.NewCounterVec(
 
 //CloudwatchSource is the runtime instance keeping track of N streams within 1 cloudwatch group
 type CloudwatchSource struct {
+	configuration.HealthTracker
 	Config CloudwatchSourceConfiguration
 	/*runtime stuff*/
 	logger           *log.Entry
 	t                *tomb.Tomb
 	cwClient         *cloudwatchlogs.CloudWatchLogs
+	insights         insightsClient
+	retrier          *retry.Retrier
 	monitoredStreams []*LogStreamTailConfig
 	streamIndexes    map[string]string
 }
@@ -72,6 +77,15 @@ type CloudwatchSourceConfiguration struct {
 	PrependCloudwatchTimestamp        *bool          `yaml:"prepend_cloudwatch_timestamp,omitempty"`
 	AwsConfigDir                      *string        `yaml:"aws_config_dir,omitempty"`
 	AwsRegion                         *string        `yaml:"aws_region,omitempty"`
+	AwsAccessKeyID                    *string        `yaml:"aws_access_key_id,omitempty"` //static keys, instead of the profile : can be env://, file:// or vault:// references
+	AwsSecretAccessKey                *string        `yaml:"aws_secret_access_key,omitempty"`
+	AwsSessionToken                   *string        `yaml:"aws_session_token,omitempty"`
+	Query                             string         `yaml:"query,omitempty"`               //Logs Insights query run over since-until in cat mode, instead of reading the streams. It must return @timestamp
+	QueryMessageField                 string         `yaml:"query_message_field,omitempty"` //field of the results that is the line, @message by default
+	QueryLimit                        *int64         `yaml:"query_limit,omitempty"`         //results of each query, the time range is split when it's reached
+	QueryPollInterval                 *time.Duration `yaml:"query_poll_interval,omitempty"` //frequency at which the status of a query is polled
+	Since                             string         `yaml:"since,omitempty"`               //RFC3339 date, or duration before now (eg. 24h)
+	Until                             string         `yaml:"until,omitempty"`
 }
 
 //LogStreamTailConfig is the configuration for one given stream within one group
@@ -170,9 +184,19 @@ func (cw *CloudwatchSource) Configure(cfg []byte, logger *log.Entry) error {
 		os.Setenv("AWS_REGION", *cw.Config.AwsRegion)
 	}
 
+	if err := cw.configureQuery(); err != nil {
+		return err
+	}
+
 	if err := cw.newClient(); err != nil {
 		return err
 	}
+	retrier, err := retry.New(cw.Config.Retry, cw.logger)
+	if err != nil {
+		return err
+	}
+	retrier.Notify = cw.notifyRetry
+	cw.retrier = retrier
 	cw.streamIndexes = make(map[string]string)
 	if cw.Config.StreamRegexp != nil {
 		if _, err := regexp.Compile(*cw.Config.StreamRegexp); err != nil {
@@ -187,6 +211,75 @@ func (cw *CloudwatchSource) Configure(cfg []byte, logger *log.Entry) error {
 	return nil
 }
 
+//configureQuery checks the configuration of the Logs Insights queries, which are only run in cat mode
+func (cw *CloudwatchSource) configureQuery() error {
+	if cw.Config.Query == "" {
+		return nil
+	}
+	if cw.Config.Mode != configuration.CAT_MODE {
+		return fmt.Errorf("query is only supported in %s mode", configuration.CAT_MODE)
+	}
+	if cw.Config.StreamName != nil || cw.Config.StreamRegexp != nil {
+		return fmt.Errorf("stream_name and stream_regexp are not used with query, filter on @logStream instead")
+	}
+	if cw.Config.QueryMessageField == "" {
+		cw.Config.QueryMessageField = "@message"
+	}
+	if cw.Config.QueryLimit == nil {
+		cw.Config.QueryLimit = &def_QueryLimit
+	}
+	if *cw.Config.QueryLimit < 1 || *cw.Config.QueryLimit > def_QueryLimit {
+		return fmt.Errorf("query_limit must be between 1 and %d", def_QueryLimit)
+	}
+	if cw.Config.QueryPollInterval == nil {
+		cw.Config.QueryPollInterval = &def_QueryPollInterval
+	}
+	if *cw.Config.QueryPollInterval <= 0 {
+		return fmt.Errorf("query_poll_interval must be positive")
+	}
+	if cw.Config.StartTime == nil {
+		if cw.Config.Since == "" {
+			return fmt.Errorf("since is mandatory with query")
+		}
+		since, err := configuration.ParseTime(cw.Config.Since)
+		if err != nil {
+			return errors.Wrap(err, "invalid since")
+		}
+		cw.Config.StartTime = &since
+	}
+	if cw.Config.EndTime == nil {
+		until := time.Now().UTC()
+		if cw.Config.Until != "" {
+			var err error
+			if until, err = configuration.ParseTime(cw.Config.Until); err != nil {
+				return errors.Wrap(err, "invalid until")
+			}
+		}
+		cw.Config.EndTime = &until
+	}
+	if !cw.Config.StartTime.Before(*cw.Config.EndTime) {
+		return fmt.Errorf("since must be before until")
+	}
+	return nil
+}
+
+//notifyRetry reports the failing calls to the aws api in the health of the datasource
+func (cw *CloudwatchSource) notifyRetry(err error) {
+	if err != nil {
+		cw.SetState(configuration.STATUS_RECONNECTING, err)
+	} else {
+		cw.SetState(configuration.STATUS_RUNNING, nil)
+	}
+}
+
+//permanentError tells the retrier not to retry calls on groups or streams that don't exist
+func permanentError(err error) error {
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == cloudwatchlogs.ErrCodeResourceNotFoundException {
+		return retry.Permanent(err)
+	}
+	return err
+}
+
 func (cw *CloudwatchSource) newClient() error {
 	var sess *session.Session
 
@@ -204,15 +297,23 @@ func (cw *CloudwatchSource) newClient() error {
 	if sess == nil {
 		return fmt.Errorf("failed to create aws session")
 	}
+	config := aws.NewConfig()
+	if cw.Config.AwsAccessKeyID != nil || cw.Config.AwsSecretAccessKey != nil {
+		creds, err := secrets.NewAWSCredentials(aws.StringValue(cw.Config.AwsAccessKeyID), aws.StringValue(cw.Config.AwsSecretAccessKey), aws.StringValue(cw.Config.AwsSessionToken))
+		if err != nil {
+			return errors.Wrap(err, "invalid aws credentials")
+		}
+		config = config.WithCredentials(creds)
+	}
 	if v := os.Getenv("AWS_ENDPOINT_FORCE"); v != "" {
 		cw.logger.Debugf("[testing] overloading endpoint with %s", v)
-		cw.cwClient = cloudwatchlogs.New(sess, aws.NewConfig().WithEndpoint(v))
-	} else {
-		cw.cwClient = cloudwatchlogs.New(sess)
+		config = config.WithEndpoint(v)
 	}
+	cw.cwClient = cloudwatchlogs.New(sess, config)
 	if cw.cwClient == nil {
 		return fmt.Errorf("failed to create cloudwatch client")
 	}
+	cw.insights = cw.cwClient
 	return nil
 }
 
@@ -241,6 +342,10 @@ func (cw *CloudwatchSource) GetName() string {
 	return "cloudwatch"
 }
 
+func (cw *CloudwatchSource) GetUuid() string {
+	return cw.Config.UniqueId
+}
+
 func (cw *CloudwatchSource) CanRun() error {
 	return nil
 }
@@ -267,58 +372,64 @@ func (cw *CloudwatchSource) WatchLogGroupForStreams(out chan LogStreamTailConfig
 
 				ctx := context.Background()
 				//there can be a lot of streams in a group, and we're only interested in those recently written to, so we sort by LastEventTime
-				err := cw.cwClient.DescribeLogStreamsPagesWithContext(
-					ctx,
-					&cloudwatchlogs.DescribeLogStreamsInput{
-						LogGroupName: aws.String(cw.Config.GroupName),
-						Descending:   aws.Bool(true),
-						NextToken:    startFrom,
-						OrderBy:      aws.String(cloudwatchlogs.OrderByLastEventTime),
-						Limit:        cw.Config.DescribeLogStreamsLimit,
-					},
-					func(page *cloudwatchlogs.DescribeLogStreamsOutput, lastPage bool) bool {
-						cw.logger.Tracef("in helper of of DescribeLogStreamsPagesWithContext")
-						for _, event := range page.LogStreams {
-							startFrom = page.NextToken
-							//we check if the stream has been written to recently enough to be monitored
-							if event.LastIngestionTime != nil {
-								//aws uses millisecond since the epoch
-								oldest := time.Now().UTC().Add(-*cw.Config.MaxStreamAge)
-								//TBD : verify that this is correct : Unix 2nd arg expects Nanoseconds, and have a code that is more explicit.
-								LastIngestionTime := time.Unix(0, *event.LastIngestionTime*int64(time.Millisecond))
-								if LastIngestionTime.Before(oldest) {
-									cw.logger.Tracef("stop iteration, %s reached oldest age, stop (%s < %s)", *event.LogStreamName, LastIngestionTime, time.Now().UTC().Add(-*cw.Config.MaxStreamAge))
-									hasMoreStreams = false
-									return false
+				err := cw.retrier.Do(cw.t.Dying(), func() error {
+					return permanentError(cw.cwClient.DescribeLogStreamsPagesWithContext(
+						ctx,
+						&cloudwatchlogs.DescribeLogStreamsInput{
+							LogGroupName: aws.String(cw.Config.GroupName),
+							Descending:   aws.Bool(true),
+							NextToken:    startFrom,
+							OrderBy:      aws.String(cloudwatchlogs.OrderByLastEventTime),
+							Limit:        cw.Config.DescribeLogStreamsLimit,
+						},
+						func(page *cloudwatchlogs.DescribeLogStreamsOutput, lastPage bool) bool {
+							cw.logger.Tracef("in helper of of DescribeLogStreamsPagesWithContext")
+							for _, event := range page.LogStreams {
+								startFrom = page.NextToken
+								//we check if the stream has been written to recently enough to be monitored
+								if event.LastIngestionTime != nil {
+									//aws uses millisecond since the epoch
+									oldest := time.Now().UTC().Add(-*cw.Config.MaxStreamAge)
+									//TBD : verify that this is correct : Unix 2nd arg expects Nanoseconds, and have a code that is more explicit.
+									LastIngestionTime := time.Unix(0, *event.LastIngestionTime*int64(time.Millisecond))
+									if LastIngestionTime.Before(oldest) {
+										cw.logger.Tracef("stop iteration, %s reached oldest age, stop (%s < %s)", *event.LogStreamName, LastIngestionTime, time.Now().UTC().Add(-*cw.Config.MaxStreamAge))
+										hasMoreStreams = false
+										return false
+									}
+									cw.logger.Tracef("stream %s is elligible for monitoring", *event.LogStreamName)
+									//the stream has been update recently, check if we should monitor it
+									var expectMode int
+									if !cw.Config.UseTimeMachine {
+										expectMode = leaky.LIVE
+									} else {
+										expectMode = leaky.TIMEMACHINE
+									}
+									monitorStream := LogStreamTailConfig{
+										GroupName:                  cw.Config.GroupName,
+										StreamName:                 *event.LogStreamName,
+										GetLogEventsPagesLimit:     *cw.Config.GetLogEventsPagesLimit,
+										PollStreamInterval:         *cw.Config.PollStreamInterval,
+										StreamReadTimeout:          *cw.Config.StreamReadTimeout,
+										PrependCloudwatchTimestamp: cw.Config.PrependCloudwatchTimestamp,
+										ExpectMode:                 expectMode,
+										Labels:                     cw.Config.Labels,
+									}
+									out <- monitorStream
 								}
-								cw.logger.Tracef("stream %s is elligible for monitoring", *event.LogStreamName)
-								//the stream has been update recently, check if we should monitor it
-								var expectMode int
-								if !cw.Config.UseTimeMachine {
-									expectMode = leaky.LIVE
-								} else {
-									expectMode = leaky.TIMEMACHINE
-								}
-								monitorStream := LogStreamTailConfig{
-									GroupName:                  cw.Config.GroupName,
-									StreamName:                 *event.LogStreamName,
-									GetLogEventsPagesLimit:     *cw.Config.GetLogEventsPagesLimit,
-									PollStreamInterval:         *cw.Config.PollStreamInterval,
-									StreamReadTimeout:          *cw.Config.StreamReadTimeout,
-									PrependCloudwatchTimestamp: cw.Config.PrependCloudwatchTimestamp,
-									ExpectMode:                 expectMode,
-									Labels:                     cw.Config.Labels,
-								}
-								out <- monitorStream
 							}
-						}
-						if lastPage {
-							cw.logger.Tracef("reached last page")
-							hasMoreStreams = false
-						}
-						return true
-					},
-				)
+							if lastPage {
+								cw.logger.Tracef("reached last page")
+								hasMoreStreams = false
+							}
+							return true
+						},
+					))
+				})
+				if err == retry.ErrDying {
+					cw.logger.Infof("stopping group watch")
+					return nil
+				}
 				if err != nil {
 					newerr := errors.Wrapf(err, "while describing group %s", cw.Config.GroupName)
 					return newerr
@@ -435,42 +546,49 @@ func (cw *CloudwatchSource) TailLogStream(cfg *LogStreamTailConfig, outChan chan
 				/*for the first call, we only consume the last item*/
 				cfg.logger.Tracef("calling GetLogEventsPagesWithContext")
 				ctx := context.Background()
-				err := cw.cwClient.GetLogEventsPagesWithContext(ctx,
-					&cloudwatchlogs.GetLogEventsInput{
-						Limit:         aws.Int64(cfg.GetLogEventsPagesLimit),
-						LogGroupName:  aws.String(cfg.GroupName),
-						LogStreamName: aws.String(cfg.StreamName),
-						NextToken:     startFrom,
-						StartFromHead: aws.Bool(true),
-					},
-					func(page *cloudwatchlogs.GetLogEventsOutput, lastPage bool) bool {
-						cfg.logger.Tracef("%d results, last:%t", len(page.Events), lastPage)
-						startFrom = page.NextForwardToken
-						if page.NextForwardToken != nil {
-							streamIndexMutex.Lock()
-							cw.streamIndexes[cfg.GroupName+"+"+cfg.StreamName] = *page.NextForwardToken
-							streamIndexMutex.Unlock()
-						}
-						if lastPage { /*wait another ticker to check on new log availability*/
-							cfg.logger.Tracef("last page")
-							hasMorePages = false
-						}
-						if len(page.Events) > 0 {
-							lastReadMessage = time.Now().UTC()
-						}
-						for _, event := range page.Events {
-							evt, err := cwLogToEvent(event, cfg)
-							if err != nil {
-								cfg.logger.Warningf("cwLogToEvent error, discarded event : %s", err)
-							} else {
-								cfg.logger.Debugf("pushing message : %s", evt.Line.Raw)
-								linesRead.With(prometheus.Labels{"group": cfg.GroupName, "stream": cfg.StreamName}).Inc()
-								outChan <- evt
+				err := cw.retrier.Do(cfg.t.Dying(), func() error {
+					return permanentError(cw.cwClient.GetLogEventsPagesWithContext(ctx,
+						&cloudwatchlogs.GetLogEventsInput{
+							Limit:         aws.Int64(cfg.GetLogEventsPagesLimit),
+							LogGroupName:  aws.String(cfg.GroupName),
+							LogStreamName: aws.String(cfg.StreamName),
+							NextToken:     startFrom,
+							StartFromHead: aws.Bool(true),
+						},
+						func(page *cloudwatchlogs.GetLogEventsOutput, lastPage bool) bool {
+							cfg.logger.Tracef("%d results, last:%t", len(page.Events), lastPage)
+							startFrom = page.NextForwardToken
+							if page.NextForwardToken != nil {
+								streamIndexMutex.Lock()
+								cw.streamIndexes[cfg.GroupName+"+"+cfg.StreamName] = *page.NextForwardToken
+								streamIndexMutex.Unlock()
 							}
-						}
-						return true
-					},
-				)
+							if lastPage { /*wait another ticker to check on new log availability*/
+								cfg.logger.Tracef("last page")
+								hasMorePages = false
+							}
+							if len(page.Events) > 0 {
+								lastReadMessage = time.Now().UTC()
+							}
+							for _, event := range page.Events {
+								evt, err := cwLogToEvent(event, cfg)
+								if err != nil {
+									cfg.logger.Warningf("cwLogToEvent error, discarded event : %s", err)
+								} else {
+									cfg.logger.Debugf("pushing message : %s", evt.Line.Raw)
+									linesRead.With(prometheus.Labels{"group": cfg.GroupName, "stream": cfg.StreamName}).Inc()
+									cw.EventSeen(&evt.Line)
+									outChan <- evt
+								}
+							}
+							return true
+						},
+					))
+				})
+				if err == retry.ErrDying {
+					cfg.logger.Infof("logstream tail stopping")
+					return fmt.Errorf("killed")
+				}
 				if err != nil {
 					newerr := errors.Wrapf(err, "while reading %s/%s", cfg.GroupName, cfg.StreamName)
 					cfg.logger.Warningf("err : %s", newerr)
@@ -493,35 +611,30 @@ func (cw *CloudwatchSource) TailLogStream(cfg *LogStreamTailConfig, outChan chan
 func (cw *CloudwatchSource) ConfigureByDSN(dsn string, labels map[string]string, logger *log.Entry) error {
 	cw.logger = logger
 
-	dsn = strings.TrimPrefix(dsn, cw.GetName()+"://")
-	args := strings.Split(dsn, "?")
-	if len(args) != 2 {
+	parsed, err := configuration.ParseDSN(dsn, cw.GetName())
+	if err != nil {
+		return err
+	}
+	if len(parsed.Params) == 0 {
 		return fmt.Errorf("query is mandatory (at least start_date and end_date or backlog)")
 	}
-	frags := strings.Split(args[0], ":")
-	if len(frags) != 2 {
+	frags := strings.Split(parsed.Target, ":")
+	if len(frags) > 2 || (len(frags) == 1 && len(parsed.Params["query"]) == 0) {
 		return fmt.Errorf("cloudwatch path must contain group and stream : /my/group/name:stream/name")
 	}
 	cw.Config.GroupName = frags[0]
-	cw.Config.StreamName = &frags[1]
+	if len(frags) == 2 {
+		cw.Config.StreamName = &frags[1]
+	}
 	cw.Config.Labels = labels
-	u, err := url.ParseQuery(args[1])
-	if err != nil {
-		return errors.Wrapf(err, "while parsing %s", dsn)
+	if err := parsed.SetLogLevel(cw.logger); err != nil {
+		return err
 	}
 
-	for k, v := range u {
+	for k, v := range parsed.Params {
 		switch k {
 		case "log_level":
-			if len(v) != 1 {
-				return fmt.Errorf("expected zero or one value for 'log_level'")
-			}
-			lvl, err := log.ParseLevel(v[0])
-			if err != nil {
-				return errors.Wrapf(err, "unknown level %s", v[0])
-			}
-			cw.logger.Logger.SetLevel(lvl)
-
+			//already handled
 		case "profile":
 			if len(v) != 1 {
 				return fmt.Errorf("expected zero or one value for 'profile'")
@@ -559,19 +672,19 @@ func (cw *CloudwatchSource) ConfigureByDSN(dsn string, labels map[string]string,
 			cw.Config.StartTime = &start
 			end := time.Now().UTC()
 			cw.Config.EndTime = &end
+		case "query":
+			if len(v) != 1 {
+				return fmt.Errorf("expected zero or one argument for 'query'")
+			}
+			cw.Config.Query = v[0]
 		default:
 			return fmt.Errorf("unexpected argument %s", k)
 		}
 	}
 	cw.logger.Tracef("host=%s", cw.Config.GroupName)
-	cw.logger.Tracef("stream=%s", *cw.Config.StreamName)
 	cw.Config.GetLogEventsPagesLimit = &def_GetLogEventsPagesLimit
 
-	if err := cw.newClient(); err != nil {
-		return err
-	}
-
-	if cw.Config.StreamName == nil || cw.Config.GroupName == "" {
+	if (cw.Config.StreamName == nil && cw.Config.Query == "") || cw.Config.GroupName == "" {
 		return fmt.Errorf("missing stream or group name")
 	}
 	if cw.Config.StartTime == nil || cw.Config.EndTime == nil {
@@ -579,12 +692,30 @@ func (cw *CloudwatchSource) ConfigureByDSN(dsn string, labels map[string]string,
 	}
 
 	cw.Config.Mode = configuration.CAT_MODE
+	if err := cw.configureQuery(); err != nil {
+		return err
+	}
+
+	if err := cw.newClient(); err != nil {
+		return err
+	}
+	if cw.Config.Query != "" {
+		retrier, err := retry.New(cw.Config.Retry, cw.logger)
+		if err != nil {
+			return err
+		}
+		retrier.Notify = cw.notifyRetry
+		cw.retrier = retrier
+	}
 	cw.streamIndexes = make(map[string]string)
 	cw.t = &tomb.Tomb{}
 	return nil
 }
 
 func (cw *CloudwatchSource) OneShotAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	if cw.Config.Query != "" {
+		return cw.InsightsAcquisition(out, t)
+	}
 	//StreamName string, Start time.Time, End time.Time
 	config := LogStreamTailConfig{
 		GroupName:              cw.Config.GroupName,
@@ -637,6 +768,7 @@ func (cw *CloudwatchSource) CatLogStream(cfg *LogStreamTailConfig, outChan chan
 							cfg.logger.Warningf("discard event : %s", err)
 						}
 						cfg.logger.Debugf("pushing message : %s", evt.Line.Raw)
+						cw.EventSeen(&evt.Line)
 						outChan <- evt
 					}
 					if startFrom != nil && *page.NextForwardToken == *startFrom {
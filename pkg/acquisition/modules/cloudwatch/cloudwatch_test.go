@@ -6,10 +6,13 @@ import (
 	"os"
 	"runtime"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
 	"github.com/crowdsecurity/crowdsec/pkg/types"
 	log "github.com/sirupsen/logrus"
@@ -567,6 +570,61 @@ labels:
 stream_name: test_stream`),
 			expectedCfgErr: "group_name is mandatory for CloudwatchSource",
 		},
+		{
+			name: "query_in_tail_mode",
+			config: []byte(`
+source: cloudwatch
+aws_region: us-east-1
+group_name: test_group
+query: fields @timestamp, @message`),
+			expectedCfgErr: "query is only supported in cat mode",
+		},
+		{
+			name: "query_with_stream",
+			config: []byte(`
+source: cloudwatch
+aws_region: us-east-1
+mode: cat
+group_name: test_group
+stream_name: test_stream
+since: 24h
+query: fields @timestamp, @message`),
+			expectedCfgErr: "stream_name and stream_regexp are not used with query",
+		},
+		{
+			name: "query_without_since",
+			config: []byte(`
+source: cloudwatch
+aws_region: us-east-1
+mode: cat
+group_name: test_group
+query: fields @timestamp, @message`),
+			expectedCfgErr: "since is mandatory with query",
+		},
+		{
+			name: "query_bad_limit",
+			config: []byte(`
+source: cloudwatch
+aws_region: us-east-1
+mode: cat
+group_name: test_group
+since: 24h
+query_limit: 20000
+query: fields @timestamp, @message`),
+			expectedCfgErr: "query_limit must be between 1 and 10000",
+		},
+		{
+			name: "query_bad_range",
+			config: []byte(`
+source: cloudwatch
+aws_region: us-east-1
+mode: cat
+group_name: test_group
+since: 2h
+until: 3h
+query: fields @timestamp, @message`),
+			expectedCfgErr: "since must be before until",
+		},
 	}
 
 	for idx, test := range tests {
@@ -645,6 +703,20 @@ func TestConfigureByDSN(t *testing.T) {
 			dsn:            "cloudwatch://bad_log_group:bad_stream_name?backlog=4h&log_level=",
 			expectedCfgErr: "unknown level : not a valid logrus Level: ",
 		},
+		{
+			name:           "missing_stream",
+			dsn:            "cloudwatch://bad_log_group?backlog=4h",
+			expectedCfgErr: "cloudwatch path must contain group and stream",
+		},
+		{
+			name: "query",
+			dsn:  "cloudwatch://bad_log_group?backlog=4h&query=fields @timestamp, @message | filter @message like /sshd/",
+		},
+		{
+			name:           "query_with_stream",
+			dsn:            "cloudwatch://bad_log_group:bad_stream_name?backlog=4h&query=fields @timestamp, @message",
+			expectedCfgErr: "stream_name and stream_regexp are not used with query",
+		},
 	}
 
 	for idx, test := range tests {
@@ -882,3 +954,155 @@ func TestOneShotAcquisition(t *testing.T) {
 	}
 
 }
+
+type insightsRecord struct {
+	timestamp time.Time
+	ptr       string
+	message   string
+}
+
+//fakeInsights runs the queries on its records : a query is running at the first poll, and complete at the next one
+type fakeInsights struct {
+	lock        sync.Mutex
+	records     []insightsRecord
+	limitErrors int      //number of StartQuery calls failing with LimitExceededException
+	starts      []int64  //start of the queries
+	stopped     []string //id of the stopped queries
+	polls       map[string]int
+	queries     map[string][]int64
+	neverEnds   bool
+}
+
+func (f *fakeInsights) StartQueryWithContext(ctx aws.Context, input *cloudwatchlogs.StartQueryInput, opts ...request.Option) (*cloudwatchlogs.StartQueryOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.limitErrors > 0 {
+		f.limitErrors--
+		return nil, awserr.New(cloudwatchlogs.ErrCodeLimitExceededException, "too many concurrent queries", nil)
+	}
+	id := fmt.Sprintf("query-%d", len(f.starts))
+	f.starts = append(f.starts, *input.StartTime)
+	f.queries[id] = []int64{*input.StartTime, *input.EndTime, *input.Limit}
+	return &cloudwatchlogs.StartQueryOutput{QueryId: aws.String(id)}, nil
+}
+
+func (f *fakeInsights) GetQueryResultsWithContext(ctx aws.Context, input *cloudwatchlogs.GetQueryResultsInput, opts ...request.Option) (*cloudwatchlogs.GetQueryResultsOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	id := *input.QueryId
+	f.polls[id]++
+	if f.neverEnds || f.polls[id] == 1 {
+		return &cloudwatchlogs.GetQueryResultsOutput{Status: aws.String(cloudwatchlogs.QueryStatusRunning)}, nil
+	}
+	query := f.queries[id]
+	results := [][]*cloudwatchlogs.ResultField{}
+	for _, record := range f.records {
+		if record.timestamp.Unix() < query[0] || record.timestamp.Unix() > query[1] || int64(len(results)) == query[2] {
+			continue
+		}
+		results = append(results, []*cloudwatchlogs.ResultField{
+			{Field: aws.String("@timestamp"), Value: aws.String(record.timestamp.Format(insightsTimestamp))},
+			{Field: aws.String("@message"), Value: aws.String(record.message)},
+			{Field: aws.String("@ptr"), Value: aws.String(record.ptr)},
+		})
+	}
+	return &cloudwatchlogs.GetQueryResultsOutput{Status: aws.String(cloudwatchlogs.QueryStatusComplete), Results: results}, nil
+}
+
+func (f *fakeInsights) StopQuery(input *cloudwatchlogs.StopQueryInput) (*cloudwatchlogs.StopQueryOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.stopped = append(f.stopped, *input.QueryId)
+	return &cloudwatchlogs.StopQueryOutput{Success: aws.Bool(true)}, nil
+}
+
+func newInsightsSource(t *testing.T, fake *fakeInsights) *CloudwatchSource {
+	cw := CloudwatchSource{}
+	err := cw.Configure([]byte(`
+source: cloudwatch
+aws_region: us-east-1
+mode: cat
+group_name: test_group
+query: fields @timestamp, @message | filter @message like /sshd/
+query_limit: 3
+query_poll_interval: 10ms
+since: 2022-03-01T10:00:00Z
+until: 2022-03-01T11:00:00Z
+retry:
+  base: 10ms`), log.WithField("type", "cloudwatch"))
+	if err != nil {
+		t.Fatalf("unexpected error : %s", err)
+	}
+	fake.polls = make(map[string]int)
+	fake.queries = make(map[string][]int64)
+	cw.insights = fake
+	return &cw
+}
+
+func TestInsightsAcquisition(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on windows")
+	}
+	base := time.Date(2022, 3, 1, 10, 0, 0, 0, time.UTC)
+	fake := &fakeInsights{
+		limitErrors: 1,
+		records: []insightsRecord{
+			{base, "a", "line a"},
+			{base.Add(100 * time.Millisecond), "b", "line b"},
+			{base.Add(time.Second), "c", "line c"},
+			{base.Add(time.Second + 100*time.Millisecond), "d", "line d"},
+			{base.Add(time.Second + 200*time.Millisecond), "e", "line e"},
+			{base.Add(2 * time.Second), "f", "line f"},
+		},
+	}
+	cw := newInsightsSource(t, fake)
+	if query := cw.insightsQuery(); query != "fields @timestamp, @message | filter @message like /sshd/ | sort @timestamp asc | limit 3" {
+		t.Fatalf("unexpected query %s", query)
+	}
+	out := make(chan types.Event, 10)
+	tmb := tomb.Tomb{}
+	if err := cw.OneShotAcquisition(out, &tmb); err != nil {
+		t.Fatalf("unexpected error : %s", err)
+	}
+	close(out)
+	messages := []string{}
+	for evt := range out {
+		if evt.Line.Src != "test_group" {
+			t.Fatalf("unexpected source %s", evt.Line.Src)
+		}
+		messages = append(messages, evt.Line.Raw)
+	}
+	//the results of the first second are paginated without duplicates
+	expected := []string{"line a", "line b", "line c", "line d", "line e", "line f"}
+	if strings.Join(messages, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected %v, got %v", expected, messages)
+	}
+	starts := []int64{base.Unix(), base.Unix() + 1, base.Unix() + 1, base.Unix() + 2}
+	if fmt.Sprint(fake.starts) != fmt.Sprint(starts) {
+		t.Fatalf("expected queries starting at %v, got %v", starts, fake.starts)
+	}
+}
+
+func TestInsightsAcquisitionKill(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on windows")
+	}
+	fake := &fakeInsights{neverEnds: true}
+	cw := newInsightsSource(t, fake)
+	out := make(chan types.Event)
+	tmb := tomb.Tomb{}
+	tmb.Go(func() error {
+		return cw.OneShotAcquisition(out, &tmb)
+	})
+	time.Sleep(100 * time.Millisecond)
+	tmb.Kill(nil)
+	if err := tmb.Wait(); err != nil {
+		t.Fatalf("unexpected error : %s", err)
+	}
+	//the running query is stopped instead of counting in the concurrent queries
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	if fmt.Sprint(fake.stopped) != "[query-0]" {
+		t.Fatalf("expected query-0 to be stopped, got %v", fake.stopped)
+	}
+}
@@ -0,0 +1,193 @@
+package cloudwatchacquisition
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/retry"
+	leaky "github.com/crowdsecurity/crowdsec/pkg/leakybucket"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/tomb.v2"
+)
+
+var (
+	def_QueryLimit        = int64(10000)
+	def_QueryPollInterval = time.Second
+)
+
+//insightsTimestamp is the format of the @timestamp field in the results of the queries
+const insightsTimestamp = "2006-01-02 15:04:05.000"
+
+//insightsClient is the part of the cloudwatch logs api used to run the Logs Insights queries
+type insightsClient interface {
+	StartQueryWithContext(ctx aws.Context, input *cloudwatchlogs.StartQueryInput, opts ...request.Option) (*cloudwatchlogs.StartQueryOutput, error)
+	GetQueryResultsWithContext(ctx aws.Context, input *cloudwatchlogs.GetQueryResultsInput, opts ...request.Option) (*cloudwatchlogs.GetQueryResultsOutput, error)
+	StopQuery(input *cloudwatchlogs.StopQueryInput) (*cloudwatchlogs.StopQueryOutput, error)
+}
+
+//insightsError tells the retrier not to retry the queries that can't succeed. The quotas errors (LimitExceeded
+//when too many queries are running, ThrottlingException) are retried with the backoff of the datasource
+func insightsError(err error) error {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case cloudwatchlogs.ErrCodeResourceNotFoundException, cloudwatchlogs.ErrCodeMalformedQueryException, cloudwatchlogs.ErrCodeInvalidParameterException:
+			return retry.Permanent(err)
+		}
+	}
+	return err
+}
+
+//insightsQuery returns the query of the configuration, sorted by time and limited so that the time range can be
+//split when the limit is reached
+func (cw *CloudwatchSource) insightsQuery() string {
+	return fmt.Sprintf("%s | sort @timestamp asc | limit %d", strings.TrimSpace(cw.Config.Query), *cw.Config.QueryLimit)
+}
+
+//runQuery runs a query between start and end (seconds since epoch), and returns its results once it's complete
+func (cw *CloudwatchSource) runQuery(start int64, end int64, t *tomb.Tomb) ([][]*cloudwatchlogs.ResultField, error) {
+	ctx := t.Context(nil)
+	var queryId *string
+	err := cw.retrier.Do(t.Dying(), func() error {
+		output, err := cw.insights.StartQueryWithContext(ctx, &cloudwatchlogs.StartQueryInput{
+			LogGroupName: aws.String(cw.Config.GroupName),
+			QueryString:  aws.String(cw.insightsQuery()),
+			StartTime:    aws.Int64(start),
+			EndTime:      aws.Int64(end),
+			Limit:        cw.Config.QueryLimit,
+		})
+		if err != nil {
+			return insightsError(err)
+		}
+		queryId = output.QueryId
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	cw.logger.Debugf("query %s started from %d to %d", aws.StringValue(queryId), start, end)
+	ticker := time.NewTicker(*cw.Config.QueryPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.Dying():
+			//the query would otherwise keep running, and counting in the concurrent queries
+			if _, err := cw.insights.StopQuery(&cloudwatchlogs.StopQueryInput{QueryId: queryId}); err != nil {
+				cw.logger.Debugf("unable to stop query %s : %s", aws.StringValue(queryId), err)
+			}
+			return nil, retry.ErrDying
+		case <-ticker.C:
+		}
+		var output *cloudwatchlogs.GetQueryResultsOutput
+		err := cw.retrier.Do(t.Dying(), func() error {
+			var err error
+			output, err = cw.insights.GetQueryResultsWithContext(ctx, &cloudwatchlogs.GetQueryResultsInput{QueryId: queryId})
+			return insightsError(err)
+		})
+		if err != nil {
+			return nil, err
+		}
+		switch aws.StringValue(output.Status) {
+		case cloudwatchlogs.QueryStatusComplete:
+			return output.Results, nil
+		case cloudwatchlogs.QueryStatusScheduled, cloudwatchlogs.QueryStatusRunning:
+			continue
+		default:
+			return nil, fmt.Errorf("query %s ended with status %s", aws.StringValue(queryId), aws.StringValue(output.Status))
+		}
+	}
+}
+
+//resultField returns the value of a field of a result
+func resultField(result []*cloudwatchlogs.ResultField, name string) (string, bool) {
+	for _, field := range result {
+		if aws.StringValue(field.Field) == name {
+			return aws.StringValue(field.Value), true
+		}
+	}
+	return "", false
+}
+
+func (cw *CloudwatchSource) insightsEvent(message string) types.Event {
+	l := types.Line{}
+	l.Raw = message
+	l.Labels = cw.Config.Labels
+	l.Time = time.Now().UTC()
+	l.Src = cw.Config.GroupName
+	l.Process = true
+	l.Module = cw.GetName()
+	return types.Event{Line: l, Process: true, Type: types.LOG, ExpectMode: leaky.TIMEMACHINE}
+}
+
+//InsightsAcquisition runs the query over the time range of the configuration. The results of a query are limited :
+//when the limit is reached, the next query starts at the second of the last result, and the results already sent
+//at this second are skipped
+func (cw *CloudwatchSource) InsightsAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	start := cw.Config.StartTime.UTC().Unix()
+	end := cw.Config.EndTime.UTC().Unix()
+	cw.logger.Infof("running query on group %s from %s to %s", cw.Config.GroupName, cw.Config.StartTime.UTC(), cw.Config.EndTime.UTC())
+	seen := map[string]bool{} //@ptr of the results sent at the second the next query starts
+	for start <= end {
+		results, err := cw.runQuery(start, end, t)
+		if err == retry.ErrDying {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(err, "while querying group %s", cw.Config.GroupName)
+		}
+		last := start
+		lastSeen := map[string]bool{}
+		for _, result := range results {
+			ptr, _ := resultField(result, "@ptr")
+			if seen[ptr] {
+				continue
+			}
+			if value, ok := resultField(result, "@timestamp"); ok {
+				if timestamp, err := time.Parse(insightsTimestamp, value); err == nil {
+					if timestamp.Unix() != last {
+						last = timestamp.Unix()
+						lastSeen = map[string]bool{}
+					}
+					lastSeen[ptr] = true
+				}
+			}
+			message, ok := resultField(result, cw.Config.QueryMessageField)
+			if !ok {
+				cw.logger.Debugf("skipping result without %s", cw.Config.QueryMessageField)
+				continue
+			}
+			evt := cw.insightsEvent(message)
+			cw.EventSeen(&evt.Line)
+			select {
+			case out <- evt:
+				linesRead.With(prometheus.Labels{"group": cw.Config.GroupName, "stream": "insights"}).Inc()
+			case <-t.Dying():
+				return nil
+			}
+		}
+		if int64(len(results)) < *cw.Config.QueryLimit {
+			break
+		}
+		if last == start && len(lastSeen) == 0 {
+			//the whole page was already sent : the limit is reached in a single second
+			cw.logger.Warningf("query_limit (%d) reached at %s, the next results of this second are skipped", *cw.Config.QueryLimit, time.Unix(start, 0).UTC())
+			last++
+		}
+		if last == start {
+			for ptr := range lastSeen {
+				seen[ptr] = true
+			}
+		} else {
+			seen = lastSeen
+		}
+		start = last
+	}
+	cw.logger.Infof("query on group %s done", cw.Config.GroupName)
+	return nil
+}
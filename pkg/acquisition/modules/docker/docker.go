@@ -4,7 +4,6 @@ import (
 	"bufio"
 	"context"
 	"fmt"
-	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
@@ -12,9 +11,12 @@ import (
 
 	"github.com/ahmetb/dlog"
 	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/limits"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/retry"
 	leaky "github.com/crowdsecurity/crowdsec/pkg/leakybucket"
 	"github.com/crowdsecurity/crowdsec/pkg/types"
 	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
 
 	"github.com/pkg/errors"
@@ -32,28 +34,33 @@ var linesRead = prometheus.NewCounterVec(
 	[]string{"source"})
 
 type DockerConfiguration struct {
-	CheckInterval                     string   `yaml:"check_interval"`
-	FollowStdout                      bool     `yaml:"follow_stdout"`
-	FollowStdErr                      bool     `yaml:"follow_stderr"`
-	Until                             string   `yaml:"until"`
-	Since                             string   `yaml:"since"`
-	DockerHost                        string   `yaml:"docker_host"`
-	ContainerName                     []string `yaml:"container_name"`
-	ContainerID                       []string `yaml:"container_id"`
-	ContainerNameRegexp               []string `yaml:"container_name_regexp"`
-	ContainerIDRegexp                 []string `yaml:"container_id_regexp"`
-	ForceInotify                      bool     `yaml:"force_inotify"`
+	CheckInterval                     string            `yaml:"check_interval"`
+	FollowStdout                      bool              `yaml:"follow_stdout"`
+	FollowStdErr                      bool              `yaml:"follow_stderr"`
+	Until                             string            `yaml:"until"`
+	Since                             string            `yaml:"since"`
+	DockerHost                        string            `yaml:"docker_host"`
+	ContainerName                     []string          `yaml:"container_name"`
+	ContainerID                       []string          `yaml:"container_id"`
+	ContainerNameRegexp               []string          `yaml:"container_name_regexp"`
+	ContainerIDRegexp                 []string          `yaml:"container_id_regexp"`
+	ContainerLabel                    []string          `yaml:"container_label"`       //label selectors : key or key=value, comma separated to require several labels
+	LabelsFromContainer               map[string]string `yaml:"labels_from_container"` //set crowdsec labels (values) from the labels of the containers (keys)
+	ForceInotify                      bool              `yaml:"force_inotify"`
 	configuration.DataSourceCommonCfg `yaml:",inline"`
 }
 
 type DockerSource struct {
+	configuration.HealthTracker
 	Config                DockerConfiguration
 	runningContainerState map[string]*ContainerConfig
 	compiledContainerName []*regexp.Regexp
 	compiledContainerID   []*regexp.Regexp
+	labelSelectors        []labelSelector
 	CheckIntervalDuration time.Duration
 	logger                *log.Entry
 	Client                client.CommonAPIClient
+	retrier               *retry.Retrier
 	t                     *tomb.Tomb
 	containerLogsOptions  *dockerTypes.ContainerLogsOptions
 }
@@ -85,8 +92,8 @@ func (d *DockerSource) Configure(Config []byte, logger *log.Entry) error {
 	}
 
 	d.logger.Tracef("DockerAcquisition configuration: %+v", d.Config)
-	if len(d.Config.ContainerName) == 0 && len(d.Config.ContainerID) == 0 && len(d.Config.ContainerIDRegexp) == 0 && len(d.Config.ContainerNameRegexp) == 0 {
-		return fmt.Errorf("no containers names or containers ID configuration provided")
+	if len(d.Config.ContainerName) == 0 && len(d.Config.ContainerID) == 0 && len(d.Config.ContainerIDRegexp) == 0 && len(d.Config.ContainerNameRegexp) == 0 && len(d.Config.ContainerLabel) == 0 {
+		return fmt.Errorf("no containers names, containers ID or containers labels configuration provided")
 	}
 
 	d.CheckIntervalDuration, err = time.ParseDuration(d.Config.CheckInterval)
@@ -110,11 +117,29 @@ func (d *DockerSource) Configure(Config []byte, logger *log.Entry) error {
 		d.compiledContainerID = append(d.compiledContainerID, regexp.MustCompile(cont))
 	}
 
+	for _, selector := range d.Config.ContainerLabel {
+		labelSelector, err := parseLabelSelector(selector)
+		if err != nil {
+			return err
+		}
+		d.labelSelectors = append(d.labelSelectors, labelSelector)
+	}
+
 	dockerClient, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		return err
 	}
 
+	d.retrier, err = retry.New(d.Config.Retry, d.logger)
+	if err != nil {
+		return err
+	}
+	d.retrier.Notify = func(err error) {
+		if err != nil {
+			d.SetState(configuration.STATUS_RECONNECTING, err)
+		}
+	}
+
 	if d.Config.Since == "" {
 		d.Config.Since = time.Now().UTC().Format(time.RFC3339)
 	}
@@ -147,10 +172,9 @@ func (d *DockerSource) Configure(Config []byte, logger *log.Entry) error {
 }
 
 func (d *DockerSource) ConfigureByDSN(dsn string, labels map[string]string, logger *log.Entry) error {
-	var err error
-
-	if !strings.HasPrefix(dsn, d.GetName()+"://") {
-		return fmt.Errorf("invalid DSN %s for docker source, must start with %s://", dsn, d.GetName())
+	parsed, err := configuration.ParseDSN(dsn, d.GetName())
+	if err != nil {
+		return err
 	}
 
 	d.Config = DockerConfiguration{
@@ -175,79 +199,51 @@ func (d *DockerSource) ConfigureByDSN(dsn string, labels map[string]string, logg
 		ShowStderr: d.Config.FollowStdErr,
 		Follow:     false,
 	}
-	dsn = strings.TrimPrefix(dsn, d.GetName()+"://")
-	args := strings.Split(dsn, "?")
-
-	if len(args) == 0 {
-		return fmt.Errorf("invalid dsn: %s", dsn)
-	}
 
-	if len(args) == 1 && args[0] == "" {
+	if parsed.Target == "" {
 		return fmt.Errorf("empty %s DSN", d.GetName()+"://")
 	}
-	d.Config.ContainerName = append(d.Config.ContainerName, args[0])
+	d.Config.ContainerName = append(d.Config.ContainerName, parsed.Target)
 	// we add it as an ID also so user can provide docker name or docker ID
-	d.Config.ContainerID = append(d.Config.ContainerID, args[0])
+	d.Config.ContainerID = append(d.Config.ContainerID, parsed.Target)
 
-	// no parameters
-	if len(args) == 1 {
-		d.Client = dockerClient
-		return nil
+	if err := parsed.CheckParams("until", "since", "follow_stdout", "follow_stderr", "docker_host"); err != nil {
+		return err
 	}
-
-	parameters, err := url.ParseQuery(args[1])
-	if err != nil {
-		return errors.Wrapf(err, "while parsing parameters %s: %s", dsn, err)
+	if err := parsed.SetLogLevel(d.logger); err != nil {
+		return err
 	}
-
-	for k, v := range parameters {
-		switch k {
-		case "log_level":
-			if len(v) != 1 {
-				return fmt.Errorf("only one 'log_level' parameters is required, not many")
-			}
-			lvl, err := log.ParseLevel(v[0])
-			if err != nil {
-				return errors.Wrapf(err, "unknown level %s", v[0])
-			}
-			d.logger.Logger.SetLevel(lvl)
-		case "until":
-			if len(v) != 1 {
-				return fmt.Errorf("only one 'until' parameters is required, not many")
-			}
-			d.containerLogsOptions.Until = v[0]
-		case "since":
-			if len(v) != 1 {
-				return fmt.Errorf("only one 'since' parameters is required, not many")
-			}
-			d.containerLogsOptions.Since = v[0]
-		case "follow_stdout":
-			if len(v) != 1 {
-				return fmt.Errorf("only one 'follow_stdout' parameters is required, not many")
-			}
-			followStdout, err := strconv.ParseBool(v[0])
-			if err != nil {
-				return fmt.Errorf("parsing 'follow_stdout' parameters: %s", err)
-			}
-			d.Config.FollowStdout = followStdout
-			d.containerLogsOptions.ShowStdout = followStdout
-		case "follow_stderr":
-			if len(v) != 1 {
-				return fmt.Errorf("only one 'follow_stderr' parameters is required, not many")
-			}
-			followStdErr, err := strconv.ParseBool(v[0])
-			if err != nil {
-				return fmt.Errorf("parsing 'follow_stderr' parameters: %s", err)
-			}
-			d.Config.FollowStdErr = followStdErr
-			d.containerLogsOptions.ShowStderr = followStdErr
-		case "docker_host":
-			if len(v) != 1 {
-				return fmt.Errorf("only one 'docker_host' parameters is required, not many")
-			}
-			if err := client.WithHost(v[0])(dockerClient); err != nil {
-				return err
-			}
+	if d.containerLogsOptions.Until, err = parsed.Param("until"); err != nil {
+		return err
+	}
+	if d.containerLogsOptions.Since, err = parsed.Param("since"); err != nil {
+		return err
+	}
+	if v, err := parsed.Param("follow_stdout"); err != nil {
+		return err
+	} else if v != "" {
+		followStdout, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("parsing 'follow_stdout' parameters: %s", err)
+		}
+		d.Config.FollowStdout = followStdout
+		d.containerLogsOptions.ShowStdout = followStdout
+	}
+	if v, err := parsed.Param("follow_stderr"); err != nil {
+		return err
+	} else if v != "" {
+		followStdErr, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("parsing 'follow_stderr' parameters: %s", err)
+		}
+		d.Config.FollowStdErr = followStdErr
+		d.containerLogsOptions.ShowStderr = followStdErr
+	}
+	if v, err := parsed.Param("docker_host"); err != nil {
+		return err
+	} else if v != "" {
+		if err := client.WithHost(v)(dockerClient); err != nil {
+			return err
 		}
 	}
 	d.Client = dockerClient
@@ -300,13 +296,14 @@ func (d *DockerSource) OneShotAcquisition(out chan types.Event, t *tomb.Tomb) er
 				}
 				l := types.Line{}
 				l.Raw = line
-				l.Labels = d.Config.Labels
+				l.Labels = containerConfig.Labels
 				l.Time = time.Now().UTC()
 				l.Src = containerConfig.Name
 				l.Process = true
 				l.Module = d.GetName()
 				linesRead.With(prometheus.Labels{"source": containerConfig.Name}).Inc()
 				evt := types.Event{Line: l, Process: true, Type: types.LOG, ExpectMode: leaky.TIMEMACHINE}
+				d.EventSeen(&evt.Line)
 				out <- evt
 				d.logger.Debugf("Sent line to parsing: %+v", evt.Line.Raw)
 			}
@@ -339,6 +336,10 @@ func (d *DockerSource) GetName() string {
 	return "docker"
 }
 
+func (d *DockerSource) GetUuid() string {
+	return d.Config.UniqueId
+}
+
 func (d *DockerSource) CanRun() error {
 	return nil
 }
@@ -351,10 +352,27 @@ func (d *DockerSource) getContainerTTY(containerId string) bool {
 	return containerDetails.Config.Tty
 }
 
+// containerConfig returns the configuration of a container to tail, with the crowdsec labels taken from its labels
+func (d *DockerSource) containerConfig(container dockerTypes.Container, name string) *ContainerConfig {
+	labels := d.Config.Labels
+	if len(d.Config.LabelsFromContainer) > 0 {
+		labels = make(map[string]string, len(d.Config.Labels))
+		for key, value := range d.Config.Labels {
+			labels[key] = value
+		}
+		for containerLabel, label := range d.Config.LabelsFromContainer {
+			if value, ok := container.Labels[containerLabel]; ok {
+				labels[label] = value
+			}
+		}
+	}
+	return &ContainerConfig{ID: container.ID, Name: name, Labels: labels, Tty: d.getContainerTTY(container.ID)}
+}
+
 func (d *DockerSource) EvalContainer(container dockerTypes.Container) (*ContainerConfig, bool) {
 	for _, containerID := range d.Config.ContainerID {
 		if containerID == container.ID {
-			return &ContainerConfig{ID: container.ID, Name: container.Names[0], Labels: d.Config.Labels, Tty: d.getContainerTTY(container.ID)}, true
+			return d.containerConfig(container, container.Names[0]), true
 		}
 	}
 
@@ -364,7 +382,7 @@ func (d *DockerSource) EvalContainer(container dockerTypes.Container) (*Containe
 				name = name[1:]
 			}
 			if name == containerName {
-				return &ContainerConfig{ID: container.ID, Name: name, Labels: d.Config.Labels, Tty: d.getContainerTTY(container.ID)}, true
+				return d.containerConfig(container, name), true
 			}
 		}
 
@@ -372,22 +390,41 @@ func (d *DockerSource) EvalContainer(container dockerTypes.Container) (*Containe
 
 	for _, cont := range d.compiledContainerID {
 		if matched := cont.Match([]byte(container.ID)); matched {
-			return &ContainerConfig{ID: container.ID, Name: container.Names[0], Labels: d.Config.Labels, Tty: d.getContainerTTY(container.ID)}, true
+			return d.containerConfig(container, container.Names[0]), true
 		}
 	}
 
 	for _, cont := range d.compiledContainerName {
 		for _, name := range container.Names {
 			if matched := cont.Match([]byte(name)); matched {
-				return &ContainerConfig{ID: container.ID, Name: name, Labels: d.Config.Labels, Tty: d.getContainerTTY(container.ID)}, true
+				return d.containerConfig(container, name), true
 			}
 		}
 
 	}
 
+	for _, selector := range d.labelSelectors {
+		if selector.match(container.Labels) {
+			return d.containerConfig(container, container.Names[0]), true
+		}
+	}
+
 	return &ContainerConfig{}, false
 }
 
+func (d *DockerSource) stopContainerTails() {
+	for idx, container := range d.runningContainerState {
+		if d.runningContainerState[idx].t.Alive() {
+			d.logger.Infof("killing tail for container %s", container.Name)
+			d.runningContainerState[idx].t.Kill(nil)
+			if err := d.runningContainerState[idx].t.Wait(); err != nil {
+				d.logger.Infof("error while waiting for death of %s : %s", container.Name, err)
+			}
+		}
+		delete(d.runningContainerState, idx)
+	}
+}
+
 func (d *DockerSource) WatchContainer(monitChan chan *ContainerConfig, deleteChan chan *ContainerConfig) error {
 	ticker := time.NewTicker(d.CheckIntervalDuration)
 	d.logger.Infof("Container watcher started, interval: %s", d.CheckIntervalDuration.String())
@@ -399,24 +436,25 @@ func (d *DockerSource) WatchContainer(monitChan chan *ContainerConfig, deleteCha
 		case <-ticker.C:
 			// to track for garbage collection
 			runningContainersID := make(map[string]bool)
-			runningContainer, err := d.Client.ContainerList(context.Background(), dockerTypes.ContainerListOptions{})
-			if err != nil {
-				if strings.Contains(strings.ToLower(err.Error()), "cannot connect to the docker daemon at") {
-					for idx, container := range d.runningContainerState {
-						if d.runningContainerState[idx].t.Alive() {
-							d.logger.Infof("killing tail for container %s", container.Name)
-							d.runningContainerState[idx].t.Kill(nil)
-							if err := d.runningContainerState[idx].t.Wait(); err != nil {
-								d.logger.Infof("error while waiting for death of %s : %s", container.Name, err)
-							}
-						}
-						delete(d.runningContainerState, idx)
-					}
-				} else {
-					log.Errorf("container list err: %s", err.Error())
+			var runningContainer []dockerTypes.Container
+			err := d.retrier.Do(d.t.Dying(), func() error {
+				var err error
+				runningContainer, err = d.Client.ContainerList(context.Background(), dockerTypes.ContainerListOptions{})
+				if err != nil && strings.Contains(strings.ToLower(err.Error()), "cannot connect to the docker daemon at") {
+					//the containers are tailed again once the daemon is back
+					d.stopContainerTails()
 				}
-				continue
+				return err
+			})
+			if err == retry.ErrDying {
+				d.logger.Infof("stopping container watcher")
+				return nil
+			}
+			if err != nil {
+				d.SetState(configuration.STATUS_ERRORED, err)
+				return errors.Wrap(err, "while listing containers")
 			}
+			d.SetState(configuration.STATUS_RUNNING, nil)
 
 			for _, container := range runningContainer {
 				runningContainersID[container.ID] = true
@@ -442,6 +480,63 @@ func (d *DockerSource) WatchContainer(monitChan chan *ContainerConfig, deleteCha
 	}
 }
 
+// watchEvents starts and stops the tails as soon as docker reports that a container started or died, instead of
+// waiting for the next check_interval. If the events stream is lost, it is opened again after check_interval
+func (d *DockerSource) watchEvents(monitChan chan *ContainerConfig, deleteChan chan *ContainerConfig) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	options := dockerTypes.EventsOptions{
+		Filters: filters.NewArgs(filters.Arg("type", "container"), filters.Arg("event", "start"), filters.Arg("event", "die")),
+	}
+	for {
+		messages, errs := d.Client.Events(ctx, options)
+	EVENTS:
+		for {
+			select {
+			case <-d.t.Dying():
+				return nil
+			case message := <-messages:
+				switch message.Action {
+				case "start":
+					details, err := d.Client.ContainerInspect(ctx, message.Actor.ID)
+					if err != nil || details.ContainerJSONBase == nil {
+						d.logger.Warningf("unable to inspect started container %s : %v", message.Actor.ID, err)
+						continue
+					}
+					container := dockerTypes.Container{ID: details.ID, Names: []string{details.Name}}
+					if details.Config != nil {
+						container.Labels = details.Config.Labels
+					}
+					containerConfig, ok := d.EvalContainer(container)
+					if !ok {
+						continue
+					}
+					d.logger.Debugf("container %s started", containerConfig.Name)
+					select {
+					case monitChan <- containerConfig:
+					case <-d.t.Dying():
+						return nil
+					}
+				case "die":
+					select {
+					case deleteChan <- &ContainerConfig{ID: message.Actor.ID}:
+					case <-d.t.Dying():
+						return nil
+					}
+				}
+			case err := <-errs:
+				d.logger.Warningf("lost docker events stream, relying on check_interval : %s", err)
+				break EVENTS
+			}
+		}
+		select {
+		case <-d.t.Dying():
+			return nil
+		case <-time.After(d.CheckIntervalDuration):
+		}
+	}
+}
+
 func (d *DockerSource) StreamingAcquisition(out chan types.Event, t *tomb.Tomb) error {
 	d.t = t
 	monitChan := make(chan *ContainerConfig)
@@ -450,6 +545,9 @@ func (d *DockerSource) StreamingAcquisition(out chan types.Event, t *tomb.Tomb)
 	t.Go(func() error {
 		return d.DockerManager(monitChan, deleteChan, out)
 	})
+	t.Go(func() error {
+		return d.watchEvents(monitChan, deleteChan)
+	})
 
 	return d.WatchContainer(monitChan, deleteChan)
 }
@@ -466,6 +564,11 @@ func ReadTailScanner(scanner *bufio.Scanner, out chan string, t *tomb.Tomb) erro
 }
 
 func (d *DockerSource) TailDocker(container *ContainerConfig, outChan chan types.Event, deleteChan chan *ContainerConfig) error {
+	//when the tailers are limited, wait for a slot : the logs are read from since, what was logged in the meantime is not lost
+	if !limits.AcquireTailer(container.t.Dying()) {
+		return nil
+	}
+	defer limits.ReleaseTailer()
 	container.logger.Infof("start tail for container %s", container.Name)
 	dockerReader, err := d.Client.ContainerLogs(context.Background(), container.ID, *d.containerLogsOptions)
 	if err != nil {
@@ -498,7 +601,7 @@ func (d *DockerSource) TailDocker(container *ContainerConfig, outChan chan types
 			}
 			l := types.Line{}
 			l.Raw = line
-			l.Labels = d.Config.Labels
+			l.Labels = container.Labels
 			l.Time = time.Now().UTC()
 			l.Src = container.Name
 			l.Process = true
@@ -510,6 +613,7 @@ func (d *DockerSource) TailDocker(container *ContainerConfig, outChan chan types
 				evt = types.Event{Line: l, Process: true, Type: types.LOG, ExpectMode: leaky.TIMEMACHINE}
 			}
 			linesRead.With(prometheus.Labels{"source": container.Name}).Inc()
+			d.EventSeen(&evt.Line)
 			outChan <- evt
 			d.logger.Debugf("Sent line to parsing: %+v", evt.Line.Raw)
 		case <-readerTomb.Dying():
@@ -560,3 +664,33 @@ func (d *DockerSource) DockerManager(in chan *ContainerConfig, deleteChan chan *
 		}
 	}
 }
+
+// labelSelector matches the containers that have all its labels, with the given value if any
+type labelSelector map[string]*string
+
+func parseLabelSelector(selector string) (labelSelector, error) {
+	ret := labelSelector{}
+	for _, label := range strings.Split(selector, ",") {
+		label = strings.TrimSpace(label)
+		if label == "" {
+			return nil, fmt.Errorf("invalid container_label '%s' : empty label", selector)
+		}
+		if idx := strings.Index(label, "="); idx >= 0 {
+			value := label[idx+1:]
+			ret[label[:idx]] = &value
+		} else {
+			ret[label] = nil
+		}
+	}
+	return ret, nil
+}
+
+func (s labelSelector) match(labels map[string]string) bool {
+	for key, expected := range s {
+		value, ok := labels[key]
+		if !ok || (expected != nil && value != *expected) {
+			return false
+		}
+	}
+	return true
+}
@@ -15,6 +15,7 @@ import (
 	"github.com/crowdsecurity/crowdsec/pkg/types"
 	dockerTypes "github.com/docker/docker/api/types"
 	dockerContainer "github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/client"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/tomb.v2"
@@ -41,7 +42,7 @@ func TestConfigure(t *testing.T) {
 			config: `
 mode: tail
 source: docker`,
-			expectedErr: "no containers names or containers ID configuration provided",
+			expectedErr: "no containers names, containers ID or containers labels configuration provided",
 		},
 		{
 			config: `
@@ -96,6 +97,10 @@ func TestConfigureDSN(t *testing.T) {
 			dsn:         "docker://test_docker?log_level=foobar",
 			expectedErr: "unknown level foobar: not a valid logrus Level:",
 		},
+		{
+			dsn:         "docker://test_docker?foobar=42",
+			expectedErr: "unsupported key foobar in docker DSN",
+		},
 		{
 			name:        "DSN ok with multiple parameters",
 			dsn:         fmt.Sprintf("docker://test_docker?since=42min&docker_host=%s", dockerHost),
@@ -254,6 +259,52 @@ func (cli *mockDockerCli) ContainerInspect(ctx context.Context, c string) (docke
 	return r, nil
 }
 
+// no container starts or dies while testing
+func (cli *mockDockerCli) Events(ctx context.Context, options dockerTypes.EventsOptions) (<-chan events.Message, <-chan error) {
+	return make(chan events.Message), make(chan error)
+}
+
+func TestEvalContainerLabels(t *testing.T) {
+	selector, err := parseLabelSelector("crowdsec.enable=true, crowdsec.type")
+	if err != nil {
+		t.Fatalf("unexpected error : %s", err)
+	}
+	_, err = parseLabelSelector("crowdsec.enable,")
+	cstest.AssertErrorContains(t, err, "invalid container_label 'crowdsec.enable,' : empty label")
+
+	d := DockerSource{
+		Client:         new(mockDockerCli),
+		labelSelectors: []labelSelector{selector},
+	}
+	d.Config.Labels = map[string]string{"type": "docker", "env": "prod"}
+	d.Config.LabelsFromContainer = map[string]string{"crowdsec.type": "type"}
+
+	//the container has all the labels of the selector
+	containerConfig, ok := d.EvalContainer(dockerTypes.Container{
+		ID:     "12456",
+		Names:  []string{"/nginx"},
+		Labels: map[string]string{"crowdsec.enable": "true", "crowdsec.type": "nginx"},
+	})
+	assert.True(t, ok)
+	assert.Equal(t, "12456", containerConfig.ID)
+	assert.Equal(t, map[string]string{"type": "nginx", "env": "prod"}, containerConfig.Labels)
+	//the configured labels are left untouched
+	assert.Equal(t, "docker", d.Config.Labels["type"])
+
+	_, ok = d.EvalContainer(dockerTypes.Container{
+		ID:     "12457",
+		Names:  []string{"/redis"},
+		Labels: map[string]string{"crowdsec.enable": "false", "crowdsec.type": "redis"},
+	})
+	assert.False(t, ok)
+	_, ok = d.EvalContainer(dockerTypes.Container{
+		ID:     "12458",
+		Names:  []string{"/postgres"},
+		Labels: map[string]string{"crowdsec.enable": "true"},
+	})
+	assert.False(t, ok)
+}
+
 func TestOneShot(t *testing.T) {
 	log.Infof("Test 'TestOneShot'")
 
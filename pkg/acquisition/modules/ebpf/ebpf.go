@@ -0,0 +1,206 @@
+package ebpfacquisition
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	leaky "github.com/crowdsecurity/crowdsec/pkg/leakybucket"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/tomb.v2"
+	"gopkg.in/yaml.v2"
+)
+
+var errTracerClosed = errors.New("tracer is closed")
+
+type EbpfConfiguration struct {
+	Events                            []string `yaml:"events,omitempty"`
+	IncludeLoopback                   bool     `yaml:"include_loopback,omitempty"` //connections to 127.0.0.0/8 and ::1 are ignored by default
+	BufferPages                       int      `yaml:"buffer_pages,omitempty"`     //per cpu, of the perf buffer
+	configuration.DataSourceCommonCfg `yaml:",inline"`
+}
+
+// EbpfSource traces the processes started and the outbound connections made on the host with eBPF, and sends each
+// of them as a json line, so the behavior of the processes can be analyzed without any other tool
+type EbpfSource struct {
+	configuration.HealthTracker
+	config  EbpfConfiguration
+	logger  *log.Entry
+	procDir string
+}
+
+var eventsReceived = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cs_ebpfsource_hits_total",
+		Help: "Total events that were received from the kernel.",
+	},
+	[]string{"event"})
+
+var eventsLost = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "cs_ebpfsource_lost_total",
+		Help: "Total events that were lost because the perf buffer was full.",
+	})
+
+func (e *EbpfSource) GetName() string {
+	return "ebpf"
+}
+
+func (e *EbpfSource) GetUuid() string {
+	return e.config.UniqueId
+}
+
+func (e *EbpfSource) GetMode() string {
+	return e.config.Mode
+}
+
+func (e *EbpfSource) Dump() interface{} {
+	return e
+}
+
+func (e *EbpfSource) CanRun() error {
+	return canRun()
+}
+
+func (e *EbpfSource) GetMetrics() []prometheus.Collector {
+	return []prometheus.Collector{eventsReceived, eventsLost}
+}
+
+func (e *EbpfSource) GetAggregMetrics() []prometheus.Collector {
+	return []prometheus.Collector{eventsReceived, eventsLost}
+}
+
+func (e *EbpfSource) ConfigureByDSN(dsn string, labels map[string]string, logger *log.Entry) error {
+	return fmt.Errorf("ebpf datasource does not support one shot acquisition")
+}
+
+func (e *EbpfSource) OneShotAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	return fmt.Errorf("ebpf datasource does not support one shot acquisition")
+}
+
+func (e *EbpfSource) Configure(yamlConfig []byte, logger *log.Entry) error {
+	e.logger = logger
+	e.procDir = defaultProcDir
+	ebpfConfig := EbpfConfiguration{}
+	ebpfConfig.Mode = configuration.TAIL_MODE
+	if err := yaml.UnmarshalStrict(yamlConfig, &ebpfConfig); err != nil {
+		return errors.Wrap(err, "Cannot parse ebpf configuration")
+	}
+	if ebpfConfig.Mode != configuration.TAIL_MODE {
+		return fmt.Errorf("unsupported mode %s for ebpf datasource", ebpfConfig.Mode)
+	}
+	if len(ebpfConfig.Events) == 0 {
+		ebpfConfig.Events = []string{EBPF_EVENT_EXEC, EBPF_EVENT_CONNECT}
+	}
+	seen := make(map[string]bool)
+	for _, event := range ebpfConfig.Events {
+		if event != EBPF_EVENT_EXEC && event != EBPF_EVENT_CONNECT {
+			return fmt.Errorf("invalid event %s (must be %s or %s)", event, EBPF_EVENT_EXEC, EBPF_EVENT_CONNECT)
+		}
+		if seen[event] {
+			return fmt.Errorf("duplicate event %s", event)
+		}
+		seen[event] = true
+	}
+	if ebpfConfig.BufferPages == 0 {
+		ebpfConfig.BufferPages = 64
+	}
+	if ebpfConfig.BufferPages < 0 {
+		return fmt.Errorf("invalid buffer_pages %d", ebpfConfig.BufferPages)
+	}
+	e.config = ebpfConfig
+	return nil
+}
+
+func (e *EbpfSource) StreamingAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	tr, err := newTracer(e.config.Events, e.config.BufferPages)
+	if err != nil {
+		return errors.Wrap(err, "could not start the ebpf tracer")
+	}
+	e.logger.Infof("tracing %v events", e.config.Events)
+	expectMode := leaky.LIVE
+	if e.config.UseTimeMachine {
+		expectMode = leaky.TIMEMACHINE
+	}
+	t.Go(func() error {
+		defer types.CatchPanic("crowdsec/acquis/ebpf/live")
+		return e.readEvents(out, t, tr, expectMode)
+	})
+	return nil
+}
+
+// keep reports whether an event has to be sent : the connections made by crowdsec itself, or to the loopback
+// unless include_loopback is set, are ignored
+func (e *EbpfSource) keep(evt *processEvent) bool {
+	if evt.Pid == uint32(os.Getpid()) {
+		return false
+	}
+	if evt.Event == EBPF_EVENT_CONNECT && !e.config.IncludeLoopback {
+		if ip := net.ParseIP(evt.DstIP); ip != nil && ip.IsLoopback() {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *EbpfSource) readEvents(out chan types.Event, t *tomb.Tomb, tr *tracer, expectMode int) error {
+	t.Go(func() error {
+		<-t.Dying()
+		e.logger.Info("ebpf datasource is dying")
+		return tr.close()
+	})
+	for {
+		raw, lost, err := tr.read()
+		if err != nil {
+			select {
+			case <-t.Dying():
+				return nil
+			default:
+			}
+			if err == errTracerClosed {
+				return nil
+			}
+			err = errors.Wrap(err, "error while reading the perf buffer")
+			e.SetState(configuration.STATUS_ERRORED, err)
+			return err
+		}
+		if lost > 0 {
+			e.logger.Warningf("lost %d events, the perf buffer is full (see buffer_pages)", lost)
+			eventsLost.Add(float64(lost))
+			continue
+		}
+		evt, err := decodeEvent(raw)
+		if err != nil {
+			e.logger.Debugf("dropping event : %s", err)
+			continue
+		}
+		if evt == nil || !e.keep(evt) {
+			continue
+		}
+		readProcInfo(e.procDir, evt)
+		eventsReceived.With(prometheus.Labels{"event": evt.Event}).Inc()
+		line, err := json.Marshal(evt)
+		if err != nil {
+			continue
+		}
+		l := types.Line{}
+		l.Raw = string(line)
+		l.Module = e.GetName()
+		l.Labels = e.config.Labels
+		l.Time = time.Now().UTC()
+		l.Src = e.GetName()
+		l.Process = true
+		e.EventSeen(&l)
+		select {
+		case out <- types.Event{Line: l, Process: true, Type: types.LOG, ExpectMode: expectMode}:
+		case <-t.Dying():
+			return nil
+		}
+	}
+}
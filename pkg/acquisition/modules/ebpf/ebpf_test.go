@@ -0,0 +1,195 @@
+package ebpfacquisition
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/crowdsecurity/crowdsec/pkg/cstest"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigure(t *testing.T) {
+	tests := []struct {
+		config      string
+		expectedErr string
+	}{
+		{
+			config:      `foobar: bla`,
+			expectedErr: "field foobar not found in type ebpfacquisition.EbpfConfiguration",
+		},
+		{
+			config:      `source: ebpf`,
+			expectedErr: "",
+		},
+		{
+			config:      `mode: cat`,
+			expectedErr: "unsupported mode cat for ebpf datasource",
+		},
+		{
+			config: `
+events:
+  - exec
+  - open`,
+			expectedErr: "invalid event open (must be exec or connect)",
+		},
+		{
+			config: `
+events:
+  - exec
+  - exec`,
+			expectedErr: "duplicate event exec",
+		},
+		{
+			config:      `buffer_pages: -1`,
+			expectedErr: "invalid buffer_pages -1",
+		},
+	}
+	subLogger := log.WithField("type", "ebpf")
+	for _, test := range tests {
+		e := EbpfSource{}
+		err := e.Configure([]byte(test.config), subLogger)
+		cstest.AssertErrorContains(t, err, test.expectedErr)
+	}
+	e := EbpfSource{}
+	require.NoError(t, e.Configure([]byte(`source: ebpf`), subLogger))
+	assert.Equal(t, []string{"exec", "connect"}, e.config.Events)
+	assert.Equal(t, 64, e.config.BufferPages)
+}
+
+func rawEvent(kind uint32, pid uint32, uid uint32, comm string, data []byte, size int) []byte {
+	raw := make([]byte, size)
+	nativeEndian.PutUint32(raw[0:4], kind)
+	nativeEndian.PutUint32(raw[4:8], pid)
+	nativeEndian.PutUint32(raw[8:12], uid)
+	copy(raw[16:eventHeaderLen], comm)
+	copy(raw[eventHeaderLen:], data)
+	return raw
+}
+
+func sockaddr(family uint16, ip net.IP, port uint16) []byte {
+	sa := make([]byte, sockaddrLen)
+	nativeEndian.PutUint16(sa[0:2], family)
+	binary.BigEndian.PutUint16(sa[2:4], port)
+	if family == afInet {
+		copy(sa[4:8], ip.To4())
+	} else {
+		copy(sa[8:24], ip.To16())
+	}
+	return sa
+}
+
+func TestDecodeEvent(t *testing.T) {
+	tests := []struct {
+		raw           []byte
+		expectedEvent *processEvent
+		expectedErr   string
+	}{
+		{
+			raw:           rawEvent(eventKindExec, 4242, 33, "bash", []byte("/usr/bin/bash\x00garbage"), execEventLen),
+			expectedEvent: &processEvent{Event: "exec", Pid: 4242, Uid: 33, Comm: "bash", Binary: "/usr/bin/bash"},
+		},
+		{
+			raw:           rawEvent(eventKindConnect, 1337, 1000, "xmrig", sockaddr(afInet, net.ParseIP("198.51.100.7"), 3333), connectEventLen),
+			expectedEvent: &processEvent{Event: "connect", Pid: 1337, Uid: 1000, Comm: "xmrig", DstIP: "198.51.100.7", DstPort: 3333},
+		},
+		{
+			raw:           rawEvent(eventKindConnect, 1337, 1000, "curl", sockaddr(afInet6, net.ParseIP("2001:db8::1"), 443), connectEventLen),
+			expectedEvent: &processEvent{Event: "connect", Pid: 1337, Uid: 1000, Comm: "curl", DstIP: "2001:db8::1", DstPort: 443},
+		},
+		{
+			//AF_UNIX
+			raw:           rawEvent(eventKindConnect, 1337, 1000, "curl", sockaddr(1, nil, 0), connectEventLen),
+			expectedEvent: nil,
+		},
+		{
+			raw:         rawEvent(eventKindExec, 4242, 33, "bash", nil, connectEventLen),
+			expectedErr: "exec event of 64 bytes is too short",
+		},
+		{
+			raw:         rawEvent(3, 4242, 33, "bash", nil, connectEventLen),
+			expectedErr: "unknown event kind 3",
+		},
+		{
+			raw:         []byte{1, 0, 0, 0},
+			expectedErr: "event of 4 bytes is too short",
+		},
+	}
+	for _, test := range tests {
+		evt, err := decodeEvent(test.raw)
+		cstest.AssertErrorContains(t, err, test.expectedErr)
+		assert.Equal(t, test.expectedEvent, evt)
+	}
+}
+
+func TestReadProcInfo(t *testing.T) {
+	procDir := t.TempDir()
+	writeProc := func(pid string, name string, content string) {
+		require.NoError(t, os.MkdirAll(filepath.Join(procDir, pid), 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(procDir, pid, name), []byte(content), 0644))
+	}
+	writeProc("4242", "stat", "4242 (evil) (bash) R 4200 4242 4200 0 -1 4194304")
+	writeProc("4242", "cmdline", "bash\x00-c\x00id\x00")
+	writeProc("4200", "comm", "php-fpm7.4\n")
+	require.NoError(t, os.Symlink("/usr/bin/bash", filepath.Join(procDir, "4242", "exe")))
+
+	evt := processEvent{Event: "exec", Pid: 4242}
+	readProcInfo(procDir, &evt)
+	assert.Equal(t, processEvent{Event: "exec", Pid: 4242, Ppid: 4200, ParentComm: "php-fpm7.4", Args: "bash -c id"}, evt)
+
+	evt = processEvent{Event: "connect", Pid: 4242}
+	readProcInfo(procDir, &evt)
+	assert.Equal(t, processEvent{Event: "connect", Pid: 4242, Ppid: 4200, ParentComm: "php-fpm7.4", Binary: "/usr/bin/bash"}, evt)
+
+	//the process is gone
+	evt = processEvent{Event: "exec", Pid: 1, Binary: "/usr/bin/true"}
+	readProcInfo(procDir, &evt)
+	assert.Equal(t, processEvent{Event: "exec", Pid: 1, Binary: "/usr/bin/true"}, evt)
+}
+
+func TestParseFormat(t *testing.T) {
+	format := `name: sys_enter_connect
+ID: 1530
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:int __syscall_nr;	offset:8;	size:4;	signed:1;
+	field:int fd;	offset:16;	size:8;	signed:0;
+	field:struct sockaddr * uservaddr;	offset:24;	size:8;	signed:0;
+	field:__data_loc char[] filename;	offset:32;	size:4;	signed:1;
+	field:char comm[16];	offset:36;	size:16;	signed:0;
+
+print fmt: "fd: 0x%08lx, uservaddr: 0x%08lx", ((unsigned long)(REC->fd)), ((unsigned long)(REC->uservaddr))
+`
+	offsets, err := parseFormat(strings.NewReader(format))
+	require.NoError(t, err)
+	assert.Equal(t, 24, offsets["uservaddr"])
+	assert.Equal(t, 32, offsets["filename"])
+	assert.Equal(t, 36, offsets["comm"])
+	assert.Equal(t, 4, offsets["common_pid"])
+
+	_, err = parseFormat(strings.NewReader("\tfield:int fd;\toffset:sixteen;\tsize:8;"))
+	cstest.AssertErrorContains(t, err, `invalid field offset in "field:int fd;\toffset:sixteen;\tsize:8;"`)
+}
+
+func TestKeep(t *testing.T) {
+	e := EbpfSource{}
+	require.NoError(t, e.Configure([]byte(`source: ebpf`), log.WithField("type", "ebpf")))
+	assert.True(t, e.keep(&processEvent{Event: "exec", Pid: 1}))
+	assert.True(t, e.keep(&processEvent{Event: "connect", Pid: 1, DstIP: "198.51.100.7"}))
+	assert.False(t, e.keep(&processEvent{Event: "connect", Pid: 1, DstIP: "127.0.0.53"}))
+	assert.False(t, e.keep(&processEvent{Event: "connect", Pid: 1, DstIP: "::1"}))
+	assert.False(t, e.keep(&processEvent{Event: "exec", Pid: uint32(os.Getpid())}))
+
+	e.config.IncludeLoopback = true
+	assert.True(t, e.keep(&processEvent{Event: "connect", Pid: 1, DstIP: "127.0.0.53"}))
+}
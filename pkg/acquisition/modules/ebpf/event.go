@@ -0,0 +1,193 @@
+package ebpfacquisition
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+const (
+	EBPF_EVENT_EXEC    = "exec"
+	EBPF_EVENT_CONNECT = "connect"
+)
+
+// layout of the events written by the programs in the perf buffer :
+//
+//	0  u32 kind
+//	4  u32 pid (the tgid of the kernel)
+//	8  u32 uid
+//	12 u32 padding
+//	16 char comm[16]
+//	32 the filename of the exec events, or the sockaddr given to connect
+const (
+	eventKindExec    = 1
+	eventKindConnect = 2
+
+	eventHeaderLen  = 32
+	commLen         = 16
+	filenameLen     = 256
+	sockaddrLen     = 28 //sizeof(struct sockaddr_in6)
+	execEventLen    = eventHeaderLen + filenameLen
+	connectEventLen = eventHeaderLen + 32
+	afInet          = 2
+	afInet6         = 10
+	defaultProcDir  = "/proc"
+)
+
+// the pid, uid and family are written in the byte order of the host, and the port and address of the sockaddr in
+// network byte order
+var nativeEndian binary.ByteOrder = binary.LittleEndian
+
+func init() {
+	buf := [2]byte{}
+	*(*uint16)(unsafe.Pointer(&buf[0])) = 0x0102
+	if buf[0] == 0x01 {
+		nativeEndian = binary.BigEndian
+	}
+}
+
+// processEvent is sent as a json line
+type processEvent struct {
+	Event      string `json:"event"`
+	Pid        uint32 `json:"pid"`
+	Ppid       uint32 `json:"ppid,omitempty"`
+	Uid        uint32 `json:"uid"`
+	Comm       string `json:"comm"`
+	Binary     string `json:"binary,omitempty"`
+	Args       string `json:"args,omitempty"`
+	ParentComm string `json:"parent_comm,omitempty"`
+	DstIP      string `json:"dst_ip,omitempty"`
+	DstPort    uint16 `json:"dst_port,omitempty"`
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// decodeEvent decodes a sample of the perf buffer. A nil event without error is returned for the connections that
+// are not made to an ip address (unix sockets and so on)
+func decodeEvent(raw []byte) (*processEvent, error) {
+	if len(raw) < eventHeaderLen {
+		return nil, fmt.Errorf("event of %d bytes is too short", len(raw))
+	}
+	evt := processEvent{
+		Pid:  nativeEndian.Uint32(raw[4:8]),
+		Uid:  nativeEndian.Uint32(raw[8:12]),
+		Comm: cString(raw[16:eventHeaderLen]),
+	}
+	switch kind := nativeEndian.Uint32(raw[0:4]); kind {
+	case eventKindExec:
+		if len(raw) < execEventLen {
+			return nil, fmt.Errorf("exec event of %d bytes is too short", len(raw))
+		}
+		evt.Event = EBPF_EVENT_EXEC
+		evt.Binary = cString(raw[eventHeaderLen:execEventLen])
+	case eventKindConnect:
+		if len(raw) < eventHeaderLen+sockaddrLen {
+			return nil, fmt.Errorf("connect event of %d bytes is too short", len(raw))
+		}
+		evt.Event = EBPF_EVENT_CONNECT
+		sockaddr := raw[eventHeaderLen : eventHeaderLen+sockaddrLen]
+		switch nativeEndian.Uint16(sockaddr[0:2]) {
+		case afInet:
+			evt.DstIP = net.IP(sockaddr[4:8]).String()
+		case afInet6:
+			evt.DstIP = net.IP(sockaddr[8:24]).String()
+		default:
+			return nil, nil
+		}
+		evt.DstPort = binary.BigEndian.Uint16(sockaddr[2:4])
+	default:
+		return nil, fmt.Errorf("unknown event kind %d", kind)
+	}
+	return &evt, nil
+}
+
+// readProcInfo completes the event with what the programs don't collect : the parent, the arguments of the
+// executed binary, and the binary doing the connection. This is best effort, the process can be gone already.
+func readProcInfo(procDir string, evt *processEvent) {
+	pid := strconv.FormatUint(uint64(evt.Pid), 10)
+	if stat, err := ioutil.ReadFile(filepath.Join(procDir, pid, "stat")); err == nil {
+		//the comm is between parentheses and can contain spaces or parentheses itself
+		if i := bytes.LastIndexByte(stat, ')'); i >= 0 {
+			//state ppid ...
+			fields := strings.Fields(string(stat[i+1:]))
+			if len(fields) > 1 {
+				if ppid, err := strconv.ParseUint(fields[1], 10, 32); err == nil {
+					evt.Ppid = uint32(ppid)
+				}
+			}
+		}
+	}
+	if evt.Ppid != 0 {
+		if comm, err := ioutil.ReadFile(filepath.Join(procDir, strconv.FormatUint(uint64(evt.Ppid), 10), "comm")); err == nil {
+			evt.ParentComm = strings.TrimRight(string(comm), "\n")
+		}
+	}
+	switch evt.Event {
+	case EBPF_EVENT_EXEC:
+		if cmdline, err := ioutil.ReadFile(filepath.Join(procDir, pid, "cmdline")); err == nil {
+			evt.Args = strings.TrimSpace(string(bytes.ReplaceAll(cmdline, []byte{0}, []byte{' '})))
+		}
+	case EBPF_EVENT_CONNECT:
+		if exe, err := os.Readlink(filepath.Join(procDir, pid, "exe")); err == nil {
+			evt.Binary = exe
+		}
+	}
+}
+
+// parseFormat returns the offsets of the fields of a tracepoint, from its format file in tracefs :
+//
+//	field:__data_loc char[] filename;	offset:8;	size:4;	signed:1;
+func parseFormat(r io.Reader) (map[string]int, error) {
+	offsets := make(map[string]int)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "field:") {
+			continue
+		}
+		var name string
+		offset := -1
+		for _, part := range strings.Split(line, ";") {
+			part = strings.TrimSpace(part)
+			switch {
+			case strings.HasPrefix(part, "field:"):
+				decl := strings.Fields(strings.TrimPrefix(part, "field:"))
+				if len(decl) == 0 {
+					continue
+				}
+				name = decl[len(decl)-1]
+				if i := strings.IndexByte(name, '['); i >= 0 {
+					name = name[:i]
+				}
+			case strings.HasPrefix(part, "offset:"):
+				o, err := strconv.Atoi(strings.TrimPrefix(part, "offset:"))
+				if err != nil {
+					return nil, fmt.Errorf("invalid field offset in %q", line)
+				}
+				offset = o
+			}
+		}
+		if name == "" || offset < 0 {
+			return nil, fmt.Errorf("invalid field %q", line)
+		}
+		offsets[name] = offset
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return offsets, nil
+}
@@ -0,0 +1,220 @@
+//go:build linux
+// +build linux
+
+package ebpfacquisition
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/link"
+	"github.com/cilium/ebpf/perf"
+	"github.com/cilium/ebpf/rlimit"
+	"github.com/pkg/errors"
+)
+
+// bpf_perf_event_output flag to write in the buffer of the cpu running the program
+const bpfFCurrentCPU = 0xffffffff
+
+// link.Tracepoint only looks up the tracepoints under debugfs, so the formats are read from the same place even
+// when tracefs is also mounted on /sys/kernel/tracing
+const traceRoot = "/sys/kernel/debug/tracing"
+
+// tracepoints used by the programs, with the field of the context they read
+var tracepoints = map[string]struct {
+	group string
+	name  string
+	field string
+}{
+	EBPF_EVENT_EXEC:    {group: "sched", name: "sched_process_exec", field: "filename"},
+	EBPF_EVENT_CONNECT: {group: "syscalls", name: "sys_enter_connect", field: "uservaddr"},
+}
+
+type tracer struct {
+	events *ebpf.Map
+	progs  []*ebpf.Program
+	links  []link.Link
+	reader *perf.Reader
+}
+
+func canRun() error {
+	if _, err := os.Stat(filepath.Join(traceRoot, "events")); err != nil {
+		return fmt.Errorf("tracefs is not available in %s, debugfs must be mounted", traceRoot)
+	}
+	return nil
+}
+
+func fieldOffset(root string, event string) (int16, error) {
+	tp := tracepoints[event]
+	format, err := os.Open(filepath.Join(root, "events", tp.group, tp.name, "format"))
+	if err != nil {
+		return 0, errors.Wrapf(err, "tracepoint %s/%s is not available", tp.group, tp.name)
+	}
+	defer format.Close()
+	offsets, err := parseFormat(format)
+	if err != nil {
+		return 0, errors.Wrapf(err, "could not parse the format of tracepoint %s/%s", tp.group, tp.name)
+	}
+	offset, ok := offsets[tp.field]
+	if !ok {
+		return 0, fmt.Errorf("tracepoint %s/%s has no field %s", tp.group, tp.name, tp.field)
+	}
+	return int16(offset), nil
+}
+
+// eventHeader writes the kind, pid, uid and comm of the current task at the start of the event, at fp-size on the
+// stack. R6 must hold the context of the program.
+func eventHeader(kind int64, size int16) asm.Instructions {
+	return asm.Instructions{
+		asm.StoreImm(asm.RFP, -size, kind, asm.Word),
+		asm.FnGetCurrentPidTgid.Call(),
+		asm.RSh.Imm(asm.R0, 32),
+		asm.StoreMem(asm.RFP, -size+4, asm.R0, asm.Word),
+		asm.FnGetCurrentUidGid.Call(),
+		asm.StoreMem(asm.RFP, -size+8, asm.R0, asm.Word),
+		asm.StoreImm(asm.RFP, -size+12, 0, asm.Word),
+		asm.Mov.Reg(asm.R1, asm.RFP),
+		asm.Add.Imm(asm.R1, int32(-size+16)),
+		asm.Mov.Imm(asm.R2, commLen),
+		asm.FnGetCurrentComm.Call(),
+	}
+}
+
+// eventOutput sends the event at fp-size in the perf buffer, and returns
+func eventOutput(events *ebpf.Map, size int16) asm.Instructions {
+	return asm.Instructions{
+		asm.Mov.Reg(asm.R1, asm.R6),
+		asm.LoadMapPtr(asm.R2, events.FD()),
+		asm.LoadImm(asm.R3, bpfFCurrentCPU, asm.DWord),
+		asm.Mov.Reg(asm.R4, asm.RFP),
+		asm.Add.Imm(asm.R4, int32(-size)),
+		asm.Mov.Imm(asm.R5, int32(size)),
+		asm.FnPerfEventOutput.Call(),
+		asm.Mov.Imm(asm.R0, 0),
+		asm.Return(),
+	}
+}
+
+// execProgram reads the filename of sched_process_exec, a __data_loc field : the low 16 bits are its offset from
+// the start of the context.
+func execProgram(events *ebpf.Map, filenameOffset int16) asm.Instructions {
+	insns := asm.Instructions{asm.Mov.Reg(asm.R6, asm.R1)}
+	insns = append(insns, eventHeader(eventKindExec, execEventLen)...)
+	insns = append(insns,
+		asm.LoadMem(asm.R3, asm.R6, filenameOffset, asm.Word),
+		asm.And.Imm(asm.R3, 0xffff),
+		asm.Add.Reg(asm.R3, asm.R6),
+		asm.Mov.Reg(asm.R1, asm.RFP),
+		asm.Add.Imm(asm.R1, -filenameLen),
+		asm.Mov.Imm(asm.R2, filenameLen),
+		asm.FnProbeReadKernelStr.Call(),
+	)
+	return append(insns, eventOutput(events, execEventLen)...)
+}
+
+// connectProgram copies the sockaddr given to connect(2), the address family is checked in userland.
+func connectProgram(events *ebpf.Map, uservaddrOffset int16) asm.Instructions {
+	insns := asm.Instructions{asm.Mov.Reg(asm.R6, asm.R1)}
+	insns = append(insns, eventHeader(eventKindConnect, connectEventLen)...)
+	insns = append(insns,
+		asm.LoadMem(asm.R3, asm.R6, uservaddrOffset, asm.DWord),
+		asm.Mov.Reg(asm.R1, asm.RFP),
+		asm.Add.Imm(asm.R1, -(connectEventLen-eventHeaderLen)),
+		asm.Mov.Imm(asm.R2, sockaddrLen),
+		asm.FnProbeReadUser.Call(),
+		asm.StoreImm(asm.RFP, -(connectEventLen-eventHeaderLen-sockaddrLen), 0, asm.Word),
+	)
+	return append(insns, eventOutput(events, connectEventLen)...)
+}
+
+// newTracer loads and attaches the programs of the requested events. The programs are written with the assembler
+// of cilium/ebpf, so neither clang nor the BTF of the kernel is needed, but a kernel >= 5.5 is.
+func newTracer(events []string, bufferPages int) (*tracer, error) {
+	if err := canRun(); err != nil {
+		return nil, err
+	}
+	//kernels < 5.11 account the memory of the maps against RLIMIT_MEMLOCK
+	if err := rlimit.RemoveMemlock(); err != nil {
+		return nil, errors.Wrap(err, "could not remove the memlock limit")
+	}
+	var err error
+	t := &tracer{}
+	t.events, err = ebpf.NewMap(&ebpf.MapSpec{Name: "cs_events", Type: ebpf.PerfEventArray})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create the perf event array")
+	}
+	for _, event := range events {
+		offset, err := fieldOffset(traceRoot, event)
+		if err != nil {
+			t.close()
+			return nil, err
+		}
+		var insns asm.Instructions
+		switch event {
+		case EBPF_EVENT_EXEC:
+			insns = execProgram(t.events, offset)
+		case EBPF_EVENT_CONNECT:
+			insns = connectProgram(t.events, offset)
+		}
+		prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+			Name:         "cs_" + event,
+			Type:         ebpf.TracePoint,
+			License:      "GPL",
+			Instructions: insns,
+		})
+		if err != nil {
+			t.close()
+			return nil, errors.Wrapf(err, "could not load the %s program", event)
+		}
+		t.progs = append(t.progs, prog)
+		tp := tracepoints[event]
+		l, err := link.Tracepoint(tp.group, tp.name, prog, nil)
+		if err != nil {
+			t.close()
+			return nil, errors.Wrapf(err, "could not attach to tracepoint %s/%s", tp.group, tp.name)
+		}
+		t.links = append(t.links, l)
+	}
+	t.reader, err = perf.NewReader(t.events, bufferPages*os.Getpagesize())
+	if err != nil {
+		t.close()
+		return nil, errors.Wrap(err, "could not create the perf reader")
+	}
+	return t, nil
+}
+
+// read blocks until an event is available. lost is the number of events dropped because the buffer was full.
+func (t *tracer) read() (raw []byte, lost uint64, err error) {
+	record, err := t.reader.Read()
+	if err != nil {
+		if errors.Is(err, perf.ErrClosed) {
+			return nil, 0, errTracerClosed
+		}
+		return nil, 0, err
+	}
+	return record.RawSample, record.LostSamples, nil
+}
+
+func (t *tracer) close() error {
+	var err error
+	for _, l := range t.links {
+		if lerr := l.Close(); lerr != nil {
+			err = lerr
+		}
+	}
+	for _, prog := range t.progs {
+		prog.Close()
+	}
+	if t.reader != nil {
+		if rerr := t.reader.Close(); rerr != nil {
+			err = rerr
+		}
+	}
+	if t.events != nil {
+		t.events.Close()
+	}
+	return err
+}
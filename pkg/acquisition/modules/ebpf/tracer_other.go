@@ -0,0 +1,23 @@
+//go:build !linux
+
+package ebpfacquisition
+
+import "errors"
+
+type tracer struct{}
+
+func canRun() error {
+	return errors.New("ebpf acquisition is only supported on Linux")
+}
+
+func newTracer(events []string, bufferPages int) (*tracer, error) {
+	return nil, canRun()
+}
+
+func (t *tracer) read() ([]byte, uint64, error) {
+	return nil, 0, errTracerClosed
+}
+
+func (t *tracer) close() error {
+	return nil
+}
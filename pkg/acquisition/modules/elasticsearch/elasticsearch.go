@@ -0,0 +1,531 @@
+package elasticsearchacquisition
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/cursors"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/retry"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/secrets"
+	leaky "github.com/crowdsecurity/crowdsec/pkg/leakybucket"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/tomb.v2"
+	"gopkg.in/yaml.v2"
+)
+
+var linesRead = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cs_elasticsearch_hits_total",
+		Help: "Total documents that were read from an index.",
+	},
+	[]string{"index"})
+
+var (
+	defaultPollInterval = 10 * time.Second
+	defaultTimeout      = 30 * time.Second
+)
+
+const (
+	defaultPageSize        = 500
+	defaultTimestampField  = "@timestamp"
+	defaultTiebreakerField = "_id"
+)
+
+type ElasticsearchConfiguration struct {
+	configuration.DataSourceCommonCfg `yaml:",inline"`
+	URL                               string         `yaml:"url"`              //eg. https://localhost:9200, works with opensearch too
+	Index                             string         `yaml:"index"`            //index name or pattern, eg. logs-*
+	Query                             string         `yaml:"query"`            //query DSL filter (json), all the documents if empty
+	TimestampField                    string         `yaml:"timestamp_field"`  //documents are read in the order of this field, @timestamp by default
+	TiebreakerField                   string         `yaml:"tiebreaker_field"` //unique field to order the documents with the same timestamp, _id by default
+	MessageField                      string         `yaml:"message_field"`    //field holding the log line (can be a dotted path), the whole document (json) if empty
+	PageSize                          int            `yaml:"page_size"`
+	PollInterval                      *time.Duration `yaml:"poll_interval"` //tail mode : how often new documents are searched for
+	Timeout                           *time.Duration `yaml:"timeout"`
+	Since                             string         `yaml:"since"` //RFC3339 date, or duration before now (eg. 1h). Tail mode starts now by default
+	Until                             string         `yaml:"until"` //cat mode only
+	Username                          string         `yaml:"username"`
+	Password                          string         `yaml:"password"` //can be env://, file:// or vault:// references, like api_key
+	APIKey                            string         `yaml:"api_key"`  //base64 encoded id:api_key
+	CACert                            string         `yaml:"ca_cert"`
+	InsecureSkipVerify                bool           `yaml:"insecure_skip_verify"`
+}
+
+// ElasticsearchSource reads the documents of an index, in the order of their timestamp. In tail mode, the index is
+// polled for new documents, and the position reached is saved as a cursor
+type ElasticsearchSource struct {
+	configuration.HealthTracker
+	config   ElasticsearchConfiguration
+	logger   *log.Entry
+	client   *http.Client
+	retrier  *retry.Retrier
+	auth     func(*http.Request)
+	query    json.RawMessage
+	from     time.Time
+	until    time.Time
+	after    []json.RawMessage //sort values of the last document read, to search the next ones after it
+	cursorId string
+}
+
+type searchHit struct {
+	Index  string            `json:"_index"`
+	ID     string            `json:"_id"`
+	Source json.RawMessage   `json:"_source"`
+	Sort   []json.RawMessage `json:"sort"`
+}
+
+type searchResponse struct {
+	Hits struct {
+		Hits []searchHit `json:"hits"`
+	} `json:"hits"`
+}
+
+func (e *ElasticsearchSource) GetMetrics() []prometheus.Collector {
+	return []prometheus.Collector{linesRead}
+}
+
+func (e *ElasticsearchSource) GetAggregMetrics() []prometheus.Collector {
+	return []prometheus.Collector{linesRead}
+}
+
+func (e *ElasticsearchSource) Configure(yamlConfig []byte, logger *log.Entry) error {
+	e.logger = logger
+	config := ElasticsearchConfiguration{}
+	if err := yaml.UnmarshalStrict(yamlConfig, &config); err != nil {
+		return errors.Wrap(err, "Cannot parse elasticsearch datasource configuration")
+	}
+	if config.Mode == "" {
+		config.Mode = configuration.TAIL_MODE
+	}
+	return e.configure(config)
+}
+
+// configure checks the configuration and sets the defaults, for Configure and ConfigureByDSN
+func (e *ElasticsearchSource) configure(config ElasticsearchConfiguration) error {
+	if config.Mode != configuration.CAT_MODE && config.Mode != configuration.TAIL_MODE {
+		return fmt.Errorf("unsupported mode %s for elasticsearch datasource", config.Mode)
+	}
+	if config.URL == "" {
+		return fmt.Errorf("url is mandatory")
+	}
+	if _, err := url.Parse(config.URL); err != nil {
+		return errors.Wrapf(err, "invalid url %s", config.URL)
+	}
+	config.URL = strings.TrimSuffix(config.URL, "/")
+	if config.Index == "" {
+		return fmt.Errorf("index is mandatory")
+	}
+	if config.Query != "" {
+		if !json.Valid([]byte(config.Query)) {
+			return fmt.Errorf("query must be a json query DSL object")
+		}
+		e.query = json.RawMessage(config.Query)
+	}
+	if config.TimestampField == "" {
+		config.TimestampField = defaultTimestampField
+	}
+	if config.TiebreakerField == "" {
+		config.TiebreakerField = defaultTiebreakerField
+	}
+	if config.PageSize == 0 {
+		config.PageSize = defaultPageSize
+	}
+	if config.PageSize < 0 {
+		return fmt.Errorf("page_size must be positive")
+	}
+	if config.PollInterval == nil {
+		config.PollInterval = &defaultPollInterval
+	}
+	if *config.PollInterval <= 0 {
+		return fmt.Errorf("poll_interval must be positive")
+	}
+	if config.Timeout == nil {
+		config.Timeout = &defaultTimeout
+	}
+	var err error
+	if e.from, err = configuration.ParseTime(config.Since); err != nil {
+		return errors.Wrap(err, "invalid since")
+	}
+	if e.until, err = configuration.ParseTime(config.Until); err != nil {
+		return errors.Wrap(err, "invalid until")
+	}
+	if !e.until.IsZero() && config.Mode == configuration.TAIL_MODE {
+		return fmt.Errorf("until is only supported in %s mode", configuration.CAT_MODE)
+	}
+	if err := e.configureAuth(config); err != nil {
+		return err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify}
+	if config.CACert != "" {
+		pem, err := ioutil.ReadFile(config.CACert)
+		if err != nil {
+			return errors.Wrapf(err, "while reading ca_cert %s", config.CACert)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in ca_cert %s", config.CACert)
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+	e.client = &http.Client{Transport: transport, Timeout: *config.Timeout}
+	e.retrier, err = retry.New(config.Retry, e.logger)
+	if err != nil {
+		return err
+	}
+	e.retrier.Notify = e.notifyRetry
+	e.cursorId = config.URL + "/" + config.Index
+	e.config = config
+	return nil
+}
+
+func (e *ElasticsearchSource) configureAuth(config ElasticsearchConfiguration) error {
+	if config.APIKey != "" && (config.Username != "" || config.Password != "") {
+		return fmt.Errorf("api_key and username/password are mutually exclusive")
+	}
+	if config.APIKey != "" {
+		apiKey, err := secrets.NewSecret(config.APIKey, e.logger)
+		if err != nil {
+			return errors.Wrap(err, "invalid api_key")
+		}
+		e.auth = func(req *http.Request) {
+			req.Header.Set("Authorization", "ApiKey "+apiKey.Get())
+		}
+	}
+	if config.Username != "" {
+		password, err := secrets.NewSecret(config.Password, e.logger)
+		if err != nil {
+			return errors.Wrap(err, "invalid password")
+		}
+		e.auth = func(req *http.Request) {
+			req.SetBasicAuth(config.Username, password.Get())
+		}
+	}
+	return nil
+}
+
+// notifyRetry reports the failing searches in the health of the datasource
+func (e *ElasticsearchSource) notifyRetry(err error) {
+	if err != nil {
+		e.SetState(configuration.STATUS_RECONNECTING, err)
+	} else {
+		e.SetState(configuration.STATUS_RUNNING, nil)
+	}
+}
+
+func (e *ElasticsearchSource) ConfigureByDSN(dsn string, labels map[string]string, logger *log.Entry) error {
+	e.logger = logger
+	//format for the DSN is : elasticsearch://host:port/index?query=...&since=...&until=... (opensearch:// works too)
+	parsed, err := configuration.ParseDSN(dsn, "elasticsearch", "opensearch")
+	if err != nil {
+		return err
+	}
+	idx := strings.Index(parsed.Target, "/")
+	if idx <= 0 || idx == len(parsed.Target)-1 {
+		return fmt.Errorf("%s DSN must contain host and index : %s://host:port/index", parsed.Scheme, parsed.Scheme)
+	}
+	if err := parsed.CheckParams("scheme", "query", "since", "until", "timestamp_field", "tiebreaker_field", "message_field",
+		"username", "password", "api_key", "insecure_skip_verify"); err != nil {
+		return err
+	}
+	if err := parsed.SetLogLevel(e.logger); err != nil {
+		return err
+	}
+	config := ElasticsearchConfiguration{}
+	config.Mode = configuration.CAT_MODE
+	config.Labels = labels
+	config.Index = parsed.Target[idx+1:]
+	scheme := "http"
+	for key, value := range map[string]*string{
+		"scheme":           &scheme,
+		"query":            &config.Query,
+		"since":            &config.Since,
+		"until":            &config.Until,
+		"timestamp_field":  &config.TimestampField,
+		"tiebreaker_field": &config.TiebreakerField,
+		"message_field":    &config.MessageField,
+		"username":         &config.Username,
+		"password":         &config.Password,
+		"api_key":          &config.APIKey,
+	} {
+		param, err := parsed.Param(key)
+		if err != nil {
+			return err
+		}
+		if param != "" {
+			*value = param
+		}
+	}
+	if insecure, err := parsed.Param("insecure_skip_verify"); err != nil {
+		return err
+	} else if insecure != "" {
+		if config.InsecureSkipVerify, err = strconv.ParseBool(insecure); err != nil {
+			return fmt.Errorf("parsing 'insecure_skip_verify' parameters: %s", err)
+		}
+	}
+	config.URL = scheme + "://" + parsed.Target[:idx]
+	return e.configure(config)
+}
+
+func (e *ElasticsearchSource) GetMode() string {
+	return e.config.Mode
+}
+
+func (e *ElasticsearchSource) GetName() string {
+	return "elasticsearch"
+}
+
+func (e *ElasticsearchSource) GetUuid() string {
+	return e.config.UniqueId
+}
+
+func (e *ElasticsearchSource) CanRun() error {
+	return nil
+}
+
+func (e *ElasticsearchSource) Dump() interface{} {
+	return e
+}
+
+// searchBody returns the search of the page of documents following the last one read
+func (e *ElasticsearchSource) searchBody() ([]byte, error) {
+	filters := []interface{}{}
+	if e.query != nil {
+		filters = append(filters, e.query)
+	}
+	timeRange := map[string]string{}
+	if !e.from.IsZero() {
+		timeRange["gte"] = e.from.Format(time.RFC3339Nano)
+	}
+	if !e.until.IsZero() {
+		timeRange["lt"] = e.until.Format(time.RFC3339Nano)
+	}
+	if len(timeRange) > 0 {
+		filters = append(filters, map[string]interface{}{
+			"range": map[string]interface{}{e.config.TimestampField: timeRange},
+		})
+	}
+	body := map[string]interface{}{
+		"size": e.config.PageSize,
+		"sort": []map[string]string{
+			{e.config.TimestampField: "asc"},
+			{e.config.TiebreakerField: "asc"},
+		},
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{"filter": filters},
+		},
+	}
+	if e.after != nil {
+		body["search_after"] = e.after
+	}
+	return json.Marshal(body)
+}
+
+func (e *ElasticsearchSource) search() ([]searchHit, error) {
+	body, err := e.searchBody()
+	if err != nil {
+		return nil, retry.Permanent(errors.Wrap(err, "while building search"))
+	}
+	req, err := http.NewRequest(http.MethodPost, e.config.URL+"/"+url.PathEscape(e.config.Index)+"/_search", bytes.NewReader(body))
+	if err != nil {
+		return nil, retry.Permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if e.auth != nil {
+		e.auth(req)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := retry.CheckResponse(resp); err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "while reading search response")
+	}
+	ret := searchResponse{}
+	if err := json.Unmarshal(content, &ret); err != nil {
+		return nil, retry.Permanent(errors.Wrap(err, "invalid search response"))
+	}
+	return ret.Hits.Hits, nil
+}
+
+// message returns the log line of a document : the message field if configured, else the whole document
+func (e *ElasticsearchSource) message(hit searchHit) (string, error) {
+	if e.config.MessageField == "" {
+		return string(hit.Source), nil
+	}
+	var doc interface{}
+	if err := json.Unmarshal(hit.Source, &doc); err != nil {
+		return "", errors.Wrap(err, "invalid document")
+	}
+	value, ok := lookup(doc, e.config.MessageField)
+	if !ok {
+		return "", fmt.Errorf("no field %s in document", e.config.MessageField)
+	}
+	if str, ok := value.(string); ok {
+		return str, nil
+	}
+	ret, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(ret), nil
+}
+
+// lookup returns the value of field in doc. The field can be a flat key containing dots, or a path in nested objects
+func lookup(doc interface{}, field string) (interface{}, bool) {
+	obj, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	if value, ok := obj[field]; ok {
+		return value, true
+	}
+	for i := 0; i < len(field); i++ {
+		if field[i] != '.' {
+			continue
+		}
+		if value, ok := obj[field[:i]]; ok {
+			if ret, ok := lookup(value, field[i+1:]); ok {
+				return ret, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// readPages sends the documents found after the last one read, until there are no more. It returns false if the
+// datasource was stopped meanwhile
+func (e *ElasticsearchSource) readPages(out chan types.Event, dying <-chan struct{}, expectMode int) (bool, error) {
+	for {
+		var hits []searchHit
+		err := e.retrier.Do(dying, func() error {
+			var err error
+			hits, err = e.search()
+			return err
+		})
+		if err == retry.ErrDying {
+			return false, nil
+		}
+		if err != nil {
+			return false, errors.Wrapf(err, "while searching %s", e.config.Index)
+		}
+		for _, hit := range hits {
+			raw, err := e.message(hit)
+			if err != nil {
+				e.logger.Warningf("skipping document %s of %s : %s", hit.ID, hit.Index, err)
+			} else {
+				l := types.Line{}
+				l.Raw = raw
+				l.Src = hit.Index
+				l.Time = time.Now().UTC()
+				l.Labels = e.config.Labels
+				l.Process = true
+				l.Module = e.GetName()
+				linesRead.With(prometheus.Labels{"index": hit.Index}).Inc()
+				e.EventSeen(&l)
+				select {
+				case out <- types.Event{Line: l, Process: true, Type: types.LOG, ExpectMode: expectMode}:
+				case <-dying:
+					return false, nil
+				}
+			}
+			e.after = hit.Sort
+		}
+		if len(hits) < e.config.PageSize {
+			return true, nil
+		}
+	}
+}
+
+func (e *ElasticsearchSource) OneShotAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	e.logger.Infof("reading index %s from %s", e.config.Index, e.config.URL)
+	_, err := e.readPages(out, t.Dying(), leaky.TIMEMACHINE)
+	if err != nil {
+		return err
+	}
+	t.Kill(nil)
+	return nil
+}
+
+// loadCursor resumes after the last document read before a restart, or starts now (or since)
+func (e *ElasticsearchSource) loadCursor() {
+	value, err := cursors.LoadCursor(e.GetName(), e.cursorId)
+	if err != nil {
+		e.logger.Warningf("unable to load cursor of %s : %s", e.cursorId, err)
+	}
+	if value != "" {
+		if err := json.Unmarshal([]byte(value), &e.after); err != nil {
+			e.logger.Warningf("invalid cursor %s for %s : %s", value, e.cursorId, err)
+			e.after = nil
+		} else {
+			e.logger.Infof("resuming %s after %s", e.cursorId, value)
+			return
+		}
+	}
+	if e.from.IsZero() {
+		e.from = time.Now().UTC()
+	}
+}
+
+func (e *ElasticsearchSource) saveCursor() {
+	if e.after == nil {
+		return
+	}
+	value, err := json.Marshal(e.after)
+	if err == nil {
+		err = cursors.SaveCursor(e.GetName(), e.cursorId, string(value))
+	}
+	if err != nil {
+		e.logger.Warningf("unable to save cursor of %s : %s", e.cursorId, err)
+	}
+}
+
+func (e *ElasticsearchSource) StreamingAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	e.loadCursor()
+	expectMode := leaky.LIVE
+	if e.config.UseTimeMachine {
+		expectMode = leaky.TIMEMACHINE
+	}
+	t.Go(func() error {
+		defer types.CatchPanic("crowdsec/acquis/elasticsearch/live")
+		e.logger.Infof("polling index %s from %s every %s", e.config.Index, e.config.URL, *e.config.PollInterval)
+		ticker := time.NewTicker(*e.config.PollInterval)
+		defer ticker.Stop()
+		for {
+			ok, err := e.readPages(out, t.Dying(), expectMode)
+			e.saveCursor()
+			if err != nil {
+				e.SetState(configuration.STATUS_ERRORED, err)
+				return err
+			}
+			if !ok {
+				return nil
+			}
+			select {
+			case <-t.Dying():
+				e.logger.Infof("elasticsearch datasource stopping")
+				return nil
+			case <-ticker.C:
+			}
+		}
+	})
+	return nil
+}
@@ -0,0 +1,308 @@
+package elasticsearchacquisition
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/cursors"
+	"github.com/crowdsecurity/crowdsec/pkg/cstest"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/tomb.v2"
+)
+
+// mockIndex answers the searches on an index, in the order of the documents, after search_after
+type mockIndex struct {
+	lock     sync.Mutex
+	docs     []map[string]interface{} //with a "ts" (int) and an "id" field
+	searches []map[string]interface{}
+	apiKey   string
+}
+
+func (m *mockIndex) add(id int, doc map[string]interface{}) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	doc["ts"] = id
+	doc["id"] = fmt.Sprintf("doc%d", id)
+	m.docs = append(m.docs, doc)
+}
+
+func (m *mockIndex) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if r.URL.Path != "/logs-test/_search" {
+		http.Error(w, `{"error": "no such index"}`, http.StatusNotFound)
+		return
+	}
+	if r.Header.Get("Authorization") != "ApiKey "+m.apiKey {
+		http.Error(w, `{"error": "unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+	search := map[string]interface{}{}
+	if err := json.NewDecoder(r.Body).Decode(&search); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	m.searches = append(m.searches, search)
+	after := -1.0
+	if values, ok := search["search_after"].([]interface{}); ok {
+		after = values[0].(float64)
+	}
+	hits := []map[string]interface{}{}
+	for _, doc := range m.docs {
+		if float64(doc["ts"].(int)) <= after || len(hits) == int(search["size"].(float64)) {
+			continue
+		}
+		hits = append(hits, map[string]interface{}{
+			"_index":  "logs-test",
+			"_id":     doc["id"],
+			"_source": doc,
+			"sort":    []interface{}{doc["ts"], doc["id"]},
+		})
+	}
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"hits": map[string]interface{}{"hits": hits}})
+}
+
+func TestConfigure(t *testing.T) {
+	tests := []struct {
+		config      string
+		expectedErr string
+	}{
+		{
+			config:      `foobar: asd`,
+			expectedErr: "field foobar not found in type elasticsearchacquisition.ElasticsearchConfiguration",
+		},
+		{
+			config:      `index: logs`,
+			expectedErr: "url is mandatory",
+		},
+		{
+			config:      `url: http://localhost:9200`,
+			expectedErr: "index is mandatory",
+		},
+		{
+			config: `
+url: http://localhost:9200
+index: logs
+query: '{"match": '`,
+			expectedErr: "query must be a json query DSL object",
+		},
+		{
+			config: `
+url: http://localhost:9200
+index: logs
+until: 1h`,
+			expectedErr: "until is only supported in cat mode",
+		},
+		{
+			config: `
+url: http://localhost:9200
+index: logs
+since: yesterday`,
+			expectedErr: "invalid since",
+		},
+		{
+			config: `
+url: http://localhost:9200
+index: logs
+api_key: abcd
+username: admin`,
+			expectedErr: "api_key and username/password are mutually exclusive",
+		},
+		{
+			config: `
+url: http://localhost:9200
+index: logs
+username: admin
+password: env://CROWDSEC_TEST_UNSET_PASSWORD`,
+			expectedErr: "invalid password",
+		},
+		{
+			config: `
+url: http://localhost:9200
+index: logs-*
+query: '{"match": {"service": "nginx"}}'
+since: 2022-06-01T00:00:00Z`,
+			expectedErr: "",
+		},
+	}
+	subLogger := log.WithFields(log.Fields{
+		"type": "elasticsearch",
+	})
+	for _, test := range tests {
+		e := ElasticsearchSource{}
+		err := e.Configure([]byte(test.config), subLogger)
+		cstest.AssertErrorContains(t, err, test.expectedErr)
+	}
+}
+
+func TestConfigureDSN(t *testing.T) {
+	tests := []struct {
+		dsn         string
+		expectedErr string
+		expectedURL string
+	}{
+		{
+			dsn:         "asd://",
+			expectedErr: "invalid DSN asd:// for elasticsearch source, must start with elasticsearch://",
+		},
+		{
+			dsn:         "elasticsearch://localhost:9200",
+			expectedErr: "elasticsearch DSN must contain host and index : elasticsearch://host:port/index",
+		},
+		{
+			dsn:         "opensearch://localhost:9200/logs?foobar=42",
+			expectedErr: "unsupported key foobar in opensearch DSN",
+		},
+		{
+			dsn:         "elasticsearch://localhost:9200/logs?page_size=2",
+			expectedErr: "unsupported key page_size in elasticsearch DSN",
+		},
+		{
+			dsn:         "elasticsearch://localhost:9200/logs?insecure_skip_verify=maybe",
+			expectedErr: "parsing 'insecure_skip_verify' parameters",
+		},
+		{
+			dsn:         "elasticsearch://localhost:9200/logs-*?scheme=https&since=24h&message_field=message&log_level=info",
+			expectedURL: "https://localhost:9200",
+		},
+		{
+			dsn:         "opensearch://localhost:9200/logs",
+			expectedURL: "http://localhost:9200",
+		},
+	}
+	subLogger := log.WithFields(log.Fields{
+		"type": "elasticsearch",
+	})
+	for _, test := range tests {
+		e := ElasticsearchSource{}
+		err := e.ConfigureByDSN(test.dsn, map[string]string{"type": "testtype"}, subLogger)
+		cstest.AssertErrorContains(t, err, test.expectedErr)
+		if test.expectedErr == "" {
+			assert.Equal(t, test.expectedURL, e.config.URL)
+			assert.Equal(t, "cat", e.GetMode())
+		}
+	}
+}
+
+func TestMessage(t *testing.T) {
+	hit := searchHit{Source: json.RawMessage(`{"message": "flat", "log": {"original": "nested", "level": 3}, "event.original": "dotted"}`)}
+	for field, expected := range map[string]string{
+		"":               string(hit.Source),
+		"message":        "flat",
+		"log.original":   "nested",
+		"log.level":      "3",
+		"event.original": "dotted",
+	} {
+		e := ElasticsearchSource{config: ElasticsearchConfiguration{MessageField: field}}
+		msg, err := e.message(hit)
+		require.NoError(t, err)
+		assert.Equal(t, expected, msg)
+	}
+	e := ElasticsearchSource{config: ElasticsearchConfiguration{MessageField: "log.missing"}}
+	_, err := e.message(hit)
+	cstest.AssertErrorContains(t, err, "no field log.missing in document")
+}
+
+func readLines(out chan types.Event, n int, timeout time.Duration) []string {
+	ret := []string{}
+	for len(ret) < n {
+		select {
+		case evt := <-out:
+			ret = append(ret, evt.Line.Raw)
+		case <-time.After(timeout):
+			return ret
+		}
+	}
+	return ret
+}
+
+func TestOneShot(t *testing.T) {
+	index := &mockIndex{apiKey: "secret"}
+	for i := 1; i <= 5; i++ {
+		index.add(i, map[string]interface{}{"log": map[string]interface{}{"original": fmt.Sprintf("line %d", i)}})
+	}
+	server := httptest.NewServer(index)
+	defer server.Close()
+
+	e := ElasticsearchSource{}
+	err := e.Configure([]byte(fmt.Sprintf(`
+url: %s
+index: logs-test
+mode: cat
+api_key: secret
+page_size: 2
+message_field: log.original
+query: '{"match": {"service": "nginx"}}'
+since: 2022-06-01T00:00:00Z`, server.URL)), log.WithField("type", "elasticsearch"))
+	require.NoError(t, err)
+
+	out := make(chan types.Event, 10)
+	tmb := tomb.Tomb{}
+	require.NoError(t, e.OneShotAcquisition(out, &tmb))
+	assert.Equal(t, []string{"line 1", "line 2", "line 3", "line 4", "line 5"}, readLines(out, 5, time.Second))
+
+	//3 pages, the last one being incomplete
+	require.Len(t, index.searches, 3)
+	assert.Nil(t, index.searches[0]["search_after"])
+	assert.Equal(t, []interface{}{float64(4), "doc4"}, index.searches[2]["search_after"])
+	filters := index.searches[0]["query"].(map[string]interface{})["bool"].(map[string]interface{})["filter"].([]interface{})
+	assert.Equal(t, map[string]interface{}{"match": map[string]interface{}{"service": "nginx"}}, filters[0])
+	assert.Equal(t, map[string]interface{}{"range": map[string]interface{}{"@timestamp": map[string]interface{}{"gte": "2022-06-01T00:00:00Z"}}}, filters[1])
+
+	//a bad api key is not retried
+	e = ElasticsearchSource{}
+	require.NoError(t, e.Configure([]byte(fmt.Sprintf("url: %s\nindex: logs-test\nmode: cat\napi_key: wrong", server.URL)), log.WithField("type", "elasticsearch")))
+	err = e.OneShotAcquisition(out, &tomb.Tomb{})
+	cstest.AssertErrorContains(t, err, "request failed with status 401")
+}
+
+func TestStreaming(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elasticsearch-cursors")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store, err := cursors.NewFileStore(filepath.Join(dir, "cursors.json"))
+	require.NoError(t, err)
+	cursors.SetStore(store)
+	defer cursors.SetStore(nil)
+
+	index := &mockIndex{apiKey: "secret"}
+	index.add(1, map[string]interface{}{"message": "line 1"})
+	server := httptest.NewServer(index)
+	defer server.Close()
+	config := fmt.Sprintf(`
+url: %s
+index: logs-test
+api_key: secret
+message_field: message
+poll_interval: 50ms`, server.URL)
+
+	e := ElasticsearchSource{}
+	require.NoError(t, e.Configure([]byte(config), log.WithField("type", "elasticsearch")))
+	//the mock index ignores the time range : fake a previous run that read the first line
+	require.NoError(t, cursors.SaveCursor("elasticsearch", server.URL+"/logs-test", `[1,"doc1"]`))
+	out := make(chan types.Event, 10)
+	tmb := tomb.Tomb{}
+	require.NoError(t, e.StreamingAcquisition(out, &tmb))
+	index.add(2, map[string]interface{}{"message": "line 2"})
+	index.add(3, map[string]interface{}{"message": "line 3"})
+	assert.Equal(t, []string{"line 2", "line 3"}, readLines(out, 2, 2*time.Second))
+	index.add(4, map[string]interface{}{"message": "line 4"})
+	assert.Equal(t, []string{"line 4"}, readLines(out, 1, 2*time.Second))
+	tmb.Kill(nil)
+	require.NoError(t, tmb.Wait())
+
+	cursor, err := cursors.LoadCursor("elasticsearch", server.URL+"/logs-test")
+	require.NoError(t, err)
+	assert.Equal(t, `[4,"doc4"]`, cursor)
+}
@@ -0,0 +1,420 @@
+package eventhubacquisition
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-amqp-common-go/v3/auth"
+	"github.com/Azure/azure-amqp-common-go/v3/conn"
+	"github.com/Azure/azure-amqp-common-go/v3/sas"
+	eventhub "github.com/Azure/azure-event-hubs-go/v3"
+	"github.com/Azure/azure-event-hubs-go/v3/persist"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/cursors"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/retry"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/secrets"
+	leaky "github.com/crowdsecurity/crowdsec/pkg/leakybucket"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/tomb.v2"
+	"gopkg.in/yaml.v2"
+)
+
+var linesRead = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cs_eventhubsource_hits_total",
+		Help: "Total lines that were read from Azure Event Hubs.",
+	},
+	[]string{"eventhub", "partition"})
+
+var defaultTimeout = 30 * time.Second
+
+const (
+	startLatest   = "latest"
+	startEarliest = "earliest"
+)
+
+type EventHubConfiguration struct {
+	configuration.DataSourceCommonCfg `yaml:",inline"`
+	ConnectionString                  string         `yaml:"connection_string"` //can be an env://, file:// or vault:// reference
+	Namespace                         string         `yaml:"namespace"`         //without connection_string, authenticates with the AZURE_* environment variables (service principal, managed identity)
+	EventHub                          string         `yaml:"event_hub"`         //the EntityPath of the connection string if empty
+	ConsumerGroup                     string         `yaml:"consumer_group"`    //$Default by default
+	Partitions                        []string       `yaml:"partitions"`        //partitions read by this agent, all of them by default
+	StartPosition                     string         `yaml:"start_position"`    //latest (default) or earliest, for the partitions without checkpoint
+	PrefetchCount                     uint32         `yaml:"prefetch_count"`
+	UnwrapRecords                     *bool          `yaml:"unwrap_records"` //one line by element of the records array of the Azure diagnostic logs, true by default
+	Timeout                           *time.Duration `yaml:"timeout"`        //to connect and list the partitions
+}
+
+// EventHubSource reads the partitions of an event hub. The position reached in each partition is saved as a
+// checkpoint in the cursors store once the events were handed to crowdsec, so that a restart resumes from it
+type EventHubSource struct {
+	configuration.HealthTracker
+	config           EventHubConfiguration
+	logger           *log.Entry
+	connectionString *secrets.Secret //resolved again at each connection
+	namespace        string          //the one of the checkpoints keys
+	retrier          *retry.Retrier
+}
+
+// checkpointStore persists the checkpoints of the partitions in the cursors store
+type checkpointStore struct {
+	datasource string
+}
+
+func checkpointKey(namespace string, name string, consumerGroup string, partitionID string) string {
+	return strings.Join([]string{namespace, name, consumerGroup, partitionID}, "/")
+}
+
+func (c *checkpointStore) Write(namespace string, name string, consumerGroup string, partitionID string, checkpoint persist.Checkpoint) error {
+	value, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	return cursors.SaveCursor(c.datasource, checkpointKey(namespace, name, consumerGroup, partitionID), string(value))
+}
+
+func (c *checkpointStore) Read(namespace string, name string, consumerGroup string, partitionID string) (persist.Checkpoint, error) {
+	key := checkpointKey(namespace, name, consumerGroup, partitionID)
+	value, err := cursors.LoadCursor(c.datasource, key)
+	if err != nil {
+		return persist.Checkpoint{}, err
+	}
+	if value == "" {
+		//like the persisters of the sdk
+		return persist.NewCheckpointFromStartOfStream(), fmt.Errorf("no checkpoint for %s", key)
+	}
+	checkpoint := persist.Checkpoint{}
+	if err := json.Unmarshal([]byte(value), &checkpoint); err != nil {
+		return persist.Checkpoint{}, errors.Wrapf(err, "invalid checkpoint for %s", key)
+	}
+	return checkpoint, nil
+}
+
+func (e *EventHubSource) GetMetrics() []prometheus.Collector {
+	return []prometheus.Collector{linesRead}
+}
+
+func (e *EventHubSource) GetAggregMetrics() []prometheus.Collector {
+	return []prometheus.Collector{linesRead}
+}
+
+// parseConnectionString returns the fields of a connection string : Endpoint=sb://<namespace>.servicebus.windows.net/;...
+func parseConnectionString(connectionString string) map[string]string {
+	ret := map[string]string{}
+	for _, part := range strings.Split(connectionString, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) == 2 {
+			ret[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+	return ret
+}
+
+func (e *EventHubSource) Configure(yamlConfig []byte, logger *log.Entry) error {
+	e.logger = logger
+	config := EventHubConfiguration{}
+	config.Mode = configuration.TAIL_MODE
+	if err := yaml.UnmarshalStrict(yamlConfig, &config); err != nil {
+		return errors.Wrap(err, "Cannot parse eventhub datasource configuration")
+	}
+	if config.Mode != configuration.TAIL_MODE {
+		return fmt.Errorf("unsupported mode %s for eventhub datasource", config.Mode)
+	}
+	if (config.ConnectionString == "") == (config.Namespace == "") {
+		return fmt.Errorf("one of connection_string or namespace is mandatory")
+	}
+	if config.ConnectionString != "" {
+		connectionString, err := secrets.NewSecret(config.ConnectionString, e.logger)
+		if err != nil {
+			return errors.Wrap(err, "invalid connection_string")
+		}
+		fields := parseConnectionString(connectionString.Get())
+		if fields["Endpoint"] == "" {
+			return fmt.Errorf("invalid connection_string : no Endpoint")
+		}
+		switch {
+		case fields["EntityPath"] == "" && config.EventHub == "":
+			return fmt.Errorf("event_hub is mandatory when the connection_string has no EntityPath")
+		case fields["EntityPath"] == "":
+		case config.EventHub == "":
+			config.EventHub = fields["EntityPath"]
+		case config.EventHub != fields["EntityPath"]:
+			return fmt.Errorf("event_hub %s does not match the EntityPath of the connection_string", config.EventHub)
+		}
+		e.connectionString = connectionString
+		e.namespace = namespaceOf(connectionString.Get())
+	} else if config.EventHub == "" {
+		return fmt.Errorf("event_hub is mandatory with namespace")
+	} else {
+		e.namespace = config.Namespace
+	}
+	if config.ConsumerGroup == "" {
+		config.ConsumerGroup = eventhub.DefaultConsumerGroup
+	}
+	if config.StartPosition == "" {
+		config.StartPosition = startLatest
+	}
+	if config.StartPosition != startLatest && config.StartPosition != startEarliest {
+		return fmt.Errorf("invalid start_position %s (must be %s or %s)", config.StartPosition, startLatest, startEarliest)
+	}
+	if config.UnwrapRecords == nil {
+		unwrap := true
+		config.UnwrapRecords = &unwrap
+	}
+	if config.Timeout == nil {
+		config.Timeout = &defaultTimeout
+	}
+	var err error
+	e.retrier, err = retry.New(config.Retry, e.logger)
+	if err != nil {
+		return err
+	}
+	e.retrier.Notify = e.notifyRetry
+	e.config = config
+	return nil
+}
+
+// notifyRetry reports the failing connections in the health of the datasource
+func (e *EventHubSource) notifyRetry(err error) {
+	if err != nil {
+		e.SetState(configuration.STATUS_RECONNECTING, err)
+	} else {
+		e.SetState(configuration.STATUS_RUNNING, nil)
+	}
+}
+
+func (e *EventHubSource) ConfigureByDSN(dsn string, labels map[string]string, logger *log.Entry) error {
+	return fmt.Errorf("eventhub datasource does not support one shot acquisition")
+}
+
+func (e *EventHubSource) GetMode() string {
+	return e.config.Mode
+}
+
+func (e *EventHubSource) GetName() string {
+	return "eventhub"
+}
+
+func (e *EventHubSource) GetUuid() string {
+	return e.config.UniqueId
+}
+
+func (e *EventHubSource) OneShotAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	return fmt.Errorf("eventhub datasource does not support one shot acquisition")
+}
+
+func (e *EventHubSource) CanRun() error {
+	return nil
+}
+
+func (e *EventHubSource) Dump() interface{} {
+	return e
+}
+
+// unwrapRecords returns the lines of an event : the elements of the records array of the Azure diagnostic logs
+// ({"records": [{...}, {...}]}), or the whole event
+func unwrapRecords(data []byte) []string {
+	envelope := struct {
+		Records []json.RawMessage `json:"records"`
+	}{}
+	if err := json.Unmarshal(data, &envelope); err != nil || len(envelope.Records) == 0 {
+		return []string{string(data)}
+	}
+	ret := make([]string, 0, len(envelope.Records))
+	for _, record := range envelope.Records {
+		//one record by line, even if the envelope was indented
+		buf := bytes.Buffer{}
+		if err := json.Compact(&buf, record); err != nil {
+			ret = append(ret, string(record))
+			continue
+		}
+		ret = append(ret, buf.String())
+	}
+	return ret
+}
+
+func (e *EventHubSource) newHub() (*eventhub.Hub, error) {
+	store := eventhub.HubWithOffsetPersistence(&checkpointStore{datasource: e.GetName()})
+	if e.connectionString != nil {
+		parsed, err := conn.ParsedConnectionFromStr(withEntityPath(e.connectionString.Get(), e.config.EventHub))
+		if err != nil {
+			return nil, err
+		}
+		return eventhub.NewHub(parsed.Namespace, parsed.HubName, &keyProvider{connectionString: e.connectionString}, store,
+			eventhub.HubWithEnvironment(azure.Environment{ServiceBusEndpointSuffix: parsed.Suffix}))
+	}
+	return eventhub.NewHubWithNamespaceNameAndEnvironment(e.config.Namespace, e.config.EventHub, store)
+}
+
+// keyProvider signs the tokens with the key of the current connection string. The sdk asks for a token each time a
+// receiver connects, so that a rotated key is used by the next connections
+type keyProvider struct {
+	connectionString *secrets.Secret
+}
+
+func (p *keyProvider) GetToken(audience string) (*auth.Token, error) {
+	parsed, err := conn.ParsedConnectionFromStr(p.connectionString.Get())
+	if err != nil {
+		return nil, err
+	}
+	provider, err := sas.NewTokenProvider(sas.TokenProviderWithKey(parsed.KeyName, parsed.Key))
+	if err != nil {
+		return nil, err
+	}
+	return provider.GetToken(audience)
+}
+
+// withEntityPath completes a connection string of the namespace with the event hub
+func withEntityPath(connectionString string, eventHub string) string {
+	if parseConnectionString(connectionString)["EntityPath"] != "" {
+		return connectionString
+	}
+	return strings.TrimSuffix(connectionString, ";") + ";EntityPath=" + eventHub
+}
+
+// handler hands the lines of the events to crowdsec. The checkpoint of an event is saved once it returned
+func (e *EventHubSource) handler(partitionID string, out chan types.Event, expectMode int) eventhub.Handler {
+	hits := linesRead.With(prometheus.Labels{"eventhub": e.config.EventHub, "partition": partitionID})
+	src := e.config.EventHub + "/" + partitionID
+	return func(ctx context.Context, event *eventhub.Event) error {
+		lines := []string{string(event.Data)}
+		if *e.config.UnwrapRecords {
+			lines = unwrapRecords(event.Data)
+		}
+		for _, line := range lines {
+			l := types.Line{}
+			l.Raw = line
+			l.Src = src
+			l.Time = time.Now().UTC()
+			l.Labels = e.config.Labels
+			l.Process = true
+			l.Module = e.GetName()
+			hits.Inc()
+			e.EventSeen(&l)
+			select {
+			case out <- types.Event{Line: l, Process: true, Type: types.LOG, ExpectMode: expectMode}:
+			case <-ctx.Done():
+				//no checkpoint, the event will be read again
+				return ctx.Err()
+			}
+		}
+		return nil
+	}
+}
+
+// receive reads a partition until the receiver fails, or dying is closed
+func (e *EventHubSource) receive(ctx context.Context, hub *eventhub.Hub, partitionID string, out chan types.Event, expectMode int) error {
+	opts := []eventhub.ReceiveOption{eventhub.ReceiveWithConsumerGroup(e.config.ConsumerGroup)}
+	if e.config.PrefetchCount > 0 {
+		opts = append(opts, eventhub.ReceiveWithPrefetchCount(e.config.PrefetchCount))
+	}
+	//the start options overwrite the checkpoint, they are only used for the partitions without one
+	key := checkpointKey(e.namespace, e.config.EventHub, e.config.ConsumerGroup, partitionID)
+	cursor, err := cursors.LoadCursor(e.GetName(), key)
+	if err != nil {
+		e.logger.Warningf("unable to load checkpoint of %s : %s", key, err)
+	}
+	switch {
+	case cursor != "":
+		e.logger.Debugf("resuming partition %s from its checkpoint", partitionID)
+	case e.config.StartPosition == startLatest:
+		opts = append(opts, eventhub.ReceiveWithLatestOffset())
+	default:
+		opts = append(opts, eventhub.ReceiveWithStartingOffset(persist.StartOfStream))
+	}
+	handle, err := hub.Receive(ctx, partitionID, e.handler(partitionID, out, expectMode), opts...)
+	if err != nil {
+		return errors.Wrapf(err, "while receiving partition %s", partitionID)
+	}
+	e.SetState(configuration.STATUS_RUNNING, nil)
+	select {
+	case <-ctx.Done():
+		closeCtx, cancel := context.WithTimeout(context.Background(), *e.config.Timeout)
+		defer cancel()
+		_ = handle.Close(closeCtx)
+		return nil
+	case <-handle.Done():
+		if err := handle.Err(); err != nil {
+			return errors.Wrapf(err, "while receiving partition %s", partitionID)
+		}
+		return fmt.Errorf("receiver of partition %s stopped", partitionID)
+	}
+}
+
+// namespaceOf returns the namespace of the endpoint of a connection string, like the sdk does for the checkpoints
+func namespaceOf(connectionString string) string {
+	host := strings.TrimPrefix(parseConnectionString(connectionString)["Endpoint"], "sb://")
+	return strings.SplitN(host, ".", 2)[0]
+}
+
+func (e *EventHubSource) StreamingAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	expectMode := leaky.LIVE
+	if e.config.UseTimeMachine {
+		expectMode = leaky.TIMEMACHINE
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Go(func() error {
+		defer types.CatchPanic("crowdsec/acquis/eventhub/live")
+		defer cancel()
+		var hub *eventhub.Hub
+		partitions := e.config.Partitions
+		err := e.retrier.Do(t.Dying(), func() error {
+			var err error
+			if hub, err = e.newHub(); err != nil {
+				return retry.Permanent(errors.Wrap(err, "while creating event hub client"))
+			}
+			if len(partitions) > 0 {
+				return nil
+			}
+			infoCtx, infoCancel := context.WithTimeout(ctx, *e.config.Timeout)
+			defer infoCancel()
+			info, err := hub.GetRuntimeInformation(infoCtx)
+			if err != nil {
+				_ = hub.Close(context.Background())
+				return errors.Wrap(err, "while listing partitions")
+			}
+			partitions = info.PartitionIDs
+			return nil
+		})
+		if err == retry.ErrDying {
+			return nil
+		}
+		if err != nil {
+			err = errors.Wrapf(err, "while connecting to event hub %s", e.config.EventHub)
+			e.SetState(configuration.STATUS_ERRORED, err)
+			return err
+		}
+		defer hub.Close(context.Background())
+		e.logger.Infof("reading partitions %s of event hub %s with consumer group %s", strings.Join(partitions, ", "),
+			e.config.EventHub, e.config.ConsumerGroup)
+		for _, partitionID := range partitions {
+			partitionID := partitionID
+			t.Go(func() error {
+				defer types.CatchPanic("crowdsec/acquis/eventhub/partition")
+				err := e.retrier.Do(t.Dying(), func() error {
+					return e.receive(ctx, hub, partitionID, out, expectMode)
+				})
+				if err == retry.ErrDying || err == nil {
+					return nil
+				}
+				e.SetState(configuration.STATUS_ERRORED, err)
+				return err
+			})
+		}
+		<-t.Dying()
+		e.logger.Infof("eventhub datasource stopping")
+		//the receivers are closed before the hub
+		cancel()
+		return nil
+	})
+	return nil
+}
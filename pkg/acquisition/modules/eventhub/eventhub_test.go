@@ -0,0 +1,177 @@
+package eventhubacquisition
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-event-hubs-go/v3/persist"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/cursors"
+	"github.com/crowdsecurity/crowdsec/pkg/cstest"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testConnectionString = "Endpoint=sb://crowdsec-ns.servicebus.windows.net/;SharedAccessKeyName=listen;SharedAccessKey=c2VjcmV0"
+
+func TestConfigure(t *testing.T) {
+	tests := []struct {
+		config      string
+		expectedErr string
+	}{
+		{
+			config:      `foobar: bla`,
+			expectedErr: "field foobar not found in type eventhubacquisition.EventHubConfiguration",
+		},
+		{
+			config:      `source: eventhub`,
+			expectedErr: "one of connection_string or namespace is mandatory",
+		},
+		{
+			config: `
+source: eventhub
+connection_string: ` + testConnectionString + `
+event_hub: logs`,
+			expectedErr: "",
+		},
+		{
+			config: `
+source: eventhub
+namespace: crowdsec-ns
+event_hub: logs
+consumer_group: crowdsec
+partitions: ["0", "1"]
+start_position: earliest`,
+			expectedErr: "",
+		},
+		{
+			config: `
+namespace: crowdsec-ns
+connection_string: ` + testConnectionString + `
+event_hub: logs`,
+			expectedErr: "one of connection_string or namespace is mandatory",
+		},
+		{
+			config: `
+namespace: crowdsec-ns
+event_hub: logs
+mode: cat`,
+			expectedErr: "unsupported mode cat for eventhub datasource",
+		},
+		{
+			config: `
+connection_string: SharedAccessKeyName=listen
+event_hub: logs`,
+			expectedErr: "invalid connection_string : no Endpoint",
+		},
+		{
+			config: `
+connection_string: ` + testConnectionString,
+			expectedErr: "event_hub is mandatory when the connection_string has no EntityPath",
+		},
+		{
+			config: `
+connection_string: ` + testConnectionString + `;EntityPath=logs
+event_hub: other`,
+			expectedErr: "event_hub other does not match the EntityPath of the connection_string",
+		},
+		{
+			config: `
+namespace: crowdsec-ns`,
+			expectedErr: "event_hub is mandatory with namespace",
+		},
+		{
+			config: `
+namespace: crowdsec-ns
+event_hub: logs
+start_position: beginning`,
+			expectedErr: "invalid start_position beginning (must be latest or earliest)",
+		},
+	}
+	subLogger := log.WithFields(log.Fields{
+		"type": "eventhub",
+	})
+	for _, test := range tests {
+		e := EventHubSource{}
+		err := e.Configure([]byte(test.config), subLogger)
+		cstest.AssertErrorContains(t, err, test.expectedErr)
+	}
+}
+
+func TestConnectionString(t *testing.T) {
+	e := EventHubSource{}
+	require.NoError(t, e.Configure([]byte(`
+connection_string: `+testConnectionString+`
+event_hub: logs`), log.WithField("type", "eventhub")))
+	assert.Equal(t, testConnectionString+";EntityPath=logs", withEntityPath(e.connectionString.Get(), e.config.EventHub))
+	assert.Equal(t, "crowdsec-ns", e.namespace)
+	assert.Equal(t, "$Default", e.config.ConsumerGroup)
+	assert.Equal(t, "latest", e.config.StartPosition)
+	assert.True(t, *e.config.UnwrapRecords)
+
+	e = EventHubSource{}
+	require.NoError(t, e.Configure([]byte(`
+connection_string: `+testConnectionString+`;EntityPath=logs`), log.WithField("type", "eventhub")))
+	assert.Equal(t, "logs", e.config.EventHub)
+}
+
+func TestUnwrapRecords(t *testing.T) {
+	tests := []struct {
+		data     string
+		expected []string
+	}{
+		{
+			data:     `plain line`,
+			expected: []string{`plain line`},
+		},
+		{
+			data:     `{"message": "not an envelope"}`,
+			expected: []string{`{"message": "not an envelope"}`},
+		},
+		{
+			data:     `{"records": []}`,
+			expected: []string{`{"records": []}`},
+		},
+		{
+			data: `{"records": [
+  {"time": "2022-06-01T10:00:00Z", "category": "AzureFirewallNetworkRule", "properties": {"msg": "TCP request"}},
+  {"time": "2022-06-01T10:00:01Z", "category": "AzureFirewallNetworkRule"}
+]}`,
+			expected: []string{
+				`{"time":"2022-06-01T10:00:00Z","category":"AzureFirewallNetworkRule","properties":{"msg":"TCP request"}}`,
+				`{"time":"2022-06-01T10:00:01Z","category":"AzureFirewallNetworkRule"}`,
+			},
+		},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, unwrapRecords([]byte(test.data)))
+	}
+}
+
+func TestCheckpointStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eventhub-cursors")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store, err := cursors.NewFileStore(filepath.Join(dir, "cursors.json"))
+	require.NoError(t, err)
+	cursors.SetStore(store)
+	defer cursors.SetStore(nil)
+
+	c := checkpointStore{datasource: "eventhub"}
+	_, err = c.Read("crowdsec-ns", "logs", "$Default", "0")
+	cstest.AssertErrorContains(t, err, "no checkpoint for crowdsec-ns/logs/$Default/0")
+
+	checkpoint := persist.Checkpoint{Offset: "4294967296", SequenceNumber: 42, EnqueueTime: time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)}
+	require.NoError(t, c.Write("crowdsec-ns", "logs", "$Default", "0", checkpoint))
+	read, err := c.Read("crowdsec-ns", "logs", "$Default", "0")
+	require.NoError(t, err)
+	assert.Equal(t, checkpoint, read)
+	//the partitions and consumer groups have their own checkpoints
+	_, err = c.Read("crowdsec-ns", "logs", "crowdsec", "0")
+	require.Error(t, err)
+	_, err = c.Read("crowdsec-ns", "logs", "$Default", "1")
+	require.Error(t, err)
+}
@@ -0,0 +1,77 @@
+package fileacquisition
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+const (
+	COMPRESSION_NONE  = ""
+	COMPRESSION_GZIP  = "gz"
+	COMPRESSION_BZIP2 = "bz2"
+	COMPRESSION_ZSTD  = "zst"
+)
+
+// the compression formats, with their magic bytes and file extensions
+var compressionFormats = []struct {
+	name       string
+	magic      []byte
+	extensions []string
+}{
+	{name: COMPRESSION_GZIP, magic: []byte{0x1f, 0x8b}, extensions: []string{".gz"}},
+	{name: COMPRESSION_BZIP2, magic: []byte("BZh"), extensions: []string{".bz2", ".bz"}},
+	{name: COMPRESSION_ZSTD, magic: []byte{0x28, 0xb5, 0x2f, 0xfd}, extensions: []string{".zst", ".zstd"}},
+}
+
+// detectCompression guesses the compression of a file from its extension, or else from its first bytes
+// (logrotate doesn't always add an extension to the files it compresses)
+func detectCompression(filename string, reader *bufio.Reader) string {
+	ext := filepath.Ext(filename)
+	for _, format := range compressionFormats {
+		for _, formatExt := range format.extensions {
+			if ext == formatExt {
+				return format.name
+			}
+		}
+	}
+	for _, format := range compressionFormats {
+		//Peek returns an error (and what it could read) if the file is too short, it can't be this format then
+		if head, err := reader.Peek(len(format.magic)); err == nil && bytes.Equal(head, format.magic) {
+			return format.name
+		}
+	}
+	return COMPRESSION_NONE
+}
+
+// newDecompressReader returns a reader of the uncompressed content of the file
+func newDecompressReader(filename string, fd io.Reader) (io.ReadCloser, error) {
+	reader := bufio.NewReader(fd)
+	switch compression := detectCompression(filename, reader); compression {
+	case COMPRESSION_GZIP:
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read %s %s", compression, filename)
+		}
+		return gz, nil
+	case COMPRESSION_BZIP2:
+		//bzip2 reports corrupted data while reading
+		return ioutil.NopCloser(bzip2.NewReader(reader)), nil
+	case COMPRESSION_ZSTD:
+		zst, err := zstd.NewReader(reader)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read %s %s", compression, filename)
+		}
+		//zstd, like bzip2, reports corrupted data while reading
+		return zst.IOReadCloser(), nil
+	default:
+		return ioutil.NopCloser(reader), nil
+	}
+}
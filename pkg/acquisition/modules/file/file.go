@@ -2,17 +2,19 @@ package fileacquisition
 
 import (
 	"bufio"
-	"compress/gzip"
 	"fmt"
 	"io"
-	"net/url"
+	stdlog "log"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/cursors"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/limits"
 	leaky "github.com/crowdsecurity/crowdsec/pkg/leakybucket"
 	"github.com/crowdsecurity/crowdsec/pkg/types"
 	"github.com/fsnotify/fsnotify"
@@ -31,6 +33,9 @@ var linesRead = prometheus.NewCounterVec(
 	},
 	[]string{"source"})
 
+// how often the offset of the tailed files is saved
+var cursorSaveInterval = 5 * time.Second
+
 type FileConfiguration struct {
 	Filenames                         []string
 	Filename                          string
@@ -39,6 +44,7 @@ type FileConfiguration struct {
 }
 
 type FileSource struct {
+	configuration.HealthTracker
 	config             FileConfiguration
 	watcher            *fsnotify.Watcher
 	watchedDirectories map[string]bool
@@ -120,52 +126,33 @@ func (f *FileSource) Configure(Config []byte, logger *log.Entry) error {
 }
 
 func (f *FileSource) ConfigureByDSN(dsn string, labels map[string]string, logger *log.Entry) error {
-	if !strings.HasPrefix(dsn, "file://") {
-		return fmt.Errorf("invalid DSN %s for file source, must start with file://", dsn)
-	}
-
 	f.logger = logger
-
-	dsn = strings.TrimPrefix(dsn, "file://")
-
-	args := strings.Split(dsn, "?")
-
-	if len(args[0]) == 0 {
+	parsed, err := configuration.ParseDSN(dsn, "file")
+	if err != nil {
+		return err
+	}
+	if len(parsed.Target) == 0 {
 		return fmt.Errorf("empty file:// DSN")
 	}
-
-	if len(args) == 2 && len(args[1]) != 0 {
-		params, err := url.ParseQuery(args[1])
-		if err != nil {
-			return fmt.Errorf("could not parse file args : %s", err)
-		}
-		for key, value := range params {
-			if key != "log_level" {
-				return fmt.Errorf("unsupported key %s in file DSN", key)
-			}
-			if len(value) != 1 {
-				return fmt.Errorf("expected zero or one value for 'log_level'")
-			}
-			lvl, err := log.ParseLevel(value[0])
-			if err != nil {
-				return errors.Wrapf(err, "unknown level %s", value[0])
-			}
-			f.logger.Logger.SetLevel(lvl)
-		}
+	if err := parsed.CheckParams(); err != nil {
+		return err
+	}
+	if err := parsed.SetLogLevel(f.logger); err != nil {
+		return err
 	}
 
 	f.config = FileConfiguration{}
 	f.config.Labels = labels
 	f.config.Mode = configuration.CAT_MODE
 
-	f.logger.Debugf("Will try pattern %s", args[0])
-	files, err := filepath.Glob(args[0])
+	f.logger.Debugf("Will try pattern %s", parsed.Target)
+	files, err := filepath.Glob(parsed.Target)
 	if err != nil {
 		return errors.Wrap(err, "Glob failure")
 	}
 
 	if len(files) == 0 {
-		return fmt.Errorf("no matching files for pattern %s", args[0])
+		return fmt.Errorf("no matching files for pattern %s", parsed.Target)
 	}
 
 	if len(files) > 1 {
@@ -222,6 +209,10 @@ func (f *FileSource) GetName() string {
 	return "file"
 }
 
+func (f *FileSource) GetUuid() string {
+	return f.config.UniqueId
+}
+
 func (f *FileSource) CanRun() error {
 	return nil
 }
@@ -252,20 +243,162 @@ func (f *FileSource) StreamingAcquisition(out chan types.Event, t *tomb.Tomb) er
 			f.logger.Warnf("%s is a directory, ignoring it.", file)
 			continue
 		}
-		tail, err := tail.TailFile(file, tail.Config{ReOpen: true, Follow: true, Poll: true, Location: &tail.SeekInfo{Offset: 0, Whence: io.SeekEnd}})
+		id, err := fileID(file)
 		if err != nil {
-			f.logger.Errorf("Could not start tailing file %s : %s", file, err)
-			continue
+			f.logger.Warningf("unable to identify %s, rotations won't be detected on restart : %s", file, err)
 		}
+		location, previous := f.startLocation(file, fi.Size(), id)
+		file := file
 		f.tails[file] = true
 		t.Go(func() error {
 			defer types.CatchPanic("crowdsec/acquis/file/live/fsnotify")
-			return f.tailFile(out, t, tail)
+			return f.runTail(out, t, file, location, id, previous)
 		})
 	}
 	return nil
 }
 
+// fileCursor is the position reached in a tailed file. The file is identified by its id, so that a rotation is
+// noticed even if the new file is already bigger than the offset. The cursors saved by older versions have no id
+type fileCursor struct {
+	id     string
+	offset int64
+}
+
+func parseFileCursor(value string) (fileCursor, error) {
+	cursor := fileCursor{}
+	offset := value
+	if idx := strings.LastIndex(value, ":"); idx >= 0 {
+		cursor.id = value[:idx]
+		offset = value[idx+1:]
+	}
+	var err error
+	cursor.offset, err = strconv.ParseInt(offset, 10, 64)
+	return cursor, err
+}
+
+func (c fileCursor) String() string {
+	if c.id == "" {
+		return strconv.FormatInt(c.offset, 10)
+	}
+	return c.id + ":" + strconv.FormatInt(c.offset, 10)
+}
+
+// startLocation resumes from the saved offset of the file if there is one, or starts at the end of the file.
+// A file truncated since (copytruncate) is read from the start. A file rotated since is read from the start too,
+// and the cursor of the rotated file is returned, so that its remainder is read first
+func (f *FileSource) startLocation(file string, size int64, id string) (*tail.SeekInfo, *fileCursor) {
+	value, err := cursors.LoadCursor(f.GetName(), file)
+	if err != nil {
+		f.logger.Warningf("unable to load cursor of %s : %s", file, err)
+	}
+	if value == "" {
+		return &tail.SeekInfo{Offset: 0, Whence: io.SeekEnd}, nil
+	}
+	cursor, err := parseFileCursor(value)
+	if err != nil {
+		f.logger.Debugf("ignoring cursor '%s' of %s : %s", value, file, err)
+		return &tail.SeekInfo{Offset: 0, Whence: io.SeekEnd}, nil
+	}
+	location, previous := f.cursorLocation(file, size, id, cursor)
+	if previous == nil && location.Offset == cursor.offset {
+		f.logger.Infof("resuming %s at offset %d", file, cursor.offset)
+	}
+	return location, previous
+}
+
+// cursorLocation resumes from cursor, unless the file was rotated or truncated since
+func (f *FileSource) cursorLocation(file string, size int64, id string, cursor fileCursor) (*tail.SeekInfo, *fileCursor) {
+	if cursor.id != "" && id != "" && cursor.id != id {
+		f.logger.Infof("%s was rotated since it was last read, reading the new file from the start", file)
+		return &tail.SeekInfo{Offset: 0, Whence: io.SeekStart}, &cursor
+	}
+	if cursor.offset > size {
+		f.logger.Infof("%s was truncated since it was last read, reading it from the start", file)
+		return &tail.SeekInfo{Offset: 0, Whence: io.SeekStart}, nil
+	}
+	return &tail.SeekInfo{Offset: cursor.offset, Whence: io.SeekStart}, nil
+}
+
+func (f *FileSource) saveOffset(file string, id string, offset int64) {
+	if err := cursors.SaveCursor(f.GetName(), file, fileCursor{id: id, offset: offset}.String()); err != nil {
+		f.logger.Warningf("unable to save cursor of %s : %s", file, err)
+	}
+}
+
+// findRotated looks for the file with the given id next to file (ie. access.log.1 for access.log)
+func findRotated(file string, id string) string {
+	dir := filepath.Dir(file)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	for _, entry := range entries {
+		candidate := filepath.Join(dir, entry.Name())
+		if entry.IsDir() || candidate == filepath.Clean(file) {
+			continue
+		}
+		if candidateID, err := fileID(candidate); err == nil && candidateID == id {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// readRotated reads what was written to a rotated file after the cursor, before the new file is tailed
+func (f *FileSource) readRotated(file string, previous *fileCursor, out chan types.Event, t *tomb.Tomb) {
+	rotated := findRotated(file, previous.id)
+	if rotated == "" {
+		f.logger.Warningf("unable to find the rotated file of %s, lines written after offset %d may be missing", file, previous.offset)
+		return
+	}
+	fd, err := os.Open(rotated)
+	if err != nil {
+		f.logger.Warningf("unable to read the rotated file %s : %s", rotated, err)
+		return
+	}
+	defer fd.Close()
+	if _, err := fd.Seek(previous.offset, io.SeekStart); err != nil {
+		f.logger.Warningf("unable to seek %s to offset %d : %s", rotated, previous.offset, err)
+		return
+	}
+	f.logger.Infof("reading the remainder of %s (rotated to %s) from offset %d", file, rotated, previous.offset)
+	hits := linesRead.With(prometheus.Labels{"source": file})
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		hits.Inc()
+		evt := f.lineEvent(trimLine(scanner.Text()), file, time.Now().UTC())
+		f.EventSeen(&evt.Line)
+		select {
+		case out <- evt:
+		case <-t.Dying():
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		f.logger.Warningf("failed to read the rotated file %s : %s", rotated, err)
+	}
+}
+
+// lineEvent builds the event of a line read from a tailed file
+func (f *FileSource) lineEvent(text string, src string, readAt time.Time) types.Event {
+	l := types.Line{}
+	l.Raw = text
+	l.Labels = f.config.Labels
+	l.Time = readAt
+	l.Src = src
+	l.Process = true
+	l.Module = f.GetName()
+	//we're tailing, it must be real time logs
+	if !f.config.UseTimeMachine {
+		return types.Event{Line: l, Process: true, Type: types.LOG, ExpectMode: leaky.LIVE}
+	}
+	return types.Event{Line: l, Process: true, Type: types.LOG, ExpectMode: leaky.TIMEMACHINE}
+}
+
 func (f *FileSource) Dump() interface{} {
 	return f
 }
@@ -320,16 +453,16 @@ func (f *FileSource) monitorNewFiles(out chan types.Event, t *tomb.Tomb) error {
 					f.logger.Errorf("unable to close %s : %s", event.Name, err)
 					continue
 				}
-				//Slightly different parameters for Location, as we want to read the first lines of the newly created file
-				tail, err := tail.TailFile(event.Name, tail.Config{ReOpen: true, Follow: true, Poll: true, Location: &tail.SeekInfo{Offset: 0, Whence: io.SeekStart}})
+				id, err := fileID(event.Name)
 				if err != nil {
-					logger.Errorf("Could not start tailing file %s : %s", event.Name, err)
-					break
+					logger.Warningf("unable to identify %s, rotations won't be detected on restart : %s", event.Name, err)
 				}
-				f.tails[event.Name] = true
+				//Slightly different parameters for Location, as we want to read the first lines of the newly created file
+				file := event.Name
+				f.tails[file] = true
 				t.Go(func() error {
 					defer types.CatchPanic("crowdsec/acquis/tailfile")
-					return f.tailFile(out, t, tail)
+					return f.runTail(out, t, file, &tail.SeekInfo{Offset: 0, Whence: io.SeekStart}, id, nil)
 				})
 			}
 		case err, ok := <-f.watcher.Errors:
@@ -347,49 +480,176 @@ func (f *FileSource) monitorNewFiles(out chan types.Event, t *tomb.Tomb) error {
 	}
 }
 
-func (f *FileSource) tailFile(out chan types.Event, t *tomb.Tomb, tail *tail.Tail) error {
+// errTailerYield is returned by tailFile when it gives its slot to a tailer waiting for one
+var errTailerYield = errors.New("tailer yields its slot")
+
+// tailLog is the output of the logger of a tailer. nxadm/tail has no hook on the reopening of the file (after a
+// rotation or a truncation), but logs it between the last line of the previous file and the first line of the new
+// one : the reopening is signaled on reopened, and the messages are logged at debug level
+type tailLog struct {
+	logger   *log.Entry
+	reopened chan struct{}
+	stop     chan struct{} //closed before the tailer is stopped, so that it doesn't wait on reopened
+}
+
+func newTailLog(logger *log.Entry) *tailLog {
+	return &tailLog{logger: logger, reopened: make(chan struct{}), stop: make(chan struct{})}
+}
+
+func (l *tailLog) Write(p []byte) (int, error) {
+	msg := strings.TrimSpace(string(p))
+	l.logger.Debugf("tail : %s", msg)
+	if strings.HasPrefix(msg, "Successfully reopened") {
+		select {
+		case l.reopened <- struct{}{}:
+		case <-l.stop:
+		}
+	}
+	return len(p), nil
+}
+
+// stopTail stops tailer, whose log is l
+func (l *tailLog) stopTail(tailer *tail.Tail) error {
+	close(l.stop)
+	return tailer.Stop()
+}
+
+// runTail tails file from location. When the number of tailers is limited (cf. limits.SetMaxTailers), the file is
+// opened once a slot is free, and the slot is given back to the waiting tailers after a while : the tail resumes
+// from where it stopped on its next turn
+func (f *FileSource) runTail(out chan types.Event, t *tomb.Tomb, file string, location *tail.SeekInfo, id string, previous *fileCursor) error {
+	var next *fileCursor
+	for {
+		if !limits.AcquireTailer(t.Dying()) {
+			return nil
+		}
+		if next != nil {
+			fi, err := os.Stat(file)
+			if err != nil {
+				limits.ReleaseTailer()
+				f.logger.Errorf("could not stat file %s, not tailing it anymore : %s", file, err)
+				return nil
+			}
+			if id, err = fileID(file); err != nil {
+				f.logger.Warningf("unable to identify %s, rotations won't be detected : %s", file, err)
+			}
+			location, previous = f.cursorLocation(file, fi.Size(), id, *next)
+		}
+		//the offset the tail starts from, in case it has to yield before reading anything
+		offset := location.Offset
+		if location.Whence == io.SeekEnd {
+			if fi, err := os.Stat(file); err == nil {
+				offset = fi.Size()
+			}
+		}
+		tailLog := newTailLog(f.logger.WithField("tail", file))
+		tailer, err := tail.TailFile(file, tail.Config{ReOpen: true, Follow: true, Poll: true, Location: location,
+			Logger: stdlog.New(tailLog, "", 0)})
+		if err != nil {
+			limits.ReleaseTailer()
+			f.logger.Errorf("Could not start tailing file %s : %s", file, err)
+			return nil
+		}
+		cursor, err := f.tailFile(out, t, tailer, tailLog, id, previous, offset)
+		limits.ReleaseTailer()
+		if err != errTailerYield {
+			return err
+		}
+		f.logger.Debugf("%s gave its slot back, resuming at offset %d on its next turn", file, cursor.offset)
+		next = &cursor
+	}
+}
+
+// tailFile pushes the lines of a tailed file, starting at offset. id identifies the file being read, previous is
+// the cursor of the file it replaced if it was rotated while crowdsec was not running.
+// It returns the position reached when it yields its slot (errTailerYield)
+func (f *FileSource) tailFile(out chan types.Event, t *tomb.Tomb, tail *tail.Tail, tailLog *tailLog, id string, previous *fileCursor, offset int64) (fileCursor, error) {
 	logger := f.logger.WithField("tail", tail.Filename)
 	logger.Debugf("-> Starting tail of %s", tail.Filename)
+	hits := linesRead.With(prometheus.Labels{"source": tail.Filename})
+	if previous != nil {
+		f.readRotated(tail.Filename, previous, out, t)
+	}
+	//the offset is saved periodically rather than on every line
+	savedOffset := offset
+	cursorTicker := time.NewTicker(cursorSaveInterval)
+	defer cursorTicker.Stop()
+	//when the tailers are limited, check once in a while if others are waiting for a slot
+	var yield <-chan time.Time
+	if quantum := limits.TailerQuantum(); quantum > 0 {
+		yieldTicker := time.NewTicker(quantum)
+		defer yieldTicker.Stop()
+		yield = yieldTicker.C
+	}
 	for {
-		l := types.Line{}
 		select {
+		case <-cursorTicker.C:
+			if offset != savedOffset {
+				f.saveOffset(tail.Filename, id, offset)
+				savedOffset = offset
+			}
+		case <-yield:
+			if !limits.TailersWaiting() {
+				continue
+			}
+			logger.Debugf("giving the slot of %s to a waiting tailer", tail.Filename)
+			if offset != savedOffset {
+				f.saveOffset(tail.Filename, id, offset)
+			}
+			if err := tailLog.stopTail(tail); err != nil {
+				f.logger.Errorf("error in stop : %s", err)
+				return fileCursor{}, err
+			}
+			return fileCursor{id: id, offset: offset}, errTailerYield
 		case <-t.Dying():
 			logger.Infof("File datasource %s stopping", tail.Filename)
-			if err := tail.Stop(); err != nil {
+			if offset != savedOffset {
+				f.saveOffset(tail.Filename, id, offset)
+			}
+			if err := tailLog.stopTail(tail); err != nil {
 				f.logger.Errorf("error in stop : %s", err)
-				return err
+				return fileCursor{}, err
 			}
-			return nil
+			return fileCursor{}, nil
+		case <-tailLog.reopened:
+			//the tailer reopened the file : it was either rotated (renamed, then created again) or truncated
+			newID, err := fileID(tail.Filename)
+			if err == nil && id != "" && newID != id {
+				f.readRotated(tail.Filename, &fileCursor{id: id, offset: offset}, out, t)
+			} else {
+				logger.Infof("%s was truncated, reading it from the start", tail.Filename)
+			}
+			if err == nil {
+				id = newID
+			}
+			offset = 0
 		case <-tail.Tomb.Dying(): //our tailer is dying
 			logger.Warningf("File reader of %s died", tail.Filename)
-			t.Kill(fmt.Errorf("dead reader for %s", tail.Filename))
-			return fmt.Errorf("reader for %s is dead", tail.Filename)
+			err := fmt.Errorf("dead reader for %s", tail.Filename)
+			f.SetState(configuration.STATUS_ERRORED, err)
+			t.Kill(err)
+			return fileCursor{}, fmt.Errorf("reader for %s is dead", tail.Filename)
 		case line := <-tail.Lines:
 			if line == nil {
 				logger.Debugf("Nil line")
-				return fmt.Errorf("tail for %s is empty", tail.Filename)
+				return fileCursor{}, fmt.Errorf("tail for %s is empty", tail.Filename)
 			}
 			if line.Err != nil {
 				logger.Warningf("fetch error : %v", line.Err)
-				return line.Err
+				return fileCursor{}, line.Err
 			}
+			offset = line.SeekInfo.Offset
 			if line.Text == "" { //skip empty lines
 				continue
 			}
-			linesRead.With(prometheus.Labels{"source": tail.Filename}).Inc()
-			l.Raw = trimLine(line.Text)
-			l.Labels = f.config.Labels
-			l.Time = line.Time
-			l.Src = tail.Filename
-			l.Process = true
-			l.Module = f.GetName()
-			//we're tailing, it must be real time logs
-			logger.Debugf("pushing %+v", l)
-			if !f.config.UseTimeMachine {
-				out <- types.Event{Line: l, Process: true, Type: types.LOG, ExpectMode: leaky.LIVE}
-			} else {
-				out <- types.Event{Line: l, Process: true, Type: types.LOG, ExpectMode: leaky.TIMEMACHINE}
+			hits.Inc()
+			evt := f.lineEvent(trimLine(line.Text), tail.Filename, line.Time)
+			if logger.Logger.IsLevelEnabled(log.DebugLevel) {
+				//avoid boxing the line on every push when not debugging
+				logger.Debugf("pushing %+v", evt.Line)
 			}
+			f.EventSeen(&evt.Line)
+			out <- evt
 		}
 	}
 }
@@ -404,36 +664,39 @@ func (f *FileSource) readFile(filename string, out chan types.Event, t *tomb.Tom
 	}
 	defer fd.Close()
 
-	if strings.HasSuffix(filename, ".gz") {
-		gz, err := gzip.NewReader(fd)
-		if err != nil {
-			logger.Errorf("Failed to read gz file: %s", err)
-			return errors.Wrapf(err, "failed to read gz %s", filename)
-		}
-		defer gz.Close()
-		scanner = bufio.NewScanner(gz)
-
-	} else {
-		scanner = bufio.NewScanner(fd)
+	//.gz and .bz2 files are decompressed on the fly
+	reader, err := newDecompressReader(filename, fd)
+	if err != nil {
+		logger.Errorf("Failed to read file: %s", err)
+		return err
 	}
+	defer reader.Close()
+	scanner = bufio.NewScanner(reader)
 	scanner.Split(bufio.ScanLines)
+	hits := linesRead.With(prometheus.Labels{"source": filename})
 	for scanner.Scan() {
-		if scanner.Text() == "" {
+		//scanner.Text() allocates a new string on each call : work on the bytes and convert only once
+		if len(scanner.Bytes()) == 0 {
 			continue
 		}
-		logger.Debugf("line %s", scanner.Text())
 		l := types.Line{}
-		l.Raw = scanner.Text()
+		l.Raw = string(scanner.Bytes())
+		logger.Debugf("line %s", l.Raw)
 		l.Time = time.Now().UTC()
 		l.Src = filename
 		l.Labels = f.config.Labels
 		l.Process = true
 		l.Module = f.GetName()
-		linesRead.With(prometheus.Labels{"source": filename}).Inc()
+		hits.Inc()
 
 		//we're reading logs at once, it must be time-machine buckets
+		f.EventSeen(&l)
 		out <- types.Event{Line: l, Process: true, Type: types.LOG, ExpectMode: leaky.TIMEMACHINE}
 	}
+	if err := scanner.Err(); err != nil {
+		logger.Errorf("Failed to read file: %s", err)
+		return errors.Wrapf(err, "failed to read %s", filename)
+	}
 	t.Kill(nil)
 	return nil
 }
@@ -2,13 +2,21 @@ package fileacquisition
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"runtime"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/cursors"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/limits"
 	"github.com/crowdsecurity/crowdsec/pkg/cstest"
 	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/nxadm/tail"
 	log "github.com/sirupsen/logrus"
 	"github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
@@ -178,6 +186,56 @@ filename: test_files/bad.gz`,
 		{
 			config: `
 mode: cat
+filename: test_files/test.log.bz2`,
+			expectedConfigErr: "",
+			expectedErr:       "",
+			expectedOutput:    "",
+			expectedLines:     5,
+			logLevel:          log.WarnLevel,
+		},
+		{
+			config: `
+mode: cat
+filename: test_files/bad.bz2`,
+			expectedConfigErr: "",
+			expectedErr:       "failed to read test_files/bad.bz2: bzip2 data invalid: bad magic value",
+			expectedOutput:    "",
+			expectedLines:     0,
+			logLevel:          log.WarnLevel,
+		},
+		{
+			config: `
+mode: cat
+filename: test_files/rotated.log.1`,
+			expectedConfigErr: "",
+			expectedErr:       "",
+			expectedOutput:    "",
+			expectedLines:     5,
+			logLevel:          log.WarnLevel,
+		},
+		{
+			config: `
+mode: cat
+filename: test_files/test.log.zst`,
+			expectedConfigErr: "",
+			expectedErr:       "",
+			expectedOutput:    "",
+			expectedLines:     5,
+			logLevel:          log.WarnLevel,
+		},
+		{
+			config: `
+mode: cat
+filename: test_files/bad.zst`,
+			expectedConfigErr: "",
+			expectedErr:       "failed to read test_files/bad.zst",
+			expectedOutput:    "",
+			expectedLines:     0,
+			logLevel:          log.WarnLevel,
+		},
+		{
+			config: `
+mode: cat
 filename: test_files/test_delete.log`,
 			setup: func() {
 				f, _ := os.Create("test_files/test_delete.log")
@@ -440,3 +498,265 @@ force_inotify: true`, testPattern),
 		tomb.Kill(nil)
 	}
 }
+
+func benchmarkOneShot(b *testing.B, lines int, lineSize int) {
+	tmpDir, err := os.MkdirTemp("", "file_bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	filename := tmpDir + "/bench.log"
+	fd, err := os.Create(filename)
+	if err != nil {
+		b.Fatal(err)
+	}
+	line := strings.Repeat("a", lineSize) + "\n"
+	for i := 0; i < lines; i++ {
+		if _, err := fd.WriteString(line); err != nil {
+			b.Fatal(err)
+		}
+	}
+	fd.Close()
+
+	subLogger := log.New().WithField("type", "file")
+	subLogger.Logger.SetLevel(log.WarnLevel)
+	b.ReportAllocs()
+	b.SetBytes(int64(lines * (lineSize + 1)))
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		f := FileSource{}
+		if err := f.Configure([]byte("mode: cat\nfilename: "+filename), subLogger); err != nil {
+			b.Fatal(err)
+		}
+		out := make(chan types.Event, 128)
+		done := make(chan int)
+		go func() {
+			count := 0
+			for range out {
+				count++
+			}
+			done <- count
+		}()
+		tomb := tomb.Tomb{}
+		if err := f.OneShotAcquisition(out, &tomb); err != nil {
+			b.Fatal(err)
+		}
+		close(out)
+		if count := <-done; count != lines {
+			b.Fatalf("expected %d lines, got %d", lines, count)
+		}
+	}
+}
+
+func BenchmarkOneShotSmallLines(b *testing.B) {
+	benchmarkOneShot(b, 10000, 64)
+}
+
+func BenchmarkOneShotLargeLines(b *testing.B) {
+	benchmarkOneShot(b, 10000, 2048)
+}
+
+func TestStartLocation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cursors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := cursors.NewFileStore(filepath.Join(dir, "cursors.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cursors.SetStore(store)
+	defer cursors.SetStore(nil)
+
+	f := FileSource{logger: log.WithField("test", "start_location")}
+	//no cursor, start at the end of the file
+	location, previous := f.startLocation("test_files/test.log", 100, "1-2")
+	assert.Equal(t, int64(0), location.Offset)
+	assert.Equal(t, io.SeekEnd, location.Whence)
+	assert.Nil(t, previous)
+
+	f.saveOffset("test_files/test.log", "1-2", 42)
+	location, previous = f.startLocation("test_files/test.log", 100, "1-2")
+	assert.Equal(t, int64(42), location.Offset)
+	assert.Equal(t, io.SeekStart, location.Whence)
+	assert.Nil(t, previous)
+
+	//the file was truncated since the cursor was saved
+	location, previous = f.startLocation("test_files/test.log", 10, "1-2")
+	assert.Equal(t, int64(0), location.Offset)
+	assert.Equal(t, io.SeekStart, location.Whence)
+	assert.Nil(t, previous)
+
+	//the file was rotated since the cursor was saved
+	location, previous = f.startLocation("test_files/test.log", 100, "1-3")
+	assert.Equal(t, int64(0), location.Offset)
+	assert.Equal(t, io.SeekStart, location.Whence)
+	assert.Equal(t, &fileCursor{id: "1-2", offset: 42}, previous)
+
+	//cursors saved without the id of the file
+	if err := store.SaveCursor("file", "test_files/test.log", "42"); err != nil {
+		t.Fatal(err)
+	}
+	location, previous = f.startLocation("test_files/test.log", 100, "1-3")
+	assert.Equal(t, int64(42), location.Offset)
+	assert.Equal(t, io.SeekStart, location.Whence)
+	assert.Nil(t, previous)
+}
+
+func TestReadRotated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "app.log")
+	if err := ioutil.WriteFile(file, []byte("read before\nwritten after\n\nrotation\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	id, err := fileID(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(file, file+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, []byte("new file\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, file+".1", findRotated(file, id))
+
+	f := FileSource{logger: log.WithField("test", "read_rotated")}
+	out := make(chan types.Event, 10)
+	tomb := tomb.Tomb{}
+	f.readRotated(file, &fileCursor{id: id, offset: int64(len("read before\n"))}, out, &tomb)
+	close(out)
+	lines := []string{}
+	for evt := range out {
+		assert.Equal(t, file, evt.Line.Src)
+		lines = append(lines, evt.Line.Raw)
+	}
+	assert.Equal(t, []string{"written after", "rotation"}, lines)
+}
+
+func TestTailRotation(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on windows")
+	}
+	dir, err := ioutil.TempDir("", "rotation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "app.log")
+	if err := ioutil.WriteFile(file, []byte("old 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	id, err := fileID(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := FileSource{logger: log.WithField("test", "tail_rotation")}
+	out := make(chan types.Event)
+	tomb := tomb.Tomb{}
+	tomb.Go(func() error {
+		return f.runTail(out, &tomb, file, &tail.SeekInfo{Offset: 0, Whence: io.SeekStart}, id, nil)
+	})
+	lines := []string{}
+	readLine := func() {
+		select {
+		case evt := <-out:
+			lines = append(lines, evt.Line.Raw)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for a line, got %v", lines)
+		}
+	}
+	readLine()
+	//a line is written just before the rotation, and the first line of the new file ends after the offset reached
+	//in the rotated one
+	fd, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(fd, "old 2\n")
+	fd.Close()
+	if err := os.Rename(file, file+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, []byte("the first line of the new file\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	readLine()
+	readLine()
+	select {
+	case evt := <-out:
+		t.Fatalf("unexpected line %s", evt.Line.Raw)
+	case <-time.After(time.Second):
+	}
+	tomb.Kill(nil)
+	if err := tomb.Wait(); err != nil {
+		t.Fatalf("unexpected error : %s", err)
+	}
+	assert.Equal(t, []string{"old 1", "old 2", "the first line of the new file"}, lines)
+}
+
+func TestTailerTurns(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on windows")
+	}
+	dir, err := ioutil.TempDir("", "turns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	first := filepath.Join(dir, "first.log")
+	second := filepath.Join(dir, "second.log")
+	if err := ioutil.WriteFile(first, []byte("first 1\nfirst 2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(second, []byte("second 1\nsecond 2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	//a single tailer at a time, the files are read in turns
+	limits.SetMaxTailers(1, 300*time.Millisecond)
+	defer limits.SetMaxTailers(0, 0)
+
+	f := FileSource{logger: log.WithField("test", "turns")}
+	out := make(chan types.Event)
+	tomb := tomb.Tomb{}
+	for _, file := range []string{first, second} {
+		file := file
+		tomb.Go(func() error {
+			return f.runTail(out, &tomb, file, &tail.SeekInfo{Offset: 0, Whence: io.SeekStart}, "", nil)
+		})
+	}
+	lines := []string{}
+	appended := false
+	timeout := time.After(10 * time.Second)
+READLOOP:
+	for len(lines) < 5 {
+		select {
+		case evt := <-out:
+			lines = append(lines, evt.Line.Raw)
+		case <-timeout:
+			break READLOOP
+		}
+		//once both files were read, the tail that gave its slot back resumes where it stopped
+		if len(lines) == 4 && !appended {
+			fd, err := os.OpenFile(first, os.O_APPEND|os.O_WRONLY, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fmt.Fprintf(fd, "first 3\n")
+			fd.Close()
+			appended = true
+		}
+	}
+	tomb.Kill(nil)
+	if err := tomb.Wait(); err != nil {
+		t.Fatalf("unexpected error : %s", err)
+	}
+	sort.Strings(lines)
+	assert.Equal(t, []string{"first 1", "first 2", "first 3", "second 1", "second 2"}, lines)
+}
@@ -0,0 +1,22 @@
+// +build !windows
+
+package fileacquisition
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// fileID identifies a file by its device and inode, which don't change when it is renamed (rotated)
+func fileID(path string) (string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", fmt.Errorf("unable to get the inode of %s", path)
+	}
+	return fmt.Sprintf("%d-%d", stat.Dev, stat.Ino), nil
+}
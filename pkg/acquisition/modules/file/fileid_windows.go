@@ -0,0 +1,23 @@
+// +build windows
+
+package fileacquisition
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// fileID identifies a file by its volume and file index, which don't change when it is renamed (rotated)
+func fileID(path string) (string, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+	var info syscall.ByHandleFileInformation
+	if err := syscall.GetFileInformationByHandle(syscall.Handle(fd.Fd()), &info); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d-%d-%d", info.VolumeSerialNumber, info.FileIndexHigh, info.FileIndexLow), nil
+}
@@ -0,0 +1,469 @@
+package fluentforwardacquisition
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/secrets"
+	leaky "github.com/crowdsecurity/crowdsec/pkg/leakybucket"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/tomb.v2"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	FORWARD_CLIENT_AUTH_NONE     = "none"
+	FORWARD_CLIENT_AUTH_OPTIONAL = "optional"
+	FORWARD_CLIENT_AUTH_REQUIRED = "required"
+
+	//how long a client has to authenticate
+	handshakeTimeout = 10 * time.Second
+)
+
+// the records of fluent bit inputs hold the line in "log" (tail, docker ...), the ones of fluentd in "message"
+var defaultMessageFields = []string{"log", "message"}
+
+type ForwardTLSConfiguration struct {
+	CertFile   string `yaml:"cert_file"`
+	KeyFile    string `yaml:"key_file"`
+	CAFile     string `yaml:"ca_file"`
+	ClientAuth string `yaml:"client_auth"`
+}
+
+type ForwardConfiguration struct {
+	Port                              int                      `yaml:"listen_port,omitempty"`
+	Addr                              string                   `yaml:"listen_addr,omitempty"`
+	MaxMessageLen                     int                      `yaml:"max_message_len,omitempty"` //bound of a chunk of events
+	MessageField                      string                   `yaml:"message_field,omitempty"`   //key of the line in the records, log or message by default
+	SharedKey                         string                   `yaml:"shared_key,omitempty"`      //can be a env://, file:// or vault:// reference
+	SelfHostname                      string                   `yaml:"self_hostname,omitempty"`   //sent to the clients in the handshake, the hostname by default
+	TLS                               *ForwardTLSConfiguration `yaml:"tls,omitempty"`
+	configuration.DataSourceCommonCfg `yaml:",inline"`
+}
+
+// ForwardSource receives the events that fluentd and fluent bit send with their forward output
+// (https://github.com/fluent/fluentd/wiki/Forward-Protocol-Specification-v1)
+type ForwardSource struct {
+	configuration.HealthTracker
+	config    ForwardConfiguration
+	logger    *log.Entry
+	tlsConfig *tls.Config
+	sharedKey *secrets.Secret //resolved again on each connection
+	listener  net.Listener
+}
+
+var linesReceived = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cs_fluentforwardsource_hits_total",
+		Help: "Total events that were received with the forward protocol.",
+	},
+	[]string{"source"})
+
+func (f *ForwardSource) GetName() string {
+	return "fluentforward"
+}
+
+func (f *ForwardSource) GetUuid() string {
+	return f.config.UniqueId
+}
+
+func (f *ForwardSource) GetMode() string {
+	return f.config.Mode
+}
+
+func (f *ForwardSource) Dump() interface{} {
+	return f
+}
+
+func (f *ForwardSource) CanRun() error {
+	return nil
+}
+
+func (f *ForwardSource) GetMetrics() []prometheus.Collector {
+	return []prometheus.Collector{linesReceived}
+}
+
+func (f *ForwardSource) GetAggregMetrics() []prometheus.Collector {
+	return []prometheus.Collector{linesReceived}
+}
+
+func (f *ForwardSource) ConfigureByDSN(dsn string, labels map[string]string, logger *log.Entry) error {
+	return fmt.Errorf("fluentforward datasource does not support one shot acquisition")
+}
+
+func (f *ForwardSource) OneShotAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	return fmt.Errorf("fluentforward datasource does not support one shot acquisition")
+}
+
+func (f *ForwardSource) Configure(yamlConfig []byte, logger *log.Entry) error {
+	f.logger = logger
+	forwardConfig := ForwardConfiguration{}
+	forwardConfig.Mode = configuration.TAIL_MODE
+	if err := yaml.UnmarshalStrict(yamlConfig, &forwardConfig); err != nil {
+		return errors.Wrap(err, "Cannot parse fluentforward configuration")
+	}
+	if forwardConfig.Addr == "" {
+		forwardConfig.Addr = "127.0.0.1"
+	}
+	if forwardConfig.Port == 0 {
+		forwardConfig.Port = 24224
+	}
+	if forwardConfig.MaxMessageLen == 0 {
+		forwardConfig.MaxMessageLen = 8 * 1024 * 1024
+	}
+	if forwardConfig.Port <= 0 || forwardConfig.Port > 65535 {
+		return fmt.Errorf("invalid port %d", forwardConfig.Port)
+	}
+	if net.ParseIP(forwardConfig.Addr) == nil {
+		return fmt.Errorf("invalid listen IP %s", forwardConfig.Addr)
+	}
+	if forwardConfig.MaxMessageLen < 0 {
+		return fmt.Errorf("invalid max_message_len %d", forwardConfig.MaxMessageLen)
+	}
+	if forwardConfig.SharedKey != "" {
+		var err error
+		if f.sharedKey, err = secrets.NewSecret(forwardConfig.SharedKey, f.logger); err != nil {
+			return errors.Wrap(err, "invalid shared_key")
+		}
+		if forwardConfig.SelfHostname == "" {
+			if forwardConfig.SelfHostname, err = os.Hostname(); err != nil {
+				return errors.Wrap(err, "while getting hostname for self_hostname")
+			}
+		}
+	}
+	if forwardConfig.TLS != nil {
+		if err := f.configureTLS(forwardConfig.TLS); err != nil {
+			return err
+		}
+	}
+	f.config = forwardConfig
+	return nil
+}
+
+func (f *ForwardSource) configureTLS(config *ForwardTLSConfiguration) error {
+	if config.CertFile == "" || config.KeyFile == "" {
+		return fmt.Errorf("tls.cert_file and tls.key_file are required")
+	}
+	cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return errors.Wrap(err, "could not load server certificate")
+	}
+	f.tlsConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if config.ClientAuth == "" {
+		config.ClientAuth = FORWARD_CLIENT_AUTH_NONE
+		if config.CAFile != "" {
+			config.ClientAuth = FORWARD_CLIENT_AUTH_REQUIRED
+		}
+	}
+	switch config.ClientAuth {
+	case FORWARD_CLIENT_AUTH_NONE:
+		f.tlsConfig.ClientAuth = tls.NoClientCert
+	case FORWARD_CLIENT_AUTH_OPTIONAL:
+		f.tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case FORWARD_CLIENT_AUTH_REQUIRED:
+		f.tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return fmt.Errorf("invalid tls.client_auth %s (must be %s, %s or %s)", config.ClientAuth,
+			FORWARD_CLIENT_AUTH_NONE, FORWARD_CLIENT_AUTH_OPTIONAL, FORWARD_CLIENT_AUTH_REQUIRED)
+	}
+	if f.tlsConfig.ClientAuth != tls.NoClientCert {
+		if config.CAFile == "" {
+			return fmt.Errorf("tls.ca_file is required to verify client certificates")
+		}
+		caCert, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return errors.Wrap(err, "could not read CA file")
+		}
+		caPool := x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(caCert) {
+			return fmt.Errorf("no certificate found in %s", config.CAFile)
+		}
+		f.tlsConfig.ClientCAs = caPool
+	}
+	return nil
+}
+
+func (f *ForwardSource) StreamingAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	addr := net.JoinHostPort(f.config.Addr, strconv.Itoa(f.config.Port))
+	var err error
+	if f.tlsConfig != nil {
+		f.listener, err = tls.Listen("tcp", addr, f.tlsConfig)
+	} else {
+		f.listener, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "could not listen on %s", addr)
+	}
+	f.logger.Infof("listening for forward protocol connections on %s", f.listener.Addr())
+	expectMode := leaky.LIVE
+	if f.config.UseTimeMachine {
+		expectMode = leaky.TIMEMACHINE
+	}
+	t.Go(func() error {
+		defer types.CatchPanic("crowdsec/acquis/fluentforward/live")
+		t.Go(func() error {
+			<-t.Dying()
+			f.logger.Info("fluentforward datasource is dying")
+			return f.listener.Close()
+		})
+		for {
+			conn, err := f.listener.Accept()
+			if err != nil {
+				select {
+				case <-t.Dying():
+					return nil
+				default:
+				}
+				err = errors.Wrap(err, "error while accepting connection")
+				f.SetState(configuration.STATUS_ERRORED, err)
+				return err
+			}
+			t.Go(func() error {
+				f.handleConn(conn, out, t, expectMode)
+				return nil
+			})
+		}
+	})
+	return nil
+}
+
+func (f *ForwardSource) handleConn(conn net.Conn, out chan types.Event, t *tomb.Tomb, expectMode int) {
+	done := make(chan struct{})
+	defer close(done)
+	//unblock the reads when the datasource stops
+	go func() {
+		select {
+		case <-t.Dying():
+		case <-done:
+		}
+		conn.Close()
+	}()
+	client, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		client = conn.RemoteAddr().String()
+	}
+	logger := f.logger.WithField("client", client)
+	decoder := newMsgpackDecoder(conn, f.config.MaxMessageLen)
+	if f.sharedKey != nil {
+		if err := f.handshake(conn, decoder, f.sharedKey.Get()); err != nil {
+			logger.Warningf("authentication failed : %s", err)
+			return
+		}
+	}
+	logger.Debugf("new connection")
+	for {
+		msg, err := decoder.Decode()
+		if err != nil {
+			if err != io.EOF {
+				logger.Debugf("closing connection : %s", err)
+			}
+			return
+		}
+		events, option, err := f.readMessage(msg, client, expectMode)
+		if err != nil {
+			logger.Warningf("closing connection : %s", err)
+			return
+		}
+		for _, evt := range events {
+			select {
+			case out <- evt:
+			case <-t.Dying():
+				return
+			}
+		}
+		//the client waits for the ack of the chunks it numbered, to resend them otherwise
+		if chunk, ok := option["chunk"]; ok {
+			if err := writeMsgpack(conn, map[string]interface{}{"ack": chunk}); err != nil {
+				logger.Debugf("closing connection : %s", err)
+				return
+			}
+		}
+	}
+}
+
+func digest(salt string, hostname string, nonce string, sharedKey string) string {
+	sum := sha512.Sum512([]byte(salt + hostname + nonce + sharedKey))
+	return hex.EncodeToString(sum[:])
+}
+
+// handshake checks that the client knows the shared key : the server sends a HELO with a nonce, the client answers
+// with a PING holding a digest of the nonce and the key, and the server with a PONG holding its own digest
+func (f *ForwardSource) handshake(conn net.Conn, decoder *msgpackDecoder, sharedKey string) error {
+	if err := conn.SetDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		return err
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	//user authentication is not supported, the empty auth salt tells the client not to send credentials
+	helo := []interface{}{"HELO", map[string]interface{}{"nonce": nonce, "auth": []byte{}, "keepalive": true}}
+	if err := writeMsgpack(conn, helo); err != nil {
+		return err
+	}
+	msg, err := decoder.Decode()
+	if err != nil {
+		return err
+	}
+	ping, ok := msg.([]interface{})
+	if !ok || len(ping) < 4 || toString(ping[0]) != "PING" {
+		return fmt.Errorf("expected a PING message")
+	}
+	hostname, salt, clientDigest := toString(ping[1]), toString(ping[2]), toString(ping[3])
+	authenticated := subtle.ConstantTimeCompare([]byte(clientDigest), []byte(digest(salt, hostname, string(nonce), sharedKey))) == 1
+	reason := ""
+	if !authenticated {
+		reason = "shared_key mismatch"
+	}
+	pong := []interface{}{"PONG", authenticated, reason, f.config.SelfHostname, digest(salt, f.config.SelfHostname, string(nonce), sharedKey)}
+	if err := writeMsgpack(conn, pong); err != nil {
+		return err
+	}
+	if !authenticated {
+		return fmt.Errorf("invalid shared key digest from %s", hostname)
+	}
+	return conn.SetDeadline(time.Time{})
+}
+
+// readMessage returns the events of a message, in any of the modes of the protocol : [tag, time, record] (Message),
+// [tag, [[time, record], ...]] (Forward), [tag, packed entries] (PackedForward), and its options
+func (f *ForwardSource) readMessage(msg interface{}, client string, expectMode int) ([]types.Event, map[string]interface{}, error) {
+	fields, ok := msg.([]interface{})
+	if !ok || len(fields) < 2 {
+		return nil, nil, fmt.Errorf("message is not an array of at least 2 values")
+	}
+	tag, ok := fields[0].(string)
+	if !ok {
+		return nil, nil, fmt.Errorf("tag is not a string")
+	}
+	var entries []interface{}
+	option := map[string]interface{}{}
+	switch value := fields[1].(type) {
+	case []interface{}:
+		entries = value
+		if len(fields) > 2 {
+			option, _ = fields[2].(map[string]interface{})
+		}
+	case string, []byte:
+		if len(fields) > 2 {
+			option, _ = fields[2].(map[string]interface{})
+		}
+		var err error
+		if entries, err = f.unpackEntries([]byte(toString(value)), toString(option["compressed"])); err != nil {
+			return nil, nil, err
+		}
+	default:
+		if len(fields) < 3 {
+			return nil, nil, fmt.Errorf("message without record")
+		}
+		entries = []interface{}{[]interface{}{fields[1], fields[2]}}
+		if len(fields) > 3 {
+			option, _ = fields[3].(map[string]interface{})
+		}
+	}
+	events := make([]types.Event, 0, len(entries))
+	hits := linesReceived.With(prometheus.Labels{"source": client})
+	for _, entry := range entries {
+		pair, ok := entry.([]interface{})
+		if !ok || len(pair) < 2 {
+			return nil, nil, fmt.Errorf("entry is not a [time, record] array")
+		}
+		record, ok := pair[1].(map[string]interface{})
+		if !ok {
+			return nil, nil, fmt.Errorf("record is not a map")
+		}
+		hits.Inc()
+		line, ok := f.message(record)
+		if !ok {
+			f.logger.Debugf("skipping record of %s without message", tag)
+			continue
+		}
+		l := types.Line{}
+		l.Raw = line
+		l.Module = f.GetName()
+		l.Labels = f.config.Labels
+		l.Time = time.Now().UTC()
+		l.Src = tag
+		l.Process = true
+		f.EventSeen(&l)
+		events = append(events, types.Event{Line: l, Process: true, Type: types.LOG, ExpectMode: expectMode})
+	}
+	if option == nil {
+		option = map[string]interface{}{}
+	}
+	return events, option, nil
+}
+
+// unpackEntries decodes the entries of the PackedForward mode, a stream of [time, record] that may be gzipped
+func (f *ForwardSource) unpackEntries(packed []byte, compressed string) ([]interface{}, error) {
+	var reader io.Reader = bytes.NewReader(packed)
+	switch compressed {
+	case "", "text":
+	case "gzip":
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid gzip entries")
+		}
+		reader = io.LimitReader(gz, int64(f.config.MaxMessageLen))
+	default:
+		return nil, fmt.Errorf("unsupported compression %s", compressed)
+	}
+	decoder := newMsgpackDecoder(reader, f.config.MaxMessageLen)
+	entries := []interface{}{}
+	for {
+		entry, err := decoder.Decode()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid packed entries")
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// message returns the line of a record
+func (f *ForwardSource) message(record map[string]interface{}) (string, bool) {
+	fields := defaultMessageFields
+	if f.config.MessageField != "" {
+		fields = []string{f.config.MessageField}
+	}
+	for _, field := range fields {
+		if value, ok := record[field]; ok {
+			return toString(value), true
+		}
+	}
+	return "", false
+}
+
+func toString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case nil:
+		return ""
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,210 @@
+package fluentforwardacquisition
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha512"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/cstest"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack/v5"
+	"gopkg.in/tomb.v2"
+)
+
+func TestConfigure(t *testing.T) {
+	tests := []struct {
+		config      string
+		expectedErr string
+	}{
+		{
+			config:      `foobar: bla`,
+			expectedErr: "field foobar not found in type fluentforwardacquisition.ForwardConfiguration",
+		},
+		{
+			config:      `source: fluentforward`,
+			expectedErr: "",
+		},
+		{
+			config:      `listen_port: 424242`,
+			expectedErr: "invalid port 424242",
+		},
+		{
+			config:      `listen_addr: 10.0.0`,
+			expectedErr: "invalid listen IP 10.0.0",
+		},
+		{
+			config:      `shared_key: env://CROWDSEC_TEST_UNSET_KEY`,
+			expectedErr: "invalid shared_key",
+		},
+		{
+			config: `
+tls:
+  cert_file: server.crt`,
+			expectedErr: "tls.cert_file and tls.key_file are required",
+		},
+	}
+	subLogger := log.WithFields(log.Fields{
+		"type": "fluentforward",
+	})
+	for _, test := range tests {
+		f := ForwardSource{}
+		err := f.Configure([]byte(test.config), subLogger)
+		cstest.AssertErrorContains(t, err, test.expectedErr)
+	}
+}
+
+func encode(t *testing.T, value interface{}) []byte {
+	data, err := msgpack.Marshal(value)
+	require.NoError(t, err)
+	return data
+}
+
+func TestMsgpack(t *testing.T) {
+	at := eventTime(time.Unix(1654041600, 123))
+	values := []interface{}{
+		nil, true, false, int64(-42), uint64(1 << 40), 1.5, "", "short", string(bytes.Repeat([]byte("a"), 300)),
+		&at,
+		[]interface{}{"tag", int64(1), []interface{}{}},
+		map[string]interface{}{"log": "line", "nested": map[string]interface{}{"level": "info"}},
+	}
+	for _, value := range values {
+		decoded, err := newMsgpackDecoder(bytes.NewReader(encode(t, value)), 1024).Decode()
+		require.NoError(t, err)
+		assert.Equal(t, value, decoded)
+	}
+
+	//the compact encodings of the other implementations
+	for encoded, expected := range map[string]interface{}{
+		"\x05":                 int64(5),
+		"\xff":                 int64(-1),
+		"\xcc\xc8":             uint64(200),
+		"\xd0\x9c":             int64(-100),
+		"\xa3foo":              "foo",
+		"\xc4\x03bin":          "bin",
+		"\x92\x01\xa1a":        []interface{}{int64(1), "a"},
+		"\x81\xa1k\xc3":        map[string]interface{}{"k": true},
+		"\xca\x3f\xc0\x00\x00": 1.5,
+	} {
+		decoded, err := newMsgpackDecoder(bytes.NewReader([]byte(encoded)), 1024).Decode()
+		require.NoError(t, err)
+		assert.Equal(t, expected, decoded)
+	}
+
+	_, err := newMsgpackDecoder(bytes.NewReader(encode(t, "too long")), 4).Decode()
+	cstest.AssertErrorContains(t, err, "message is larger than max_message_len")
+	//the bound applies to each message
+	decoder := newMsgpackDecoder(bytes.NewReader(append(encode(t, "one"), encode(t, "two")...)), 4)
+	for _, expected := range []string{"one", "two"} {
+		decoded, err := decoder.Decode()
+		require.NoError(t, err)
+		assert.Equal(t, expected, decoded)
+	}
+	_, err = newMsgpackDecoder(bytes.NewReader([]byte{0xc1}), 4).Decode()
+	cstest.AssertErrorContains(t, err, "unknown code c1")
+	_, err = newMsgpackDecoder(bytes.NewReader(bytes.Repeat([]byte{0x91}, 64)), 1024).Decode()
+	cstest.AssertErrorContains(t, err, "msgpack value is nested more than 32 times")
+}
+
+func startSource(t *testing.T, config string) (*tomb.Tomb, chan types.Event) {
+	f := ForwardSource{}
+	require.NoError(t, f.Configure([]byte(config), log.WithField("type", "fluentforward")))
+	tmb := tomb.Tomb{}
+	out := make(chan types.Event)
+	require.NoError(t, f.StreamingAcquisition(out, &tmb))
+	return &tmb, out
+}
+
+func readLines(t *testing.T, out chan types.Event, n int) []string {
+	ret := []string{}
+	for len(ret) < n {
+		select {
+		case evt := <-out:
+			assert.Equal(t, "app.access", evt.Line.Src)
+			ret = append(ret, evt.Line.Raw)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout waiting for line %d", len(ret)+1)
+		}
+	}
+	return ret
+}
+
+func TestModes(t *testing.T) {
+	tmb, out := startSource(t, `
+source: fluentforward
+listen_port: 24251`)
+	conn, err := net.Dial("tcp", "127.0.0.1:24251")
+	require.NoError(t, err)
+	defer conn.Close()
+	now := int64(time.Now().Unix())
+	at := &[]eventTime{eventTime(time.Now())}[0]
+
+	//Message
+	_, _ = conn.Write(encode(t, []interface{}{"app.access", now, map[string]interface{}{"log": "message mode"}}))
+	assert.Equal(t, []string{"message mode"}, readLines(t, out, 1))
+	//Forward, with the records of fluentd
+	_, _ = conn.Write(encode(t, []interface{}{"app.access", []interface{}{
+		[]interface{}{at, map[string]interface{}{"message": "forward 1"}},
+		[]interface{}{at, map[string]interface{}{"other": "no message"}},
+		[]interface{}{at, map[string]interface{}{"message": "forward 2"}},
+	}}))
+	assert.Equal(t, []string{"forward 1", "forward 2"}, readLines(t, out, 2))
+	//PackedForward
+	packed := append(encode(t, []interface{}{at, map[string]interface{}{"log": "packed 1"}}),
+		encode(t, []interface{}{now, map[string]interface{}{"log": "packed 2"}})...)
+	_, _ = conn.Write(encode(t, []interface{}{"app.access", packed}))
+	assert.Equal(t, []string{"packed 1", "packed 2"}, readLines(t, out, 2))
+	//CompressedPackedForward, that expects an ack
+	gzipped := bytes.Buffer{}
+	gz := gzip.NewWriter(&gzipped)
+	_, _ = gz.Write(packed)
+	gz.Close()
+	_, _ = conn.Write(encode(t, []interface{}{"app.access", gzipped.Bytes(), map[string]interface{}{"compressed": "gzip", "chunk": "p8n9gmxTQVC8/nh2wlKKeQ=="}}))
+	assert.Equal(t, []string{"packed 1", "packed 2"}, readLines(t, out, 2))
+	ack, err := newMsgpackDecoder(conn, 1024).Decode()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"ack": "p8n9gmxTQVC8/nh2wlKKeQ=="}, ack)
+
+	tmb.Kill(nil)
+	require.NoError(t, tmb.Wait())
+}
+
+func TestSharedKey(t *testing.T) {
+	tmb, out := startSource(t, `
+source: fluentforward
+listen_port: 24252
+shared_key: secret
+self_hostname: crowdsec`)
+	digest := func(salt, hostname, nonce, key string) string {
+		sum := sha512.Sum512([]byte(salt + hostname + nonce + key))
+		return hex.EncodeToString(sum[:])
+	}
+	for _, key := range []string{"wrong", "secret"} {
+		conn, err := net.Dial("tcp", "127.0.0.1:24252")
+		require.NoError(t, err)
+		defer conn.Close()
+		decoder := newMsgpackDecoder(conn, 1024)
+		helo, err := decoder.Decode()
+		require.NoError(t, err)
+		require.Equal(t, "HELO", helo.([]interface{})[0])
+		nonce := helo.([]interface{})[1].(map[string]interface{})["nonce"].(string)
+		_, _ = conn.Write(encode(t, []interface{}{"PING", "web1", "salt", digest("salt", "web1", nonce, key), "", ""}))
+		pong, err := decoder.Decode()
+		require.NoError(t, err)
+		if key == "wrong" {
+			assert.Equal(t, []interface{}{"PONG", false, "shared_key mismatch", "crowdsec", digest("salt", "crowdsec", nonce, "secret")}, pong)
+			continue
+		}
+		assert.Equal(t, []interface{}{"PONG", true, "", "crowdsec", digest("salt", "crowdsec", nonce, "secret")}, pong)
+		_, _ = conn.Write(encode(t, []interface{}{"app.access", int64(0), map[string]interface{}{"log": "authenticated"}}))
+		assert.Equal(t, []string{"authenticated"}, readLines(t, out, 1))
+	}
+	tmb.Kill(nil)
+	require.NoError(t, tmb.Wait())
+}
@@ -0,0 +1,162 @@
+package fluentforwardacquisition
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/vmihailenco/msgpack/v5/msgpcode"
+)
+
+// The messages are decoded by vmihailenco/msgpack into generic values : nil, bool, int64, uint64, float64, string
+// (for str and bin), []interface{}, map[string]interface{} or *eventTime. The arrays and maps are walked here, as the
+// library does not bound their depth
+
+const maxDepth = 32
+
+// eventTime is the EventTime extension (type 0) of the forward protocol, a time with nanoseconds
+type eventTime time.Time
+
+func init() {
+	msgpack.RegisterExt(0, (*eventTime)(nil))
+}
+
+func (t *eventTime) MarshalMsgpack() ([]byte, error) {
+	ret := make([]byte, 8)
+	binary.BigEndian.PutUint32(ret[:4], uint32(time.Time(*t).Unix()))
+	binary.BigEndian.PutUint32(ret[4:], uint32(time.Time(*t).Nanosecond()))
+	return ret, nil
+}
+
+func (t *eventTime) UnmarshalMsgpack(data []byte) error {
+	if len(data) != 8 {
+		return fmt.Errorf("invalid EventTime of %d bytes", len(data))
+	}
+	sec, nsec := binary.BigEndian.Uint32(data[:4]), binary.BigEndian.Uint32(data[4:])
+	*t = eventTime(time.Unix(int64(sec), int64(nsec)))
+	return nil
+}
+
+// limitedReader bounds the bytes read for a message. It is a io.ByteScanner, so that the decoder uses its buffer
+// instead of adding its own
+type limitedReader struct {
+	reader    *bufio.Reader
+	remaining int
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		return 0, fmt.Errorf("message is larger than max_message_len")
+	}
+	if len(p) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.reader.Read(p)
+	r.remaining -= n
+	return n, err
+}
+
+func (r *limitedReader) ReadByte() (byte, error) {
+	if r.remaining <= 0 {
+		return 0, fmt.Errorf("message is larger than max_message_len")
+	}
+	b, err := r.reader.ReadByte()
+	if err == nil {
+		r.remaining--
+	}
+	return b, err
+}
+
+func (r *limitedReader) UnreadByte() error {
+	err := r.reader.UnreadByte()
+	if err == nil {
+		r.remaining++
+	}
+	return err
+}
+
+type msgpackDecoder struct {
+	reader  *limitedReader
+	decoder *msgpack.Decoder
+	maxLen  int
+}
+
+func newMsgpackDecoder(reader io.Reader, maxLen int) *msgpackDecoder {
+	limited := &limitedReader{reader: bufio.NewReader(reader)}
+	decoder := msgpack.NewDecoder(limited)
+	decoder.UseLooseInterfaceDecoding(true)
+	return &msgpackDecoder{reader: limited, decoder: decoder, maxLen: maxLen}
+}
+
+// Decode reads the next message, of max_message_len bytes at most
+func (d *msgpackDecoder) Decode() (interface{}, error) {
+	d.reader.remaining = d.maxLen
+	return d.decode(0)
+}
+
+func (d *msgpackDecoder) decode(depth int) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, fmt.Errorf("msgpack value is nested more than %d times", maxDepth)
+	}
+	code, err := d.decoder.PeekCode()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case msgpcode.IsFixedArray(code) || code == msgpcode.Array16 || code == msgpcode.Array32:
+		n, err := d.decoder.DecodeArrayLen()
+		if err != nil {
+			return nil, err
+		}
+		//the length is not trusted for the allocation, a value takes a byte at least
+		ret := make([]interface{}, 0, minInt(n, d.reader.remaining))
+		for i := 0; i < n; i++ {
+			value, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, value)
+		}
+		return ret, nil
+	case msgpcode.IsFixedMap(code) || code == msgpcode.Map16 || code == msgpcode.Map32:
+		n, err := d.decoder.DecodeMapLen()
+		if err != nil {
+			return nil, err
+		}
+		ret := make(map[string]interface{}, minInt(n, d.reader.remaining/2))
+		for i := 0; i < n; i++ {
+			key, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			value, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			ret[toString(key)] = value
+		}
+		return ret, nil
+	}
+	return d.decoder.DecodeInterfaceLoose()
+}
+
+// writeMsgpack sends an answer of the server in a single write
+func writeMsgpack(conn net.Conn, value interface{}) error {
+	data, err := msgpack.Marshal(value)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(data)
+	return err
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
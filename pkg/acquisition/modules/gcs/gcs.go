@@ -0,0 +1,614 @@
+package gcsacquisition
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/cursors"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/retry"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/secrets"
+	leaky "github.com/crowdsecurity/crowdsec/pkg/leakybucket"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/tomb.v2"
+	"gopkg.in/yaml.v2"
+)
+
+var linesRead = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cs_gcssource_hits_total",
+		Help: "Total lines that were read from Google Cloud Storage objects.",
+	},
+	[]string{"bucket"})
+
+var (
+	defaultPollInterval = time.Minute
+	defaultTimeout      = 30 * time.Second
+)
+
+const (
+	defaultEndpoint = "https://storage.googleapis.com"
+	//the audience of the self-signed tokens of the service accounts
+	storageAudience = "https://storage.googleapis.com/"
+)
+
+type GCSConfiguration struct {
+	configuration.DataSourceCommonCfg `yaml:",inline"`
+	Bucket                            string         `yaml:"bucket"`
+	Prefix                            string         `yaml:"prefix"`
+	Project                           string         `yaml:"project"`          //of the subscription, the one of credentials_file by default
+	Subscription                      string         `yaml:"subscription"`     //of the Pub/Sub notifications of the bucket, instead of polling it
+	CredentialsFile                   string         `yaml:"credentials_file"` //json key of a service account. Without it, the service account of the instance is used
+	Endpoint                          string         `yaml:"endpoint"`         //STORAGE_EMULATOR_HOST is used if set
+	PollInterval                      *time.Duration `yaml:"poll_interval"`
+	Timeout                           *time.Duration `yaml:"timeout"`
+	Since                             string         `yaml:"since"` //RFC3339 date, or duration before now (eg. 1h). Objects updated before are skipped
+	Until                             string         `yaml:"until"` //cat mode only
+}
+
+// GCSSource reads the objects of a bucket, eg. the logs exported by a Cloud Logging sink. In tail mode, the bucket is
+// polled, or the objects are read when their Pub/Sub notifications are received. Objects can't be appended to, so
+// each one is read entirely, and its generation is saved as a cursor so that it isn't read again
+type GCSSource struct {
+	configuration.HealthTracker
+	config        GCSConfiguration
+	logger        *log.Entry
+	client        *http.Client
+	retrier       *retry.Retrier
+	endpoint      string
+	tokens        *secrets.GCPTokenSource //nil for the emulator
+	notifications *notifications          //nil when the bucket is polled
+	from          time.Time
+	until         time.Time
+	generations   map[string]string //generation read, by object name
+	cursorId      string
+}
+
+// object is an object resource of the JSON API, with the fields used by the datasource
+type object struct {
+	Name       string    `json:"name"`
+	Generation string    `json:"generation"`
+	Size       string    `json:"size"`
+	Updated    time.Time `json:"updated"`
+}
+
+type listObjectsResponse struct {
+	Items         []object `json:"items"`
+	NextPageToken string   `json:"nextPageToken"`
+}
+
+func (g *GCSSource) GetMetrics() []prometheus.Collector {
+	return []prometheus.Collector{linesRead}
+}
+
+func (g *GCSSource) GetAggregMetrics() []prometheus.Collector {
+	return []prometheus.Collector{linesRead}
+}
+
+func (g *GCSSource) Configure(yamlConfig []byte, logger *log.Entry) error {
+	g.logger = logger
+	config := GCSConfiguration{}
+	if err := yaml.UnmarshalStrict(yamlConfig, &config); err != nil {
+		return errors.Wrap(err, "Cannot parse gcs datasource configuration")
+	}
+	if config.Mode == "" {
+		config.Mode = configuration.TAIL_MODE
+	}
+	return g.configure(config)
+}
+
+// emulatorURL returns the url of an emulator set in the environment, which can be given without scheme
+func emulatorURL(variable string) string {
+	host := os.Getenv(variable)
+	if host == "" || strings.Contains(host, "://") {
+		return strings.TrimSuffix(host, "/")
+	}
+	return "http://" + strings.TrimSuffix(host, "/")
+}
+
+// configure checks the configuration and sets the defaults, for Configure and ConfigureByDSN
+func (g *GCSSource) configure(config GCSConfiguration) error {
+	if config.Mode != configuration.CAT_MODE && config.Mode != configuration.TAIL_MODE {
+		return fmt.Errorf("unsupported mode %s for gcs datasource", config.Mode)
+	}
+	if config.Bucket == "" {
+		return fmt.Errorf("bucket is mandatory")
+	}
+	if config.PollInterval == nil {
+		config.PollInterval = &defaultPollInterval
+	}
+	if *config.PollInterval <= 0 {
+		return fmt.Errorf("poll_interval must be positive")
+	}
+	if config.Timeout == nil {
+		config.Timeout = &defaultTimeout
+	}
+	var err error
+	if g.from, err = configuration.ParseTime(config.Since); err != nil {
+		return errors.Wrap(err, "invalid since")
+	}
+	if g.until, err = configuration.ParseTime(config.Until); err != nil {
+		return errors.Wrap(err, "invalid until")
+	}
+	if !g.until.IsZero() && config.Mode == configuration.TAIL_MODE {
+		return fmt.Errorf("until is only supported in %s mode", configuration.CAT_MODE)
+	}
+	var key *secrets.GCPServiceAccountKey
+	if config.CredentialsFile != "" {
+		if key, err = secrets.LoadGCPServiceAccountKey(config.CredentialsFile); err != nil {
+			return err
+		}
+		if config.Project == "" {
+			config.Project = key.ProjectID
+		}
+	}
+	g.endpoint = config.Endpoint
+	if emulator := emulatorURL("STORAGE_EMULATOR_HOST"); emulator != "" && g.endpoint == "" {
+		g.logger.Infof("using the storage emulator at %s", emulator)
+		g.endpoint = emulator
+	} else {
+		g.tokens = secrets.NewGCPTokenSource(&http.Client{Timeout: *config.Timeout}, key, storageAudience)
+	}
+	if g.endpoint == "" {
+		g.endpoint = defaultEndpoint
+	}
+	g.endpoint = strings.TrimSuffix(g.endpoint, "/")
+	if !strings.HasPrefix(g.endpoint, "http://") && !strings.HasPrefix(g.endpoint, "https://") {
+		return fmt.Errorf("invalid endpoint %s : must be a http(s) url", g.endpoint)
+	}
+	g.notifications = nil
+	if config.Subscription != "" {
+		if config.Mode != configuration.TAIL_MODE {
+			return fmt.Errorf("subscription is only supported in %s mode", configuration.TAIL_MODE)
+		}
+		if g.notifications, err = newNotifications(config, key, g.logger); err != nil {
+			return err
+		}
+	}
+	//the whole download of an object can take longer than the timeout, it only bounds the wait for the responses
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = *config.Timeout
+	g.client = &http.Client{Transport: transport}
+	g.retrier, err = retry.New(config.Retry, g.logger)
+	if err != nil {
+		return err
+	}
+	g.retrier.Notify = g.notifyRetry
+	g.cursorId = "gs://" + config.Bucket
+	g.generations = map[string]string{}
+	g.config = config
+	return nil
+}
+
+// notifyRetry reports the failing requests in the health of the datasource
+func (g *GCSSource) notifyRetry(err error) {
+	if err != nil {
+		g.SetState(configuration.STATUS_RECONNECTING, err)
+	} else {
+		g.SetState(configuration.STATUS_RUNNING, nil)
+	}
+}
+
+func (g *GCSSource) ConfigureByDSN(dsn string, labels map[string]string, logger *log.Entry) error {
+	g.logger = logger
+	//format for the DSN is : gcs://bucket[/prefix]?credentials_file=...&endpoint=...&since=...&until=...
+	parsed, err := configuration.ParseDSN(dsn, "gcs")
+	if err != nil {
+		return err
+	}
+	parts := strings.SplitN(parsed.Target, "/", 2)
+	if parts[0] == "" {
+		return fmt.Errorf("gcs DSN must contain a bucket : gcs://bucket[/prefix]")
+	}
+	if err := parsed.CheckParams("credentials_file", "endpoint", "since", "until"); err != nil {
+		return err
+	}
+	if err := parsed.SetLogLevel(g.logger); err != nil {
+		return err
+	}
+	config := GCSConfiguration{}
+	config.Mode = configuration.CAT_MODE
+	config.Labels = labels
+	config.Bucket = parts[0]
+	if len(parts) == 2 {
+		config.Prefix = parts[1]
+	}
+	for key, value := range map[string]*string{
+		"credentials_file": &config.CredentialsFile,
+		"endpoint":         &config.Endpoint,
+		"since":            &config.Since,
+		"until":            &config.Until,
+	} {
+		if *value, err = parsed.Param(key); err != nil {
+			return err
+		}
+	}
+	return g.configure(config)
+}
+
+func (g *GCSSource) GetMode() string {
+	return g.config.Mode
+}
+
+func (g *GCSSource) GetName() string {
+	return "gcs"
+}
+
+func (g *GCSSource) GetUuid() string {
+	return g.config.UniqueId
+}
+
+func (g *GCSSource) CanRun() error {
+	return nil
+}
+
+func (g *GCSSource) Dump() interface{} {
+	return g
+}
+
+// newRequest returns a request on the bucket, or on one of its objects, with the credentials of the datasource
+func (g *GCSSource) newRequest(name string, params url.Values) (*http.Request, error) {
+	u := g.endpoint + "/storage/v1/b/" + url.PathEscape(g.config.Bucket) + "/o"
+	if name != "" {
+		//the slashes of the object names are escaped too
+		u += "/" + url.PathEscape(name)
+	}
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, retry.Permanent(err)
+	}
+	if g.tokens != nil {
+		token, err := g.tokens.Token()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req, nil
+}
+
+// listObjects returns the objects of the bucket whose name starts with the prefix, in the order of their names
+func (g *GCSSource) listObjects(dying <-chan struct{}) ([]object, error) {
+	ret := []object{}
+	pageToken := ""
+	for {
+		page := listObjectsResponse{}
+		err := g.retrier.Do(dying, func() error {
+			params := url.Values{}
+			params.Set("fields", "items(name,generation,size,updated),nextPageToken")
+			if g.config.Prefix != "" {
+				params.Set("prefix", g.config.Prefix)
+			}
+			if pageToken != "" {
+				params.Set("pageToken", pageToken)
+			}
+			req, err := g.newRequest("", params)
+			if err != nil {
+				return err
+			}
+			resp, err := g.client.Do(req)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			if err := retry.CheckResponse(resp); err != nil {
+				return err
+			}
+			content, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				return errors.Wrap(err, "while reading objects list")
+			}
+			page = listObjectsResponse{}
+			if err := json.Unmarshal(content, &page); err != nil {
+				return retry.Permanent(errors.Wrap(err, "invalid objects list"))
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, page.Items...)
+		if page.NextPageToken == "" {
+			return ret, nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+// inRange tells if the object was updated between since and until
+func (g *GCSSource) inRange(obj object) bool {
+	if !g.from.IsZero() && obj.Updated.Before(g.from) {
+		return false
+	}
+	if !g.until.IsZero() && !obj.Updated.Before(g.until) {
+		return false
+	}
+	return true
+}
+
+// empty tells if the object has no content, like the placeholders of the folders created in the console
+func (obj object) empty() bool {
+	return obj.Size == "0" || strings.HasSuffix(obj.Name, "/")
+}
+
+func (g *GCSSource) send(out chan types.Event, dying <-chan struct{}, name string, raw string, expectMode int) bool {
+	l := types.Line{}
+	l.Raw = raw
+	l.Src = "gs://" + g.config.Bucket + "/" + name
+	l.Time = time.Now().UTC()
+	l.Labels = g.config.Labels
+	l.Process = true
+	l.Module = g.GetName()
+	linesRead.With(prometheus.Labels{"bucket": g.config.Bucket}).Inc()
+	g.EventSeen(&l)
+	select {
+	case out <- types.Event{Line: l, Process: true, Type: types.LOG, ExpectMode: expectMode}:
+		return true
+	case <-dying:
+		return false
+	}
+}
+
+// decompress returns the content of the gzip objects uncompressed, whether it is their Content-Encoding (which
+// isn't removed as the request accepts gzip) or just their format, eg. the .gz files uploaded as is
+func decompress(body io.Reader) (io.Reader, error) {
+	reader := bufio.NewReader(body)
+	magic, err := reader.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(magic) < 2 || magic[0] != 0x1f || magic[1] != 0x8b {
+		return reader, nil
+	}
+	return gzip.NewReader(reader)
+}
+
+// readObject sends the lines of a generation of an object. It returns false if it was not read entirely because the
+// datasource was stopped meanwhile
+func (g *GCSSource) readObject(out chan types.Event, dying <-chan struct{}, name string, generation string, expectMode int) (bool, error) {
+	//the lines sent before a failed download are skipped when it is retried
+	sent := 0
+	stopped := false
+	err := g.retrier.Do(dying, func() error {
+		params := url.Values{}
+		params.Set("alt", "media")
+		params.Set("generation", generation)
+		req, err := g.newRequest(name, params)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp, err := g.client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if err := retry.CheckResponse(resp); err != nil {
+			return err
+		}
+		body, err := decompress(resp.Body)
+		if err != nil {
+			return errors.Wrapf(err, "while reading %s", name)
+		}
+		reader := bufio.NewReader(body)
+		for line := 0; ; line++ {
+			content, err := reader.ReadString('\n')
+			if err != nil && err != io.EOF {
+				return errors.Wrapf(err, "while reading %s", name)
+			}
+			raw := strings.TrimRight(content, "\r\n")
+			if line >= sent && raw != "" {
+				if !g.send(out, dying, name, raw, expectMode) {
+					stopped = true
+					return nil
+				}
+			}
+			if line >= sent {
+				sent = line + 1
+			}
+			if err == io.EOF {
+				return nil
+			}
+		}
+	})
+	if err == retry.ErrDying || stopped {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// notFound tells if an object was deleted, or replaced by a new generation, before it was read
+func notFound(err error) bool {
+	statusErr := &retry.StatusError{}
+	return errors.As(err, &statusErr) && statusErr.Status == http.StatusNotFound
+}
+
+func (g *GCSSource) OneShotAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	g.logger.Infof("reading bucket %s", g.config.Bucket)
+	objects, err := g.listObjects(t.Dying())
+	if err == retry.ErrDying {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "while listing bucket %s", g.config.Bucket)
+	}
+	for _, obj := range objects {
+		if obj.empty() || !g.inRange(obj) {
+			continue
+		}
+		g.logger.Debugf("reading %s", obj.Name)
+		done, err := g.readObject(out, t.Dying(), obj.Name, obj.Generation, leaky.TIMEMACHINE)
+		if err != nil {
+			if notFound(err) {
+				g.logger.Warningf("object %s was deleted before it was read", obj.Name)
+				continue
+			}
+			return errors.Wrapf(err, "while reading object %s", obj.Name)
+		}
+		if !done {
+			return nil
+		}
+	}
+	t.Kill(nil)
+	return nil
+}
+
+func (g *GCSSource) saveCursor(key string, value string) {
+	if err := cursors.SaveCursor(g.GetName(), g.cursorId+"/"+key, value); err != nil {
+		g.logger.Warningf("unable to save cursor of %s : %s", key, err)
+	}
+}
+
+func (g *GCSSource) loadCursor(key string) string {
+	value, err := cursors.LoadCursor(g.GetName(), g.cursorId+"/"+key)
+	if err != nil {
+		g.logger.Warningf("unable to load cursor of %s : %s", key, err)
+	}
+	return value
+}
+
+// pollCursor is the key of the cursor of the last poll, which is not an object name
+func (g *GCSSource) pollCursor() string {
+	return "?prefix=" + g.config.Prefix
+}
+
+// generation returns the generation of an object already read, or an empty string
+func (g *GCSSource) generation(name string) string {
+	if generation, ok := g.generations[name]; ok {
+		return generation
+	}
+	return g.loadCursor(name)
+}
+
+// process reads a generation of an object, unless it was already read, and remembers it. It returns false if the
+// datasource was stopped meanwhile
+func (g *GCSSource) process(out chan types.Event, dying <-chan struct{}, name string, generation string, expectMode int) (bool, error) {
+	if g.generation(name) == generation {
+		g.generations[name] = generation
+		return true, nil
+	}
+	g.logger.Debugf("reading generation %s of %s", generation, name)
+	done, err := g.readObject(out, dying, name, generation, expectMode)
+	if err != nil && notFound(err) {
+		g.logger.Debugf("generation %s of %s was deleted before it was read", generation, name)
+		return true, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "while reading object %s", name)
+	}
+	if !done {
+		return false, nil
+	}
+	g.generations[name] = generation
+	g.saveCursor(name, generation)
+	return true, nil
+}
+
+// poll reads the new objects, and the new generations of the others. It returns false if the datasource was stopped
+// meanwhile
+func (g *GCSSource) poll(out chan types.Event, dying <-chan struct{}, expectMode int) (bool, error) {
+	start := time.Now().UTC()
+	objects, err := g.listObjects(dying)
+	if err == retry.ErrDying {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "while listing bucket %s", g.config.Bucket)
+	}
+	g.SetState(configuration.STATUS_RUNNING, nil)
+	seen := make(map[string]bool, len(objects))
+	for _, obj := range objects {
+		if obj.empty() {
+			continue
+		}
+		seen[obj.Name] = true
+		//the objects met for the first time are skipped if they were updated before since, or before the start of crowdsec
+		if g.generation(obj.Name) == "" && !g.inRange(obj) {
+			g.logger.Debugf("skipping %s, which was updated before %s", obj.Name, g.from)
+			g.generations[obj.Name] = obj.Generation
+			g.saveCursor(obj.Name, obj.Generation)
+			continue
+		}
+		ok, err := g.process(out, dying, obj.Name, obj.Generation, expectMode)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	//the deleted objects are forgotten
+	for name := range g.generations {
+		if !seen[name] {
+			delete(g.generations, name)
+		}
+	}
+	g.saveCursor(g.pollCursor(), start.Format(time.RFC3339Nano))
+	return true, nil
+}
+
+func (g *GCSSource) StreamingAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	expectMode := leaky.LIVE
+	if g.config.UseTimeMachine {
+		expectMode = leaky.TIMEMACHINE
+	}
+	if g.notifications != nil {
+		t.Go(func() error {
+			defer types.CatchPanic("crowdsec/acquis/gcs/live")
+			g.logger.Infof("reading the objects of bucket %s notified on %s", g.config.Bucket, g.notifications.subscription)
+			if err := g.receive(out, t.Dying(), expectMode); err != nil {
+				g.SetState(configuration.STATUS_ERRORED, err)
+				return err
+			}
+			g.logger.Infof("gcs datasource stopping")
+			return nil
+		})
+		return nil
+	}
+	//without since, the objects updated before the last poll of the previous run (or else before now) were already read
+	if g.from.IsZero() {
+		g.from = time.Now().UTC()
+		if value := g.loadCursor(g.pollCursor()); value != "" {
+			if last, err := time.Parse(time.RFC3339Nano, value); err == nil {
+				g.from = last
+			} else {
+				g.logger.Warningf("invalid cursor %s of the last poll : %s", value, err)
+			}
+		}
+	}
+	t.Go(func() error {
+		defer types.CatchPanic("crowdsec/acquis/gcs/live")
+		g.logger.Infof("polling bucket %s every %s", g.config.Bucket, *g.config.PollInterval)
+		ticker := time.NewTicker(*g.config.PollInterval)
+		defer ticker.Stop()
+		for {
+			ok, err := g.poll(out, t.Dying(), expectMode)
+			if err != nil {
+				g.SetState(configuration.STATUS_ERRORED, err)
+				return err
+			}
+			if !ok {
+				return nil
+			}
+			select {
+			case <-t.Dying():
+				g.logger.Infof("gcs datasource stopping")
+				return nil
+			case <-ticker.C:
+			}
+		}
+	})
+	return nil
+}
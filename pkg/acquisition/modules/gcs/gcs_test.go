@@ -0,0 +1,459 @@
+package gcsacquisition
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/cursors"
+	"github.com/crowdsecurity/crowdsec/pkg/cstest"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/tomb.v2"
+)
+
+func TestConfigure(t *testing.T) {
+	tests := []struct {
+		config      string
+		expectedErr string
+	}{
+		{
+			config:      `foobar: bla`,
+			expectedErr: "field foobar not found in type gcsacquisition.GCSConfiguration",
+		},
+		{
+			config:      `prefix: cloudaudit.googleapis.com/`,
+			expectedErr: "bucket is mandatory",
+		},
+		{
+			config: `
+source: gcs
+bucket: crowdsec-logs
+prefix: cloudaudit.googleapis.com/activity/`,
+			expectedErr: "",
+		},
+		{
+			config: `
+source: gcs
+bucket: crowdsec-logs
+subscription: projects/crowdsec/subscriptions/crowdsec-logs`,
+			expectedErr: "",
+		},
+		{
+			config: `
+bucket: crowdsec-logs
+subscription: crowdsec-logs`,
+			expectedErr: "project is mandatory when subscription is not a full path",
+		},
+		{
+			config: `
+bucket: crowdsec-logs
+subscription: projects/crowdsec/topics/crowdsec-logs`,
+			expectedErr: "invalid subscription projects/crowdsec/topics/crowdsec-logs",
+		},
+		{
+			config: `
+bucket: crowdsec-logs
+mode: cat
+subscription: projects/crowdsec/subscriptions/crowdsec-logs`,
+			expectedErr: "subscription is only supported in tail mode",
+		},
+		{
+			config: `
+bucket: crowdsec-logs
+until: 1h`,
+			expectedErr: "until is only supported in cat mode",
+		},
+		{
+			config: `
+bucket: crowdsec-logs
+poll_interval: 0s`,
+			expectedErr: "poll_interval must be positive",
+		},
+		{
+			config: `
+bucket: crowdsec-logs
+endpoint: storage.googleapis.com`,
+			expectedErr: "invalid endpoint storage.googleapis.com : must be a http(s) url",
+		},
+		{
+			config: `
+bucket: crowdsec-logs
+credentials_file: /does/not/exist.json`,
+			expectedErr: "while reading credentials_file /does/not/exist.json",
+		},
+	}
+	subLogger := log.WithField("type", "gcs")
+	for _, test := range tests {
+		g := GCSSource{}
+		err := g.Configure([]byte(test.config), subLogger)
+		cstest.AssertErrorContains(t, err, test.expectedErr)
+	}
+}
+
+func TestConfigureByDSN(t *testing.T) {
+	tests := []struct {
+		dsn         string
+		expectedErr string
+	}{
+		{
+			dsn:         "gcs://",
+			expectedErr: "gcs DSN must contain a bucket",
+		},
+		{
+			dsn:         "gcs://crowdsec-logs?foo=bar",
+			expectedErr: "unsupported key foo in gcs DSN",
+		},
+		{
+			dsn:         "gcs://crowdsec-logs/cloudaudit.googleapis.com/?since=2022-06-01T00:00:00Z&until=2022-06-02T00:00:00Z",
+			expectedErr: "",
+		},
+	}
+	for _, test := range tests {
+		g := GCSSource{}
+		err := g.ConfigureByDSN(test.dsn, map[string]string{"type": "gcp-audit"}, log.WithField("type", "gcs"))
+		cstest.AssertErrorContains(t, err, test.expectedErr)
+	}
+	g := GCSSource{}
+	require.NoError(t, g.ConfigureByDSN("gcs://crowdsec-logs/cloudaudit.googleapis.com/", nil, log.WithField("type", "gcs")))
+	assert.Equal(t, "https://storage.googleapis.com", g.endpoint)
+	assert.Equal(t, "crowdsec-logs", g.config.Bucket)
+	assert.Equal(t, "cloudaudit.googleapis.com/", g.config.Prefix)
+	assert.Equal(t, "cat", g.config.Mode)
+}
+
+type fakeObject struct {
+	content    []byte
+	generation int64
+	updated    time.Time
+	encoding   string
+}
+
+// fakeStorage is a bucket, which lists its objects by pages of two. It also gives the tokens of the metadata server
+type fakeStorage struct {
+	lock        sync.Mutex
+	objects     map[string]*fakeObject
+	generations int64
+	requests    []string
+	auth        string
+}
+
+func newFakeStorage() *fakeStorage {
+	return &fakeStorage{objects: map[string]*fakeObject{}, generations: 1000}
+}
+
+func gzipped(content string) []byte {
+	buf := bytes.Buffer{}
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte(content))
+	w.Close()
+	return buf.Bytes()
+}
+
+func (s *fakeStorage) put(name string, content []byte, encoding string, updated time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.generations++
+	s.objects[name] = &fakeObject{content: content, generation: s.generations, updated: updated, encoding: encoding}
+}
+
+func (s *fakeStorage) generation(name string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return strconv.FormatInt(s.objects[name].generation, 10)
+}
+
+func (s *fakeStorage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if r.URL.Path == "/computeMetadata/v1/instance/service-accounts/default/token" {
+		fmt.Fprint(w, `{"access_token": "ya29.token", "expires_in": 3599}`)
+		return
+	}
+	s.requests = append(s.requests, r.URL.EscapedPath()+" "+r.URL.Query().Get("generation"))
+	if r.Header.Get("Authorization") != s.auth {
+		http.Error(w, `{"error": {"code": 401}}`, http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Path == "/storage/v1/b/logs/o" {
+		names := []string{}
+		for name := range s.objects {
+			if strings.HasPrefix(name, r.URL.Query().Get("prefix")) && name > r.URL.Query().Get("pageToken") {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		page := listObjectsResponse{}
+		if len(names) > 2 {
+			names, page.NextPageToken = names[:2], names[1]
+		}
+		for _, name := range names {
+			obj := s.objects[name]
+			page.Items = append(page.Items, object{Name: name, Generation: strconv.FormatInt(obj.generation, 10), Size: strconv.Itoa(len(obj.content)), Updated: obj.updated})
+		}
+		json.NewEncoder(w).Encode(page)
+		return
+	}
+	obj, ok := s.objects[strings.TrimPrefix(r.URL.Path, "/storage/v1/b/logs/o/")]
+	if !ok || r.URL.Query().Get("alt") != "media" || r.URL.Query().Get("generation") != strconv.FormatInt(obj.generation, 10) {
+		http.Error(w, `{"error": {"code": 404}}`, http.StatusNotFound)
+		return
+	}
+	//the gzip objects are only sent compressed to the clients which accept it
+	if obj.encoding == "gzip" {
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			http.Error(w, "decompressive transcoding is not implemented", http.StatusNotImplemented)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+	}
+	w.Write(obj.content)
+}
+
+func (s *fakeStorage) history() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string{}, s.requests...)
+}
+
+func readEvents(t *testing.T, out chan types.Event, expected []string) {
+	for _, line := range expected {
+		select {
+		case evt := <-out:
+			assert.Equal(t, line, evt.Line.Raw)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout waiting for %s", line)
+		}
+	}
+}
+
+func TestOneShotAcquisition(t *testing.T) {
+	storage := newFakeStorage()
+	storage.auth = "Bearer ya29.token"
+	server := httptest.NewServer(storage)
+	defer server.Close()
+	os.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(server.URL, "http://"))
+	defer os.Unsetenv("GCE_METADATA_HOST")
+	day := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	storage.put("audit/2022/05/31/23:00:00_23:59:59_S0.json", []byte("old\n"), "", day.Add(-time.Hour))
+	storage.put("audit/2022/06/01/", []byte{}, "", day.Add(time.Minute))
+	storage.put("audit/2022/06/01/00:00:00_00:59:59_S0.json", []byte("line 1\nline 2\n"), "", day.Add(time.Hour))
+	storage.put("audit/2022/06/01/01:00:00_01:59:59_S0.json", gzipped("line 3\r\n\nline 4"), "gzip", day.Add(2*time.Hour))
+	storage.put("audit/2022/06/01/02:00:00_02:59:59_S0.json.gz", gzipped("line 5\n"), "", day.Add(3*time.Hour))
+	storage.put("audit/2022/06/02/00:00:00_00:59:59_S0.json", []byte("too recent\n"), "", day.Add(24*time.Hour))
+	storage.put("other/2022/06/01/00:00:00_00:59:59_S0.json", []byte("other\n"), "", day.Add(time.Hour))
+
+	g := GCSSource{}
+	require.NoError(t, g.Configure([]byte(`
+source: gcs
+mode: cat
+bucket: logs
+prefix: audit/
+endpoint: `+server.URL+`
+since: 2022-06-01T00:00:00Z
+until: 2022-06-02T00:00:00Z`), log.WithField("type", "gcs")))
+	out := make(chan types.Event, 10)
+	tmb := tomb.Tomb{}
+	require.NoError(t, g.OneShotAcquisition(out, &tmb))
+	close(out)
+	lines := []string{}
+	for evt := range out {
+		lines = append(lines, evt.Line.Raw)
+		assert.True(t, strings.HasPrefix(evt.Line.Src, "gs://logs/audit/2022/06/01/"))
+	}
+	assert.Equal(t, []string{"line 1", "line 2", "line 3", "line 4", "line 5"}, lines)
+	//the slashes of the object names are escaped
+	assert.Contains(t, storage.history(), "/storage/v1/b/logs/o/audit%2F2022%2F06%2F01%2F00:00:00_00:59:59_S0.json "+
+		storage.generation("audit/2022/06/01/00:00:00_00:59:59_S0.json"))
+}
+
+func TestStreamingAcquisition(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcs-cursors")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store, err := cursors.NewFileStore(filepath.Join(dir, "cursors.json"))
+	require.NoError(t, err)
+	cursors.SetStore(store)
+	defer cursors.SetStore(nil)
+
+	storage := newFakeStorage()
+	server := httptest.NewServer(storage)
+	defer server.Close()
+	os.Setenv("STORAGE_EMULATOR_HOST", strings.TrimPrefix(server.URL, "http://"))
+	defer os.Unsetenv("STORAGE_EMULATOR_HOST")
+	storage.put("old.log", []byte("old line\n"), "", time.Now().Add(-time.Hour))
+
+	config := []byte(`
+bucket: logs
+poll_interval: 50ms`)
+	g := GCSSource{}
+	require.NoError(t, g.Configure(config, log.WithField("type", "gcs")))
+	out := make(chan types.Event)
+	tmb := tomb.Tomb{}
+	require.NoError(t, g.StreamingAcquisition(out, &tmb))
+	//the objects updated before the start were already read, the new generations of the objects are read
+	storage.put("new.log", []byte("line 1\n"), "", time.Now().Add(time.Second))
+	readEvents(t, out, []string{"line 1"})
+	storage.put("new.log", []byte("line 2\n"), "", time.Now().Add(time.Second))
+	storage.put("archive.log.gz", gzipped("line 3\n"), "", time.Now().Add(time.Second))
+	readEvents(t, out, []string{"line 3", "line 2"})
+	tmb.Kill(nil)
+	require.NoError(t, tmb.Wait())
+
+	//a restart only reads the objects created meanwhile
+	storage.put("other.log", []byte("line 4\n"), "", time.Now().Add(time.Second))
+	g = GCSSource{}
+	require.NoError(t, g.Configure(config, log.WithField("type", "gcs")))
+	tmb = tomb.Tomb{}
+	require.NoError(t, g.StreamingAcquisition(out, &tmb))
+	readEvents(t, out, []string{"line 4"})
+	tmb.Kill(nil)
+	require.NoError(t, tmb.Wait())
+	downloads := 0
+	for _, request := range storage.history() {
+		if strings.HasPrefix(request, "/storage/v1/b/logs/o/new.log ") {
+			downloads++
+		}
+	}
+	assert.Equal(t, 2, downloads)
+}
+
+// fakePubSub is a subscription of the notifications of a bucket, whose messages are pulled once
+type fakePubSub struct {
+	lock     sync.Mutex
+	sent     int
+	messages []receivedMessage
+	acked    []string
+	extended []string
+}
+
+func (p *fakePubSub) notify(eventType string, bucket string, name string, generation string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	ackID := strconv.Itoa(p.sent)
+	p.sent++
+	p.messages = append(p.messages, receivedMessage{AckID: ackID, Message: pubsubMessage{
+		MessageID: "msg" + ackID,
+		Attributes: map[string]string{
+			"eventType":        eventType,
+			"bucketId":         bucket,
+			"objectId":         name,
+			"objectGeneration": generation,
+			"payloadFormat":    "JSON_API_V1",
+		},
+	}})
+}
+
+func (p *fakePubSub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	body := map[string]interface{}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ackIDs := []string{}
+	if ids, ok := body["ackIds"].([]interface{}); ok {
+		for _, id := range ids {
+			ackIDs = append(ackIDs, id.(string))
+		}
+	}
+	switch r.URL.Path {
+	case "/v1/projects/crowdsec/subscriptions/notifications:pull":
+		if len(p.messages) == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		json.NewEncoder(w).Encode(pullResponse{ReceivedMessages: p.messages})
+		p.messages = nil
+	case "/v1/projects/crowdsec/subscriptions/notifications:modifyAckDeadline":
+		if body["ackDeadlineSeconds"] != float64(ackDeadlineSeconds) {
+			http.Error(w, "unexpected deadline", http.StatusBadRequest)
+			return
+		}
+		p.extended = append(p.extended, ackIDs...)
+		fmt.Fprint(w, `{}`)
+	case "/v1/projects/crowdsec/subscriptions/notifications:acknowledge":
+		p.acked = append(p.acked, ackIDs...)
+		fmt.Fprint(w, `{}`)
+	default:
+		http.Error(w, `{"error": {"code": 404}}`, http.StatusNotFound)
+	}
+}
+
+func (p *fakePubSub) ackedIDs() []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]string{}, p.acked...)
+}
+
+func TestNotifications(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcs-cursors")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store, err := cursors.NewFileStore(filepath.Join(dir, "cursors.json"))
+	require.NoError(t, err)
+	cursors.SetStore(store)
+	defer cursors.SetStore(nil)
+
+	storage := newFakeStorage()
+	storageServer := httptest.NewServer(storage)
+	defer storageServer.Close()
+	pubsub := &fakePubSub{}
+	pubsubServer := httptest.NewServer(pubsub)
+	defer pubsubServer.Close()
+	os.Setenv("STORAGE_EMULATOR_HOST", storageServer.URL)
+	defer os.Unsetenv("STORAGE_EMULATOR_HOST")
+	os.Setenv("PUBSUB_EMULATOR_HOST", strings.TrimPrefix(pubsubServer.URL, "http://"))
+	defer os.Unsetenv("PUBSUB_EMULATOR_HOST")
+
+	storage.put("audit/a.json", []byte("line 1\n"), "", time.Now())
+	storage.put("audit/b.json.gz", gzipped("line 2\n"), "", time.Now())
+	storage.put("other/c.json", []byte("other\n"), "", time.Now())
+	pubsub.notify("OBJECT_FINALIZE", "logs", "audit/a.json", storage.generation("audit/a.json"))
+	pubsub.notify("OBJECT_DELETE", "logs", "audit/a.json", storage.generation("audit/a.json"))
+	pubsub.notify("OBJECT_FINALIZE", "other-bucket", "audit/a.json", "1")
+	pubsub.notify("OBJECT_FINALIZE", "logs", "other/c.json", storage.generation("other/c.json"))
+	//redelivered, or replaced before it was read
+	pubsub.notify("OBJECT_FINALIZE", "logs", "audit/a.json", storage.generation("audit/a.json"))
+	pubsub.notify("OBJECT_FINALIZE", "logs", "audit/b.json.gz", "1")
+	pubsub.notify("OBJECT_FINALIZE", "logs", "audit/b.json.gz", storage.generation("audit/b.json.gz"))
+
+	g := GCSSource{}
+	require.NoError(t, g.Configure([]byte(`
+bucket: logs
+prefix: audit/
+project: crowdsec
+subscription: notifications`), log.WithField("type", "gcs")))
+	out := make(chan types.Event)
+	tmb := tomb.Tomb{}
+	require.NoError(t, g.StreamingAcquisition(out, &tmb))
+	readEvents(t, out, []string{"line 1", "line 2"})
+	storage.put("audit/a.json", []byte("line 3\n"), "", time.Now())
+	pubsub.notify("OBJECT_FINALIZE", "logs", "audit/a.json", storage.generation("audit/a.json"))
+	readEvents(t, out, []string{"line 3"})
+	for i := 0; i < 100 && len(pubsub.ackedIDs()) < 8; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	tmb.Kill(nil)
+	require.NoError(t, tmb.Wait())
+	assert.Equal(t, []string{"0", "1", "2", "3", "4", "5", "6", "7"}, pubsub.ackedIDs())
+	assert.Equal(t, pubsub.ackedIDs(), pubsub.extended)
+	//the bucket is not listed
+	for _, request := range storage.history() {
+		assert.True(t, request != "/storage/v1/b/logs/o ", request)
+	}
+}
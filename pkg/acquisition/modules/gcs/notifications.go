@@ -0,0 +1,217 @@
+package gcsacquisition
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/retry"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/secrets"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// The notifications of the bucket (https://cloud.google.com/storage/docs/pubsub-notifications) are received with
+// the REST API of Pub/Sub : they are few, and only their attributes are used
+
+const (
+	defaultPubSubEndpoint = "https://pubsub.googleapis.com"
+	pubsubAudience        = "https://pubsub.googleapis.com/"
+	//a pull waits for messages, it is cancelled after this long and a new one is sent
+	pullWait        = 2 * time.Minute
+	pullMaxMessages = 100
+	//the deadline of the messages pulled, long enough to read their objects
+	ackDeadlineSeconds = 600
+)
+
+type notifications struct {
+	subscription string //projects/<project>/subscriptions/<name>
+	endpoint     string
+	tokens       *secrets.GCPTokenSource //nil for the emulator
+	client       *http.Client
+}
+
+type pubsubMessage struct {
+	Attributes map[string]string `json:"attributes"`
+	MessageID  string            `json:"messageId"`
+}
+
+type receivedMessage struct {
+	AckID   string        `json:"ackId"`
+	Message pubsubMessage `json:"message"`
+}
+
+type pullResponse struct {
+	ReceivedMessages []receivedMessage `json:"receivedMessages"`
+}
+
+func newNotifications(config GCSConfiguration, key *secrets.GCPServiceAccountKey, logger *log.Entry) (*notifications, error) {
+	n := &notifications{subscription: config.Subscription, client: &http.Client{Timeout: pullWait + *config.Timeout}}
+	if !strings.HasPrefix(n.subscription, "projects/") {
+		if config.Project == "" {
+			return nil, fmt.Errorf("project is mandatory when subscription is not a full path (projects/<project>/subscriptions/<name>)")
+		}
+		n.subscription = "projects/" + config.Project + "/subscriptions/" + config.Subscription
+	}
+	parts := strings.Split(n.subscription, "/")
+	if len(parts) != 4 || parts[1] == "" || parts[2] != "subscriptions" || parts[3] == "" {
+		return nil, fmt.Errorf("invalid subscription %s", n.subscription)
+	}
+	if emulator := emulatorURL("PUBSUB_EMULATOR_HOST"); emulator != "" {
+		logger.Infof("using the pubsub emulator at %s", emulator)
+		n.endpoint = emulator
+	} else {
+		n.endpoint = defaultPubSubEndpoint
+		n.tokens = secrets.NewGCPTokenSource(&http.Client{Timeout: *config.Timeout}, key, pubsubAudience)
+	}
+	return n, nil
+}
+
+// call sends a request on the subscription, eg. pull, and decodes its response in ret if it's not nil
+func (n *notifications) call(ctx context.Context, method string, body interface{}, ret interface{}) error {
+	content, err := json.Marshal(body)
+	if err != nil {
+		return retry.Permanent(err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.endpoint+"/v1/"+n.subscription+":"+method, bytes.NewReader(content))
+	if err != nil {
+		return retry.Permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.tokens != nil {
+		token, err := n.tokens.Token()
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := retry.CheckResponse(resp); err != nil {
+		return err
+	}
+	if ret == nil {
+		return nil
+	}
+	if content, err = ioutil.ReadAll(resp.Body); err != nil {
+		return errors.Wrapf(err, "while reading %s response", method)
+	}
+	if err := json.Unmarshal(content, ret); err != nil {
+		return retry.Permanent(errors.Wrapf(err, "invalid %s response", method))
+	}
+	return nil
+}
+
+// pull waits for the next notifications, it returns none if there were none for pullWait
+func (g *GCSSource) pull(ctx context.Context, dying <-chan struct{}) ([]receivedMessage, error) {
+	ret := pullResponse{}
+	err := g.retrier.Do(dying, func() error {
+		pullCtx, cancel := context.WithTimeout(ctx, pullWait)
+		defer cancel()
+		ret = pullResponse{}
+		err := g.notifications.call(pullCtx, "pull", map[string]interface{}{"maxMessages": pullMaxMessages}, &ret)
+		switch {
+		case err == nil:
+			return nil
+		case ctx.Err() != nil:
+			return retry.Permanent(retry.ErrDying)
+		case pullCtx.Err() != nil:
+			ret = pullResponse{}
+			return nil
+		}
+		return err
+	})
+	return ret.ReceivedMessages, err
+}
+
+// acknowledge acks the messages, or changes their deadline. It is tried once more if the datasource is stopping
+func (g *GCSSource) acknowledge(dying <-chan struct{}, method string, ackIDs []string, deadline int) error {
+	if len(ackIDs) == 0 {
+		return nil
+	}
+	body := map[string]interface{}{"ackIds": ackIDs}
+	if method == "modifyAckDeadline" {
+		body["ackDeadlineSeconds"] = deadline
+	}
+	return g.retrier.Do(dying, func() error {
+		return g.notifications.call(context.Background(), method, body, nil)
+	})
+}
+
+// handle reads the object of a notification. It returns false if the datasource was stopped meanwhile
+func (g *GCSSource) handle(out chan types.Event, dying <-chan struct{}, msg pubsubMessage, expectMode int) (bool, error) {
+	attributes := msg.Attributes
+	name := attributes["objectId"]
+	switch {
+	case attributes["eventType"] != "OBJECT_FINALIZE":
+		//the deletions and metadata updates are ignored
+		return true, nil
+	case attributes["bucketId"] != g.config.Bucket:
+		g.logger.Warningf("ignoring notification %s of bucket %s", msg.MessageID, attributes["bucketId"])
+		return true, nil
+	case !strings.HasPrefix(name, g.config.Prefix) || strings.HasSuffix(name, "/"):
+		return true, nil
+	case attributes["objectGeneration"] == "":
+		g.logger.Warningf("ignoring notification %s of %s without objectGeneration", msg.MessageID, name)
+		return true, nil
+	}
+	return g.process(out, dying, name, attributes["objectGeneration"], expectMode)
+}
+
+// receive reads the objects of the notifications until the datasource is stopped. The messages are acked once their
+// objects are read : if crowdsec stops meanwhile, they are received again, and the objects already read are skipped
+func (g *GCSSource) receive(out chan types.Event, dying <-chan struct{}, expectMode int) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-dying:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	for {
+		messages, err := g.pull(ctx, dying)
+		if err == retry.ErrDying {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(err, "while pulling notifications from %s", g.notifications.subscription)
+		}
+		g.SetState(configuration.STATUS_RUNNING, nil)
+		ackIDs := make([]string, 0, len(messages))
+		for _, msg := range messages {
+			ackIDs = append(ackIDs, msg.AckID)
+		}
+		if err := g.acknowledge(dying, "modifyAckDeadline", ackIDs, ackDeadlineSeconds); err != nil && err != retry.ErrDying {
+			g.logger.Warningf("unable to extend the deadline of the notifications : %s", err)
+		}
+		done := 0
+		for _, msg := range messages {
+			ok, err := g.handle(out, dying, msg.Message, expectMode)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				break
+			}
+			done++
+		}
+		if err := g.acknowledge(dying, "acknowledge", ackIDs[:done], 0); err != nil && err != retry.ErrDying {
+			return errors.Wrapf(err, "while acknowledging notifications on %s", g.notifications.subscription)
+		}
+		if done < len(messages) {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,420 @@
+package gelfacquisition
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	leaky "github.com/crowdsecurity/crowdsec/pkg/leakybucket"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/tomb.v2"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	GELF_PROTO_UDP = "udp"
+	GELF_PROTO_TCP = "tcp"
+	GELF_PROTO_TLS = "tls"
+
+	GELF_CLIENT_AUTH_NONE     = "none"
+	GELF_CLIENT_AUTH_OPTIONAL = "optional"
+	GELF_CLIENT_AUTH_REQUIRED = "required"
+
+	GELF_MESSAGE_SHORT = "short_message"
+	GELF_MESSAGE_FULL  = "full_message"
+
+	//the GELF fields are added to the event metadata with this prefix
+	metaPrefix = "gelf_"
+)
+
+type GelfTLSConfiguration struct {
+	CertFile   string `yaml:"cert_file"`
+	KeyFile    string `yaml:"key_file"`
+	CAFile     string `yaml:"ca_file"`
+	ClientAuth string `yaml:"client_auth"`
+}
+
+type GelfConfiguration struct {
+	Proto                             string                `yaml:"protocol,omitempty"`
+	Port                              int                   `yaml:"listen_port,omitempty"`
+	Addr                              string                `yaml:"listen_addr,omitempty"`
+	MaxMessageLen                     int                   `yaml:"max_message_len,omitempty"` //once reassembled and decompressed
+	MessageField                      string                `yaml:"message_field,omitempty"`   //short_message, or full_message when the client sends it
+	TLS                               *GelfTLSConfiguration `yaml:"tls,omitempty"`
+	configuration.DataSourceCommonCfg `yaml:",inline"`
+}
+
+type GelfSource struct {
+	configuration.HealthTracker
+	config    GelfConfiguration
+	logger    *log.Entry
+	tlsConfig *tls.Config
+	udpConn   *net.UDPConn
+	listener  net.Listener
+}
+
+var linesReceived = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cs_gelfsource_hits_total",
+		Help: "Total GELF messages that were received.",
+	},
+	[]string{"source"})
+
+var linesInvalid = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cs_gelfsource_invalid_total",
+		Help: "Total GELF messages that were dropped because they were invalid.",
+	},
+	[]string{"source"})
+
+func (g *GelfSource) GetName() string {
+	return "gelf"
+}
+
+func (g *GelfSource) GetUuid() string {
+	return g.config.UniqueId
+}
+
+func (g *GelfSource) GetMode() string {
+	return g.config.Mode
+}
+
+func (g *GelfSource) Dump() interface{} {
+	return g
+}
+
+func (g *GelfSource) CanRun() error {
+	return nil
+}
+
+func (g *GelfSource) GetMetrics() []prometheus.Collector {
+	return []prometheus.Collector{linesReceived, linesInvalid}
+}
+
+func (g *GelfSource) GetAggregMetrics() []prometheus.Collector {
+	return []prometheus.Collector{linesReceived, linesInvalid}
+}
+
+func (g *GelfSource) ConfigureByDSN(dsn string, labels map[string]string, logger *log.Entry) error {
+	return fmt.Errorf("gelf datasource does not support one shot acquisition")
+}
+
+func (g *GelfSource) OneShotAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	return fmt.Errorf("gelf datasource does not support one shot acquisition")
+}
+
+func (g *GelfSource) Configure(yamlConfig []byte, logger *log.Entry) error {
+	g.logger = logger
+	gelfConfig := GelfConfiguration{}
+	gelfConfig.Mode = configuration.TAIL_MODE
+	if err := yaml.UnmarshalStrict(yamlConfig, &gelfConfig); err != nil {
+		return errors.Wrap(err, "Cannot parse gelf configuration")
+	}
+	if gelfConfig.Addr == "" {
+		gelfConfig.Addr = "127.0.0.1"
+	}
+	if gelfConfig.Proto == "" {
+		gelfConfig.Proto = GELF_PROTO_UDP
+	}
+	if gelfConfig.Port == 0 {
+		gelfConfig.Port = 12201
+	}
+	if gelfConfig.MaxMessageLen == 0 {
+		gelfConfig.MaxMessageLen = 1024 * 1024
+	}
+	if gelfConfig.MessageField == "" {
+		gelfConfig.MessageField = GELF_MESSAGE_SHORT
+	}
+	if gelfConfig.Port <= 0 || gelfConfig.Port > 65535 {
+		return fmt.Errorf("invalid port %d", gelfConfig.Port)
+	}
+	if net.ParseIP(gelfConfig.Addr) == nil {
+		return fmt.Errorf("invalid listen IP %s", gelfConfig.Addr)
+	}
+	if gelfConfig.MaxMessageLen < 0 {
+		return fmt.Errorf("invalid max_message_len %d", gelfConfig.MaxMessageLen)
+	}
+	if gelfConfig.MessageField != GELF_MESSAGE_SHORT && gelfConfig.MessageField != GELF_MESSAGE_FULL {
+		return fmt.Errorf("invalid message_field %s (must be %s or %s)", gelfConfig.MessageField, GELF_MESSAGE_SHORT, GELF_MESSAGE_FULL)
+	}
+	switch gelfConfig.Proto {
+	case GELF_PROTO_UDP, GELF_PROTO_TCP:
+		if gelfConfig.TLS != nil {
+			return fmt.Errorf("tls configuration requires protocol: %s", GELF_PROTO_TLS)
+		}
+	case GELF_PROTO_TLS:
+		if err := g.configureTLS(gelfConfig.TLS); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid protocol %s (must be %s, %s or %s)", gelfConfig.Proto, GELF_PROTO_UDP, GELF_PROTO_TCP, GELF_PROTO_TLS)
+	}
+	g.config = gelfConfig
+	return nil
+}
+
+func (g *GelfSource) configureTLS(config *GelfTLSConfiguration) error {
+	if config == nil || config.CertFile == "" || config.KeyFile == "" {
+		return fmt.Errorf("tls.cert_file and tls.key_file are required with protocol: %s", GELF_PROTO_TLS)
+	}
+	cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return errors.Wrap(err, "could not load server certificate")
+	}
+	g.tlsConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if config.ClientAuth == "" {
+		config.ClientAuth = GELF_CLIENT_AUTH_NONE
+		if config.CAFile != "" {
+			config.ClientAuth = GELF_CLIENT_AUTH_REQUIRED
+		}
+	}
+	switch config.ClientAuth {
+	case GELF_CLIENT_AUTH_NONE:
+		g.tlsConfig.ClientAuth = tls.NoClientCert
+	case GELF_CLIENT_AUTH_OPTIONAL:
+		g.tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case GELF_CLIENT_AUTH_REQUIRED:
+		g.tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return fmt.Errorf("invalid tls.client_auth %s (must be %s, %s or %s)", config.ClientAuth,
+			GELF_CLIENT_AUTH_NONE, GELF_CLIENT_AUTH_OPTIONAL, GELF_CLIENT_AUTH_REQUIRED)
+	}
+	if g.tlsConfig.ClientAuth != tls.NoClientCert {
+		if config.CAFile == "" {
+			return fmt.Errorf("tls.ca_file is required to verify client certificates")
+		}
+		caCert, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return errors.Wrap(err, "could not read CA file")
+		}
+		caPool := x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(caCert) {
+			return fmt.Errorf("no certificate found in %s", config.CAFile)
+		}
+		g.tlsConfig.ClientCAs = caPool
+	}
+	return nil
+}
+
+func (g *GelfSource) StreamingAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	addr := net.JoinHostPort(g.config.Addr, strconv.Itoa(g.config.Port))
+	expectMode := leaky.LIVE
+	if g.config.UseTimeMachine {
+		expectMode = leaky.TIMEMACHINE
+	}
+	if g.config.Proto == GELF_PROTO_UDP {
+		udpAddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return errors.Wrapf(err, "could not resolve addr %s", addr)
+		}
+		if g.udpConn, err = net.ListenUDP("udp", udpAddr); err != nil {
+			return errors.Wrapf(err, "could not listen on %s", addr)
+		}
+		g.logger.Infof("listening for GELF messages on %s (udp)", g.udpConn.LocalAddr())
+		t.Go(func() error {
+			defer types.CatchPanic("crowdsec/acquis/gelf/live")
+			return g.serveUDP(out, t, expectMode)
+		})
+		return nil
+	}
+	var err error
+	if g.config.Proto == GELF_PROTO_TLS {
+		g.listener, err = tls.Listen("tcp", addr, g.tlsConfig)
+	} else {
+		g.listener, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "could not listen on %s", addr)
+	}
+	g.logger.Infof("listening for GELF messages on %s (%s)", g.listener.Addr(), g.config.Proto)
+	t.Go(func() error {
+		defer types.CatchPanic("crowdsec/acquis/gelf/live")
+		return g.serveTCP(out, t, expectMode)
+	})
+	return nil
+}
+
+// serveUDP reads the datagrams, that hold a message or a chunk of a message
+func (g *GelfSource) serveUDP(out chan types.Event, t *tomb.Tomb, expectMode int) error {
+	t.Go(func() error {
+		<-t.Dying()
+		g.logger.Info("gelf datasource is dying")
+		return g.udpConn.Close()
+	})
+	assembler := newChunkAssembler(g.config.MaxMessageLen)
+	//chunks are at most 8192 bytes, but some clients send larger unchunked datagrams
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := g.udpConn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-t.Dying():
+				return nil
+			default:
+			}
+			err = errors.Wrap(err, "error while reading from socket")
+			g.SetState(configuration.STATUS_ERRORED, err)
+			return err
+		}
+		client := addr.IP.String()
+		payload := buf[:n]
+		if isChunk(payload) {
+			payload, err = assembler.add(payload, time.Now())
+			if err != nil {
+				g.logger.WithField("client", client).Debugf("dropping chunk : %s", err)
+				linesInvalid.With(prometheus.Labels{"source": client}).Inc()
+				continue
+			}
+			if payload == nil {
+				continue
+			}
+		}
+		if !g.handleMessage(payload, client, out, t, expectMode) {
+			return nil
+		}
+	}
+}
+
+// serveTCP accepts the connections, on which the messages are uncompressed and separated by null bytes
+func (g *GelfSource) serveTCP(out chan types.Event, t *tomb.Tomb, expectMode int) error {
+	t.Go(func() error {
+		<-t.Dying()
+		g.logger.Info("gelf datasource is dying")
+		return g.listener.Close()
+	})
+	for {
+		conn, err := g.listener.Accept()
+		if err != nil {
+			select {
+			case <-t.Dying():
+				return nil
+			default:
+			}
+			err = errors.Wrap(err, "error while accepting connection")
+			g.SetState(configuration.STATUS_ERRORED, err)
+			return err
+		}
+		t.Go(func() error {
+			g.handleConn(conn, out, t, expectMode)
+			return nil
+		})
+	}
+}
+
+func (g *GelfSource) handleConn(conn net.Conn, out chan types.Event, t *tomb.Tomb, expectMode int) {
+	done := make(chan struct{})
+	defer close(done)
+	//unblock the reads when the datasource stops
+	go func() {
+		select {
+		case <-t.Dying():
+		case <-done:
+		}
+		conn.Close()
+	}()
+	client, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		client = conn.RemoteAddr().String()
+	}
+	logger := g.logger.WithField("client", client)
+	logger.Debugf("new connection")
+	reader := bufio.NewReader(conn)
+	for {
+		msg, err := readFrame(reader, g.config.MaxMessageLen)
+		if err != nil {
+			if err != io.EOF {
+				logger.Debugf("closing connection : %s", err)
+			}
+			return
+		}
+		if len(msg) == 0 {
+			continue
+		}
+		if !g.handleMessage(msg, client, out, t, expectMode) {
+			return
+		}
+	}
+}
+
+// readFrame reads a message terminated by a null byte. The messages larger than maxLen are an error, as they can't
+// be parsed once truncated
+func readFrame(reader *bufio.Reader, maxLen int) ([]byte, error) {
+	msg := []byte{}
+	for {
+		chunk, err := reader.ReadSlice(0)
+		if err == bufio.ErrBufferFull {
+			msg = append(msg, chunk...)
+			if len(msg) > maxLen {
+				return nil, fmt.Errorf("message is larger than %d bytes", maxLen)
+			}
+			continue
+		}
+		if err != nil && (err != io.EOF || len(msg)+len(chunk) == 0) {
+			return nil, err
+		}
+		msg = append(msg, bytes.TrimSuffix(chunk, []byte{0})...)
+		msg = bytes.TrimSpace(msg)
+		if len(msg) > maxLen {
+			return nil, fmt.Errorf("message is larger than %d bytes", maxLen)
+		}
+		return msg, nil
+	}
+}
+
+// handleMessage sends the event of a GELF payload, and returns false when the datasource is stopping
+func (g *GelfSource) handleMessage(payload []byte, client string, out chan types.Event, t *tomb.Tomb, expectMode int) bool {
+	logger := g.logger.WithField("client", client)
+	linesReceived.With(prometheus.Labels{"source": client}).Inc()
+	decompressed, err := decompress(payload, g.config.MaxMessageLen)
+	if err != nil {
+		logger.Debugf("dropping message : %s", err)
+		linesInvalid.With(prometheus.Labels{"source": client}).Inc()
+		return true
+	}
+	msg, err := parseMessage(decompressed)
+	if err != nil {
+		logger.Debugf("dropping message : %s", err)
+		linesInvalid.With(prometheus.Labels{"source": client}).Inc()
+		return true
+	}
+	select {
+	case out <- g.newEvent(msg, client, expectMode):
+	case <-t.Dying():
+		return false
+	}
+	return true
+}
+
+func (g *GelfSource) newEvent(msg *gelfMessage, client string, expectMode int) types.Event {
+	l := types.Line{}
+	l.Raw = msg.ShortMessage
+	if g.config.MessageField == GELF_MESSAGE_FULL && msg.FullMessage != "" {
+		l.Raw = msg.FullMessage
+	}
+	l.Module = g.GetName()
+	l.Labels = g.config.Labels
+	l.Time = time.Now().UTC()
+	l.Src = client
+	l.Process = true
+	meta := make(map[string]string, len(msg.Fields)+1)
+	meta[metaPrefix+"host"] = msg.Host
+	for key, value := range msg.Fields {
+		meta[metaPrefix+key] = value
+	}
+	g.EventSeen(&l)
+	return types.Event{Line: l, Process: true, Type: types.LOG, ExpectMode: expectMode, Meta: meta}
+}
@@ -0,0 +1,239 @@
+package gelfacquisition
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/cstest"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/tomb.v2"
+)
+
+func TestConfigure(t *testing.T) {
+	tests := []struct {
+		config      string
+		expectedErr string
+	}{
+		{
+			config:      `foobar: bla`,
+			expectedErr: "field foobar not found in type gelfacquisition.GelfConfiguration",
+		},
+		{
+			config:      `source: gelf`,
+			expectedErr: "",
+		},
+		{
+			config:      `listen_port: 424242`,
+			expectedErr: "invalid port 424242",
+		},
+		{
+			config:      `listen_addr: 10.0.0`,
+			expectedErr: "invalid listen IP 10.0.0",
+		},
+		{
+			config:      `protocol: http`,
+			expectedErr: "invalid protocol http (must be udp, tcp or tls)",
+		},
+		{
+			config:      `message_field: _raw`,
+			expectedErr: "invalid message_field _raw (must be short_message or full_message)",
+		},
+		{
+			config: `
+protocol: tcp
+tls:
+  cert_file: server.crt`,
+			expectedErr: "tls configuration requires protocol: tls",
+		},
+		{
+			config:      `protocol: tls`,
+			expectedErr: "tls.cert_file and tls.key_file are required with protocol: tls",
+		},
+	}
+	subLogger := log.WithFields(log.Fields{
+		"type": "gelf",
+	})
+	for _, test := range tests {
+		g := GelfSource{}
+		err := g.Configure([]byte(test.config), subLogger)
+		cstest.AssertErrorContains(t, err, test.expectedErr)
+	}
+}
+
+func TestParseMessage(t *testing.T) {
+	msg, err := parseMessage([]byte(`{"version": "1.1", "host": "web1", "short_message": "GET / 200", "full_message": "GET / 200\nbacktrace",
+		"timestamp": 1654041600.123, "level": 6, "_container_name": "nginx", "_id": "ignored", "_tags": ["a"], "_null": null}`))
+	require.NoError(t, err)
+	assert.Equal(t, "web1", msg.Host)
+	assert.Equal(t, "GET / 200", msg.ShortMessage)
+	assert.Equal(t, "GET / 200\nbacktrace", msg.FullMessage)
+	assert.Equal(t, map[string]string{
+		"timestamp":      "1654041600.123",
+		"level":          "6",
+		"container_name": "nginx",
+		"tags":           `["a"]`,
+	}, msg.Fields)
+
+	for payload, expectedErr := range map[string]string{
+		`{"host": "web1"`:              "invalid json payload",
+		`{"short_message": "foo"}`:     "missing host field",
+		`{"host": "web1", "level": 3}`: "missing short_message field",
+	} {
+		_, err := parseMessage([]byte(payload))
+		cstest.AssertErrorContains(t, err, expectedErr)
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	payload := []byte(`{"host": "web1", "short_message": "compressed"}`)
+	gzipped := bytes.Buffer{}
+	gz := gzip.NewWriter(&gzipped)
+	_, _ = gz.Write(payload)
+	gz.Close()
+	zlibbed := bytes.Buffer{}
+	zl := zlib.NewWriter(&zlibbed)
+	_, _ = zl.Write(payload)
+	zl.Close()
+
+	for _, compressed := range [][]byte{payload, gzipped.Bytes(), zlibbed.Bytes()} {
+		ret, err := decompress(compressed, 1024)
+		require.NoError(t, err)
+		assert.Equal(t, payload, ret)
+	}
+	_, err := decompress(gzipped.Bytes(), 10)
+	cstest.AssertErrorContains(t, err, "message is larger than 10 bytes once decompressed")
+	_, err = decompress(payload, 10)
+	cstest.AssertErrorContains(t, err, "message is larger than 10 bytes")
+}
+
+// chunk builds the datagram of a chunk of the message id
+func chunk(id uint64, seq int, count int, data string) []byte {
+	header := make([]byte, chunkHeaderLen)
+	copy(header, chunkMagic)
+	binary.BigEndian.PutUint64(header[2:10], id)
+	header[10], header[11] = byte(seq), byte(count)
+	return append(header, data...)
+}
+
+func TestChunkAssembler(t *testing.T) {
+	a := newChunkAssembler(1024)
+	now := time.Now()
+
+	//the chunks can arrive out of order, and be duplicated
+	ret, err := a.add(chunk(1, 2, 3, "baz"), now)
+	require.NoError(t, err)
+	assert.Nil(t, ret)
+	ret, err = a.add(chunk(1, 0, 3, "foo"), now)
+	require.NoError(t, err)
+	assert.Nil(t, ret)
+	ret, err = a.add(chunk(1, 0, 3, "foo"), now)
+	require.NoError(t, err)
+	assert.Nil(t, ret)
+	ret, err = a.add(chunk(1, 1, 3, "bar"), now)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("foobarbaz"), ret)
+	assert.Empty(t, a.pending)
+
+	//the incomplete messages expire
+	_, err = a.add(chunk(2, 0, 2, "foo"), now)
+	require.NoError(t, err)
+	ret, err = a.add(chunk(2, 1, 2, "bar"), now.Add(chunkTimeout+time.Second))
+	require.NoError(t, err)
+	assert.Nil(t, ret)
+
+	_, err = a.add(chunk(3, 3, 3, "foo"), now)
+	cstest.AssertErrorContains(t, err, "invalid chunk 3 of 3")
+	_, err = a.add(chunk(4, 0, 129, "foo"), now)
+	cstest.AssertErrorContains(t, err, "invalid chunk 0 of 129")
+	_, err = a.add(chunk(5, 0, 2, strings.Repeat("a", 1024)), now)
+	require.NoError(t, err)
+	_, err = a.add(chunk(5, 1, 2, "a"), now)
+	cstest.AssertErrorContains(t, err, "is larger than 1024 bytes")
+}
+
+func readEvents(t *testing.T, out chan types.Event, n int) []types.Event {
+	ret := []types.Event{}
+	for len(ret) < n {
+		select {
+		case evt := <-out:
+			ret = append(ret, evt)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout waiting for event %d", len(ret)+1)
+		}
+	}
+	return ret
+}
+
+func TestStreamingUDP(t *testing.T) {
+	g := GelfSource{}
+	require.NoError(t, g.Configure([]byte(`
+source: gelf
+listen_port: 12241
+labels:
+  type: nginx`), log.WithField("type", "gelf")))
+	tmb := tomb.Tomb{}
+	out := make(chan types.Event)
+	require.NoError(t, g.StreamingAcquisition(out, &tmb))
+
+	conn, err := net.Dial("udp", "127.0.0.1:12241")
+	require.NoError(t, err)
+	defer conn.Close()
+	_, _ = conn.Write([]byte(`{"version": "1.1", "host": "web1", "short_message": "plain", "level": 6, "_container_name": "nginx"}`))
+	_, _ = conn.Write([]byte(`{"host": "web1"}`))
+	gzipped := bytes.Buffer{}
+	gz := gzip.NewWriter(&gzipped)
+	_, _ = gz.Write([]byte(`{"host": "web1", "short_message": "chunked"}`))
+	gz.Close()
+	half := gzipped.Len() / 2
+	_, _ = conn.Write(chunk(42, 1, 2, gzipped.String()[half:]))
+	_, _ = conn.Write(chunk(42, 0, 2, gzipped.String()[:half]))
+
+	events := readEvents(t, out, 2)
+	assert.Equal(t, "plain", events[0].Line.Raw)
+	assert.Equal(t, "127.0.0.1", events[0].Line.Src)
+	assert.Equal(t, map[string]string{"type": "nginx"}, events[0].Line.Labels)
+	assert.Equal(t, map[string]string{"gelf_host": "web1", "gelf_level": "6", "gelf_container_name": "nginx"}, events[0].Meta)
+	assert.Equal(t, "chunked", events[1].Line.Raw)
+	tmb.Kill(nil)
+	require.NoError(t, tmb.Wait())
+}
+
+func TestStreamingTCP(t *testing.T) {
+	g := GelfSource{}
+	require.NoError(t, g.Configure([]byte(`
+source: gelf
+protocol: tcp
+listen_port: 12242
+max_message_len: 200
+message_field: full_message`), log.WithField("type", "gelf")))
+	tmb := tomb.Tomb{}
+	out := make(chan types.Event)
+	require.NoError(t, g.StreamingAcquisition(out, &tmb))
+
+	conn, err := net.Dial("tcp", "127.0.0.1:12242")
+	require.NoError(t, err)
+	defer conn.Close()
+	fmt.Fprintf(conn, "%s\x00", `{"host": "web1", "short_message": "short", "full_message": "full"}`)
+	fmt.Fprintf(conn, "%s\x00", `{"host": "web1", "short_message": "no full message"}`)
+	events := readEvents(t, out, 2)
+	assert.Equal(t, "full", events[0].Line.Raw)
+	assert.Equal(t, "no full message", events[1].Line.Raw)
+
+	//a message too large to be parsed closes the connection
+	fmt.Fprintf(conn, `{"host": "web1", "short_message": "%s"}`+"\x00", strings.Repeat("a", 200))
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+	tmb.Kill(nil)
+	require.NoError(t, tmb.Wait())
+}
@@ -0,0 +1,184 @@
+package gelfacquisition
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	chunkMagic = []byte{0x1e, 0x0f}
+	gzipMagic  = []byte{0x1f, 0x8b}
+)
+
+const (
+	chunkHeaderLen = 12 //magic, message id (8), sequence number, sequence count
+	maxChunks      = 128
+	chunkTimeout   = 5 * time.Second
+	maxPending     = 1024 //chunked messages being reassembled
+)
+
+// gelfMessage is the payload of a GELF message (https://go2docs.graylog.org/current/getting_in_log_data/gelf.html)
+type gelfMessage struct {
+	Host         string
+	ShortMessage string
+	FullMessage  string
+	Fields       map[string]string //the other fields, including the additional ones without their _ prefix
+}
+
+// decompress returns the json payload of a message, that may be compressed with gzip or zlib. Each message is
+// limited to maxLen bytes once decompressed
+func decompress(payload []byte, maxLen int) ([]byte, error) {
+	var reader io.Reader
+	var err error
+	switch {
+	case bytes.HasPrefix(payload, gzipMagic):
+		reader, err = gzip.NewReader(bytes.NewReader(payload))
+	case len(payload) >= 2 && payload[0]&0x0f == 8 && binary.BigEndian.Uint16(payload)%31 == 0:
+		//zlib header : deflate method, and a checksum of the first two bytes
+		reader, err = zlib.NewReader(bytes.NewReader(payload))
+	default:
+		if len(payload) > maxLen {
+			return nil, fmt.Errorf("message is larger than %d bytes", maxLen)
+		}
+		return payload, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ret, err := ioutil.ReadAll(io.LimitReader(reader, int64(maxLen)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(ret) > maxLen {
+		return nil, fmt.Errorf("message is larger than %d bytes once decompressed", maxLen)
+	}
+	return ret, nil
+}
+
+// parseMessage checks the mandatory fields of a GELF payload, and converts the others to strings
+func parseMessage(payload []byte) (*gelfMessage, error) {
+	fields := map[string]interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, fmt.Errorf("invalid json payload : %s", err)
+	}
+	msg := &gelfMessage{Fields: map[string]string{}}
+	for key, value := range fields {
+		var str string
+		switch v := value.(type) {
+		case string:
+			str = v
+		case json.Number:
+			str = v.String()
+		case bool:
+			str = strconv.FormatBool(v)
+		case nil:
+			continue
+		default:
+			//the spec only allows strings and numbers, keep the others as json
+			raw, _ := json.Marshal(v)
+			str = string(raw)
+		}
+		switch key {
+		case "host":
+			msg.Host = str
+		case "short_message":
+			msg.ShortMessage = str
+		case "full_message":
+			msg.FullMessage = str
+		case "version", "_id":
+		default:
+			msg.Fields[strings.TrimPrefix(key, "_")] = str
+		}
+	}
+	if msg.Host == "" {
+		return nil, fmt.Errorf("missing host field")
+	}
+	if msg.ShortMessage == "" {
+		return nil, fmt.Errorf("missing short_message field")
+	}
+	return msg, nil
+}
+
+// chunkedMessage is a message split in several UDP datagrams
+type chunkedMessage struct {
+	chunks   [][]byte
+	received int
+	size     int
+	first    time.Time
+}
+
+// chunkAssembler reassembles the chunked messages. The messages whose chunks didn't all arrive in time are dropped
+type chunkAssembler struct {
+	pending map[uint64]*chunkedMessage
+	maxLen  int
+}
+
+func newChunkAssembler(maxLen int) *chunkAssembler {
+	return &chunkAssembler{
+		pending: map[uint64]*chunkedMessage{},
+		maxLen:  maxLen,
+	}
+}
+
+func isChunk(datagram []byte) bool {
+	return bytes.HasPrefix(datagram, chunkMagic)
+}
+
+// add stores a chunk, and returns the payload of the message once all its chunks were received
+func (a *chunkAssembler) add(datagram []byte, now time.Time) ([]byte, error) {
+	a.expire(now)
+	if len(datagram) < chunkHeaderLen {
+		return nil, fmt.Errorf("chunk is too short")
+	}
+	id := binary.BigEndian.Uint64(datagram[2:10])
+	seq, count := int(datagram[10]), int(datagram[11])
+	if count == 0 || count > maxChunks || seq >= count {
+		return nil, fmt.Errorf("invalid chunk %d of %d", seq, count)
+	}
+	msg, ok := a.pending[id]
+	if !ok {
+		if len(a.pending) >= maxPending {
+			return nil, fmt.Errorf("too many chunked messages pending")
+		}
+		msg = &chunkedMessage{chunks: make([][]byte, count), first: now}
+		a.pending[id] = msg
+	}
+	if len(msg.chunks) != count {
+		delete(a.pending, id)
+		return nil, fmt.Errorf("inconsistent chunk count for message %x", id)
+	}
+	if msg.chunks[seq] != nil {
+		return nil, nil
+	}
+	msg.chunks[seq] = append([]byte{}, datagram[chunkHeaderLen:]...)
+	msg.received++
+	msg.size += len(msg.chunks[seq])
+	if msg.size > a.maxLen {
+		delete(a.pending, id)
+		return nil, fmt.Errorf("chunked message %x is larger than %d bytes", id, a.maxLen)
+	}
+	if msg.received < count {
+		return nil, nil
+	}
+	delete(a.pending, id)
+	return bytes.Join(msg.chunks, nil), nil
+}
+
+func (a *chunkAssembler) expire(now time.Time) {
+	for id, msg := range a.pending {
+		if now.Sub(msg.first) > chunkTimeout {
+			delete(a.pending, id)
+		}
+	}
+}
@@ -0,0 +1,450 @@
+package httpacquisition
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/secrets"
+	leaky "github.com/crowdsecurity/crowdsec/pkg/leakybucket"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/tomb.v2"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	defaultPort        = 8088
+	defaultPath        = "/"
+	defaultMaxBodySize = 10 * 1024 * 1024
+
+	apiKeyHeader = "X-Api-Key"
+)
+
+type HTTPTLSConfiguration struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	CAFile   string `yaml:"ca_file"` //verify the certificates of the clients authenticated by certificate with this CA
+}
+
+// HTTPClientConfiguration is a system allowed to push lines, authenticated by an api key or by the common name of
+// its client certificate
+type HTTPClientConfiguration struct {
+	Name       string            `yaml:"name"`
+	APIKey     string            `yaml:"api_key"`     //sent in the X-Api-Key header or as a bearer token, can be env://, file:// or vault:// references
+	CommonName string            `yaml:"common_name"` //of the client certificate
+	Labels     map[string]string `yaml:"labels"`      //added to the labels of the datasource, they take precedence
+}
+
+type HTTPConfiguration struct {
+	ListenAddr                        string                    `yaml:"listen_addr"`
+	ListenPort                        int                       `yaml:"listen_port"`
+	Path                              string                    `yaml:"path"`
+	MaxBodySize                       int64                     `yaml:"max_body_size"` //of a request, once decompressed
+	Clients                           []HTTPClientConfiguration `yaml:"clients"`
+	TLS                               *HTTPTLSConfiguration     `yaml:"tls"`
+	configuration.DataSourceCommonCfg `yaml:",inline"`
+}
+
+// httpClient is an authenticated client, with its api key and merged labels
+type httpClient struct {
+	name   string
+	apiKey *secrets.Secret //resolved again for the requests, nil for the clients authenticated by their certificate
+	labels map[string]string
+}
+
+func (c *httpClient) key() string {
+	return strings.TrimSpace(c.apiKey.Get())
+}
+
+// HTTPSource receives the log lines POSTed by external systems, as text, ndjson or a json array
+type HTTPSource struct {
+	configuration.HealthTracker
+	config     HTTPConfiguration
+	logger     *log.Entry
+	tlsConfig  *tls.Config
+	apiKeys    []*httpClient
+	certs      map[string]*httpClient //by common name
+	out        chan types.Event
+	dying      <-chan struct{}
+	expectMode int
+}
+
+var linesReceived = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cs_httpsource_hits_total",
+		Help: "Total lines that were pushed over http.",
+	},
+	[]string{"client"})
+
+func (h *HTTPSource) GetName() string {
+	return "http"
+}
+
+func (h *HTTPSource) GetUuid() string {
+	return h.config.UniqueId
+}
+
+func (h *HTTPSource) GetMode() string {
+	return h.config.Mode
+}
+
+func (h *HTTPSource) Dump() interface{} {
+	return h
+}
+
+func (h *HTTPSource) CanRun() error {
+	return nil
+}
+
+func (h *HTTPSource) GetMetrics() []prometheus.Collector {
+	return []prometheus.Collector{linesReceived}
+}
+
+func (h *HTTPSource) GetAggregMetrics() []prometheus.Collector {
+	return []prometheus.Collector{linesReceived}
+}
+
+func (h *HTTPSource) ConfigureByDSN(dsn string, labels map[string]string, logger *log.Entry) error {
+	return fmt.Errorf("http datasource does not support one shot acquisition")
+}
+
+func (h *HTTPSource) OneShotAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	return fmt.Errorf("http datasource does not support one shot acquisition")
+}
+
+func (h *HTTPSource) Configure(yamlConfig []byte, logger *log.Entry) error {
+	h.logger = logger
+	config := HTTPConfiguration{}
+	config.Mode = configuration.TAIL_MODE
+	if err := yaml.UnmarshalStrict(yamlConfig, &config); err != nil {
+		return errors.Wrap(err, "Cannot parse http datasource configuration")
+	}
+	if config.Mode != configuration.TAIL_MODE {
+		return fmt.Errorf("unsupported mode %s for http datasource", config.Mode)
+	}
+	if config.ListenAddr == "" {
+		config.ListenAddr = "127.0.0.1"
+	}
+	if net.ParseIP(config.ListenAddr) == nil {
+		return fmt.Errorf("invalid listen IP %s", config.ListenAddr)
+	}
+	if config.ListenPort == 0 {
+		config.ListenPort = defaultPort
+	}
+	if config.ListenPort < 0 || config.ListenPort > 65535 {
+		return fmt.Errorf("invalid port %d", config.ListenPort)
+	}
+	if config.Path == "" {
+		config.Path = defaultPath
+	}
+	if !strings.HasPrefix(config.Path, "/") {
+		return fmt.Errorf("path must start with /")
+	}
+	if config.MaxBodySize == 0 {
+		config.MaxBodySize = defaultMaxBodySize
+	}
+	if config.MaxBodySize < 0 {
+		return fmt.Errorf("invalid max_body_size %d", config.MaxBodySize)
+	}
+	if config.TLS != nil {
+		if err := h.configureTLS(config.TLS); err != nil {
+			return err
+		}
+	}
+	if err := h.configureClients(config.Clients, config.Labels); err != nil {
+		return err
+	}
+	h.config = config
+	return nil
+}
+
+func (h *HTTPSource) configureTLS(config *HTTPTLSConfiguration) error {
+	if config.CertFile == "" || config.KeyFile == "" {
+		return fmt.Errorf("tls.cert_file and tls.key_file are required")
+	}
+	cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return errors.Wrap(err, "could not load server certificate")
+	}
+	h.tlsConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if config.CAFile != "" {
+		caCert, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return errors.Wrap(err, "could not read CA file")
+		}
+		caPool := x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(caCert) {
+			return fmt.Errorf("no certificate found in %s", config.CAFile)
+		}
+		h.tlsConfig.ClientCAs = caPool
+		//the clients with an api key don't need a certificate
+		h.tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return nil
+}
+
+// configureClients checks the api keys, and merges the labels of the clients once
+func (h *HTTPSource) configureClients(clients []HTTPClientConfiguration, labels map[string]string) error {
+	if len(clients) == 0 {
+		return fmt.Errorf("at least one client is required")
+	}
+	h.apiKeys = nil
+	h.certs = make(map[string]*httpClient)
+	names := make(map[string]bool, len(clients))
+	for _, config := range clients {
+		if config.Name == "" {
+			return fmt.Errorf("clients must have a name")
+		}
+		if names[config.Name] {
+			return fmt.Errorf("duplicate client %s", config.Name)
+		}
+		names[config.Name] = true
+		if (config.APIKey == "") == (config.CommonName == "") {
+			return fmt.Errorf("client %s: exactly one of api_key or common_name is required", config.Name)
+		}
+		client := &httpClient{name: config.Name, labels: make(map[string]string, len(labels)+len(config.Labels))}
+		for k, v := range labels {
+			client.labels[k] = v
+		}
+		for k, v := range config.Labels {
+			client.labels[k] = v
+		}
+		if config.CommonName != "" {
+			if h.tlsConfig == nil || h.tlsConfig.ClientCAs == nil {
+				return fmt.Errorf("client %s: tls.ca_file is required to verify client certificates", config.Name)
+			}
+			if _, ok := h.certs[config.CommonName]; ok {
+				return fmt.Errorf("client %s: duplicate common_name %s", config.Name, config.CommonName)
+			}
+			h.certs[config.CommonName] = client
+			continue
+		}
+		apiKey, err := secrets.NewSecret(config.APIKey, h.logger)
+		if err != nil {
+			return errors.Wrapf(err, "client %s: invalid api_key", config.Name)
+		}
+		client.apiKey = apiKey
+		if client.key() == "" {
+			return fmt.Errorf("client %s: empty api_key", config.Name)
+		}
+		for _, other := range h.apiKeys {
+			if other.key() == client.key() {
+				return fmt.Errorf("client %s: api_key already used by %s", config.Name, other.name)
+			}
+		}
+		h.apiKeys = append(h.apiKeys, client)
+	}
+	return nil
+}
+
+func (h *HTTPSource) StreamingAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	h.out = out
+	h.dying = t.Dying()
+	h.expectMode = leaky.LIVE
+	if h.config.UseTimeMachine {
+		h.expectMode = leaky.TIMEMACHINE
+	}
+	addr := net.JoinHostPort(h.config.ListenAddr, strconv.Itoa(h.config.ListenPort))
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrapf(err, "could not listen on %s", addr)
+	}
+	h.logger.Infof("listening for pushed lines on %s%s", listener.Addr(), h.config.Path)
+	mux := http.NewServeMux()
+	mux.HandleFunc(h.config.Path, h.handler)
+	server := &http.Server{Handler: mux, TLSConfig: h.tlsConfig, ReadHeaderTimeout: 10 * time.Second}
+	t.Go(func() error {
+		defer types.CatchPanic("crowdsec/acquis/http/live")
+		t.Go(func() error {
+			<-t.Dying()
+			h.logger.Info("http datasource is dying")
+			server.Close()
+			return nil
+		})
+		var err error
+		if h.tlsConfig != nil {
+			err = server.ServeTLS(listener, "", "")
+		} else {
+			err = server.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			err = errors.Wrap(err, "http server has exited")
+			h.SetState(configuration.STATUS_ERRORED, err)
+			return err
+		}
+		return nil
+	})
+	return nil
+}
+
+// authenticate returns the client sending the request, by its api key first, then by its certificate
+func (h *HTTPSource) authenticate(r *http.Request) *httpClient {
+	apiKey := r.Header.Get(apiKeyHeader)
+	if apiKey == "" {
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			apiKey = strings.TrimPrefix(auth, "Bearer ")
+		}
+	}
+	if apiKey != "" {
+		for _, client := range h.apiKeys {
+			if subtle.ConstantTimeCompare([]byte(apiKey), []byte(client.key())) == 1 {
+				return client
+			}
+		}
+		return nil
+	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return h.certs[r.TLS.PeerCertificates[0].Subject.CommonName]
+	}
+	return nil
+}
+
+// parseLines splits a request body in lines, according to its media type. The json values are compacted to one
+// line, except the strings which are sent as is
+func parseLines(mediaType string, body []byte) ([]string, error) {
+	lines := []string{}
+	switch mediaType {
+	case "text/plain":
+		for _, line := range strings.Split(string(body), "\n") {
+			if line = strings.TrimSuffix(line, "\r"); line != "" {
+				lines = append(lines, line)
+			}
+		}
+		return lines, nil
+	case "application/x-ndjson", "application/jsonl":
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		for {
+			value := json.RawMessage{}
+			if err := decoder.Decode(&value); err == io.EOF {
+				return lines, nil
+			} else if err != nil {
+				return nil, errors.Wrap(err, "invalid ndjson")
+			}
+			line, err := jsonLine(value)
+			if err != nil {
+				return nil, err
+			}
+			lines = append(lines, line)
+		}
+	case "application/json":
+		values := []json.RawMessage{}
+		if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] != '[' {
+			//a single value
+			if !json.Valid(trimmed) {
+				return nil, fmt.Errorf("invalid json")
+			}
+			values = append(values, json.RawMessage(trimmed))
+		} else if err := json.Unmarshal(body, &values); err != nil {
+			return nil, errors.Wrap(err, "invalid json")
+		}
+		for _, value := range values {
+			line, err := jsonLine(value)
+			if err != nil {
+				return nil, err
+			}
+			lines = append(lines, line)
+		}
+		return lines, nil
+	}
+	return nil, fmt.Errorf("unsupported content type %s", mediaType)
+}
+
+func jsonLine(value json.RawMessage) (string, error) {
+	s := ""
+	if err := json.Unmarshal(value, &s); err == nil {
+		return s, nil
+	}
+	line := bytes.Buffer{}
+	if err := json.Compact(&line, value); err != nil {
+		return "", errors.Wrap(err, "invalid json")
+	}
+	return line.String(), nil
+}
+
+func (h *HTTPSource) handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	client := h.authenticate(r)
+	if client == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	logger := h.logger.WithField("client", client.name)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "text/plain", "application/x-ndjson", "application/jsonl", "application/json":
+	default:
+		http.Error(w, "only text/plain, application/x-ndjson and application/json payloads are supported", http.StatusUnsupportedMediaType)
+		return
+	}
+	var body io.Reader = http.MaxBytesReader(w, r.Body, h.config.MaxBodySize)
+	switch r.Header.Get("Content-Encoding") {
+	case "", "identity":
+	case "gzip":
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		body = io.LimitReader(gz, h.config.MaxBodySize+1)
+	default:
+		http.Error(w, "unsupported content encoding", http.StatusUnsupportedMediaType)
+		return
+	}
+	request, err := ioutil.ReadAll(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if int64(len(request)) > h.config.MaxBodySize {
+		http.Error(w, fmt.Sprintf("request is larger than %d bytes", h.config.MaxBodySize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	//the whole request is rejected if it's invalid, so that the client can send it again once fixed
+	lines, err := parseLines(mediaType, request)
+	if err != nil {
+		logger.Debugf("rejecting request : %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	linesReceived.With(prometheus.Labels{"client": client.name}).Add(float64(len(lines)))
+	for _, line := range lines {
+		l := types.Line{}
+		l.Raw = line
+		l.Module = h.GetName()
+		l.Labels = client.labels
+		l.Time = time.Now().UTC()
+		l.Src = client.name
+		l.Process = true
+		h.EventSeen(&l)
+		select {
+		case h.out <- types.Event{Line: l, Process: true, Type: types.LOG, ExpectMode: h.expectMode}:
+		case <-h.dying:
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,357 @@
+package httpacquisition
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/cstest"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/tomb.v2"
+)
+
+func TestConfigure(t *testing.T) {
+	tests := []struct {
+		config      string
+		expectedErr string
+	}{
+		{
+			config:      `foobar: bla`,
+			expectedErr: "field foobar not found in type httpacquisition.HTTPConfiguration",
+		},
+		{
+			config:      `source: http`,
+			expectedErr: "at least one client is required",
+		},
+		{
+			config:      `mode: cat`,
+			expectedErr: "unsupported mode cat for http datasource",
+		},
+		{
+			config:      `listen_port: 424242`,
+			expectedErr: "invalid port 424242",
+		},
+		{
+			config:      `listen_addr: 10.0.0`,
+			expectedErr: "invalid listen IP 10.0.0",
+		},
+		{
+			config:      `path: logs`,
+			expectedErr: "path must start with /",
+		},
+		{
+			config:      `max_body_size: -1`,
+			expectedErr: "invalid max_body_size -1",
+		},
+		{
+			config: `
+clients:
+  - api_key: abcd`,
+			expectedErr: "clients must have a name",
+		},
+		{
+			config: `
+clients:
+  - name: nginx
+    api_key: abcd
+  - name: nginx
+    api_key: efgh`,
+			expectedErr: "duplicate client nginx",
+		},
+		{
+			config: `
+clients:
+  - name: nginx`,
+			expectedErr: "client nginx: exactly one of api_key or common_name is required",
+		},
+		{
+			config: `
+clients:
+  - name: nginx
+    api_key: abcd
+  - name: haproxy
+    api_key: abcd`,
+			expectedErr: "client haproxy: api_key already used by nginx",
+		},
+		{
+			config: `
+clients:
+  - name: nginx
+    api_key: env://CROWDSEC_HTTP_UNSET_KEY`,
+			expectedErr: "environment variable CROWDSEC_HTTP_UNSET_KEY is not set",
+		},
+		{
+			config: `
+clients:
+  - name: web01
+    common_name: web01`,
+			expectedErr: "client web01: tls.ca_file is required to verify client certificates",
+		},
+		{
+			config: `
+tls:
+  cert_file: server.crt`,
+			expectedErr: "tls.cert_file and tls.key_file are required",
+		},
+		{
+			config: `
+source: http
+clients:
+  - name: nginx
+    api_key: abcd`,
+			expectedErr: "",
+		},
+	}
+	subLogger := log.WithField("type", "http")
+	for _, test := range tests {
+		h := HTTPSource{}
+		err := h.Configure([]byte(test.config), subLogger)
+		cstest.AssertErrorContains(t, err, test.expectedErr)
+	}
+}
+
+func TestParseLines(t *testing.T) {
+	tests := []struct {
+		mediaType     string
+		body          string
+		expectedLines []string
+		expectedErr   string
+	}{
+		{
+			mediaType:     "text/plain",
+			body:          "line 1\r\n\nline 2",
+			expectedLines: []string{"line 1", "line 2"},
+		},
+		{
+			mediaType:     "application/x-ndjson",
+			body:          "{\"msg\": \"a\"}\n\"line 2\"\n",
+			expectedLines: []string{`{"msg":"a"}`, "line 2"},
+		},
+		{
+			mediaType:   "application/x-ndjson",
+			body:        "{\"msg\": \"a\"}\n{\"msg\"",
+			expectedErr: "invalid ndjson",
+		},
+		{
+			mediaType:     "application/json",
+			body:          `[{"msg": "a", "status": 403}, "line 2", 42]`,
+			expectedLines: []string{`{"msg":"a","status":403}`, "line 2", "42"},
+		},
+		{
+			mediaType:     "application/json",
+			body:          ` {"msg": "a"}`,
+			expectedLines: []string{`{"msg":"a"}`},
+		},
+		{
+			mediaType:   "application/json",
+			body:        `[{"msg": "a"}`,
+			expectedErr: "invalid json",
+		},
+	}
+	for _, test := range tests {
+		lines, err := parseLines(test.mediaType, []byte(test.body))
+		cstest.AssertErrorContains(t, err, test.expectedErr)
+		if test.expectedErr == "" {
+			assert.Equal(t, test.expectedLines, lines)
+		}
+	}
+}
+
+func startSource(t *testing.T, config string) (*tomb.Tomb, chan types.Event) {
+	h := HTTPSource{}
+	require.NoError(t, h.Configure([]byte(config), log.WithField("type", "http")))
+	tmb := tomb.Tomb{}
+	//buffered, as the requests return once their lines are sent
+	out := make(chan types.Event, 10)
+	require.NoError(t, h.StreamingAcquisition(out, &tmb))
+	return &tmb, out
+}
+
+func readEvent(t *testing.T, out chan types.Event) types.Event {
+	select {
+	case evt := <-out:
+		return evt
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for event")
+	}
+	return types.Event{}
+}
+
+func post(t *testing.T, client *http.Client, url string, headers map[string]string, body []byte) int {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	require.NoError(t, err)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestPush(t *testing.T) {
+	t.Setenv("CROWDSEC_HTTP_KEY", "haproxy-key\n")
+	tmb, out := startSource(t, `
+source: http
+listen_port: 4394
+path: /logs
+max_body_size: 64
+labels:
+  type: nginx
+  env: prod
+clients:
+  - name: nginx
+    api_key: nginx-key
+  - name: haproxy
+    api_key: env://CROWDSEC_HTTP_KEY
+    labels:
+      type: haproxy`)
+	url := "http://127.0.0.1:4394/logs"
+	client := http.DefaultClient
+
+	assert.Equal(t, http.StatusOK, post(t, client, url, map[string]string{"X-Api-Key": "nginx-key", "Content-Type": "text/plain; charset=utf-8"}, []byte("line 1\nline 2\n")))
+	evt := readEvent(t, out)
+	assert.Equal(t, "line 1", evt.Line.Raw)
+	assert.Equal(t, "nginx", evt.Line.Src)
+	assert.Equal(t, map[string]string{"type": "nginx", "env": "prod"}, evt.Line.Labels)
+	assert.Equal(t, "line 2", readEvent(t, out).Line.Raw)
+
+	//the labels of the client take precedence
+	assert.Equal(t, http.StatusOK, post(t, client, url, map[string]string{"Authorization": "Bearer haproxy-key", "Content-Type": "application/json"}, []byte(`[{"msg": "a"}]`)))
+	evt = readEvent(t, out)
+	assert.Equal(t, `{"msg":"a"}`, evt.Line.Raw)
+	assert.Equal(t, "haproxy", evt.Line.Src)
+	assert.Equal(t, map[string]string{"type": "haproxy", "env": "prod"}, evt.Line.Labels)
+
+	//the size limit applies to the decompressed body
+	gzipped := func(content string) []byte {
+		buf := bytes.Buffer{}
+		gz := gzip.NewWriter(&buf)
+		_, _ = gz.Write([]byte(content))
+		gz.Close()
+		return buf.Bytes()
+	}
+	headers := map[string]string{"X-Api-Key": "nginx-key", "Content-Type": "application/x-ndjson", "Content-Encoding": "gzip"}
+	assert.Equal(t, http.StatusOK, post(t, client, url, headers, gzipped("{\"msg\": \"compressed\"}\n")))
+	assert.Equal(t, `{"msg":"compressed"}`, readEvent(t, out).Line.Raw)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post(t, client, url, headers, gzipped(strings.Repeat("\"line\"\n", 20))))
+	headers["Content-Encoding"] = "br"
+	assert.Equal(t, http.StatusUnsupportedMediaType, post(t, client, url, headers, []byte("{}")))
+
+	assert.Equal(t, http.StatusUnauthorized, post(t, client, url, map[string]string{"Content-Type": "text/plain"}, []byte("line")))
+	assert.Equal(t, http.StatusUnauthorized, post(t, client, url, map[string]string{"X-Api-Key": "wrong", "Content-Type": "text/plain"}, []byte("line")))
+	assert.Equal(t, http.StatusUnsupportedMediaType, post(t, client, url, map[string]string{"X-Api-Key": "nginx-key", "Content-Type": "application/xml"}, []byte("<line/>")))
+	assert.Equal(t, http.StatusBadRequest, post(t, client, url, map[string]string{"X-Api-Key": "nginx-key", "Content-Type": "application/json"}, []byte(`["valid", "inval`)))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post(t, client, url, map[string]string{"X-Api-Key": "nginx-key", "Content-Type": "text/plain"}, []byte(strings.Repeat("line\n", 20))))
+	//nothing was sent for the rejected requests
+	assert.Len(t, out, 0)
+
+	resp, err := client.Get(url)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	tmb.Kill(nil)
+	require.NoError(t, tmb.Wait())
+}
+
+func writeCert(t *testing.T, dir string, name string, template *x509.Certificate, parent *x509.Certificate, parentKey *rsa.PrivateKey) (*x509.Certificate, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0600))
+	return cert, key
+}
+
+func TestClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	notAfter := time.Now().Add(time.Hour)
+	ca, caKey := writeCert(t, dir, "ca", &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "http-ca"},
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	writeCert(t, dir, "server", &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	for serial, name := range []string{"web01", "web02"} {
+		writeCert(t, dir, name, &x509.Certificate{
+			SerialNumber: big.NewInt(int64(serial + 3)),
+			Subject:      pkix.Name{CommonName: name},
+			NotAfter:     notAfter,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, ca, caKey)
+	}
+	tmb, out := startSource(t, fmt.Sprintf(`
+source: http
+listen_port: 4395
+tls:
+  cert_file: %[1]s/server.crt
+  key_file: %[1]s/server.key
+  ca_file: %[1]s/ca.crt
+clients:
+  - name: web
+    common_name: web01
+  - name: collector
+    api_key: collector-key`, dir))
+	url := "https://127.0.0.1:4395/"
+	caPool := x509.NewCertPool()
+	caPool.AddCert(ca)
+	httpsClient := func(name string) *http.Client {
+		config := &tls.Config{RootCAs: caPool}
+		if name != "" {
+			cert, err := tls.LoadX509KeyPair(filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key"))
+			require.NoError(t, err)
+			config.Certificates = []tls.Certificate{cert}
+		}
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	}
+	headers := map[string]string{"Content-Type": "text/plain"}
+
+	assert.Equal(t, http.StatusOK, post(t, httpsClient("web01"), url, headers, []byte("from web01")))
+	evt := readEvent(t, out)
+	assert.Equal(t, "from web01", evt.Line.Raw)
+	assert.Equal(t, "web", evt.Line.Src)
+	//a valid certificate of an unknown client
+	assert.Equal(t, http.StatusUnauthorized, post(t, httpsClient("web02"), url, headers, []byte("from web02")))
+	//the api keys don't need a certificate
+	headers["X-Api-Key"] = "collector-key"
+	assert.Equal(t, http.StatusOK, post(t, httpsClient(""), url, headers, []byte("from collector")))
+	assert.Equal(t, "collector", readEvent(t, out).Line.Src)
+
+	tmb.Kill(nil)
+	require.NoError(t, tmb.Wait())
+}
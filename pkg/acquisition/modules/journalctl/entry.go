@@ -0,0 +1,77 @@
+package journalctlacquisition
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// journalField is a field of a journal entry : journalctl exports it as a string, as an array of bytes if it's not
+// valid utf-8, as an array of values if it was set several times, or as null if it's too big
+type journalField string
+
+func (f *journalField) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err == nil {
+		*f = journalField(value)
+		return nil
+	}
+	var values []json.RawMessage
+	if err := json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+	if len(values) == 0 {
+		*f = ""
+		return nil
+	}
+	raw := make([]byte, 0, len(values))
+	for _, v := range values {
+		var b byte
+		if err := json.Unmarshal(v, &b); err != nil {
+			//not an array of bytes, keep the first value
+			return f.UnmarshalJSON(values[0])
+		}
+		raw = append(raw, b)
+	}
+	*f = journalField(raw)
+	return nil
+}
+
+// journalEntry is an entry of the journal, as exported by journalctl --output json
+type journalEntry struct {
+	Cursor     journalField `json:"__CURSOR"`
+	Realtime   journalField `json:"__REALTIME_TIMESTAMP"`
+	Hostname   journalField `json:"_HOSTNAME"`
+	Identifier journalField `json:"SYSLOG_IDENTIFIER"`
+	Comm       journalField `json:"_COMM"`
+	Pid        journalField `json:"_PID"`
+	SyslogPid  journalField `json:"SYSLOG_PID"`
+	Message    journalField `json:"MESSAGE"`
+}
+
+func parseJournalEntry(data string) (journalEntry, error) {
+	entry := journalEntry{}
+	err := json.Unmarshal([]byte(data), &entry)
+	return entry, err
+}
+
+// line formats the entry like the default (short) output of journalctl, which is what the parsers expect
+func (e journalEntry) line() string {
+	ts := time.Now()
+	if usec, err := strconv.ParseInt(string(e.Realtime), 10, 64); err == nil {
+		ts = time.Unix(0, usec*int64(time.Microsecond))
+	}
+	identifier := e.Identifier
+	if identifier == "" {
+		identifier = e.Comm
+	}
+	pid := e.Pid
+	if pid == "" {
+		pid = e.SyslogPid
+	}
+	prefix := ts.Format("Jan 02 15:04:05") + " " + string(e.Hostname) + " " + string(identifier)
+	if pid != "" {
+		prefix += "[" + string(pid) + "]"
+	}
+	return prefix + ": " + string(e.Message)
+}
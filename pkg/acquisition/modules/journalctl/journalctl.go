@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/cursors"
 	leaky "github.com/crowdsecurity/crowdsec/pkg/leakybucket"
 	"github.com/crowdsecurity/crowdsec/pkg/types"
 	"github.com/pkg/errors"
@@ -23,13 +24,19 @@ import (
 type JournalCtlConfiguration struct {
 	configuration.DataSourceCommonCfg `yaml:",inline"`
 	Filters                           []string `yaml:"journalctl_filter"`
+	Units                             []string `yaml:"units"`          //unit names or glob patterns, ie. nginx*.service
+	ThisBoot                          bool     `yaml:"this_boot"`      //only read the entries of the current boot
+	BootId                            string   `yaml:"boot_id"`        //only read the entries of this boot
+	PersistCursor                     *bool    `yaml:"persist_cursor"` //tail mode : resume after the last entry read on restart, true by default
 }
 
 type JournalCtlSource struct {
-	config JournalCtlConfiguration
-	logger *log.Entry
-	src    string
-	args   []string
+	configuration.HealthTracker
+	config        JournalCtlConfiguration
+	logger        *log.Entry
+	src           string
+	args          []string
+	persistCursor bool
 }
 
 const journalctlCmd string = "journalctl"
@@ -39,6 +46,9 @@ var (
 	journalctlArgstreaming = []string{"--follow", "-n", "0"}
 )
 
+// how often the cursor of the journal is saved
+var cursorSaveInterval = 5 * time.Second
+
 var linesRead = prometheus.NewCounterVec(
 	prometheus.CounterOpts{
 		Name: "cs_journalctlsource_hits_total",
@@ -62,10 +72,41 @@ func readLine(scanner *bufio.Scanner, out chan string, errChan chan error) error
 	return nil
 }
 
+// commandArgs returns the arguments of journalctl. In tail mode, it resumes after the saved cursor if there is one,
+// or else starts at the end of the journal
+func (j *JournalCtlSource) commandArgs() []string {
+	var args []string
+	if j.config.Mode != configuration.TAIL_MODE {
+		args = append(args, journalctlArgsOneShot...)
+		return append(args, j.args...)
+	}
+	cursor := ""
+	if j.persistCursor {
+		var err error
+		cursor, err = cursors.LoadCursor(j.GetName(), j.src)
+		if err != nil {
+			j.logger.Warningf("unable to load cursor of %s : %s", j.src, err)
+		}
+	}
+	if cursor != "" {
+		j.logger.Infof("resuming %s after cursor %s", j.src, cursor)
+		args = append(args, "--follow", "--after-cursor", cursor)
+	} else {
+		args = append(args, journalctlArgstreaming...)
+	}
+	return append(args, j.args...)
+}
+
+func (j *JournalCtlSource) saveCursor(cursor string) {
+	if err := cursors.SaveCursor(j.GetName(), j.src, cursor); err != nil {
+		j.logger.Warningf("unable to save cursor of %s : %s", j.src, err)
+	}
+}
+
 func (j *JournalCtlSource) runJournalCtl(out chan types.Event, t *tomb.Tomb) error {
 	ctx, cancel := context.WithCancel(context.Background())
 
-	cmd := exec.CommandContext(ctx, journalctlCmd, j.args...)
+	cmd := exec.CommandContext(ctx, journalctlCmd, j.commandArgs()...)
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		cancel()
@@ -114,8 +155,22 @@ func (j *JournalCtlSource) runJournalCtl(out chan types.Event, t *tomb.Tomb) err
 		return readLine(stderrScanner, stderrChan, nil)
 	})
 
+	//the cursor is saved periodically rather than on every entry
+	var cursor, savedCursor string
+	cursorTicker := time.NewTicker(cursorSaveInterval)
+	defer cursorTicker.Stop()
+	defer func() {
+		if cursor != savedCursor {
+			j.saveCursor(cursor)
+		}
+	}()
 	for {
 		select {
+		case <-cursorTicker.C:
+			if cursor != savedCursor {
+				j.saveCursor(cursor)
+				savedCursor = cursor
+			}
 		case <-t.Dying():
 			logger.Infof("journalctl datasource %s stopping", j.src)
 			cancel()
@@ -124,6 +179,15 @@ func (j *JournalCtlSource) runJournalCtl(out chan types.Event, t *tomb.Tomb) err
 		case stdoutLine := <-stdoutChan:
 			l := types.Line{}
 			l.Raw = stdoutLine
+			if j.persistCursor {
+				entry, err := parseJournalEntry(stdoutLine)
+				if err != nil {
+					logger.Warningf("unable to parse journal entry '%s' : %s", stdoutLine, err)
+					continue
+				}
+				l.Raw = entry.line()
+				cursor = string(entry.Cursor)
+			}
 			logger.Debugf("getting one line : %s", l.Raw)
 			l.Labels = j.config.Labels
 			l.Time = time.Now().UTC()
@@ -137,10 +201,12 @@ func (j *JournalCtlSource) runJournalCtl(out chan types.Event, t *tomb.Tomb) err
 			} else {
 				evt = types.Event{Line: l, Process: true, Type: types.LOG, ExpectMode: leaky.TIMEMACHINE}
 			}
+			j.EventSeen(&evt.Line)
 			out <- evt
 		case stderrLine := <-stderrChan:
 			logger.Warnf("Got stderr message : %s", stderrLine)
 			err := fmt.Errorf("journalctl error : %s", stderrLine)
+			j.SetState(configuration.STATUS_ERRORED, err)
 			t.Kill(err)
 		case errScanner, ok := <-errChan:
 			if !ok {
@@ -148,6 +214,7 @@ func (j *JournalCtlSource) runJournalCtl(out chan types.Event, t *tomb.Tomb) err
 				t.Kill(nil)
 			}
 			if errScanner != nil {
+				j.SetState(configuration.STATUS_ERRORED, errScanner)
 				t.Kill(errScanner)
 			}
 		}
@@ -172,17 +239,30 @@ func (j *JournalCtlSource) Configure(yamlConfig []byte, logger *log.Entry) error
 	if config.Mode == "" {
 		config.Mode = configuration.TAIL_MODE
 	}
-	var args []string
-	if config.Mode == configuration.TAIL_MODE {
-		args = journalctlArgstreaming
-	} else {
-		args = journalctlArgsOneShot
+	if len(config.Filters) == 0 && len(config.Units) == 0 {
+		return fmt.Errorf("journalctl_filter is required, unless units are set")
+	}
+	if config.ThisBoot && config.BootId != "" {
+		return fmt.Errorf("this_boot and boot_id are mutually exclusive")
+	}
+	j.persistCursor = config.Mode == configuration.TAIL_MODE && (config.PersistCursor == nil || *config.PersistCursor)
+	j.args = []string{}
+	if config.ThisBoot {
+		j.args = append(j.args, "--boot")
 	}
-	if len(config.Filters) == 0 {
-		return fmt.Errorf("journalctl_filter is required")
+	if config.BootId != "" {
+		j.args = append(j.args, "--boot="+config.BootId)
 	}
-	j.args = append(args, config.Filters...)
-	j.src = fmt.Sprintf("journalctl-%s", strings.Join(config.Filters, "."))
+	//journalctl matches the unit names against the glob patterns itself
+	for _, unit := range config.Units {
+		j.args = append(j.args, "--unit", unit)
+	}
+	//the cursor of each entry is only available in the json output
+	if j.persistCursor {
+		j.args = append(j.args, "--output", "json")
+	}
+	j.args = append(j.args, config.Filters...)
+	j.src = fmt.Sprintf("journalctl-%s", strings.Join(append(append([]string{}, config.Filters...), config.Units...), "."))
 	j.config = config
 	return nil
 }
@@ -193,38 +273,36 @@ func (j *JournalCtlSource) ConfigureByDSN(dsn string, labels map[string]string,
 	j.config.Mode = configuration.CAT_MODE
 	j.config.Labels = labels
 
-	//format for the DSN is : journalctl://filters=FILTER1&filters=FILTER2
-	if !strings.HasPrefix(dsn, "journalctl://") {
-		return fmt.Errorf("invalid DSN %s for journalctl source, must start with journalctl://", dsn)
+	//format for the DSN is : journalctl://filters=FILTER1&filters=FILTER2 (journald:// works too)
+	parsed, err := configuration.ParseDSN(dsn, "journalctl", "journald")
+	if err != nil {
+		return err
 	}
-
-	qs := strings.TrimPrefix(dsn, "journalctl://")
-	if len(qs) == 0 {
-		return fmt.Errorf("empty journalctl:// DSN")
+	if len(parsed.Target) == 0 && len(parsed.Params) == 0 {
+		return fmt.Errorf("empty %s:// DSN", parsed.Scheme)
 	}
-
-	params, err := url.ParseQuery(qs)
+	//the parameters are usually given right after the scheme, without '?'
+	params, err := url.ParseQuery(parsed.Target)
 	if err != nil {
 		return fmt.Errorf("could not parse journalctl DSN : %s", err)
 	}
-	for key, value := range params {
-		switch key {
-		case "filters":
-			j.config.Filters = append(j.config.Filters, value...)
-		case "log_level":
-			if len(value) != 1 {
-				return fmt.Errorf("expected zero or one value for 'log_level'")
-			}
-			lvl, err := log.ParseLevel(value[0])
-			if err != nil {
-				return errors.Wrapf(err, "unknown level %s", value[0])
-			}
-			j.logger.Logger.SetLevel(lvl)
-		case "since":
-			j.args = append(j.args, "--since", value[0])
-		default:
-			return fmt.Errorf("unsupported key %s in journalctl DSN", key)
-		}
+	for key, value := range parsed.Params {
+		params[key] = append(params[key], value...)
+	}
+	parsed.Params = params
+	if err := parsed.CheckParams("filters", "since"); err != nil {
+		return err
+	}
+	if err := parsed.SetLogLevel(j.logger); err != nil {
+		return err
+	}
+	j.config.Filters = append(j.config.Filters, params["filters"]...)
+	since, err := parsed.Param("since")
+	if err != nil {
+		return err
+	}
+	if since != "" {
+		j.args = append(j.args, "--since", since)
 	}
 	j.args = append(j.args, j.config.Filters...)
 	return nil
@@ -238,6 +316,10 @@ func (j *JournalCtlSource) GetName() string {
 	return "journalctl"
 }
 
+func (j *JournalCtlSource) GetUuid() string {
+	return j.config.UniqueId
+}
+
 func (j *JournalCtlSource) OneShotAcquisition(out chan types.Event, t *tomb.Tomb) error {
 	defer types.CatchPanic("crowdsec/acquis/journalctl/oneshot")
 	err := j.runJournalCtl(out, t)
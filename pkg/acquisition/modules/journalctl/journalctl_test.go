@@ -1,12 +1,15 @@
 package journalctlacquisition
 
 import (
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
 	"testing"
 	"time"
 
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/cursors"
 	"github.com/crowdsecurity/crowdsec/pkg/cstest"
 	"github.com/crowdsecurity/crowdsec/pkg/types"
 	log "github.com/sirupsen/logrus"
@@ -41,6 +44,16 @@ journalctl_filter:
  - _UID=42`,
 			expectedErr: "",
 		},
+		{
+			config: `
+mode: tail
+source: journalctl
+units:
+ - nginx*.service
+this_boot: true
+boot_id: 4ae15ff3f1ab4a4eb5a6ff8b43e4fd4c`,
+			expectedErr: "this_boot and boot_id are mutually exclusive",
+		},
 	}
 
 	subLogger := log.WithFields(log.Fields{
@@ -89,6 +102,14 @@ func TestConfigureDSN(t *testing.T) {
 			dsn:         "journalctl://filters=_UID=1000&log_level=warn&since=yesterday",
 			expectedErr: "",
 		},
+		{
+			dsn:         "journald://filters=_UID=1000?since=yesterday",
+			expectedErr: "",
+		},
+		{
+			dsn:         "journald://",
+			expectedErr: "empty journald:// DSN",
+		},
 	}
 	subLogger := log.WithFields(log.Fields{
 		"type": "journalctl",
@@ -277,6 +298,125 @@ journalctl_filter:
 	}
 }
 
+func TestCommandArgs(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on windows")
+	}
+	tests := []struct {
+		config       string
+		expectedArgs []string
+	}{
+		{
+			config: `
+mode: cat
+source: journalctl
+journalctl_filter:
+ - _UID=42`,
+			expectedArgs: []string{"_UID=42"},
+		},
+		{
+			config: `
+mode: tail
+source: journalctl
+units:
+ - nginx*.service
+ - ssh.service
+this_boot: true`,
+			expectedArgs: []string{"--follow", "-n", "0", "--boot", "--unit", "nginx*.service", "--unit", "ssh.service", "--output", "json"},
+		},
+		{
+			config: `
+mode: tail
+source: journalctl
+boot_id: 4ae15ff3f1ab4a4eb5a6ff8b43e4fd4c
+persist_cursor: false
+journalctl_filter:
+ - _UID=42`,
+			expectedArgs: []string{"--follow", "-n", "0", "--boot=4ae15ff3f1ab4a4eb5a6ff8b43e4fd4c", "_UID=42"},
+		},
+	}
+	subLogger := log.WithFields(log.Fields{
+		"type": "journalctl",
+	})
+	for _, test := range tests {
+		j := JournalCtlSource{}
+		err := j.Configure([]byte(test.config), subLogger)
+		if err != nil {
+			t.Fatalf("Unexpected error : %s", err)
+		}
+		assert.Equal(t, test.expectedArgs, j.commandArgs())
+	}
+}
+
+func TestJournalEntry(t *testing.T) {
+	entry, err := parseJournalEntry(`{"__CURSOR":"s=abc;i=1","__REALTIME_TIMESTAMP":"1606040539000000","_HOSTNAME":"zeroed",` +
+		`"SYSLOG_IDENTIFIER":"sshd","_PID":"1480","MESSAGE":[73,110,118,97,108,105,100]}`)
+	if err != nil {
+		t.Fatalf("Unexpected error : %s", err)
+	}
+	assert.Equal(t, journalField("s=abc;i=1"), entry.Cursor)
+	expectedDate := time.Unix(1606040539, 0).Format("Jan 02 15:04:05")
+	assert.Equal(t, expectedDate+" zeroed sshd[1480]: Invalid", entry.line())
+
+	entry, err = parseJournalEntry(`{"_HOSTNAME":"zeroed","_COMM":"kernel","MESSAGE":null}`)
+	if err != nil {
+		t.Fatalf("Unexpected error : %s", err)
+	}
+	assert.Contains(t, entry.line(), " zeroed kernel: ")
+}
+
+func TestCursor(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on windows")
+	}
+	dir, err := ioutil.TempDir("", "cursors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := cursors.NewFileStore(filepath.Join(dir, "cursors.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cursors.SetStore(store)
+	defer cursors.SetStore(nil)
+
+	j := JournalCtlSource{}
+	err = j.Configure([]byte(`
+source: journalctl
+mode: tail
+journalctl_filter:
+ - _SYSTEMD_UNIT=ssh.service`), log.WithField("type", "journalctl"))
+	if err != nil {
+		t.Fatalf("Unexpected error : %s", err)
+	}
+	//only the entries after the saved cursor are read
+	j.saveCursor("s=fake;i=10")
+	tomb := tomb.Tomb{}
+	out := make(chan types.Event)
+	err = j.StreamingAcquisition(out, &tomb)
+	if err != nil {
+		t.Fatalf("Unexpected error : %s", err)
+	}
+	lines := []string{}
+READLOOP:
+	for {
+		select {
+		case evt := <-out:
+			lines = append(lines, evt.Line.Raw)
+		case <-time.After(1 * time.Second):
+			break READLOOP
+		}
+	}
+	tomb.Kill(nil)
+	tomb.Wait()
+	assert.Equal(t, 2, len(lines))
+	assert.Contains(t, lines[0], " zeroed sshd[1791]: Invalid user wqeqwe5 from 127.0.0.1 port 55834")
+	//the cursor of the last entry is saved when stopping
+	cursor, _ := store.LoadCursor("journalctl", "journalctl-_SYSTEMD_UNIT=ssh.service")
+	assert.Equal(t, "s=fake;i=12", cursor)
+}
+
 func TestMain(m *testing.M) {
 	if os.Getenv("USE_SYSTEM_JOURNALCTL") == "" {
 		os.Setenv("PATH", "./test_files"+":"+os.Getenv("PATH"))
@@ -0,0 +1,713 @@
+package kafkaacquisition
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/retry"
+	leaky "github.com/crowdsecurity/crowdsec/pkg/leakybucket"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/segmentio/kafka-go"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/tomb.v2"
+	"gopkg.in/yaml.v2"
+)
+
+var linesRead = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cs_kafkasource_hits_total",
+		Help: "Total messages that were read from Kafka topics.",
+	},
+	[]string{"topic"})
+
+var consumerLag = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "cs_kafkasource_consumer_lag",
+		Help: "Messages of the partitions that were not read yet by the consumer group.",
+	},
+	[]string{"group", "topic", "partition"})
+
+var (
+	defaultTimeout         = 10 * time.Second
+	defaultMaxWait         = time.Second
+	defaultCommitInterval  = time.Second
+	defaultRefreshInterval = 5 * time.Minute
+)
+
+const (
+	defaultGroupID  = "crowdsec"
+	defaultClientID = "crowdsec"
+	startEarliest   = "earliest"
+	startLatest     = "latest"
+)
+
+type KafkaTLSConfiguration struct {
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"` //client certificate, when the brokers verify them
+	KeyFile            string `yaml:"key_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+type KafkaSASLConfiguration struct {
+	Mechanism string `yaml:"mechanism"` //PLAIN, SCRAM-SHA-256, SCRAM-SHA-512 or OAUTHBEARER
+	Username  string `yaml:"username"`
+	Password  string `yaml:"password"` //can be env://, file:// or vault:// references, like token
+	Token     string `yaml:"token"`    //of OAUTHBEARER, resolved again at each authentication so that a renewed token is picked up
+}
+
+type KafkaConfiguration struct {
+	configuration.DataSourceCommonCfg `yaml:",inline"`
+	Brokers                           []string                `yaml:"brokers"`
+	Topics                            []string                `yaml:"topics"`
+	TopicRegex                        string                  `yaml:"topic_regex"`      //instead of topics, the topics whose name matches are read
+	RefreshInterval                   *time.Duration          `yaml:"refresh_interval"` //how often the topics matching topic_regex are listed
+	GroupID                           string                  `yaml:"group_id"`
+	StartOffset                       string                  `yaml:"start_offset"`    //of the partitions without committed offset : earliest or latest
+	CommitInterval                    *time.Duration          `yaml:"commit_interval"` //the offsets of the messages sent are committed in batches
+	MaxWait                           *time.Duration          `yaml:"max_wait"`        //how long the fetch requests wait for messages
+	Timeout                           *time.Duration          `yaml:"timeout"`         //to connect to the brokers
+	ClientID                          string                  `yaml:"client_id"`
+	SASL                              *KafkaSASLConfiguration `yaml:"sasl"`
+	TLS                               *KafkaTLSConfiguration  `yaml:"tls"`
+}
+
+// reader is the part of the kafka-go reader used by the datasource
+type reader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// partitionReader is the part of the kafka-go reader of a single partition, without consumer group, used in cat mode
+type partitionReader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	SetOffset(offset int64) error
+	Close() error
+}
+
+// partitionRange is the part of a partition replayed in cat mode : from its first message (after since), up to the
+// offset its next message had when the replay started
+type partitionRange struct {
+	partition int
+	start     int64
+	end       int64
+}
+
+// KafkaSource reads topics as a member of a consumer group : the partitions are shared with the other members, and
+// the offsets of the messages handed to crowdsec are committed so that a restart resumes after them.
+// In cat mode (kafka:// DSN), the partitions are read one after the other, without consumer group nor commit
+type KafkaSource struct {
+	configuration.HealthTracker
+	config             KafkaConfiguration
+	logger             *log.Entry
+	dialer             *kafka.Dialer
+	topicRegex         *regexp.Regexp
+	retrier            *retry.Retrier
+	since              time.Time //cat mode
+	newReader          func(topics []string) reader
+	listTopics         func(ctx context.Context) ([]string, error)
+	newPartitionReader func(topic string, partition int) partitionReader
+	listPartitions     func(ctx context.Context, topic string) ([]partitionRange, error)
+}
+
+func (k *KafkaSource) GetMetrics() []prometheus.Collector {
+	return []prometheus.Collector{linesRead, consumerLag}
+}
+
+func (k *KafkaSource) GetAggregMetrics() []prometheus.Collector {
+	return []prometheus.Collector{linesRead, consumerLag}
+}
+
+func (k *KafkaSource) Configure(yamlConfig []byte, logger *log.Entry) error {
+	k.logger = logger
+	config := KafkaConfiguration{}
+	if err := yaml.UnmarshalStrict(yamlConfig, &config); err != nil {
+		return errors.Wrap(err, "Cannot parse kafka datasource configuration")
+	}
+	if config.Mode == "" {
+		config.Mode = configuration.TAIL_MODE
+	}
+	if config.Mode != configuration.TAIL_MODE {
+		return fmt.Errorf("unsupported mode %s for kafka datasource", config.Mode)
+	}
+	return k.configure(config)
+}
+
+// configure checks the configuration and sets the defaults, for Configure and ConfigureByDSN
+func (k *KafkaSource) configure(config KafkaConfiguration) error {
+	if len(config.Brokers) == 0 {
+		return fmt.Errorf("brokers is mandatory")
+	}
+	for _, broker := range config.Brokers {
+		if broker == "" || !strings.Contains(broker, ":") {
+			return fmt.Errorf("invalid broker '%s', expected host:port", broker)
+		}
+	}
+	if len(config.Topics) == 0 && config.TopicRegex == "" {
+		return fmt.Errorf("topics or topic_regex is mandatory")
+	}
+	if len(config.Topics) != 0 && config.TopicRegex != "" {
+		return fmt.Errorf("topics and topic_regex are mutually exclusive")
+	}
+	for _, topic := range config.Topics {
+		if topic == "" || strings.ContainsAny(topic, " \t\r\n/") {
+			return fmt.Errorf("invalid topic '%s'", topic)
+		}
+	}
+	if config.TopicRegex != "" {
+		var err error
+		if k.topicRegex, err = regexp.Compile(config.TopicRegex); err != nil {
+			return errors.Wrap(err, "invalid topic_regex")
+		}
+	}
+	if config.RefreshInterval == nil {
+		config.RefreshInterval = &defaultRefreshInterval
+	}
+	if *config.RefreshInterval <= 0 {
+		return fmt.Errorf("refresh_interval must be positive")
+	}
+	if config.GroupID == "" {
+		config.GroupID = defaultGroupID
+	}
+	if config.StartOffset == "" {
+		config.StartOffset = startLatest
+	}
+	if config.StartOffset != startEarliest && config.StartOffset != startLatest {
+		return fmt.Errorf("start_offset must be %s or %s", startEarliest, startLatest)
+	}
+	if config.CommitInterval == nil {
+		config.CommitInterval = &defaultCommitInterval
+	}
+	if *config.CommitInterval < 0 {
+		return fmt.Errorf("commit_interval can't be negative")
+	}
+	if config.MaxWait == nil {
+		config.MaxWait = &defaultMaxWait
+	}
+	if config.Timeout == nil {
+		config.Timeout = &defaultTimeout
+	}
+	if config.ClientID == "" {
+		config.ClientID = defaultClientID
+	}
+	k.dialer = &kafka.Dialer{Timeout: *config.Timeout, DualStack: true, ClientID: config.ClientID}
+	if config.SASL != nil {
+		mechanism, err := newMechanism(config.SASL, k.logger)
+		if err != nil {
+			return err
+		}
+		k.dialer.SASLMechanism = mechanism
+	}
+	if config.TLS != nil {
+		tlsConfig, err := newTLSConfig(config.TLS)
+		if err != nil {
+			return err
+		}
+		k.dialer.TLS = tlsConfig
+	}
+	var err error
+	k.retrier, err = retry.New(config.Retry, k.logger)
+	if err != nil {
+		return err
+	}
+	k.retrier.Notify = k.notifyRetry
+	k.config = config
+	k.newReader = k.newKafkaReader
+	k.listTopics = k.listKafkaTopics
+	k.newPartitionReader = k.newKafkaPartitionReader
+	k.listPartitions = k.listKafkaPartitions
+	return nil
+}
+
+func newTLSConfig(config *KafkaTLSConfiguration) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify, MinVersion: tls.VersionTLS12}
+	if config.CAFile != "" {
+		pem, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "while reading tls.ca_file %s", config.CAFile)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in tls.ca_file %s", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		return nil, fmt.Errorf("tls.cert_file and tls.key_file must be set together")
+	}
+	if config.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not load client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// notifyRetry reports the failing connections in the health of the datasource
+func (k *KafkaSource) notifyRetry(err error) {
+	if err != nil {
+		k.SetState(configuration.STATUS_RECONNECTING, err)
+	} else {
+		k.SetState(configuration.STATUS_RUNNING, nil)
+	}
+}
+
+func (k *KafkaSource) ConfigureByDSN(dsn string, labels map[string]string, logger *log.Entry) error {
+	k.logger = logger
+	//format for the DSN is : kafka://broker1:9092,broker2:9092?topic=...&since=...
+	parsed, err := configuration.ParseDSN(dsn, "kafka")
+	if err != nil {
+		return err
+	}
+	if parsed.Target == "" {
+		return fmt.Errorf("empty kafka:// DSN")
+	}
+	if err := parsed.CheckParams("topic", "since", "mechanism", "username", "password", "token", "tls", "ca_file", "insecure_skip_verify"); err != nil {
+		return err
+	}
+	if err := parsed.SetLogLevel(k.logger); err != nil {
+		return err
+	}
+	config := KafkaConfiguration{}
+	config.Mode = configuration.CAT_MODE
+	config.Labels = labels
+	config.Brokers = strings.Split(parsed.Target, ",")
+	config.Topics = parsed.Params["topic"]
+	since, err := parsed.Param("since")
+	if err != nil {
+		return err
+	}
+	if k.since, err = configuration.ParseTime(since); err != nil {
+		return errors.Wrap(err, "invalid since")
+	}
+	sasl := KafkaSASLConfiguration{}
+	tlsConfig := KafkaTLSConfiguration{}
+	useTLS := ""
+	insecure := ""
+	for key, value := range map[string]*string{
+		"mechanism":            &sasl.Mechanism,
+		"username":             &sasl.Username,
+		"password":             &sasl.Password,
+		"token":                &sasl.Token,
+		"tls":                  &useTLS,
+		"ca_file":              &tlsConfig.CAFile,
+		"insecure_skip_verify": &insecure,
+	} {
+		if *value, err = parsed.Param(key); err != nil {
+			return err
+		}
+	}
+	if sasl != (KafkaSASLConfiguration{}) {
+		config.SASL = &sasl
+	}
+	if insecure != "" {
+		if tlsConfig.InsecureSkipVerify, err = strconv.ParseBool(insecure); err != nil {
+			return fmt.Errorf("parsing 'insecure_skip_verify' parameters: %s", err)
+		}
+	}
+	if useTLS != "" {
+		enabled, err := strconv.ParseBool(useTLS)
+		if err != nil {
+			return fmt.Errorf("parsing 'tls' parameters: %s", err)
+		}
+		if enabled {
+			config.TLS = &tlsConfig
+		}
+	}
+	if config.TLS == nil && (insecure != "" || tlsConfig.CAFile != "") {
+		config.TLS = &tlsConfig
+	}
+	return k.configure(config)
+}
+
+func (k *KafkaSource) GetMode() string {
+	return k.config.Mode
+}
+
+func (k *KafkaSource) GetName() string {
+	return "kafka"
+}
+
+func (k *KafkaSource) GetUuid() string {
+	return k.config.UniqueId
+}
+
+func (k *KafkaSource) CanRun() error {
+	return nil
+}
+
+func (k *KafkaSource) Dump() interface{} {
+	return k
+}
+
+func (k *KafkaSource) newKafkaReader(topics []string) reader {
+	startOffset := kafka.LastOffset
+	if k.config.StartOffset == startEarliest {
+		startOffset = kafka.FirstOffset
+	}
+	return kafka.NewReader(kafka.ReaderConfig{
+		Brokers:        k.config.Brokers,
+		GroupID:        k.config.GroupID,
+		GroupTopics:    topics,
+		Dialer:         k.dialer,
+		StartOffset:    startOffset,
+		MaxWait:        *k.config.MaxWait,
+		CommitInterval: *k.config.CommitInterval,
+		Logger:         kafka.LoggerFunc(k.logger.Tracef),
+		ErrorLogger:    kafka.LoggerFunc(k.logger.Debugf),
+	})
+}
+
+func (k *KafkaSource) newKafkaPartitionReader(topic string, partition int) partitionReader {
+	return kafka.NewReader(kafka.ReaderConfig{
+		Brokers:     k.config.Brokers,
+		Topic:       topic,
+		Partition:   partition,
+		Dialer:      k.dialer,
+		MaxWait:     *k.config.MaxWait,
+		Logger:      kafka.LoggerFunc(k.logger.Tracef),
+		ErrorLogger: kafka.LoggerFunc(k.logger.Debugf),
+	})
+}
+
+// readPartitions returns the partitions of the topics, or of the whole cluster without topics, as known by the first
+// broker that answers. It also returns the address of this broker
+func (k *KafkaSource) readPartitions(ctx context.Context, topics ...string) ([]kafka.Partition, string, error) {
+	var lastErr error
+	for _, broker := range k.config.Brokers {
+		conn, err := k.dialer.DialContext(ctx, "tcp", broker)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		partitions, err := conn.ReadPartitions(topics...)
+		conn.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return partitions, broker, nil
+	}
+	return nil, "", lastErr
+}
+
+// listKafkaPartitions returns the offsets to replay of each partition of a topic, as told by their leader
+func (k *KafkaSource) listKafkaPartitions(ctx context.Context, topic string) ([]partitionRange, error) {
+	partitions, broker, err := k.readPartitions(ctx, topic)
+	if err != nil {
+		return nil, errors.Wrapf(err, "while listing the partitions of %s", topic)
+	}
+	ret := []partitionRange{}
+	for _, partition := range partitions {
+		conn, err := k.dialer.DialLeader(ctx, "tcp", broker, topic, partition.ID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "while connecting to the leader of partition %d of %s", partition.ID, topic)
+		}
+		r := partitionRange{partition: partition.ID}
+		if r.end, err = conn.ReadLastOffset(); err == nil {
+			if k.since.IsZero() {
+				r.start, err = conn.ReadFirstOffset()
+			} else {
+				r.start, err = conn.ReadOffset(k.since)
+			}
+		}
+		conn.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "while reading the offsets of partition %d of %s", partition.ID, topic)
+		}
+		//no message since
+		if r.start < 0 {
+			r.start = r.end
+		}
+		ret = append(ret, r)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].partition < ret[j].partition
+	})
+	return ret, nil
+}
+
+// listKafkaTopics returns the topics of the cluster, as known by the first broker that answers
+func (k *KafkaSource) listKafkaTopics(ctx context.Context) ([]string, error) {
+	partitions, _, err := k.readPartitions(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "while listing topics")
+	}
+	seen := map[string]bool{}
+	topics := []string{}
+	for _, partition := range partitions {
+		if !seen[partition.Topic] {
+			seen[partition.Topic] = true
+			topics = append(topics, partition.Topic)
+		}
+	}
+	return topics, nil
+}
+
+// resolveTopics returns the topics to read, sorted : the configured ones, or the ones matching topic_regex
+func (k *KafkaSource) resolveTopics(ctx context.Context, dying <-chan struct{}) ([]string, error) {
+	if k.topicRegex == nil {
+		return k.config.Topics, nil
+	}
+	var topics []string
+	err := k.retrier.Do(dying, func() error {
+		all, err := k.listTopics(ctx)
+		if ctx.Err() != nil {
+			return retry.Permanent(retry.ErrDying)
+		}
+		if err != nil {
+			return err
+		}
+		topics = []string{}
+		for _, topic := range all {
+			//the internal topics, eg. __consumer_offsets, are never read
+			if k.topicRegex.MatchString(topic) && !strings.HasPrefix(topic, "__") {
+				topics = append(topics, topic)
+			}
+		}
+		sort.Strings(topics)
+		return nil
+	})
+	return topics, err
+}
+
+func (k *KafkaSource) event(msg kafka.Message, expectMode int) types.Event {
+	l := types.Line{}
+	l.Raw = string(msg.Value)
+	l.Src = msg.Topic
+	l.Time = time.Now().UTC()
+	l.Labels = k.config.Labels
+	l.Process = true
+	l.Module = k.GetName()
+	meta := map[string]string{
+		"kafka_topic":     msg.Topic,
+		"kafka_partition": strconv.Itoa(msg.Partition),
+		"kafka_offset":    strconv.FormatInt(msg.Offset, 10),
+	}
+	if len(msg.Key) != 0 {
+		meta["kafka_key"] = string(msg.Key)
+	}
+	return types.Event{Line: l, Process: true, Type: types.LOG, ExpectMode: expectMode, Meta: meta}
+}
+
+// consume reads the topics until ctx is canceled, or the reader fails. The offset of each message is committed once
+// the message was handed to crowdsec
+func (k *KafkaSource) consume(ctx context.Context, r reader, out chan types.Event, expectMode int) error {
+	for {
+		msg, err := r.FetchMessage(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		k.SetState(configuration.STATUS_RUNNING, nil)
+		//the high watermark is the offset of the next message that will be produced in the partition
+		consumerLag.With(prometheus.Labels{"group": k.config.GroupID, "topic": msg.Topic, "partition": strconv.Itoa(msg.Partition)}).Set(float64(msg.HighWaterMark - msg.Offset - 1))
+		evt := k.event(msg, expectMode)
+		k.EventSeen(&evt.Line)
+		select {
+		case out <- evt:
+			linesRead.With(prometheus.Labels{"topic": msg.Topic}).Inc()
+		case <-ctx.Done():
+			//not committed, the message will be read again
+			return nil
+		}
+		if err := r.CommitMessages(ctx, msg); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return errors.Wrap(err, "while committing offset")
+		}
+	}
+}
+
+// follow reads the topics until dying is closed, or the reader fails. With topic_regex, the reader is replaced when
+// the topics matching it change
+func (k *KafkaSource) follow(out chan types.Event, dying <-chan struct{}, expectMode int) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-dying:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	topics, err := k.resolveTopics(ctx, dying)
+	if err != nil {
+		return err
+	}
+	for {
+		k.logger.Infof("consuming topics %s with group %s", strings.Join(topics, ","), k.config.GroupID)
+		readerCtx, stop := context.WithCancel(ctx)
+		changed := make(chan []string, 1)
+		if k.topicRegex != nil {
+			go k.watchTopics(readerCtx, stop, dying, topics, changed)
+		}
+		r := k.newReader(topics)
+		err := k.consume(readerCtx, r, out, expectMode)
+		stop()
+		//closing the reader commits the pending offsets, and leaves the group
+		if closeErr := r.Close(); closeErr != nil {
+			k.logger.Warningf("while closing reader : %s", closeErr)
+		}
+		if err != nil {
+			return err
+		}
+		select {
+		case <-dying:
+			return nil
+		default:
+		}
+		//the reader was stopped because the topics changed
+		topics = <-changed
+	}
+}
+
+// watchTopics lists the topics matching topic_regex every refresh_interval. When they are not the ones read anymore,
+// it sends them on changed and stops the reader
+func (k *KafkaSource) watchTopics(ctx context.Context, stop context.CancelFunc, dying <-chan struct{}, current []string, changed chan []string) {
+	ticker := time.NewTicker(*k.config.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		topics, err := k.resolveTopics(ctx, dying)
+		if err != nil {
+			if err != retry.ErrDying {
+				k.logger.Warningf("unable to list the topics : %s", err)
+			}
+			continue
+		}
+		if strings.Join(topics, ",") != strings.Join(current, ",") {
+			k.logger.Infof("the topics matching %s changed", k.config.TopicRegex)
+			changed <- topics
+			stop()
+			return
+		}
+	}
+}
+
+// readPartition reads a partition up to the end of its range. It also returns when no message came for the timeout,
+// as the last offsets can be transaction markers, which are not delivered
+func (k *KafkaSource) readPartition(ctx context.Context, topic string, r partitionRange, out chan types.Event) error {
+	pr := k.newPartitionReader(topic, r.partition)
+	defer pr.Close()
+	if err := pr.SetOffset(r.start); err != nil {
+		return errors.Wrapf(err, "while seeking partition %d of %s", r.partition, topic)
+	}
+	k.SetState(configuration.STATUS_RUNNING, nil)
+	for {
+		fetchCtx, cancel := context.WithTimeout(ctx, *k.config.Timeout)
+		msg, err := pr.FetchMessage(fetchCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err == context.DeadlineExceeded {
+			k.logger.Debugf("no message from partition %d of %s for %s, done", r.partition, topic, *k.config.Timeout)
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(err, "while reading partition %d of %s", r.partition, topic)
+		}
+		evt := k.event(msg, leaky.TIMEMACHINE)
+		k.EventSeen(&evt.Line)
+		select {
+		case out <- evt:
+			linesRead.With(prometheus.Labels{"topic": msg.Topic}).Inc()
+		case <-ctx.Done():
+			return nil
+		}
+		if msg.Offset >= r.end-1 {
+			return nil
+		}
+	}
+}
+
+// replay reads the partitions of a topic one after the other, from since up to their last message
+func (k *KafkaSource) replay(topic string, out chan types.Event, dying <-chan struct{}) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-dying:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	partitions, err := k.listPartitions(ctx, topic)
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, r := range partitions {
+		if r.start >= r.end {
+			continue
+		}
+		if err := k.readPartition(ctx, topic, r, out); err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (k *KafkaSource) OneShotAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	for _, topic := range k.config.Topics {
+		k.logger.Infof("reading topic %s on %s", topic, strings.Join(k.config.Brokers, ","))
+		err := k.retrier.Do(t.Dying(), func() error {
+			return k.replay(topic, out, t.Dying())
+		})
+		if err == retry.ErrDying {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(err, "while reading %s", topic)
+		}
+	}
+	t.Kill(nil)
+	return nil
+}
+
+func (k *KafkaSource) StreamingAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	expectMode := leaky.LIVE
+	if k.config.UseTimeMachine {
+		expectMode = leaky.TIMEMACHINE
+	}
+	t.Go(func() error {
+		defer types.CatchPanic("crowdsec/acquis/kafka/live")
+		err := k.retrier.Do(t.Dying(), func() error {
+			return k.follow(out, t.Dying(), expectMode)
+		})
+		if err == retry.ErrDying || err == nil {
+			k.logger.Infof("kafka datasource stopping")
+			return nil
+		}
+		err = errors.Wrapf(err, "while consuming topics of %s", strings.Join(k.config.Brokers, ","))
+		k.SetState(configuration.STATUS_ERRORED, err)
+		return err
+	})
+	return nil
+}
@@ -0,0 +1,452 @@
+package kafkaacquisition
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/cstest"
+	leaky "github.com/crowdsecurity/crowdsec/pkg/leakybucket"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/segmentio/kafka-go"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/tomb.v2"
+)
+
+func TestConfigure(t *testing.T) {
+	tests := []struct {
+		config      string
+		expectedErr string
+	}{
+		{
+			config:      `foobar: bla`,
+			expectedErr: "field foobar not found in type kafkaacquisition.KafkaConfiguration",
+		},
+		{
+			config:      `topics: [logs]`,
+			expectedErr: "brokers is mandatory",
+		},
+		{
+			config: `
+brokers: [localhost]
+topics: [logs]`,
+			expectedErr: "invalid broker 'localhost', expected host:port",
+		},
+		{
+			config:      `brokers: ["localhost:9092"]`,
+			expectedErr: "topics or topic_regex is mandatory",
+		},
+		{
+			config: `
+brokers: ["localhost:9092"]
+topics: [logs]
+topic_regex: ^logs-`,
+			expectedErr: "topics and topic_regex are mutually exclusive",
+		},
+		{
+			config: `
+brokers: ["localhost:9092"]
+topic_regex: "logs-("`,
+			expectedErr: "invalid topic_regex",
+		},
+		{
+			config: `
+brokers: ["localhost:9092"]
+topics: [logs]
+mode: cat`,
+			expectedErr: "unsupported mode cat for kafka datasource",
+		},
+		{
+			config: `
+brokers: ["localhost:9092"]
+topics: [logs]
+start_offset: first`,
+			expectedErr: "start_offset must be earliest or latest",
+		},
+		{
+			config: `
+brokers: ["localhost:9092"]
+topics: [logs]
+sasl:
+  mechanism: GSSAPI
+  username: crowdsec
+  password: secret`,
+			expectedErr: "unsupported sasl.mechanism 'GSSAPI'",
+		},
+		{
+			config: `
+brokers: ["localhost:9092"]
+topics: [logs]
+sasl:
+  mechanism: SCRAM-SHA-512
+  password: secret`,
+			expectedErr: "sasl.username is mandatory with SCRAM-SHA-512",
+		},
+		{
+			config: `
+brokers: ["localhost:9092"]
+topics: [logs]
+sasl:
+  mechanism: OAUTHBEARER`,
+			expectedErr: "sasl.token is mandatory with OAUTHBEARER",
+		},
+		{
+			config: `
+brokers: ["localhost:9092"]
+topics: [logs]
+sasl:
+  mechanism: PLAIN
+  username: crowdsec
+  password: env://CROWDSEC_KAFKA_UNSET_PASSWORD`,
+			expectedErr: "environment variable CROWDSEC_KAFKA_UNSET_PASSWORD is not set",
+		},
+		{
+			config: `
+brokers: ["localhost:9092"]
+topics: [logs]
+tls:
+  cert_file: client.pem`,
+			expectedErr: "tls.cert_file and tls.key_file must be set together",
+		},
+		{
+			config: `
+source: kafka
+brokers: ["kafka-1:9093", "kafka-2:9093"]
+topics: [alb, cloudfront]
+group_id: crowdsec-lapi
+start_offset: earliest
+sasl:
+  mechanism: scram-sha-256
+  username: crowdsec
+  password: secret
+tls:
+  insecure_skip_verify: true`,
+			expectedErr: "",
+		},
+	}
+	subLogger := log.WithField("type", "kafka")
+	for _, test := range tests {
+		k := KafkaSource{}
+		err := k.Configure([]byte(test.config), subLogger)
+		cstest.AssertErrorContains(t, err, test.expectedErr)
+	}
+	k := KafkaSource{}
+	require.NoError(t, k.Configure([]byte(`
+brokers: ["localhost:9092"]
+topic_regex: ^logs-`), subLogger))
+	assert.Equal(t, "crowdsec", k.config.GroupID)
+	assert.Equal(t, "latest", k.config.StartOffset)
+	assert.Equal(t, 5*time.Minute, *k.config.RefreshInterval)
+	assert.Equal(t, "crowdsec", k.dialer.ClientID)
+}
+
+func TestOAuthBearer(t *testing.T) {
+	t.Setenv("CROWDSEC_KAFKA_TOKEN", "eyJhbGciOiJIUzI1NiJ9.e30.token\n")
+	mechanism, err := newMechanism(&KafkaSASLConfiguration{Mechanism: "OAUTHBEARER", Token: "env://CROWDSEC_KAFKA_TOKEN"}, log.WithField("type", "kafka"))
+	require.NoError(t, err)
+	assert.Equal(t, "OAUTHBEARER", mechanism.Name())
+	state, ir, err := mechanism.Start(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "n,,\x01auth=Bearer eyJhbGciOiJIUzI1NiJ9.e30.token\x01\x01", string(ir))
+	done, _, err := state.Next(context.Background(), nil)
+	require.NoError(t, err)
+	assert.True(t, done)
+	_, _, err = state.Next(context.Background(), []byte(`{"status":"invalid_token"}`))
+	cstest.AssertErrorContains(t, err, `token rejected : {"status":"invalid_token"}`)
+
+	//the token is read again at each authentication
+	t.Setenv("CROWDSEC_KAFKA_TOKEN", "renewed")
+	_, ir, err = mechanism.Start(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "n,,\x01auth=Bearer renewed\x01\x01", string(ir))
+}
+
+func TestPasswordMechanism(t *testing.T) {
+	t.Setenv("CROWDSEC_KAFKA_PASSWORD", "first")
+	mechanism, err := newMechanism(&KafkaSASLConfiguration{Mechanism: "plain", Username: "crowdsec", Password: "env://CROWDSEC_KAFKA_PASSWORD"}, log.WithField("type", "kafka"))
+	require.NoError(t, err)
+	assert.Equal(t, "PLAIN", mechanism.Name())
+	_, ir, err := mechanism.Start(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "\x00crowdsec\x00first", string(ir))
+
+	//the password is resolved again at the authentications made after the refresh interval
+	t.Setenv("CROWDSEC_KAFKA_PASSWORD", "second")
+	mechanism.(*passwordMechanism).password.Refresh = 0
+	_, ir, err = mechanism.Start(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "\x00crowdsec\x00second", string(ir))
+
+	_, err = newMechanism(&KafkaSASLConfiguration{Mechanism: "GSSAPI", Username: "crowdsec"}, log.WithField("type", "kafka"))
+	cstest.AssertErrorContains(t, err, "unsupported sasl.mechanism 'GSSAPI'")
+}
+
+// fakeReader is a reader of the messages pushed on its channel
+type fakeReader struct {
+	topics    []string
+	messages  chan kafka.Message
+	lock      sync.Mutex
+	committed []int64
+	closed    bool
+}
+
+func (r *fakeReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	select {
+	case msg := <-r.messages:
+		return msg, nil
+	case <-ctx.Done():
+		return kafka.Message{}, ctx.Err()
+	}
+}
+
+func (r *fakeReader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, msg := range msgs {
+		r.committed = append(r.committed, msg.Offset)
+	}
+	return nil
+}
+
+func (r *fakeReader) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.closed = true
+	return nil
+}
+
+func (r *fakeReader) state() ([]int64, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]int64{}, r.committed...), r.closed
+}
+
+// fakeCluster creates the fake readers, and lists the topics
+type fakeCluster struct {
+	lock    sync.Mutex
+	topics  []string
+	readers chan *fakeReader
+}
+
+func (c *fakeCluster) newReader(topics []string) reader {
+	r := &fakeReader{topics: topics, messages: make(chan kafka.Message)}
+	c.readers <- r
+	return r
+}
+
+func (c *fakeCluster) listTopics(ctx context.Context) ([]string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]string{}, c.topics...), nil
+}
+
+func (c *fakeCluster) setTopics(topics ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.topics = topics
+}
+
+func (c *fakeCluster) nextReader(t *testing.T) *fakeReader {
+	select {
+	case r := <-c.readers:
+		return r
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for reader")
+	}
+	return nil
+}
+
+func readEvent(t *testing.T, out chan types.Event) types.Event {
+	select {
+	case evt := <-out:
+		return evt
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for event")
+	}
+	return types.Event{}
+}
+
+func TestStreamingAcquisition(t *testing.T) {
+	k := KafkaSource{}
+	require.NoError(t, k.Configure([]byte(`
+brokers: ["localhost:9092"]
+topics: [alb, cloudfront]
+group_id: test-streaming
+labels:
+  type: aws-alb`), log.WithField("type", "kafka")))
+	cluster := &fakeCluster{readers: make(chan *fakeReader, 1)}
+	k.newReader = cluster.newReader
+
+	out := make(chan types.Event)
+	tmb := tomb.Tomb{}
+	require.NoError(t, k.StreamingAcquisition(out, &tmb))
+	r := cluster.nextReader(t)
+	assert.Equal(t, []string{"alb", "cloudfront"}, r.topics)
+
+	r.messages <- kafka.Message{Topic: "alb", Partition: 2, Offset: 41, HighWaterMark: 50, Key: []byte("lb-1"), Value: []byte("line 1")}
+	evt := readEvent(t, out)
+	assert.Equal(t, "line 1", evt.Line.Raw)
+	assert.Equal(t, "alb", evt.Line.Src)
+	assert.Equal(t, "aws-alb", evt.Line.Labels["type"])
+	assert.Equal(t, map[string]string{"kafka_topic": "alb", "kafka_partition": "2", "kafka_offset": "41", "kafka_key": "lb-1"}, evt.Meta)
+	r.messages <- kafka.Message{Topic: "alb", Partition: 2, Offset: 42, HighWaterMark: 50, Value: []byte("line 2")}
+	readEvent(t, out)
+	assert.Equal(t, float64(7), testutil.ToFloat64(consumerLag.WithLabelValues("test-streaming", "alb", "2")))
+
+	//the message not sent when stopping is not committed
+	r.messages <- kafka.Message{Topic: "alb", Partition: 2, Offset: 43, HighWaterMark: 50, Value: []byte("line 3")}
+	tmb.Kill(nil)
+	require.NoError(t, tmb.Wait())
+	committed, closed := r.state()
+	assert.Equal(t, []int64{41, 42}, committed)
+	assert.True(t, closed)
+}
+
+func TestTopicRegex(t *testing.T) {
+	k := KafkaSource{}
+	require.NoError(t, k.Configure([]byte(`
+brokers: ["localhost:9092"]
+topic_regex: ^logs-
+refresh_interval: 50ms`), log.WithField("type", "kafka")))
+	cluster := &fakeCluster{readers: make(chan *fakeReader, 1)}
+	cluster.setTopics("logs-b", "metrics", "logs-a", "__consumer_offsets")
+	k.newReader = cluster.newReader
+	k.listTopics = cluster.listTopics
+
+	out := make(chan types.Event)
+	tmb := tomb.Tomb{}
+	require.NoError(t, k.StreamingAcquisition(out, &tmb))
+	r := cluster.nextReader(t)
+	assert.Equal(t, []string{"logs-a", "logs-b"}, r.topics)
+
+	//a new topic matching the regex replaces the reader
+	cluster.setTopics("logs-b", "metrics", "logs-a", "logs-c")
+	next := cluster.nextReader(t)
+	assert.Equal(t, []string{"logs-a", "logs-b", "logs-c"}, next.topics)
+	_, closed := r.state()
+	assert.True(t, closed)
+
+	next.messages <- kafka.Message{Topic: "logs-c", Offset: 0, HighWaterMark: 1, Value: []byte("line")}
+	assert.Equal(t, "logs-c", readEvent(t, out).Line.Src)
+	tmb.Kill(nil)
+	require.NoError(t, tmb.Wait())
+}
+
+func TestConfigureByDSN(t *testing.T) {
+	tests := []struct {
+		dsn         string
+		expectedErr string
+	}{
+		{
+			dsn:         "kafka://",
+			expectedErr: "empty kafka:// DSN",
+		},
+		{
+			dsn:         "kafka://localhost:9092",
+			expectedErr: "topics or topic_regex is mandatory",
+		},
+		{
+			dsn:         "kafka://localhost:9092?topic=logs&group_id=test",
+			expectedErr: "unsupported key group_id in kafka DSN",
+		},
+		{
+			dsn:         "kafka://localhost:9092?topic=logs&since=yesterday",
+			expectedErr: "invalid since",
+		},
+		{
+			dsn:         "kafka://localhost:9092?topic=logs&mechanism=PLAIN",
+			expectedErr: "sasl.username is mandatory with PLAIN",
+		},
+		{
+			dsn:         "kafka://localhost:9092?topic=logs&tls=maybe",
+			expectedErr: "parsing 'tls' parameters",
+		},
+		{
+			dsn:         "kafka://kafka-1:9093,kafka-2:9093?topic=alb&topic=cloudfront&since=1h&mechanism=SCRAM-SHA-512&username=crowdsec&password=secret&insecure_skip_verify=true&log_level=debug",
+			expectedErr: "",
+		},
+	}
+	for _, test := range tests {
+		k := KafkaSource{}
+		err := k.ConfigureByDSN(test.dsn, map[string]string{"type": "aws-alb"}, log.WithField("type", "kafka"))
+		cstest.AssertErrorContains(t, err, test.expectedErr)
+	}
+	k := KafkaSource{}
+	require.NoError(t, k.ConfigureByDSN("kafka://kafka-1:9093,kafka-2:9093?topic=alb&since=1h&tls=true", nil, log.WithField("type", "kafka")))
+	assert.Equal(t, "cat", k.GetMode())
+	assert.Equal(t, []string{"kafka-1:9093", "kafka-2:9093"}, k.config.Brokers)
+	assert.Equal(t, []string{"alb"}, k.config.Topics)
+	assert.WithinDuration(t, time.Now().Add(-time.Hour), k.since, time.Minute)
+	require.NotNil(t, k.dialer.TLS)
+	assert.False(t, k.dialer.TLS.InsecureSkipVerify)
+	assert.Nil(t, k.dialer.SASLMechanism)
+}
+
+// fakePartitionReader reads the messages of a partition, and blocks after the last one
+type fakePartitionReader struct {
+	messages []kafka.Message
+	offset   int64
+}
+
+func (r *fakePartitionReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	for _, msg := range r.messages {
+		if msg.Offset >= r.offset {
+			r.offset = msg.Offset + 1
+			return msg, nil
+		}
+	}
+	<-ctx.Done()
+	return kafka.Message{}, ctx.Err()
+}
+
+func (r *fakePartitionReader) SetOffset(offset int64) error {
+	r.offset = offset
+	return nil
+}
+
+func (r *fakePartitionReader) Close() error {
+	return nil
+}
+
+func TestOneShotAcquisition(t *testing.T) {
+	k := KafkaSource{}
+	require.NoError(t, k.ConfigureByDSN("kafka://localhost:9092?topic=alb&topic=cloudfront", nil, log.WithField("type", "kafka")))
+	timeout := 100 * time.Millisecond
+	k.config.Timeout = &timeout
+	partitions := map[string][]partitionRange{
+		//the messages before 1 were deleted, the message 3 is not there anymore when the replay starts
+		"alb": {{partition: 0, start: 1, end: 3}, {partition: 1, start: 0, end: 0}},
+		//the last offset is a transaction marker
+		"cloudfront": {{partition: 0, start: 0, end: 2}},
+	}
+	messages := map[string][]kafka.Message{
+		"alb/0": {
+			{Topic: "alb", Offset: 1, Value: []byte("alb 1")},
+			{Topic: "alb", Offset: 2, Value: []byte("alb 2")},
+			{Topic: "alb", Offset: 3, Value: []byte("alb 3")},
+		},
+		"cloudfront/0": {
+			{Topic: "cloudfront", Offset: 0, Value: []byte("cloudfront 0")},
+		},
+	}
+	k.listPartitions = func(ctx context.Context, topic string) ([]partitionRange, error) {
+		return partitions[topic], nil
+	}
+	k.newPartitionReader = func(topic string, partition int) partitionReader {
+		return &fakePartitionReader{messages: messages[fmt.Sprintf("%s/%d", topic, partition)]}
+	}
+	out := make(chan types.Event, 10)
+	tmb := tomb.Tomb{}
+	require.NoError(t, k.OneShotAcquisition(out, &tmb))
+	require.Len(t, out, 3)
+	for _, expected := range []string{"alb 1", "alb 2", "cloudfront 0"} {
+		evt := <-out
+		assert.Equal(t, expected, evt.Line.Raw)
+		assert.Equal(t, leaky.TIMEMACHINE, evt.ExpectMode)
+	}
+}
@@ -0,0 +1,110 @@
+package kafkaacquisition
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/secrets"
+	"github.com/pkg/errors"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+	log "github.com/sirupsen/logrus"
+)
+
+// newMechanism returns the SASL mechanism used to authenticate to the brokers
+func newMechanism(config *KafkaSASLConfiguration, logger *log.Entry) (sasl.Mechanism, error) {
+	mechanism := strings.ToUpper(config.Mechanism)
+	if mechanism == "OAUTHBEARER" {
+		if config.Token == "" {
+			return nil, fmt.Errorf("sasl.token is mandatory with OAUTHBEARER")
+		}
+		if config.Username != "" || config.Password != "" {
+			return nil, fmt.Errorf("sasl.username and sasl.password are not used with OAUTHBEARER")
+		}
+		if _, err := secrets.Resolve(config.Token); err != nil {
+			return nil, errors.Wrap(err, "invalid sasl.token")
+		}
+		return &oauthBearer{token: config.Token}, nil
+	}
+	if config.Username == "" {
+		return nil, fmt.Errorf("sasl.username is mandatory with %s", config.Mechanism)
+	}
+	if config.Token != "" {
+		return nil, fmt.Errorf("sasl.token is only used with OAUTHBEARER")
+	}
+	password, err := secrets.NewSecret(config.Password, logger)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid sasl.password")
+	}
+	var build func(password string) (sasl.Mechanism, error)
+	switch mechanism {
+	case "PLAIN":
+		build = func(password string) (sasl.Mechanism, error) {
+			return plain.Mechanism{Username: config.Username, Password: password}, nil
+		}
+	case "SCRAM-SHA-256":
+		build = func(password string) (sasl.Mechanism, error) {
+			return scram.Mechanism(scram.SHA256, config.Username, password)
+		}
+	case "SCRAM-SHA-512":
+		build = func(password string) (sasl.Mechanism, error) {
+			return scram.Mechanism(scram.SHA512, config.Username, password)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported sasl.mechanism '%s', must be PLAIN, SCRAM-SHA-256, SCRAM-SHA-512 or OAUTHBEARER", config.Mechanism)
+	}
+	if _, err := build(password.Get()); err != nil {
+		return nil, err
+	}
+	return &passwordMechanism{name: mechanism, password: password, build: build}, nil
+}
+
+// passwordMechanism builds the PLAIN or SCRAM mechanism with the current password at each authentication, so that a
+// rotated password is picked up by the next connections
+type passwordMechanism struct {
+	name     string
+	password *secrets.Secret
+	build    func(password string) (sasl.Mechanism, error)
+}
+
+func (p *passwordMechanism) Name() string {
+	return p.name
+}
+
+func (p *passwordMechanism) Start(ctx context.Context) (sasl.StateMachine, []byte, error) {
+	mechanism, err := p.build(p.password.Get())
+	if err != nil {
+		return nil, nil, err
+	}
+	return mechanism.Start(ctx)
+}
+
+// oauthBearer is the OAUTHBEARER mechanism (RFC 7628) with a token obtained outside of crowdsec, eg. written to a
+// file by a sidecar which renews it
+type oauthBearer struct {
+	token string
+}
+
+func (o *oauthBearer) Name() string {
+	return "OAUTHBEARER"
+}
+
+func (o *oauthBearer) Start(ctx context.Context) (sasl.StateMachine, []byte, error) {
+	token, err := secrets.Resolve(o.token)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "while reading sasl.token")
+	}
+	//gs2 header without authorization identity, then the bearer token
+	return o, []byte("n,,\x01auth=Bearer " + strings.TrimSpace(token) + "\x01\x01"), nil
+}
+
+// Next handles the answer of the broker : nothing when the token is accepted, else a json error to acknowledge
+// before the authentication fails
+func (o *oauthBearer) Next(ctx context.Context, challenge []byte) (bool, []byte, error) {
+	if len(challenge) != 0 {
+		return false, []byte("\x01"), fmt.Errorf("token rejected : %s", challenge)
+	}
+	return true, nil, nil
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -14,6 +15,8 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/kinesis"
 	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/retry"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/secrets"
 	"github.com/crowdsecurity/crowdsec/pkg/leakybucket"
 	"github.com/crowdsecurity/crowdsec/pkg/types"
 	"github.com/pkg/errors"
@@ -34,12 +37,17 @@ type KinesisConfiguration struct {
 	ConsumerName                      string  `yaml:"consumer_name"`
 	FromSubscription                  bool    `yaml:"from_subscription"`
 	MaxRetries                        int     `yaml:"max_retries"`
+	AwsAccessKeyID                    string  `yaml:"aws_access_key_id"` //static keys, instead of the profile : can be env://, file:// or vault:// references
+	AwsSecretAccessKey                string  `yaml:"aws_secret_access_key"`
+	AwsSessionToken                   string  `yaml:"aws_session_token"`
 }
 
 type KinesisSource struct {
+	configuration.HealthTracker
 	Config          KinesisConfiguration
 	logger          *log.Entry
 	kClient         *kinesis.Kinesis
+	retrier         *retry.Retrier
 	shardReaderTomb *tomb.Tomb
 }
 
@@ -98,6 +106,13 @@ func (k *KinesisSource) newClient() error {
 	if k.Config.AwsEndpoint != "" {
 		config = config.WithEndpoint(k.Config.AwsEndpoint)
 	}
+	if k.Config.AwsAccessKeyID != "" || k.Config.AwsSecretAccessKey != "" {
+		creds, err := secrets.NewAWSCredentials(k.Config.AwsAccessKeyID, k.Config.AwsSecretAccessKey, k.Config.AwsSessionToken)
+		if err != nil {
+			return errors.Wrap(err, "invalid aws credentials")
+		}
+		config = config.WithCredentials(creds)
+	}
 	k.kClient = kinesis.New(sess, config)
 	if k.kClient == nil {
 		return fmt.Errorf("failed to create kinesis client")
@@ -143,10 +158,47 @@ func (k *KinesisSource) Configure(yamlConfig []byte, logger *log.Entry) error {
 	if err != nil {
 		return errors.Wrap(err, "Cannot create kinesis client")
 	}
+	k.retrier, err = retry.New(k.Config.Retry, k.logger)
+	if err != nil {
+		return err
+	}
+	k.retrier.Notify = k.notifyRetry
 	k.shardReaderTomb = &tomb.Tomb{}
 	return nil
 }
 
+//notifyRetry reports the failing calls to the kinesis api in the health of the datasource
+func (k *KinesisSource) notifyRetry(err error) {
+	if err != nil {
+		k.SetState(configuration.STATUS_RECONNECTING, err)
+	} else {
+		k.SetState(configuration.STATUS_RUNNING, nil)
+	}
+}
+
+//listShards lists the shards of the stream, retrying according to the retry policy of the datasource
+func (k *KinesisSource) listShards(streamName string, dying <-chan struct{}) ([]*kinesis.Shard, error) {
+	ret := []*kinesis.Shard{}
+	input := &kinesis.ListShardsInput{StreamName: aws.String(streamName)}
+	for {
+		var page *kinesis.ListShardsOutput
+		err := k.retrier.Do(dying, func() error {
+			var err error
+			page, err = k.kClient.ListShards(input)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, page.Shards...)
+		if page.NextToken == nil {
+			return ret, nil
+		}
+		//the stream name can't be given with the token
+		input = &kinesis.ListShardsInput{NextToken: page.NextToken}
+	}
+}
+
 func (k *KinesisSource) ConfigureByDSN(string, map[string]string, *log.Entry) error {
 	return fmt.Errorf("kinesis datasource does not support command-line acquisition")
 }
@@ -159,6 +211,10 @@ func (k *KinesisSource) GetName() string {
 	return "kinesis"
 }
 
+func (k *KinesisSource) GetUuid() string {
+	return k.Config.UniqueId
+}
+
 func (k *KinesisSource) OneShotAcquisition(out chan types.Event, t *tomb.Tomb) error {
 	return fmt.Errorf("kinesis datasource does not support one-shot acquisition")
 }
@@ -302,63 +358,184 @@ func (k *KinesisSource) ParseAndPushRecords(records []*kinesis.Record, out chan
 			} else {
 				evt = types.Event{Line: l, Process: true, Type: types.LOG, ExpectMode: leakybucket.TIMEMACHINE}
 			}
+			k.EventSeen(&evt.Line)
 			out <- evt
 		}
 	}
 }
 
-func (k *KinesisSource) ReadFromSubscription(reader kinesis.SubscribeToShardEventStreamReader, out chan types.Event, shardId string, streamName string) error {
-	logger := k.logger.WithFields(log.Fields{"shard_id": shardId})
-	//ghetto sync, kinesis allows to subscribe to a closed shard, which will make the goroutine exit immediately
-	//and we won't be able to start a new one if this is the first one started by the tomb
-	//TODO: look into parent shards to see if a shard is closed before starting to read it ?
-	time.Sleep(time.Second)
+// shardTracker follows the shards read with enhanced fan-out. When a resharding closes a shard, its children are read
+// once all their parents that were read are closed, so that the records of a partition key stay in order
+type shardTracker struct {
+	lock    sync.Mutex
+	started map[string]bool
+	closed  map[string]bool
+}
+
+func newShardTracker() *shardTracker {
+	return &shardTracker{started: map[string]bool{}, closed: map[string]bool{}}
+}
+
+// start tells if a shard must be read, ie. it is not read yet
+func (s *shardTracker) start(shardId string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.started[shardId] {
+		return false
+	}
+	s.started[shardId] = true
+	return true
+}
+
+// close marks a shard as read entirely, and returns its children that can be read now
+func (s *shardTracker) close(shardId string, children []*kinesis.ChildShard) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed[shardId] = true
+	ready := []string{}
+	for _, child := range children {
+		childId := aws.StringValue(child.ShardId)
+		if s.started[childId] {
+			continue
+		}
+		waiting := false
+		for _, parent := range child.ParentShards {
+			//a parent that was not read, because it was closed before crowdsec started, is not waited for
+			if id := aws.StringValue(parent); s.started[id] && !s.closed[id] {
+				waiting = true
+			}
+		}
+		if !waiting {
+			s.started[childId] = true
+			ready = append(ready, childId)
+		}
+	}
+	return ready
+}
+
+// subscribeToShard starts a subscription of the consumer to a shard. The subscriptions of a shard are limited to
+// one per second, and a new one fails while the previous one is not closed : both are retried
+func (k *KinesisSource) subscribeToShard(consumerARN *string, shardId string, position *kinesis.StartingPosition) (*kinesis.SubscribeToShardEventStream, error) {
+	var stream *kinesis.SubscribeToShardEventStream
+	err := k.retrier.Do(k.shardReaderTomb.Dying(), func() error {
+		output, err := k.kClient.SubscribeToShard(&kinesis.SubscribeToShardInput{
+			ShardId:          aws.String(shardId),
+			StartingPosition: position,
+			ConsumerARN:      consumerARN,
+		})
+		if err != nil {
+			switch err.(type) {
+			case *kinesis.LimitExceededException, *kinesis.ResourceInUseException:
+				return err
+			}
+			return retry.Permanent(err)
+		}
+		stream = output.GetEventStream()
+		return nil
+	})
+	return stream, err
+}
+
+// readSubscription sends the records of a subscription until it expires (after 5 minutes), fails, or the shard is
+// closed. It returns the sequence number to resubscribe after, and the children of the shard if it was closed
+func (k *KinesisSource) readSubscription(stream *kinesis.SubscribeToShardEventStream, out chan types.Event, logger *log.Entry, shardId string) (string, []*kinesis.ChildShard, bool) {
+	defer stream.Close()
+	continuation := ""
 	for {
 		select {
 		case <-k.shardReaderTomb.Dying():
-			logger.Infof("Subscribed shard reader is dying")
-			err := reader.Close()
-			if err != nil {
-				return errors.Wrap(err, "Cannot close kinesis subscribed shard reader")
-			}
-			return nil
-		case event, ok := <-reader.Events():
+			return continuation, nil, false
+		case event, ok := <-stream.Events():
 			if !ok {
-				logger.Infof("Event chan has been closed")
-				return nil
+				if err := stream.Err(); err != nil {
+					logger.Warningf("subscription to shard failed, resubscribing : %s", err)
+				} else {
+					logger.Debugf("subscription to shard expired, resubscribing")
+				}
+				return continuation, nil, false
 			}
 			switch event := event.(type) {
 			case *kinesis.SubscribeToShardEvent:
 				k.ParseAndPushRecords(event.Records, out, logger, shardId)
+				if event.ContinuationSequenceNumber != nil {
+					continuation = *event.ContinuationSequenceNumber
+				}
+				//the last event of a closed shard has its children, and no continuation
+				if event.ContinuationSequenceNumber == nil && len(event.ChildShards) != 0 {
+					return continuation, event.ChildShards, true
+				}
 			case *kinesis.SubscribeToShardEventStreamUnknownEvent:
-				logger.Infof("got an unknown event, what to do ?")
+				logger.Debugf("ignoring unknown event %s", event.Type)
 			}
 		}
 	}
 }
 
-func (k *KinesisSource) SubscribeToShards(arn arn.ARN, streamConsumer *kinesis.RegisterStreamConsumerOutput, out chan types.Event) error {
-	shards, err := k.kClient.ListShards(&kinesis.ListShardsInput{
-		StreamName: aws.String(arn.Resource[7:]),
-	})
+// readSubscribedShard reads a shard with enhanced fan-out from position, resubscribing after the last record read
+// when a subscription ends. When the shard is closed, its children are read from their first record
+func (k *KinesisSource) readSubscribedShard(consumerARN *string, shardId string, position *kinesis.StartingPosition, tracker *shardTracker, out chan types.Event) error {
+	logger := k.logger.WithFields(log.Fields{"shard_id": shardId})
+	logger.Debugf("reading shard from %s", aws.StringValue(position.Type))
+	for {
+		stream, err := k.subscribeToShard(consumerARN, shardId, position)
+		if err == retry.ErrDying {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(err, "Cannot subscribe to shard %s", shardId)
+		}
+		k.SetState(configuration.STATUS_RUNNING, nil)
+		continuation, children, closed := k.readSubscription(stream, out, logger, shardId)
+		if closed {
+			logger.Infof("shard has been closed")
+			for _, childId := range tracker.close(shardId, children) {
+				childId := childId
+				k.shardReaderTomb.Go(func() error {
+					defer types.CatchPanic("crowdsec/acquis/kinesis/streaming/subscription")
+					return k.readSubscribedShard(consumerARN, childId, &kinesis.StartingPosition{Type: aws.String(kinesis.ShardIteratorTypeTrimHorizon)}, tracker, out)
+				})
+			}
+			return nil
+		}
+		select {
+		case <-k.shardReaderTomb.Dying():
+			return nil
+		default:
+		}
+		if continuation != "" {
+			position = &kinesis.StartingPosition{
+				Type:           aws.String(kinesis.ShardIteratorTypeAfterSequenceNumber),
+				SequenceNumber: aws.String(continuation),
+			}
+		}
+	}
+}
+
+// SubscribeToShards reads the open shards of the stream with enhanced fan-out, from their latest records
+func (k *KinesisSource) SubscribeToShards(arn arn.ARN, streamConsumer *kinesis.RegisterStreamConsumerOutput, out chan types.Event, t *tomb.Tomb) error {
+	shards, err := k.listShards(arn.Resource[7:], t.Dying())
 	if err != nil {
 		return errors.Wrap(err, "Cannot list shards for enhanced_read")
 	}
-
-	for _, shard := range shards.Shards {
-		shardId := *shard.ShardId
-		r, err := k.kClient.SubscribeToShard(&kinesis.SubscribeToShardInput{
-			ShardId:          aws.String(shardId),
-			StartingPosition: &kinesis.StartingPosition{Type: aws.String(kinesis.ShardIteratorTypeLatest)},
-			ConsumerARN:      streamConsumer.Consumer.ConsumerARN,
-		})
-		if err != nil {
-			return errors.Wrap(err, "Cannot subscribe to shard")
+	tracker := newShardTracker()
+	//the readers are started from a tracked goroutine, so that the tomb isn't dead if the first ones fail right away
+	k.shardReaderTomb.Go(func() error {
+		for _, shard := range shards {
+			shardId := *shard.ShardId
+			if shard.SequenceNumberRange != nil && shard.SequenceNumberRange.EndingSequenceNumber != nil {
+				//closed by a resharding, its children are open
+				continue
+			}
+			if !tracker.start(shardId) {
+				continue
+			}
+			k.shardReaderTomb.Go(func() error {
+				defer types.CatchPanic("crowdsec/acquis/kinesis/streaming/subscription")
+				return k.readSubscribedShard(streamConsumer.Consumer.ConsumerARN, shardId, &kinesis.StartingPosition{Type: aws.String(kinesis.ShardIteratorTypeLatest)}, tracker, out)
+			})
 		}
-		k.shardReaderTomb.Go(func() error {
-			return k.ReadFromSubscription(r.GetEventStream().Reader, out, shardId, arn.Resource[7:])
-		})
-	}
+		return nil
+	})
 	return nil
 }
 
@@ -386,10 +563,15 @@ func (k *KinesisSource) EnhancedRead(out chan types.Event, t *tomb.Tomb) error {
 	for {
 		k.shardReaderTomb = &tomb.Tomb{}
 
-		err = k.SubscribeToShards(parsedARN, streamConsumer, out)
+		err = k.SubscribeToShards(parsedARN, streamConsumer, out, t)
+		if err == retry.ErrDying {
+			k.logger.Infof("Kinesis source is dying")
+			return k.DeregisterConsumer()
+		}
 		if err != nil {
 			return errors.Wrap(err, "Cannot subscribe to shards")
 		}
+		k.SetState(configuration.STATUS_RUNNING, nil)
 		select {
 		case <-t.Dying():
 			k.logger.Infof("Kinesis source is dying")
@@ -405,8 +587,9 @@ func (k *KinesisSource) EnhancedRead(out chan types.Event, t *tomb.Tomb) error {
 			if k.shardReaderTomb.Err() != nil {
 				return k.shardReaderTomb.Err()
 			}
-			//All goroutines have exited without error, so a resharding event, start again
-			k.logger.Debugf("All reader goroutines have exited, resharding event or periodic resubscribe")
+			//All goroutines have exited without error : the shards were closed without children to read, list them again
+			k.logger.Debugf("All reader goroutines have exited, listing the shards again")
+			k.SetState(configuration.STATUS_RECONNECTING, nil)
 			continue
 		}
 	}
@@ -428,14 +611,23 @@ func (k *KinesisSource) ReadFromShard(out chan types.Event, shardId string) erro
 	for {
 		select {
 		case <-ticker.C:
-			records, err := k.kClient.GetRecords(&kinesis.GetRecordsInput{ShardIterator: it})
-			it = records.NextShardIterator
+			var records *kinesis.GetRecordsOutput
+			//only the throttled calls are retried, the other errors are handled below
+			err := k.retrier.Do(k.shardReaderTomb.Dying(), func() error {
+				var err error
+				records, err = k.kClient.GetRecords(&kinesis.GetRecordsInput{ShardIterator: it})
+				if _, ok := err.(*kinesis.ProvisionedThroughputExceededException); err != nil && !ok {
+					return retry.Permanent(err)
+				}
+				return err
+			})
+			if err == retry.ErrDying {
+				logger.Infof("shardReaderTomb is dying, exiting ReadFromShard")
+				ticker.Stop()
+				return nil
+			}
 			if err != nil {
-				switch err.(type) {
-				case *kinesis.ProvisionedThroughputExceededException:
-					logger.Warn("Provisioned throughput exceeded")
-					//TODO: implement exponential backoff
-					continue
+				switch errors.Cause(err).(type) {
 				case *kinesis.ExpiredIteratorException:
 					logger.Warn("Expired iterator")
 					continue
@@ -444,6 +636,7 @@ func (k *KinesisSource) ReadFromShard(out chan types.Event, shardId string) erro
 					return errors.Wrap(err, "Cannot get records")
 				}
 			}
+			it = records.NextShardIterator
 			k.ParseAndPushRecords(records.Records, out, logger, shardId)
 
 			if it == nil {
@@ -462,14 +655,17 @@ func (k *KinesisSource) ReadFromStream(out chan types.Event, t *tomb.Tomb) error
 	k.logger = k.logger.WithFields(log.Fields{"stream": k.Config.StreamName})
 	k.logger.Info("starting kinesis acquisition from shards")
 	for {
-		shards, err := k.kClient.ListShards(&kinesis.ListShardsInput{
-			StreamName: aws.String(k.Config.StreamName),
-		})
+		shards, err := k.listShards(k.Config.StreamName, t.Dying())
+		if err == retry.ErrDying {
+			k.logger.Info("kinesis source is dying")
+			return nil
+		}
 		if err != nil {
 			return errors.Wrap(err, "Cannot list shards")
 		}
+		k.SetState(configuration.STATUS_RUNNING, nil)
 		k.shardReaderTomb = &tomb.Tomb{}
-		for _, shard := range shards.Shards {
+		for _, shard := range shards {
 			shardId := *shard.ShardId
 			k.shardReaderTomb.Go(func() error {
 				defer types.CatchPanic("crowdsec/acquis/kinesis/streaming/shard")
@@ -489,6 +685,7 @@ func (k *KinesisSource) ReadFromStream(out chan types.Event, t *tomb.Tomb) error
 				return reason
 			}
 			k.logger.Infof("All shards have been closed, probably a resharding event, restarting acquisition")
+			k.SetState(configuration.STATUS_RECONNECTING, nil)
 			continue
 		}
 	}
@@ -497,11 +694,16 @@ func (k *KinesisSource) ReadFromStream(out chan types.Event, t *tomb.Tomb) error
 func (k *KinesisSource) StreamingAcquisition(out chan types.Event, t *tomb.Tomb) error {
 	t.Go(func() error {
 		defer types.CatchPanic("crowdsec/acquis/kinesis/streaming")
+		var err error
 		if k.Config.UseEnhancedFanOut {
-			return k.EnhancedRead(out, t)
+			err = k.EnhancedRead(out, t)
 		} else {
-			return k.ReadFromStream(out, t)
+			err = k.ReadFromStream(out, t)
+		}
+		if err != nil {
+			k.SetState(configuration.STATUS_ERRORED, err)
 		}
+		return err
 	})
 	return nil
 }
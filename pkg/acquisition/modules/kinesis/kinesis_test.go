@@ -332,3 +332,25 @@ use_enhanced_fanout: true`,
 	}
 }
 */
+
+func TestShardTracker(t *testing.T) {
+	child := func(id string, parents ...string) *kinesis.ChildShard {
+		return &kinesis.ChildShard{ShardId: aws.String(id), ParentShards: aws.StringSlice(parents)}
+	}
+	tracker := newShardTracker()
+	assert.True(t, tracker.start("shard-1"))
+	assert.True(t, tracker.start("shard-2"))
+	assert.True(t, tracker.start("shard-3"))
+	assert.False(t, tracker.start("shard-1"))
+
+	//a split : both children are read right away
+	assert.Equal(t, []string{"shard-4", "shard-5"}, tracker.close("shard-1", []*kinesis.ChildShard{child("shard-4", "shard-1"), child("shard-5", "shard-1")}))
+	assert.False(t, tracker.start("shard-4"))
+
+	//a merge : the child is read once both parents are closed
+	assert.Equal(t, []string{}, tracker.close("shard-2", []*kinesis.ChildShard{child("shard-6", "shard-2", "shard-3")}))
+	assert.Equal(t, []string{"shard-6"}, tracker.close("shard-3", []*kinesis.ChildShard{child("shard-6", "shard-2", "shard-3")}))
+
+	//the parents that were not read are not waited for
+	assert.Equal(t, []string{"shard-7"}, tracker.close("shard-6", []*kinesis.ChildShard{child("shard-7", "shard-0", "shard-6")}))
+}
@@ -0,0 +1,313 @@
+package kubernetesacquisition
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/retry"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/secrets"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/tomb.v2"
+	"gopkg.in/yaml.v2"
+)
+
+var linesRead = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cs_kubernetessource_hits_total",
+		Help: "Total lines that were read from the logs of the pods.",
+	},
+	[]string{"namespace"})
+
+var (
+	defaultTimeout = 30 * time.Second
+	//how long an interrupted log stream of a running container waits before being opened again
+	reopenDelay = 5 * time.Second
+)
+
+// serviceAccountDir holds the token and the CA of the api server when crowdsec runs in a pod
+var serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+var namespaceRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+type KubernetesConfiguration struct {
+	configuration.DataSourceCommonCfg `yaml:",inline"`
+	APIServer                         string         `yaml:"api_server"` //https://host:port, from the environment of the service account when crowdsec runs in the cluster
+	Token                             string         `yaml:"token"`      //can be env://, file:// or vault:// references, read again for each request as the service account tokens are renewed
+	CACert                            string         `yaml:"ca_cert"`
+	InsecureSkipVerify                bool           `yaml:"insecure_skip_verify"`
+	Namespaces                        []string       `yaml:"namespaces"`     //all namespaces if empty
+	LabelSelector                     string         `yaml:"label_selector"` //eg. app=nginx,tier in (frontend,edge)
+	Containers                        []string       `yaml:"containers"`     //only read these containers of the pods, all of them if empty
+	Since                             string         `yaml:"since"`          //of the containers running at startup, now by default. The new containers are read from their start
+	Timeout                           *time.Duration `yaml:"timeout"`        //of the requests listing the pods
+}
+
+// KubernetesSource follows the logs of the containers of the pods matching the selectors. The pods are watched, so
+// that the new pods are read from their start, and the end of the logs of a restarted container isn't lost.
+// In cat mode (k8s:// DSN), the logs of the containers of the pods matching the selectors are read from since up to
+// now, one container after the other
+type KubernetesSource struct {
+	configuration.HealthTracker
+	config     KubernetesConfiguration
+	logger     *log.Entry
+	client     *http.Client
+	retrier    *retry.Retrier
+	containers map[string]bool
+	since      time.Time
+	started    time.Time //the containers started before the acquisition are read from since
+}
+
+func (k *KubernetesSource) GetMetrics() []prometheus.Collector {
+	return []prometheus.Collector{linesRead}
+}
+
+func (k *KubernetesSource) GetAggregMetrics() []prometheus.Collector {
+	return []prometheus.Collector{linesRead}
+}
+
+func (k *KubernetesSource) Configure(yamlConfig []byte, logger *log.Entry) error {
+	k.logger = logger
+	config := KubernetesConfiguration{}
+	if err := yaml.UnmarshalStrict(yamlConfig, &config); err != nil {
+		return errors.Wrap(err, "Cannot parse kubernetes datasource configuration")
+	}
+	if config.Mode == "" {
+		config.Mode = configuration.TAIL_MODE
+	}
+	if config.Mode != configuration.TAIL_MODE {
+		return fmt.Errorf("unsupported mode %s for kubernetes datasource", config.Mode)
+	}
+	return k.configure(config)
+}
+
+// configure checks the configuration and sets the defaults, for Configure and ConfigureByDSN
+func (k *KubernetesSource) configure(config KubernetesConfiguration) error {
+	inCluster := false
+	if config.APIServer == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return fmt.Errorf("api_server is mandatory when crowdsec doesn't run in the cluster")
+		}
+		config.APIServer = "https://" + net.JoinHostPort(host, port)
+		inCluster = true
+	}
+	if _, err := url.Parse(config.APIServer); err != nil {
+		return errors.Wrapf(err, "invalid api_server %s", config.APIServer)
+	}
+	config.APIServer = strings.TrimSuffix(config.APIServer, "/")
+	if inCluster && config.Token == "" {
+		config.Token = secrets.FILE_SCHEME + serviceAccountDir + "/token"
+	}
+	if inCluster && config.CACert == "" {
+		config.CACert = serviceAccountDir + "/ca.crt"
+	}
+	if config.Token != "" {
+		if _, err := secrets.Resolve(config.Token); err != nil {
+			return errors.Wrap(err, "invalid token")
+		}
+	}
+	for _, namespace := range config.Namespaces {
+		if !namespaceRegexp.MatchString(namespace) {
+			return fmt.Errorf("invalid namespace '%s'", namespace)
+		}
+	}
+	k.containers = make(map[string]bool)
+	for _, container := range config.Containers {
+		k.containers[container] = true
+	}
+	var err error
+	if k.since, err = configuration.ParseTime(config.Since); err != nil {
+		return errors.Wrap(err, "invalid since")
+	}
+	if config.Timeout == nil {
+		config.Timeout = &defaultTimeout
+	}
+	if *config.Timeout <= 0 {
+		return fmt.Errorf("timeout must be positive")
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify}
+	if config.CACert != "" {
+		pem, err := ioutil.ReadFile(config.CACert)
+		if err != nil {
+			return errors.Wrapf(err, "while reading ca_cert %s", config.CACert)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in ca_cert %s", config.CACert)
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+	//no timeout on the client : the watches and the log streams stay open
+	k.client = &http.Client{Transport: transport}
+	k.retrier, err = retry.New(config.Retry, k.logger)
+	if err != nil {
+		return err
+	}
+	k.retrier.Notify = k.notifyRetry
+	k.config = config
+	return nil
+}
+
+// notifyRetry reports the failing requests to the api server in the health of the datasource
+func (k *KubernetesSource) notifyRetry(err error) {
+	if err != nil {
+		k.SetState(configuration.STATUS_RECONNECTING, err)
+	} else {
+		k.SetState(configuration.STATUS_RUNNING, nil)
+	}
+}
+
+func (k *KubernetesSource) ConfigureByDSN(dsn string, labels map[string]string, logger *log.Entry) error {
+	k.logger = logger
+	//format for the DSN is : k8s://namespace1,namespace2?label_selector=...&since=... , or k8s:// for all the namespaces
+	parsed, err := configuration.ParseDSN(dsn, "k8s", "kubernetes")
+	if err != nil {
+		return err
+	}
+	if err := parsed.CheckParams("label_selector", "container", "since", "api_server", "token", "ca_cert", "insecure_skip_verify"); err != nil {
+		return err
+	}
+	if err := parsed.SetLogLevel(k.logger); err != nil {
+		return err
+	}
+	config := KubernetesConfiguration{}
+	config.Mode = configuration.CAT_MODE
+	config.Labels = labels
+	if parsed.Target != "" {
+		config.Namespaces = strings.Split(parsed.Target, ",")
+	}
+	config.Containers = parsed.Params["container"]
+	for key, value := range map[string]*string{
+		"label_selector": &config.LabelSelector,
+		"since":          &config.Since,
+		"api_server":     &config.APIServer,
+		"token":          &config.Token,
+		"ca_cert":        &config.CACert,
+	} {
+		if *value, err = parsed.Param(key); err != nil {
+			return err
+		}
+	}
+	if insecure, err := parsed.Param("insecure_skip_verify"); err != nil {
+		return err
+	} else if insecure != "" {
+		if config.InsecureSkipVerify, err = strconv.ParseBool(insecure); err != nil {
+			return fmt.Errorf("parsing 'insecure_skip_verify' parameters: %s", err)
+		}
+	}
+	return k.configure(config)
+}
+
+func (k *KubernetesSource) GetMode() string {
+	return k.config.Mode
+}
+
+func (k *KubernetesSource) GetName() string {
+	return "kubernetes"
+}
+
+func (k *KubernetesSource) GetUuid() string {
+	return k.config.UniqueId
+}
+
+func (k *KubernetesSource) OneShotAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	k.started = time.Now().UTC()
+	scopes := k.config.Namespaces
+	if len(scopes) == 0 {
+		scopes = []string{""}
+	}
+	for _, scope := range scopes {
+		k.logger.Infof("reading the logs of the pods of %s", scopeName(scope))
+		err := k.replayPods(scope, out, t)
+		if err == retry.ErrDying {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(err, "while reading the logs of the pods of %s", scopeName(scope))
+		}
+	}
+	t.Kill(nil)
+	return nil
+}
+
+func (k *KubernetesSource) CanRun() error {
+	return nil
+}
+
+func (k *KubernetesSource) Dump() interface{} {
+	return k
+}
+
+// get sends a request to the api server. The errors of the response are returned, the body of a successful one
+// must be closed by the caller
+func (k *KubernetesSource) get(ctx context.Context, path string, params url.Values) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, k.config.APIServer+path+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, retry.Permanent(err)
+	}
+	if k.config.Token != "" {
+		token, err := secrets.Resolve(k.config.Token)
+		if err != nil {
+			return nil, errors.Wrap(err, "while reading token")
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(token))
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := retry.CheckResponse(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (k *KubernetesSource) StreamingAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	k.started = time.Now().UTC()
+	if k.since.IsZero() {
+		k.since = k.started
+	}
+	scopes := k.config.Namespaces
+	if len(scopes) == 0 {
+		scopes = []string{""}
+	}
+	events := make(chan podEvent)
+	for _, scope := range scopes {
+		scope := scope
+		t.Go(func() error {
+			defer types.CatchPanic("crowdsec/acquis/kubernetes/watch")
+			err := k.watchPods(scope, events, t.Dying())
+			if err == retry.ErrDying || err == nil {
+				return nil
+			}
+			err = errors.Wrapf(err, "while watching pods of %s", scopeName(scope))
+			k.SetState(configuration.STATUS_ERRORED, err)
+			return err
+		})
+	}
+	t.Go(func() error {
+		defer types.CatchPanic("crowdsec/acquis/kubernetes/live")
+		k.managePods(events, out, t.Dying())
+		k.logger.Infof("kubernetes datasource stopping")
+		return nil
+	})
+	return nil
+}
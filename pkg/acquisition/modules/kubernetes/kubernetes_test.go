@@ -0,0 +1,412 @@
+package kubernetesacquisition
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/cstest"
+	leaky "github.com/crowdsecurity/crowdsec/pkg/leakybucket"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/tomb.v2"
+)
+
+func TestConfigure(t *testing.T) {
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+	tests := []struct {
+		config      string
+		expectedErr string
+	}{
+		{
+			config:      `foobar: bla`,
+			expectedErr: "field foobar not found in type kubernetesacquisition.KubernetesConfiguration",
+		},
+		{
+			config:      `namespaces: [default]`,
+			expectedErr: "api_server is mandatory when crowdsec doesn't run in the cluster",
+		},
+		{
+			config: `
+api_server: https://10.0.0.1:6443
+mode: cat`,
+			expectedErr: "unsupported mode cat for kubernetes datasource",
+		},
+		{
+			config: `
+api_server: https://10.0.0.1:6443
+namespaces: [Default]`,
+			expectedErr: "invalid namespace 'Default'",
+		},
+		{
+			config: `
+api_server: https://10.0.0.1:6443
+token: env://CROWDSEC_K8S_UNSET_TOKEN`,
+			expectedErr: "environment variable CROWDSEC_K8S_UNSET_TOKEN is not set",
+		},
+		{
+			config: `
+api_server: https://10.0.0.1:6443
+since: yesterday`,
+			expectedErr: "invalid since",
+		},
+		{
+			config: `
+api_server: https://10.0.0.1:6443
+ca_cert: /does/not/exist.crt`,
+			expectedErr: "while reading ca_cert /does/not/exist.crt",
+		},
+		{
+			config: `
+source: kubernetes
+api_server: https://10.0.0.1:6443/
+token: secret
+namespaces: [default, ingress-nginx]
+label_selector: app in (nginx, traefik)
+containers: [controller]
+since: 1h`,
+			expectedErr: "",
+		},
+	}
+	subLogger := log.WithField("type", "kubernetes")
+	for _, test := range tests {
+		k := KubernetesSource{}
+		err := k.Configure([]byte(test.config), subLogger)
+		cstest.AssertErrorContains(t, err, test.expectedErr)
+	}
+}
+
+func TestInCluster(t *testing.T) {
+	dir := t.TempDir()
+	serviceAccountDir = dir
+	defer func() { serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount" }()
+	t.Setenv("KUBERNETES_SERVICE_HOST", "10.96.0.1")
+	t.Setenv("KUBERNETES_SERVICE_PORT", "443")
+
+	k := KubernetesSource{}
+	err := k.Configure([]byte(`label_selector: app=nginx`), log.WithField("type", "kubernetes"))
+	cstest.AssertErrorContains(t, err, "invalid token")
+
+	require.NoError(t, ioutil.WriteFile(dir+"/token", []byte("service-account-token\n"), 0600))
+	err = k.Configure([]byte(`label_selector: app=nginx`), log.WithField("type", "kubernetes"))
+	cstest.AssertErrorContains(t, err, "while reading ca_cert "+dir+"/ca.crt")
+
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	require.NoError(t, ioutil.WriteFile(dir+"/ca.crt", ca, 0600))
+	require.NoError(t, k.Configure([]byte(`label_selector: app=nginx`), log.WithField("type", "kubernetes")))
+	assert.Equal(t, "https://10.96.0.1:443", k.config.APIServer)
+	assert.Equal(t, "file://"+dir+"/token", k.config.Token)
+}
+
+// fakeAPI serves the pods of the namespace default, their changes pushed on watch, and the logs pushed on the
+// channels of logs
+type fakeAPI struct {
+	t        *testing.T
+	lock     sync.Mutex
+	pods     []pod
+	watch    chan watchEvent
+	logs     map[string]chan string //by pod/container, or pod/container/previous
+	requests chan string            //query of the log requests
+	closed   chan string            //log streams closed by the datasource, if set
+}
+
+func (f *fakeAPI) setLogs(key string, lines chan string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.logs[key] = lines
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer test-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	flusher := w.(http.Flusher)
+	switch {
+	case r.URL.Path == "/api/v1/namespaces/default/pods" && r.URL.Query().Get("watch") == "":
+		assert.Equal(f.t, "app=web", r.URL.Query().Get("labelSelector"))
+		list := podList{Items: f.pods}
+		list.Metadata.ResourceVersion = "10"
+		json.NewEncoder(w).Encode(list)
+	case r.URL.Path == "/api/v1/namespaces/default/pods":
+		assert.Equal(f.t, "10", r.URL.Query().Get("resourceVersion"))
+		flusher.Flush()
+		for {
+			select {
+			case event := <-f.watch:
+				json.NewEncoder(w).Encode(event)
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	case strings.HasSuffix(r.URL.Path, "/log"):
+		name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/v1/namespaces/default/pods/"), "/log")
+		key := name + "/" + r.URL.Query().Get("container")
+		if r.URL.Query().Get("previous") == "true" {
+			key += "/previous"
+		}
+		f.requests <- key + "?" + r.URL.Query().Get("sinceTime")
+		f.lock.Lock()
+		lines := f.logs[key]
+		f.lock.Unlock()
+		if lines == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		flusher.Flush()
+		for {
+			select {
+			case line, ok := <-lines:
+				if !ok {
+					return
+				}
+				fmt.Fprintln(w, line)
+				flusher.Flush()
+			case <-r.Context().Done():
+				if f.closed != nil {
+					f.closed <- key
+				}
+				return
+			}
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newPod(name string, startedAt time.Time, restartCount int) pod {
+	p := pod{}
+	p.Metadata.Name = name
+	p.Metadata.Namespace = "default"
+	p.Metadata.UID = "uid-" + name
+	p.Metadata.ResourceVersion = "11"
+	p.Spec.NodeName = "node-1"
+	for _, container := range []string{"nginx", "sidecar"} {
+		status := containerStatus{Name: container, RestartCount: restartCount}
+		status.State.Running = &struct {
+			StartedAt time.Time `json:"startedAt"`
+		}{StartedAt: startedAt}
+		p.Status.ContainerStatuses = append(p.Status.ContainerStatuses, status)
+	}
+	return p
+}
+
+func podWatchEvent(t *testing.T, eventType string, p pod) watchEvent {
+	object, err := json.Marshal(p)
+	require.NoError(t, err)
+	return watchEvent{Type: eventType, Object: object}
+}
+
+func logLine(timestamp time.Time, message string) string {
+	return timestamp.UTC().Format(time.RFC3339Nano) + " " + message
+}
+
+func readEvent(t *testing.T, out chan types.Event) types.Event {
+	select {
+	case evt := <-out:
+		return evt
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for event")
+	}
+	return types.Event{}
+}
+
+func readRequest(t *testing.T, requests chan string) string {
+	select {
+	case request := <-requests:
+		return request
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for log request")
+	}
+	return ""
+}
+
+func TestStreamingAcquisition(t *testing.T) {
+	reopenDelay = time.Minute
+	defer func() { reopenDelay = 5 * time.Second }()
+	api := &fakeAPI{
+		t:        t,
+		pods:     []pod{newPod("web-1", time.Now().Add(-time.Hour), 0)},
+		watch:    make(chan watchEvent),
+		logs:     make(map[string]chan string),
+		requests: make(chan string, 10),
+		closed:   make(chan string, 10),
+	}
+	web1 := make(chan string, 10)
+	api.setLogs("web-1/nginx", web1)
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	k := KubernetesSource{}
+	require.NoError(t, k.Configure([]byte(`
+api_server: `+server.URL+`
+token: test-token
+namespaces: [default]
+label_selector: app=web
+containers: [nginx]
+retry:
+  base: 10ms
+labels:
+  type: nginx`), log.WithField("type", "kubernetes")))
+	out := make(chan types.Event)
+	tmb := tomb.Tomb{}
+	require.NoError(t, k.StreamingAcquisition(out, &tmb))
+
+	//the container running before the start is read from now, and the sidecar is ignored
+	request := readRequest(t, api.requests)
+	assert.Equal(t, "web-1/nginx?"+k.since.Format(time.RFC3339), request)
+	web1 <- logLine(time.Now().Add(-time.Hour), "old line")
+	web1 <- logLine(time.Now().Add(time.Second), "new line")
+	evt := readEvent(t, out)
+	assert.Equal(t, "new line", evt.Line.Raw)
+	assert.Equal(t, "default/web-1/nginx", evt.Line.Src)
+	assert.Equal(t, "nginx", evt.Line.Labels["type"])
+	assert.Equal(t, map[string]string{"k8s_namespace": "default", "k8s_pod": "web-1", "k8s_container": "nginx", "k8s_node": "node-1"}, evt.Meta)
+
+	//a new pod is read from its start
+	web2 := make(chan string, 10)
+	api.setLogs("web-2/nginx", web2)
+	api.watch <- podWatchEvent(t, "ADDED", newPod("web-2", time.Now(), 0))
+	assert.Equal(t, "web-2/nginx?", readRequest(t, api.requests))
+	web2 <- logLine(time.Now(), "first line of web-2")
+	assert.Equal(t, "first line of web-2", readEvent(t, out).Line.Raw)
+
+	//the restarted container : the end of the previous instance, then the new one after the last line read
+	last := time.Now().Add(2 * time.Second)
+	web1 <- logLine(last, "before crash")
+	assert.Equal(t, "before crash", readEvent(t, out).Line.Raw)
+	previous := make(chan string, 10)
+	previous <- logLine(last, "before crash")
+	previous <- logLine(last.Add(time.Millisecond), "crash")
+	close(previous)
+	api.setLogs("web-1/nginx/previous", previous)
+	restarted := make(chan string, 10)
+	api.setLogs("web-1/nginx", restarted)
+	close(web1)
+	api.watch <- podWatchEvent(t, "MODIFIED", newPod("web-1", time.Now(), 1))
+	assert.Equal(t, "web-1/nginx/previous?"+last.UTC().Format(time.RFC3339), readRequest(t, api.requests))
+	assert.Equal(t, "crash", readEvent(t, out).Line.Raw)
+	assert.Equal(t, "web-1/nginx?"+last.Add(time.Millisecond).UTC().Format(time.RFC3339), readRequest(t, api.requests))
+	restarted <- logLine(last.Add(time.Second), "restarted")
+	assert.Equal(t, "restarted", readEvent(t, out).Line.Raw)
+
+	//the tail of a deleted pod is stopped
+	api.watch <- podWatchEvent(t, "DELETED", newPod("web-2", time.Now(), 0))
+	select {
+	case key := <-api.closed:
+		assert.Equal(t, "web-2/nginx", key)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for the log stream of web-2 to be closed")
+	}
+	web2 <- logLine(time.Now(), "after deletion")
+	select {
+	case evt := <-out:
+		t.Fatalf("unexpected event %s", evt.Line.Raw)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	tmb.Kill(nil)
+	require.NoError(t, tmb.Wait())
+}
+
+func TestConfigureByDSN(t *testing.T) {
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+	tests := []struct {
+		dsn         string
+		expectedErr string
+	}{
+		{
+			dsn:         "kubectl://default",
+			expectedErr: "invalid DSN kubectl://default for k8s source, must start with k8s://",
+		},
+		{
+			dsn:         "k8s://default",
+			expectedErr: "api_server is mandatory when crowdsec doesn't run in the cluster",
+		},
+		{
+			dsn:         "k8s://default?api_server=https://127.0.0.1:6443&selector=app",
+			expectedErr: "unsupported key selector in k8s DSN",
+		},
+		{
+			dsn:         "k8s://Default?api_server=https://127.0.0.1:6443",
+			expectedErr: "invalid namespace 'Default'",
+		},
+		{
+			dsn:         "k8s://default?api_server=https://127.0.0.1:6443&since=yesterday",
+			expectedErr: "invalid since",
+		},
+		{
+			dsn:         "kubernetes://default,monitoring?api_server=https://127.0.0.1:6443&label_selector=app%3Dweb&container=nginx&since=1h&insecure_skip_verify=true&log_level=debug",
+			expectedErr: "",
+		},
+	}
+	for _, test := range tests {
+		k := KubernetesSource{}
+		err := k.ConfigureByDSN(test.dsn, map[string]string{"type": "nginx"}, log.WithField("type", "kubernetes"))
+		cstest.AssertErrorContains(t, err, test.expectedErr)
+	}
+	k := KubernetesSource{}
+	require.NoError(t, k.ConfigureByDSN("k8s://default,monitoring?api_server=https://127.0.0.1:6443&label_selector=app%3Dweb&container=nginx&since=1h", nil, log.WithField("type", "kubernetes")))
+	assert.Equal(t, "cat", k.GetMode())
+	assert.Equal(t, []string{"default", "monitoring"}, k.config.Namespaces)
+	assert.Equal(t, "app=web", k.config.LabelSelector)
+	assert.Equal(t, map[string]bool{"nginx": true}, k.containers)
+	assert.WithinDuration(t, time.Now().Add(-time.Hour), k.since, time.Minute)
+}
+
+func TestOneShotAcquisition(t *testing.T) {
+	since := time.Now().Add(-time.Hour)
+	waiting := newPod("web-3", time.Now(), 0)
+	waiting.Status.ContainerStatuses[0].State.Running = nil
+	api := &fakeAPI{
+		t:        t,
+		pods:     []pod{newPod("web-1", since.Add(-time.Hour), 1), newPod("web-2", since.Add(-time.Hour), 0), waiting},
+		logs:     make(map[string]chan string),
+		requests: make(chan string, 10),
+	}
+	for key, lines := range map[string][]string{
+		"web-1/nginx/previous": {logLine(since.Add(-time.Minute), "too old"), logLine(since.Add(time.Minute), "before restart")},
+		"web-1/nginx":          {logLine(since.Add(2*time.Minute), "after restart")},
+		"web-2/nginx":          {logLine(since.Add(3*time.Minute), "web-2")},
+	} {
+		ch := make(chan string, len(lines))
+		for _, line := range lines {
+			ch <- line
+		}
+		close(ch)
+		api.setLogs(key, ch)
+	}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	k := KubernetesSource{}
+	dsn := "k8s://default?api_server=" + server.URL + "&token=test-token&label_selector=app%3Dweb&container=nginx&since=" + since.UTC().Format(time.RFC3339)
+	require.NoError(t, k.ConfigureByDSN(dsn, map[string]string{"type": "nginx"}, log.WithField("type", "kubernetes")))
+	out := make(chan types.Event, 10)
+	tmb := tomb.Tomb{}
+	require.NoError(t, k.OneShotAcquisition(out, &tmb))
+	require.Len(t, out, 3)
+	for _, expected := range []string{"before restart", "after restart", "web-2"} {
+		evt := <-out
+		assert.Equal(t, expected, evt.Line.Raw)
+		assert.Equal(t, leaky.TIMEMACHINE, evt.ExpectMode)
+	}
+	//the restarted container is read from since, then after the last line of its previous instance
+	sinceTime := since.UTC().Format(time.RFC3339)
+	assert.Equal(t, "web-1/nginx/previous?"+sinceTime, readRequest(t, api.requests))
+	assert.Equal(t, "web-1/nginx?"+since.Add(time.Minute).UTC().Format(time.RFC3339), readRequest(t, api.requests))
+	assert.Equal(t, "web-2/nginx?"+sinceTime, readRequest(t, api.requests))
+	assert.Empty(t, api.requests)
+}
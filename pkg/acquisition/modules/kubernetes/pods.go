@@ -0,0 +1,504 @@
+package kubernetesacquisition
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/retry"
+	leaky "github.com/crowdsecurity/crowdsec/pkg/leakybucket"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/tomb.v2"
+)
+
+// watchTimeout is how long the api server keeps a watch open, it's then opened again from the last resource version
+const watchTimeout = 5 * time.Minute
+
+type containerStatus struct {
+	Name         string `json:"name"`
+	RestartCount int    `json:"restartCount"`
+	State        struct {
+		Running *struct {
+			StartedAt time.Time `json:"startedAt"`
+		} `json:"running"`
+		Terminated *struct{} `json:"terminated"`
+	} `json:"state"`
+}
+
+// pod is the part of a pod used by the datasource
+type pod struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace"`
+		UID             string `json:"uid"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Spec struct {
+		NodeName string `json:"nodeName"`
+	} `json:"spec"`
+	Status struct {
+		ContainerStatuses []containerStatus `json:"containerStatuses"`
+	} `json:"status"`
+}
+
+type podList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []pod `json:"items"`
+}
+
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// podEvent is a change of the pods of a namespace ("" for all the namespaces). A sync event carries all the pods of
+// the namespace after they were listed, the ones that are not part of it were deleted in between
+type podEvent struct {
+	scope   string
+	sync    bool
+	deleted bool
+	pods    []pod
+}
+
+func scopeName(scope string) string {
+	if scope == "" {
+		return "all namespaces"
+	}
+	return "namespace " + scope
+}
+
+func podsPath(scope string) string {
+	if scope == "" {
+		return "/api/v1/pods"
+	}
+	return "/api/v1/namespaces/" + url.PathEscape(scope) + "/pods"
+}
+
+func (k *KubernetesSource) podParams() url.Values {
+	params := url.Values{}
+	if k.config.LabelSelector != "" {
+		params.Set("labelSelector", k.config.LabelSelector)
+	}
+	return params
+}
+
+func (k *KubernetesSource) listPods(ctx context.Context, scope string) (*podList, error) {
+	ctx, cancel := context.WithTimeout(ctx, *k.config.Timeout)
+	defer cancel()
+	resp, err := k.get(ctx, podsPath(scope), k.podParams())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	list := podList{}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, errors.Wrap(err, "while decoding pods")
+	}
+	return &list, nil
+}
+
+// watchPods lists the pods of scope, then sends their changes to events until dying is closed. They are listed again
+// when the watch fails, eg. when its resource version expired
+func (k *KubernetesSource) watchPods(scope string, events chan podEvent, dying <-chan struct{}) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-dying:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	for {
+		var list *podList
+		err := k.retrier.Do(dying, func() error {
+			var err error
+			list, err = k.listPods(ctx, scope)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		k.logger.Debugf("%d pods in %s", len(list.Items), scopeName(scope))
+		select {
+		case events <- podEvent{scope: scope, sync: true, pods: list.Items}:
+		case <-dying:
+			return retry.ErrDying
+		}
+		err = k.followPods(ctx, scope, list.Metadata.ResourceVersion, events, dying)
+		var watchErr *watchError
+		if !errors.As(err, &watchErr) {
+			return err
+		}
+		k.logger.Infof("watch of the pods of %s interrupted (%s), listing them again", scopeName(scope), err)
+	}
+}
+
+// watchError is a failure of a watch that is recovered by listing the pods again
+type watchError struct {
+	err error
+}
+
+func (e *watchError) Error() string {
+	return e.err.Error()
+}
+
+// followPods watches the pods of scope from resourceVersion. The watch is opened again when the api server closes
+// it, a watchError is returned when it can't be resumed
+func (k *KubernetesSource) followPods(ctx context.Context, scope string, resourceVersion string, events chan podEvent, dying <-chan struct{}) error {
+	for {
+		params := k.podParams()
+		params.Set("watch", "true")
+		params.Set("resourceVersion", resourceVersion)
+		params.Set("allowWatchBookmarks", "true")
+		params.Set("timeoutSeconds", fmt.Sprint(int(watchTimeout.Seconds())))
+		var body io.ReadCloser
+		err := k.retrier.Do(dying, func() error {
+			resp, err := k.get(ctx, podsPath(scope), params)
+			if err != nil {
+				return err
+			}
+			body = resp.Body
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		decoder := json.NewDecoder(body)
+		for {
+			event := watchEvent{}
+			err = decoder.Decode(&event)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				body.Close()
+				if ctx.Err() != nil {
+					return retry.ErrDying
+				}
+				return &watchError{err: err}
+			}
+			if event.Type == "ERROR" {
+				status := struct {
+					Code    int    `json:"code"`
+					Message string `json:"message"`
+				}{}
+				json.Unmarshal(event.Object, &status)
+				body.Close()
+				return &watchError{err: fmt.Errorf("watch error %d : %s", status.Code, status.Message)}
+			}
+			p := pod{}
+			if err := json.Unmarshal(event.Object, &p); err != nil {
+				body.Close()
+				return &watchError{err: errors.Wrapf(err, "while decoding %s event", event.Type)}
+			}
+			resourceVersion = p.Metadata.ResourceVersion
+			if event.Type == "BOOKMARK" {
+				continue
+			}
+			select {
+			case events <- podEvent{scope: scope, deleted: event.Type == "DELETED", pods: []pod{p}}:
+			case <-dying:
+				body.Close()
+				return retry.ErrDying
+			}
+		}
+		body.Close()
+	}
+}
+
+// managePods starts and stops the tails of the containers according to the changes of the pods
+func (k *KubernetesSource) managePods(events chan podEvent, out chan types.Event, dying <-chan struct{}) {
+	tails := make(map[string]*containerTail)
+	stop := func(key string) {
+		tail := tails[key]
+		tail.logger.Infof("stopping tail of %s", tail.src)
+		tail.t.Kill(nil)
+		if err := tail.t.Wait(); err != nil {
+			tail.logger.Errorf("error while waiting for the end of %s : %s", tail.src, err)
+		}
+		delete(tails, key)
+	}
+	defer func() {
+		for key := range tails {
+			stop(key)
+		}
+	}()
+	for {
+		var event podEvent
+		select {
+		case <-dying:
+			return
+		case event = <-events:
+		}
+		if event.sync {
+			current := make(map[string]bool)
+			for _, p := range event.pods {
+				current[p.Metadata.UID] = true
+			}
+			for key, tail := range tails {
+				if (event.scope == "" || tail.namespace == event.scope) && !current[tail.uid] {
+					stop(key)
+				}
+			}
+		}
+		for _, p := range event.pods {
+			for _, status := range p.Status.ContainerStatuses {
+				if len(k.containers) != 0 && !k.containers[status.Name] {
+					continue
+				}
+				key := p.Metadata.UID + "/" + status.Name
+				tail, ok := tails[key]
+				if event.deleted {
+					if ok {
+						stop(key)
+					}
+					continue
+				}
+				state := containerState{running: status.State.Running != nil, restartCount: status.RestartCount}
+				if ok {
+					tail.update(state)
+					continue
+				}
+				if !state.running {
+					continue
+				}
+				tail = k.newTail(p, status)
+				tails[key] = tail
+				tail.logger.Infof("starting tail of %s", tail.src)
+				tail.t.Go(func() error {
+					defer types.CatchPanic("crowdsec/acquis/kubernetes/tail")
+					tail.run(out)
+					return nil
+				})
+			}
+		}
+	}
+}
+
+// replayPods reads the logs of the containers of the pods of scope up to now, one container after the other. The
+// ones that were restarted are read from the start of their previous instance
+func (k *KubernetesSource) replayPods(scope string, out chan types.Event, t *tomb.Tomb) error {
+	var list *podList
+	err := k.retrier.Do(t.Dying(), func() error {
+		var err error
+		list, err = k.listPods(t.Context(nil), scope)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	k.logger.Debugf("%d pods in %s", len(list.Items), scopeName(scope))
+	for _, p := range list.Items {
+		for _, status := range p.Status.ContainerStatuses {
+			if len(k.containers) != 0 && !k.containers[status.Name] {
+				continue
+			}
+			//a container waiting to start has no logs yet
+			if status.State.Running == nil && status.State.Terminated == nil {
+				continue
+			}
+			tail := k.newTail(p, status)
+			tail.t = t
+			tail.logger.Infof("reading logs of %s", tail.src)
+			if status.RestartCount > 0 {
+				if err := tail.read(out, true); err != nil {
+					tail.logger.Warningf("unable to read the logs of the previous instance of %s : %s", tail.src, err)
+				}
+			}
+			err := k.retrier.Do(t.Dying(), func() error {
+				return tail.read(out, false)
+			})
+			if err == retry.ErrDying {
+				return err
+			}
+			//eg. the pod was deleted since it was listed
+			if err != nil {
+				tail.logger.Warningf("unable to read the logs of %s : %s", tail.src, err)
+			}
+			if !t.Alive() {
+				return retry.ErrDying
+			}
+		}
+	}
+	return nil
+}
+
+// containerState is the part of the status of a container that changes how its logs are read
+type containerState struct {
+	running      bool
+	restartCount int
+}
+
+// containerTail follows the logs of a container, across its restarts
+type containerTail struct {
+	k         *KubernetesSource
+	namespace string
+	pod       string
+	container string
+	node      string
+	uid       string
+	src       string
+	state     containerState
+	states    chan containerState //latest state of the container, sent by managePods
+	last      time.Time           //timestamp of the last line read, the logs are read again after it
+	t         *tomb.Tomb
+	logger    *log.Entry
+}
+
+func (k *KubernetesSource) newTail(p pod, status containerStatus) *containerTail {
+	tail := &containerTail{
+		k:         k,
+		namespace: p.Metadata.Namespace,
+		pod:       p.Metadata.Name,
+		container: status.Name,
+		node:      p.Spec.NodeName,
+		uid:       p.Metadata.UID,
+		src:       p.Metadata.Namespace + "/" + p.Metadata.Name + "/" + status.Name,
+		state:     containerState{running: true, restartCount: status.RestartCount},
+		states:    make(chan containerState, 1),
+		t:         &tomb.Tomb{},
+	}
+	tail.logger = k.logger.WithField("container", tail.src)
+	//the containers running before the acquisition started are read from since, the new ones from their start. In
+	//cat mode, they are all read from since
+	if k.config.Mode == configuration.CAT_MODE || status.State.Running.StartedAt.Before(k.started) {
+		tail.last = k.since
+	}
+	return tail
+}
+
+// update hands the latest state of the container to the tail, replacing the one it didn't handle yet
+func (c *containerTail) update(state containerState) {
+	select {
+	case <-c.states:
+	default:
+	}
+	c.states <- state
+}
+
+func (c *containerTail) run(out chan types.Event) {
+	restartCount := c.state.restartCount
+	state := c.state
+	for {
+		if state.restartCount != restartCount {
+			//the container restarted : the end of the logs of its previous instance is read first
+			if err := c.read(out, true); err != nil {
+				c.logger.Warningf("unable to read the logs of the previous instance of %s : %s", c.src, err)
+			}
+			restartCount = state.restartCount
+		}
+		var reopen <-chan time.Time
+		if state.running {
+			err := c.k.retrier.Do(c.t.Dying(), func() error {
+				return c.read(out, false)
+			})
+			if err == retry.ErrDying {
+				return
+			}
+			if err != nil {
+				c.logger.Errorf("unable to read the logs of %s : %s", c.src, err)
+			}
+			//the stream ends when the container stops, or is interrupted while it's still running
+			reopen = time.After(reopenDelay)
+		}
+		select {
+		case <-c.t.Dying():
+			return
+		case state = <-c.states:
+		case <-reopen:
+		}
+	}
+}
+
+// read sends the lines of the logs of the container after the last one read, following them in tail mode, or reading
+// the previous instance of the container. It returns when the logs end
+func (c *containerTail) read(out chan types.Event, previous bool) error {
+	params := url.Values{}
+	params.Set("container", c.container)
+	params.Set("timestamps", "true")
+	if previous {
+		params.Set("previous", "true")
+	} else if c.k.config.Mode == configuration.TAIL_MODE {
+		params.Set("follow", "true")
+	}
+	if !c.last.IsZero() {
+		//sinceTime is truncated to the second, the lines up to the last one read are skipped
+		params.Set("sinceTime", c.last.UTC().Format(time.RFC3339))
+	}
+	path := "/api/v1/namespaces/" + url.PathEscape(c.namespace) + "/pods/" + url.PathEscape(c.pod) + "/log"
+	resp, err := c.k.get(c.t.Context(nil), path, params)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	c.k.SetState(configuration.STATUS_RUNNING, nil)
+	reader := bufio.NewReader(resp.Body)
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			if !c.handle(out, line) {
+				return nil
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if !c.t.Alive() {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// handle sends a line prefixed by its timestamp, unless it was already read. It returns false when the tail is dying
+func (c *containerTail) handle(out chan types.Event, line string) bool {
+	line = strings.TrimRight(line, "\r\n")
+	if idx := strings.IndexByte(line, ' '); idx > 0 {
+		if timestamp, err := time.Parse(time.RFC3339Nano, line[:idx]); err == nil {
+			if !timestamp.After(c.last) {
+				return true
+			}
+			c.last = timestamp
+			line = line[idx+1:]
+		}
+	}
+	l := types.Line{}
+	l.Raw = line
+	l.Src = c.src
+	l.Time = time.Now().UTC()
+	l.Labels = c.k.config.Labels
+	l.Process = true
+	l.Module = c.k.GetName()
+	expectMode := leaky.LIVE
+	if c.k.config.UseTimeMachine || c.k.config.Mode == configuration.CAT_MODE {
+		expectMode = leaky.TIMEMACHINE
+	}
+	meta := map[string]string{
+		"k8s_namespace": c.namespace,
+		"k8s_pod":       c.pod,
+		"k8s_container": c.container,
+		"k8s_node":      c.node,
+	}
+	c.k.EventSeen(&l)
+	select {
+	case out <- types.Event{Line: l, Process: true, Type: types.LOG, ExpectMode: expectMode, Meta: meta}:
+		linesRead.With(prometheus.Labels{"namespace": c.namespace}).Inc()
+		return true
+	case <-c.t.Dying():
+		return false
+	}
+}
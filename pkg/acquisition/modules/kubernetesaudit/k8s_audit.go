@@ -0,0 +1,332 @@
+package kubernetesauditacquisition
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/secrets"
+	leaky "github.com/crowdsecurity/crowdsec/pkg/leakybucket"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/tomb.v2"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	defaultWebhookPath = "/audit/webhook/event"
+	defaultPort        = 9876
+	defaultMaxBodySize = 16 * 1024 * 1024
+)
+
+// the stages at which the events are sent by default : the request is then complete, with its response code
+var defaultStages = []string{"ResponseComplete", "Panic"}
+
+type KubernetesAuditTLSConfiguration struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	CAFile   string `yaml:"ca_file"` //verify the client certificate of the api server with this CA
+}
+
+type KubernetesAuditConfiguration struct {
+	ListenAddr                        string                           `yaml:"listen_addr"`
+	ListenPort                        int                              `yaml:"listen_port"`
+	WebhookPath                       string                           `yaml:"webhook_path"`
+	Token                             string                           `yaml:"token"`         //bearer token of the webhook kubeconfig, can be env://, file:// or vault:// references
+	Stages                            []string                         `yaml:"stages"`        //only send the events of these stages
+	MaxBodySize                       int64                            `yaml:"max_body_size"` //of a batch of events
+	TLS                               *KubernetesAuditTLSConfiguration `yaml:"tls"`
+	configuration.DataSourceCommonCfg `yaml:",inline"`
+}
+
+// KubernetesAuditSource implements the webhook backend of the audit logs of the kubernetes api server : the api
+// server POSTs batches of audit events (an audit.k8s.io EventList), each of them is sent as a json line
+type KubernetesAuditSource struct {
+	configuration.HealthTracker
+	config     KubernetesAuditConfiguration
+	logger     *log.Entry
+	tlsConfig  *tls.Config
+	token      *secrets.Secret //resolved again on each request
+	stages     map[string]bool
+	out        chan types.Event
+	dying      <-chan struct{}
+	expectMode int
+}
+
+// eventList is the body of the requests of the api server. The events are kept as is, only their stage is read
+type eventList struct {
+	Kind  string            `json:"kind"`
+	Items []json.RawMessage `json:"items"`
+}
+
+var requestCount = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cs_k8sauditsource_requests_total",
+		Help: "Total number of batches of audit events received.",
+	},
+	[]string{"source"})
+
+var eventCount = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cs_k8sauditsource_hits_total",
+		Help: "Total number of audit events received.",
+	},
+	[]string{"source"})
+
+func (ka *KubernetesAuditSource) GetName() string {
+	return "k8s-audit"
+}
+
+func (ka *KubernetesAuditSource) GetUuid() string {
+	return ka.config.UniqueId
+}
+
+func (ka *KubernetesAuditSource) GetMode() string {
+	return ka.config.Mode
+}
+
+func (ka *KubernetesAuditSource) Dump() interface{} {
+	return ka
+}
+
+func (ka *KubernetesAuditSource) CanRun() error {
+	return nil
+}
+
+func (ka *KubernetesAuditSource) GetMetrics() []prometheus.Collector {
+	return []prometheus.Collector{requestCount, eventCount}
+}
+
+func (ka *KubernetesAuditSource) GetAggregMetrics() []prometheus.Collector {
+	return []prometheus.Collector{requestCount, eventCount}
+}
+
+func (ka *KubernetesAuditSource) ConfigureByDSN(dsn string, labels map[string]string, logger *log.Entry) error {
+	return fmt.Errorf("k8s-audit datasource does not support one shot acquisition")
+}
+
+func (ka *KubernetesAuditSource) OneShotAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	return fmt.Errorf("k8s-audit datasource does not support one shot acquisition")
+}
+
+func (ka *KubernetesAuditSource) Configure(yamlConfig []byte, logger *log.Entry) error {
+	ka.logger = logger
+	config := KubernetesAuditConfiguration{}
+	config.Mode = configuration.TAIL_MODE
+	if err := yaml.UnmarshalStrict(yamlConfig, &config); err != nil {
+		return errors.Wrap(err, "Cannot parse k8s-audit configuration")
+	}
+	if config.Mode != configuration.TAIL_MODE {
+		return fmt.Errorf("unsupported mode %s for k8s-audit datasource", config.Mode)
+	}
+	if config.ListenAddr == "" {
+		config.ListenAddr = "127.0.0.1"
+	}
+	if net.ParseIP(config.ListenAddr) == nil {
+		return fmt.Errorf("invalid listen IP %s", config.ListenAddr)
+	}
+	if config.ListenPort == 0 {
+		config.ListenPort = defaultPort
+	}
+	if config.ListenPort < 0 || config.ListenPort > 65535 {
+		return fmt.Errorf("invalid port %d", config.ListenPort)
+	}
+	if config.WebhookPath == "" {
+		config.WebhookPath = defaultWebhookPath
+	}
+	if !strings.HasPrefix(config.WebhookPath, "/") {
+		return fmt.Errorf("webhook_path must start with /")
+	}
+	if config.MaxBodySize == 0 {
+		config.MaxBodySize = defaultMaxBodySize
+	}
+	if config.MaxBodySize < 0 {
+		return fmt.Errorf("invalid max_body_size %d", config.MaxBodySize)
+	}
+	if config.Token != "" {
+		token, err := secrets.NewSecret(config.Token, ka.logger)
+		if err != nil {
+			return errors.Wrap(err, "invalid token")
+		}
+		ka.token = token
+	}
+	if len(config.Stages) == 0 {
+		config.Stages = defaultStages
+	}
+	ka.stages = make(map[string]bool)
+	for _, stage := range config.Stages {
+		switch stage {
+		case "RequestReceived", "ResponseStarted", "ResponseComplete", "Panic":
+			ka.stages[stage] = true
+		default:
+			return fmt.Errorf("invalid stage %s (must be RequestReceived, ResponseStarted, ResponseComplete or Panic)", stage)
+		}
+	}
+	if config.TLS != nil {
+		if err := ka.configureTLS(config.TLS); err != nil {
+			return err
+		}
+	}
+	ka.config = config
+	return nil
+}
+
+func (ka *KubernetesAuditSource) configureTLS(config *KubernetesAuditTLSConfiguration) error {
+	if config.CertFile == "" || config.KeyFile == "" {
+		return fmt.Errorf("tls.cert_file and tls.key_file are required")
+	}
+	cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return errors.Wrap(err, "could not load server certificate")
+	}
+	ka.tlsConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if config.CAFile != "" {
+		caCert, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return errors.Wrap(err, "could not read CA file")
+		}
+		caPool := x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(caCert) {
+			return fmt.Errorf("no certificate found in %s", config.CAFile)
+		}
+		ka.tlsConfig.ClientCAs = caPool
+		ka.tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return nil
+}
+
+func (ka *KubernetesAuditSource) StreamingAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	ka.out = out
+	ka.dying = t.Dying()
+	ka.expectMode = leaky.LIVE
+	if ka.config.UseTimeMachine {
+		ka.expectMode = leaky.TIMEMACHINE
+	}
+	addr := net.JoinHostPort(ka.config.ListenAddr, strconv.Itoa(ka.config.ListenPort))
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrapf(err, "could not listen on %s", addr)
+	}
+	ka.logger.Infof("listening for kubernetes audit events on %s%s", listener.Addr(), ka.config.WebhookPath)
+	mux := http.NewServeMux()
+	mux.HandleFunc(ka.config.WebhookPath, ka.webhookHandler)
+	server := &http.Server{Handler: mux, TLSConfig: ka.tlsConfig, ReadHeaderTimeout: 10 * time.Second}
+	t.Go(func() error {
+		defer types.CatchPanic("crowdsec/acquis/k8s-audit/live")
+		t.Go(func() error {
+			<-t.Dying()
+			ka.logger.Info("k8s-audit datasource is dying")
+			server.Close()
+			return nil
+		})
+		var err error
+		if ka.tlsConfig != nil {
+			err = server.ServeTLS(listener, "", "")
+		} else {
+			err = server.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			err = errors.Wrap(err, "k8s-audit server has exited")
+			ka.SetState(configuration.STATUS_ERRORED, err)
+			return err
+		}
+		return nil
+	})
+	return nil
+}
+
+// authorized checks the bearer token of the webhook kubeconfig, if one is configured
+func (ka *KubernetesAuditSource) authorized(r *http.Request) bool {
+	if ka.token == nil {
+		return true
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(strings.TrimSpace(ka.token.Get()))) == 1
+}
+
+func (ka *KubernetesAuditSource) webhookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !ka.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		http.Error(w, "only application/json payloads are supported", http.StatusUnsupportedMediaType)
+		return
+	}
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+	logger := ka.logger.WithField("client", client)
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, ka.config.MaxBodySize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	requestCount.With(prometheus.Labels{"source": client}).Inc()
+	events := eventList{}
+	if err := json.Unmarshal(body, &events); err != nil {
+		logger.Debugf("rejecting request : %s", err)
+		http.Error(w, "invalid audit event list", http.StatusBadRequest)
+		return
+	}
+	if events.Kind != "EventList" {
+		logger.Debugf("rejecting request of kind %s", events.Kind)
+		http.Error(w, "expected an EventList", http.StatusBadRequest)
+		return
+	}
+	for _, item := range events.Items {
+		event := struct {
+			Stage string `json:"stage"`
+		}{}
+		if err := json.Unmarshal(item, &event); err != nil {
+			logger.Debugf("skipping invalid audit event : %s", err)
+			continue
+		}
+		if !ka.stages[event.Stage] {
+			continue
+		}
+		//one event per line, whatever the formatting of the batch
+		line := bytes.Buffer{}
+		if err := json.Compact(&line, item); err != nil {
+			continue
+		}
+		eventCount.With(prometheus.Labels{"source": client}).Inc()
+		l := types.Line{}
+		l.Raw = line.String()
+		l.Module = ka.GetName()
+		l.Labels = ka.config.Labels
+		l.Time = time.Now().UTC()
+		l.Src = client
+		l.Process = true
+		ka.EventSeen(&l)
+		select {
+		case ka.out <- types.Event{Line: l, Process: true, Type: types.LOG, ExpectMode: ka.expectMode}:
+		case <-ka.dying:
+			//the api server sends the batch again
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,158 @@
+package kubernetesauditacquisition
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/cstest"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/tomb.v2"
+)
+
+func TestConfigure(t *testing.T) {
+	tests := []struct {
+		config      string
+		expectedErr string
+	}{
+		{
+			config:      `foobar: bla`,
+			expectedErr: "field foobar not found in type kubernetesauditacquisition.KubernetesAuditConfiguration",
+		},
+		{
+			config:      `source: k8s-audit`,
+			expectedErr: "",
+		},
+		{
+			config:      `mode: cat`,
+			expectedErr: "unsupported mode cat for k8s-audit datasource",
+		},
+		{
+			config:      `listen_port: 424242`,
+			expectedErr: "invalid port 424242",
+		},
+		{
+			config:      `listen_addr: 10.0.0`,
+			expectedErr: "invalid listen IP 10.0.0",
+		},
+		{
+			config:      `webhook_path: audit`,
+			expectedErr: "webhook_path must start with /",
+		},
+		{
+			config:      `stages: [ResponseDone]`,
+			expectedErr: "invalid stage ResponseDone",
+		},
+		{
+			config:      `token: env://CROWDSEC_K8S_AUDIT_UNSET_TOKEN`,
+			expectedErr: "environment variable CROWDSEC_K8S_AUDIT_UNSET_TOKEN is not set",
+		},
+		{
+			config: `
+tls:
+  cert_file: server.crt`,
+			expectedErr: "tls.cert_file and tls.key_file are required",
+		},
+	}
+	subLogger := log.WithField("type", "k8s-audit")
+	for _, test := range tests {
+		ka := KubernetesAuditSource{}
+		err := ka.Configure([]byte(test.config), subLogger)
+		cstest.AssertErrorContains(t, err, test.expectedErr)
+	}
+	ka := KubernetesAuditSource{}
+	require.NoError(t, ka.Configure([]byte(`source: k8s-audit`), subLogger))
+	assert.Equal(t, 9876, ka.config.ListenPort)
+	assert.Equal(t, "/audit/webhook/event", ka.config.WebhookPath)
+	assert.Equal(t, map[string]bool{"ResponseComplete": true, "Panic": true}, ka.stages)
+}
+
+func readEvent(t *testing.T, out chan types.Event) types.Event {
+	select {
+	case evt := <-out:
+		return evt
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for event")
+	}
+	return types.Event{}
+}
+
+func post(t *testing.T, url string, token string, body []byte) int {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestWebhook(t *testing.T) {
+	t.Setenv("CROWDSEC_K8S_AUDIT_TOKEN", "webhook-token\n")
+	ka := KubernetesAuditSource{}
+	require.NoError(t, ka.Configure([]byte(`
+source: k8s-audit
+listen_port: 4393
+webhook_path: /audit
+token: env://CROWDSEC_K8S_AUDIT_TOKEN
+labels:
+  type: k8s-audit`), log.WithField("type", "k8s-audit")))
+	out := make(chan types.Event, 10)
+	tmb := tomb.Tomb{}
+	require.NoError(t, ka.StreamingAcquisition(out, &tmb))
+	url := "http://127.0.0.1:4393/audit"
+
+	//an exec into a pod by an anonymous user, pretty printed
+	batch := []byte(`{
+  "kind": "EventList",
+  "apiVersion": "audit.k8s.io/v1",
+  "items": [
+    {
+      "kind": "Event",
+      "level": "Metadata",
+      "auditID": "1",
+      "stage": "RequestReceived",
+      "verb": "create"
+    },
+    {
+      "kind": "Event",
+      "level": "Metadata",
+      "auditID": "1",
+      "stage": "ResponseComplete",
+      "requestURI": "/api/v1/namespaces/default/pods/web/exec?command=sh",
+      "verb": "create",
+      "user": {"username": "system:anonymous"},
+      "sourceIPs": ["192.168.1.42"],
+      "objectRef": {"resource": "pods", "namespace": "default", "name": "web", "subresource": "exec"},
+      "responseStatus": {"code": 101}
+    }
+  ]
+}`)
+	assert.Equal(t, http.StatusUnauthorized, post(t, url, "", batch))
+	assert.Equal(t, http.StatusUnauthorized, post(t, url, "other-token", batch))
+	assert.Equal(t, http.StatusOK, post(t, url, "webhook-token", batch))
+	evt := readEvent(t, out)
+	assert.Equal(t, "k8s-audit", evt.Line.Labels["type"])
+	assert.Equal(t, "127.0.0.1", evt.Line.Src)
+	assert.NotContains(t, evt.Line.Raw, "\n")
+	event := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal([]byte(evt.Line.Raw), &event))
+	assert.Equal(t, "ResponseComplete", event["stage"])
+	assert.Equal(t, "system:anonymous", event["user"].(map[string]interface{})["username"])
+	//the RequestReceived stage was skipped
+	assert.Len(t, out, 0)
+
+	assert.Equal(t, http.StatusBadRequest, post(t, url, "webhook-token", []byte(`{"kind": "Event"}`)))
+	assert.Equal(t, http.StatusBadRequest, post(t, url, "webhook-token", []byte(`not json`)))
+
+	tmb.Kill(nil)
+	require.NoError(t, tmb.Wait())
+}
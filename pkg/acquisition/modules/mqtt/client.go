@@ -0,0 +1,127 @@
+package mqttacquisition
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/retry"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/pkg/errors"
+)
+
+// messageHandler hands a message to crowdsec, and tells if it can be acknowledged
+type messageHandler func(msg mqtt.Message) bool
+
+// session is the part of a paho client used by the datasource : a connection subscribed to the topics, calling the
+// handler for each message in order
+type session interface {
+	// Lost receives the error that closed the connection
+	Lost() <-chan error
+	// Close disconnects from the broker, once the message being handled was handed to crowdsec or dropped
+	Close()
+}
+
+// connackError is a connection refused by the broker
+type connackError struct {
+	code byte
+}
+
+var connackReasons = map[byte]string{
+	packets.ErrRefusedBadProtocolVersion:    "unacceptable protocol version",
+	packets.ErrRefusedIDRejected:            "client identifier rejected",
+	packets.ErrRefusedServerUnavailable:     "server unavailable",
+	packets.ErrRefusedBadUsernameOrPassword: "bad username or password",
+	packets.ErrRefusedNotAuthorised:         "not authorized",
+}
+
+func (e *connackError) Error() string {
+	reason, ok := connackReasons[e.code]
+	if !ok {
+		reason = "unknown reason"
+	}
+	return fmt.Sprintf("connection refused by broker : %s (code %d)", reason, e.code)
+}
+
+// connectError turns the return code of a failed connection into an error : the refusals that come from the
+// configuration of the datasource are not retried, unlike the network errors and an unavailable broker
+func connectError(code byte, err error) error {
+	if code == packets.Accepted || code == packets.ErrNetworkError || code == packets.ErrProtocolViolation {
+		return err
+	}
+	ret := &connackError{code: code}
+	if code == packets.ErrRefusedServerUnavailable {
+		return ret
+	}
+	return retry.Permanent(ret)
+}
+
+type pahoSession struct {
+	client   mqtt.Client
+	lost     chan error
+	lostOnce sync.Once
+}
+
+// dialSession connects to the broker, and subscribes to the topics. The messages are acknowledged once the handler
+// returns true, so that the broker delivers again the ones that were not handed to crowdsec
+func (m *MqttSource) dialSession(handler messageHandler) (session, error) {
+	s := &pahoSession{lost: make(chan error, 1)}
+	//the options are copied by the client
+	options := *m.options
+	options.SetPassword(m.password.Get())
+	options.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		s.lostOnce.Do(func() {
+			s.lost <- err
+		})
+	})
+	s.client = mqtt.NewClient(&options)
+	token := s.client.Connect()
+	//bounded by the connect timeout
+	token.Wait()
+	connect := token.(*mqtt.ConnectToken)
+	if err := token.Error(); err != nil {
+		return nil, connectError(connect.ReturnCode(), err)
+	}
+	if !options.CleanSession && !connect.SessionPresent() {
+		m.logger.Debugf("no session found for client %s, starting a new one", options.ClientID)
+	}
+	filters := make(map[string]byte, len(m.config.Topics))
+	for _, topic := range m.config.Topics {
+		filters[topic] = byte(m.config.QoS)
+	}
+	token = s.client.SubscribeMultiple(filters, func(_ mqtt.Client, msg mqtt.Message) {
+		if handler(msg) {
+			msg.Ack()
+		}
+	})
+	if !token.WaitTimeout(*m.config.Timeout) {
+		s.Close()
+		return nil, fmt.Errorf("timeout waiting for the subscription to %v", m.config.Topics)
+	}
+	if err := token.Error(); err != nil {
+		s.Close()
+		return nil, errors.Wrap(err, "while subscribing")
+	}
+	granted := token.(*mqtt.SubscribeToken).Result()
+	for _, topic := range m.config.Topics {
+		code := granted[topic]
+		//0x80 is the failure return code of SUBACK
+		if code == 0x80 {
+			s.Close()
+			return nil, retry.Permanent(fmt.Errorf("subscription to %s refused by broker", topic))
+		}
+		if int(code) < m.config.QoS {
+			m.logger.Warningf("broker granted QoS %d instead of %d for %s", code, m.config.QoS, topic)
+		}
+	}
+	return s, nil
+}
+
+func (s *pahoSession) Lost() <-chan error {
+	return s.lost
+}
+
+func (s *pahoSession) Close() {
+	//a clean DISCONNECT, so that the broker does not publish the will of the client
+	s.client.Disconnect(250)
+}
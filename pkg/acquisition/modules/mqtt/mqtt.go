@@ -0,0 +1,433 @@
+package mqttacquisition
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/retry"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/secrets"
+	leaky "github.com/crowdsecurity/crowdsec/pkg/leakybucket"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/tomb.v2"
+	"gopkg.in/yaml.v2"
+)
+
+var linesRead = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cs_mqttsource_hits_total",
+		Help: "Total messages that were read from MQTT topics.",
+	},
+	[]string{"topic"})
+
+var (
+	defaultTimeout   = 10 * time.Second
+	defaultKeepAlive = 30 * time.Second
+)
+
+const (
+	defaultURL           = "mqtt://127.0.0.1:1883"
+	defaultMaxMessageLen = 1024 * 1024
+)
+
+type MqttTLSConfiguration struct {
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"` //client certificate, when the broker verifies them
+	KeyFile            string `yaml:"key_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+type MqttConfiguration struct {
+	configuration.DataSourceCommonCfg `yaml:",inline"`
+	URL                               string                `yaml:"url"`             //eg. mqtt://localhost:1883, or mqtts://localhost:8883 for TLS
+	Topics                            []string              `yaml:"topics"`          //topic filters, with the + and # wildcards
+	QoS                               int                   `yaml:"qos"`             //maximum QoS of the messages, 0 by default
+	ClientID                          string                `yaml:"client_id"`       //random if empty
+	CleanSession                      *bool                 `yaml:"clean_session"`   //true by default. If false, the broker keeps the messages of QoS 1 and 2 while crowdsec is away
+	KeepAlive                         *time.Duration        `yaml:"keep_alive"`      //interval of the pings to the broker
+	Timeout                           *time.Duration        `yaml:"timeout"`         //to connect, and for the answers of the broker
+	MaxMessageLen                     int                   `yaml:"max_message_len"` //larger messages are skipped
+	MessageField                      string                `yaml:"message_field"`   //field of the json payloads holding the log line (can be a dotted path), the whole payload if empty
+	Username                          string                `yaml:"username"`
+	Password                          string                `yaml:"password"` //can be an env://, file:// or vault:// reference
+	TLS                               *MqttTLSConfiguration `yaml:"tls"`
+}
+
+// MqttSource subscribes to topics of a MQTT broker. The messages of QoS 1 and 2 are acknowledged once they were
+// handed to crowdsec : with a persistent session (clean_session: false), the broker delivers again the messages that
+// were not acknowledged, and keeps the new ones while crowdsec is disconnected
+type MqttSource struct {
+	configuration.HealthTracker
+	config   MqttConfiguration
+	logger   *log.Entry
+	options  *mqtt.ClientOptions
+	password *secrets.Secret //resolved again on each connection
+	dial     func(handler messageHandler) (session, error)
+	retrier  *retry.Retrier
+}
+
+func (m *MqttSource) GetMetrics() []prometheus.Collector {
+	return []prometheus.Collector{linesRead}
+}
+
+func (m *MqttSource) GetAggregMetrics() []prometheus.Collector {
+	return []prometheus.Collector{linesRead}
+}
+
+// validTopicFilter checks the wildcards of a topic filter : + must be a whole level, and # the whole last level
+func validTopicFilter(filter string) bool {
+	if filter == "" || len(filter) > 65535 || strings.ContainsRune(filter, 0) {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return false
+		}
+		if strings.Contains(level, "+") && level != "+" {
+			return false
+		}
+	}
+	return true
+}
+
+// matchTopic tells if a topic matches a topic filter. Like the brokers, the wildcards at the beginning of a filter
+// do not match the topics starting with $ (eg. $SYS)
+func matchTopic(filter string, topic string) bool {
+	if strings.HasPrefix(filter, "$share/") {
+		//$share/<group>/<filter>
+		parts := strings.SplitN(filter, "/", 3)
+		if len(parts) < 3 {
+			return false
+		}
+		filter = parts[2]
+	}
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+func (m *MqttSource) Configure(yamlConfig []byte, logger *log.Entry) error {
+	m.logger = logger
+	config := MqttConfiguration{}
+	config.Mode = configuration.TAIL_MODE
+	if err := yaml.UnmarshalStrict(yamlConfig, &config); err != nil {
+		return errors.Wrap(err, "Cannot parse mqtt datasource configuration")
+	}
+	if config.Mode != configuration.TAIL_MODE {
+		return fmt.Errorf("unsupported mode %s for mqtt datasource", config.Mode)
+	}
+	if config.URL == "" {
+		config.URL = defaultURL
+	}
+	brokerURL, err := url.Parse(config.URL)
+	if err != nil {
+		return errors.Wrapf(err, "invalid url %s", config.URL)
+	}
+	if brokerURL.Scheme != "mqtt" && brokerURL.Scheme != "mqtts" {
+		return fmt.Errorf("invalid url %s : scheme must be mqtt or mqtts", config.URL)
+	}
+	if len(config.Topics) == 0 {
+		return fmt.Errorf("topics is mandatory")
+	}
+	for _, topic := range config.Topics {
+		if !validTopicFilter(topic) {
+			return fmt.Errorf("invalid topic '%s'", topic)
+		}
+	}
+	if config.QoS < 0 || config.QoS > 2 {
+		return fmt.Errorf("invalid qos %d (must be 0, 1 or 2)", config.QoS)
+	}
+	if config.CleanSession == nil {
+		cleanSession := true
+		config.CleanSession = &cleanSession
+	}
+	if config.ClientID == "" {
+		if !*config.CleanSession {
+			return fmt.Errorf("client_id is mandatory when clean_session is false")
+		}
+		buf := make([]byte, 6)
+		_, _ = rand.Read(buf)
+		config.ClientID = "crowdsec-" + hex.EncodeToString(buf)
+	}
+	if config.KeepAlive == nil {
+		config.KeepAlive = &defaultKeepAlive
+	}
+	if *config.KeepAlive < time.Second || *config.KeepAlive > 65535*time.Second {
+		return fmt.Errorf("invalid keep_alive %s", *config.KeepAlive)
+	}
+	if config.Timeout == nil {
+		config.Timeout = &defaultTimeout
+	}
+	if config.MaxMessageLen == 0 {
+		config.MaxMessageLen = defaultMaxMessageLen
+	}
+	if config.MaxMessageLen < 0 {
+		return fmt.Errorf("invalid max_message_len %d", config.MaxMessageLen)
+	}
+	m.password, err = secrets.NewSecret(config.Password, m.logger)
+	if err != nil {
+		return errors.Wrap(err, "invalid password")
+	}
+	if m.password.Get() != "" && config.Username == "" {
+		return fmt.Errorf("password requires a username")
+	}
+	if brokerURL.Port() == "" {
+		port := "1883"
+		if brokerURL.Scheme == "mqtts" {
+			port = "8883"
+		}
+		brokerURL.Host = net.JoinHostPort(brokerURL.Hostname(), port)
+	}
+	//MQTT 3.1.1, with manual acks of the messages that are handled in order. The datasource reconnects itself, with
+	//the retry policy
+	m.options = mqtt.NewClientOptions().
+		AddBroker(brokerURL.String()).
+		SetProtocolVersion(4).
+		SetClientID(config.ClientID).
+		SetCleanSession(*config.CleanSession).
+		SetKeepAlive(*config.KeepAlive).
+		SetPingTimeout(*config.Timeout).
+		SetConnectTimeout(*config.Timeout).
+		SetWriteTimeout(*config.Timeout).
+		SetUsername(config.Username).
+		SetPassword(m.password.Get()).
+		SetOrderMatters(true).
+		SetAutoAckDisabled(true).
+		SetAutoReconnect(false).
+		SetConnectRetry(false)
+	m.dial = m.dialSession
+	if config.TLS != nil && brokerURL.Scheme != "mqtts" {
+		return fmt.Errorf("the tls section requires a mqtts:// url")
+	}
+	if brokerURL.Scheme == "mqtts" {
+		if config.TLS == nil {
+			config.TLS = &MqttTLSConfiguration{}
+		}
+		if err := m.configureTLS(config.TLS); err != nil {
+			return err
+		}
+	}
+	m.retrier, err = retry.New(config.Retry, m.logger)
+	if err != nil {
+		return err
+	}
+	m.retrier.Notify = m.notifyRetry
+	m.config = config
+	return nil
+}
+
+func (m *MqttSource) configureTLS(config *MqttTLSConfiguration) error {
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify, MinVersion: tls.VersionTLS12}
+	if config.CAFile != "" {
+		pem, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return errors.Wrapf(err, "while reading tls.ca_file %s", config.CAFile)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in tls.ca_file %s", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		return fmt.Errorf("tls.cert_file and tls.key_file must be set together")
+	}
+	if config.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return errors.Wrap(err, "could not load client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	m.options.SetTLSConfig(tlsConfig)
+	return nil
+}
+
+// notifyRetry reports the failing connections in the health of the datasource
+func (m *MqttSource) notifyRetry(err error) {
+	if err != nil {
+		m.SetState(configuration.STATUS_RECONNECTING, err)
+	} else {
+		m.SetState(configuration.STATUS_RUNNING, nil)
+	}
+}
+
+func (m *MqttSource) ConfigureByDSN(dsn string, labels map[string]string, logger *log.Entry) error {
+	return fmt.Errorf("mqtt datasource does not support one shot acquisition")
+}
+
+func (m *MqttSource) GetMode() string {
+	return m.config.Mode
+}
+
+func (m *MqttSource) GetName() string {
+	return "mqtt"
+}
+
+func (m *MqttSource) GetUuid() string {
+	return m.config.UniqueId
+}
+
+func (m *MqttSource) OneShotAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	return fmt.Errorf("mqtt datasource does not support one shot acquisition")
+}
+
+func (m *MqttSource) CanRun() error {
+	return nil
+}
+
+func (m *MqttSource) Dump() interface{} {
+	return m
+}
+
+// message returns the log line of a message : the message field of its json payload if configured, else the payload
+func (m *MqttSource) message(payload []byte) (string, error) {
+	if m.config.MessageField == "" {
+		return string(payload), nil
+	}
+	var doc interface{}
+	if err := json.Unmarshal(payload, &doc); err != nil {
+		return "", errors.Wrap(err, "invalid json payload")
+	}
+	value, ok := lookup(doc, m.config.MessageField)
+	if !ok {
+		return "", fmt.Errorf("no field %s in payload", m.config.MessageField)
+	}
+	if str, ok := value.(string); ok {
+		return str, nil
+	}
+	ret, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(ret), nil
+}
+
+// lookup returns the value of field in doc. The field can be a flat key containing dots, or a path in nested objects
+func lookup(doc interface{}, field string) (interface{}, bool) {
+	obj, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	if value, ok := obj[field]; ok {
+		return value, true
+	}
+	for i := 0; i < len(field); i++ {
+		if field[i] != '.' {
+			continue
+		}
+		if value, ok := obj[field[:i]]; ok {
+			if ret, ok := lookup(value, field[i+1:]); ok {
+				return ret, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// filterOf returns the configured topic filter matching a topic, for the metrics
+func (m *MqttSource) filterOf(topic string) string {
+	for _, filter := range m.config.Topics {
+		if matchTopic(filter, topic) {
+			return filter
+		}
+	}
+	return topic
+}
+
+// handle hands a message to crowdsec. It returns false if dying was closed meanwhile
+func (m *MqttSource) handle(msg mqtt.Message, out chan types.Event, dying <-chan struct{}, expectMode int) bool {
+	if len(msg.Payload()) > m.config.MaxMessageLen {
+		m.logger.Warningf("skipping message of %s : larger than %d bytes", msg.Topic(), m.config.MaxMessageLen)
+		return true
+	}
+	raw, err := m.message(msg.Payload())
+	if err != nil {
+		m.logger.Warningf("skipping message of %s : %s", msg.Topic(), err)
+		return true
+	}
+	l := types.Line{}
+	l.Raw = raw
+	l.Src = msg.Topic()
+	l.Time = time.Now().UTC()
+	l.Labels = m.config.Labels
+	l.Process = true
+	l.Module = m.GetName()
+	linesRead.With(prometheus.Labels{"topic": m.filterOf(msg.Topic())}).Inc()
+	m.EventSeen(&l)
+	select {
+	case out <- types.Event{Line: l, Process: true, Type: types.LOG, ExpectMode: expectMode}:
+		return true
+	case <-dying:
+		return false
+	}
+}
+
+// consume subscribes to the topics and hands the messages to crowdsec, until the connection fails or dying is closed
+func (m *MqttSource) consume(out chan types.Event, dying <-chan struct{}, expectMode int) error {
+	s, err := m.dial(func(msg mqtt.Message) bool {
+		return m.handle(msg, out, dying, expectMode)
+	})
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	m.logger.Infof("subscribed to %s", strings.Join(m.config.Topics, ", "))
+	m.SetState(configuration.STATUS_RUNNING, nil)
+	select {
+	case <-dying:
+		return nil
+	case err := <-s.Lost():
+		return errors.Wrap(err, "connection to broker lost")
+	}
+}
+
+func (m *MqttSource) StreamingAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	expectMode := leaky.LIVE
+	if m.config.UseTimeMachine {
+		expectMode = leaky.TIMEMACHINE
+	}
+	t.Go(func() error {
+		defer types.CatchPanic("crowdsec/acquis/mqtt/live")
+		m.logger.Infof("connecting to %s as %s", m.config.URL, m.config.ClientID)
+		err := m.retrier.Do(t.Dying(), func() error {
+			return m.consume(out, t.Dying(), expectMode)
+		})
+		if err == retry.ErrDying || err == nil {
+			m.logger.Infof("mqtt datasource stopping")
+			return nil
+		}
+		err = errors.Wrapf(err, "while consuming %s", m.config.URL)
+		m.SetState(configuration.STATUS_ERRORED, err)
+		return err
+	})
+	return nil
+}
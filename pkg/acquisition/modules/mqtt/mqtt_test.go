@@ -0,0 +1,389 @@
+package mqttacquisition
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/cstest"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/tomb.v2"
+)
+
+func TestConfigure(t *testing.T) {
+	tests := []struct {
+		config      string
+		expectedErr string
+	}{
+		{
+			config:      `foobar: bla`,
+			expectedErr: "field foobar not found in type mqttacquisition.MqttConfiguration",
+		},
+		{
+			config:      `source: mqtt`,
+			expectedErr: "topics is mandatory",
+		},
+		{
+			config: `
+source: mqtt
+topics: [devices/+/logs, $share/crowdsec/syslog/#]
+qos: 1`,
+			expectedErr: "",
+		},
+		{
+			config: `
+topics: [logs]
+mode: cat`,
+			expectedErr: "unsupported mode cat for mqtt datasource",
+		},
+		{
+			config: `
+topics: [logs]
+url: http://localhost:1883`,
+			expectedErr: "scheme must be mqtt or mqtts",
+		},
+		{
+			config: `
+topics: [logs/#/errors]`,
+			expectedErr: "invalid topic 'logs/#/errors'",
+		},
+		{
+			config: `
+topics: [logs/dev+]`,
+			expectedErr: "invalid topic 'logs/dev+'",
+		},
+		{
+			config: `
+topics: [logs]
+qos: 3`,
+			expectedErr: "invalid qos 3",
+		},
+		{
+			config: `
+topics: [logs]
+clean_session: false`,
+			expectedErr: "client_id is mandatory when clean_session is false",
+		},
+		{
+			config: `
+topics: [logs]
+keep_alive: 10ms`,
+			expectedErr: "invalid keep_alive 10ms",
+		},
+		{
+			config: `
+topics: [logs]
+password: secret`,
+			expectedErr: "password requires a username",
+		},
+		{
+			config: `
+topics: [logs]
+tls:
+  insecure_skip_verify: true`,
+			expectedErr: "the tls section requires a mqtts:// url",
+		},
+		{
+			config: `
+topics: [logs]
+url: mqtts://localhost
+tls:
+  key_file: client.key`,
+			expectedErr: "tls.cert_file and tls.key_file must be set together",
+		},
+	}
+	subLogger := log.WithFields(log.Fields{
+		"type": "mqtt",
+	})
+	for _, test := range tests {
+		m := MqttSource{}
+		err := m.Configure([]byte(test.config), subLogger)
+		cstest.AssertErrorContains(t, err, test.expectedErr)
+	}
+}
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		match  bool
+	}{
+		{"logs", "logs", true},
+		{"logs", "logs/web", false},
+		{"devices/+/logs", "devices/gw1/logs", true},
+		{"devices/+/logs", "devices/gw1/metrics", false},
+		{"devices/+/logs", "devices/logs", false},
+		{"devices/#", "devices", true},
+		{"devices/#", "devices/gw1/logs", true},
+		{"#", "devices/gw1/logs", true},
+		{"#", "$SYS/broker/uptime", false},
+		{"+/broker/uptime", "$SYS/broker/uptime", false},
+		{"$SYS/#", "$SYS/broker/uptime", true},
+		{"$share/crowdsec/devices/+", "devices/gw1", true},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.match, matchTopic(test.filter, test.topic), "%s %s", test.filter, test.topic)
+	}
+}
+
+func TestClientOptions(t *testing.T) {
+	m := MqttSource{}
+	require.NoError(t, m.Configure([]byte(`
+url: mqtts://broker.example.com
+topics: [devices/+/logs]
+client_id: crowdsec-test
+clean_session: false
+keep_alive: 1m
+username: crowdsec
+password: secret`), log.WithField("type", "mqtt")))
+	require.Len(t, m.options.Servers, 1)
+	assert.Equal(t, "mqtts://broker.example.com:8883", m.options.Servers[0].String())
+	assert.Equal(t, "crowdsec-test", m.options.ClientID)
+	assert.False(t, m.options.CleanSession)
+	assert.Equal(t, time.Minute, time.Duration(m.options.KeepAlive)*time.Second)
+	assert.Equal(t, "crowdsec", m.options.Username)
+	assert.Equal(t, "secret", m.options.Password)
+	assert.NotNil(t, m.options.TLSConfig)
+	//the messages are acknowledged by the datasource, in order, and it reconnects itself
+	assert.True(t, m.options.AutoAckDisabled)
+	assert.True(t, m.options.Order)
+	assert.False(t, m.options.AutoReconnect)
+}
+
+// fakeMessage records its ack, like paho only the messages of QoS 1 and 2 are acknowledged
+type fakeMessage struct {
+	topic   string
+	qos     byte
+	id      uint16
+	payload string
+	acks    chan uint16
+}
+
+func (m *fakeMessage) Duplicate() bool {
+	return false
+}
+
+func (m *fakeMessage) Qos() byte {
+	return m.qos
+}
+
+func (m *fakeMessage) Retained() bool {
+	return false
+}
+
+func (m *fakeMessage) Topic() string {
+	return m.topic
+}
+
+func (m *fakeMessage) MessageID() uint16 {
+	return m.id
+}
+
+func (m *fakeMessage) Payload() []byte {
+	return []byte(m.payload)
+}
+
+func (m *fakeMessage) Ack() {
+	if m.qos > 0 {
+		m.acks <- m.id
+	}
+}
+
+// fakeSession calls the handler for its messages like the paho router, then loses the connection if lost is set
+type fakeSession struct {
+	lost   chan error
+	done   chan struct{}
+	closed bool
+}
+
+func newFakeSession(handler messageHandler, messages []*fakeMessage, lost error) *fakeSession {
+	s := &fakeSession{lost: make(chan error, 1), done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		for _, msg := range messages {
+			if handler(msg) {
+				msg.Ack()
+			}
+		}
+		if lost != nil {
+			s.lost <- lost
+		}
+	}()
+	return s
+}
+
+func (s *fakeSession) Lost() <-chan error {
+	return s.lost
+}
+
+func (s *fakeSession) Close() {
+	//paho waits for the handler too
+	<-s.done
+	s.closed = true
+}
+
+func TestStreamingAcquisition(t *testing.T) {
+	acks := make(chan uint16, 10)
+	sessions := [][]*fakeMessage{
+		{
+			{topic: "devices/gw1/logs", payload: `{"log": {"message": "line 1"}}`},
+			{topic: "devices/gw2/logs", qos: 1, id: 7, payload: `{"log": {"message": "line 2"}}`},
+			{topic: "devices/gw2/logs", qos: 1, id: 8, payload: `not json`},
+			{topic: "devices/gw2/logs", qos: 1, id: 9, payload: `{"log": {"message": "` + strings.Repeat("a", 2000) + `"}}`},
+		},
+		{
+			{topic: "devices/gw1/logs", qos: 2, id: 10, payload: `{"log": {"message": "line 3"}}`},
+		},
+	}
+	m := MqttSource{}
+	require.NoError(t, m.Configure([]byte(`
+source: mqtt
+topics: [devices/+/logs]
+qos: 2
+client_id: crowdsec-test
+clean_session: false
+message_field: log.message
+max_message_len: 1000
+retry:
+  base: 10ms`), log.WithField("type", "mqtt")))
+	dialed := []*fakeSession{}
+	m.dial = func(handler messageHandler) (session, error) {
+		messages := sessions[len(dialed)]
+		for _, msg := range messages {
+			msg.acks = acks
+		}
+		var lost error
+		if len(dialed) == 0 {
+			//the datasource connects again
+			lost = fmt.Errorf("EOF")
+		}
+		s := newFakeSession(handler, messages, lost)
+		dialed = append(dialed, s)
+		return s, nil
+	}
+	out := make(chan types.Event)
+	tmb := tomb.Tomb{}
+	require.NoError(t, m.StreamingAcquisition(out, &tmb))
+	for _, expected := range []string{"line 1", "line 2", "line 3"} {
+		select {
+		case evt := <-out:
+			assert.Equal(t, expected, evt.Line.Raw)
+			assert.True(t, strings.HasPrefix(evt.Line.Src, "devices/"))
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout waiting for %s", expected)
+		}
+	}
+	//the skipped messages are acknowledged too
+	for _, expected := range []uint16{7, 8, 9, 10} {
+		select {
+		case ack := <-acks:
+			assert.Equal(t, expected, ack)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout waiting for ack %d", expected)
+		}
+	}
+	tmb.Kill(nil)
+	require.NoError(t, tmb.Wait())
+	require.Len(t, dialed, 2)
+	assert.True(t, dialed[0].closed)
+	assert.True(t, dialed[1].closed)
+}
+
+func TestNotAckedOnStop(t *testing.T) {
+	acks := make(chan uint16, 1)
+	m := MqttSource{}
+	require.NoError(t, m.Configure([]byte("topics: [logs]\nqos: 1"), log.WithField("type", "mqtt")))
+	m.dial = func(handler messageHandler) (session, error) {
+		return newFakeSession(handler, []*fakeMessage{{topic: "logs", qos: 1, id: 1, payload: "line 1", acks: acks}}, nil), nil
+	}
+	tmb := tomb.Tomb{}
+	//nobody reads the events
+	require.NoError(t, m.StreamingAcquisition(make(chan types.Event), &tmb))
+	time.Sleep(50 * time.Millisecond)
+	tmb.Kill(nil)
+	require.NoError(t, tmb.Wait())
+	//the broker delivers it again
+	assert.Empty(t, acks)
+}
+
+func TestRefusedConnection(t *testing.T) {
+	for _, test := range []struct {
+		code        byte
+		expectedErr string
+		permanent   bool
+	}{
+		{
+			code:        packets.ErrRefusedNotAuthorised,
+			expectedErr: "connection refused by broker : not authorized (code 5)",
+			permanent:   true,
+		},
+		{
+			code:        packets.ErrRefusedBadUsernameOrPassword,
+			expectedErr: "connection refused by broker : bad username or password (code 4)",
+			permanent:   true,
+		},
+		{
+			code:        packets.ErrRefusedServerUnavailable,
+			expectedErr: "connection refused by broker : server unavailable (code 3)",
+		},
+		{
+			code:        packets.ErrNetworkError,
+			expectedErr: "network Error : dial tcp 127.0.0.1:1883: connect: connection refused",
+		},
+	} {
+		m := MqttSource{}
+		require.NoError(t, m.Configure([]byte(`
+topics: ["#"]
+retry:
+  base: 10ms
+  max_attempts: 2`), log.WithField("type", "mqtt")))
+		attempts := 0
+		m.dial = func(handler messageHandler) (session, error) {
+			attempts++
+			return nil, connectError(test.code, fmt.Errorf("network Error : dial tcp 127.0.0.1:1883: connect: connection refused"))
+		}
+		tmb := tomb.Tomb{}
+		require.NoError(t, m.StreamingAcquisition(make(chan types.Event), &tmb))
+		select {
+		case <-tmb.Dead():
+		case <-time.After(2 * time.Second):
+			t.Fatal("timeout waiting for the datasource to stop")
+		}
+		cstest.AssertErrorContains(t, tmb.Err(), test.expectedErr)
+		//the refusals coming from the configuration are not retried
+		if test.permanent {
+			assert.Equal(t, 1, attempts, "code %d", test.code)
+		} else {
+			assert.Equal(t, 2, attempts, "code %d", test.code)
+		}
+	}
+}
+
+func TestDialRefused(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			//not a MQTT broker
+			conn.Close()
+		}
+	}()
+	m := MqttSource{}
+	require.NoError(t, m.Configure([]byte("topics: [logs]\ntimeout: 1s\nurl: mqtt://"+listener.Addr().String()), log.WithField("type", "mqtt")))
+	_, err = m.dial(func(msg mqtt.Message) bool {
+		return true
+	})
+	assert.Error(t, err)
+}
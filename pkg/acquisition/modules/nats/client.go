@@ -0,0 +1,158 @@
+package natsacquisition
+
+import (
+	"strings"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/retry"
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+// subscription is the part of a nats.go pull subscription used by the datasource
+type subscription interface {
+	// Fetch waits up to maxWait for a batch of messages, it returns nats.ErrTimeout if there was none
+	Fetch(batch int, maxWait time.Duration) ([]*nats.Msg, error)
+	// Ack tells the server that the message was handed to crowdsec
+	Ack(msg *nats.Msg) error
+	// Close closes the connection. The ephemeral consumer of cat mode is deleted, the durable one is kept
+	Close()
+}
+
+// permanentErrors are the refusals of the server that come from the configuration of the datasource
+var permanentErrors = []error{
+	nats.ErrAuthorization,
+	nats.ErrAuthExpired,
+	nats.ErrAuthRevoked,
+	nats.ErrAccountAuthExpired,
+	nats.ErrJetStreamNotEnabled,
+	nats.ErrSubjectMismatch,
+}
+
+// wrapError makes the refusals of the server permanent. nats.go returns the -ERR received while connecting, and the
+// errors of the JetStream api, as their description : an unknown stream is one of them
+func wrapError(err error) error {
+	for _, permanent := range permanentErrors {
+		if errors.Is(err, permanent) {
+			return retry.Permanent(err)
+		}
+		if strings.EqualFold(err.Error(), permanent.Error()) {
+			return retry.Permanent(permanent)
+		}
+	}
+	if strings.Contains(err.Error(), "stream not found") {
+		return retry.Permanent(err)
+	}
+	return err
+}
+
+// matchSubject tells if a subject matches a filter, where * matches a token and > the remaining ones
+func matchSubject(filter string, subject string) bool {
+	filterTokens := strings.Split(filter, ".")
+	subjectTokens := strings.Split(subject, ".")
+	for i, token := range filterTokens {
+		if token == ">" {
+			return len(subjectTokens) > i
+		}
+		if i >= len(subjectTokens) {
+			return false
+		}
+		if token != "*" && token != subjectTokens[i] {
+			return false
+		}
+	}
+	return len(filterTokens) == len(subjectTokens)
+}
+
+// consumerConfig is the configuration of the durable consumer of tail mode
+func (n *NatsSource) consumerConfig() *nats.ConsumerConfig {
+	config := &nats.ConsumerConfig{
+		Durable:       n.config.Consumer,
+		AckPolicy:     nats.AckExplicitPolicy,
+		FilterSubject: n.filterSubject(),
+	}
+	if n.config.AckWait != nil {
+		config.AckWait = *n.config.AckWait
+	}
+	switch {
+	case n.config.StartSeq != 0:
+		config.DeliverPolicy = nats.DeliverByStartSequencePolicy
+		config.OptStartSeq = n.config.StartSeq
+	case !n.since.IsZero():
+		config.DeliverPolicy = nats.DeliverByStartTimePolicy
+		config.OptStartTime = &n.since
+	default:
+		config.DeliverPolicy = nats.DeliverNewPolicy
+	}
+	return config
+}
+
+// filterSubject is the subject filtered by the consumer. The consumers of NATS < 2.10 filter one subject at most, so
+// with several subjects the consumer reads the whole stream and the datasource skips the other subjects
+func (n *NatsSource) filterSubject() string {
+	if len(n.config.Subjects) == 1 {
+		return n.config.Subjects[0]
+	}
+	return ""
+}
+
+type natsSubscription struct {
+	conn      *nats.Conn
+	sub       *nats.Subscription
+	ephemeral bool
+}
+
+// dialSubscription connects to the server, and creates the pull consumer : an ephemeral one in cat mode, or the
+// durable one of tail mode, unless it was created by a previous run
+func (n *NatsSource) dialSubscription() (subscription, error) {
+	conn, err := nats.Connect(n.config.URL, n.options...)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	s := &natsSubscription{conn: conn}
+	js, err := conn.JetStream(nats.MaxWait(*n.config.Timeout))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if n.config.Mode == configuration.CAT_MODE {
+		opts := []nats.SubOpt{nats.BindStream(n.config.Stream), nats.AckExplicit()}
+		switch {
+		case n.config.StartSeq != 0:
+			opts = append(opts, nats.StartSequence(n.config.StartSeq))
+		case !n.since.IsZero():
+			opts = append(opts, nats.StartTime(n.since))
+		default:
+			opts = append(opts, nats.DeliverAll())
+		}
+		s.ephemeral = true
+		s.sub, err = js.PullSubscribe(n.filterSubject(), "", opts...)
+	} else {
+		//the deliver policy only applies when the durable consumer is created, it then resumes after the acked messages
+		if _, err = js.AddConsumer(n.config.Stream, n.consumerConfig()); err == nil {
+			s.sub, err = js.PullSubscribe(n.filterSubject(), n.config.Consumer, nats.BindStream(n.config.Stream))
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrapf(wrapError(err), "while creating consumer on stream %s", n.config.Stream)
+	}
+	return s, nil
+}
+
+func (s *natsSubscription) Fetch(batch int, maxWait time.Duration) ([]*nats.Msg, error) {
+	return s.sub.Fetch(batch, nats.MaxWait(maxWait))
+}
+
+func (s *natsSubscription) Ack(msg *nats.Msg) error {
+	return msg.Ack()
+}
+
+func (s *natsSubscription) Close() {
+	if s.ephemeral {
+		//deletes the consumer
+		_ = s.sub.Unsubscribe()
+	}
+	s.conn.Close()
+}
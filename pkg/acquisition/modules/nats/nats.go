@@ -0,0 +1,504 @@
+package natsacquisition
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/retry"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/secrets"
+	leaky "github.com/crowdsecurity/crowdsec/pkg/leakybucket"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/tomb.v2"
+	"gopkg.in/yaml.v2"
+)
+
+var linesRead = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cs_natssource_hits_total",
+		Help: "Total messages that were read from NATS JetStream.",
+	},
+	[]string{"stream"})
+
+var (
+	defaultTimeout = 10 * time.Second
+	defaultMaxWait = 5 * time.Second
+)
+
+const (
+	defaultURL       = "nats://127.0.0.1:4222"
+	defaultConsumer  = "crowdsec"
+	defaultBatchSize = 100
+)
+
+type NatsTLSConfiguration struct {
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"` //client certificate, when the server verifies them
+	KeyFile            string `yaml:"key_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+type NatsConfiguration struct {
+	configuration.DataSourceCommonCfg `yaml:",inline"`
+	URL                               string                `yaml:"url"`        //eg. nats://localhost:4222, or tls://localhost:4222 to require TLS
+	Stream                            string                `yaml:"stream"`     //JetStream stream to read
+	Subjects                          []string              `yaml:"subjects"`   //subjects of the stream to read (with the * and > wildcards), all of them if empty
+	Consumer                          string                `yaml:"consumer"`   //durable consumer of tail mode, that remembers the acked messages
+	StartSeq                          uint64                `yaml:"start_seq"`  //first stream sequence to read
+	Since                             string                `yaml:"since"`      //RFC3339 date, or duration before now (eg. 1h)
+	BatchSize                         int                   `yaml:"batch_size"` //messages asked by each pull request
+	MaxWait                           *time.Duration        `yaml:"max_wait"`   //how long a pull request waits for messages
+	AckWait                           *time.Duration        `yaml:"ack_wait"`   //how long before a message that was not acked is redelivered
+	Timeout                           *time.Duration        `yaml:"timeout"`    //to connect, and for the answers of the JetStream api
+	Username                          string                `yaml:"username"`
+	Password                          string                `yaml:"password"` //can be env://, file:// or vault:// references, like token and nkey_seed
+	Token                             string                `yaml:"token"`
+	NkeySeed                          string                `yaml:"nkey_seed"`        //seed of a user nkey (SU...)
+	CredentialsFile                   string                `yaml:"credentials_file"` //user jwt and nkey seed, as generated by nsc
+	TLS                               *NatsTLSConfiguration `yaml:"tls"`
+}
+
+// NatsSource reads the messages of a JetStream stream with a pull consumer. In tail mode, the consumer is durable
+// and each message is acked once it was handed to crowdsec : after a disconnection or a restart, the server delivers
+// the messages that followed. In cat mode, an ephemeral consumer reads the messages stored in the stream
+type NatsSource struct {
+	configuration.HealthTracker
+	config    NatsConfiguration
+	logger    *log.Entry
+	options   []nats.Option
+	subscribe func() (subscription, error)
+	retrier   *retry.Retrier
+	since     time.Time
+}
+
+func (n *NatsSource) GetMetrics() []prometheus.Collector {
+	return []prometheus.Collector{linesRead}
+}
+
+func (n *NatsSource) GetAggregMetrics() []prometheus.Collector {
+	return []prometheus.Collector{linesRead}
+}
+
+func (n *NatsSource) Configure(yamlConfig []byte, logger *log.Entry) error {
+	n.logger = logger
+	config := NatsConfiguration{}
+	if err := yaml.UnmarshalStrict(yamlConfig, &config); err != nil {
+		return errors.Wrap(err, "Cannot parse nats datasource configuration")
+	}
+	if config.Mode == "" {
+		config.Mode = configuration.TAIL_MODE
+	}
+	return n.configure(config)
+}
+
+// validName tells if a stream or consumer name can be used in the subjects of the JetStream api
+func validName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, " \t\r\n.*>/\\")
+}
+
+// configure checks the configuration and sets the defaults, for Configure and ConfigureByDSN
+func (n *NatsSource) configure(config NatsConfiguration) error {
+	if config.Mode != configuration.CAT_MODE && config.Mode != configuration.TAIL_MODE {
+		return fmt.Errorf("unsupported mode %s for nats datasource", config.Mode)
+	}
+	if config.URL == "" {
+		config.URL = defaultURL
+	}
+	serverURL, err := url.Parse(config.URL)
+	if err != nil {
+		return errors.Wrapf(err, "invalid url %s", config.URL)
+	}
+	if serverURL.Scheme != "nats" && serverURL.Scheme != "tls" {
+		return fmt.Errorf("invalid url %s : scheme must be nats or tls", config.URL)
+	}
+	if !validName(config.Stream) {
+		return fmt.Errorf("invalid stream name '%s'", config.Stream)
+	}
+	if config.Consumer == "" {
+		config.Consumer = defaultConsumer
+	}
+	if !validName(config.Consumer) {
+		return fmt.Errorf("invalid consumer name '%s'", config.Consumer)
+	}
+	for _, subject := range config.Subjects {
+		if subject == "" || strings.ContainsAny(subject, " \t\r\n") {
+			return fmt.Errorf("invalid subject '%s'", subject)
+		}
+	}
+	if n.since, err = configuration.ParseTime(config.Since); err != nil {
+		return errors.Wrap(err, "invalid since")
+	}
+	if config.StartSeq != 0 && !n.since.IsZero() {
+		return fmt.Errorf("start_seq and since are mutually exclusive")
+	}
+	if config.BatchSize == 0 {
+		config.BatchSize = defaultBatchSize
+	}
+	if config.BatchSize < 0 {
+		return fmt.Errorf("invalid batch_size %d", config.BatchSize)
+	}
+	if config.MaxWait == nil {
+		config.MaxWait = &defaultMaxWait
+	}
+	if config.Timeout == nil {
+		config.Timeout = &defaultTimeout
+	}
+	//the datasource reconnects itself, with the retry policy
+	n.options = []nats.Option{nats.Name("crowdsec"), nats.Timeout(*config.Timeout), nats.NoReconnect()}
+	n.subscribe = n.dialSubscription
+	if err := n.configureAuth(config); err != nil {
+		return err
+	}
+	if config.TLS != nil {
+		if err := n.configureTLS(config.TLS); err != nil {
+			return err
+		}
+	}
+	n.retrier, err = retry.New(config.Retry, n.logger)
+	if err != nil {
+		return err
+	}
+	n.retrier.Notify = n.notifyRetry
+	n.config = config
+	return nil
+}
+
+func (n *NatsSource) configureAuth(config NatsConfiguration) error {
+	methods := 0
+	for _, value := range []string{config.Username, config.Token, config.NkeySeed, config.CredentialsFile} {
+		if value != "" {
+			methods++
+		}
+	}
+	if methods > 1 {
+		return fmt.Errorf("username/password, token, nkey_seed and credentials_file are mutually exclusive")
+	}
+	switch {
+	case config.Username != "":
+		password, err := secrets.NewSecret(config.Password, n.logger)
+		if err != nil {
+			return errors.Wrap(err, "invalid password")
+		}
+		n.options = append(n.options, secretOption(password, func(password string) (nats.Option, error) {
+			return nats.UserInfo(config.Username, password), nil
+		}))
+	case config.Token != "":
+		token, err := secrets.NewSecret(config.Token, n.logger)
+		if err != nil {
+			return errors.Wrap(err, "invalid token")
+		}
+		n.options = append(n.options, secretOption(token, func(token string) (nats.Option, error) {
+			return nats.Token(token), nil
+		}))
+	case config.NkeySeed != "":
+		seed, err := secrets.NewSecret(config.NkeySeed, n.logger)
+		if err != nil {
+			return errors.Wrap(err, "invalid nkey_seed")
+		}
+		if _, err := nkeyOption(seed.Get()); err != nil {
+			return err
+		}
+		n.options = append(n.options, secretOption(seed, nkeyOption))
+	case config.CredentialsFile != "":
+		content, err := ioutil.ReadFile(config.CredentialsFile)
+		if err != nil {
+			return errors.Wrapf(err, "while reading credentials file %s", config.CredentialsFile)
+		}
+		if _, err := nkeys.ParseDecoratedJWT(content); err != nil {
+			return errors.Wrapf(err, "invalid credentials file %s", config.CredentialsFile)
+		}
+		if _, err := nkeys.ParseDecoratedUserNKey(content); err != nil {
+			return errors.Wrapf(err, "invalid credentials file %s", config.CredentialsFile)
+		}
+		//the file is read at each connection, so that a renewed jwt is picked up
+		n.options = append(n.options, nats.UserCredentials(config.CredentialsFile))
+	}
+	return nil
+}
+
+// secretOption builds an option with the current value of secret, on each connection
+func secretOption(secret *secrets.Secret, option func(value string) (nats.Option, error)) nats.Option {
+	return func(opts *nats.Options) error {
+		opt, err := option(secret.Get())
+		if err != nil {
+			return err
+		}
+		return opt(opts)
+	}
+}
+
+// nkeyOption authenticates with the nkey of a user seed
+func nkeyOption(seed string) (nats.Option, error) {
+	key, err := nkeys.FromSeed([]byte(strings.TrimSpace(seed)))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid nkey_seed")
+	}
+	publicKey, err := key.PublicKey()
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid nkey_seed")
+	}
+	if !nkeys.IsValidPublicUserKey(publicKey) {
+		return nil, fmt.Errorf("invalid nkey_seed : not a user seed")
+	}
+	return nats.Nkey(publicKey, key.Sign), nil
+}
+
+func (n *NatsSource) configureTLS(config *NatsTLSConfiguration) error {
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify, MinVersion: tls.VersionTLS12}
+	if config.CAFile != "" {
+		pem, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return errors.Wrapf(err, "while reading tls.ca_file %s", config.CAFile)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in tls.ca_file %s", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		return fmt.Errorf("tls.cert_file and tls.key_file must be set together")
+	}
+	if config.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return errors.Wrap(err, "could not load client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	n.options = append(n.options, nats.Secure(tlsConfig))
+	return nil
+}
+
+// notifyRetry reports the failing connections in the health of the datasource
+func (n *NatsSource) notifyRetry(err error) {
+	if err != nil {
+		n.SetState(configuration.STATUS_RECONNECTING, err)
+	} else {
+		n.SetState(configuration.STATUS_RUNNING, nil)
+	}
+}
+
+func (n *NatsSource) ConfigureByDSN(dsn string, labels map[string]string, logger *log.Entry) error {
+	n.logger = logger
+	//format for the DSN is : nats://host:port?stream=...&subject=...&start_seq=...
+	parsed, err := configuration.ParseDSN(dsn, "nats", "tls")
+	if err != nil {
+		return err
+	}
+	if parsed.Target == "" {
+		return fmt.Errorf("empty nats:// DSN")
+	}
+	if err := parsed.CheckParams("stream", "subject", "start_seq", "since", "batch_size", "username", "password",
+		"token", "nkey_seed", "credentials_file"); err != nil {
+		return err
+	}
+	if err := parsed.SetLogLevel(n.logger); err != nil {
+		return err
+	}
+	config := NatsConfiguration{}
+	config.Mode = configuration.CAT_MODE
+	config.Labels = labels
+	config.URL = parsed.Scheme + "://" + parsed.Target
+	config.Subjects = parsed.Params["subject"]
+	for key, value := range map[string]*string{
+		"stream":           &config.Stream,
+		"since":            &config.Since,
+		"username":         &config.Username,
+		"password":         &config.Password,
+		"token":            &config.Token,
+		"nkey_seed":        &config.NkeySeed,
+		"credentials_file": &config.CredentialsFile,
+	} {
+		param, err := parsed.Param(key)
+		if err != nil {
+			return err
+		}
+		if param != "" {
+			*value = param
+		}
+	}
+	if startSeq, err := parsed.Param("start_seq"); err != nil {
+		return err
+	} else if startSeq != "" {
+		if config.StartSeq, err = strconv.ParseUint(startSeq, 10, 64); err != nil {
+			return fmt.Errorf("parsing 'start_seq' parameters: %s", err)
+		}
+	}
+	if batchSize, err := parsed.Param("batch_size"); err != nil {
+		return err
+	} else if batchSize != "" {
+		if config.BatchSize, err = strconv.Atoi(batchSize); err != nil {
+			return fmt.Errorf("parsing 'batch_size' parameters: %s", err)
+		}
+	}
+	return n.configure(config)
+}
+
+func (n *NatsSource) GetMode() string {
+	return n.config.Mode
+}
+
+func (n *NatsSource) GetName() string {
+	return "nats"
+}
+
+func (n *NatsSource) GetUuid() string {
+	return n.config.UniqueId
+}
+
+func (n *NatsSource) CanRun() error {
+	return nil
+}
+
+func (n *NatsSource) Dump() interface{} {
+	return n
+}
+
+// fetch waits for a batch of messages and hands them to crowdsec, acking each of them. It returns false when there are
+// no more messages for the consumer, or dying was closed
+func (n *NatsSource) fetch(s subscription, out chan types.Event, dying <-chan struct{}, expectMode int) (bool, error) {
+	msgs, err := s.Fetch(n.config.BatchSize, *n.config.MaxWait)
+	if err == nats.ErrTimeout {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	hits := linesRead.With(prometheus.Labels{"stream": n.config.Stream})
+	more := true
+	for _, msg := range msgs {
+		if n.wanted(msg.Subject) {
+			l := types.Line{}
+			l.Raw = string(msg.Data)
+			l.Src = msg.Subject
+			l.Time = time.Now().UTC()
+			l.Labels = n.config.Labels
+			l.Process = true
+			l.Module = n.GetName()
+			hits.Inc()
+			n.EventSeen(&l)
+			select {
+			case out <- types.Event{Line: l, Process: true, Type: types.LOG, ExpectMode: expectMode}:
+			case <-dying:
+				//not acked, the message will be delivered again
+				return false, nil
+			}
+		}
+		if err := s.Ack(msg); err != nil {
+			return false, errors.Wrap(err, "while acking message")
+		}
+		if meta, err := msg.Metadata(); err == nil && meta.NumPending == 0 {
+			//the last message of the stream
+			more = false
+		}
+	}
+	return more, nil
+}
+
+// wanted tells if a message of the stream is one of the configured subjects
+func (n *NatsSource) wanted(subject string) bool {
+	if len(n.config.Subjects) < 2 {
+		//filtered by the consumer
+		return true
+	}
+	for _, filter := range n.config.Subjects {
+		if matchSubject(filter, subject) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *NatsSource) OneShotAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	n.logger.Infof("reading stream %s on %s", n.config.Stream, n.config.URL)
+	var s subscription
+	err := n.retrier.Do(t.Dying(), func() error {
+		var err error
+		s, err = n.subscribe()
+		return err
+	})
+	if err == retry.ErrDying {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "while connecting to %s", n.config.URL)
+	}
+	defer s.Close()
+	for {
+		more, err := n.fetch(s, out, t.Dying(), leaky.TIMEMACHINE)
+		if err != nil {
+			return errors.Wrapf(err, "while reading stream %s", n.config.Stream)
+		}
+		if !more {
+			break
+		}
+	}
+	t.Kill(nil)
+	return nil
+}
+
+// follow reads the stream until the connection fails, or dying is closed
+func (n *NatsSource) follow(out chan types.Event, dying <-chan struct{}, expectMode int) error {
+	s, err := n.subscribe()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer types.CatchPanic("crowdsec/acquis/nats/close")
+		select {
+		case <-dying:
+			//unblocks the pending fetch
+			s.Close()
+		case <-done:
+		}
+	}()
+	n.SetState(configuration.STATUS_RUNNING, nil)
+	for {
+		_, err := n.fetch(s, out, dying, expectMode)
+		select {
+		case <-dying:
+			return nil
+		default:
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (n *NatsSource) StreamingAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	expectMode := leaky.LIVE
+	if n.config.UseTimeMachine {
+		expectMode = leaky.TIMEMACHINE
+	}
+	t.Go(func() error {
+		defer types.CatchPanic("crowdsec/acquis/nats/live")
+		n.logger.Infof("consuming stream %s on %s with consumer %s", n.config.Stream, n.config.URL, n.config.Consumer)
+		err := n.retrier.Do(t.Dying(), func() error {
+			return n.follow(out, t.Dying(), expectMode)
+		})
+		if err == retry.ErrDying || err == nil {
+			n.logger.Infof("nats datasource stopping")
+			return nil
+		}
+		err = errors.Wrapf(err, "while consuming stream %s", n.config.Stream)
+		n.SetState(configuration.STATUS_ERRORED, err)
+		return err
+	})
+	return nil
+}
@@ -0,0 +1,378 @@
+package natsacquisition
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/cstest"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/tomb.v2"
+)
+
+const testSeed = "SUACSSL3UAHUDXKFSNVUZRF5UHPMWZ6BFDTJ7M6USDXIEDNPPQYYYCU3VY"
+
+func TestConfigure(t *testing.T) {
+	tests := []struct {
+		config      string
+		expectedErr string
+	}{
+		{
+			config:      `foobar: bla`,
+			expectedErr: "field foobar not found in type natsacquisition.NatsConfiguration",
+		},
+		{
+			config:      `source: nats`,
+			expectedErr: "invalid stream name ''",
+		},
+		{
+			config: `
+source: nats
+stream: logs`,
+			expectedErr: "",
+		},
+		{
+			config: `
+stream: logs
+url: http://localhost:4222`,
+			expectedErr: "scheme must be nats or tls",
+		},
+		{
+			config: `
+stream: logs
+consumer: crowd.sec`,
+			expectedErr: "invalid consumer name 'crowd.sec'",
+		},
+		{
+			config: `
+stream: logs
+start_seq: 10
+since: 1h`,
+			expectedErr: "start_seq and since are mutually exclusive",
+		},
+		{
+			config: `
+stream: logs
+username: crowdsec
+token: secret`,
+			expectedErr: "mutually exclusive",
+		},
+		{
+			config: `
+stream: logs
+nkey_seed: SUAINVALID`,
+			expectedErr: "invalid nkey_seed",
+		},
+		{
+			config: `
+stream: logs
+tls:
+  cert_file: client.crt`,
+			expectedErr: "tls.cert_file and tls.key_file must be set together",
+		},
+	}
+	subLogger := log.WithFields(log.Fields{
+		"type": "nats",
+	})
+	for _, test := range tests {
+		n := NatsSource{}
+		err := n.Configure([]byte(test.config), subLogger)
+		cstest.AssertErrorContains(t, err, test.expectedErr)
+	}
+}
+
+// natsOptions applies the options of the datasource
+func natsOptions(n *NatsSource) nats.Options {
+	opts := nats.GetDefaultOptions()
+	for _, opt := range n.options {
+		_ = opt(&opts)
+	}
+	return opts
+}
+
+func TestAuth(t *testing.T) {
+	n := NatsSource{}
+	require.NoError(t, n.Configure([]byte("stream: logs\nusername: crowdsec\npassword: secret"), log.WithField("type", "nats")))
+	opts := natsOptions(&n)
+	assert.Equal(t, "crowdsec", opts.User)
+	assert.Equal(t, "secret", opts.Password)
+	assert.False(t, opts.AllowReconnect)
+
+	//the seed and its public key are the ones of the nkeys documentation
+	require.NoError(t, n.Configure([]byte("stream: logs\nnkey_seed: "+testSeed), log.WithField("type", "nats")))
+	opts = natsOptions(&n)
+	assert.Equal(t, "UDXU4RCSJNZOIQHZNWXHXORDPRTGNJAHAHFRGZNEEJCPQTT2M7NLCNF4", opts.Nkey)
+	sig, err := opts.SignatureCB([]byte("nonce"))
+	require.NoError(t, err)
+	key, err := nkeys.FromPublicKey(opts.Nkey)
+	require.NoError(t, err)
+	assert.NoError(t, key.Verify([]byte("nonce"), sig))
+
+	dir := t.TempDir()
+	creds := filepath.Join(dir, "user.creds")
+	require.NoError(t, ioutil.WriteFile(creds, []byte(`-----BEGIN NATS USER JWT-----
+eyJ0eXAiOiJKV1QiLCJhbGciOiJlZDI1NTE5LW5rZXkifQ.e30.c2ln
+------END NATS USER JWT------
+
+************************* IMPORTANT *************************
+NKEY Seed printed below can be used to sign and prove identity.
+
+-----BEGIN USER NKEY SEED-----
+`+testSeed+`
+------END USER NKEY SEED------
+`), 0600))
+	require.NoError(t, n.Configure([]byte("stream: logs\ncredentials_file: "+creds), log.WithField("type", "nats")))
+	opts = natsOptions(&n)
+	require.NotNil(t, opts.UserJWT)
+	jwt, err := opts.UserJWT()
+	require.NoError(t, err)
+	assert.Equal(t, "eyJ0eXAiOiJKV1QiLCJhbGciOiJlZDI1NTE5LW5rZXkifQ.e30.c2ln", jwt)
+
+	err = n.Configure([]byte("stream: logs\ncredentials_file: "+filepath.Join(dir, "missing.creds")), log.WithField("type", "nats"))
+	cstest.AssertErrorContains(t, err, "while reading credentials file")
+}
+
+func TestConsumerConfig(t *testing.T) {
+	n := NatsSource{}
+	require.NoError(t, n.Configure([]byte(`
+stream: logs
+subjects: [app.>]
+start_seq: 10
+ack_wait: 1m`), log.WithField("type", "nats")))
+	config := n.consumerConfig()
+	assert.Equal(t, "crowdsec", config.Durable)
+	assert.Equal(t, nats.AckExplicitPolicy, config.AckPolicy)
+	assert.Equal(t, nats.DeliverByStartSequencePolicy, config.DeliverPolicy)
+	assert.Equal(t, uint64(10), config.OptStartSeq)
+	assert.Equal(t, time.Minute, config.AckWait)
+	assert.Equal(t, "app.>", config.FilterSubject)
+
+	//several subjects are filtered by the datasource
+	require.NoError(t, n.Configure([]byte(`
+stream: logs
+subjects: [app.web, app.db]`), log.WithField("type", "nats")))
+	config = n.consumerConfig()
+	assert.Equal(t, nats.DeliverNewPolicy, config.DeliverPolicy)
+	assert.Equal(t, "", config.FilterSubject)
+}
+
+func TestMatchSubject(t *testing.T) {
+	tests := []struct {
+		filter  string
+		subject string
+		match   bool
+	}{
+		{"app.web", "app.web", true},
+		{"app.web", "app.db", false},
+		{"app.*", "app.web", true},
+		{"app.*", "app.web.access", false},
+		{"app.>", "app.web.access", true},
+		{"app.>", "app", false},
+		{"*.web", "app.web", true},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.match, matchSubject(test.filter, test.subject), "%s %s", test.filter, test.subject)
+	}
+}
+
+// fakeSubscription returns its batches of messages, then waits for more until maxWait, and records the acks
+type fakeSubscription struct {
+	mu      sync.Mutex
+	batches [][]*nats.Msg
+	err     error //returned once the batches were fetched
+	acks    []string
+	closed  chan struct{}
+}
+
+func newFakeSubscription(err error, batches ...[]*nats.Msg) *fakeSubscription {
+	return &fakeSubscription{batches: batches, err: err, closed: make(chan struct{})}
+}
+
+func (s *fakeSubscription) Fetch(batch int, maxWait time.Duration) ([]*nats.Msg, error) {
+	s.mu.Lock()
+	if len(s.batches) > 0 {
+		msgs := s.batches[0]
+		s.batches = s.batches[1:]
+		s.mu.Unlock()
+		return msgs, nil
+	}
+	err := s.err
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-s.closed:
+		return nil, nats.ErrConnectionClosed
+	case <-time.After(maxWait):
+		return nil, nats.ErrTimeout
+	}
+}
+
+func (s *fakeSubscription) Ack(msg *nats.Msg) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.acks = append(s.acks, string(msg.Data))
+	return nil
+}
+
+func (s *fakeSubscription) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.closed:
+	default:
+		close(s.closed)
+	}
+}
+
+func (s *fakeSubscription) state() ([]string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.closed:
+		return append([]string{}, s.acks...), true
+	default:
+		return append([]string{}, s.acks...), false
+	}
+}
+
+func natsMsg(subject string, data string) *nats.Msg {
+	return &nats.Msg{Subject: subject, Data: []byte(data)}
+}
+
+func TestOneShotAcquisition(t *testing.T) {
+	s := newFakeSubscription(nil,
+		[]*nats.Msg{natsMsg("app.web", "line 1"), natsMsg("app.api", "other subject")},
+		[]*nats.Msg{natsMsg("app.db", "line 2"), natsMsg("app.web", "line 3")},
+	)
+	n := NatsSource{}
+	dsn := "nats://127.0.0.1:4222?stream=logs&subject=app.web&subject=app.db&batch_size=2&nkey_seed=" + testSeed
+	require.NoError(t, n.ConfigureByDSN(dsn, map[string]string{"type": "app"}, log.WithField("type", "nats")))
+	//the stream was read once it has no more messages
+	n.config.MaxWait = &[]time.Duration{10 * time.Millisecond}[0]
+	n.subscribe = func() (subscription, error) {
+		return s, nil
+	}
+	out := make(chan types.Event, 10)
+	tmb := tomb.Tomb{}
+	require.NoError(t, n.OneShotAcquisition(out, &tmb))
+	require.Len(t, out, 3)
+	for _, expected := range [][2]string{{"app.web", "line 1"}, {"app.db", "line 2"}, {"app.web", "line 3"}} {
+		evt := <-out
+		assert.Equal(t, expected[1], evt.Line.Raw)
+		assert.Equal(t, expected[0], evt.Line.Src)
+		assert.Equal(t, "app", evt.Line.Labels["type"])
+	}
+	//the skipped message is acked too
+	acks, closed := s.state()
+	assert.Equal(t, []string{"line 1", "other subject", "line 2", "line 3"}, acks)
+	assert.True(t, closed)
+}
+
+func TestStreamingAcquisition(t *testing.T) {
+	//the connection is lost, the datasource connects again
+	first := newFakeSubscription(nats.ErrConnectionClosed, []*nats.Msg{natsMsg("app.web", "line 1"), natsMsg("app.db", "line 2")})
+	second := newFakeSubscription(nil, []*nats.Msg{natsMsg("app.web", "line 3")})
+	subscriptions := make(chan *fakeSubscription, 2)
+	subscriptions <- first
+	subscriptions <- second
+	n := NatsSource{}
+	require.NoError(t, n.Configure([]byte(`
+source: nats
+stream: logs
+retry:
+  base: 10ms`), log.WithField("type", "nats")))
+	n.subscribe = func() (subscription, error) {
+		return <-subscriptions, nil
+	}
+	out := make(chan types.Event)
+	tmb := tomb.Tomb{}
+	require.NoError(t, n.StreamingAcquisition(out, &tmb))
+	for _, expected := range []string{"line 1", "line 2", "line 3"} {
+		select {
+		case evt := <-out:
+			assert.Equal(t, expected, evt.Line.Raw)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout waiting for %s", expected)
+		}
+	}
+	//the message is acked once handed to crowdsec
+	time.Sleep(50 * time.Millisecond)
+	//the pending fetch does not delay the stop
+	tmb.Kill(nil)
+	select {
+	case <-tmb.Dead():
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the datasource to stop")
+	}
+	require.NoError(t, tmb.Err())
+
+	acks, closed := first.state()
+	assert.Equal(t, []string{"line 1", "line 2"}, acks)
+	assert.True(t, closed)
+	acks, closed = second.state()
+	assert.Equal(t, []string{"line 3"}, acks)
+	assert.True(t, closed)
+}
+
+func TestNotAckedOnStop(t *testing.T) {
+	s := newFakeSubscription(nil, []*nats.Msg{natsMsg("app.web", "line 1")})
+	n := NatsSource{}
+	require.NoError(t, n.Configure([]byte("stream: logs"), log.WithField("type", "nats")))
+	n.subscribe = func() (subscription, error) {
+		return s, nil
+	}
+	tmb := tomb.Tomb{}
+	//nobody reads the events
+	require.NoError(t, n.StreamingAcquisition(make(chan types.Event), &tmb))
+	time.Sleep(50 * time.Millisecond)
+	tmb.Kill(nil)
+	require.NoError(t, tmb.Wait())
+	//the server delivers it again
+	acks, closed := s.state()
+	assert.Empty(t, acks)
+	assert.True(t, closed)
+}
+
+func TestAuthorizationViolation(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	connections := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			//refuses the CONNECT, like a server with authentication
+			fmt.Fprintf(conn, "INFO {\"server_id\":\"test\",\"max_payload\":1048576,\"headers\":true}\r\n")
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			connections <- line
+			fmt.Fprintf(conn, "-ERR 'Authorization Violation'\r\n")
+			conn.Close()
+		}
+	}()
+	n := NatsSource{}
+	require.NoError(t, n.ConfigureByDSN("nats://"+listener.Addr().String()+"?stream=logs&username=crowdsec&password=secret",
+		nil, log.WithField("type", "nats")))
+	err = n.OneShotAcquisition(make(chan types.Event), &tomb.Tomb{})
+	cstest.AssertErrorContains(t, err, "authorization violation")
+	//the refusal is not retried
+	require.Len(t, connections, 1)
+	connect := <-connections
+	assert.True(t, strings.HasPrefix(connect, "CONNECT "))
+	assert.Contains(t, connect, `"user":"crowdsec"`)
+}
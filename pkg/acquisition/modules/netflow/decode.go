@@ -0,0 +1,395 @@
+package netflowacquisition
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	FLOW_TYPE_NETFLOW_V5 = "netflow_v5"
+	FLOW_TYPE_NETFLOW_V9 = "netflow_v9"
+	FLOW_TYPE_IPFIX      = "ipfix"
+	FLOW_TYPE_SFLOW      = "sflow"
+
+	//the data sets and flowsets refer to the templates with ids from 256
+	minDataSetID = 256
+	//the IPFIX fields of this length are prefixed with their length
+	variableLength = 65535
+)
+
+var errTruncated = fmt.Errorf("truncated packet")
+
+// flowRecord is a flow, sent as a json line. The sFlow records describe a sampled packet, that stands for
+// sampling_rate packets
+type flowRecord struct {
+	Type         string `json:"type"`
+	Exporter     string `json:"exporter"`
+	SrcAddr      string `json:"src_addr,omitempty"`
+	DstAddr      string `json:"dst_addr,omitempty"`
+	NextHop      string `json:"next_hop,omitempty"`
+	SrcPort      uint64 `json:"src_port"`
+	DstPort      uint64 `json:"dst_port"`
+	Proto        uint64 `json:"proto"`
+	TCPFlags     uint64 `json:"tcp_flags"`
+	ToS          uint64 `json:"tos"`
+	Packets      uint64 `json:"packets"`
+	Bytes        uint64 `json:"bytes"`
+	InIf         uint64 `json:"in_if"`
+	OutIf        uint64 `json:"out_if"`
+	SrcAS        uint64 `json:"src_as,omitempty"`
+	DstAS        uint64 `json:"dst_as,omitempty"`
+	SamplingRate uint64 `json:"sampling_rate,omitempty"`
+	Start        string `json:"start,omitempty"`
+	End          string `json:"end,omitempty"`
+}
+
+// reader reads the fields of a packet, the first read past its end sets err and the next ones return nil or zeros
+type reader struct {
+	data []byte
+	err  error
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.err != nil || n < 0 || n > len(r.data) {
+		r.err = errTruncated
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *reader) u8() uint8 {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *reader) u16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *reader) u32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+// templateKey identifies a template of an exporter, the templates ids being local to a netflow v9 source id or to
+// an IPFIX observation domain
+type templateKey struct {
+	exporter string
+	domain   uint32
+	id       uint16
+}
+
+type templateField struct {
+	id         uint16
+	length     uint16
+	enterprise uint32
+}
+
+// decoder keeps the templates of the netflow v9 and IPFIX exporters, to decode their data records
+type decoder struct {
+	templates    map[templateKey][]templateField
+	maxTemplates int
+}
+
+func newDecoder(maxTemplates int) *decoder {
+	return &decoder{templates: make(map[templateKey][]templateField), maxTemplates: maxTemplates}
+}
+
+// exportClock converts the times of the records, relative to the uptime of the exporter for netflow
+type exportClock struct {
+	exportTime time.Time
+	uptime     uint32 //in ms, 0 for IPFIX
+}
+
+func (c exportClock) fromUptime(at uint32) string {
+	return c.exportTime.Add(-time.Duration(c.uptime-at) * time.Millisecond).UTC().Format(time.RFC3339Nano)
+}
+
+// decode returns the flows of a packet, whose format is guessed from its version
+func (d *decoder) decode(payload []byte, exporter string) ([]flowRecord, error) {
+	if len(payload) < 4 {
+		return nil, errTruncated
+	}
+	switch version := binary.BigEndian.Uint16(payload[0:2]); version {
+	case 5:
+		return decodeNetflowV5(payload, exporter)
+	case 9:
+		return d.decodeNetflowV9(payload, exporter)
+	case 10:
+		return d.decodeIPFIX(payload, exporter)
+	case 0:
+		//the version of sFlow is a 32 bits integer
+		if binary.BigEndian.Uint32(payload[0:4]) == 5 {
+			return decodeSflow(payload)
+		}
+	}
+	return nil, fmt.Errorf("unsupported version %d", binary.BigEndian.Uint32(payload[0:4]))
+}
+
+func ipString(b []byte) string {
+	if len(b) != net.IPv4len && len(b) != net.IPv6len {
+		return ""
+	}
+	return net.IP(b).String()
+}
+
+func decodeNetflowV5(payload []byte, exporter string) ([]flowRecord, error) {
+	r := &reader{data: payload}
+	r.u16()
+	count := int(r.u16())
+	clock := exportClock{uptime: r.u32()}
+	clock.exportTime = time.Unix(int64(r.u32()), int64(r.u32()))
+	r.bytes(6) //sequence, engine type and id
+	sampling := uint64(r.u16() & 0x3fff)
+	if len(r.data) < count*48 {
+		return nil, errTruncated
+	}
+	records := make([]flowRecord, 0, count)
+	for i := 0; i < count; i++ {
+		record := flowRecord{Type: FLOW_TYPE_NETFLOW_V5, Exporter: exporter}
+		record.SrcAddr = ipString(r.bytes(4))
+		record.DstAddr = ipString(r.bytes(4))
+		record.NextHop = ipString(r.bytes(4))
+		record.InIf = uint64(r.u16())
+		record.OutIf = uint64(r.u16())
+		record.Packets = uint64(r.u32())
+		record.Bytes = uint64(r.u32())
+		record.Start = clock.fromUptime(r.u32())
+		record.End = clock.fromUptime(r.u32())
+		record.SrcPort = uint64(r.u16())
+		record.DstPort = uint64(r.u16())
+		r.u8()
+		record.TCPFlags = uint64(r.u8())
+		record.Proto = uint64(r.u8())
+		record.ToS = uint64(r.u8())
+		record.SrcAS = uint64(r.u16())
+		record.DstAS = uint64(r.u16())
+		r.bytes(4) //masks and padding
+		if sampling > 1 {
+			record.SamplingRate = sampling
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func (d *decoder) decodeNetflowV9(payload []byte, exporter string) ([]flowRecord, error) {
+	r := &reader{data: payload}
+	r.bytes(4) //version and count
+	clock := exportClock{uptime: r.u32()}
+	clock.exportTime = time.Unix(int64(r.u32()), 0)
+	r.u32() //sequence
+	key := templateKey{exporter: exporter, domain: r.u32()}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return d.decodeSets(r, key, clock, FLOW_TYPE_NETFLOW_V9, 0, 1)
+}
+
+func (d *decoder) decodeIPFIX(payload []byte, exporter string) ([]flowRecord, error) {
+	r := &reader{data: payload}
+	r.u16()
+	length := int(r.u16())
+	clock := exportClock{exportTime: time.Unix(int64(r.u32()), 0)}
+	r.u32() //sequence
+	key := templateKey{exporter: exporter, domain: r.u32()}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if length < 16 || length > len(payload) {
+		return nil, fmt.Errorf("invalid message length %d", length)
+	}
+	r.data = payload[16:length]
+	return d.decodeSets(r, key, clock, FLOW_TYPE_IPFIX, 2, 3)
+}
+
+// decodeSets reads the flowsets of netflow v9 or the sets of IPFIX, that differ by the ids of their template sets
+func (d *decoder) decodeSets(r *reader, key templateKey, clock exportClock, flowType string, templateSetID uint16, optionsSetID uint16) ([]flowRecord, error) {
+	records := []flowRecord{}
+	for len(r.data) >= 4 {
+		id := r.u16()
+		length := int(r.u16())
+		if length < 4 {
+			return nil, fmt.Errorf("invalid set length %d", length)
+		}
+		set := &reader{data: r.bytes(length - 4)}
+		if r.err != nil {
+			return nil, r.err
+		}
+		switch {
+		case id == templateSetID:
+			if err := d.parseTemplates(set, key, flowType == FLOW_TYPE_IPFIX); err != nil {
+				return nil, err
+			}
+		case id == optionsSetID:
+			//the options describe the exporter, not the flows
+		case id >= minDataSetID:
+			key.id = id
+			template, ok := d.templates[key]
+			if !ok {
+				//the exporters send their templates periodically, the data sets received before are lost
+				continue
+			}
+			setRecords, err := parseData(set, template, flowRecord{Type: flowType, Exporter: key.exporter}, clock)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, setRecords...)
+		}
+	}
+	return records, nil
+}
+
+func (d *decoder) parseTemplates(r *reader, key templateKey, ipfix bool) error {
+	for len(r.data) >= 4 {
+		key.id = r.u16()
+		count := int(r.u16())
+		if key.id == 0 && count == 0 {
+			//padding
+			return nil
+		}
+		if key.id < minDataSetID {
+			return fmt.Errorf("invalid template id %d", key.id)
+		}
+		if count == 0 {
+			//withdrawal of the template
+			delete(d.templates, key)
+			continue
+		}
+		fields := make([]templateField, 0, count)
+		for i := 0; i < count; i++ {
+			field := templateField{id: r.u16(), length: r.u16()}
+			if ipfix && field.id&0x8000 != 0 {
+				field.id &= 0x7fff
+				field.enterprise = r.u32()
+			}
+			fields = append(fields, field)
+		}
+		if r.err != nil {
+			return r.err
+		}
+		if minRecordLen(fields) == 0 {
+			return fmt.Errorf("empty template %d", key.id)
+		}
+		if _, ok := d.templates[key]; !ok && len(d.templates) >= d.maxTemplates {
+			return fmt.Errorf("too many templates (%d)", d.maxTemplates)
+		}
+		d.templates[key] = fields
+	}
+	return nil
+}
+
+// minRecordLen is the length of the smallest record of a template, the sets are padded with less bytes
+func minRecordLen(template []templateField) int {
+	n := 0
+	for _, field := range template {
+		if field.length == variableLength {
+			n++
+		} else {
+			n += int(field.length)
+		}
+	}
+	return n
+}
+
+func parseData(r *reader, template []templateField, base flowRecord, clock exportClock) ([]flowRecord, error) {
+	records := []flowRecord{}
+	minLen := minRecordLen(template)
+	for len(r.data) >= minLen {
+		record := base
+		for _, field := range template {
+			length := int(field.length)
+			if field.length == variableLength {
+				if length = int(r.u8()); length == 255 {
+					length = int(r.u16())
+				}
+			}
+			record.set(field, r.bytes(length), clock)
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func uintValue(b []byte) uint64 {
+	if len(b) > 8 {
+		b = b[len(b)-8:]
+	}
+	v := uint64(0)
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+// set sets the value of an information element of the IANA registry, shared by netflow v9 and IPFIX
+func (f *flowRecord) set(field templateField, value []byte, clock exportClock) {
+	if field.enterprise != 0 {
+		return
+	}
+	switch field.id {
+	case 1: //octetDeltaCount
+		f.Bytes = uintValue(value)
+	case 2: //packetDeltaCount
+		f.Packets = uintValue(value)
+	case 4: //protocolIdentifier
+		f.Proto = uintValue(value)
+	case 5: //ipClassOfService
+		f.ToS = uintValue(value)
+	case 6: //tcpControlBits
+		f.TCPFlags = uintValue(value)
+	case 7: //sourceTransportPort
+		f.SrcPort = uintValue(value)
+	case 8, 27: //sourceIPv4Address, sourceIPv6Address
+		f.SrcAddr = ipString(value)
+	case 10: //ingressInterface
+		f.InIf = uintValue(value)
+	case 11: //destinationTransportPort
+		f.DstPort = uintValue(value)
+	case 12, 28: //destinationIPv4Address, destinationIPv6Address
+		f.DstAddr = ipString(value)
+	case 14: //egressInterface
+		f.OutIf = uintValue(value)
+	case 15, 62: //ipNextHopIPv4Address, ipNextHopIPv6Address
+		f.NextHop = ipString(value)
+	case 16: //bgpSourceAsNumber
+		f.SrcAS = uintValue(value)
+	case 17: //bgpDestinationAsNumber
+		f.DstAS = uintValue(value)
+	case 21: //flowEndSysUpTime
+		if clock.uptime != 0 {
+			f.End = clock.fromUptime(uint32(uintValue(value)))
+		}
+	case 22: //flowStartSysUpTime
+		if clock.uptime != 0 {
+			f.Start = clock.fromUptime(uint32(uintValue(value)))
+		}
+	case 34, 305: //samplingInterval, samplingPacketInterval
+		f.SamplingRate = uintValue(value)
+	case 150: //flowStartSeconds
+		f.Start = time.Unix(int64(uintValue(value)), 0).UTC().Format(time.RFC3339Nano)
+	case 151: //flowEndSeconds
+		f.End = time.Unix(int64(uintValue(value)), 0).UTC().Format(time.RFC3339Nano)
+	case 152: //flowStartMilliseconds
+		f.Start = time.UnixMilli(int64(uintValue(value))).UTC().Format(time.RFC3339Nano)
+	case 153: //flowEndMilliseconds
+		f.End = time.UnixMilli(int64(uintValue(value))).UTC().Format(time.RFC3339Nano)
+	}
+}
@@ -0,0 +1,189 @@
+package netflowacquisition
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	leaky "github.com/crowdsecurity/crowdsec/pkg/leakybucket"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/tomb.v2"
+	"gopkg.in/yaml.v2"
+)
+
+type NetflowConfiguration struct {
+	Port                              int    `yaml:"listen_port,omitempty"`
+	Addr                              string `yaml:"listen_addr,omitempty"`
+	MaxTemplates                      int    `yaml:"max_templates,omitempty"` //of the netflow v9 and IPFIX exporters, as the templates are kept forever
+	configuration.DataSourceCommonCfg `yaml:",inline"`
+}
+
+// NetflowSource is a flow collector : the NetFlow v5 and v9, IPFIX and sFlow v5 datagrams of the routers are
+// decoded, and each flow is sent as a json line
+type NetflowSource struct {
+	configuration.HealthTracker
+	config  NetflowConfiguration
+	logger  *log.Entry
+	udpConn *net.UDPConn
+	decoder *decoder
+}
+
+var flowsReceived = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cs_netflowsource_hits_total",
+		Help: "Total flows that were received.",
+	},
+	[]string{"source", "type"})
+
+var packetsInvalid = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cs_netflowsource_invalid_total",
+		Help: "Total flow export packets that were dropped because they were invalid.",
+	},
+	[]string{"source"})
+
+func (n *NetflowSource) GetName() string {
+	return "netflow"
+}
+
+func (n *NetflowSource) GetUuid() string {
+	return n.config.UniqueId
+}
+
+func (n *NetflowSource) GetMode() string {
+	return n.config.Mode
+}
+
+func (n *NetflowSource) Dump() interface{} {
+	return n
+}
+
+func (n *NetflowSource) CanRun() error {
+	return nil
+}
+
+func (n *NetflowSource) GetMetrics() []prometheus.Collector {
+	return []prometheus.Collector{flowsReceived, packetsInvalid}
+}
+
+func (n *NetflowSource) GetAggregMetrics() []prometheus.Collector {
+	return []prometheus.Collector{flowsReceived, packetsInvalid}
+}
+
+func (n *NetflowSource) ConfigureByDSN(dsn string, labels map[string]string, logger *log.Entry) error {
+	return fmt.Errorf("netflow datasource does not support one shot acquisition")
+}
+
+func (n *NetflowSource) OneShotAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	return fmt.Errorf("netflow datasource does not support one shot acquisition")
+}
+
+func (n *NetflowSource) Configure(yamlConfig []byte, logger *log.Entry) error {
+	n.logger = logger
+	netflowConfig := NetflowConfiguration{}
+	netflowConfig.Mode = configuration.TAIL_MODE
+	if err := yaml.UnmarshalStrict(yamlConfig, &netflowConfig); err != nil {
+		return errors.Wrap(err, "Cannot parse netflow configuration")
+	}
+	if netflowConfig.Mode != configuration.TAIL_MODE {
+		return fmt.Errorf("unsupported mode %s for netflow datasource", netflowConfig.Mode)
+	}
+	if netflowConfig.Addr == "" {
+		netflowConfig.Addr = "127.0.0.1"
+	}
+	if netflowConfig.Port == 0 {
+		netflowConfig.Port = 2055
+	}
+	if netflowConfig.MaxTemplates == 0 {
+		netflowConfig.MaxTemplates = 10000
+	}
+	if netflowConfig.Port <= 0 || netflowConfig.Port > 65535 {
+		return fmt.Errorf("invalid port %d", netflowConfig.Port)
+	}
+	if net.ParseIP(netflowConfig.Addr) == nil {
+		return fmt.Errorf("invalid listen IP %s", netflowConfig.Addr)
+	}
+	if netflowConfig.MaxTemplates < 0 {
+		return fmt.Errorf("invalid max_templates %d", netflowConfig.MaxTemplates)
+	}
+	n.decoder = newDecoder(netflowConfig.MaxTemplates)
+	n.config = netflowConfig
+	return nil
+}
+
+func (n *NetflowSource) StreamingAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	addr := net.JoinHostPort(n.config.Addr, strconv.Itoa(n.config.Port))
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return errors.Wrapf(err, "could not resolve addr %s", addr)
+	}
+	if n.udpConn, err = net.ListenUDP("udp", udpAddr); err != nil {
+		return errors.Wrapf(err, "could not listen on %s", addr)
+	}
+	n.logger.Infof("listening for flows on %s (udp)", n.udpConn.LocalAddr())
+	expectMode := leaky.LIVE
+	if n.config.UseTimeMachine {
+		expectMode = leaky.TIMEMACHINE
+	}
+	t.Go(func() error {
+		defer types.CatchPanic("crowdsec/acquis/netflow/live")
+		return n.serveUDP(out, t, expectMode)
+	})
+	return nil
+}
+
+func (n *NetflowSource) serveUDP(out chan types.Event, t *tomb.Tomb, expectMode int) error {
+	t.Go(func() error {
+		<-t.Dying()
+		n.logger.Info("netflow datasource is dying")
+		return n.udpConn.Close()
+	})
+	buf := make([]byte, 65536)
+	for {
+		size, addr, err := n.udpConn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-t.Dying():
+				return nil
+			default:
+			}
+			err = errors.Wrap(err, "error while reading from socket")
+			n.SetState(configuration.STATUS_ERRORED, err)
+			return err
+		}
+		exporter := addr.IP.String()
+		records, err := n.decoder.decode(buf[:size], exporter)
+		if err != nil {
+			n.logger.WithField("exporter", exporter).Debugf("dropping packet : %s", err)
+			packetsInvalid.With(prometheus.Labels{"source": exporter}).Inc()
+			continue
+		}
+		for _, record := range records {
+			flowsReceived.With(prometheus.Labels{"source": exporter, "type": record.Type}).Inc()
+			line, err := json.Marshal(record)
+			if err != nil {
+				continue
+			}
+			l := types.Line{}
+			l.Raw = string(line)
+			l.Module = n.GetName()
+			l.Labels = n.config.Labels
+			l.Time = time.Now().UTC()
+			//the agent address of sFlow, that can differ from the sender of the datagram
+			l.Src = record.Exporter
+			l.Process = true
+			n.EventSeen(&l)
+			select {
+			case out <- types.Event{Line: l, Process: true, Type: types.LOG, ExpectMode: expectMode}:
+			case <-t.Dying():
+				return nil
+			}
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package netflowacquisition
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/cstest"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/tomb.v2"
+)
+
+func TestConfigure(t *testing.T) {
+	tests := []struct {
+		config      string
+		expectedErr string
+	}{
+		{
+			config:      `foobar: bla`,
+			expectedErr: "field foobar not found in type netflowacquisition.NetflowConfiguration",
+		},
+		{
+			config:      `source: netflow`,
+			expectedErr: "",
+		},
+		{
+			config:      `mode: cat`,
+			expectedErr: "unsupported mode cat for netflow datasource",
+		},
+		{
+			config:      `listen_port: 424242`,
+			expectedErr: "invalid port 424242",
+		},
+		{
+			config:      `listen_addr: 10.0.0`,
+			expectedErr: "invalid listen IP 10.0.0",
+		},
+		{
+			config:      `max_templates: -1`,
+			expectedErr: "invalid max_templates -1",
+		},
+	}
+	subLogger := log.WithField("type", "netflow")
+	for _, test := range tests {
+		n := NetflowSource{}
+		err := n.Configure([]byte(test.config), subLogger)
+		cstest.AssertErrorContains(t, err, test.expectedErr)
+	}
+}
+
+// The helpers below encode the packets like the exporters do, the integers being big endian
+
+func packet(fields ...interface{}) []byte {
+	buf := bytes.Buffer{}
+	for _, field := range fields {
+		_ = binary.Write(&buf, binary.BigEndian, field)
+	}
+	return buf.Bytes()
+}
+
+func ip(addr string) []byte {
+	if ip := net.ParseIP(addr).To4(); ip != nil {
+		return ip
+	}
+	return net.ParseIP(addr)
+}
+
+// set is a flowset of netflow v9 or a set of IPFIX
+func set(id uint16, body ...[]byte) []byte {
+	content := bytes.Join(body, nil)
+	return packet(id, uint16(len(content)+4), content)
+}
+
+// sflowData is a sample or a record of sFlow, prefixed by its format and length
+func sflowData(format uint32, body ...[]byte) []byte {
+	content := bytes.Join(body, nil)
+	return packet(format, uint32(len(content)), content)
+}
+
+func netflowV5() []byte {
+	header := packet(uint16(5), uint16(1), uint32(100000), uint32(1654041600), uint32(0), uint32(42), uint8(0), uint8(0), uint16(1<<14|100))
+	record := packet(ip("192.168.1.42"), ip("10.0.0.1"), ip("10.0.0.254"), uint16(1), uint16(2), uint32(3), uint32(180),
+		uint32(99000), uint32(99500), uint16(51234), uint16(22), uint8(0), uint8(0x02), uint8(6), uint8(0), uint16(0), uint16(64512),
+		uint8(24), uint8(24), uint16(0))
+	return append(header, record...)
+}
+
+func TestDecodeNetflowV5(t *testing.T) {
+	d := newDecoder(10)
+	records, err := d.decode(netflowV5(), "10.0.0.254")
+	require.NoError(t, err)
+	assert.Equal(t, []flowRecord{{
+		Type:         FLOW_TYPE_NETFLOW_V5,
+		Exporter:     "10.0.0.254",
+		SrcAddr:      "192.168.1.42",
+		DstAddr:      "10.0.0.1",
+		NextHop:      "10.0.0.254",
+		SrcPort:      51234,
+		DstPort:      22,
+		Proto:        6,
+		TCPFlags:     2,
+		Packets:      3,
+		Bytes:        180,
+		InIf:         1,
+		OutIf:        2,
+		DstAS:        64512,
+		SamplingRate: 100,
+		Start:        "2022-05-31T23:59:59Z",
+		End:          "2022-05-31T23:59:59.5Z",
+	}}, records)
+
+	_, err = d.decode(netflowV5()[:60], "10.0.0.254")
+	cstest.AssertErrorContains(t, err, "truncated packet")
+	_, err = d.decode(packet(uint16(7), uint16(0)), "10.0.0.254")
+	cstest.AssertErrorContains(t, err, "unsupported version 458752")
+}
+
+func TestDecodeNetflowV9(t *testing.T) {
+	d := newDecoder(1)
+	header := packet(uint16(9), uint16(2), uint32(100000), uint32(1654041600), uint32(1), uint32(1))
+	template := set(0, packet(uint16(256), uint16(7),
+		uint16(8), uint16(4), uint16(12), uint16(4), uint16(7), uint16(2), uint16(11), uint16(2), uint16(4), uint16(1), uint16(1), uint16(4),
+		uint16(22), uint16(4)))
+	data := set(256,
+		packet(ip("192.168.1.42"), ip("10.0.0.1"), uint16(51234), uint16(22), uint8(6), uint32(180), uint32(99000)),
+		packet(ip("192.168.1.42"), ip("10.0.0.2"), uint16(51235), uint16(23), uint8(6), uint32(60), uint32(99000)),
+		[]byte{0, 0})
+
+	//the data received before the template are dropped
+	records, err := d.decode(append(header, data...), "10.0.0.254")
+	require.NoError(t, err)
+	assert.Empty(t, records)
+
+	records, err = d.decode(bytes.Join([][]byte{header, template, set(1, []byte{0, 0, 0, 0}), data}, nil), "10.0.0.254")
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, flowRecord{
+		Type:     FLOW_TYPE_NETFLOW_V9,
+		Exporter: "10.0.0.254",
+		SrcAddr:  "192.168.1.42",
+		DstAddr:  "10.0.0.1",
+		SrcPort:  51234,
+		DstPort:  22,
+		Proto:    6,
+		Bytes:    180,
+		Start:    "2022-05-31T23:59:59Z",
+	}, records[0])
+	assert.Equal(t, "10.0.0.2", records[1].DstAddr)
+	assert.Equal(t, uint64(23), records[1].DstPort)
+
+	//the templates are by exporter and source id
+	records, err = d.decode(append(header, data...), "10.0.0.253")
+	require.NoError(t, err)
+	assert.Empty(t, records)
+	_, err = d.decode(append(header, template...), "10.0.0.253")
+	cstest.AssertErrorContains(t, err, "too many templates (1)")
+
+	_, err = d.decode(append(header, set(0, packet(uint16(12), uint16(1), uint16(8), uint16(4)))...), "10.0.0.254")
+	cstest.AssertErrorContains(t, err, "invalid template id 12")
+	_, err = d.decode(append(header, packet(uint16(256), uint16(2))...), "10.0.0.254")
+	cstest.AssertErrorContains(t, err, "invalid set length 2")
+	_, err = d.decode(append(header, data[:10]...), "10.0.0.254")
+	cstest.AssertErrorContains(t, err, "truncated packet")
+}
+
+func TestDecodeIPFIX(t *testing.T) {
+	d := newDecoder(10)
+	message := func(sets ...[]byte) []byte {
+		content := bytes.Join(sets, nil)
+		return append(packet(uint16(10), uint16(len(content)+16), uint32(1654041600), uint32(1), uint32(7)), content...)
+	}
+	template := set(2, packet(uint16(300), uint16(6),
+		uint16(27), uint16(16), uint16(28), uint16(16),
+		uint16(0x8000|1), uint16(4), uint32(9), //an enterprise field, with the id of octetDeltaCount
+		uint16(82), uint16(65535), //interfaceName
+		uint16(152), uint16(8), uint16(2), uint16(8)))
+	data := set(300,
+		packet(ip("2001:db8::1"), ip("2001:db8::2"), uint32(1234), uint8(4), []byte("eth0"), uint64(1654041600123), uint64(10)),
+		packet(ip("2001:db8::1"), ip("2001:db8::3"), uint32(1234), uint8(255), uint16(4), []byte("eth1"), uint64(1654041600456), uint64(20)))
+
+	records, err := d.decode(message(template, data), "10.0.0.254")
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, flowRecord{
+		Type:     FLOW_TYPE_IPFIX,
+		Exporter: "10.0.0.254",
+		SrcAddr:  "2001:db8::1",
+		DstAddr:  "2001:db8::2",
+		Packets:  10,
+		Start:    "2022-06-01T00:00:00.123Z",
+	}, records[0])
+	assert.Equal(t, "2001:db8::3", records[1].DstAddr)
+	assert.Equal(t, uint64(20), records[1].Packets)
+
+	//the template is withdrawn
+	records, err = d.decode(message(set(2, packet(uint16(300), uint16(0))), data), "10.0.0.254")
+	require.NoError(t, err)
+	assert.Empty(t, records)
+
+	_, err = d.decode(message(template)[:30], "10.0.0.254")
+	cstest.AssertErrorContains(t, err, "invalid message length 52")
+}
+
+func TestDecodeSflow(t *testing.T) {
+	d := newDecoder(10)
+	ethernet := packet(make([]byte, 12), uint16(0x8100), uint16(42), uint16(0x0800),
+		uint8(0x45), uint8(0x10), uint16(40), uint16(1), uint16(0x4000), uint8(64), uint8(6), uint16(0), ip("192.168.1.42"), ip("10.0.0.1"),
+		uint16(40000), uint16(445), uint32(0), uint32(0), uint8(0x50), uint8(0x02), uint16(1024), uint32(0),
+		[]byte{0, 0})
+	flowSample := sflowData(1, packet(uint32(1), uint32(3), uint32(1000), uint32(100000), uint32(0), uint32(3), uint32(4), uint32(2)),
+		sflowData(1, packet(uint32(1), uint32(64), uint32(4), uint32(len(ethernet)-2)), ethernet),
+		sflowData(1001, []byte("switch data")))
+	expandedSample := sflowData(3, packet(uint32(2), uint32(0), uint32(3), uint32(512), uint32(100000), uint32(0),
+		uint32(0), uint32(5), uint32(0), uint32(6), uint32(1)),
+		sflowData(4, packet(uint32(1500), uint32(17), ip("2001:db8::1"), ip("2001:db8::2"), uint32(5353), uint32(53), uint32(0), uint32(0))))
+	counterSample := sflowData(2, []byte("counters"))
+	datagram := packet(uint32(5), uint32(1), ip("10.0.0.254"), uint32(0), uint32(1), uint32(1000), uint32(3),
+		counterSample, flowSample, expandedSample)
+
+	records, err := d.decode(datagram, "10.0.0.1")
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, flowRecord{
+		Type:         FLOW_TYPE_SFLOW,
+		Exporter:     "10.0.0.254",
+		SrcAddr:      "192.168.1.42",
+		DstAddr:      "10.0.0.1",
+		SrcPort:      40000,
+		DstPort:      445,
+		Proto:        6,
+		TCPFlags:     2,
+		ToS:          0x10,
+		Packets:      1,
+		Bytes:        64,
+		InIf:         3,
+		OutIf:        4,
+		SamplingRate: 1000,
+	}, records[0])
+	assert.Equal(t, flowRecord{
+		Type:         FLOW_TYPE_SFLOW,
+		Exporter:     "10.0.0.254",
+		SrcAddr:      "2001:db8::1",
+		DstAddr:      "2001:db8::2",
+		SrcPort:      5353,
+		DstPort:      53,
+		Proto:        17,
+		Packets:      1,
+		Bytes:        1500,
+		InIf:         5,
+		OutIf:        6,
+		SamplingRate: 512,
+	}, records[1])
+
+	_, err = d.decode(datagram[:len(datagram)-4], "10.0.0.1")
+	cstest.AssertErrorContains(t, err, "truncated packet")
+	_, err = d.decode(packet(uint32(5), uint32(3)), "10.0.0.1")
+	cstest.AssertErrorContains(t, err, "invalid agent address type 3")
+}
+
+func TestStreamingAcquisition(t *testing.T) {
+	n := NetflowSource{}
+	require.NoError(t, n.Configure([]byte(`
+source: netflow
+listen_port: 2155
+labels:
+  type: netflow`), log.WithField("type", "netflow")))
+	tmb := tomb.Tomb{}
+	out := make(chan types.Event)
+	require.NoError(t, n.StreamingAcquisition(out, &tmb))
+
+	conn, err := net.Dial("udp", "127.0.0.1:2155")
+	require.NoError(t, err)
+	defer conn.Close()
+	_, _ = conn.Write([]byte("not a flow"))
+	_, _ = conn.Write(netflowV5())
+	select {
+	case evt := <-out:
+		assert.Equal(t, "127.0.0.1", evt.Line.Src)
+		assert.Equal(t, "netflow", evt.Line.Labels["type"])
+		record := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal([]byte(evt.Line.Raw), &record))
+		assert.Equal(t, "netflow_v5", record["type"])
+		assert.Equal(t, "192.168.1.42", record["src_addr"])
+		assert.Equal(t, float64(22), record["dst_port"])
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for event")
+	}
+
+	tmb.Kill(nil)
+	require.NoError(t, tmb.Wait())
+}
@@ -0,0 +1,185 @@
+package netflowacquisition
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	//the formats of the samples and records of the standard enterprise, see https://sflow.org/sflow_version_5.txt
+	sflowFlowSample         = 1
+	sflowExpandedFlowSample = 3
+	sflowRawPacketHeader    = 1
+	sflowSampledIPv4        = 3
+	sflowSampledIPv6        = 4
+
+	sflowHeaderEthernet = 1
+	sflowHeaderIPv4     = 11
+	sflowHeaderIPv6     = 12
+
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86dd
+	etherTypeVLAN = 0x8100
+	etherTypeQinQ = 0x88a8
+
+	protoTCP = 6
+	protoUDP = 17
+)
+
+// decodeSflow returns the flow samples of a datagram, one record per sampled packet. The counter samples are
+// ignored
+func decodeSflow(payload []byte) ([]flowRecord, error) {
+	r := &reader{data: payload}
+	r.u32() //version
+	exporter := ""
+	switch addressType := r.u32(); addressType {
+	case 1:
+		exporter = ipString(r.bytes(4))
+	case 2:
+		exporter = ipString(r.bytes(16))
+	default:
+		return nil, fmt.Errorf("invalid agent address type %d", addressType)
+	}
+	r.bytes(12) //sub agent id, sequence and uptime
+	count := r.u32()
+	records := []flowRecord{}
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		format := r.u32()
+		sample := &reader{data: r.bytes(int(r.u32()))}
+		if r.err != nil {
+			break
+		}
+		if format != sflowFlowSample && format != sflowExpandedFlowSample {
+			continue
+		}
+		record, ok := decodeFlowSample(sample, exporter, format == sflowExpandedFlowSample)
+		if sample.err != nil {
+			return nil, sample.err
+		}
+		if ok {
+			records = append(records, record)
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return records, nil
+}
+
+func decodeFlowSample(r *reader, exporter string, expanded bool) (flowRecord, bool) {
+	record := flowRecord{Type: FLOW_TYPE_SFLOW, Exporter: exporter, Packets: 1}
+	r.u32() //sequence
+	if expanded {
+		r.bytes(8) //source id type and index
+	} else {
+		r.u32() //source id
+	}
+	record.SamplingRate = uint64(r.u32())
+	r.bytes(8) //sample pool and drops
+	if expanded {
+		r.u32()
+		record.InIf = uint64(r.u32())
+		r.u32()
+		record.OutIf = uint64(r.u32())
+	} else {
+		record.InIf = uint64(r.u32() & 0x3fffffff)
+		record.OutIf = uint64(r.u32() & 0x3fffffff)
+	}
+	count := r.u32()
+	found := false
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		format := r.u32()
+		data := &reader{data: r.bytes(int(r.u32()))}
+		switch format {
+		case sflowRawPacketHeader:
+			protocol := data.u32()
+			record.Bytes = uint64(data.u32())
+			data.u32() //stripped
+			header := data.bytes(int(data.u32()))
+			switch protocol {
+			case sflowHeaderEthernet:
+				found = record.parseEthernet(header) || found
+			case sflowHeaderIPv4:
+				found = record.parseIP(etherTypeIPv4, header) || found
+			case sflowHeaderIPv6:
+				found = record.parseIP(etherTypeIPv6, header) || found
+			}
+		case sflowSampledIPv4, sflowSampledIPv6:
+			addrLen := 4
+			if format == sflowSampledIPv6 {
+				addrLen = 16
+			}
+			record.Bytes = uint64(data.u32())
+			record.Proto = uint64(data.u32())
+			record.SrcAddr = ipString(data.bytes(addrLen))
+			record.DstAddr = ipString(data.bytes(addrLen))
+			record.SrcPort = uint64(data.u32())
+			record.DstPort = uint64(data.u32())
+			record.TCPFlags = uint64(data.u32())
+			record.ToS = uint64(data.u32())
+			found = data.err == nil || found
+		}
+	}
+	return record, found
+}
+
+// parseEthernet reads the addresses and ports of the header of a sampled frame, and returns false if it's not IP
+func (f *flowRecord) parseEthernet(header []byte) bool {
+	if len(header) < 14 {
+		return false
+	}
+	etherType := binary.BigEndian.Uint16(header[12:14])
+	header = header[14:]
+	for etherType == etherTypeVLAN || etherType == etherTypeQinQ {
+		if len(header) < 4 {
+			return false
+		}
+		etherType = binary.BigEndian.Uint16(header[2:4])
+		header = header[4:]
+	}
+	return f.parseIP(etherType, header)
+}
+
+func (f *flowRecord) parseIP(etherType uint16, header []byte) bool {
+	var transport []byte
+	switch etherType {
+	case etherTypeIPv4:
+		if len(header) < 20 {
+			return false
+		}
+		ihl := int(header[0]&0x0f) * 4
+		f.ToS = uint64(header[1])
+		f.Proto = uint64(header[9])
+		f.SrcAddr = ipString(header[12:16])
+		f.DstAddr = ipString(header[16:20])
+		//only the first fragment holds the ports
+		if binary.BigEndian.Uint16(header[6:8])&0x1fff == 0 && ihl >= 20 && len(header) >= ihl {
+			transport = header[ihl:]
+		}
+	case etherTypeIPv6:
+		if len(header) < 40 {
+			return false
+		}
+		f.ToS = uint64(binary.BigEndian.Uint16(header[0:2]) >> 4 & 0xff)
+		f.Proto = uint64(header[6])
+		f.SrcAddr = ipString(header[8:24])
+		f.DstAddr = ipString(header[24:40])
+		transport = header[40:]
+	default:
+		return false
+	}
+	switch f.Proto {
+	case protoTCP:
+		if len(transport) >= 14 {
+			f.SrcPort = uint64(binary.BigEndian.Uint16(transport[0:2]))
+			f.DstPort = uint64(binary.BigEndian.Uint16(transport[2:4]))
+			f.TCPFlags = uint64(transport[13])
+		}
+	case protoUDP:
+		if len(transport) >= 4 {
+			f.SrcPort = uint64(binary.BigEndian.Uint16(transport[0:2]))
+			f.DstPort = uint64(binary.BigEndian.Uint16(transport[2:4]))
+		}
+	}
+	return true
+}
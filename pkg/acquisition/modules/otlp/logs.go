@@ -0,0 +1,291 @@
+package otlpacquisition
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The messages of the OTLP logs service (https://github.com/open-telemetry/opentelemetry-proto, logs/v1 and
+// collector/logs/v1) are decoded by field number : only the ones crowdsec needs are read, the others are skipped
+
+const (
+	//the attributes are added to the event metadata with this prefix
+	metaPrefix = "otel_"
+	//of the arrays and maps in the values
+	maxDepth = 32
+)
+
+// logRecord is a log record of an export request, with the attributes of its resource and scope
+type logRecord struct {
+	Body string
+	Meta map[string]string
+}
+
+// protoField is a field of a protobuf message : its bytes if it's length-delimited, or else its value
+type protoField struct {
+	num   protowire.Number
+	typ   protowire.Type
+	bytes []byte
+	value uint64
+}
+
+// walk calls fn with each field of a message
+func walk(b []byte, fn func(f protoField) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		f := protoField{num: num, typ: typ}
+		switch typ {
+		case protowire.VarintType:
+			f.value, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed32Type:
+			var v uint32
+			v, n = protowire.ConsumeFixed32(b)
+			f.value = uint64(v)
+		case protowire.Fixed64Type:
+			f.value, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			f.bytes, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseExportRequest returns the log records of an ExportLogsServiceRequest
+func parseExportRequest(b []byte) ([]logRecord, error) {
+	records := []logRecord{}
+	err := walk(b, func(f protoField) error {
+		//resource_logs
+		if f.num != 1 || f.typ != protowire.BytesType {
+			return nil
+		}
+		resourceRecords, err := parseResourceLogs(f.bytes)
+		if err != nil {
+			return err
+		}
+		records = append(records, resourceRecords...)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid export request : %s", err)
+	}
+	return records, nil
+}
+
+// parseResourceLogs returns the records of a ResourceLogs : the resource may come after the records
+func parseResourceLogs(b []byte) ([]logRecord, error) {
+	resource := map[string]string{}
+	records := []logRecord{}
+	err := walk(b, func(f protoField) error {
+		if f.typ != protowire.BytesType {
+			return nil
+		}
+		switch f.num {
+		case 1: //resource
+			return walk(f.bytes, func(f protoField) error {
+				if f.num == 1 && f.typ == protowire.BytesType {
+					return parseAttribute(f.bytes, metaPrefix+"resource_", resource)
+				}
+				return nil
+			})
+		case 2, 1000: //scope_logs, or instrumentation_library_logs before OTLP 0.15
+			scopeRecords, err := parseScopeLogs(f.bytes)
+			if err != nil {
+				return err
+			}
+			records = append(records, scopeRecords...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		for key, value := range resource {
+			record.Meta[key] = value
+		}
+	}
+	return records, nil
+}
+
+func parseScopeLogs(b []byte) ([]logRecord, error) {
+	scope := ""
+	records := []logRecord{}
+	err := walk(b, func(f protoField) error {
+		if f.typ != protowire.BytesType {
+			return nil
+		}
+		switch f.num {
+		case 1: //scope (or instrumentation_library), its name
+			return walk(f.bytes, func(f protoField) error {
+				if f.num == 1 && f.typ == protowire.BytesType {
+					scope = string(f.bytes)
+				}
+				return nil
+			})
+		case 2: //log_records
+			record, err := parseLogRecord(f.bytes)
+			if err != nil {
+				return err
+			}
+			records = append(records, record)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if scope != "" {
+		for _, record := range records {
+			record.Meta[metaPrefix+"scope"] = scope
+		}
+	}
+	return records, nil
+}
+
+func parseLogRecord(b []byte) (logRecord, error) {
+	record := logRecord{Meta: map[string]string{}}
+	severityNumber := uint64(0)
+	err := walk(b, func(f protoField) error {
+		switch {
+		case f.num == 2 && f.typ == protowire.VarintType:
+			severityNumber = f.value
+		case f.num == 3 && f.typ == protowire.BytesType:
+			record.Meta[metaPrefix+"severity"] = string(f.bytes)
+		case f.num == 5 && f.typ == protowire.BytesType:
+			body, err := parseAnyValue(f.bytes, 0)
+			if err != nil {
+				return err
+			}
+			record.Body = stringify(body)
+		case f.num == 6 && f.typ == protowire.BytesType:
+			return parseAttribute(f.bytes, metaPrefix, record.Meta)
+		case f.num == 9 && f.typ == protowire.BytesType && len(f.bytes) > 0:
+			record.Meta[metaPrefix+"trace_id"] = hex.EncodeToString(f.bytes)
+		case f.num == 10 && f.typ == protowire.BytesType && len(f.bytes) > 0:
+			record.Meta[metaPrefix+"span_id"] = hex.EncodeToString(f.bytes)
+		}
+		return nil
+	})
+	if _, ok := record.Meta[metaPrefix+"severity"]; !ok && severityNumber > 0 {
+		record.Meta[metaPrefix+"severity"] = strconv.FormatUint(severityNumber, 10)
+	}
+	return record, err
+}
+
+// parseKeyValue returns the key and the value of a KeyValue
+func parseKeyValue(b []byte, depth int) (string, interface{}, error) {
+	key := ""
+	var value interface{}
+	err := walk(b, func(f protoField) error {
+		if f.typ != protowire.BytesType {
+			return nil
+		}
+		switch f.num {
+		case 1:
+			key = string(f.bytes)
+		case 2:
+			var err error
+			value, err = parseAnyValue(f.bytes, depth)
+			return err
+		}
+		return nil
+	})
+	return key, value, err
+}
+
+// parseAttribute adds an attribute to meta, with the prefix
+func parseAttribute(b []byte, prefix string, meta map[string]string) error {
+	key, value, err := parseKeyValue(b, 0)
+	if err != nil {
+		return err
+	}
+	if key != "" {
+		meta[prefix+key] = stringify(value)
+	}
+	return nil
+}
+
+// parseAnyValue returns the value of an AnyValue as a string, bool, int64, float64, []byte, []interface{} or
+// map[string]interface{}
+func parseAnyValue(b []byte, depth int) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, fmt.Errorf("value is nested more than %d times", maxDepth)
+	}
+	var ret interface{}
+	err := walk(b, func(f protoField) error {
+		switch {
+		case f.num == 1 && f.typ == protowire.BytesType:
+			ret = string(f.bytes)
+		case f.num == 2 && f.typ == protowire.VarintType:
+			ret = f.value != 0
+		case f.num == 3 && f.typ == protowire.VarintType:
+			ret = int64(f.value)
+		case f.num == 4 && f.typ == protowire.Fixed64Type:
+			ret = math.Float64frombits(f.value)
+		case f.num == 5 && f.typ == protowire.BytesType:
+			values := []interface{}{}
+			err := walk(f.bytes, func(f protoField) error {
+				if f.num != 1 || f.typ != protowire.BytesType {
+					return nil
+				}
+				value, err := parseAnyValue(f.bytes, depth+1)
+				values = append(values, value)
+				return err
+			})
+			ret = values
+			return err
+		case f.num == 6 && f.typ == protowire.BytesType:
+			values := map[string]interface{}{}
+			err := walk(f.bytes, func(f protoField) error {
+				if f.num != 1 || f.typ != protowire.BytesType {
+					return nil
+				}
+				key, value, err := parseKeyValue(f.bytes, depth+1)
+				values[key] = value
+				return err
+			})
+			ret = values
+			return err
+		case f.num == 7 && f.typ == protowire.BytesType:
+			ret = f.bytes
+		}
+		return nil
+	})
+	return ret, err
+}
+
+// stringify returns the string of a value, json for the arrays and maps
+func stringify(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []byte:
+		return base64.StdEncoding.EncodeToString(v)
+	}
+	ret, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(ret)
+}
@@ -0,0 +1,406 @@
+package otlpacquisition
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	leaky "github.com/crowdsecurity/crowdsec/pkg/leakybucket"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	_ "google.golang.org/grpc/encoding/gzip" //the collector exporters compress with gzip by default
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"gopkg.in/tomb.v2"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	OTLP_PROTO_GRPC = "grpc"
+	OTLP_PROTO_HTTP = "http"
+
+	OTLP_CLIENT_AUTH_NONE     = "none"
+	OTLP_CLIENT_AUTH_OPTIONAL = "optional"
+	OTLP_CLIENT_AUTH_REQUIRED = "required"
+
+	logsPath = "/v1/logs"
+)
+
+type OTLPTLSConfiguration struct {
+	CertFile   string `yaml:"cert_file"`
+	KeyFile    string `yaml:"key_file"`
+	CAFile     string `yaml:"ca_file"`
+	ClientAuth string `yaml:"client_auth"`
+}
+
+type OTLPConfiguration struct {
+	Proto                             string                `yaml:"protocol,omitempty"`
+	Port                              int                   `yaml:"listen_port,omitempty"`
+	Addr                              string                `yaml:"listen_addr,omitempty"`
+	MaxMessageLen                     int                   `yaml:"max_message_len,omitempty"` //bound of an export request, once decompressed
+	TLS                               *OTLPTLSConfiguration `yaml:"tls,omitempty"`
+	configuration.DataSourceCommonCfg `yaml:",inline"`
+}
+
+// OTLPSource receives the log records that the OpenTelemetry SDKs and collectors export with OTLP, over gRPC or
+// HTTP with protobuf payloads
+type OTLPSource struct {
+	configuration.HealthTracker
+	config     OTLPConfiguration
+	logger     *log.Entry
+	tlsConfig  *tls.Config
+	out        chan types.Event
+	dying      <-chan struct{}
+	expectMode int
+}
+
+var linesReceived = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cs_otlpsource_hits_total",
+		Help: "Total log records that were received with OTLP.",
+	},
+	[]string{"source"})
+
+func (o *OTLPSource) GetName() string {
+	return "otlp"
+}
+
+func (o *OTLPSource) GetUuid() string {
+	return o.config.UniqueId
+}
+
+func (o *OTLPSource) GetMode() string {
+	return o.config.Mode
+}
+
+func (o *OTLPSource) Dump() interface{} {
+	return o
+}
+
+func (o *OTLPSource) CanRun() error {
+	return nil
+}
+
+func (o *OTLPSource) GetMetrics() []prometheus.Collector {
+	return []prometheus.Collector{linesReceived}
+}
+
+func (o *OTLPSource) GetAggregMetrics() []prometheus.Collector {
+	return []prometheus.Collector{linesReceived}
+}
+
+func (o *OTLPSource) ConfigureByDSN(dsn string, labels map[string]string, logger *log.Entry) error {
+	return fmt.Errorf("otlp datasource does not support one shot acquisition")
+}
+
+func (o *OTLPSource) OneShotAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	return fmt.Errorf("otlp datasource does not support one shot acquisition")
+}
+
+func (o *OTLPSource) Configure(yamlConfig []byte, logger *log.Entry) error {
+	o.logger = logger
+	otlpConfig := OTLPConfiguration{}
+	otlpConfig.Mode = configuration.TAIL_MODE
+	if err := yaml.UnmarshalStrict(yamlConfig, &otlpConfig); err != nil {
+		return errors.Wrap(err, "Cannot parse otlp configuration")
+	}
+	if otlpConfig.Addr == "" {
+		otlpConfig.Addr = "127.0.0.1"
+	}
+	if otlpConfig.Proto == "" {
+		otlpConfig.Proto = OTLP_PROTO_GRPC
+	}
+	if otlpConfig.Port == 0 {
+		otlpConfig.Port = 4317
+		if otlpConfig.Proto == OTLP_PROTO_HTTP {
+			otlpConfig.Port = 4318
+		}
+	}
+	if otlpConfig.MaxMessageLen == 0 {
+		otlpConfig.MaxMessageLen = 4 * 1024 * 1024
+	}
+	if otlpConfig.Proto != OTLP_PROTO_GRPC && otlpConfig.Proto != OTLP_PROTO_HTTP {
+		return fmt.Errorf("invalid protocol %s (must be %s or %s)", otlpConfig.Proto, OTLP_PROTO_GRPC, OTLP_PROTO_HTTP)
+	}
+	if otlpConfig.Port <= 0 || otlpConfig.Port > 65535 {
+		return fmt.Errorf("invalid port %d", otlpConfig.Port)
+	}
+	if net.ParseIP(otlpConfig.Addr) == nil {
+		return fmt.Errorf("invalid listen IP %s", otlpConfig.Addr)
+	}
+	if otlpConfig.MaxMessageLen < 0 {
+		return fmt.Errorf("invalid max_message_len %d", otlpConfig.MaxMessageLen)
+	}
+	if otlpConfig.TLS != nil {
+		if err := o.configureTLS(otlpConfig.TLS); err != nil {
+			return err
+		}
+	}
+	o.config = otlpConfig
+	return nil
+}
+
+func (o *OTLPSource) configureTLS(config *OTLPTLSConfiguration) error {
+	if config.CertFile == "" || config.KeyFile == "" {
+		return fmt.Errorf("tls.cert_file and tls.key_file are required")
+	}
+	cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return errors.Wrap(err, "could not load server certificate")
+	}
+	o.tlsConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if config.ClientAuth == "" {
+		config.ClientAuth = OTLP_CLIENT_AUTH_NONE
+		if config.CAFile != "" {
+			config.ClientAuth = OTLP_CLIENT_AUTH_REQUIRED
+		}
+	}
+	switch config.ClientAuth {
+	case OTLP_CLIENT_AUTH_NONE:
+		o.tlsConfig.ClientAuth = tls.NoClientCert
+	case OTLP_CLIENT_AUTH_OPTIONAL:
+		o.tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case OTLP_CLIENT_AUTH_REQUIRED:
+		o.tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return fmt.Errorf("invalid tls.client_auth %s (must be %s, %s or %s)", config.ClientAuth,
+			OTLP_CLIENT_AUTH_NONE, OTLP_CLIENT_AUTH_OPTIONAL, OTLP_CLIENT_AUTH_REQUIRED)
+	}
+	if o.tlsConfig.ClientAuth != tls.NoClientCert {
+		if config.CAFile == "" {
+			return fmt.Errorf("tls.ca_file is required to verify client certificates")
+		}
+		caCert, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return errors.Wrap(err, "could not read CA file")
+		}
+		caPool := x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(caCert) {
+			return fmt.Errorf("no certificate found in %s", config.CAFile)
+		}
+		o.tlsConfig.ClientCAs = caPool
+	}
+	return nil
+}
+
+func (o *OTLPSource) StreamingAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	o.out = out
+	o.dying = t.Dying()
+	o.expectMode = leaky.LIVE
+	if o.config.UseTimeMachine {
+		o.expectMode = leaky.TIMEMACHINE
+	}
+	addr := net.JoinHostPort(o.config.Addr, strconv.Itoa(o.config.Port))
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrapf(err, "could not listen on %s", addr)
+	}
+	o.logger.Infof("listening for OTLP logs on %s (%s)", listener.Addr(), o.config.Proto)
+	var serve func() error
+	var stop func()
+	if o.config.Proto == OTLP_PROTO_GRPC {
+		opts := []grpc.ServerOption{grpc.ForceServerCodec(rawCodec{}), grpc.MaxRecvMsgSize(o.config.MaxMessageLen)}
+		if o.tlsConfig != nil {
+			opts = append(opts, grpc.Creds(credentials.NewTLS(o.tlsConfig)))
+		}
+		server := grpc.NewServer(opts...)
+		server.RegisterService(&logsServiceDesc, o)
+		serve = func() error { return server.Serve(listener) }
+		stop = server.Stop
+	} else {
+		mux := http.NewServeMux()
+		mux.HandleFunc(logsPath, o.handleHTTP)
+		server := &http.Server{Handler: mux, TLSConfig: o.tlsConfig, ReadHeaderTimeout: 10 * time.Second}
+		serve = func() error {
+			var err error
+			if o.tlsConfig != nil {
+				err = server.ServeTLS(listener, "", "")
+			} else {
+				err = server.Serve(listener)
+			}
+			if err == http.ErrServerClosed {
+				return nil
+			}
+			return err
+		}
+		stop = func() { server.Close() }
+	}
+	t.Go(func() error {
+		defer types.CatchPanic("crowdsec/acquis/otlp/live")
+		t.Go(func() error {
+			<-t.Dying()
+			o.logger.Info("otlp datasource is dying")
+			stop()
+			return nil
+		})
+		if err := serve(); err != nil {
+			select {
+			case <-t.Dying():
+				return nil
+			default:
+			}
+			err = errors.Wrap(err, "otlp server has exited")
+			o.SetState(configuration.STATUS_ERRORED, err)
+			return err
+		}
+		return nil
+	})
+	return nil
+}
+
+// export sends the records of an ExportLogsServiceRequest, and returns false if the datasource stopped meanwhile
+func (o *OTLPSource) export(request []byte, client string) (bool, error) {
+	records, err := parseExportRequest(request)
+	if err != nil {
+		return true, err
+	}
+	linesReceived.With(prometheus.Labels{"source": client}).Add(float64(len(records)))
+	for _, record := range records {
+		l := types.Line{}
+		l.Raw = record.Body
+		l.Module = o.GetName()
+		l.Labels = o.config.Labels
+		l.Time = time.Now().UTC()
+		l.Src = record.Meta[metaPrefix+"resource_service.name"]
+		if l.Src == "" {
+			l.Src = client
+		}
+		l.Process = true
+		o.EventSeen(&l)
+		select {
+		case o.out <- types.Event{Line: l, Process: true, Type: types.LOG, ExpectMode: o.expectMode, Meta: record.Meta}:
+		case <-o.dying:
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// handleHTTP implements the OTLP/HTTP logs endpoint, with binary protobuf payloads
+func (o *OTLPSource) handleHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/x-protobuf" {
+		http.Error(w, "only application/x-protobuf payloads are supported", http.StatusUnsupportedMediaType)
+		return
+	}
+	var body io.Reader = http.MaxBytesReader(w, r.Body, int64(o.config.MaxMessageLen))
+	switch r.Header.Get("Content-Encoding") {
+	case "", "identity":
+	case "gzip":
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		body = io.LimitReader(gz, int64(o.config.MaxMessageLen)+1)
+	default:
+		http.Error(w, "unsupported content encoding", http.StatusUnsupportedMediaType)
+		return
+	}
+	request, err := ioutil.ReadAll(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if len(request) > o.config.MaxMessageLen {
+		http.Error(w, fmt.Sprintf("request is larger than %d bytes", o.config.MaxMessageLen), http.StatusRequestEntityTooLarge)
+		return
+	}
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+	ok, err := o.export(request, client)
+	if err != nil {
+		o.logger.WithField("client", client).Debugf("rejecting request : %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !ok {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	//an empty ExportLogsServiceResponse : all the records were accepted
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.WriteHeader(http.StatusOK)
+}
+
+// rawCodec hands the gRPC requests undecoded to the handlers, as the OTLP messages are decoded with protowire
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	return *v.(*[]byte), nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	*v.(*[]byte) = data
+	return nil
+}
+
+func (rawCodec) Name() string {
+	return "proto"
+}
+
+// logsServer is implemented by OTLPSource, to be registered with logsServiceDesc
+type logsServer interface {
+	export(request []byte, client string) (bool, error)
+}
+
+func _LogsService_Export_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	request := []byte{}
+	if err := dec(&request); err != nil {
+		return nil, err
+	}
+	client := ""
+	if p, ok := peer.FromContext(ctx); ok {
+		if client, _, _ = net.SplitHostPort(p.Addr.String()); client == "" {
+			client = p.Addr.String()
+		}
+	}
+	ok, err := srv.(logsServer).export(request, client)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if !ok {
+		return nil, status.Error(codes.Unavailable, "shutting down")
+	}
+	//an empty ExportLogsServiceResponse : all the records were accepted
+	return &[]byte{}, nil
+}
+
+// logsServiceDesc is the grpc.ServiceDesc of the LogsService of opentelemetry-proto, declared by hand like the
+// one of the datasource plugins
+var logsServiceDesc = grpc.ServiceDesc{
+	ServiceName: "opentelemetry.proto.collector.logs.v1.LogsService",
+	HandlerType: (*logsServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Export",
+			Handler:    _LogsService_Export_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "opentelemetry/proto/collector/logs/v1/logs_service.proto",
+}
@@ -0,0 +1,241 @@
+package otlpacquisition
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"math"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/cstest"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+	"gopkg.in/tomb.v2"
+)
+
+func TestConfigure(t *testing.T) {
+	tests := []struct {
+		config       string
+		expectedErr  string
+		expectedPort int
+	}{
+		{
+			config:      `foobar: bla`,
+			expectedErr: "field foobar not found in type otlpacquisition.OTLPConfiguration",
+		},
+		{
+			config:       `source: otlp`,
+			expectedPort: 4317,
+		},
+		{
+			config:       `protocol: http`,
+			expectedPort: 4318,
+		},
+		{
+			config:      `protocol: udp`,
+			expectedErr: "invalid protocol udp (must be grpc or http)",
+		},
+		{
+			config:      `listen_port: 424242`,
+			expectedErr: "invalid port 424242",
+		},
+		{
+			config:      `listen_addr: 10.0.0`,
+			expectedErr: "invalid listen IP 10.0.0",
+		},
+		{
+			config: `
+tls:
+  cert_file: server.crt`,
+			expectedErr: "tls.cert_file and tls.key_file are required",
+		},
+	}
+	subLogger := log.WithFields(log.Fields{
+		"type": "otlp",
+	})
+	for _, test := range tests {
+		o := OTLPSource{}
+		err := o.Configure([]byte(test.config), subLogger)
+		cstest.AssertErrorContains(t, err, test.expectedErr)
+		if test.expectedErr == "" {
+			assert.Equal(t, test.expectedPort, o.config.Port)
+		}
+	}
+}
+
+// The helpers below encode the OTLP messages like the SDKs do
+
+func message(fields ...[]byte) []byte {
+	return bytes.Join(fields, nil)
+}
+
+func bytesField(num protowire.Number, value []byte) []byte {
+	b := protowire.AppendTag(nil, num, protowire.BytesType)
+	return protowire.AppendBytes(b, value)
+}
+
+func varintField(num protowire.Number, value uint64) []byte {
+	b := protowire.AppendTag(nil, num, protowire.VarintType)
+	return protowire.AppendVarint(b, value)
+}
+
+func stringValue(value string) []byte {
+	return bytesField(1, []byte(value))
+}
+
+func keyValue(key string, value []byte) []byte {
+	return message(bytesField(1, []byte(key)), bytesField(2, value))
+}
+
+func exportRequest(service string, records ...[]byte) []byte {
+	resource := bytesField(1, bytesField(1, keyValue("service.name", stringValue(service))))
+	scopeLogs := bytesField(1, bytesField(1, []byte("my.logger")))
+	for _, record := range records {
+		scopeLogs = append(scopeLogs, bytesField(2, record)...)
+	}
+	return bytesField(1, message(resource, bytesField(2, scopeLogs)))
+}
+
+func TestParseExportRequest(t *testing.T) {
+	float := protowire.AppendTag(nil, 4, protowire.Fixed64Type)
+	float = protowire.AppendFixed64(float, math.Float64bits(1.5))
+	record := message(
+		varintField(1, uint64(time.Now().UnixNano())),
+		varintField(2, 17),
+		bytesField(5, stringValue("connection refused")),
+		bytesField(6, keyValue("http.status_code", varintField(3, 403))),
+		bytesField(6, keyValue("ratio", float)),
+		bytesField(6, keyValue("tags", bytesField(5, message(bytesField(1, stringValue("a")), bytesField(1, varintField(2, 1)))))),
+		bytesField(9, []byte{0x5b, 0x8e, 0xff, 0xf7, 0x98, 0x03, 0x81, 0x03, 0xd2, 0x69, 0xb6, 0x33, 0x81, 0x3f, 0xc6, 0x0c}),
+		bytesField(99, []byte("unknown field")),
+	)
+	records, err := parseExportRequest(exportRequest("frontend", record, bytesField(3, []byte("WARN"))))
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, "connection refused", records[0].Body)
+	assert.Equal(t, map[string]string{
+		"otel_resource_service.name": "frontend",
+		"otel_scope":                 "my.logger",
+		"otel_severity":              "17",
+		"otel_http.status_code":      "403",
+		"otel_ratio":                 "1.5",
+		"otel_tags":                  `["a",true]`,
+		"otel_trace_id":              "5b8efff798038103d269b633813fc60c",
+	}, records[0].Meta)
+	assert.Equal(t, "", records[1].Body)
+	assert.Equal(t, "WARN", records[1].Meta["otel_severity"])
+
+	//a structured body is kept as json
+	records, err = parseExportRequest(exportRequest("frontend", bytesField(5, bytesField(6, bytesField(1, keyValue("msg", stringValue("hello")))))))
+	require.NoError(t, err)
+	assert.Equal(t, `{"msg":"hello"}`, records[0].Body)
+
+	_, err = parseExportRequest([]byte{0x0a, 0x10, 0x01})
+	cstest.AssertErrorContains(t, err, "invalid export request")
+	nested := stringValue("deep")
+	for i := 0; i < 40; i++ {
+		nested = bytesField(5, bytesField(1, nested))
+	}
+	_, err = parseExportRequest(exportRequest("frontend", bytesField(5, nested)))
+	cstest.AssertErrorContains(t, err, "value is nested more than 32 times")
+}
+
+func startSource(t *testing.T, config string) (*tomb.Tomb, chan types.Event) {
+	o := OTLPSource{}
+	require.NoError(t, o.Configure([]byte(config), log.WithField("type", "otlp")))
+	tmb := tomb.Tomb{}
+	//buffered, as the requests return once their records are sent
+	out := make(chan types.Event, 10)
+	require.NoError(t, o.StreamingAcquisition(out, &tmb))
+	return &tmb, out
+}
+
+func readEvent(t *testing.T, out chan types.Event) types.Event {
+	select {
+	case evt := <-out:
+		return evt
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for event")
+	}
+	return types.Event{}
+}
+
+func TestHTTP(t *testing.T) {
+	tmb, out := startSource(t, `
+source: otlp
+protocol: http
+listen_port: 4391`)
+	url := "http://127.0.0.1:4391/v1/logs"
+	request := exportRequest("frontend", bytesField(5, stringValue("over http")))
+
+	resp, err := http.Post(url, "application/x-protobuf", bytes.NewReader(request))
+	require.NoError(t, err)
+	resp.Body.Close()
+	evt := readEvent(t, out)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "over http", evt.Line.Raw)
+	assert.Equal(t, "frontend", evt.Line.Src)
+	assert.Equal(t, "my.logger", evt.Meta["otel_scope"])
+
+	gzipped := bytes.Buffer{}
+	gz := gzip.NewWriter(&gzipped)
+	_, _ = gz.Write(request)
+	gz.Close()
+	req, err := http.NewRequest(http.MethodPost, url, &gzipped)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "over http", readEvent(t, out).Line.Raw)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = http.Post(url, "application/json", bytes.NewReader([]byte("{}")))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+	resp, err = http.Post(url, "application/x-protobuf", bytes.NewReader([]byte{0x0a, 0x10, 0x01}))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	tmb.Kill(nil)
+	require.NoError(t, tmb.Wait())
+}
+
+func TestGRPC(t *testing.T) {
+	tmb, out := startSource(t, `
+source: otlp
+listen_port: 4392`)
+	conn, err := grpc.Dial("127.0.0.1:4392", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	method := "/opentelemetry.proto.collector.logs.v1.LogsService/Export"
+
+	request := exportRequest("backend", bytesField(5, stringValue("over grpc")))
+	response := []byte{}
+	require.NoError(t, conn.Invoke(ctx, method, &request, &response, grpc.ForceCodec(rawCodec{})))
+	evt := readEvent(t, out)
+	assert.Equal(t, "over grpc", evt.Line.Raw)
+	assert.Equal(t, "backend", evt.Line.Src)
+	assert.Empty(t, response)
+
+	request = []byte{0x0a, 0x10, 0x01}
+	err = conn.Invoke(ctx, method, &request, &response, grpc.ForceCodec(rawCodec{}))
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	tmb.Kill(nil)
+	require.NoError(t, tmb.Wait())
+}
@@ -0,0 +1,322 @@
+package pluginacquisition
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"runtime"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/csconfig"
+	"github.com/crowdsecurity/crowdsec/pkg/csplugin"
+	leaky "github.com/crowdsecurity/crowdsec/pkg/leakybucket"
+	"github.com/crowdsecurity/crowdsec/pkg/protobufs"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"gopkg.in/tomb.v2"
+	"gopkg.in/yaml.v2"
+)
+
+var linesRead = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cs_pluginsource_hits_total",
+		Help: "Total lines that were read from a datasource plugin.",
+	},
+	[]string{"plugin"})
+
+var healthCheckFailures = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cs_pluginsource_health_check_failures_total",
+		Help: "Total health checks a datasource plugin failed to answer.",
+	},
+	[]string{"plugin"})
+
+var pluginMetrics = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "cs_pluginsource_metric",
+		Help: "Metrics reported by a datasource plugin in its health checks.",
+	},
+	[]string{"plugin", "metric"})
+
+// pluginStates are the datasource states matching the states reported by the plugins
+var pluginStates = map[protobufs.DataSourceHealth_State]string{
+	protobufs.DataSourceHealth_RUNNING:      configuration.STATUS_RUNNING,
+	protobufs.DataSourceHealth_RECONNECTING: configuration.STATUS_RECONNECTING,
+	protobufs.DataSourceHealth_ERRORED:      configuration.STATUS_ERRORED,
+}
+
+var defaultHealthCheckInterval = 30 * time.Second
+
+// where the datasource plugins are, and which user runs them : set by crowdsec before loading the acquisition
+var (
+	pluginDir        string
+	pluginProcConfig *csconfig.PluginCfg
+)
+
+func SetPluginConfig(dir string, procConfig *csconfig.PluginCfg) {
+	pluginDir = dir
+	pluginProcConfig = procConfig
+}
+
+type PluginConfiguration struct {
+	Plugin                            string         `yaml:"plugin"` //the binary is <plugin_dir>/datasource-<plugin>
+	HealthCheckInterval               *time.Duration `yaml:"health_check_interval"`
+	configuration.DataSourceCommonCfg `yaml:",inline"`
+}
+
+// PluginSource runs an external binary implementing the DataSource service of pkg/protobufs,
+// and forwards the lines it sends. The plugin is started with the acquisition and killed with it
+type PluginSource struct {
+	configuration.HealthTracker
+	config     PluginConfiguration
+	binaryPath string
+	rawConfig  []byte
+	logger     *log.Entry
+}
+
+func (p *PluginSource) Configure(yamlConfig []byte, logger *log.Entry) error {
+	p.logger = logger
+	config := PluginConfiguration{}
+	//the plugin specific directives are checked by the plugin itself. yaml.v2 ignores the inline map of
+	//DataSourceCommonCfg when it is embedded, so the unknown directives can't be collected in config.Config
+	if err := yaml.Unmarshal(yamlConfig, &config); err != nil {
+		return errors.Wrap(err, "Cannot parse plugin datasource configuration")
+	}
+	if config.Mode == "" {
+		config.Mode = configuration.TAIL_MODE
+	}
+	if config.Mode != configuration.CAT_MODE && config.Mode != configuration.TAIL_MODE {
+		return fmt.Errorf("unsupported mode %s for plugin datasource", config.Mode)
+	}
+	if config.Plugin == "" {
+		return fmt.Errorf("plugin is mandatory")
+	}
+	if config.HealthCheckInterval == nil {
+		config.HealthCheckInterval = &defaultHealthCheckInterval
+	}
+	if *config.HealthCheckInterval <= 0 {
+		return fmt.Errorf("health_check_interval must be positive")
+	}
+	if pluginDir == "" {
+		return fmt.Errorf("config_paths.plugin_dir is not defined")
+	}
+	//On windows, the plugins are always run as medium-integrity processes, so we don't care about plugin_config
+	if pluginProcConfig == nil && runtime.GOOS != "windows" {
+		return fmt.Errorf("the plugin_config section is missing in the configuration")
+	}
+	p.config = config
+	p.binaryPath = csplugin.DataSourcePluginPath(pluginDir, config.Plugin)
+	if err := csplugin.CheckDataSourcePlugin(p.binaryPath); err != nil {
+		return err
+	}
+	p.rawConfig = yamlConfig
+	return nil
+}
+
+func (p *PluginSource) ConfigureByDSN(string, map[string]string, *log.Entry) error {
+	return fmt.Errorf("plugin datasource does not support command-line acquisition")
+}
+
+func (p *PluginSource) GetMode() string {
+	return p.config.Mode
+}
+
+func (p *PluginSource) GetName() string {
+	return "plugin"
+}
+
+func (p *PluginSource) GetUuid() string {
+	return p.config.UniqueId
+}
+
+func (p *PluginSource) GetMetrics() []prometheus.Collector {
+	return []prometheus.Collector{linesRead, healthCheckFailures, pluginMetrics}
+}
+
+func (p *PluginSource) GetAggregMetrics() []prometheus.Collector {
+	return []prometheus.Collector{linesRead, healthCheckFailures, pluginMetrics}
+}
+
+func (p *PluginSource) CanRun() error {
+	return nil
+}
+
+func (p *PluginSource) Dump() interface{} {
+	return p
+}
+
+// start runs the plugin and hands it its configuration
+func (p *PluginSource) start() (*csplugin.DataSourcePluginClient, error) {
+	client, err := csplugin.StartDataSourcePlugin(p.config.Plugin, p.binaryPath, pluginProcConfig)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := client.Configure(context.Background(), &protobufs.DataSourceConfig{Config: p.rawConfig}); err != nil {
+		client.Kill()
+		return nil, errors.Wrapf(err, "while configuring plugin %s", p.config.Plugin)
+	}
+	p.logger.Infof("started plugin %s", p.config.Plugin)
+	return client, nil
+}
+
+func (p *PluginSource) lineToEvent(line *protobufs.DataSourceEvent, expectMode int) (types.Event, error) {
+	l := types.Line{}
+	l.Raw = line.GetRaw()
+	l.Src = line.GetSrc()
+	if l.Src == "" {
+		l.Src = p.config.Plugin
+	}
+	if line.GetTime() != nil {
+		if err := line.GetTime().CheckValid(); err != nil {
+			return types.Event{}, errors.Wrap(err, "invalid time")
+		}
+		l.Time = line.GetTime().AsTime()
+	} else {
+		l.Time = time.Now().UTC()
+	}
+	l.Labels = p.config.Labels
+	l.Process = true
+	l.Module = p.GetName()
+	return types.Event{Line: l, Process: true, Type: types.LOG, ExpectMode: expectMode}, nil
+}
+
+// eventStream is the stream of the OneShotAcquisition and StreamingAcquisition calls
+type eventStream interface {
+	Recv() (*protobufs.DataSourceEvent, error)
+	Context() context.Context
+}
+
+// read forwards the lines sent by the plugin until the stream ends, or ctx is cancelled
+func (p *PluginSource) read(stream eventStream, out chan types.Event, expectMode int) error {
+	hits := linesRead.With(prometheus.Labels{"plugin": p.config.Plugin})
+	for {
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(err, "while reading from plugin %s", p.config.Plugin)
+		}
+		evt, err := p.lineToEvent(msg, expectMode)
+		if err != nil {
+			p.logger.Warningf("discarding line from plugin %s : %s", p.config.Plugin, err)
+			continue
+		}
+		hits.Inc()
+		p.EventSeen(&evt.Line)
+		select {
+		case out <- evt:
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+func (p *PluginSource) OneShotAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	client, err := p.start()
+	if err != nil {
+		return err
+	}
+	defer client.Kill()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := client.OneShotAcquisition(ctx, &emptypb.Empty{})
+	if err != nil {
+		return errors.Wrapf(err, "while starting acquisition of plugin %s", p.config.Plugin)
+	}
+	go func() {
+		select {
+		case <-t.Dying():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	if err := p.read(stream, out, leaky.TIMEMACHINE); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
+
+func (p *PluginSource) StreamingAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	client, err := p.start()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := client.StreamingAcquisition(ctx, &emptypb.Empty{})
+	if err != nil {
+		cancel()
+		client.Kill()
+		return errors.Wrapf(err, "while starting acquisition of plugin %s", p.config.Plugin)
+	}
+	expectMode := leaky.LIVE
+	if p.config.UseTimeMachine {
+		expectMode = leaky.TIMEMACHINE
+	}
+	readErr := make(chan error, 1)
+	go func() {
+		defer types.CatchPanic("crowdsec/acquis/plugin/live")
+		err := p.read(stream, out, expectMode)
+		if err == nil {
+			err = fmt.Errorf("plugin %s closed the stream", p.config.Plugin)
+		}
+		readErr <- err
+	}()
+	t.Go(func() error {
+		defer types.CatchPanic("crowdsec/acquis/plugin/health")
+		defer client.Kill()
+		defer cancel()
+		return p.monitor(client, readErr, t)
+	})
+	return nil
+}
+
+// checkHealth asks the plugin for its status, and reports it in the health of the datasource and in the metrics
+func (p *PluginSource) checkHealth(client *csplugin.DataSourcePluginClient) error {
+	ctx, cancel := context.WithTimeout(context.Background(), *p.config.HealthCheckInterval)
+	defer cancel()
+	health, err := client.Health(ctx, &emptypb.Empty{})
+	if err != nil {
+		return err
+	}
+	state, ok := pluginStates[health.GetState()]
+	if !ok {
+		return fmt.Errorf("unknown state %s", health.GetState())
+	}
+	var stateErr error
+	if health.GetError() != "" {
+		stateErr = errors.New(health.GetError())
+	}
+	p.SetState(state, stateErr)
+	for name, value := range health.GetMetrics() {
+		pluginMetrics.With(prometheus.Labels{"plugin": p.config.Plugin, "metric": name}).Set(value)
+	}
+	return nil
+}
+
+// monitor checks the health of the plugin until the acquisition is over
+func (p *PluginSource) monitor(client *csplugin.DataSourcePluginClient, readErr chan error, t *tomb.Tomb) error {
+	ticker := time.NewTicker(*p.config.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.Dying():
+			p.logger.Infof("plugin %s stopping", p.config.Plugin)
+			return nil
+		case err := <-readErr:
+			p.SetState(configuration.STATUS_ERRORED, err)
+			return err
+		case <-ticker.C:
+			if err := p.checkHealth(client); err != nil {
+				healthCheckFailures.With(prometheus.Labels{"plugin": p.config.Plugin}).Inc()
+				err = errors.Wrapf(err, "health check of plugin %s failed", p.config.Plugin)
+				p.SetState(configuration.STATUS_ERRORED, err)
+				return err
+			}
+		}
+	}
+}
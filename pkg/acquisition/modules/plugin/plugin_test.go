@@ -0,0 +1,186 @@
+package pluginacquisition
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/csconfig"
+	"github.com/crowdsecurity/crowdsec/pkg/csplugin"
+	"github.com/crowdsecurity/crowdsec/pkg/cstest"
+	leaky "github.com/crowdsecurity/crowdsec/pkg/leakybucket"
+	"github.com/crowdsecurity/crowdsec/pkg/protobufs"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestConfigure(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on windows")
+	}
+	dir, err := ioutil.TempDir("", "datasource-plugins")
+	if err != nil {
+		t.Fatalf("unable to create temp dir : %s", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(csplugin.DataSourcePluginPath(dir, "dummy"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatalf("unable to create plugin : %s", err)
+	}
+	if err := ioutil.WriteFile(csplugin.DataSourcePluginPath(dir, "writable"), []byte("#!/bin/sh\n"), 0777); err != nil {
+		t.Fatalf("unable to create plugin : %s", err)
+	}
+	//WriteFile is subject to the umask
+	os.Chmod(csplugin.DataSourcePluginPath(dir, "writable"), 0777)
+
+	tests := []struct {
+		config      string
+		pluginDir   string
+		procConfig  *csconfig.PluginCfg
+		expectedErr string
+	}{
+		{
+			config:      `foobar: asd`,
+			pluginDir:   dir,
+			procConfig:  &csconfig.PluginCfg{},
+			expectedErr: "plugin is mandatory",
+		},
+		{
+			config: `
+mode: ratata
+plugin: dummy`,
+			pluginDir:   dir,
+			procConfig:  &csconfig.PluginCfg{},
+			expectedErr: "unsupported mode ratata for plugin datasource",
+		},
+		{
+			config: `
+plugin: dummy
+health_check_interval: -1s`,
+			pluginDir:   dir,
+			procConfig:  &csconfig.PluginCfg{},
+			expectedErr: "health_check_interval must be positive",
+		},
+		{
+			config:      `plugin: dummy`,
+			pluginDir:   "",
+			procConfig:  &csconfig.PluginCfg{},
+			expectedErr: "config_paths.plugin_dir is not defined",
+		},
+		{
+			config:      `plugin: dummy`,
+			pluginDir:   dir,
+			procConfig:  nil,
+			expectedErr: "the plugin_config section is missing in the configuration",
+		},
+		{
+			config:      `plugin: missing`,
+			pluginDir:   dir,
+			procConfig:  &csconfig.PluginCfg{},
+			expectedErr: "plugin at " + filepath.Join(dir, "datasource-missing") + " does not exist",
+		},
+		{
+			config:      `plugin: writable`,
+			pluginDir:   dir,
+			procConfig:  &csconfig.PluginCfg{},
+			expectedErr: "world writable plugins are invalid",
+		},
+		{
+			config: `
+plugin: dummy
+labels:
+  type: dummy
+some_plugin_setting: 42`,
+			pluginDir:   dir,
+			procConfig:  &csconfig.PluginCfg{},
+			expectedErr: "",
+		},
+	}
+
+	subLogger := log.WithFields(log.Fields{
+		"type": "plugin",
+	})
+	for _, test := range tests {
+		SetPluginConfig(test.pluginDir, test.procConfig)
+		p := PluginSource{}
+		err := p.Configure([]byte(test.config), subLogger)
+		cstest.AssertErrorContains(t, err, test.expectedErr)
+	}
+}
+
+func TestLineToEvent(t *testing.T) {
+	p := PluginSource{}
+	p.config.Plugin = "dummy"
+	p.config.Labels = map[string]string{"type": "dummy"}
+
+	evt, err := p.lineToEvent(&protobufs.DataSourceEvent{
+		Raw:  "hello",
+		Src:  "host1",
+		Time: timestamppb.New(time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)),
+	}, leaky.LIVE)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", evt.Line.Raw)
+	assert.Equal(t, "host1", evt.Line.Src)
+	assert.Equal(t, time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC), evt.Line.Time)
+	assert.Equal(t, "plugin", evt.Line.Module)
+	assert.Equal(t, "dummy", evt.Line.Labels["type"])
+	assert.Equal(t, leaky.LIVE, evt.ExpectMode)
+
+	//the source and time default to the plugin name and the reception time
+	evt, err = p.lineToEvent(&protobufs.DataSourceEvent{Raw: "hello"}, leaky.TIMEMACHINE)
+	assert.NoError(t, err)
+	assert.Equal(t, "dummy", evt.Line.Src)
+	assert.False(t, evt.Line.Time.IsZero())
+	assert.Equal(t, leaky.TIMEMACHINE, evt.ExpectMode)
+
+	_, err = p.lineToEvent(&protobufs.DataSourceEvent{Raw: "hello", Time: &timestamppb.Timestamp{Nanos: -1}}, leaky.LIVE)
+	assert.Error(t, err)
+}
+
+type healthClient struct {
+	protobufs.DataSourceClient
+	health *protobufs.DataSourceHealth
+	err    error
+}
+
+func (c *healthClient) Health(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*protobufs.DataSourceHealth, error) {
+	return c.health, c.err
+}
+
+func TestCheckHealth(t *testing.T) {
+	interval := time.Second
+	p := PluginSource{}
+	p.config.Plugin = "health"
+	p.config.HealthCheckInterval = &interval
+
+	client := &healthClient{health: &protobufs.DataSourceHealth{
+		State:   protobufs.DataSourceHealth_RECONNECTING,
+		Error:   "upstream is down",
+		Metrics: map[string]float64{"queue_size": 42},
+	}}
+	assert.NoError(t, p.checkHealth(&csplugin.DataSourcePluginClient{DataSourceClient: client}))
+	assert.Equal(t, configuration.STATUS_RECONNECTING, p.Health().State)
+	assert.Equal(t, "upstream is down", p.Health().Error)
+	assert.Equal(t, 42.0, testutil.ToFloat64(pluginMetrics.With(prometheus.Labels{"plugin": "health", "metric": "queue_size"})))
+
+	client.health = &protobufs.DataSourceHealth{State: protobufs.DataSourceHealth_RUNNING}
+	assert.NoError(t, p.checkHealth(&csplugin.DataSourcePluginClient{DataSourceClient: client}))
+	assert.Equal(t, configuration.STATUS_RUNNING, p.Health().State)
+	assert.Empty(t, p.Health().Error)
+
+	client.health = &protobufs.DataSourceHealth{State: 42}
+	cstest.AssertErrorContains(t, p.checkHealth(&csplugin.DataSourcePluginClient{DataSourceClient: client}), "unknown state 42")
+
+	client.err = fmt.Errorf("connection refused")
+	cstest.AssertErrorContains(t, p.checkHealth(&csplugin.DataSourcePluginClient{DataSourceClient: client}), "connection refused")
+}
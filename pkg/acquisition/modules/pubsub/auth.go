@@ -0,0 +1,36 @@
+package pubsubacquisition
+
+import (
+	"context"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/retry"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/secrets"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// the audience of the self-signed tokens of the service accounts
+const pubsubAudience = "https://pubsub.googleapis.com/"
+
+// rpcCredentials hands the access tokens to the streams. It implements credentials.PerRPCCredentials
+type rpcCredentials struct {
+	tokens *secrets.GCPTokenSource
+}
+
+func (c *rpcCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	token, err := c.tokens.Token()
+	if err != nil {
+		//the metadata server refusing to give a token (eg. no service account attached) is not retried
+		statusErr := &retry.StatusError{}
+		if errors.As(err, &statusErr) && statusErr.Status >= 400 && statusErr.Status < 500 {
+			return nil, status.Error(codes.Unauthenticated, "while getting an access token : "+err.Error())
+		}
+		return nil, status.Error(codes.Unavailable, "while getting an access token : "+err.Error())
+	}
+	return map[string]string{"authorization": "Bearer " + token}, nil
+}
+
+func (c *rpcCredentials) RequireTransportSecurity() bool {
+	return true
+}
@@ -0,0 +1,75 @@
+package pubsubacquisition
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/retry"
+	pubsubpb "google.golang.org/genproto/googleapis/pubsub/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// The datasource only uses the StreamingPull method of the Subscriber service, through the client generated from
+// https://github.com/googleapis/googleapis/blob/master/google/pubsub/v1/pubsub.proto
+
+// pullStream is the part of pubsubpb.Subscriber_StreamingPullClient used by the datasource. The first request of a
+// stream opens it, the next ones ack and modify the deadline of the messages received
+type pullStream interface {
+	Send(req *pubsubpb.StreamingPullRequest) error
+	Recv() (*pubsubpb.StreamingPullResponse, error)
+	CloseSend() error
+}
+
+// statusError is a failed call, its code (eg. Unavailable) can be matched in retry_on
+type statusError struct {
+	err error
+}
+
+func (e *statusError) Error() string {
+	return e.err.Error()
+}
+
+func (e *statusError) Code() string {
+	return status.Code(e.err).String()
+}
+
+// wrapStatus returns the error to hand to the retrier : the ones caused by the configuration are permanent
+func wrapStatus(err error) error {
+	switch status.Code(err) {
+	case codes.NotFound, codes.PermissionDenied, codes.Unauthenticated, codes.InvalidArgument:
+		return retry.Permanent(&statusError{err: err})
+	}
+	return &statusError{err: err}
+}
+
+// dialer opens the streams of the datasource
+type dialer struct {
+	endpoint string
+	emulator bool //without TLS nor credentials
+	creds    *rpcCredentials
+}
+
+func (d *dialer) open(ctx context.Context) (pullStream, io.Closer, error) {
+	opts := []grpc.DialOption{}
+	if d.emulator {
+		opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	} else {
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12})),
+			grpc.WithPerRPCCredentials(d.creds))
+	}
+	conn, err := grpc.DialContext(ctx, d.endpoint, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	stream, err := pubsubpb.NewSubscriberClient(conn).StreamingPull(ctx)
+	if err != nil {
+		conn.Close()
+		return nil, nil, wrapStatus(err)
+	}
+	return stream, conn, nil
+}
@@ -0,0 +1,560 @@
+package pubsubacquisition
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/retry"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/secrets"
+	leaky "github.com/crowdsecurity/crowdsec/pkg/leakybucket"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	pubsubpb "google.golang.org/genproto/googleapis/pubsub/v1"
+	"gopkg.in/tomb.v2"
+	"gopkg.in/yaml.v2"
+)
+
+var linesRead = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cs_pubsubsource_hits_total",
+		Help: "Total messages that were read from a Pub/Sub subscription.",
+	},
+	[]string{"subscription"})
+
+var (
+	defaultAckDeadline  = time.Minute
+	defaultMaxExtension = time.Hour
+	defaultTimeout      = 30 * time.Second
+	//how often the acks are sent, and the deadlines checked
+	ackInterval = 100 * time.Millisecond
+	//the deadlines are extended when they are closer than this
+	extensionMargin = 10 * time.Second
+)
+
+const (
+	defaultEndpoint               = "pubsub.googleapis.com:443"
+	defaultMaxOutstandingMessages = 1000
+	defaultMaxOutstandingBytes    = 100 * 1024 * 1024
+	//of a request, whose size is limited to 512KB
+	maxAckIDs = 2500
+	//the LogEntry fields and the message attributes are added to the event metadata with these prefixes
+	logEntryMetaPrefix = "gcp_"
+	messageMetaPrefix  = "pubsub_"
+)
+
+type PubSubConfiguration struct {
+	configuration.DataSourceCommonCfg `yaml:",inline"`
+	Project                           string         `yaml:"project"`          //the one of credentials_file by default
+	Subscription                      string         `yaml:"subscription"`     //name, or projects/<project>/subscriptions/<name>
+	CredentialsFile                   string         `yaml:"credentials_file"` //json key of a service account. Without it, the service account of the instance is used
+	Endpoint                          string         `yaml:"endpoint"`         //pubsub.googleapis.com:443 by default, the PUBSUB_EMULATOR_HOST environment variable is honored
+	AckDeadline                       *time.Duration `yaml:"ack_deadline"`
+	MaxExtension                      *time.Duration `yaml:"max_extension"` //the deadline of a message is extended until it is acked, or for this long at most
+	MaxOutstandingMessages            int64          `yaml:"max_outstanding_messages"`
+	MaxOutstandingBytes               int64          `yaml:"max_outstanding_bytes"`
+	UnwrapLogEntry                    *bool          `yaml:"unwrap_log_entry"` //the payload of the LogEntry of the Cloud Logging sinks is the line, true by default
+	Timeout                           *time.Duration `yaml:"timeout"`
+}
+
+// PubSubSource reads a subscription with a streaming pull. The messages are handed to crowdsec in the order they
+// were received (the order of their ordering key, if the subscription has message ordering), then acked. The deadline
+// of the ones waiting to be handed is extended meanwhile
+type PubSubSource struct {
+	configuration.HealthTracker
+	config       PubSubConfiguration
+	logger       *log.Entry
+	subscription string //projects/<project>/subscriptions/<name>
+	name         string //of the subscription, for the sources and metrics
+	clientID     string
+	retrier      *retry.Retrier
+	open         func(ctx context.Context) (pullStream, io.Closer, error)
+}
+
+func (p *PubSubSource) GetMetrics() []prometheus.Collector {
+	return []prometheus.Collector{linesRead}
+}
+
+func (p *PubSubSource) GetAggregMetrics() []prometheus.Collector {
+	return []prometheus.Collector{linesRead}
+}
+
+func (p *PubSubSource) Configure(yamlConfig []byte, logger *log.Entry) error {
+	p.logger = logger
+	config := PubSubConfiguration{}
+	config.Mode = configuration.TAIL_MODE
+	if err := yaml.UnmarshalStrict(yamlConfig, &config); err != nil {
+		return errors.Wrap(err, "Cannot parse pubsub datasource configuration")
+	}
+	if config.Mode != configuration.TAIL_MODE {
+		return fmt.Errorf("unsupported mode %s for pubsub datasource", config.Mode)
+	}
+	if config.Subscription == "" {
+		return fmt.Errorf("subscription is mandatory")
+	}
+	if config.Timeout == nil {
+		config.Timeout = &defaultTimeout
+	}
+	d := &dialer{endpoint: config.Endpoint}
+	if emulator := os.Getenv("PUBSUB_EMULATOR_HOST"); emulator != "" && d.endpoint == "" {
+		p.logger.Infof("using the pubsub emulator at %s", emulator)
+		d.endpoint, d.emulator = emulator, true
+	}
+	if d.endpoint == "" {
+		d.endpoint = defaultEndpoint
+	}
+	if !d.emulator {
+		var key *secrets.GCPServiceAccountKey
+		if config.CredentialsFile != "" {
+			var err error
+			if key, err = secrets.LoadGCPServiceAccountKey(config.CredentialsFile); err != nil {
+				return err
+			}
+			if config.Project == "" {
+				config.Project = key.ProjectID
+			}
+		}
+		d.creds = &rpcCredentials{tokens: secrets.NewGCPTokenSource(&http.Client{Timeout: *config.Timeout}, key, pubsubAudience)}
+	}
+	p.subscription = config.Subscription
+	if !strings.HasPrefix(p.subscription, "projects/") {
+		if config.Project == "" {
+			return fmt.Errorf("project is mandatory when subscription is not a full path (projects/<project>/subscriptions/<name>)")
+		}
+		p.subscription = "projects/" + config.Project + "/subscriptions/" + config.Subscription
+	}
+	parts := strings.Split(p.subscription, "/")
+	if len(parts) != 4 || parts[1] == "" || parts[2] != "subscriptions" || parts[3] == "" {
+		return fmt.Errorf("invalid subscription %s", p.subscription)
+	}
+	p.name = parts[3]
+	if config.AckDeadline == nil {
+		config.AckDeadline = &defaultAckDeadline
+	}
+	if *config.AckDeadline < 10*time.Second || *config.AckDeadline > 10*time.Minute {
+		return fmt.Errorf("invalid ack_deadline %s (must be between 10s and 10m)", *config.AckDeadline)
+	}
+	if config.MaxExtension == nil {
+		config.MaxExtension = &defaultMaxExtension
+	}
+	if config.MaxOutstandingMessages == 0 {
+		config.MaxOutstandingMessages = defaultMaxOutstandingMessages
+	}
+	if config.MaxOutstandingBytes == 0 {
+		config.MaxOutstandingBytes = defaultMaxOutstandingBytes
+	}
+	if config.MaxOutstandingMessages < 0 || config.MaxOutstandingBytes < 0 {
+		return fmt.Errorf("max_outstanding_messages and max_outstanding_bytes must be positive")
+	}
+	if config.UnwrapLogEntry == nil {
+		unwrap := true
+		config.UnwrapLogEntry = &unwrap
+	}
+	//identifies the streams of this agent, so that the server keeps delivering them the same ordering keys
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return errors.Wrap(err, "while generating client id")
+	}
+	p.clientID = "crowdsec-" + hex.EncodeToString(id)
+	var err error
+	p.retrier, err = retry.New(config.Retry, p.logger)
+	if err != nil {
+		return err
+	}
+	p.retrier.Notify = p.notifyRetry
+	p.open = d.open
+	p.config = config
+	return nil
+}
+
+// notifyRetry reports the failing streams in the health of the datasource
+func (p *PubSubSource) notifyRetry(err error) {
+	if err != nil {
+		p.SetState(configuration.STATUS_RECONNECTING, err)
+	} else {
+		p.SetState(configuration.STATUS_RUNNING, nil)
+	}
+}
+
+func (p *PubSubSource) ConfigureByDSN(dsn string, labels map[string]string, logger *log.Entry) error {
+	return fmt.Errorf("pubsub datasource does not support one shot acquisition")
+}
+
+func (p *PubSubSource) GetMode() string {
+	return p.config.Mode
+}
+
+func (p *PubSubSource) GetName() string {
+	return "pubsub"
+}
+
+func (p *PubSubSource) GetUuid() string {
+	return p.config.UniqueId
+}
+
+func (p *PubSubSource) OneShotAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	return fmt.Errorf("pubsub datasource does not support one shot acquisition")
+}
+
+func (p *PubSubSource) CanRun() error {
+	return nil
+}
+
+func (p *PubSubSource) Dump() interface{} {
+	return p
+}
+
+// logEntry is the LogEntry (https://cloud.google.com/logging/docs/reference/v2/rest/v2/LogEntry) that the Cloud
+// Logging sinks publish
+type logEntry struct {
+	LogName  string `json:"logName"`
+	Resource struct {
+		Type   string            `json:"type"`
+		Labels map[string]string `json:"labels"`
+	} `json:"resource"`
+	Timestamp    string            `json:"timestamp"`
+	Severity     string            `json:"severity"`
+	InsertID     string            `json:"insertId"`
+	Labels       map[string]string `json:"labels"`
+	TextPayload  *string           `json:"textPayload"`
+	JSONPayload  json.RawMessage   `json:"jsonPayload"`
+	ProtoPayload json.RawMessage   `json:"protoPayload"` //eg. the AuditLog of the audit logs
+}
+
+// unwrapLogEntry returns the payload of a LogEntry (as json for the structured ones, eg. the VPC flow logs), with the
+// fields of the entry as metadata. It returns false if data is not a LogEntry
+func unwrapLogEntry(data []byte) (string, map[string]string, bool) {
+	entry := logEntry{}
+	if err := json.Unmarshal(data, &entry); err != nil || entry.LogName == "" {
+		return "", nil, false
+	}
+	var payload json.RawMessage
+	switch {
+	case entry.TextPayload != nil:
+	case entry.JSONPayload != nil:
+		payload = entry.JSONPayload
+	case entry.ProtoPayload != nil:
+		payload = entry.ProtoPayload
+	default:
+		return "", nil, false
+	}
+	line := ""
+	if entry.TextPayload != nil {
+		line = *entry.TextPayload
+	} else {
+		buf := bytes.Buffer{}
+		if err := json.Compact(&buf, payload); err != nil {
+			return "", nil, false
+		}
+		line = buf.String()
+	}
+	meta := map[string]string{
+		logEntryMetaPrefix + "log_name":      entry.LogName,
+		logEntryMetaPrefix + "resource_type": entry.Resource.Type,
+	}
+	for key, value := range map[string]string{"timestamp": entry.Timestamp, "severity": entry.Severity, "insert_id": entry.InsertID} {
+		if value != "" {
+			meta[logEntryMetaPrefix+key] = value
+		}
+	}
+	for key, value := range entry.Resource.Labels {
+		meta[logEntryMetaPrefix+"resource_"+key] = value
+	}
+	for key, value := range entry.Labels {
+		meta[logEntryMetaPrefix+"label_"+key] = value
+	}
+	return line, meta, true
+}
+
+// event returns the event of a message
+func (p *PubSubSource) event(received *pubsubpb.ReceivedMessage, expectMode int) types.Event {
+	msg := received.GetMessage()
+	raw, meta, ok := "", map[string]string(nil), false
+	if *p.config.UnwrapLogEntry {
+		raw, meta, ok = unwrapLogEntry(msg.GetData())
+	}
+	if !ok {
+		raw, meta = string(msg.GetData()), map[string]string{}
+	}
+	meta[messageMetaPrefix+"message_id"] = msg.GetMessageId()
+	if msg.GetPublishTime() != nil {
+		meta[messageMetaPrefix+"publish_time"] = msg.GetPublishTime().AsTime().Format(time.RFC3339Nano)
+	}
+	if msg.GetOrderingKey() != "" {
+		meta[messageMetaPrefix+"ordering_key"] = msg.GetOrderingKey()
+	}
+	if received.GetDeliveryAttempt() > 0 {
+		meta[messageMetaPrefix+"delivery_attempt"] = strconv.FormatInt(int64(received.GetDeliveryAttempt()), 10)
+	}
+	for key, value := range msg.GetAttributes() {
+		meta[messageMetaPrefix+"attribute_"+key] = value
+	}
+	l := types.Line{}
+	l.Raw = raw
+	l.Src = p.name
+	l.Time = time.Now().UTC()
+	l.Labels = p.config.Labels
+	l.Process = true
+	l.Module = p.GetName()
+	return types.Event{Line: l, Process: true, Type: types.LOG, ExpectMode: expectMode, Meta: meta}
+}
+
+// outstanding are the messages received but not acked yet, with their deadline
+type outstanding struct {
+	lock      sync.Mutex
+	received  map[string]time.Time
+	deadlines map[string]time.Time
+}
+
+func (o *outstanding) add(ackID string, now time.Time, deadline time.Duration) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.received[ackID] = now
+	o.deadlines[ackID] = now.Add(deadline)
+}
+
+func (o *outstanding) remove(ackID string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	delete(o.received, ackID)
+	delete(o.deadlines, ackID)
+}
+
+// due returns the messages whose deadline must be extended, and sets their new deadline. The ones received more than
+// maxExtension ago are left to expire, and will be delivered again
+func (o *outstanding) due(now time.Time, deadline time.Duration, maxExtension time.Duration) []string {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	//short deadlines are extended halfway, not at each check
+	margin := extensionMargin
+	if margin > deadline/2 {
+		margin = deadline / 2
+	}
+	ret := []string{}
+	for ackID, expires := range o.deadlines {
+		if expires.Sub(now) > margin {
+			continue
+		}
+		if now.Sub(o.received[ackID]) >= maxExtension {
+			delete(o.received, ackID)
+			delete(o.deadlines, ackID)
+			continue
+		}
+		o.deadlines[ackID] = now.Add(deadline)
+		ret = append(ret, ackID)
+	}
+	return ret
+}
+
+func (o *outstanding) all() []string {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	ret := make([]string, 0, len(o.received))
+	for ackID := range o.received {
+		ret = append(ret, ackID)
+	}
+	return ret
+}
+
+// modifyDeadlines sets the deadline of messages, by requests of maxAckIDs messages at most. A deadline of 0 nacks
+// them, for them to be delivered again right away
+func modifyDeadlines(stream pullStream, ackIDs []string, seconds int32) error {
+	for start := 0; start < len(ackIDs); start += maxAckIDs {
+		end := start + maxAckIDs
+		if end > len(ackIDs) {
+			end = len(ackIDs)
+		}
+		req := &pubsubpb.StreamingPullRequest{ModifyDeadlineAckIds: ackIDs[start:end], ModifyDeadlineSeconds: make([]int32, end-start)}
+		for i := range req.ModifyDeadlineSeconds {
+			req.ModifyDeadlineSeconds[i] = seconds
+		}
+		if err := stream.Send(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// consume reads the subscription until the stream fails, or dying is closed
+func (p *PubSubSource) consume(out chan types.Event, dying <-chan struct{}, expectMode int) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, conn, err := p.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	deadline := int32(p.config.AckDeadline.Seconds())
+	err = stream.Send(&pubsubpb.StreamingPullRequest{
+		Subscription:             p.subscription,
+		StreamAckDeadlineSeconds: deadline,
+		ClientId:                 p.clientID,
+		MaxOutstandingMessages:   p.config.MaxOutstandingMessages,
+		MaxOutstandingBytes:      p.config.MaxOutstandingBytes,
+	})
+	if err != nil {
+		return wrapStatus(err)
+	}
+	pending := &outstanding{received: map[string]time.Time{}, deadlines: map[string]time.Time{}}
+	//the messages are handed to crowdsec one at a time, in the order they were received
+	received := make(chan *pubsubpb.ReceivedMessage, p.config.MaxOutstandingMessages)
+	acks := make(chan string, p.config.MaxOutstandingMessages)
+	recvErr := make(chan error, 1)
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	defer cancel()
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		first := true
+		for {
+			resp, err := stream.Recv()
+			if err != nil {
+				recvErr <- wrapStatus(err)
+				return
+			}
+			if first {
+				ordering := resp.GetSubscriptionProperties().GetMessageOrderingEnabled()
+				p.logger.Infof("reading subscription %s (message ordering : %t)", p.subscription, ordering)
+				p.SetState(configuration.STATUS_RUNNING, nil)
+				first = false
+			}
+			for _, msg := range resp.GetReceivedMessages() {
+				pending.add(msg.GetAckId(), time.Now(), *p.config.AckDeadline)
+				select {
+				case received <- msg:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	dispatched := make(chan struct{})
+	go func() {
+		defer wg.Done()
+		defer close(dispatched)
+		hits := linesRead.With(prometheus.Labels{"subscription": p.name})
+		for {
+			select {
+			case msg := <-received:
+				hits.Inc()
+				evt := p.event(msg, expectMode)
+				p.EventSeen(&evt.Line)
+				select {
+				case out <- evt:
+				case <-dying:
+					return
+				case <-ctx.Done():
+					return
+				}
+				select {
+				case acks <- msg.GetAckId():
+				case <-ctx.Done():
+					return
+				}
+			case <-dying:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	ticker := time.NewTicker(ackInterval)
+	defer ticker.Stop()
+	ackIDs := []string{}
+	flush := func() error {
+		for len(ackIDs) > 0 {
+			batch := ackIDs
+			if len(batch) > maxAckIDs {
+				batch = batch[:maxAckIDs]
+			}
+			if err := stream.Send(&pubsubpb.StreamingPullRequest{AckIds: batch}); err != nil {
+				return wrapStatus(err)
+			}
+			ackIDs = ackIDs[len(batch):]
+		}
+		return nil
+	}
+	for {
+		select {
+		case ackID := <-acks:
+			pending.remove(ackID)
+			ackIDs = append(ackIDs, ackID)
+			if len(ackIDs) >= maxAckIDs {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		case <-ticker.C:
+			if err := flush(); err != nil {
+				return err
+			}
+			if err := modifyDeadlines(stream, pending.due(time.Now(), *p.config.AckDeadline, *p.config.MaxExtension), deadline); err != nil {
+				return wrapStatus(err)
+			}
+		case err := <-recvErr:
+			//the stream is closed, the messages not acked will be delivered again
+			return err
+		case <-dying:
+			//the messages handed to crowdsec are acked, the others are delivered again, in order, right away. The
+			//stream is only closed afterwards
+		drain:
+			for {
+				select {
+				case ackID := <-acks:
+					pending.remove(ackID)
+					ackIDs = append(ackIDs, ackID)
+				case <-dispatched:
+					break drain
+				}
+			}
+			for len(acks) > 0 {
+				ackID := <-acks
+				pending.remove(ackID)
+				ackIDs = append(ackIDs, ackID)
+			}
+			if err := flush(); err != nil {
+				p.logger.Warningf("unable to ack the last messages : %s", err)
+			}
+			if err := modifyDeadlines(stream, pending.all(), 0); err != nil {
+				p.logger.Warningf("unable to nack the pending messages : %s", err)
+			}
+			_ = stream.CloseSend()
+			return nil
+		}
+	}
+}
+
+func (p *PubSubSource) StreamingAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	expectMode := leaky.LIVE
+	if p.config.UseTimeMachine {
+		expectMode = leaky.TIMEMACHINE
+	}
+	t.Go(func() error {
+		defer types.CatchPanic("crowdsec/acquis/pubsub/live")
+		err := p.retrier.Do(t.Dying(), func() error {
+			return p.consume(out, t.Dying(), expectMode)
+		})
+		if err == retry.ErrDying || err == nil {
+			p.logger.Infof("pubsub datasource stopping")
+			return nil
+		}
+		err = errors.Wrapf(err, "while reading subscription %s", p.subscription)
+		p.SetState(configuration.STATUS_ERRORED, err)
+		return err
+	})
+	return nil
+}
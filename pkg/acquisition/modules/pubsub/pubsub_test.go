@@ -0,0 +1,449 @@
+package pubsubacquisition
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/secrets"
+	"github.com/crowdsecurity/crowdsec/pkg/cstest"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	pubsubpb "google.golang.org/genproto/googleapis/pubsub/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gopkg.in/tomb.v2"
+)
+
+func TestConfigure(t *testing.T) {
+	tests := []struct {
+		config      string
+		expectedErr string
+	}{
+		{
+			config:      `foobar: bla`,
+			expectedErr: "field foobar not found in type pubsubacquisition.PubSubConfiguration",
+		},
+		{
+			config:      `source: pubsub`,
+			expectedErr: "subscription is mandatory",
+		},
+		{
+			config: `
+source: pubsub
+subscription: projects/crowdsec/subscriptions/audit-logs`,
+			expectedErr: "",
+		},
+		{
+			config: `
+source: pubsub
+project: crowdsec
+subscription: vpc-flows
+ack_deadline: 30s
+max_outstanding_messages: 100`,
+			expectedErr: "",
+		},
+		{
+			config: `
+subscription: projects/crowdsec/subscriptions/audit-logs
+mode: cat`,
+			expectedErr: "unsupported mode cat for pubsub datasource",
+		},
+		{
+			config:      `subscription: audit-logs`,
+			expectedErr: "project is mandatory when subscription is not a full path",
+		},
+		{
+			config:      `subscription: projects/crowdsec/topics/audit-logs`,
+			expectedErr: "invalid subscription projects/crowdsec/topics/audit-logs",
+		},
+		{
+			config: `
+subscription: projects/crowdsec/subscriptions/audit-logs
+ack_deadline: 1s`,
+			expectedErr: "invalid ack_deadline 1s (must be between 10s and 10m)",
+		},
+		{
+			config: `
+subscription: projects/crowdsec/subscriptions/audit-logs
+max_outstanding_bytes: -1`,
+			expectedErr: "max_outstanding_messages and max_outstanding_bytes must be positive",
+		},
+		{
+			config: `
+subscription: audit-logs
+credentials_file: /does/not/exist.json`,
+			expectedErr: "while reading credentials_file /does/not/exist.json",
+		},
+	}
+	subLogger := log.WithFields(log.Fields{
+		"type": "pubsub",
+	})
+	for _, test := range tests {
+		p := PubSubSource{}
+		err := p.Configure([]byte(test.config), subLogger)
+		cstest.AssertErrorContains(t, err, test.expectedErr)
+	}
+}
+
+func TestServiceAccountKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pubsub-key")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	content, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"project_id":     "crowdsec",
+		"private_key_id": "key1",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"client_email":   "agent@crowdsec.iam.gserviceaccount.com",
+	})
+	require.NoError(t, err)
+	path := filepath.Join(dir, "key.json")
+	require.NoError(t, ioutil.WriteFile(path, content, 0600))
+
+	p := PubSubSource{}
+	require.NoError(t, p.Configure([]byte("subscription: audit-logs\ncredentials_file: "+path), log.WithField("type", "pubsub")))
+	assert.Equal(t, "projects/crowdsec/subscriptions/audit-logs", p.subscription)
+
+	loaded, err := secrets.LoadGCPServiceAccountKey(path)
+	require.NoError(t, err)
+	tokens := secrets.NewGCPTokenSource(nil, loaded, pubsubAudience)
+	creds := rpcCredentials{tokens: tokens}
+	md, err := creds.GetRequestMetadata(context.Background())
+	require.NoError(t, err)
+	token := strings.TrimPrefix(md["authorization"], "Bearer ")
+	parts := strings.Split(token, ".")
+	require.Len(t, parts, 3)
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	require.NoError(t, err)
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	require.NoError(t, rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature))
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	require.NoError(t, err)
+	claims := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(payload, &claims))
+	assert.Equal(t, "https://pubsub.googleapis.com/", claims["aud"])
+	assert.Equal(t, "agent@crowdsec.iam.gserviceaccount.com", claims["iss"])
+	//the token is kept until it is about to expire
+	again, err := tokens.Token()
+	require.NoError(t, err)
+	assert.Equal(t, token, again)
+}
+
+func TestUnwrapLogEntry(t *testing.T) {
+	tests := []struct {
+		data     string
+		expected string
+		meta     map[string]string
+	}{
+		{
+			data:     `not json`,
+			expected: "",
+		},
+		{
+			data:     `{"message": "not a log entry"}`,
+			expected: "",
+		},
+		{
+			data: `{"logName": "projects/crowdsec/logs/syslog", "resource": {"type": "gce_instance", "labels": {"instance_id": "42"}},
+"textPayload": "sshd[42]: Failed password for root", "severity": "INFO", "timestamp": "2022-06-01T10:00:00Z"}`,
+			expected: "sshd[42]: Failed password for root",
+			meta: map[string]string{
+				"gcp_log_name":             "projects/crowdsec/logs/syslog",
+				"gcp_resource_type":        "gce_instance",
+				"gcp_resource_instance_id": "42",
+				"gcp_severity":             "INFO",
+				"gcp_timestamp":            "2022-06-01T10:00:00Z",
+			},
+		},
+		{
+			data: `{"logName": "projects/crowdsec/logs/compute.googleapis.com%2Fvpc_flows", "resource": {"type": "gce_subnetwork"},
+"jsonPayload": {"connection": {"src_ip": "10.0.0.1", "dest_port": 22}}, "insertId": "abc", "labels": {"env": "prod"}}`,
+			expected: `{"connection":{"src_ip":"10.0.0.1","dest_port":22}}`,
+			meta: map[string]string{
+				"gcp_log_name":      "projects/crowdsec/logs/compute.googleapis.com%2Fvpc_flows",
+				"gcp_resource_type": "gce_subnetwork",
+				"gcp_insert_id":     "abc",
+				"gcp_label_env":     "prod",
+			},
+		},
+		{
+			data: `{"logName": "projects/crowdsec/logs/cloudaudit.googleapis.com%2Factivity",
+"protoPayload": {"@type": "type.googleapis.com/google.cloud.audit.AuditLog", "methodName": "SetIamPolicy"}}`,
+			expected: `{"@type":"type.googleapis.com/google.cloud.audit.AuditLog","methodName":"SetIamPolicy"}`,
+			meta: map[string]string{
+				"gcp_log_name":      "projects/crowdsec/logs/cloudaudit.googleapis.com%2Factivity",
+				"gcp_resource_type": "",
+			},
+		},
+	}
+	for _, test := range tests {
+		line, meta, ok := unwrapLogEntry([]byte(test.data))
+		assert.Equal(t, test.expected != "", ok, test.data)
+		assert.Equal(t, test.expected, line)
+		assert.Equal(t, test.meta, meta)
+	}
+}
+
+func TestOutstanding(t *testing.T) {
+	now := time.Now()
+	o := outstanding{received: map[string]time.Time{}, deadlines: map[string]time.Time{}}
+	o.add("fresh", now, time.Minute)
+	o.add("due", now.Add(-55*time.Second), time.Minute)
+	o.add("old", now.Add(-2*time.Hour), time.Minute)
+	o.add("acked", now.Add(-55*time.Second), time.Minute)
+	o.remove("acked")
+	assert.Equal(t, []string{"due"}, o.due(now, time.Minute, time.Hour))
+	//the deadline was extended, and the message received too long ago was dropped
+	assert.Empty(t, o.due(now, time.Minute, time.Hour))
+	all := o.all()
+	sort.Strings(all)
+	assert.Equal(t, []string{"due", "fresh"}, all)
+}
+
+type testMessage struct {
+	ackID       string
+	data        string
+	orderingKey string
+	attributes  map[string]string
+}
+
+func pullResponse(ordering bool, msgs ...testMessage) *pubsubpb.StreamingPullResponse {
+	resp := &pubsubpb.StreamingPullResponse{}
+	for _, msg := range msgs {
+		resp.ReceivedMessages = append(resp.ReceivedMessages, &pubsubpb.ReceivedMessage{
+			AckId: msg.ackID,
+			Message: &pubsubpb.PubsubMessage{
+				Data:        []byte(msg.data),
+				Attributes:  msg.attributes,
+				MessageId:   "id-" + msg.ackID,
+				PublishTime: timestamppb.New(time.Unix(1654077600, 0)),
+				OrderingKey: msg.orderingKey,
+			},
+		})
+	}
+	if ordering {
+		resp.SubscriptionProperties = &pubsubpb.StreamingPullResponse_SubscriptionProperties{MessageOrderingEnabled: true}
+	}
+	return resp
+}
+
+// fakeStream is a streaming pull, which delivers the responses and records the requests
+type fakeStream struct {
+	ctx       context.Context
+	responses chan *pubsubpb.StreamingPullResponse
+	err       error //returned once the responses are closed
+	lock      sync.Mutex
+	requests  []*pubsubpb.StreamingPullRequest
+	closed    bool
+}
+
+func (s *fakeStream) Send(req *pubsubpb.StreamingPullRequest) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.requests = append(s.requests, proto.Clone(req).(*pubsubpb.StreamingPullRequest))
+	return nil
+}
+
+func (s *fakeStream) Recv() (*pubsubpb.StreamingPullResponse, error) {
+	select {
+	case resp, ok := <-s.responses:
+		if !ok {
+			return nil, s.err
+		}
+		return resp, nil
+	case <-s.ctx.Done():
+		return nil, fmt.Errorf("context canceled")
+	}
+}
+
+func (s *fakeStream) CloseSend() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *fakeStream) history() []*pubsubpb.StreamingPullRequest {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]*pubsubpb.StreamingPullRequest{}, s.requests...)
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+func TestStreamingAcquisition(t *testing.T) {
+	p := PubSubSource{}
+	require.NoError(t, p.Configure([]byte(`
+source: pubsub
+subscription: projects/crowdsec/subscriptions/audit-logs
+ack_deadline: 20s`), log.WithField("type", "pubsub")))
+	stream := &fakeStream{responses: make(chan *pubsubpb.StreamingPullResponse, 10)}
+	p.open = func(ctx context.Context) (pullStream, io.Closer, error) {
+		stream.ctx = ctx
+		return stream, nopCloser{}, nil
+	}
+	stream.responses <- pullResponse(true,
+		testMessage{ackID: "ack1", orderingKey: "vm1", data: `{"logName": "projects/crowdsec/logs/syslog", "textPayload": "line 1"}`},
+		testMessage{ackID: "ack2", orderingKey: "vm1", data: "line 2", attributes: map[string]string{"origin": "agent"}},
+	)
+	out := make(chan types.Event)
+	tmb := tomb.Tomb{}
+	require.NoError(t, p.StreamingAcquisition(out, &tmb))
+	evt := <-out
+	assert.Equal(t, "line 1", evt.Line.Raw)
+	assert.Equal(t, "audit-logs", evt.Line.Src)
+	assert.Equal(t, "projects/crowdsec/logs/syslog", evt.Meta["gcp_log_name"])
+	assert.Equal(t, "vm1", evt.Meta["pubsub_ordering_key"])
+	assert.Equal(t, "id-ack1", evt.Meta["pubsub_message_id"])
+	assert.Equal(t, "2022-06-01T10:00:00Z", evt.Meta["pubsub_publish_time"])
+	evt = <-out
+	assert.Equal(t, "line 2", evt.Line.Raw)
+	assert.Equal(t, "agent", evt.Meta["pubsub_attribute_origin"])
+
+	//the messages handed to crowdsec are acked, the one waiting when the datasource stops is nacked
+	stream.responses <- pullResponse(false, testMessage{ackID: "ack3", data: "line 3"})
+	for len(stream.responses) > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(3 * ackInterval)
+	tmb.Kill(nil)
+	require.NoError(t, tmb.Wait())
+
+	requests := stream.history()
+	require.True(t, len(requests) >= 3)
+	assert.Equal(t, "projects/crowdsec/subscriptions/audit-logs", requests[0].Subscription)
+	assert.Equal(t, int32(20), requests[0].StreamAckDeadlineSeconds)
+	assert.Equal(t, int64(1000), requests[0].MaxOutstandingMessages)
+	assert.True(t, strings.HasPrefix(requests[0].ClientId, "crowdsec-"))
+	acked := []string{}
+	for _, r := range requests[1 : len(requests)-1] {
+		acked = append(acked, r.AckIds...)
+	}
+	assert.Equal(t, []string{"ack1", "ack2"}, acked)
+	last := requests[len(requests)-1]
+	assert.Empty(t, last.AckIds)
+	assert.Equal(t, []string{"ack3"}, last.ModifyDeadlineAckIds)
+	assert.Equal(t, []int32{0}, last.ModifyDeadlineSeconds)
+	stream.lock.Lock()
+	assert.True(t, stream.closed)
+	stream.lock.Unlock()
+}
+
+func TestRefused(t *testing.T) {
+	p := PubSubSource{}
+	require.NoError(t, p.Configure([]byte(`subscription: projects/crowdsec/subscriptions/unknown`), log.WithField("type", "pubsub")))
+	stream := &fakeStream{responses: make(chan *pubsubpb.StreamingPullResponse), err: status.Error(codes.NotFound, "Resource not found (resource=unknown).")}
+	close(stream.responses)
+	p.open = func(ctx context.Context) (pullStream, io.Closer, error) {
+		stream.ctx = ctx
+		return stream, nopCloser{}, nil
+	}
+	tmb := tomb.Tomb{}
+	require.NoError(t, p.StreamingAcquisition(make(chan types.Event), &tmb))
+	//a missing subscription is not retried
+	select {
+	case <-tmb.Dead():
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for the datasource to stop")
+	}
+	cstest.AssertErrorContains(t, tmb.Err(), "while reading subscription projects/crowdsec/subscriptions/unknown: rpc error: code = NotFound desc = Resource not found")
+}
+
+// fakeSubscriber is a Subscriber service, which delivers a message on the streaming pulls and records the acks
+type fakeSubscriber struct {
+	pubsubpb.UnimplementedSubscriberServer
+	acks chan string
+}
+
+func (s *fakeSubscriber) StreamingPull(stream pubsubpb.Subscriber_StreamingPullServer) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	if req.Subscription != "projects/crowdsec/subscriptions/audit-logs" {
+		return status.Errorf(codes.NotFound, "Resource not found (resource=%s).", req.Subscription)
+	}
+	if err := stream.Send(pullResponse(false, testMessage{ackID: "ack1", data: "line 1"})); err != nil {
+		return err
+	}
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			return nil
+		}
+		for _, ackID := range req.AckIds {
+			s.acks <- ackID
+		}
+	}
+}
+
+func TestEmulator(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := grpc.NewServer()
+	subscriber := &fakeSubscriber{acks: make(chan string, 10)}
+	pubsubpb.RegisterSubscriberServer(server, subscriber)
+	go server.Serve(listener)
+	defer server.Stop()
+	t.Setenv("PUBSUB_EMULATOR_HOST", listener.Addr().String())
+
+	p := PubSubSource{}
+	require.NoError(t, p.Configure([]byte(`subscription: projects/crowdsec/subscriptions/audit-logs`), log.WithField("type", "pubsub")))
+	out := make(chan types.Event)
+	tmb := tomb.Tomb{}
+	require.NoError(t, p.StreamingAcquisition(out, &tmb))
+	evt := <-out
+	assert.Equal(t, "line 1", evt.Line.Raw)
+	assert.Equal(t, "id-ack1", evt.Meta["pubsub_message_id"])
+	select {
+	case ackID := <-subscriber.acks:
+		assert.Equal(t, "ack1", ackID)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for the message to be acked")
+	}
+	tmb.Kill(nil)
+	require.NoError(t, tmb.Wait())
+
+	//a missing subscription is not retried
+	p = PubSubSource{}
+	require.NoError(t, p.Configure([]byte(`subscription: projects/crowdsec/subscriptions/unknown`), log.WithField("type", "pubsub")))
+	tmb = tomb.Tomb{}
+	require.NoError(t, p.StreamingAcquisition(make(chan types.Event), &tmb))
+	select {
+	case <-tmb.Dead():
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for the datasource to stop")
+	}
+	cstest.AssertErrorContains(t, tmb.Err(), "rpc error: code = NotFound desc = Resource not found (resource=projects/crowdsec/subscriptions/unknown)")
+}
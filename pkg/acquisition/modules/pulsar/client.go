@@ -0,0 +1,84 @@
+package pulsaracquisition
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/retry"
+	"github.com/pkg/errors"
+)
+
+// client is the part of a pulsar-client-go client used by the datasource
+type client interface {
+	// Subscribe creates the consumer of tail mode, on all the partitions of a topic
+	Subscribe(options pulsar.ConsumerOptions) (pulsar.Consumer, error)
+	// CreateReader creates the reader of cat mode, on a partition
+	CreateReader(options pulsar.ReaderOptions) (pulsar.Reader, error)
+	// TopicPartitions returns the partitions of a topic, or the topic itself if it is not partitioned
+	TopicPartitions(topic string) ([]string, error)
+	Close()
+}
+
+// brokerError is a refusal of the broker, eg. "server error: ConsumerBusy: Exclusive consumer is already connected".
+// Its code can be matched in retry_on
+type brokerError struct {
+	code string
+	msg  string
+}
+
+func (e *brokerError) Error() string {
+	return e.msg
+}
+
+func (e *brokerError) Code() string {
+	return e.code
+}
+
+// permanentCodes are the refusals of the broker that come from the configuration of the datasource
+var permanentCodes = map[string]bool{
+	"AuthenticationError": true,
+	"AuthorizationError":  true,
+	"NotAllowedError":     true,
+	"TopicNotFound":       true,
+	"InvalidTopicName":    true,
+}
+
+// lookupError is a failed lookup of a topic, that pulsar-client-go returns as the name of the error
+var lookupError = regexp.MustCompile(`^[A-Z][A-Za-z]+$`)
+
+// wrapError turns the refusals of the broker into brokerError, permanent if they come from the configuration.
+// pulsar-client-go returns them as "server error: <code>: <message>", or as the code alone for the lookups
+func wrapError(err error) error {
+	var clientErr *pulsar.Error
+	if errors.As(err, &clientErr) {
+		switch clientErr.Result() {
+		case pulsar.InvalidConfiguration, pulsar.InvalidTopicName, pulsar.InvalidURL, pulsar.AuthenticationError:
+			return retry.Permanent(err)
+		}
+		return err
+	}
+	ret := &brokerError{msg: err.Error()}
+	switch {
+	case strings.HasPrefix(ret.msg, "server error: "):
+		ret.code = strings.SplitN(strings.TrimPrefix(ret.msg, "server error: "), ":", 2)[0]
+	case lookupError.MatchString(ret.msg):
+		ret.code = ret.msg
+	default:
+		return err
+	}
+	if permanentCodes[ret.code] {
+		return retry.Permanent(ret)
+	}
+	return ret
+}
+
+// dialClient creates a client of the brokers. It only connects when a consumer or a reader is created, so its errors
+// come from the configuration
+func (p *PulsarSource) dialClient() (client, error) {
+	c, err := pulsar.NewClient(p.options)
+	if err != nil {
+		return nil, retry.Permanent(err)
+	}
+	return c, nil
+}
@@ -0,0 +1,500 @@
+package pulsaracquisition
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	pulsarlog "github.com/apache/pulsar-client-go/pulsar/log"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/retry"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/secrets"
+	leaky "github.com/crowdsecurity/crowdsec/pkg/leakybucket"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/tomb.v2"
+	"gopkg.in/yaml.v2"
+)
+
+var linesRead = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cs_pulsarsource_hits_total",
+		Help: "Total messages that were read from Pulsar topics.",
+	},
+	[]string{"topic"})
+
+var defaultTimeout = 10 * time.Second
+
+const (
+	defaultURL               = "pulsar://127.0.0.1:6650"
+	defaultSubscription      = "crowdsec"
+	defaultReceiverQueueSize = 1000
+)
+
+var subscriptionTypes = map[string]pulsar.SubscriptionType{
+	"exclusive":  pulsar.Exclusive,
+	"shared":     pulsar.Shared,
+	"failover":   pulsar.Failover,
+	"key_shared": pulsar.KeyShared,
+}
+
+type PulsarTLSConfiguration struct {
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"` //client certificate, for the TLS authentication of pulsar
+	KeyFile            string `yaml:"key_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+type PulsarConfiguration struct {
+	configuration.DataSourceCommonCfg `yaml:",inline"`
+	URL                               string                  `yaml:"url"`                 //service url of the brokers, eg. pulsar://localhost:6650, pulsar+ssl://, or http(s):// for the lookups over http
+	Topics                            []string                `yaml:"topics"`              //eg. persistent://public/default/logs, or logs in the public tenant and default namespace
+	Subscription                      string                  `yaml:"subscription"`        //tail mode, crowdsec by default
+	SubscriptionType                  string                  `yaml:"subscription_type"`   //exclusive (default), shared, failover or key_shared
+	ReceiverQueueSize                 int                     `yaml:"receiver_queue_size"` //messages prefetched by the broker for each partition
+	Since                             string                  `yaml:"since"`               //cat mode : RFC3339 date, or duration before now (eg. 1h), the whole topics by default
+	Timeout                           *time.Duration          `yaml:"timeout"`             //to connect and for the requests, and in cat mode how long to wait for more messages
+	Token                             string                  `yaml:"token"`               //JWT of the token authentication, can be a env://, file:// or vault:// reference
+	TLS                               *PulsarTLSConfiguration `yaml:"tls"`
+}
+
+// PulsarSource consumes topics with pulsar-client-go.
+// In tail mode, the messages are acked once they were handed to crowdsec, so the subscription resumes after them.
+// In cat mode, each partition is read from since up to its last message by a reader, which does not create a
+// subscription
+type PulsarSource struct {
+	configuration.HealthTracker
+	config    PulsarConfiguration
+	logger    *log.Entry
+	options   pulsar.ClientOptions
+	newClient func() (client, error)
+	retrier   *retry.Retrier
+	topics    []topicName
+	since     time.Time
+}
+
+// topicName is a fully qualified topic : persistent://tenant/namespace/topic
+type topicName struct {
+	Domain    string
+	Tenant    string
+	Namespace string
+	Topic     string
+}
+
+func parseTopic(name string) (topicName, error) {
+	ret := topicName{Domain: "persistent"}
+	if idx := strings.Index(name, "://"); idx >= 0 {
+		ret.Domain, name = name[:idx], name[idx+3:]
+		if ret.Domain != "persistent" && ret.Domain != "non-persistent" {
+			return ret, fmt.Errorf("invalid topic domain %s", ret.Domain)
+		}
+	}
+	parts := strings.Split(name, "/")
+	switch len(parts) {
+	case 1:
+		ret.Tenant, ret.Namespace, ret.Topic = "public", "default", parts[0]
+	case 3:
+		ret.Tenant, ret.Namespace, ret.Topic = parts[0], parts[1], parts[2]
+	default:
+		return ret, fmt.Errorf("invalid topic %s : must be <topic> or [persistent://]<tenant>/<namespace>/<topic>", name)
+	}
+	for _, part := range []string{ret.Tenant, ret.Namespace, ret.Topic} {
+		if part == "" {
+			return ret, fmt.Errorf("invalid topic %s", name)
+		}
+	}
+	return ret, nil
+}
+
+func (t topicName) String() string {
+	return t.Domain + "://" + t.Tenant + "/" + t.Namespace + "/" + t.Topic
+}
+
+func (p *PulsarSource) GetMetrics() []prometheus.Collector {
+	return []prometheus.Collector{linesRead}
+}
+
+func (p *PulsarSource) GetAggregMetrics() []prometheus.Collector {
+	return []prometheus.Collector{linesRead}
+}
+
+func (p *PulsarSource) Configure(yamlConfig []byte, logger *log.Entry) error {
+	p.logger = logger
+	config := PulsarConfiguration{}
+	if err := yaml.UnmarshalStrict(yamlConfig, &config); err != nil {
+		return errors.Wrap(err, "Cannot parse pulsar datasource configuration")
+	}
+	if config.Mode == "" {
+		config.Mode = configuration.TAIL_MODE
+	}
+	return p.configure(config)
+}
+
+// configure checks the configuration and sets the defaults, for Configure and ConfigureByDSN
+func (p *PulsarSource) configure(config PulsarConfiguration) error {
+	if config.Mode != configuration.CAT_MODE && config.Mode != configuration.TAIL_MODE {
+		return fmt.Errorf("unsupported mode %s for pulsar datasource", config.Mode)
+	}
+	if config.URL == "" {
+		config.URL = defaultURL
+	}
+	serviceURL, err := url.Parse(config.URL)
+	if err != nil {
+		return errors.Wrapf(err, "invalid url %s", config.URL)
+	}
+	switch serviceURL.Scheme {
+	case "pulsar", "pulsar+ssl", "http", "https":
+	default:
+		return fmt.Errorf("invalid url %s : scheme must be pulsar, pulsar+ssl, http or https", config.URL)
+	}
+	if len(config.Topics) == 0 {
+		return fmt.Errorf("topics is mandatory")
+	}
+	p.topics = []topicName{}
+	for _, name := range config.Topics {
+		topic, err := parseTopic(name)
+		if err != nil {
+			return err
+		}
+		p.topics = append(p.topics, topic)
+	}
+	if config.Subscription == "" {
+		config.Subscription = defaultSubscription
+	}
+	if config.SubscriptionType == "" {
+		config.SubscriptionType = "exclusive"
+	}
+	if _, ok := subscriptionTypes[config.SubscriptionType]; !ok {
+		return fmt.Errorf("invalid subscription_type %s (must be exclusive, shared, failover or key_shared)", config.SubscriptionType)
+	}
+	if config.ReceiverQueueSize == 0 {
+		config.ReceiverQueueSize = defaultReceiverQueueSize
+	}
+	if config.ReceiverQueueSize < 0 {
+		return fmt.Errorf("invalid receiver_queue_size %d", config.ReceiverQueueSize)
+	}
+	if p.since, err = configuration.ParseTime(config.Since); err != nil {
+		return errors.Wrap(err, "invalid since")
+	}
+	if !p.since.IsZero() && config.Mode == configuration.TAIL_MODE {
+		return fmt.Errorf("since is only supported in %s mode", configuration.CAT_MODE)
+	}
+	if config.Timeout == nil {
+		config.Timeout = &defaultTimeout
+	}
+	p.options = pulsar.ClientOptions{
+		URL:               config.URL,
+		ConnectionTimeout: *config.Timeout,
+		OperationTimeout:  *config.Timeout,
+		Logger:            pulsarlog.NewLoggerWithLogrus(p.logger.Logger),
+	}
+	if config.Token != "" {
+		token, err := secrets.NewSecret(config.Token, p.logger)
+		if err != nil {
+			return errors.Wrap(err, "invalid token")
+		}
+		//the token is asked at each connection to a broker
+		p.options.Authentication = pulsar.NewAuthenticationTokenFromSupplier(func() (string, error) {
+			return token.Get(), nil
+		})
+	}
+	if config.TLS != nil {
+		if err := p.configureTLS(config.TLS, config.Token != ""); err != nil {
+			return err
+		}
+	}
+	p.newClient = p.dialClient
+	p.retrier, err = retry.New(config.Retry, p.logger)
+	if err != nil {
+		return err
+	}
+	p.retrier.Notify = p.notifyRetry
+	p.config = config
+	return nil
+}
+
+// configureTLS sets the TLS options of the client. pulsar-client-go only sends a client certificate for the TLS
+// authentication, which can't be used along the token one
+func (p *PulsarSource) configureTLS(config *PulsarTLSConfiguration, hasToken bool) error {
+	p.options.TLSAllowInsecureConnection = config.InsecureSkipVerify
+	p.options.TLSValidateHostname = !config.InsecureSkipVerify
+	if config.CAFile != "" {
+		//pulsar-client-go reads the file when it connects, it is checked here to report the errors at startup
+		pem, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return errors.Wrapf(err, "while reading tls.ca_file %s", config.CAFile)
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in tls.ca_file %s", config.CAFile)
+		}
+		p.options.TLSTrustCertsFilePath = config.CAFile
+	}
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		return fmt.Errorf("tls.cert_file and tls.key_file must be set together")
+	}
+	if config.CertFile != "" {
+		if hasToken {
+			return fmt.Errorf("tls.cert_file and token can't be used together")
+		}
+		p.options.Authentication = pulsar.NewAuthenticationTLS(config.CertFile, config.KeyFile)
+	}
+	return nil
+}
+
+// notifyRetry reports the failing connections in the health of the datasource
+func (p *PulsarSource) notifyRetry(err error) {
+	if err != nil {
+		p.SetState(configuration.STATUS_RECONNECTING, err)
+	} else {
+		p.SetState(configuration.STATUS_RUNNING, nil)
+	}
+}
+
+func (p *PulsarSource) ConfigureByDSN(dsn string, labels map[string]string, logger *log.Entry) error {
+	p.logger = logger
+	//format for the DSN is : pulsar://host:port?topic=...&since=... or pulsar+ssl://host:port?...
+	parsed, err := configuration.ParseDSN(dsn, "pulsar", "pulsar+ssl")
+	if err != nil {
+		return err
+	}
+	if parsed.Target == "" {
+		return fmt.Errorf("empty pulsar:// DSN")
+	}
+	if err := parsed.CheckParams("topic", "since", "token", "insecure_skip_verify"); err != nil {
+		return err
+	}
+	if err := parsed.SetLogLevel(p.logger); err != nil {
+		return err
+	}
+	config := PulsarConfiguration{}
+	config.Mode = configuration.CAT_MODE
+	config.Labels = labels
+	config.URL = parsed.Scheme + "://" + parsed.Target
+	config.Topics = parsed.Params["topic"]
+	for key, value := range map[string]*string{
+		"since": &config.Since,
+		"token": &config.Token,
+	} {
+		if *value, err = parsed.Param(key); err != nil {
+			return err
+		}
+	}
+	if insecure, err := parsed.Param("insecure_skip_verify"); err != nil {
+		return err
+	} else if insecure != "" {
+		config.TLS = &PulsarTLSConfiguration{}
+		if config.TLS.InsecureSkipVerify, err = strconv.ParseBool(insecure); err != nil {
+			return fmt.Errorf("parsing 'insecure_skip_verify' parameters: %s", err)
+		}
+	}
+	return p.configure(config)
+}
+
+func (p *PulsarSource) GetMode() string {
+	return p.config.Mode
+}
+
+func (p *PulsarSource) GetName() string {
+	return "pulsar"
+}
+
+func (p *PulsarSource) GetUuid() string {
+	return p.config.UniqueId
+}
+
+func (p *PulsarSource) CanRun() error {
+	return nil
+}
+
+func (p *PulsarSource) Dump() interface{} {
+	return p
+}
+
+// contextUntil returns a context that is cancelled when dying is closed
+func contextUntil(dying <-chan struct{}) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-dying:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// send hands a message to crowdsec, it returns false if dying was closed meanwhile
+func (p *PulsarSource) send(topic topicName, msg pulsar.Message, out chan types.Event, dying <-chan struct{}, expectMode int) bool {
+	l := types.Line{}
+	l.Raw = string(msg.Payload())
+	l.Src = topic.String()
+	l.Time = time.Now().UTC()
+	l.Labels = p.config.Labels
+	l.Process = true
+	l.Module = p.GetName()
+	linesRead.With(prometheus.Labels{"topic": topic.String()}).Inc()
+	p.EventSeen(&l)
+	select {
+	case out <- types.Event{Line: l, Process: true, Type: types.LOG, ExpectMode: expectMode}:
+		return true
+	case <-dying:
+		return false
+	}
+}
+
+// consume reads the messages of the subscription and acks them once they were sent, until dying is closed or the
+// consumer fails. pulsar-client-go reconnects the consumer by itself once it was created
+func (p *PulsarSource) consume(topic topicName, out chan types.Event, dying <-chan struct{}, expectMode int) error {
+	c, err := p.newClient()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	consumer, err := c.Subscribe(pulsar.ConsumerOptions{
+		Topic:             topic.String(),
+		SubscriptionName:  p.config.Subscription,
+		Type:              subscriptionTypes[p.config.SubscriptionType],
+		ReceiverQueueSize: p.config.ReceiverQueueSize,
+	})
+	if err != nil {
+		return errors.Wrapf(wrapError(err), "while subscribing to %s", topic)
+	}
+	defer consumer.Close()
+	ctx, cancel := contextUntil(dying)
+	defer cancel()
+	p.SetState(configuration.STATUS_RUNNING, nil)
+	for {
+		msg, err := consumer.Receive(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(wrapError(err), "while reading %s", topic)
+		}
+		if !p.send(topic, msg, out, dying, expectMode) {
+			//not acked, the message will be delivered again
+			return nil
+		}
+		consumer.Ack(msg)
+	}
+}
+
+// read reads a partition from since up to its last message. It also returns when no message came for the timeout,
+// as the broker tells the last message of the partition even if it is before since
+func (p *PulsarSource) read(c client, topic topicName, partition string, out chan types.Event, dying <-chan struct{}) error {
+	reader, err := c.CreateReader(pulsar.ReaderOptions{
+		Topic:             partition,
+		StartMessageID:    pulsar.EarliestMessageID(),
+		ReceiverQueueSize: p.config.ReceiverQueueSize,
+	})
+	if err != nil {
+		return errors.Wrapf(wrapError(err), "while creating reader on %s", partition)
+	}
+	defer reader.Close()
+	if !p.since.IsZero() {
+		if err := reader.SeekByTime(p.since); err != nil {
+			return errors.Wrapf(wrapError(err), "while seeking %s", partition)
+		}
+	}
+	ctx, cancel := contextUntil(dying)
+	defer cancel()
+	p.SetState(configuration.STATUS_RUNNING, nil)
+	//HasNext asks the broker for the last message, and retries until it answers
+	for reader.HasNext() {
+		msgCtx, msgCancel := context.WithTimeout(ctx, *p.config.Timeout)
+		msg, err := reader.Next(msgCtx)
+		msgCancel()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err == context.DeadlineExceeded {
+			p.logger.Debugf("no message from %s for %s, done", partition, *p.config.Timeout)
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(wrapError(err), "while reading %s", partition)
+		}
+		if msg.PublishTime().Before(p.since) {
+			//prefetched before the seek
+			continue
+		}
+		if !p.send(topic, msg, out, dying, leaky.TIMEMACHINE) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// replay reads the partitions of a topic one after the other
+func (p *PulsarSource) replay(topic topicName, out chan types.Event, dying <-chan struct{}) error {
+	c, err := p.newClient()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	partitions, err := c.TopicPartitions(topic.String())
+	if err != nil {
+		return errors.Wrapf(wrapError(err), "while getting the partitions of %s", topic)
+	}
+	for _, partition := range partitions {
+		if err := p.read(c, topic, partition, out, dying); err != nil {
+			return err
+		}
+		select {
+		case <-dying:
+			return nil
+		default:
+		}
+	}
+	return nil
+}
+
+func (p *PulsarSource) OneShotAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	for _, topic := range p.topics {
+		p.logger.Infof("reading topic %s on %s", topic, p.config.URL)
+		err := p.retrier.Do(t.Dying(), func() error {
+			return p.replay(topic, out, t.Dying())
+		})
+		if err == retry.ErrDying {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(err, "while reading %s", topic)
+		}
+	}
+	t.Kill(nil)
+	return nil
+}
+
+func (p *PulsarSource) StreamingAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	expectMode := leaky.LIVE
+	if p.config.UseTimeMachine {
+		expectMode = leaky.TIMEMACHINE
+	}
+	for _, topic := range p.topics {
+		topic := topic
+		t.Go(func() error {
+			defer types.CatchPanic("crowdsec/acquis/pulsar/live")
+			p.logger.Infof("consuming topic %s on %s with subscription %s", topic, p.config.URL, p.config.Subscription)
+			err := p.retrier.Do(t.Dying(), func() error {
+				return p.consume(topic, out, t.Dying(), expectMode)
+			})
+			if err == retry.ErrDying || err == nil {
+				p.logger.Infof("pulsar datasource stopping for %s", topic)
+				return nil
+			}
+			err = errors.Wrapf(err, "while consuming %s", topic)
+			p.SetState(configuration.STATUS_ERRORED, err)
+			return err
+		})
+	}
+	return nil
+}
@@ -0,0 +1,424 @@
+package pulsaracquisition
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/crowdsecurity/crowdsec/pkg/cstest"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/tomb.v2"
+)
+
+func TestConfigure(t *testing.T) {
+	tests := []struct {
+		config      string
+		expectedErr string
+	}{
+		{
+			config:      `foobar: bla`,
+			expectedErr: "field foobar not found in type pulsaracquisition.PulsarConfiguration",
+		},
+		{
+			config:      `source: pulsar`,
+			expectedErr: "topics is mandatory",
+		},
+		{
+			config: `
+source: pulsar
+topics: [logs, persistent://acme/web/access, non-persistent://acme/web/debug]`,
+			expectedErr: "",
+		},
+		{
+			config: `
+topics: [acme/logs]`,
+			expectedErr: "invalid topic acme/logs",
+		},
+		{
+			config: `
+topics: [logs]
+url: ws://localhost:8080`,
+			expectedErr: "scheme must be pulsar, pulsar+ssl, http or https",
+		},
+		{
+			config: `
+topics: [logs]
+subscription_type: broadcast`,
+			expectedErr: "invalid subscription_type broadcast",
+		},
+		{
+			config: `
+topics: [logs]
+since: 1h`,
+			expectedErr: "since is only supported in cat mode",
+		},
+		{
+			config: `
+topics: [logs]
+token: env://CROWDSEC_TEST_UNSET_TOKEN`,
+			expectedErr: "invalid token",
+		},
+		{
+			config: `
+topics: [logs]
+token: secret
+tls:
+  cert_file: client.pem
+  key_file: client.key`,
+			expectedErr: "tls.cert_file and token can't be used together",
+		},
+	}
+	subLogger := log.WithFields(log.Fields{
+		"type": "pulsar",
+	})
+	for _, test := range tests {
+		p := PulsarSource{}
+		err := p.Configure([]byte(test.config), subLogger)
+		cstest.AssertErrorContains(t, err, test.expectedErr)
+	}
+}
+
+func TestClientOptions(t *testing.T) {
+	p := PulsarSource{}
+	require.NoError(t, p.Configure([]byte(`
+topics: [logs]
+timeout: 3s
+token: secret`), log.WithField("type", "pulsar")))
+	assert.Equal(t, "pulsar://127.0.0.1:6650", p.options.URL)
+	assert.Equal(t, 3*time.Second, p.options.ConnectionTimeout)
+	assert.Equal(t, 3*time.Second, p.options.OperationTimeout)
+	require.NotNil(t, p.options.Authentication)
+
+	p = PulsarSource{}
+	require.NoError(t, p.ConfigureByDSN("pulsar+ssl://broker:6651?topic=logs&insecure_skip_verify=true", nil, log.WithField("type", "pulsar")))
+	assert.Equal(t, "pulsar+ssl://broker:6651", p.options.URL)
+	assert.True(t, p.options.TLSAllowInsecureConnection)
+	assert.False(t, p.options.TLSValidateHostname)
+	assert.Nil(t, p.options.Authentication)
+}
+
+// fakeMessage is a message of a partition of a topic
+type fakeMessage struct {
+	pulsar.Message
+	topic       string
+	payload     string
+	publishTime time.Time
+}
+
+func (m *fakeMessage) Topic() string {
+	return m.topic
+}
+
+func (m *fakeMessage) Payload() []byte {
+	return []byte(m.payload)
+}
+
+func (m *fakeMessage) PublishTime() time.Time {
+	return m.publishTime
+}
+
+// fakeConsumer delivers its messages, then waits for more like pulsar-client-go
+type fakeConsumer struct {
+	pulsar.Consumer
+	messages chan pulsar.Message
+	acks     chan string
+	closed   bool
+}
+
+func (c *fakeConsumer) Receive(ctx context.Context) (pulsar.Message, error) {
+	select {
+	case msg := <-c.messages:
+		return msg, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *fakeConsumer) Ack(msg pulsar.Message) {
+	c.acks <- string(msg.Payload())
+}
+
+func (c *fakeConsumer) Close() {
+	c.closed = true
+}
+
+// fakeReader reads a partition. Like pulsar-client-go, HasNext is true while the last message of the partition was
+// not read, even if the seek skipped it
+type fakeReader struct {
+	pulsar.Reader
+	messages []*fakeMessage
+	read     int
+	seek     time.Time
+	closed   bool
+}
+
+func (r *fakeReader) HasNext() bool {
+	return r.read < len(r.messages)
+}
+
+func (r *fakeReader) Next(ctx context.Context) (pulsar.Message, error) {
+	for r.read < len(r.messages) {
+		msg := r.messages[r.read]
+		r.read++
+		if !msg.publishTime.Before(r.seek) {
+			return msg, nil
+		}
+	}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (r *fakeReader) SeekByTime(t time.Time) error {
+	r.seek = t
+	return nil
+}
+
+func (r *fakeReader) Close() {
+	r.closed = true
+}
+
+// fakeClient serves the consumer and the readers of the partitions
+type fakeClient struct {
+	mu           sync.Mutex
+	consumer     *fakeConsumer
+	subscribeErr error
+	readers      map[string]*fakeReader
+	subscribed   []pulsar.ConsumerOptions
+	readOptions  []pulsar.ReaderOptions
+	closed       bool
+}
+
+func (c *fakeClient) Subscribe(options pulsar.ConsumerOptions) (pulsar.Consumer, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.subscribed = append(c.subscribed, options)
+	if c.subscribeErr != nil {
+		return nil, c.subscribeErr
+	}
+	return c.consumer, nil
+}
+
+func (c *fakeClient) CreateReader(options pulsar.ReaderOptions) (pulsar.Reader, error) {
+	c.readOptions = append(c.readOptions, options)
+	return c.readers[options.Topic], nil
+}
+
+func (c *fakeClient) TopicPartitions(topic string) ([]string, error) {
+	return []string{topic + "-partition-0", topic + "-partition-1"}, nil
+}
+
+func (c *fakeClient) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+}
+
+func TestOneShotAcquisition(t *testing.T) {
+	since := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	partition := "persistent://public/default/logs-partition-"
+	fake := &fakeClient{readers: map[string]*fakeReader{
+		partition + "0": {messages: []*fakeMessage{
+			{payload: "line 0", publishTime: since.Add(-time.Hour)},
+			{payload: "line 1", publishTime: since},
+			{payload: "line 2", publishTime: since.Add(time.Minute)},
+		}},
+		//all its messages are before since
+		partition + "1": {messages: []*fakeMessage{
+			{payload: "line 3", publishTime: since.Add(-time.Minute)},
+		}},
+	}}
+	p := PulsarSource{}
+	require.NoError(t, p.Configure([]byte(`
+mode: cat
+topics: [logs]
+since: 2022-06-01T00:00:00Z
+timeout: 100ms
+labels:
+  type: app`), log.WithField("type", "pulsar")))
+	p.newClient = func() (client, error) {
+		return fake, nil
+	}
+	out := make(chan types.Event, 10)
+	tmb := tomb.Tomb{}
+	require.NoError(t, p.OneShotAcquisition(out, &tmb))
+	require.Len(t, out, 2)
+	for _, expected := range []string{"line 1", "line 2"} {
+		evt := <-out
+		assert.Equal(t, expected, evt.Line.Raw)
+		assert.Equal(t, "persistent://public/default/logs", evt.Line.Src)
+		assert.Equal(t, "app", evt.Line.Labels["type"])
+	}
+	require.Len(t, fake.readOptions, 2)
+	for i, options := range fake.readOptions {
+		assert.Equal(t, fmt.Sprintf("%s%d", partition, i), options.Topic)
+		assert.Equal(t, pulsar.EarliestMessageID(), options.StartMessageID)
+		assert.Equal(t, 1000, options.ReceiverQueueSize)
+	}
+	for _, reader := range fake.readers {
+		assert.Equal(t, since, reader.seek)
+		assert.True(t, reader.closed)
+	}
+	assert.True(t, fake.closed)
+	assert.Empty(t, fake.subscribed)
+}
+
+func TestStreamingAcquisition(t *testing.T) {
+	consumer := &fakeConsumer{messages: make(chan pulsar.Message, 3), acks: make(chan string, 3)}
+	for _, line := range []string{"line 1", "line 2", "line 3"} {
+		consumer.messages <- &fakeMessage{topic: "persistent://acme/web/access-partition-0", payload: line}
+	}
+	fake := &fakeClient{consumer: consumer}
+	p := PulsarSource{}
+	require.NoError(t, p.Configure([]byte(`
+source: pulsar
+topics: [acme/web/access]
+subscription_type: shared`), log.WithField("type", "pulsar")))
+	p.newClient = func() (client, error) {
+		return fake, nil
+	}
+	out := make(chan types.Event)
+	tmb := tomb.Tomb{}
+	require.NoError(t, p.StreamingAcquisition(out, &tmb))
+	for _, expected := range []string{"line 1", "line 2", "line 3"} {
+		select {
+		case evt := <-out:
+			assert.Equal(t, expected, evt.Line.Raw)
+			assert.Equal(t, "persistent://acme/web/access", evt.Line.Src)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout waiting for %s", expected)
+		}
+	}
+	//the messages are acked once they were sent
+	for _, expected := range []string{"line 1", "line 2", "line 3"} {
+		select {
+		case ack := <-consumer.acks:
+			assert.Equal(t, expected, ack)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout waiting for the ack of %s", expected)
+		}
+	}
+	tmb.Kill(nil)
+	require.NoError(t, tmb.Wait())
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	require.Len(t, fake.subscribed, 1)
+	assert.Equal(t, pulsar.ConsumerOptions{
+		Topic:             "persistent://acme/web/access",
+		SubscriptionName:  "crowdsec",
+		Type:              pulsar.Shared,
+		ReceiverQueueSize: 1000,
+	}, fake.subscribed[0])
+	assert.True(t, consumer.closed)
+	assert.True(t, fake.closed)
+}
+
+func TestNotAckedOnStop(t *testing.T) {
+	consumer := &fakeConsumer{messages: make(chan pulsar.Message, 1), acks: make(chan string, 1)}
+	consumer.messages <- &fakeMessage{topic: "persistent://public/default/logs", payload: "line 1"}
+	p := PulsarSource{}
+	require.NoError(t, p.Configure([]byte("topics: [logs]"), log.WithField("type", "pulsar")))
+	p.newClient = func() (client, error) {
+		return &fakeClient{consumer: consumer}, nil
+	}
+	tmb := tomb.Tomb{}
+	//nobody reads the events
+	require.NoError(t, p.StreamingAcquisition(make(chan types.Event), &tmb))
+	time.Sleep(50 * time.Millisecond)
+	tmb.Kill(nil)
+	require.NoError(t, tmb.Wait())
+	//the broker delivers it again
+	assert.Empty(t, consumer.acks)
+}
+
+func TestRefusedSubscription(t *testing.T) {
+	for _, test := range []struct {
+		err         error
+		expectedErr string
+		permanent   bool
+	}{
+		{
+			err:         fmt.Errorf("server error: AuthorizationError: Client is not authorized to subscribe"),
+			expectedErr: "server error: AuthorizationError: Client is not authorized to subscribe",
+			permanent:   true,
+		},
+		{
+			//a failed lookup
+			err:         fmt.Errorf("TopicNotFound"),
+			expectedErr: "TopicNotFound",
+			permanent:   true,
+		},
+		{
+			err:         fmt.Errorf("server error: ConsumerBusy: Exclusive consumer is already connected"),
+			expectedErr: "server error: ConsumerBusy",
+		},
+		{
+			err:         fmt.Errorf("connection error"),
+			expectedErr: "connection error",
+		},
+	} {
+		p := PulsarSource{}
+		require.NoError(t, p.Configure([]byte(`
+topics: [logs]
+retry:
+  base: 10ms
+  max_attempts: 2`), log.WithField("type", "pulsar")))
+		fake := &fakeClient{subscribeErr: test.err}
+		p.newClient = func() (client, error) {
+			return fake, nil
+		}
+		tmb := tomb.Tomb{}
+		require.NoError(t, p.StreamingAcquisition(make(chan types.Event), &tmb))
+		select {
+		case <-tmb.Dead():
+		case <-time.After(2 * time.Second):
+			t.Fatal("timeout waiting for the datasource to stop")
+		}
+		cstest.AssertErrorContains(t, tmb.Err(), test.expectedErr)
+		//the refusals coming from the configuration are not retried
+		if test.permanent {
+			assert.Len(t, fake.subscribed, 1, test.err)
+		} else {
+			assert.Len(t, fake.subscribed, 2, test.err)
+		}
+	}
+}
+
+func TestBrokerError(t *testing.T) {
+	err := wrapError(fmt.Errorf("server error: ConsumerBusy: Exclusive consumer is already connected"))
+	var coded interface{ Code() string }
+	require.ErrorAs(t, err, &coded)
+	//it can be matched in retry_on
+	assert.Equal(t, "ConsumerBusy", coded.Code())
+	assert.Equal(t, "server error: ConsumerBusy: Exclusive consumer is already connected", err.Error())
+}
+
+func TestDialRefused(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			//not a pulsar broker
+			conn.Close()
+		}
+	}()
+	p := PulsarSource{}
+	require.NoError(t, p.Configure([]byte("topics: [logs]\ntimeout: 1s\nurl: pulsar://"+listener.Addr().String()), log.WithField("type", "pulsar")))
+	c, err := p.newClient()
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.Subscribe(pulsar.ConsumerOptions{Topic: "logs", SubscriptionName: "crowdsec"})
+	assert.Error(t, err)
+}
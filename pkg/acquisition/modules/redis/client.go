@@ -0,0 +1,138 @@
+package redisacquisition
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/retry"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+)
+
+// redisError is an error reply, eg. "NOGROUP No such key 'logs' or consumer group 'crowdsec'". Its code can be matched
+// in retry_on
+type redisError struct {
+	msg string
+}
+
+func (e *redisError) Error() string {
+	return e.msg
+}
+
+// Code returns the first word of the error, eg. NOGROUP or WRONGPASS
+func (e *redisError) Code() string {
+	return strings.SplitN(e.msg, " ", 2)[0]
+}
+
+// permanent tells if the error comes from the configuration : wrong credentials or permissions, a key which is not
+// a stream, or a server without streams
+func (e *redisError) permanent() bool {
+	switch e.Code() {
+	case "WRONGPASS", "NOAUTH", "NOPERM", "WRONGTYPE":
+		return true
+	}
+	return strings.HasPrefix(e.msg, "ERR unknown command")
+}
+
+// wrapError turns the error replies of the server into redisError, permanent if they come from the configuration
+func wrapError(err error) error {
+	var serverErr redis.Error
+	if !errors.As(err, &serverErr) {
+		return err
+	}
+	ret := &redisError{msg: serverErr.Error()}
+	if ret.permanent() {
+		return retry.Permanent(ret)
+	}
+	return ret
+}
+
+// newClient opens a client with a single connection : the datasource sends one command at a time
+func (r *RedisSource) newClient() *redis.Client {
+	//the client sets the defaults in the options it is given
+	options := *r.options
+	if r.password != nil {
+		options.Password = r.password.Get()
+	}
+	return redis.NewClient(&options)
+}
+
+// readGroup reads the entries of the stream after id : > for the new entries, or the id of the last pending entry
+func (r *RedisSource) readGroup(ctx context.Context, client *redis.Client, id string, block bool) ([]redis.XMessage, error) {
+	args := &redis.XReadGroupArgs{
+		Group:    r.config.Group,
+		Consumer: r.config.Consumer,
+		Streams:  []string{r.config.Stream, id},
+		Count:    int64(r.config.BatchSize),
+		Block:    -1,
+	}
+	if block {
+		args.Block = *r.config.Block
+	}
+	streams, err := client.XReadGroup(ctx, args).Result()
+	if err == redis.Nil {
+		//the block timed out
+		return nil, nil
+	}
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	if len(streams) == 0 {
+		return nil, nil
+	}
+	return streams[0].Messages, nil
+}
+
+// claim takes over the entries left pending by the other consumers of the group for more than claim_min_idle. It
+// returns the id to start from at the next call. The reply is decoded here, as the XAutoClaim command of go-redis v8
+// fails on the deleted ids that Redis 7 adds to it
+func (r *RedisSource) claim(ctx context.Context, client *redis.Client, start string) ([]redis.XMessage, string, error) {
+	reply, err := client.Do(ctx, "xautoclaim", r.config.Stream, r.config.Group, r.config.Consumer,
+		r.config.ClaimMinIdle.Milliseconds(), start, "count", r.config.BatchSize).Result()
+	if err != nil {
+		return nil, start, errors.Wrap(wrapError(err), "while claiming pending entries")
+	}
+	//[next start, entries], followed by the deleted ids since Redis 7
+	parts, ok := reply.([]interface{})
+	if !ok || len(parts) < 2 {
+		return nil, start, fmt.Errorf("invalid XAUTOCLAIM reply")
+	}
+	next, _ := parts[0].(string)
+	entries, err := parseEntries(parts[1])
+	return entries, next, err
+}
+
+// parseEntries decodes the entries of a XAUTOCLAIM reply : [[id, [field, value ...]] ...]. The fields are nil if the
+// entry was deleted while it was pending
+func parseEntries(reply interface{}) ([]redis.XMessage, error) {
+	items, ok := reply.([]interface{})
+	if !ok && reply != nil {
+		return nil, fmt.Errorf("invalid entries %v", reply)
+	}
+	ret := make([]redis.XMessage, 0, len(items))
+	for _, item := range items {
+		parts, ok := item.([]interface{})
+		if !ok || len(parts) != 2 {
+			return nil, fmt.Errorf("invalid entry %v", item)
+		}
+		id, ok := parts[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid entry id %v", parts[0])
+		}
+		e := redis.XMessage{ID: id}
+		if parts[1] != nil {
+			fields, ok := parts[1].([]interface{})
+			if !ok || len(fields)%2 != 0 {
+				return nil, fmt.Errorf("invalid fields of entry %s", id)
+			}
+			e.Values = make(map[string]interface{}, len(fields)/2)
+			for i := 0; i < len(fields); i += 2 {
+				key, _ := fields[i].(string)
+				e.Values[key] = fields[i+1]
+			}
+		}
+		ret = append(ret, e)
+	}
+	return ret, nil
+}
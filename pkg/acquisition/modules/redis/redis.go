@@ -0,0 +1,442 @@
+package redisacquisition
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/cursors"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/retry"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/secrets"
+	leaky "github.com/crowdsecurity/crowdsec/pkg/leakybucket"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/tomb.v2"
+	"gopkg.in/yaml.v2"
+)
+
+var linesRead = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cs_redissource_hits_total",
+		Help: "Total entries that were read from Redis streams.",
+	},
+	[]string{"stream"})
+
+var (
+	defaultTimeout = 10 * time.Second
+	defaultBlock   = 5 * time.Second
+)
+
+const (
+	defaultURL          = "redis://127.0.0.1:6379"
+	defaultGroup        = "crowdsec"
+	defaultStartID      = "$"
+	defaultMessageField = "message"
+	defaultBatchSize    = 100
+)
+
+var streamID = regexp.MustCompile(`^[0-9]+(-[0-9]+)?$`)
+
+type RedisTLSConfiguration struct {
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"` //client certificate, when the server verifies them
+	KeyFile            string `yaml:"key_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+type RedisConfiguration struct {
+	configuration.DataSourceCommonCfg `yaml:",inline"`
+	URL                               string                 `yaml:"url"`            //eg. redis://localhost:6379/0, or rediss:// for TLS
+	Stream                            string                 `yaml:"stream"`         //key of the stream
+	Group                             string                 `yaml:"group"`          //consumer group, shared by the agents that split the stream
+	Consumer                          string                 `yaml:"consumer"`       //name of the agent in the group, the hostname by default
+	StartID                           string                 `yaml:"start_id"`       //where a new group starts : $ (new entries, default), 0 (whole stream) or an entry id
+	MessageField                      string                 `yaml:"message_field"`  //field of the entries holding the log line
+	BatchSize                         int                    `yaml:"batch_size"`     //entries read at once
+	Block                             *time.Duration         `yaml:"block"`          //how long a read waits for new entries
+	ClaimMinIdle                      *time.Duration         `yaml:"claim_min_idle"` //claim the entries left unacked by other consumers for this long (needs Redis 6.2)
+	Timeout                           *time.Duration         `yaml:"timeout"`        //to connect, and for the replies of the server
+	Username                          string                 `yaml:"username"`       //overrides the one of the url, for the ACL users
+	Password                          string                 `yaml:"password"`       //can be an env://, file:// or vault:// reference
+	TLS                               *RedisTLSConfiguration `yaml:"tls"`
+}
+
+// RedisSource reads a stream with a consumer group, so that several agents can share its entries. The entries are
+// acked once they were handed to crowdsec, and the entries left pending by a previous run are read again first. The
+// id of the last entry acked is saved as a cursor : if the group disappears (eg. the server restarted without
+// persistence), it is created again after this entry
+type RedisSource struct {
+	configuration.HealthTracker
+	config   RedisConfiguration
+	logger   *log.Entry
+	options  *redis.Options
+	password *secrets.Secret //of the configuration, resolved again on each connection
+	retrier  *retry.Retrier
+	cursorId string
+	server   string //url without the credentials, for the logs
+}
+
+func (r *RedisSource) GetMetrics() []prometheus.Collector {
+	return []prometheus.Collector{linesRead}
+}
+
+func (r *RedisSource) GetAggregMetrics() []prometheus.Collector {
+	return []prometheus.Collector{linesRead}
+}
+
+func (r *RedisSource) Configure(yamlConfig []byte, logger *log.Entry) error {
+	r.logger = logger
+	config := RedisConfiguration{}
+	config.Mode = configuration.TAIL_MODE
+	if err := yaml.UnmarshalStrict(yamlConfig, &config); err != nil {
+		return errors.Wrap(err, "Cannot parse redis datasource configuration")
+	}
+	if config.Mode != configuration.TAIL_MODE {
+		return fmt.Errorf("unsupported mode %s for redis datasource", config.Mode)
+	}
+	if config.URL == "" {
+		config.URL = defaultURL
+	}
+	serverURL, err := url.Parse(config.URL)
+	if err != nil {
+		//the error holds the url, which can hold the password
+		return fmt.Errorf("invalid url")
+	}
+	if serverURL.Scheme != "redis" && serverURL.Scheme != "rediss" {
+		return fmt.Errorf("invalid url %s : scheme must be redis or rediss", serverURL.Redacted())
+	}
+	db := 0
+	if path := strings.Trim(serverURL.Path, "/"); path != "" {
+		if db, err = strconv.Atoi(path); err != nil || db < 0 {
+			return fmt.Errorf("invalid database '%s' in url", path)
+		}
+	}
+	if config.Stream == "" {
+		return fmt.Errorf("stream is mandatory")
+	}
+	if config.Group == "" {
+		config.Group = defaultGroup
+	}
+	if config.Consumer == "" {
+		if config.Consumer, err = os.Hostname(); err != nil {
+			return errors.Wrap(err, "consumer is not set and the hostname is unknown")
+		}
+	}
+	if config.StartID == "" {
+		config.StartID = defaultStartID
+	}
+	if config.StartID != "$" && !streamID.MatchString(config.StartID) {
+		return fmt.Errorf("invalid start_id %s (must be $, 0 or an entry id)", config.StartID)
+	}
+	if config.MessageField == "" {
+		config.MessageField = defaultMessageField
+	}
+	if config.BatchSize == 0 {
+		config.BatchSize = defaultBatchSize
+	}
+	if config.BatchSize < 0 {
+		return fmt.Errorf("invalid batch_size %d", config.BatchSize)
+	}
+	if config.Block == nil {
+		config.Block = &defaultBlock
+	}
+	if *config.Block < time.Millisecond {
+		return fmt.Errorf("invalid block %s", *config.Block)
+	}
+	if config.ClaimMinIdle != nil && *config.ClaimMinIdle < 0 {
+		return fmt.Errorf("invalid claim_min_idle %s", *config.ClaimMinIdle)
+	}
+	if config.Timeout == nil {
+		config.Timeout = &defaultTimeout
+	}
+	host := serverURL.Host
+	if serverURL.Port() == "" {
+		host = net.JoinHostPort(serverURL.Hostname(), "6379")
+	}
+	r.options = &redis.Options{
+		Addr:         host,
+		DB:           db,
+		DialTimeout:  *config.Timeout,
+		ReadTimeout:  *config.Timeout,
+		WriteTimeout: *config.Timeout,
+		//one command at a time, the failures are retried by the datasource
+		PoolSize:   1,
+		MaxRetries: -1,
+	}
+	if err := r.configureAuth(config, serverURL); err != nil {
+		return err
+	}
+	if config.TLS != nil && serverURL.Scheme != "rediss" {
+		return fmt.Errorf("the tls section requires a rediss:// url")
+	}
+	if serverURL.Scheme == "rediss" {
+		if config.TLS == nil {
+			config.TLS = &RedisTLSConfiguration{}
+		}
+		if err := r.configureTLS(config.TLS, serverURL.Hostname()); err != nil {
+			return err
+		}
+	}
+	r.server = serverURL.Redacted()
+	r.cursorId = fmt.Sprintf("%s/%d/%s/%s", serverURL.Host, db, config.Stream, config.Group)
+	r.retrier, err = retry.New(config.Retry, r.logger)
+	if err != nil {
+		return err
+	}
+	r.retrier.Notify = r.notifyRetry
+	r.config = config
+	return nil
+}
+
+// configureAuth picks the credentials : the ones of the configuration, else the ones of the url
+func (r *RedisSource) configureAuth(config RedisConfiguration, serverURL *url.URL) error {
+	password, err := secrets.NewSecret(config.Password, r.logger)
+	if err != nil {
+		return errors.Wrap(err, "invalid password")
+	}
+	switch {
+	case config.Username != "" || password.Get() != "":
+		if password.Get() == "" {
+			return fmt.Errorf("username requires a password")
+		}
+		r.password = password
+		r.options.Username, r.options.Password = config.Username, password.Get()
+	case serverURL.User != nil:
+		//redis://:password@host for the password of requirepass
+		r.options.Username = serverURL.User.Username()
+		r.options.Password, _ = serverURL.User.Password()
+		if r.options.Password == "" {
+			return fmt.Errorf("the credentials of the url require a password")
+		}
+	}
+	return nil
+}
+
+func (r *RedisSource) configureTLS(config *RedisTLSConfiguration, serverName string) error {
+	tlsConfig := &tls.Config{ServerName: serverName, InsecureSkipVerify: config.InsecureSkipVerify, MinVersion: tls.VersionTLS12}
+	if config.CAFile != "" {
+		pem, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return errors.Wrapf(err, "while reading tls.ca_file %s", config.CAFile)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in tls.ca_file %s", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		return fmt.Errorf("tls.cert_file and tls.key_file must be set together")
+	}
+	if config.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return errors.Wrap(err, "could not load client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	r.options.TLSConfig = tlsConfig
+	return nil
+}
+
+// notifyRetry reports the failing connections in the health of the datasource
+func (r *RedisSource) notifyRetry(err error) {
+	if err != nil {
+		r.SetState(configuration.STATUS_RECONNECTING, err)
+	} else {
+		r.SetState(configuration.STATUS_RUNNING, nil)
+	}
+}
+
+func (r *RedisSource) ConfigureByDSN(dsn string, labels map[string]string, logger *log.Entry) error {
+	return fmt.Errorf("redis datasource does not support one shot acquisition")
+}
+
+func (r *RedisSource) GetMode() string {
+	return r.config.Mode
+}
+
+func (r *RedisSource) GetName() string {
+	return "redis"
+}
+
+func (r *RedisSource) GetUuid() string {
+	return r.config.UniqueId
+}
+
+func (r *RedisSource) OneShotAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	return fmt.Errorf("redis datasource does not support one shot acquisition")
+}
+
+func (r *RedisSource) CanRun() error {
+	return nil
+}
+
+func (r *RedisSource) Dump() interface{} {
+	return r
+}
+
+// createGroup creates the consumer group if needed, after the last entry acked before if it was lost
+func (r *RedisSource) createGroup(ctx context.Context, client *redis.Client) error {
+	startID := r.config.StartID
+	cursor, err := cursors.LoadCursor(r.GetName(), r.cursorId)
+	if err != nil {
+		r.logger.Warningf("unable to load cursor of %s : %s", r.cursorId, err)
+	}
+	if cursor != "" {
+		startID = cursor
+	}
+	err = wrapError(client.XGroupCreateMkStream(ctx, r.config.Stream, r.config.Group, startID).Err())
+	if rerr, ok := err.(*redisError); ok && rerr.Code() == "BUSYGROUP" {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "while creating group %s", r.config.Group)
+	}
+	r.logger.Infof("created group %s on stream %s, starting after %s", r.config.Group, r.config.Stream, startID)
+	return nil
+}
+
+// handle hands the entries to crowdsec and acks them. It returns false if dying was closed meanwhile
+func (r *RedisSource) handle(ctx context.Context, client *redis.Client, entries []redis.XMessage, out chan types.Event, dying <-chan struct{}, expectMode int) (bool, error) {
+	hits := linesRead.With(prometheus.Labels{"stream": r.config.Stream})
+	for _, e := range entries {
+		//the fields are nil if the entry was deleted while it was pending
+		if e.Values != nil {
+			raw, ok := e.Values[r.config.MessageField].(string)
+			if !ok {
+				r.logger.Warningf("skipping entry %s : no field %s", e.ID, r.config.MessageField)
+			} else {
+				l := types.Line{}
+				l.Raw = raw
+				l.Src = r.config.Stream
+				l.Time = time.Now().UTC()
+				l.Labels = r.config.Labels
+				l.Process = true
+				l.Module = r.GetName()
+				hits.Inc()
+				r.EventSeen(&l)
+				select {
+				case out <- types.Event{Line: l, Process: true, Type: types.LOG, ExpectMode: expectMode}:
+				case <-dying:
+					//not acked, the entry stays pending and is read again at the next start
+					return false, nil
+				}
+			}
+		}
+		if err := client.XAck(ctx, r.config.Stream, r.config.Group, e.ID).Err(); err != nil {
+			return false, errors.Wrapf(wrapError(err), "while acking entry %s", e.ID)
+		}
+		if err := cursors.SaveCursor(r.GetName(), r.cursorId, e.ID); err != nil {
+			r.logger.Warningf("unable to save cursor of %s : %s", r.cursorId, err)
+		}
+	}
+	return true, nil
+}
+
+// consume reads the stream until the connection fails, or dying is closed
+func (r *RedisSource) consume(out chan types.Event, dying <-chan struct{}, expectMode int) error {
+	//the connection is opened, authenticated and bound to the database by the first command
+	client := r.newClient()
+	defer client.Close()
+	ctx := context.Background()
+	if err := r.createGroup(ctx, client); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-dying:
+			//unblocks the pending command
+			client.Close()
+		case <-done:
+		}
+	}()
+	//wraps the errors caused by closing the connection
+	stopped := func(err error) error {
+		select {
+		case <-dying:
+			return nil
+		default:
+		}
+		return err
+	}
+	//the entries delivered to this consumer but not acked, eg. before a restart
+	pending := "0"
+	for pending != "" {
+		entries, err := r.readGroup(ctx, client, pending, false)
+		if err != nil {
+			return stopped(errors.Wrap(err, "while reading pending entries"))
+		}
+		if len(entries) == 0 {
+			break
+		}
+		if more, err := r.handle(ctx, client, entries, out, dying, expectMode); !more || err != nil {
+			return stopped(err)
+		}
+		pending = entries[len(entries)-1].ID
+	}
+	r.logger.Infof("reading stream %s as %s in group %s", r.config.Stream, r.config.Consumer, r.config.Group)
+	r.SetState(configuration.STATUS_RUNNING, nil)
+	claimStart, lastClaim := "0-0", time.Time{}
+	for {
+		if r.config.ClaimMinIdle != nil && *r.config.ClaimMinIdle > 0 && time.Since(lastClaim) >= *r.config.ClaimMinIdle {
+			entries, next, err := r.claim(ctx, client, claimStart)
+			if err != nil {
+				return stopped(err)
+			}
+			if more, err := r.handle(ctx, client, entries, out, dying, expectMode); !more || err != nil {
+				return stopped(err)
+			}
+			claimStart = next
+			//the whole pending list was scanned
+			if next == "0-0" {
+				lastClaim = time.Now()
+			}
+		}
+		entries, err := r.readGroup(ctx, client, ">", true)
+		if err != nil {
+			//eg. NOGROUP if the group or the stream was deleted, it is created again at the next connection
+			return stopped(errors.Wrapf(err, "while reading stream %s", r.config.Stream))
+		}
+		if more, err := r.handle(ctx, client, entries, out, dying, expectMode); !more || err != nil {
+			return stopped(err)
+		}
+	}
+}
+
+func (r *RedisSource) StreamingAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	expectMode := leaky.LIVE
+	if r.config.UseTimeMachine {
+		expectMode = leaky.TIMEMACHINE
+	}
+	t.Go(func() error {
+		defer types.CatchPanic("crowdsec/acquis/redis/live")
+		r.logger.Infof("connecting to %s", r.server)
+		err := r.retrier.Do(t.Dying(), func() error {
+			return r.consume(out, t.Dying(), expectMode)
+		})
+		if err == retry.ErrDying || err == nil {
+			r.logger.Infof("redis datasource stopping")
+			return nil
+		}
+		err = errors.Wrapf(err, "while consuming stream %s", r.config.Stream)
+		r.SetState(configuration.STATUS_ERRORED, err)
+		return err
+	})
+	return nil
+}
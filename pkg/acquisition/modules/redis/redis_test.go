@@ -0,0 +1,369 @@
+package redisacquisition
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/cursors"
+	"github.com/crowdsecurity/crowdsec/pkg/cstest"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/tomb.v2"
+)
+
+func TestConfigure(t *testing.T) {
+	tests := []struct {
+		config      string
+		expectedErr string
+	}{
+		{
+			config:      `foobar: bla`,
+			expectedErr: "field foobar not found in type redisacquisition.RedisConfiguration",
+		},
+		{
+			config:      `source: redis`,
+			expectedErr: "stream is mandatory",
+		},
+		{
+			config: `
+source: redis
+url: redis://:secret@localhost/2
+stream: logs
+claim_min_idle: 1m`,
+			expectedErr: "",
+		},
+		{
+			config: `
+stream: logs
+mode: cat`,
+			expectedErr: "unsupported mode cat for redis datasource",
+		},
+		{
+			config: `
+stream: logs
+url: http://:secret@localhost:6379`,
+			expectedErr: "invalid url http://:xxxxx@localhost:6379 : scheme must be redis or rediss",
+		},
+		{
+			config: `
+stream: logs
+url: redis://localhost/logs`,
+			expectedErr: "invalid database 'logs' in url",
+		},
+		{
+			config: `
+stream: logs
+start_id: latest`,
+			expectedErr: "invalid start_id latest",
+		},
+		{
+			config: `
+stream: logs
+username: crowdsec`,
+			expectedErr: "username requires a password",
+		},
+		{
+			config: `
+stream: logs
+block: 0s`,
+			expectedErr: "invalid block 0s",
+		},
+		{
+			config: `
+stream: logs
+tls:
+  insecure_skip_verify: true`,
+			expectedErr: "the tls section requires a rediss:// url",
+		},
+	}
+	subLogger := log.WithFields(log.Fields{
+		"type": "redis",
+	})
+	for _, test := range tests {
+		r := RedisSource{}
+		err := r.Configure([]byte(test.config), subLogger)
+		cstest.AssertErrorContains(t, err, test.expectedErr)
+	}
+}
+
+// fakeEntry is an entry of the stream of the fake server, consumer is set while it is pending
+type fakeEntry struct {
+	id       string
+	fields   []string
+	consumer string
+	acked    bool
+}
+
+// fakeServer is a Redis server with a stream and its consumer group
+type fakeServer struct {
+	listener  net.Listener
+	password  string
+	mu        sync.Mutex
+	entries   []*fakeEntry
+	group     bool
+	delivered int //entries delivered to the group
+	commands  []string
+}
+
+func newFakeServer(t *testing.T, password string, entries []*fakeEntry) *fakeServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &fakeServer{listener: listener, password: password, entries: entries}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeServer) URL() string {
+	return "redis://" + s.listener.Addr().String() + "/1"
+}
+
+func (s *fakeServer) history() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.commands...)
+}
+
+func encodeEntries(entries []*fakeEntry) string {
+	ret := fmt.Sprintf("*%d\r\n", len(entries))
+	for _, e := range entries {
+		ret += fmt.Sprintf("*2\r\n$%d\r\n%s\r\n*%d\r\n", len(e.id), e.id, len(e.fields))
+		for _, field := range e.fields {
+			ret += fmt.Sprintf("$%d\r\n%s\r\n", len(field), field)
+		}
+	}
+	return ret
+}
+
+// readCommand reads a command sent by the client : an array of bulk strings
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	var size int
+	if _, err := fmt.Fscanf(reader, "*%d\r\n", &size); err != nil {
+		return nil, err
+	}
+	args := make([]string, size)
+	for i := range args {
+		var length int
+		if _, err := fmt.Fscanf(reader, "$%d\r\n", &length); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:length])
+	}
+	return args, nil
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+		if strings.ToUpper(args[0]) == "XREADGROUP" && args[len(args)-1] == ">" {
+			//like a blocking read, waits for new entries
+			time.Sleep(20 * time.Millisecond)
+		}
+		s.mu.Lock()
+		s.commands = append(s.commands, strings.Join(args, " "))
+		fmt.Fprint(conn, s.handle(args))
+		s.mu.Unlock()
+	}
+}
+
+func (s *fakeServer) handle(args []string) string {
+	switch strings.ToUpper(args[0]) {
+	case "AUTH":
+		if args[len(args)-1] != s.password {
+			return "-WRONGPASS invalid username-password pair or user is disabled.\r\n"
+		}
+		return "+OK\r\n"
+	case "SELECT":
+		return "+OK\r\n"
+	case "XGROUP":
+		if s.group {
+			return "-BUSYGROUP Consumer Group name already exists\r\n"
+		}
+		s.group = true
+		for s.delivered < len(s.entries) && s.entries[s.delivered].id <= args[4] {
+			s.delivered++
+		}
+		return "+OK\r\n"
+	case "XREADGROUP":
+		consumer, id := args[3], args[len(args)-1]
+		ret := []*fakeEntry{}
+		if id == ">" {
+			for ; s.delivered < len(s.entries); s.delivered++ {
+				s.entries[s.delivered].consumer = consumer
+				ret = append(ret, s.entries[s.delivered])
+			}
+			if len(ret) == 0 {
+				return "*-1\r\n"
+			}
+		} else {
+			for _, e := range s.entries[:s.delivered] {
+				if e.consumer == consumer && !e.acked && (id == "0" || e.id > id) {
+					ret = append(ret, e)
+				}
+			}
+		}
+		return fmt.Sprintf("*1\r\n*2\r\n$4\r\nlogs\r\n%s", encodeEntries(ret))
+	case "XAUTOCLAIM":
+		consumer := args[3]
+		ret := []*fakeEntry{}
+		for _, e := range s.entries[:s.delivered] {
+			if e.consumer != "" && e.consumer != consumer && !e.acked {
+				e.consumer = consumer
+				ret = append(ret, e)
+			}
+		}
+		return fmt.Sprintf("*3\r\n$3\r\n0-0\r\n%s*0\r\n", encodeEntries(ret))
+	case "XACK":
+		for _, e := range s.entries {
+			if e.id == args[3] {
+				e.acked = true
+			}
+		}
+		return ":1\r\n"
+	}
+	return "-ERR unknown command '" + args[0] + "'\r\n"
+}
+
+func TestStreamingAcquisition(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redis-cursors")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store, err := cursors.NewFileStore(filepath.Join(dir, "cursors.json"))
+	require.NoError(t, err)
+	cursors.SetStore(store)
+	defer cursors.SetStore(nil)
+
+	server := newFakeServer(t, "secret", []*fakeEntry{
+		{id: "1-1", fields: []string{"message", "line 1"}},
+		{id: "1-2", fields: []string{"message", "line 2", "host", "web"}},
+		{id: "1-3", fields: []string{"msg", "skipped"}},
+		{id: "1-4", fields: []string{"message", "line 4"}},
+	})
+	defer server.listener.Close()
+	cursorId := server.listener.Addr().String() + "/1/logs/crowdsec"
+	//the group was lost, it is created again after the last entry acked
+	require.NoError(t, cursors.SaveCursor("redis", cursorId, "1-1"))
+
+	r := RedisSource{}
+	require.NoError(t, r.Configure([]byte(`
+source: redis
+url: `+server.URL()+`
+stream: logs
+consumer: agent1
+block: 50ms
+username: crowdsec
+password: secret`), log.WithField("type", "redis")))
+	out := make(chan types.Event)
+	tmb := tomb.Tomb{}
+	require.NoError(t, r.StreamingAcquisition(out, &tmb))
+	for _, expected := range []string{"line 2", "line 4"} {
+		select {
+		case evt := <-out:
+			assert.Equal(t, expected, evt.Line.Raw)
+			assert.Equal(t, "logs", evt.Line.Src)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout waiting for %s", expected)
+		}
+	}
+	//the ack of the last entry is sent after it was read
+	time.Sleep(100 * time.Millisecond)
+	tmb.Kill(nil)
+	require.NoError(t, tmb.Wait())
+
+	commands := server.history()
+	require.True(t, len(commands) > 6)
+	assert.Equal(t, []string{
+		"auth crowdsec secret",
+		"select 1",
+		"xgroup create logs crowdsec 1-1 mkstream",
+		"xreadgroup group crowdsec agent1 count 100 streams logs 0",
+		"xreadgroup group crowdsec agent1 count 100 block 50 streams logs >",
+		"xack logs crowdsec 1-2",
+		"xack logs crowdsec 1-3",
+		"xack logs crowdsec 1-4",
+	}, commands[:8])
+	cursor, err := cursors.LoadCursor("redis", cursorId)
+	require.NoError(t, err)
+	assert.Equal(t, "1-4", cursor)
+}
+
+func TestPendingEntries(t *testing.T) {
+	server := newFakeServer(t, "", []*fakeEntry{
+		{id: "1-1", fields: []string{"message", "line 1"}, consumer: "agent1"},
+		{id: "1-2", fields: []string{"message", "line 2"}, consumer: "agent2"},
+		{id: "1-3", fields: []string{"message", "line 3"}},
+	})
+	defer server.listener.Close()
+	server.mu.Lock()
+	server.group = true
+	server.delivered = 2
+	server.mu.Unlock()
+
+	r := RedisSource{}
+	require.NoError(t, r.Configure([]byte(`
+url: `+server.URL()+`
+stream: logs
+consumer: agent1
+claim_min_idle: 1m`), log.WithField("type", "redis")))
+	out := make(chan types.Event)
+	tmb := tomb.Tomb{}
+	require.NoError(t, r.StreamingAcquisition(out, &tmb))
+	//the entry left pending by a previous run, then the one claimed from the other consumer, then the new one
+	for _, expected := range []string{"line 1", "line 2", "line 3"} {
+		select {
+		case evt := <-out:
+			assert.Equal(t, expected, evt.Line.Raw)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout waiting for %s", expected)
+		}
+	}
+	tmb.Kill(nil)
+	require.NoError(t, tmb.Wait())
+	//the reply of the fake server holds the deleted ids, like the one of Redis 7
+	assert.Contains(t, server.history(), "xautoclaim logs crowdsec agent1 60000 0-0 count 100")
+}
+
+func TestRefused(t *testing.T) {
+	server := newFakeServer(t, "secret", nil)
+	defer server.listener.Close()
+	r := RedisSource{}
+	require.NoError(t, r.Configure([]byte(`
+url: `+strings.Replace(server.URL(), "redis://", "redis://:wrong@", 1)+`
+stream: logs`), log.WithField("type", "redis")))
+	tmb := tomb.Tomb{}
+	require.NoError(t, r.StreamingAcquisition(make(chan types.Event), &tmb))
+	//wrong credentials are not retried
+	select {
+	case <-tmb.Dead():
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for the datasource to stop")
+	}
+	cstest.AssertErrorContains(t, tmb.Err(), "while consuming stream logs: WRONGPASS invalid username-password pair")
+}
@@ -0,0 +1,247 @@
+package s3acquisition
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/retry"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/pkg/errors"
+)
+
+// snsNotification is the body of the messages delivered by a SNS subscription, without raw message delivery
+type snsNotification struct {
+	Type     string `json:"Type"`
+	TopicArn string `json:"TopicArn"`
+	Message  string `json:"Message"`
+}
+
+// s3Notification is the body of the event notifications of a bucket
+// (https://docs.aws.amazon.com/AmazonS3/latest/userguide/notification-content-structure.html)
+type s3Notification struct {
+	Records []s3Record `json:"Records"`
+	Event   string     `json:"Event"` //s3:TestEvent, sent when the notifications are configured
+}
+
+type s3Record struct {
+	EventSource string    `json:"eventSource"`
+	EventName   string    `json:"eventName"`
+	EventTime   time.Time `json:"eventTime"`
+	S3          struct {
+		Bucket struct {
+			Name string `json:"name"`
+		} `json:"bucket"`
+		Object struct {
+			Key  string `json:"key"` //url encoded
+			Size int64  `json:"size"`
+			ETag string `json:"eTag"`
+		} `json:"object"`
+	} `json:"s3"`
+}
+
+// parseNotification returns the records of the body of a message, unwrapped from its SNS notification if any
+func parseNotification(body string) (s3Notification, error) {
+	notification := snsNotification{}
+	if err := json.Unmarshal([]byte(body), &notification); err == nil && notification.Type == "Notification" && notification.TopicArn != "" {
+		body = notification.Message
+	}
+	ret := s3Notification{}
+	if err := json.Unmarshal([]byte(body), &ret); err != nil {
+		return ret, err
+	}
+	if len(ret.Records) == 0 && ret.Event == "" {
+		return ret, errors.New("no records")
+	}
+	return ret, nil
+}
+
+// lease extends the visibility of the notifications received until they are handled
+type lease struct {
+	lock    sync.Mutex
+	pending []*sqs.Message
+}
+
+func (l *lease) set(pending []*sqs.Message) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.pending = pending
+}
+
+func (l *lease) get() []*sqs.Message {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.pending
+}
+
+// extensionMargin is how long before their visibility timeout expires the notifications are extended
+func (s *S3Source) extensionMargin() time.Duration {
+	margin := *s.config.VisibilityTimeout / 2
+	if margin > 10*time.Second {
+		margin = 10 * time.Second
+	}
+	return margin
+}
+
+// keepAlive extends the visibility of the pending notifications until done is closed
+func (s *S3Source) keepAlive(dying <-chan struct{}, done <-chan struct{}, l *lease) {
+	ticker := time.NewTicker(*s.config.VisibilityTimeout - s.extensionMargin())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			pending := l.get()
+			s.logger.Debugf("extending the visibility of %d notifications", len(pending))
+			s.changeVisibility(dying, pending, *s.config.VisibilityTimeout)
+		}
+	}
+}
+
+// receiveMessages waits for the next notifications
+func (s *S3Source) receiveMessages(ctx context.Context, dying <-chan struct{}) ([]*sqs.Message, error) {
+	var messages []*sqs.Message
+	err := s.retrier.Do(dying, func() error {
+		output, err := s.sqs.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(s.config.QueueURL),
+			MaxNumberOfMessages: aws.Int64(10),
+			WaitTimeSeconds:     aws.Int64(20),
+			VisibilityTimeout:   aws.Int64(int64(*s.config.VisibilityTimeout / time.Second)),
+		})
+		if ctx.Err() != nil {
+			return retry.Permanent(retry.ErrDying)
+		}
+		if err != nil {
+			return wrapError(err)
+		}
+		messages = output.Messages
+		return nil
+	})
+	return messages, err
+}
+
+// deleteMessage deletes a notification whose object was read
+func (s *S3Source) deleteMessage(dying <-chan struct{}, msg *sqs.Message) {
+	err := s.retrier.Do(dying, func() error {
+		_, err := s.sqs.DeleteMessage(&sqs.DeleteMessageInput{QueueUrl: aws.String(s.config.QueueURL), ReceiptHandle: msg.ReceiptHandle})
+		return wrapError(err)
+	})
+	//the notification is received again once its visibility timeout expires, and its object is skipped as it was read
+	if err != nil && err != retry.ErrDying {
+		s.logger.Warningf("unable to delete notification %s : %s", aws.StringValue(msg.MessageId), err)
+	}
+}
+
+// changeVisibility sets the visibility timeout of the notifications, 0 makes them available again immediately
+func (s *S3Source) changeVisibility(dying <-chan struct{}, messages []*sqs.Message, timeout time.Duration) {
+	if len(messages) == 0 {
+		return
+	}
+	entries := make([]*sqs.ChangeMessageVisibilityBatchRequestEntry, 0, len(messages))
+	for i, msg := range messages {
+		entries = append(entries, &sqs.ChangeMessageVisibilityBatchRequestEntry{
+			Id:                aws.String(strconv.Itoa(i)),
+			ReceiptHandle:     msg.ReceiptHandle,
+			VisibilityTimeout: aws.Int64(int64(timeout / time.Second)),
+		})
+	}
+	var failed []*sqs.BatchResultErrorEntry
+	err := s.retrier.Do(dying, func() error {
+		output, err := s.sqs.ChangeMessageVisibilityBatch(&sqs.ChangeMessageVisibilityBatchInput{QueueUrl: aws.String(s.config.QueueURL), Entries: entries})
+		if err != nil {
+			return wrapError(err)
+		}
+		failed = output.Failed
+		return nil
+	})
+	if err != nil && err != retry.ErrDying {
+		s.logger.Warningf("unable to change the visibility of %d notifications : %s", len(messages), err)
+	}
+	for _, entry := range failed {
+		s.logger.Warningf("unable to change the visibility of notification : %s (%s)", aws.StringValue(entry.Message), aws.StringValue(entry.Code))
+	}
+}
+
+// handle reads the objects created of a notification. It returns false if the datasource was stopped meanwhile
+func (s *S3Source) handle(out chan types.Event, dying <-chan struct{}, msg *sqs.Message, expectMode int) (bool, error) {
+	notification, err := parseNotification(aws.StringValue(msg.Body))
+	if err != nil {
+		s.logger.Warningf("ignoring message %s, which isn't a s3 notification : %s", aws.StringValue(msg.MessageId), err)
+		return true, nil
+	}
+	for _, record := range notification.Records {
+		if record.EventSource != "aws:s3" || !strings.HasPrefix(record.EventName, "ObjectCreated:") {
+			continue
+		}
+		if record.S3.Bucket.Name != s.config.Bucket {
+			s.logger.Debugf("ignoring notification of bucket %s", record.S3.Bucket.Name)
+			continue
+		}
+		key, err := url.QueryUnescape(record.S3.Object.Key)
+		if err != nil {
+			s.logger.Warningf("invalid key %s in notification %s : %s", record.S3.Object.Key, aws.StringValue(msg.MessageId), err)
+			continue
+		}
+		if !strings.HasPrefix(key, s.config.Prefix) || record.S3.Object.Size == 0 {
+			continue
+		}
+		if !s.from.IsZero() && record.EventTime.Before(s.from) {
+			s.logger.Debugf("skipping %s, which was created before %s", key, s.from)
+			continue
+		}
+		ok, err := s.process(out, dying, key, record.S3.Object.ETag, expectMode)
+		//the cursor remembers the object read, the notifications of the other objects don't need it in memory
+		delete(s.etags, key)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// receive reads the objects notified on the queue until the datasource is stopped. Each notification is deleted once
+// its objects are read, and the notifications not handled yet are made available again when stopping
+func (s *S3Source) receive(out chan types.Event, dying <-chan struct{}, expectMode int) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-dying:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	for {
+		messages, err := s.receiveMessages(ctx, dying)
+		if err == retry.ErrDying {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(err, "while receiving notifications from %s", s.config.QueueURL)
+		}
+		s.SetState(configuration.STATUS_RUNNING, nil)
+		l := &lease{pending: messages}
+		done := make(chan struct{})
+		go s.keepAlive(dying, done, l)
+		for i, msg := range messages {
+			l.set(messages[i:])
+			ok, err := s.handle(out, dying, msg, expectMode)
+			if err != nil || !ok {
+				close(done)
+				s.changeVisibility(dying, messages[i:], 0)
+				return err
+			}
+			l.set(messages[i+1:])
+			s.deleteMessage(dying, msg)
+		}
+		close(done)
+	}
+}
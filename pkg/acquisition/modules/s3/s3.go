@@ -0,0 +1,606 @@
+package s3acquisition
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/cursors"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/retry"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/secrets"
+	leaky "github.com/crowdsecurity/crowdsec/pkg/leakybucket"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/tomb.v2"
+	"gopkg.in/yaml.v2"
+)
+
+var linesRead = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cs_s3source_hits_total",
+		Help: "Total lines that were read from S3 objects.",
+	},
+	[]string{"bucket"})
+
+var (
+	defaultPollInterval      = time.Minute
+	defaultVisibilityTimeout = 5 * time.Minute
+)
+
+type S3Configuration struct {
+	configuration.DataSourceCommonCfg `yaml:",inline"`
+	Bucket                            string         `yaml:"bucket"`
+	Prefix                            string         `yaml:"prefix"`
+	QueueURL                          string         `yaml:"queue_url"` //of the SQS queue which receives the notifications of the bucket, instead of polling it
+	PollInterval                      *time.Duration `yaml:"poll_interval"`
+	VisibilityTimeout                 *time.Duration `yaml:"visibility_timeout"` //of the notifications, extended until their objects are read
+	Since                             string         `yaml:"since"`              //RFC3339 date, or duration before now (eg. 1h). Objects modified before are skipped
+	Until                             string         `yaml:"until"`              //cat mode only
+	ForcePathStyle                    bool           `yaml:"force_path_style"`   //for the S3 compatible storages, eg. minio
+	AwsProfile                        *string        `yaml:"aws_profile"`
+	AwsRegion                         string         `yaml:"aws_region"`
+	AwsEndpoint                       string         `yaml:"aws_endpoint"`
+	AwsAccessKeyID                    string         `yaml:"aws_access_key_id"` //static keys, instead of the profile : can be env://, file:// or vault:// references
+	AwsSecretAccessKey                string         `yaml:"aws_secret_access_key"`
+	AwsSessionToken                   string         `yaml:"aws_session_token"`
+}
+
+// s3Client is the part of the s3 api used by the datasource
+type s3Client interface {
+	ListObjectsV2(input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error)
+	GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error)
+}
+
+// sqsClient is the part of the sqs api used to receive the notifications
+type sqsClient interface {
+	ReceiveMessageWithContext(ctx aws.Context, input *sqs.ReceiveMessageInput, opts ...request.Option) (*sqs.ReceiveMessageOutput, error)
+	DeleteMessage(input *sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error)
+	ChangeMessageVisibilityBatch(input *sqs.ChangeMessageVisibilityBatchInput) (*sqs.ChangeMessageVisibilityBatchOutput, error)
+}
+
+// S3Source reads the objects of a bucket, eg. the gzip logs of the load balancers, CloudFront or the VPC flows. In
+// tail mode, the bucket is polled, or the objects are read when their notifications are received from a SQS queue.
+// The ETag of each object read is saved as a cursor so that it isn't read again, and the lines already sent of an
+// object whose reading was interrupted are skipped when it's read again
+type S3Source struct {
+	configuration.HealthTracker
+	config   S3Configuration
+	logger   *log.Entry
+	s3       s3Client
+	sqs      sqsClient //nil when the bucket is polled
+	retrier  *retry.Retrier
+	from     time.Time
+	until    time.Time
+	etags    map[string]string //ETag read, by key
+	cursorId string
+}
+
+func (s *S3Source) GetMetrics() []prometheus.Collector {
+	return []prometheus.Collector{linesRead}
+}
+
+func (s *S3Source) GetAggregMetrics() []prometheus.Collector {
+	return []prometheus.Collector{linesRead}
+}
+
+func (s *S3Source) newClients() error {
+	options := session.Options{SharedConfigState: session.SharedConfigEnable}
+	if s.config.AwsProfile != nil {
+		options.Profile = *s.config.AwsProfile
+	}
+	sess, err := session.NewSessionWithOptions(options)
+	if err != nil {
+		return errors.Wrap(err, "failed to create aws session")
+	}
+	config := aws.NewConfig()
+	if s.config.AwsRegion != "" {
+		config = config.WithRegion(s.config.AwsRegion)
+	}
+	if s.config.AwsAccessKeyID != "" || s.config.AwsSecretAccessKey != "" {
+		creds, err := secrets.NewAWSCredentials(s.config.AwsAccessKeyID, s.config.AwsSecretAccessKey, s.config.AwsSessionToken)
+		if err != nil {
+			return errors.Wrap(err, "invalid aws credentials")
+		}
+		config = config.WithCredentials(creds)
+	}
+	if s.config.QueueURL != "" {
+		s.sqs = sqs.New(sess, config)
+	}
+	//the endpoint is the one of the storage, the queue url is enough for sqs
+	s3Config := config.Copy().WithS3ForcePathStyle(s.config.ForcePathStyle)
+	if s.config.AwsEndpoint != "" {
+		s3Config = s3Config.WithEndpoint(s.config.AwsEndpoint)
+	}
+	s.s3 = s3.New(sess, s3Config)
+	return nil
+}
+
+func (s *S3Source) Configure(yamlConfig []byte, logger *log.Entry) error {
+	s.logger = logger
+	config := S3Configuration{}
+	if err := yaml.UnmarshalStrict(yamlConfig, &config); err != nil {
+		return errors.Wrap(err, "Cannot parse s3 datasource configuration")
+	}
+	if config.Mode == "" {
+		config.Mode = configuration.TAIL_MODE
+	}
+	return s.configure(config)
+}
+
+// configure checks the configuration and sets the defaults, for Configure and ConfigureByDSN
+func (s *S3Source) configure(config S3Configuration) error {
+	if config.Mode != configuration.CAT_MODE && config.Mode != configuration.TAIL_MODE {
+		return fmt.Errorf("unsupported mode %s for s3 datasource", config.Mode)
+	}
+	if config.Bucket == "" {
+		return fmt.Errorf("bucket is mandatory")
+	}
+	if config.QueueURL != "" && config.Mode != configuration.TAIL_MODE {
+		return fmt.Errorf("queue_url is only supported in %s mode", configuration.TAIL_MODE)
+	}
+	if config.PollInterval == nil {
+		config.PollInterval = &defaultPollInterval
+	}
+	if *config.PollInterval <= 0 {
+		return fmt.Errorf("poll_interval must be positive")
+	}
+	if config.VisibilityTimeout == nil {
+		config.VisibilityTimeout = &defaultVisibilityTimeout
+	}
+	if *config.VisibilityTimeout < 2*time.Second || *config.VisibilityTimeout > 12*time.Hour {
+		return fmt.Errorf("visibility_timeout must be between 2s and 12h")
+	}
+	var err error
+	if s.from, err = configuration.ParseTime(config.Since); err != nil {
+		return errors.Wrap(err, "invalid since")
+	}
+	if s.until, err = configuration.ParseTime(config.Until); err != nil {
+		return errors.Wrap(err, "invalid until")
+	}
+	if !s.until.IsZero() && config.Mode == configuration.TAIL_MODE {
+		return fmt.Errorf("until is only supported in %s mode", configuration.CAT_MODE)
+	}
+	s.config = config
+	if err := s.newClients(); err != nil {
+		return errors.Wrap(err, "Cannot create s3 client")
+	}
+	s.retrier, err = retry.New(config.Retry, s.logger)
+	if err != nil {
+		return err
+	}
+	s.retrier.Notify = s.notifyRetry
+	s.cursorId = "s3://" + config.Bucket
+	s.etags = map[string]string{}
+	return nil
+}
+
+// notifyRetry reports the failing calls to the aws apis in the health of the datasource
+func (s *S3Source) notifyRetry(err error) {
+	if err != nil {
+		s.SetState(configuration.STATUS_RECONNECTING, err)
+	} else {
+		s.SetState(configuration.STATUS_RUNNING, nil)
+	}
+}
+
+func (s *S3Source) ConfigureByDSN(dsn string, labels map[string]string, logger *log.Entry) error {
+	s.logger = logger
+	//format for the DSN is : s3://bucket[/prefix]?aws_profile=...&aws_region=...&aws_endpoint=...&since=...&until=...
+	parsed, err := configuration.ParseDSN(dsn, "s3")
+	if err != nil {
+		return err
+	}
+	parts := strings.SplitN(parsed.Target, "/", 2)
+	if parts[0] == "" {
+		return fmt.Errorf("s3 DSN must contain a bucket : s3://bucket[/prefix]")
+	}
+	if err := parsed.CheckParams("aws_profile", "aws_region", "aws_endpoint", "force_path_style", "since", "until"); err != nil {
+		return err
+	}
+	if err := parsed.SetLogLevel(s.logger); err != nil {
+		return err
+	}
+	config := S3Configuration{}
+	config.Mode = configuration.CAT_MODE
+	config.Labels = labels
+	config.Bucket = parts[0]
+	if len(parts) == 2 {
+		config.Prefix = parts[1]
+	}
+	profile := ""
+	pathStyle := ""
+	for key, value := range map[string]*string{
+		"aws_profile":      &profile,
+		"aws_region":       &config.AwsRegion,
+		"aws_endpoint":     &config.AwsEndpoint,
+		"force_path_style": &pathStyle,
+		"since":            &config.Since,
+		"until":            &config.Until,
+	} {
+		if *value, err = parsed.Param(key); err != nil {
+			return err
+		}
+	}
+	if profile != "" {
+		config.AwsProfile = &profile
+	}
+	if pathStyle != "" {
+		if config.ForcePathStyle, err = strconv.ParseBool(pathStyle); err != nil {
+			return errors.Wrap(err, "invalid force_path_style")
+		}
+	}
+	return s.configure(config)
+}
+
+func (s *S3Source) GetMode() string {
+	return s.config.Mode
+}
+
+func (s *S3Source) GetName() string {
+	return "s3"
+}
+
+func (s *S3Source) GetUuid() string {
+	return s.config.UniqueId
+}
+
+func (s *S3Source) CanRun() error {
+	return nil
+}
+
+func (s *S3Source) Dump() interface{} {
+	return s
+}
+
+// permanentCodes are the errors caused by the configuration, which are not retried
+var permanentCodes = map[string]bool{
+	s3.ErrCodeNoSuchBucket:       true,
+	s3.ErrCodeNoSuchKey:          true,
+	sqs.ErrCodeQueueDoesNotExist: true,
+	"PreconditionFailed":         true,
+	"AccessDenied":               true,
+	"InvalidAccessKeyId":         true,
+	"InvalidClientTokenId":       true,
+	"SignatureDoesNotMatch":      true,
+}
+
+// wrapError returns the error of a call to hand to the retrier, its code (eg. SlowDown) can be matched in retry_on
+func wrapError(err error) error {
+	if aerr, ok := err.(awserr.Error); ok && permanentCodes[aerr.Code()] {
+		return retry.Permanent(err)
+	}
+	return err
+}
+
+// gone tells if an object was deleted, or replaced, before it was read
+func gone(err error) bool {
+	aerr, ok := errors.Cause(err).(awserr.Error)
+	return ok && (aerr.Code() == s3.ErrCodeNoSuchKey || aerr.Code() == "PreconditionFailed")
+}
+
+// listObjects returns the objects of the bucket whose key starts with the prefix, in the order of their keys
+func (s *S3Source) listObjects(dying <-chan struct{}) ([]*s3.Object, error) {
+	ret := []*s3.Object{}
+	var token *string
+	for {
+		var page *s3.ListObjectsV2Output
+		err := s.retrier.Do(dying, func() error {
+			var err error
+			page, err = s.s3.ListObjectsV2(&s3.ListObjectsV2Input{
+				Bucket:            aws.String(s.config.Bucket),
+				Prefix:            aws.String(s.config.Prefix),
+				ContinuationToken: token,
+			})
+			return wrapError(err)
+		})
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, page.Contents...)
+		if !aws.BoolValue(page.IsTruncated) || page.NextContinuationToken == nil {
+			return ret, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// inRange tells if the object was modified between since and until
+func (s *S3Source) inRange(obj *s3.Object) bool {
+	modified := aws.TimeValue(obj.LastModified)
+	if !s.from.IsZero() && modified.Before(s.from) {
+		return false
+	}
+	if !s.until.IsZero() && !modified.Before(s.until) {
+		return false
+	}
+	return true
+}
+
+// etag returns the ETag of an object without its quotes, as it is in the notifications
+func etag(obj *s3.Object) string {
+	return strings.Trim(aws.StringValue(obj.ETag), `"`)
+}
+
+func (s *S3Source) send(out chan types.Event, dying <-chan struct{}, key string, raw string, expectMode int) bool {
+	l := types.Line{}
+	l.Raw = raw
+	l.Src = "s3://" + s.config.Bucket + "/" + key
+	l.Time = time.Now().UTC()
+	l.Labels = s.config.Labels
+	l.Process = true
+	l.Module = s.GetName()
+	s.EventSeen(&l)
+	select {
+	case out <- types.Event{Line: l, Process: true, Type: types.LOG, ExpectMode: expectMode}:
+		linesRead.With(prometheus.Labels{"bucket": s.config.Bucket}).Inc()
+		return true
+	case <-dying:
+		return false
+	}
+}
+
+// decompress returns the content of the gzip objects uncompressed, whatever their name or Content-Encoding
+func decompress(body io.Reader) (io.Reader, error) {
+	reader := bufio.NewReader(body)
+	magic, err := reader.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(magic) < 2 || magic[0] != 0x1f || magic[1] != 0x8b {
+		return reader, nil
+	}
+	return gzip.NewReader(reader)
+}
+
+// readObject sends the lines of an object after the skip first ones. It returns the lines of the object sent, and if
+// it was read entirely (else the datasource was stopped meanwhile)
+func (s *S3Source) readObject(out chan types.Event, dying <-chan struct{}, key string, tag string, skip int, expectMode int) (int, bool, error) {
+	sent := skip
+	stopped := false
+	err := s.retrier.Do(dying, func() error {
+		input := &s3.GetObjectInput{Bucket: aws.String(s.config.Bucket), Key: aws.String(key)}
+		if tag != "" {
+			//the lines to skip are the ones of this version of the object
+			input.IfMatch = aws.String(`"` + tag + `"`)
+		}
+		output, err := s.s3.GetObject(input)
+		if err != nil {
+			return wrapError(err)
+		}
+		defer output.Body.Close()
+		body, err := decompress(output.Body)
+		if err != nil {
+			return errors.Wrapf(err, "while reading %s", key)
+		}
+		reader := bufio.NewReader(body)
+		for line := 0; ; line++ {
+			content, err := reader.ReadString('\n')
+			if err != nil && err != io.EOF {
+				return errors.Wrapf(err, "while reading %s", key)
+			}
+			if line >= sent {
+				if raw := strings.TrimRight(content, "\r\n"); raw != "" && !s.send(out, dying, key, raw, expectMode) {
+					stopped = true
+					return nil
+				}
+				sent = line + 1
+			}
+			if err == io.EOF {
+				return nil
+			}
+		}
+	})
+	if err == retry.ErrDying || stopped {
+		return sent, false, nil
+	}
+	return sent, err == nil, err
+}
+
+func (s *S3Source) OneShotAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	s.logger.Infof("reading bucket %s", s.config.Bucket)
+	objects, err := s.listObjects(t.Dying())
+	if err == retry.ErrDying {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "while listing bucket %s", s.config.Bucket)
+	}
+	for _, obj := range objects {
+		key := aws.StringValue(obj.Key)
+		if aws.Int64Value(obj.Size) == 0 || !s.inRange(obj) {
+			continue
+		}
+		s.logger.Debugf("reading %s", key)
+		_, done, err := s.readObject(out, t.Dying(), key, "", 0, leaky.TIMEMACHINE)
+		if err != nil {
+			if gone(err) {
+				s.logger.Warningf("object %s was deleted before it was read", key)
+				continue
+			}
+			return errors.Wrapf(err, "while reading object %s", key)
+		}
+		if !done {
+			return nil
+		}
+	}
+	t.Kill(nil)
+	return nil
+}
+
+func (s *S3Source) saveCursor(key string, value string) {
+	if err := cursors.SaveCursor(s.GetName(), s.cursorId+"/"+key, value); err != nil {
+		s.logger.Warningf("unable to save cursor of %s : %s", key, err)
+	}
+}
+
+func (s *S3Source) loadCursor(key string) string {
+	value, err := cursors.LoadCursor(s.GetName(), s.cursorId+"/"+key)
+	if err != nil {
+		s.logger.Warningf("unable to load cursor of %s : %s", key, err)
+	}
+	return value
+}
+
+// pollCursor is the key of the cursor of the last poll, which is not an object key
+func (s *S3Source) pollCursor() string {
+	return "?prefix=" + s.config.Prefix
+}
+
+// progress returns the ETag of the object read, and the lines already sent if its reading was interrupted. The
+// cursors are the ETag, followed by #<lines> for the interrupted ones
+func (s *S3Source) progress(key string) (string, int) {
+	if tag, ok := s.etags[key]; ok {
+		return tag, -1
+	}
+	value := s.loadCursor(key)
+	idx := strings.LastIndex(value, "#")
+	if idx < 0 {
+		return value, -1
+	}
+	lines, err := strconv.Atoi(value[idx+1:])
+	if err != nil {
+		s.logger.Warningf("invalid cursor %s for %s : %s", value, key, err)
+		return "", 0
+	}
+	return value[:idx], lines
+}
+
+// process reads an object, unless this version of it was already read, and remembers it. It returns false if the
+// datasource was stopped meanwhile
+func (s *S3Source) process(out chan types.Event, dying <-chan struct{}, key string, tag string, expectMode int) (bool, error) {
+	done, skip := s.progress(key)
+	if done == tag && skip < 0 {
+		s.etags[key] = tag
+		return true, nil
+	}
+	if done != tag {
+		skip = 0
+	}
+	s.logger.Debugf("reading %s from line %d", key, skip)
+	sent, ok, err := s.readObject(out, dying, key, tag, skip, expectMode)
+	if err != nil && gone(err) {
+		s.logger.Debugf("%s was deleted or replaced before it was read", key)
+		return true, nil
+	}
+	if err != nil {
+		if sent > skip {
+			s.saveCursor(key, tag+"#"+strconv.Itoa(sent))
+		}
+		return false, errors.Wrapf(err, "while reading object %s", key)
+	}
+	if !ok {
+		s.saveCursor(key, tag+"#"+strconv.Itoa(sent))
+		return false, nil
+	}
+	s.etags[key] = tag
+	s.saveCursor(key, tag)
+	return true, nil
+}
+
+// poll reads the new objects, and the new versions of the others. It returns false if the datasource was stopped
+// meanwhile
+func (s *S3Source) poll(out chan types.Event, dying <-chan struct{}, expectMode int) (bool, error) {
+	start := time.Now().UTC()
+	objects, err := s.listObjects(dying)
+	if err == retry.ErrDying {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "while listing bucket %s", s.config.Bucket)
+	}
+	s.SetState(configuration.STATUS_RUNNING, nil)
+	seen := make(map[string]bool, len(objects))
+	for _, obj := range objects {
+		key := aws.StringValue(obj.Key)
+		if aws.Int64Value(obj.Size) == 0 {
+			continue
+		}
+		seen[key] = true
+		//the objects met for the first time are skipped if they were modified before since, or before the start of crowdsec
+		if tag, _ := s.progress(key); tag == "" && !s.inRange(obj) {
+			s.logger.Debugf("skipping %s, which was modified before %s", key, s.from)
+			s.etags[key] = etag(obj)
+			s.saveCursor(key, etag(obj))
+			continue
+		}
+		ok, err := s.process(out, dying, key, etag(obj), expectMode)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	//the deleted objects are forgotten
+	for key := range s.etags {
+		if !seen[key] {
+			delete(s.etags, key)
+		}
+	}
+	s.saveCursor(s.pollCursor(), start.Format(time.RFC3339Nano))
+	return true, nil
+}
+
+func (s *S3Source) StreamingAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	expectMode := leaky.LIVE
+	if s.config.UseTimeMachine {
+		expectMode = leaky.TIMEMACHINE
+	}
+	if s.sqs != nil {
+		t.Go(func() error {
+			defer types.CatchPanic("crowdsec/acquis/s3/live")
+			s.logger.Infof("reading the objects of bucket %s notified on %s", s.config.Bucket, s.config.QueueURL)
+			if err := s.receive(out, t.Dying(), expectMode); err != nil {
+				s.SetState(configuration.STATUS_ERRORED, err)
+				return err
+			}
+			s.logger.Infof("s3 datasource stopping")
+			return nil
+		})
+		return nil
+	}
+	//without since, the objects modified before the last poll of the previous run (or else before now) were already read
+	if s.from.IsZero() {
+		s.from = time.Now().UTC()
+		if value := s.loadCursor(s.pollCursor()); value != "" {
+			if last, err := time.Parse(time.RFC3339Nano, value); err == nil {
+				s.from = last
+			} else {
+				s.logger.Warningf("invalid cursor %s of the last poll : %s", value, err)
+			}
+		}
+	}
+	t.Go(func() error {
+		defer types.CatchPanic("crowdsec/acquis/s3/live")
+		s.logger.Infof("polling bucket %s every %s", s.config.Bucket, *s.config.PollInterval)
+		ticker := time.NewTicker(*s.config.PollInterval)
+		defer ticker.Stop()
+		for {
+			ok, err := s.poll(out, t.Dying(), expectMode)
+			if err != nil {
+				s.SetState(configuration.STATUS_ERRORED, err)
+				return err
+			}
+			if !ok {
+				return nil
+			}
+			select {
+			case <-t.Dying():
+				s.logger.Infof("s3 datasource stopping")
+				return nil
+			case <-ticker.C:
+			}
+		}
+	})
+	return nil
+}
@@ -0,0 +1,495 @@
+package s3acquisition
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/cursors"
+	"github.com/crowdsecurity/crowdsec/pkg/cstest"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/tomb.v2"
+)
+
+func TestConfigure(t *testing.T) {
+	tests := []struct {
+		config      string
+		expectedErr string
+	}{
+		{
+			config:      `foobar: bla`,
+			expectedErr: "field foobar not found in type s3acquisition.S3Configuration",
+		},
+		{
+			config:      `prefix: AWSLogs/`,
+			expectedErr: "bucket is mandatory",
+		},
+		{
+			config: `
+bucket: logs
+mode: cat
+queue_url: https://sqs.eu-west-1.amazonaws.com/123456789012/logs`,
+			expectedErr: "queue_url is only supported in tail mode",
+		},
+		{
+			config: `
+bucket: logs
+poll_interval: 0s`,
+			expectedErr: "poll_interval must be positive",
+		},
+		{
+			config: `
+bucket: logs
+visibility_timeout: 1s`,
+			expectedErr: "visibility_timeout must be between 2s and 12h",
+		},
+		{
+			config: `
+bucket: logs
+until: 1h`,
+			expectedErr: "until is only supported in cat mode",
+		},
+		{
+			config: `
+bucket: logs
+since: yesterday`,
+			expectedErr: "invalid since",
+		},
+		{
+			config: `
+bucket: logs
+aws_region: eu-west-1
+aws_access_key_id: AKID`,
+			expectedErr: "both the access key id and the secret access key are needed",
+		},
+		{
+			config: `
+source: s3
+bucket: logs
+prefix: AWSLogs/123456789012/elasticloadbalancing/
+aws_region: eu-west-1
+since: 24h`,
+			expectedErr: "",
+		},
+		{
+			config: `
+source: s3
+bucket: logs
+queue_url: https://sqs.eu-west-1.amazonaws.com/123456789012/logs
+aws_region: eu-west-1`,
+			expectedErr: "",
+		},
+	}
+	subLogger := log.WithField("type", "s3")
+	for _, test := range tests {
+		s := S3Source{}
+		err := s.Configure([]byte(test.config), subLogger)
+		cstest.AssertErrorContains(t, err, test.expectedErr)
+	}
+	s := S3Source{}
+	require.NoError(t, s.Configure([]byte(`
+bucket: logs
+aws_region: eu-west-1`), subLogger))
+	assert.Equal(t, "tail", s.GetMode())
+	assert.Equal(t, time.Minute, *s.config.PollInterval)
+	assert.Nil(t, s.sqs)
+}
+
+func TestConfigureByDSN(t *testing.T) {
+	tests := []struct {
+		dsn         string
+		expectedErr string
+		bucket      string
+		prefix      string
+	}{
+		{
+			dsn:         "s3://",
+			expectedErr: "s3 DSN must contain a bucket",
+		},
+		{
+			dsn:         "file://logs",
+			expectedErr: "invalid DSN file://logs for s3 source, must start with s3://",
+		},
+		{
+			dsn:         "s3://logs?foo=bar",
+			expectedErr: "unsupported key foo in s3 DSN",
+		},
+		{
+			dsn:         "s3://logs?force_path_style=maybe",
+			expectedErr: "invalid force_path_style",
+		},
+		{
+			dsn:    "s3://logs",
+			bucket: "logs",
+		},
+		{
+			dsn:    "s3://logs/AWSLogs/123456789012/?aws_region=eu-west-1&force_path_style=true&since=2022-06-01T00:00:00Z",
+			bucket: "logs",
+			prefix: "AWSLogs/123456789012/",
+		},
+	}
+	for _, test := range tests {
+		s := S3Source{}
+		err := s.ConfigureByDSN(test.dsn, map[string]string{"type": "aws-alb"}, log.WithField("type", "s3"))
+		cstest.AssertErrorContains(t, err, test.expectedErr)
+		if test.expectedErr != "" {
+			continue
+		}
+		assert.Equal(t, test.bucket, s.config.Bucket)
+		assert.Equal(t, test.prefix, s.config.Prefix)
+		assert.Equal(t, "cat", s.GetMode())
+	}
+}
+
+type fakeObject struct {
+	content  []byte
+	etag     string
+	modified time.Time
+}
+
+// fakeBucket is a bucket whose objects are listed two by two
+type fakeBucket struct {
+	lock    sync.Mutex
+	objects map[string]fakeObject
+	gets    []string
+	version int
+}
+
+func (b *fakeBucket) put(key string, lines []string, modified time.Time) string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	content := strings.Join(lines, "\n") + "\n"
+	if strings.HasSuffix(key, ".gz") {
+		buf := bytes.Buffer{}
+		writer := gzip.NewWriter(&buf)
+		writer.Write([]byte(content))
+		writer.Close()
+		content = buf.String()
+	}
+	b.version++
+	tag := fmt.Sprintf("etag%d", b.version)
+	if b.objects == nil {
+		b.objects = map[string]fakeObject{}
+	}
+	b.objects[key] = fakeObject{content: []byte(content), etag: tag, modified: modified}
+	return tag
+}
+
+func (b *fakeBucket) ListObjectsV2(input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if aws.StringValue(input.Bucket) != "logs" {
+		return nil, awserr.New(s3.ErrCodeNoSuchBucket, "The specified bucket does not exist", nil)
+	}
+	keys := []string{}
+	for key := range b.objects {
+		if strings.HasPrefix(key, aws.StringValue(input.Prefix)) && key > aws.StringValue(input.ContinuationToken) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	output := &s3.ListObjectsV2Output{}
+	for i, key := range keys {
+		if i == 2 {
+			output.IsTruncated = aws.Bool(true)
+			output.NextContinuationToken = aws.String(keys[1])
+			break
+		}
+		obj := b.objects[key]
+		output.Contents = append(output.Contents, &s3.Object{
+			Key:          aws.String(key),
+			ETag:         aws.String(`"` + obj.etag + `"`),
+			Size:         aws.Int64(int64(len(obj.content))),
+			LastModified: aws.Time(obj.modified),
+		})
+	}
+	return output, nil
+}
+
+func (b *fakeBucket) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	key := aws.StringValue(input.Key)
+	b.gets = append(b.gets, key)
+	obj, ok := b.objects[key]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+	if input.IfMatch != nil && aws.StringValue(input.IfMatch) != `"`+obj.etag+`"` {
+		return nil, awserr.New("PreconditionFailed", "At least one of the pre-conditions you specified did not hold", nil)
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(obj.content))}, nil
+}
+
+// history returns the keys of the objects downloaded
+func (b *fakeBucket) history() []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return append([]string{}, b.gets...)
+}
+
+func readEvents(t *testing.T, out chan types.Event, expected []string) []types.Event {
+	ret := []types.Event{}
+	for _, line := range expected {
+		select {
+		case evt := <-out:
+			assert.Equal(t, line, evt.Line.Raw)
+			ret = append(ret, evt)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout waiting for %s", line)
+		}
+	}
+	return ret
+}
+
+func assertNoEvent(t *testing.T, out chan types.Event) {
+	select {
+	case evt := <-out:
+		t.Fatalf("unexpected event %s", evt.Line.Raw)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestOneShotAcquisition(t *testing.T) {
+	now := time.Now().UTC()
+	bucket := &fakeBucket{}
+	bucket.put("alb/1.log.gz", []string{"alb 1", "alb 2"}, now.Add(-2*time.Hour))
+	bucket.put("alb/2.log", []string{"alb 3", "", "alb 4"}, now.Add(-time.Hour))
+	bucket.put("alb/3.log", []string{"alb 5"}, now.Add(-30*time.Minute))
+	bucket.put("old/1.log", []string{"old"}, now.Add(-time.Hour))
+
+	s := S3Source{}
+	require.NoError(t, s.ConfigureByDSN("s3://logs/alb/?since=90m", map[string]string{"type": "aws-alb"}, log.WithField("type", "s3")))
+	s.s3 = bucket
+	out := make(chan types.Event, 10)
+	tmb := tomb.Tomb{}
+	require.NoError(t, s.OneShotAcquisition(out, &tmb))
+	events := readEvents(t, out, []string{"alb 3", "alb 4", "alb 5"})
+	assertNoEvent(t, out)
+	assert.Equal(t, "s3://logs/alb/2.log", events[0].Line.Src)
+	assert.Equal(t, "aws-alb", events[0].Line.Labels["type"])
+	assert.Equal(t, []string{"alb/2.log", "alb/3.log"}, bucket.history())
+
+	s = S3Source{}
+	require.NoError(t, s.ConfigureByDSN("s3://unknown", map[string]string{"type": "aws-alb"}, log.WithField("type", "s3")))
+	s.s3 = bucket
+	cstest.AssertErrorContains(t, s.OneShotAcquisition(out, &tomb.Tomb{}), "while listing bucket unknown: NoSuchBucket")
+}
+
+func setCursorStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3-cursors")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	store, err := cursors.NewFileStore(filepath.Join(dir, "cursors.json"))
+	require.NoError(t, err)
+	cursors.SetStore(store)
+	t.Cleanup(func() { cursors.SetStore(nil) })
+}
+
+func TestStreamingAcquisition(t *testing.T) {
+	setCursorStore(t)
+	now := time.Now().UTC()
+	bucket := &fakeBucket{}
+	bucket.put("alb/old.log", []string{"old"}, now.Add(-time.Hour))
+
+	config := []byte(`
+bucket: logs
+prefix: alb/
+aws_region: eu-west-1
+poll_interval: 50ms
+labels:
+  type: aws-alb`)
+	s := S3Source{}
+	require.NoError(t, s.Configure(config, log.WithField("type", "s3")))
+	s.s3 = bucket
+	out := make(chan types.Event)
+	tmb := tomb.Tomb{}
+	require.NoError(t, s.StreamingAcquisition(out, &tmb))
+	//the objects modified before the start are skipped
+	assertNoEvent(t, out)
+	bucket.put("alb/1.log.gz", []string{"alb 1", "alb 2", "alb 3"}, time.Now().UTC())
+	readEvents(t, out, []string{"alb 1"})
+	//the reading is interrupted, the lines sent are remembered
+	tmb.Kill(nil)
+	require.NoError(t, tmb.Wait())
+
+	//the lines sent aren't sent again, nor the objects read
+	s = S3Source{}
+	require.NoError(t, s.Configure(config, log.WithField("type", "s3")))
+	s.s3 = bucket
+	tmb = tomb.Tomb{}
+	require.NoError(t, s.StreamingAcquisition(out, &tmb))
+	readEvents(t, out, []string{"alb 2", "alb 3"})
+	assertNoEvent(t, out)
+	//a new version of an object is read again
+	bucket.put("alb/1.log.gz", []string{"alb 4"}, time.Now().UTC())
+	bucket.put("alb/2.log", []string{"alb 5"}, time.Now().UTC())
+	readEvents(t, out, []string{"alb 4", "alb 5"})
+	assertNoEvent(t, out)
+	tmb.Kill(nil)
+	require.NoError(t, tmb.Wait())
+	assert.Equal(t, []string{"alb/1.log.gz", "alb/1.log.gz", "alb/1.log.gz", "alb/2.log"}, bucket.history())
+}
+
+// fakeQueue is a queue whose batches are received in order
+type fakeQueue struct {
+	lock       sync.Mutex
+	batches    [][]*sqs.Message
+	deleted    []string
+	visibility []string
+}
+
+func (q *fakeQueue) push(messages ...*sqs.Message) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.batches = append(q.batches, messages)
+}
+
+func (q *fakeQueue) ReceiveMessageWithContext(ctx aws.Context, input *sqs.ReceiveMessageInput, opts ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	q.lock.Lock()
+	if len(q.batches) == 0 {
+		q.lock.Unlock()
+		select {
+		case <-ctx.Done():
+			return nil, awserr.New(request.CanceledErrorCode, "request context canceled", ctx.Err())
+		case <-time.After(10 * time.Millisecond):
+		}
+		return &sqs.ReceiveMessageOutput{}, nil
+	}
+	defer q.lock.Unlock()
+	batch := q.batches[0]
+	q.batches = q.batches[1:]
+	return &sqs.ReceiveMessageOutput{Messages: batch}, nil
+}
+
+func (q *fakeQueue) DeleteMessage(input *sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.deleted = append(q.deleted, aws.StringValue(input.ReceiptHandle))
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func (q *fakeQueue) ChangeMessageVisibilityBatch(input *sqs.ChangeMessageVisibilityBatchInput) (*sqs.ChangeMessageVisibilityBatchOutput, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for _, entry := range input.Entries {
+		q.visibility = append(q.visibility, fmt.Sprintf("%s:%d", aws.StringValue(entry.ReceiptHandle), aws.Int64Value(entry.VisibilityTimeout)))
+	}
+	return &sqs.ChangeMessageVisibilityBatchOutput{}, nil
+}
+
+// state returns the receipt handles of the messages deleted, and the visibility changes
+func (q *fakeQueue) state() ([]string, []string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return append([]string{}, q.deleted...), append([]string{}, q.visibility...)
+}
+
+// waitDeleted waits until count messages are deleted
+func (q *fakeQueue) waitDeleted(t *testing.T, count int) {
+	for i := 0; i < 200; i++ {
+		if deleted, _ := q.state(); len(deleted) >= count {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timeout waiting for %d deleted messages", count)
+}
+
+func notification(id string, bucket string, key string, tag string, sns bool) *sqs.Message {
+	record := s3Record{EventSource: "aws:s3", EventName: "ObjectCreated:Put", EventTime: time.Now().UTC()}
+	record.S3.Bucket.Name = bucket
+	record.S3.Object.Key = key
+	record.S3.Object.Size = 42
+	record.S3.Object.ETag = tag
+	body, err := json.Marshal(s3Notification{Records: []s3Record{record}})
+	if err != nil {
+		panic(err)
+	}
+	if sns {
+		body, err = json.Marshal(snsNotification{Type: "Notification", TopicArn: "arn:aws:sns:eu-west-1:123456789012:logs", Message: string(body)})
+		if err != nil {
+			panic(err)
+		}
+	}
+	return &sqs.Message{MessageId: aws.String(id), ReceiptHandle: aws.String("rh-" + id), Body: aws.String(string(body))}
+}
+
+func TestNotifications(t *testing.T) {
+	setCursorStore(t)
+	bucket := &fakeBucket{}
+	tag1 := bucket.put("alb/a b.log.gz", []string{"alb 1", "alb 2"}, time.Now().UTC())
+	tag2 := bucket.put("alb/2.log", []string{"alb 3"}, time.Now().UTC())
+	tag3 := bucket.put("alb/3.log", []string{"alb 4", "alb 5"}, time.Now().UTC())
+
+	s := S3Source{}
+	require.NoError(t, s.Configure([]byte(`
+bucket: logs
+prefix: alb/
+queue_url: https://sqs.eu-west-1.amazonaws.com/123456789012/logs
+aws_region: eu-west-1
+labels:
+  type: aws-alb`), log.WithField("type", "s3")))
+	s.s3 = bucket
+	queue := &fakeQueue{}
+	s.sqs = queue
+	queue.push(
+		notification("1", "logs", "alb/a+b.log.gz", tag1, false),
+		&sqs.Message{MessageId: aws.String("2"), ReceiptHandle: aws.String("rh-2"), Body: aws.String(`{"Service": "Amazon S3", "Event": "s3:TestEvent", "Bucket": "logs"}`)},
+		notification("3", "other", "alb/2.log", tag2, false),
+		notification("4", "logs", "vpc/1.log", tag2, false),
+	)
+	queue.push(
+		notification("5", "logs", "alb/2.log", tag2, true),
+		//the notifications are delivered at least once
+		notification("6", "logs", "alb/2.log", tag2, false),
+		//the object was replaced before it was read
+		notification("7", "logs", "alb/3.log", "etag0", false),
+		notification("8", "logs", "alb/3.log", tag3, false),
+	)
+
+	out := make(chan types.Event)
+	tmb := tomb.Tomb{}
+	require.NoError(t, s.StreamingAcquisition(out, &tmb))
+	events := readEvents(t, out, []string{"alb 1", "alb 2", "alb 3", "alb 4"})
+	assert.Equal(t, "s3://logs/alb/a b.log.gz", events[0].Line.Src)
+	queue.waitDeleted(t, 7)
+	deleted, _ := queue.state()
+	assert.Equal(t, []string{"rh-1", "rh-2", "rh-3", "rh-4", "rh-5", "rh-6", "rh-7"}, deleted)
+
+	//the notification not handled when stopping is available again
+	tmb.Kill(nil)
+	require.NoError(t, tmb.Wait())
+	deleted, visibility := queue.state()
+	assert.Len(t, deleted, 7)
+	assert.Equal(t, []string{"rh-8:0"}, visibility)
+
+	//the lines already sent are skipped when it's received again
+	s.etags = map[string]string{}
+	queue.push(notification("8", "logs", "alb/3.log", tag3, false))
+	tmb = tomb.Tomb{}
+	require.NoError(t, s.StreamingAcquisition(out, &tmb))
+	readEvents(t, out, []string{"alb 5"})
+	queue.waitDeleted(t, 8)
+	assertNoEvent(t, out)
+	tmb.Kill(nil)
+	require.NoError(t, tmb.Wait())
+	assert.Equal(t, []string{"alb/a b.log.gz", "alb/2.log", "alb/3.log", "alb/3.log", "alb/3.log"}, bucket.history())
+}
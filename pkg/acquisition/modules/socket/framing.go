@@ -0,0 +1,83 @@
+package socketacquisition
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// the octet counting of RFC 6587 : the length of the line is written in decimal before it, followed by a space
+const maxOctetCountDigits = 10
+
+// readLine reads the next line of a connection. The lines larger than maxLen are an error, as the connection can't
+// be synchronized again with the length prefixed framings
+func readLine(reader *bufio.Reader, framing string, maxLen int) (string, error) {
+	switch framing {
+	case SOCKET_FRAMING_OCTET_COUNTED:
+		count := ""
+		for {
+			c, err := reader.ReadByte()
+			if err != nil {
+				if err == io.EOF && count != "" {
+					return "", io.ErrUnexpectedEOF
+				}
+				return "", err
+			}
+			if c == ' ' {
+				break
+			}
+			if c < '0' || c > '9' || len(count) == maxOctetCountDigits {
+				return "", fmt.Errorf("invalid octet count %q", count+string(c))
+			}
+			count += string(c)
+		}
+		n, err := strconv.Atoi(count)
+		if err != nil {
+			return "", fmt.Errorf("invalid octet count %q", count)
+		}
+		return readCounted(reader, n, maxLen)
+	case SOCKET_FRAMING_LENGTH_PREFIXED:
+		prefix := make([]byte, 4)
+		if _, err := io.ReadFull(reader, prefix); err != nil {
+			return "", err
+		}
+		return readCounted(reader, int(binary.BigEndian.Uint32(prefix)), maxLen)
+	}
+	line := []byte{}
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			line = append(line, chunk...)
+			if len(line) > maxLen {
+				return "", fmt.Errorf("line is larger than %d bytes", maxLen)
+			}
+			continue
+		}
+		if err != nil && (err != io.EOF || len(line)+len(chunk) == 0) {
+			return "", err
+		}
+		line = append(line, chunk...)
+		trimmed := strings.TrimRight(string(line), "\r\n\x00")
+		if len(trimmed) > maxLen {
+			return "", fmt.Errorf("line is larger than %d bytes", maxLen)
+		}
+		return trimmed, nil
+	}
+}
+
+func readCounted(reader *bufio.Reader, n int, maxLen int) (string, error) {
+	if n > maxLen {
+		return "", fmt.Errorf("line of %d bytes is larger than %d bytes", n, maxLen)
+	}
+	line := make([]byte, n)
+	if _, err := io.ReadFull(reader, line); err != nil {
+		if err == io.EOF {
+			return "", io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n\x00"), nil
+}
@@ -0,0 +1,471 @@
+package socketacquisition
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	leaky "github.com/crowdsecurity/crowdsec/pkg/leakybucket"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/tomb.v2"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	SOCKET_PROTO_TCP = "tcp"
+	SOCKET_PROTO_UDP = "udp"
+	SOCKET_PROTO_TLS = "tls"
+
+	SOCKET_CLIENT_AUTH_NONE     = "none"
+	SOCKET_CLIENT_AUTH_OPTIONAL = "optional"
+	SOCKET_CLIENT_AUTH_REQUIRED = "required"
+
+	SOCKET_FRAMING_NEWLINE         = "newline"
+	SOCKET_FRAMING_OCTET_COUNTED   = "octet_counted"
+	SOCKET_FRAMING_LENGTH_PREFIXED = "length_prefixed"
+)
+
+type SocketTLSConfiguration struct {
+	CertFile   string `yaml:"cert_file"`
+	KeyFile    string `yaml:"key_file"`
+	CAFile     string `yaml:"ca_file"`
+	ClientAuth string `yaml:"client_auth"`
+	//labels added to the lines sent by a peer, by common name of the client certificate
+	PeerLabels map[string]map[string]string `yaml:"peer_labels"`
+}
+
+type SocketConfiguration struct {
+	Proto                             string                       `yaml:"protocol,omitempty"`
+	Port                              int                          `yaml:"listen_port,omitempty"`
+	Addr                              string                       `yaml:"listen_addr,omitempty"`
+	Framing                           string                       `yaml:"framing,omitempty"` //of the lines on the tcp and tls connections, the udp datagrams are split on newlines
+	MaxMessageLen                     int                          `yaml:"max_message_len,omitempty"`
+	PeerLabels                        map[string]map[string]string `yaml:"peer_labels,omitempty"` //labels added to the lines sent by a peer, by IP or network of the peer
+	TLS                               *SocketTLSConfiguration      `yaml:"tls,omitempty"`
+	configuration.DataSourceCommonCfg `yaml:",inline"`
+}
+
+// peerNetwork holds the labels of the peers of a network, merged with the ones of the datasource
+type peerNetwork struct {
+	network *net.IPNet
+	labels  map[string]string
+}
+
+// SocketSource reads the plain text lines sent by the devices that can only write to a socket
+type SocketSource struct {
+	configuration.HealthTracker
+	config       SocketConfiguration
+	logger       *log.Entry
+	tlsConfig    *tls.Config
+	udpConn      *net.UDPConn
+	listener     net.Listener
+	peerNetworks []peerNetwork                //the most specific networks first
+	peerNames    map[string]map[string]string //by common name of the client certificate
+}
+
+var linesReceived = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cs_socketsource_hits_total",
+		Help: "Total lines that were received on the socket.",
+	},
+	[]string{"source"})
+
+var connectionsAccepted = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cs_socketsource_connections_total",
+		Help: "Total connections that were accepted.",
+	},
+	[]string{"source"})
+
+var connectionsOpen = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "cs_socketsource_open_connections",
+		Help: "Number of connections currently open.",
+	},
+	[]string{"source"})
+
+func (s *SocketSource) GetName() string {
+	return "socket"
+}
+
+func (s *SocketSource) GetUuid() string {
+	return s.config.UniqueId
+}
+
+func (s *SocketSource) GetMode() string {
+	return s.config.Mode
+}
+
+func (s *SocketSource) Dump() interface{} {
+	return s
+}
+
+func (s *SocketSource) CanRun() error {
+	return nil
+}
+
+func (s *SocketSource) GetMetrics() []prometheus.Collector {
+	return []prometheus.Collector{linesReceived, connectionsAccepted, connectionsOpen}
+}
+
+func (s *SocketSource) GetAggregMetrics() []prometheus.Collector {
+	return []prometheus.Collector{linesReceived, connectionsAccepted, connectionsOpen}
+}
+
+func (s *SocketSource) ConfigureByDSN(dsn string, labels map[string]string, logger *log.Entry) error {
+	return fmt.Errorf("socket datasource does not support one shot acquisition")
+}
+
+func (s *SocketSource) OneShotAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	return fmt.Errorf("socket datasource does not support one shot acquisition")
+}
+
+func (s *SocketSource) Configure(yamlConfig []byte, logger *log.Entry) error {
+	s.logger = logger
+	socketConfig := SocketConfiguration{}
+	socketConfig.Mode = configuration.TAIL_MODE
+	if err := yaml.UnmarshalStrict(yamlConfig, &socketConfig); err != nil {
+		return errors.Wrap(err, "Cannot parse socket configuration")
+	}
+	if socketConfig.Addr == "" {
+		socketConfig.Addr = "127.0.0.1"
+	}
+	if socketConfig.Proto == "" {
+		socketConfig.Proto = SOCKET_PROTO_TCP
+	}
+	if socketConfig.Framing == "" {
+		socketConfig.Framing = SOCKET_FRAMING_NEWLINE
+	}
+	if socketConfig.MaxMessageLen == 0 {
+		socketConfig.MaxMessageLen = 64 * 1024
+	}
+	if socketConfig.Port == 0 {
+		return fmt.Errorf("listen_port is required")
+	}
+	if socketConfig.Port < 0 || socketConfig.Port > 65535 {
+		return fmt.Errorf("invalid port %d", socketConfig.Port)
+	}
+	if net.ParseIP(socketConfig.Addr) == nil {
+		return fmt.Errorf("invalid listen IP %s", socketConfig.Addr)
+	}
+	if socketConfig.MaxMessageLen < 0 {
+		return fmt.Errorf("invalid max_message_len %d", socketConfig.MaxMessageLen)
+	}
+	switch socketConfig.Framing {
+	case SOCKET_FRAMING_NEWLINE:
+	case SOCKET_FRAMING_OCTET_COUNTED, SOCKET_FRAMING_LENGTH_PREFIXED:
+		if socketConfig.Proto == SOCKET_PROTO_UDP {
+			return fmt.Errorf("framing %s requires protocol: %s or %s", socketConfig.Framing, SOCKET_PROTO_TCP, SOCKET_PROTO_TLS)
+		}
+	default:
+		return fmt.Errorf("invalid framing %s (must be %s, %s or %s)", socketConfig.Framing,
+			SOCKET_FRAMING_NEWLINE, SOCKET_FRAMING_OCTET_COUNTED, SOCKET_FRAMING_LENGTH_PREFIXED)
+	}
+	switch socketConfig.Proto {
+	case SOCKET_PROTO_UDP, SOCKET_PROTO_TCP:
+		if socketConfig.TLS != nil {
+			return fmt.Errorf("tls configuration requires protocol: %s", SOCKET_PROTO_TLS)
+		}
+	case SOCKET_PROTO_TLS:
+		if err := s.configureTLS(socketConfig.TLS, socketConfig.Labels); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid protocol %s (must be %s, %s or %s)", socketConfig.Proto, SOCKET_PROTO_TCP, SOCKET_PROTO_UDP, SOCKET_PROTO_TLS)
+	}
+	if err := s.configurePeerNetworks(socketConfig.PeerLabels, socketConfig.Labels); err != nil {
+		return err
+	}
+	s.config = socketConfig
+	return nil
+}
+
+func (s *SocketSource) configureTLS(config *SocketTLSConfiguration, labels map[string]string) error {
+	if config == nil || config.CertFile == "" || config.KeyFile == "" {
+		return fmt.Errorf("tls.cert_file and tls.key_file are required with protocol: %s", SOCKET_PROTO_TLS)
+	}
+	cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return errors.Wrap(err, "could not load server certificate")
+	}
+	s.tlsConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if config.ClientAuth == "" {
+		config.ClientAuth = SOCKET_CLIENT_AUTH_NONE
+		if config.CAFile != "" {
+			config.ClientAuth = SOCKET_CLIENT_AUTH_REQUIRED
+		}
+	}
+	switch config.ClientAuth {
+	case SOCKET_CLIENT_AUTH_NONE:
+		s.tlsConfig.ClientAuth = tls.NoClientCert
+	case SOCKET_CLIENT_AUTH_OPTIONAL:
+		s.tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case SOCKET_CLIENT_AUTH_REQUIRED:
+		s.tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return fmt.Errorf("invalid tls.client_auth %s (must be %s, %s or %s)", config.ClientAuth,
+			SOCKET_CLIENT_AUTH_NONE, SOCKET_CLIENT_AUTH_OPTIONAL, SOCKET_CLIENT_AUTH_REQUIRED)
+	}
+	if s.tlsConfig.ClientAuth != tls.NoClientCert {
+		if config.CAFile == "" {
+			return fmt.Errorf("tls.ca_file is required to verify client certificates")
+		}
+		caCert, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return errors.Wrap(err, "could not read CA file")
+		}
+		caPool := x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(caCert) {
+			return fmt.Errorf("no certificate found in %s", config.CAFile)
+		}
+		s.tlsConfig.ClientCAs = caPool
+	} else if len(config.PeerLabels) > 0 {
+		return fmt.Errorf("tls.peer_labels requires client certificates")
+	}
+	s.peerNames = make(map[string]map[string]string, len(config.PeerLabels))
+	for peer, peerLabels := range config.PeerLabels {
+		s.peerNames[peer] = mergeLabels(labels, peerLabels)
+	}
+	return nil
+}
+
+// configurePeerNetworks parses the IPs and networks of peer_labels, sorted so that the most specific one matches
+func (s *SocketSource) configurePeerNetworks(peerLabels map[string]map[string]string, labels map[string]string) error {
+	s.peerNetworks = make([]peerNetwork, 0, len(peerLabels))
+	for peer, peerLabels := range peerLabels {
+		network := &net.IPNet{}
+		if strings.Contains(peer, "/") {
+			var err error
+			if _, network, err = net.ParseCIDR(peer); err != nil {
+				return fmt.Errorf("invalid peer_labels network %s", peer)
+			}
+		} else {
+			ip := net.ParseIP(peer)
+			if ip == nil {
+				return fmt.Errorf("invalid peer_labels IP %s", peer)
+			}
+			if ip.To4() != nil {
+				network = &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}
+			} else {
+				network = &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+			}
+		}
+		s.peerNetworks = append(s.peerNetworks, peerNetwork{network: network, labels: mergeLabels(labels, peerLabels)})
+	}
+	sort.Slice(s.peerNetworks, func(i, j int) bool {
+		iOnes, _ := s.peerNetworks[i].network.Mask.Size()
+		jOnes, _ := s.peerNetworks[j].network.Mask.Size()
+		return iOnes > jOnes
+	})
+	return nil
+}
+
+// mergeLabels merges the labels once, the peer labels take precedence
+func mergeLabels(labels map[string]string, peerLabels map[string]string) map[string]string {
+	merged := make(map[string]string, len(labels)+len(peerLabels))
+	for k, v := range labels {
+		merged[k] = v
+	}
+	for k, v := range peerLabels {
+		merged[k] = v
+	}
+	return merged
+}
+
+// labelsOf returns the labels of the lines of a peer : the ones of its certificate, then of its network
+func (s *SocketSource) labelsOf(ip net.IP, commonName string) map[string]string {
+	if labels, ok := s.peerNames[commonName]; ok && commonName != "" {
+		return labels
+	}
+	for _, peer := range s.peerNetworks {
+		if peer.network.Contains(ip) {
+			return peer.labels
+		}
+	}
+	return s.config.Labels
+}
+
+func (s *SocketSource) StreamingAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	addr := net.JoinHostPort(s.config.Addr, strconv.Itoa(s.config.Port))
+	expectMode := leaky.LIVE
+	if s.config.UseTimeMachine {
+		expectMode = leaky.TIMEMACHINE
+	}
+	if s.config.Proto == SOCKET_PROTO_UDP {
+		udpAddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return errors.Wrapf(err, "could not resolve addr %s", addr)
+		}
+		if s.udpConn, err = net.ListenUDP("udp", udpAddr); err != nil {
+			return errors.Wrapf(err, "could not listen on %s", addr)
+		}
+		s.logger.Infof("listening for lines on %s (udp)", s.udpConn.LocalAddr())
+		t.Go(func() error {
+			defer types.CatchPanic("crowdsec/acquis/socket/live")
+			return s.serveUDP(out, t, expectMode)
+		})
+		return nil
+	}
+	var err error
+	if s.config.Proto == SOCKET_PROTO_TLS {
+		s.listener, err = tls.Listen("tcp", addr, s.tlsConfig)
+	} else {
+		s.listener, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "could not listen on %s", addr)
+	}
+	s.logger.Infof("listening for lines on %s (%s, %s framing)", s.listener.Addr(), s.config.Proto, s.config.Framing)
+	t.Go(func() error {
+		defer types.CatchPanic("crowdsec/acquis/socket/live")
+		return s.serveTCP(out, t, expectMode)
+	})
+	return nil
+}
+
+// serveUDP reads the datagrams, that hold one or several lines
+func (s *SocketSource) serveUDP(out chan types.Event, t *tomb.Tomb, expectMode int) error {
+	t.Go(func() error {
+		<-t.Dying()
+		s.logger.Info("socket datasource is dying")
+		return s.udpConn.Close()
+	})
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := s.udpConn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-t.Dying():
+				return nil
+			default:
+			}
+			err = errors.Wrap(err, "error while reading from socket")
+			s.SetState(configuration.STATUS_ERRORED, err)
+			return err
+		}
+		client := addr.IP.String()
+		labels := s.labelsOf(addr.IP, "")
+		payload := buf[:n]
+		if len(payload) > s.config.MaxMessageLen {
+			payload = payload[:s.config.MaxMessageLen]
+		}
+		for _, line := range strings.Split(string(payload), "\n") {
+			if line = strings.TrimRight(line, "\r\x00"); line == "" {
+				continue
+			}
+			if !s.sendLine(line, client, labels, out, t, expectMode) {
+				return nil
+			}
+		}
+	}
+}
+
+// serveTCP accepts the tcp or tls connections
+func (s *SocketSource) serveTCP(out chan types.Event, t *tomb.Tomb, expectMode int) error {
+	t.Go(func() error {
+		<-t.Dying()
+		s.logger.Info("socket datasource is dying")
+		return s.listener.Close()
+	})
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			select {
+			case <-t.Dying():
+				return nil
+			default:
+			}
+			err = errors.Wrap(err, "error while accepting connection")
+			s.SetState(configuration.STATUS_ERRORED, err)
+			return err
+		}
+		t.Go(func() error {
+			s.handleConn(conn, out, t, expectMode)
+			return nil
+		})
+	}
+}
+
+func (s *SocketSource) handleConn(conn net.Conn, out chan types.Event, t *tomb.Tomb, expectMode int) {
+	done := make(chan struct{})
+	defer close(done)
+	//unblock the reads when the datasource stops
+	go func() {
+		select {
+		case <-t.Dying():
+		case <-done:
+		}
+		conn.Close()
+	}()
+	client, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		client = conn.RemoteAddr().String()
+	}
+	logger := s.logger.WithField("client", client)
+	connectionsAccepted.With(prometheus.Labels{"source": client}).Inc()
+	connectionsOpen.With(prometheus.Labels{"source": client}).Inc()
+	defer connectionsOpen.With(prometheus.Labels{"source": client}).Dec()
+	commonName := ""
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		//the handshake is done by the first read otherwise, the certificate is needed before
+		if err := tlsConn.Handshake(); err != nil {
+			logger.Debugf("closing connection : %s", err)
+			return
+		}
+		if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+			commonName = certs[0].Subject.CommonName
+		}
+	}
+	labels := s.labelsOf(net.ParseIP(client), commonName)
+	logger.Debugf("new connection")
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := readLine(reader, s.config.Framing, s.config.MaxMessageLen)
+		if err != nil {
+			if err != io.EOF {
+				logger.Debugf("closing connection : %s", err)
+			}
+			return
+		}
+		if line == "" {
+			continue
+		}
+		if !s.sendLine(line, client, labels, out, t, expectMode) {
+			return
+		}
+	}
+}
+
+// sendLine returns false when the datasource is stopping
+func (s *SocketSource) sendLine(line string, client string, labels map[string]string, out chan types.Event, t *tomb.Tomb, expectMode int) bool {
+	linesReceived.With(prometheus.Labels{"source": client}).Inc()
+	l := types.Line{}
+	l.Raw = line
+	l.Module = s.GetName()
+	l.Labels = labels
+	l.Time = time.Now().UTC()
+	l.Src = client
+	l.Process = true
+	s.EventSeen(&l)
+	select {
+	case out <- types.Event{Line: l, Process: true, Type: types.LOG, ExpectMode: expectMode}:
+	case <-t.Dying():
+		return false
+	}
+	return true
+}
@@ -0,0 +1,351 @@
+package socketacquisition
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/cstest"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/tomb.v2"
+)
+
+func TestConfigure(t *testing.T) {
+	tests := []struct {
+		config      string
+		expectedErr string
+	}{
+		{
+			config:      `foobar: bla`,
+			expectedErr: "field foobar not found in type socketacquisition.SocketConfiguration",
+		},
+		{
+			config:      `source: socket`,
+			expectedErr: "listen_port is required",
+		},
+		{
+			config:      `listen_port: 424242`,
+			expectedErr: "invalid port 424242",
+		},
+		{
+			config: `
+listen_port: 5140
+listen_addr: 10.0.0`,
+			expectedErr: "invalid listen IP 10.0.0",
+		},
+		{
+			config: `
+listen_port: 5140
+protocol: sctp`,
+			expectedErr: "invalid protocol sctp (must be tcp, udp or tls)",
+		},
+		{
+			config: `
+listen_port: 5140
+framing: cbor`,
+			expectedErr: "invalid framing cbor (must be newline, octet_counted or length_prefixed)",
+		},
+		{
+			config: `
+listen_port: 5140
+protocol: udp
+framing: octet_counted`,
+			expectedErr: "framing octet_counted requires protocol: tcp or tls",
+		},
+		{
+			config: `
+listen_port: 5140
+peer_labels:
+  10.0.0/24:
+    type: cisco`,
+			expectedErr: "invalid peer_labels network 10.0.0/24",
+		},
+		{
+			config: `
+listen_port: 5140
+tls:
+  cert_file: server.crt`,
+			expectedErr: "tls configuration requires protocol: tls",
+		},
+		{
+			config: `
+listen_port: 5140
+protocol: tls`,
+			expectedErr: "tls.cert_file and tls.key_file are required with protocol: tls",
+		},
+		{
+			config: `
+source: socket
+listen_port: 5140
+protocol: udp
+peer_labels:
+  10.0.0.0/24:
+    type: cisco
+  10.0.0.1:
+    type: fortigate`,
+			expectedErr: "",
+		},
+	}
+	subLogger := log.WithField("type", "socket")
+	for _, test := range tests {
+		s := SocketSource{}
+		err := s.Configure([]byte(test.config), subLogger)
+		cstest.AssertErrorContains(t, err, test.expectedErr)
+	}
+}
+
+func TestLabelsOf(t *testing.T) {
+	s := SocketSource{}
+	require.NoError(t, s.Configure([]byte(`
+listen_port: 5140
+labels:
+  type: syslog
+  env: prod
+peer_labels:
+  10.0.0.0/8:
+    type: cisco
+  10.1.0.0/16:
+    type: fortigate
+  10.1.2.3:
+    env: staging`), log.WithField("type", "socket")))
+	assert.Equal(t, map[string]string{"type": "syslog", "env": "staging"}, s.labelsOf(net.ParseIP("10.1.2.3"), ""))
+	assert.Equal(t, map[string]string{"type": "fortigate", "env": "prod"}, s.labelsOf(net.ParseIP("10.1.2.4"), ""))
+	assert.Equal(t, map[string]string{"type": "cisco", "env": "prod"}, s.labelsOf(net.ParseIP("10.2.0.1"), ""))
+	assert.Equal(t, map[string]string{"type": "syslog", "env": "prod"}, s.labelsOf(net.ParseIP("192.168.1.1"), ""))
+}
+
+func lengthPrefixed(line string) string {
+	prefix := make([]byte, 4)
+	binary.BigEndian.PutUint32(prefix, uint32(len(line)))
+	return string(prefix) + line
+}
+
+func TestReadLine(t *testing.T) {
+	tests := []struct {
+		framing       string
+		input         string
+		expectedLines []string
+		expectedErr   string
+	}{
+		{
+			framing:       SOCKET_FRAMING_NEWLINE,
+			input:         "line 1\r\n\nline 2\x00\nlast line",
+			expectedLines: []string{"line 1", "", "line 2", "last line"},
+			expectedErr:   "EOF",
+		},
+		{
+			framing:       SOCKET_FRAMING_NEWLINE,
+			input:         "line 1\n" + strings.Repeat("a", 33) + "\n",
+			expectedLines: []string{"line 1"},
+			expectedErr:   "line is larger than 32 bytes",
+		},
+		{
+			framing:       SOCKET_FRAMING_OCTET_COUNTED,
+			input:         "6 line 121 line 2\nwith a newline",
+			expectedLines: []string{"line 1", "line 2\nwith a newline"},
+			expectedErr:   "EOF",
+		},
+		{
+			framing:       SOCKET_FRAMING_OCTET_COUNTED,
+			input:         "6 line 1<13>line 2",
+			expectedLines: []string{"line 1"},
+			expectedErr:   `invalid octet count "<"`,
+		},
+		{
+			framing:       SOCKET_FRAMING_OCTET_COUNTED,
+			input:         "33 " + strings.Repeat("a", 33),
+			expectedLines: []string{},
+			expectedErr:   "line of 33 bytes is larger than 32 bytes",
+		},
+		{
+			framing:       SOCKET_FRAMING_OCTET_COUNTED,
+			input:         "10 line",
+			expectedLines: []string{},
+			expectedErr:   "unexpected EOF",
+		},
+		{
+			framing:       SOCKET_FRAMING_LENGTH_PREFIXED,
+			input:         lengthPrefixed("line 1") + lengthPrefixed("line 2\n"),
+			expectedLines: []string{"line 1", "line 2"},
+			expectedErr:   "EOF",
+		},
+		{
+			framing:       SOCKET_FRAMING_LENGTH_PREFIXED,
+			input:         lengthPrefixed(strings.Repeat("a", 33)),
+			expectedLines: []string{},
+			expectedErr:   "line of 33 bytes is larger than 32 bytes",
+		},
+	}
+	for _, test := range tests {
+		reader := bufio.NewReader(strings.NewReader(test.input))
+		lines := []string{}
+		var err error
+		for {
+			var line string
+			if line, err = readLine(reader, test.framing, 32); err != nil {
+				break
+			}
+			lines = append(lines, line)
+		}
+		assert.Equal(t, test.expectedLines, lines)
+		cstest.AssertErrorContains(t, err, test.expectedErr)
+	}
+}
+
+func startSource(t *testing.T, config string) (*tomb.Tomb, chan types.Event) {
+	s := SocketSource{}
+	require.NoError(t, s.Configure([]byte(config), log.WithField("type", "socket")))
+	tmb := tomb.Tomb{}
+	out := make(chan types.Event)
+	require.NoError(t, s.StreamingAcquisition(out, &tmb))
+	return &tmb, out
+}
+
+func readEvent(t *testing.T, out chan types.Event) types.Event {
+	select {
+	case evt := <-out:
+		return evt
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for event")
+	}
+	return types.Event{}
+}
+
+func TestStreamingTCP(t *testing.T) {
+	tmb, out := startSource(t, `
+source: socket
+listen_port: 5141
+labels:
+  type: syslog
+peer_labels:
+  127.0.0.0/8:
+    type: cisco`)
+	conn, err := net.Dial("tcp", "127.0.0.1:5141")
+	require.NoError(t, err)
+	fmt.Fprint(conn, "first line\r\n\nsecond line\nlast line")
+	conn.Close()
+	for _, expected := range []string{"first line", "second line", "last line"} {
+		evt := readEvent(t, out)
+		assert.Equal(t, expected, evt.Line.Raw)
+		assert.Equal(t, "127.0.0.1", evt.Line.Src)
+		assert.Equal(t, "socket", evt.Line.Module)
+		assert.Equal(t, map[string]string{"type": "cisco"}, evt.Line.Labels)
+	}
+	tmb.Kill(nil)
+	require.NoError(t, tmb.Wait())
+}
+
+func TestStreamingUDP(t *testing.T) {
+	tmb, out := startSource(t, `
+source: socket
+protocol: udp
+listen_port: 5142
+labels:
+  type: syslog`)
+	conn, err := net.Dial("udp", "127.0.0.1:5142")
+	require.NoError(t, err)
+	defer conn.Close()
+	_, _ = conn.Write([]byte("one datagram"))
+	_, _ = conn.Write([]byte("two lines\nin a datagram\n"))
+	for _, expected := range []string{"one datagram", "two lines", "in a datagram"} {
+		evt := readEvent(t, out)
+		assert.Equal(t, expected, evt.Line.Raw)
+		assert.Equal(t, map[string]string{"type": "syslog"}, evt.Line.Labels)
+	}
+	tmb.Kill(nil)
+	require.NoError(t, tmb.Wait())
+}
+
+func writeCert(t *testing.T, dir string, name string, template *x509.Certificate, parent *x509.Certificate, parentKey *rsa.PrivateKey) (*x509.Certificate, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0600))
+	return cert, key
+}
+
+func TestStreamingTLS(t *testing.T) {
+	dir := t.TempDir()
+	notAfter := time.Now().Add(time.Hour)
+	ca, caKey := writeCert(t, dir, "ca", &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "socket-ca"},
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	writeCert(t, dir, "server", &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	writeCert(t, dir, "client", &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "fw01"},
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	//the labels of the certificate take precedence over the ones of the network
+	tmb, out := startSource(t, fmt.Sprintf(`
+source: socket
+protocol: tls
+listen_port: 5143
+framing: length_prefixed
+labels:
+  type: syslog
+peer_labels:
+  127.0.0.1:
+    type: cisco
+tls:
+  cert_file: %[1]s/server.crt
+  key_file: %[1]s/server.key
+  ca_file: %[1]s/ca.crt
+  peer_labels:
+    fw01:
+      type: fortigate`, dir))
+	caPool := x509.NewCertPool()
+	caPool.AddCert(ca)
+	clientCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key"))
+	require.NoError(t, err)
+	conn, err := tls.Dial("tcp", "127.0.0.1:5143", &tls.Config{RootCAs: caPool, Certificates: []tls.Certificate{clientCert}})
+	require.NoError(t, err)
+	_, err = io.WriteString(conn, lengthPrefixed("over tls"))
+	require.NoError(t, err)
+	evt := readEvent(t, out)
+	assert.Equal(t, "over tls", evt.Line.Raw)
+	assert.Equal(t, map[string]string{"type": "fortigate"}, evt.Line.Labels)
+	conn.Close()
+
+	tmb.Kill(nil)
+	require.NoError(t, tmb.Wait())
+}
@@ -0,0 +1,502 @@
+package splunkacquisition
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/cursors"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/retry"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/secrets"
+	leaky "github.com/crowdsecurity/crowdsec/pkg/leakybucket"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/tomb.v2"
+	"gopkg.in/yaml.v2"
+)
+
+var linesRead = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cs_splunk_hits_total",
+		Help: "Total events that were read from Splunk searches.",
+	},
+	[]string{"url"})
+
+var (
+	defaultPollInterval = 1 * time.Minute
+	defaultIndexDelay   = 30 * time.Second
+	defaultTimeout      = 30 * time.Second
+)
+
+const (
+	defaultMessageField = "_raw"
+	maxResultSize       = 1024 * 1024
+)
+
+type SplunkConfiguration struct {
+	configuration.DataSourceCommonCfg `yaml:",inline"`
+	URL                               string         `yaml:"url"` //url of the REST api, eg. https://splunk:8089
+	Index                             string         `yaml:"index"`
+	SourceType                        string         `yaml:"sourcetype"`
+	Query                             string         `yaml:"query"`         //SPL search terms and commands, appended to the index and sourcetype selection
+	MessageField                      string         `yaml:"message_field"` //field holding the log line, _raw by default
+	PollInterval                      *time.Duration `yaml:"poll_interval"` //tail mode : how often the new events are searched for
+	IndexDelay                        *time.Duration `yaml:"index_delay"`   //tail mode : don't search the last seconds, whose events may not be indexed yet
+	Timeout                           *time.Duration `yaml:"timeout"`       //how long to wait for the search to start answering
+	Since                             string         `yaml:"since"`         //RFC3339 date, or duration before now (eg. 1h). Tail mode starts now by default
+	Until                             string         `yaml:"until"`         //cat mode only
+	Token                             string         `yaml:"token"`         //authentication token, can be a env://, file:// or vault:// reference like password
+	Username                          string         `yaml:"username"`
+	Password                          string         `yaml:"password"`
+	CACert                            string         `yaml:"ca_cert"`
+	InsecureSkipVerify                bool           `yaml:"insecure_skip_verify"`
+}
+
+// SplunkSource runs a search on the export endpoint of the Splunk REST api, over the since/until range (cat mode) or
+// over successive windows of time (tail mode). The end of the last window searched is saved as a cursor
+type SplunkSource struct {
+	configuration.HealthTracker
+	config   SplunkConfiguration
+	logger   *log.Entry
+	client   *http.Client
+	retrier  *retry.Retrier
+	auth     func(*http.Request)
+	search   string
+	from     time.Time
+	until    time.Time
+	cursorId string
+}
+
+// exportResult is a line of the json output of the export endpoint
+type exportResult struct {
+	Preview  bool                   `json:"preview"`
+	Result   map[string]interface{} `json:"result"`
+	Messages []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"messages"`
+}
+
+func (s *SplunkSource) GetMetrics() []prometheus.Collector {
+	return []prometheus.Collector{linesRead}
+}
+
+func (s *SplunkSource) GetAggregMetrics() []prometheus.Collector {
+	return []prometheus.Collector{linesRead}
+}
+
+func (s *SplunkSource) Configure(yamlConfig []byte, logger *log.Entry) error {
+	s.logger = logger
+	config := SplunkConfiguration{}
+	if err := yaml.UnmarshalStrict(yamlConfig, &config); err != nil {
+		return errors.Wrap(err, "Cannot parse splunk datasource configuration")
+	}
+	if config.Mode == "" {
+		config.Mode = configuration.TAIL_MODE
+	}
+	return s.configure(config)
+}
+
+// configure checks the configuration and sets the defaults, for Configure and ConfigureByDSN
+func (s *SplunkSource) configure(config SplunkConfiguration) error {
+	if config.Mode != configuration.CAT_MODE && config.Mode != configuration.TAIL_MODE {
+		return fmt.Errorf("unsupported mode %s for splunk datasource", config.Mode)
+	}
+	if config.URL == "" {
+		return fmt.Errorf("url is mandatory")
+	}
+	if _, err := url.Parse(config.URL); err != nil {
+		return errors.Wrapf(err, "invalid url %s", config.URL)
+	}
+	config.URL = strings.TrimSuffix(config.URL, "/")
+	if config.Index == "" && config.Query == "" {
+		return fmt.Errorf("index or query is mandatory")
+	}
+	if config.MessageField == "" {
+		config.MessageField = defaultMessageField
+	}
+	if config.PollInterval == nil {
+		config.PollInterval = &defaultPollInterval
+	}
+	if *config.PollInterval <= 0 {
+		return fmt.Errorf("poll_interval must be positive")
+	}
+	if config.IndexDelay == nil {
+		config.IndexDelay = &defaultIndexDelay
+	}
+	if *config.IndexDelay < 0 {
+		return fmt.Errorf("index_delay can't be negative")
+	}
+	if config.Timeout == nil {
+		config.Timeout = &defaultTimeout
+	}
+	var err error
+	if s.from, err = configuration.ParseTime(config.Since); err != nil {
+		return errors.Wrap(err, "invalid since")
+	}
+	if s.until, err = configuration.ParseTime(config.Until); err != nil {
+		return errors.Wrap(err, "invalid until")
+	}
+	if !s.until.IsZero() && config.Mode == configuration.TAIL_MODE {
+		return fmt.Errorf("until is only supported in %s mode", configuration.CAT_MODE)
+	}
+	if err := s.configureAuth(config); err != nil {
+		return err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	//the results are streamed : only the wait for the server is bounded
+	transport.ResponseHeaderTimeout = *config.Timeout
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify}
+	if config.CACert != "" {
+		pem, err := ioutil.ReadFile(config.CACert)
+		if err != nil {
+			return errors.Wrapf(err, "while reading ca_cert %s", config.CACert)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in ca_cert %s", config.CACert)
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+	s.client = &http.Client{Transport: transport}
+	s.retrier, err = retry.New(config.Retry, s.logger)
+	if err != nil {
+		return err
+	}
+	s.retrier.Notify = s.notifyRetry
+	s.search = buildSearch(config)
+	s.cursorId = config.URL + "?" + s.search
+	s.config = config
+	return nil
+}
+
+// buildSearch returns the SPL search of the configuration, sorted so that the events are sent in order
+func buildSearch(config SplunkConfiguration) string {
+	terms := []string{}
+	if config.Index != "" {
+		terms = append(terms, "index="+strconv.Quote(config.Index))
+	}
+	if config.SourceType != "" {
+		terms = append(terms, "sourcetype="+strconv.Quote(config.SourceType))
+	}
+	query := strings.TrimSpace(config.Query)
+	if strings.HasPrefix(query, "|") {
+		//a generating command (ie. | tstats ...) can't follow the search terms
+		return query + " | sort 0 _time"
+	}
+	query = strings.TrimPrefix(query, "search ")
+	if query != "" {
+		terms = append(terms, query)
+	}
+	return "search " + strings.Join(terms, " ") + " | sort 0 _time"
+}
+
+func (s *SplunkSource) configureAuth(config SplunkConfiguration) error {
+	if config.Token != "" && (config.Username != "" || config.Password != "") {
+		return fmt.Errorf("token and username/password are mutually exclusive")
+	}
+	if config.Token != "" {
+		token, err := secrets.NewSecret(config.Token, s.logger)
+		if err != nil {
+			return errors.Wrap(err, "invalid token")
+		}
+		s.auth = func(req *http.Request) {
+			req.Header.Set("Authorization", "Bearer "+token.Get())
+		}
+	}
+	if config.Username != "" {
+		password, err := secrets.NewSecret(config.Password, s.logger)
+		if err != nil {
+			return errors.Wrap(err, "invalid password")
+		}
+		s.auth = func(req *http.Request) {
+			req.SetBasicAuth(config.Username, password.Get())
+		}
+	}
+	return nil
+}
+
+// notifyRetry reports the failing searches in the health of the datasource
+func (s *SplunkSource) notifyRetry(err error) {
+	if err != nil {
+		s.SetState(configuration.STATUS_RECONNECTING, err)
+	} else {
+		s.SetState(configuration.STATUS_RUNNING, nil)
+	}
+}
+
+func (s *SplunkSource) ConfigureByDSN(dsn string, labels map[string]string, logger *log.Entry) error {
+	s.logger = logger
+	//format for the DSN is : splunk://host:port?index=...&sourcetype=...&query=...&since=...&until=...
+	parsed, err := configuration.ParseDSN(dsn, "splunk")
+	if err != nil {
+		return err
+	}
+	if parsed.Target == "" {
+		return fmt.Errorf("empty splunk:// DSN")
+	}
+	if err := parsed.CheckParams("scheme", "index", "sourcetype", "query", "since", "until", "message_field",
+		"token", "username", "password", "insecure_skip_verify"); err != nil {
+		return err
+	}
+	if err := parsed.SetLogLevel(s.logger); err != nil {
+		return err
+	}
+	config := SplunkConfiguration{}
+	config.Mode = configuration.CAT_MODE
+	config.Labels = labels
+	//the management port of splunk only speaks https
+	scheme := "https"
+	for key, value := range map[string]*string{
+		"scheme":        &scheme,
+		"index":         &config.Index,
+		"sourcetype":    &config.SourceType,
+		"query":         &config.Query,
+		"since":         &config.Since,
+		"until":         &config.Until,
+		"message_field": &config.MessageField,
+		"token":         &config.Token,
+		"username":      &config.Username,
+		"password":      &config.Password,
+	} {
+		param, err := parsed.Param(key)
+		if err != nil {
+			return err
+		}
+		if param != "" {
+			*value = param
+		}
+	}
+	if insecure, err := parsed.Param("insecure_skip_verify"); err != nil {
+		return err
+	} else if insecure != "" {
+		if config.InsecureSkipVerify, err = strconv.ParseBool(insecure); err != nil {
+			return fmt.Errorf("parsing 'insecure_skip_verify' parameters: %s", err)
+		}
+	}
+	config.URL = scheme + "://" + parsed.Target
+	return s.configure(config)
+}
+
+func (s *SplunkSource) GetMode() string {
+	return s.config.Mode
+}
+
+func (s *SplunkSource) GetName() string {
+	return "splunk"
+}
+
+func (s *SplunkSource) GetUuid() string {
+	return s.config.UniqueId
+}
+
+func (s *SplunkSource) CanRun() error {
+	return nil
+}
+
+func (s *SplunkSource) Dump() interface{} {
+	return s
+}
+
+// field returns a field of a result as a string, the first value of the multivalued fields
+func field(result map[string]interface{}, name string) (string, bool) {
+	switch value := result[name].(type) {
+	case string:
+		return value, true
+	case []interface{}:
+		if len(value) > 0 {
+			return fmt.Sprint(value[0]), true
+		}
+	case nil:
+	default:
+		return fmt.Sprint(value), true
+	}
+	return "", false
+}
+
+// export runs the search over [from, to) and sends its results. A search that fails while its results are read is
+// retried, skipping the results that were already sent
+func (s *SplunkSource) export(from time.Time, to time.Time, out chan types.Event, dying <-chan struct{}, expectMode int) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-dying:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	params := url.Values{
+		"search":      {s.search},
+		"output_mode": {"json"},
+	}
+	if !from.IsZero() {
+		params.Set("earliest_time", strconv.FormatInt(from.Unix(), 10))
+	}
+	if !to.IsZero() {
+		params.Set("latest_time", strconv.FormatInt(to.Unix(), 10))
+	}
+	hits := linesRead.With(prometheus.Labels{"url": s.config.URL})
+	sent := 0
+	err := s.retrier.Do(dying, func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.config.URL+"/services/search/jobs/export", strings.NewReader(params.Encode()))
+		if err != nil {
+			return retry.Permanent(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if s.auth != nil {
+			s.auth(req)
+		}
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if err := retry.CheckResponse(resp); err != nil {
+			return err
+		}
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(make([]byte, 64*1024), maxResultSize)
+		read := 0
+		for scanner.Scan() {
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+			line := exportResult{}
+			if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+				s.logger.Warningf("skipping invalid result : %s", err)
+				continue
+			}
+			for _, msg := range line.Messages {
+				if msg.Type == "FATAL" || msg.Type == "ERROR" {
+					return retry.Permanent(fmt.Errorf("search failed : %s", msg.Text))
+				}
+			}
+			if line.Preview || line.Result == nil {
+				continue
+			}
+			if read++; read <= sent {
+				continue
+			}
+			msg, ok := field(line.Result, s.config.MessageField)
+			if !ok {
+				s.logger.Debugf("skipping result without %s field", s.config.MessageField)
+				sent++
+				continue
+			}
+			l := types.Line{}
+			l.Raw = msg
+			l.Src, _ = field(line.Result, "source")
+			if l.Src == "" {
+				l.Src = s.config.URL
+			}
+			l.Time = time.Now().UTC()
+			l.Labels = s.config.Labels
+			l.Process = true
+			l.Module = s.GetName()
+			hits.Inc()
+			s.EventSeen(&l)
+			select {
+			case out <- types.Event{Line: l, Process: true, Type: types.LOG, ExpectMode: expectMode}:
+			case <-dying:
+				return nil
+			}
+			sent++
+		}
+		return scanner.Err()
+	})
+	if err == retry.ErrDying {
+		return nil
+	}
+	return err
+}
+
+func (s *SplunkSource) OneShotAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	s.logger.Infof("running search %s on %s", s.search, s.config.URL)
+	if err := s.export(s.from, s.until, out, t.Dying(), leaky.TIMEMACHINE); err != nil {
+		return errors.Wrapf(err, "while searching %s", s.config.URL)
+	}
+	t.Kill(nil)
+	return nil
+}
+
+// loadCursor resumes after the last window searched before a restart, or starts now (or since)
+func (s *SplunkSource) loadCursor() {
+	value, err := cursors.LoadCursor(s.GetName(), s.cursorId)
+	if err != nil {
+		s.logger.Warningf("unable to load cursor of %s : %s", s.cursorId, err)
+	}
+	if value != "" {
+		epoch, err := strconv.ParseInt(value, 10, 64)
+		if err == nil {
+			s.logger.Infof("resuming %s from %s", s.cursorId, value)
+			s.from = time.Unix(epoch, 0)
+			return
+		}
+		s.logger.Warningf("invalid cursor %s for %s : %s", value, s.cursorId, err)
+	}
+	if s.from.IsZero() {
+		s.from = s.windowEnd()
+	}
+}
+
+func (s *SplunkSource) saveCursor() {
+	if err := cursors.SaveCursor(s.GetName(), s.cursorId, strconv.FormatInt(s.from.Unix(), 10)); err != nil {
+		s.logger.Warningf("unable to save cursor of %s : %s", s.cursorId, err)
+	}
+}
+
+// windowEnd is the end of the next window to search : the events of the last index_delay may not be searchable yet
+func (s *SplunkSource) windowEnd() time.Time {
+	return time.Now().Add(-*s.config.IndexDelay).Truncate(time.Second)
+}
+
+func (s *SplunkSource) StreamingAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	s.loadCursor()
+	expectMode := leaky.LIVE
+	if s.config.UseTimeMachine {
+		expectMode = leaky.TIMEMACHINE
+	}
+	t.Go(func() error {
+		defer types.CatchPanic("crowdsec/acquis/splunk/live")
+		s.logger.Infof("running search %s on %s every %s", s.search, s.config.URL, *s.config.PollInterval)
+		ticker := time.NewTicker(*s.config.PollInterval)
+		defer ticker.Stop()
+		for {
+			//the windows don't overlap : latest_time is exclusive
+			if to := s.windowEnd(); to.After(s.from) {
+				if err := s.export(s.from, to, out, t.Dying(), expectMode); err != nil {
+					err = errors.Wrapf(err, "while searching %s", s.config.URL)
+					s.SetState(configuration.STATUS_ERRORED, err)
+					return err
+				}
+				select {
+				case <-t.Dying():
+					//the window may not have been read entirely
+				default:
+					s.from = to
+					s.saveCursor()
+				}
+			}
+			select {
+			case <-t.Dying():
+				s.logger.Infof("splunk datasource stopping")
+				return nil
+			case <-ticker.C:
+			}
+		}
+	})
+	return nil
+}
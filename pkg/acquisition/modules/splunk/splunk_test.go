@@ -0,0 +1,312 @@
+package splunkacquisition
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/cursors"
+	"github.com/crowdsecurity/crowdsec/pkg/cstest"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/tomb.v2"
+)
+
+// mockSplunk answers the exports with its events in the [earliest_time, latest_time) range
+type mockSplunk struct {
+	lock     sync.Mutex
+	events   []map[string]interface{}
+	searches []map[string]string
+	token    string
+}
+
+func (m *mockSplunk) add(at time.Time, raw string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.events = append(m.events, map[string]interface{}{
+		"_time":  at.Unix(),
+		"_raw":   raw,
+		"source": "/var/log/nginx/access.log",
+		"host":   []interface{}{"web1", "web1.local"},
+	})
+}
+
+func (m *mockSplunk) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if r.URL.Path != "/services/search/jobs/export" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer "+m.token {
+		http.Error(w, `{"messages":[{"type":"WARN","text":"call not properly authenticated"}]}`, http.StatusUnauthorized)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	search := map[string]string{}
+	for key := range r.Form {
+		search[key] = r.Form.Get(key)
+	}
+	m.searches = append(m.searches, search)
+	earliest, _ := strconv.ParseInt(search["earliest_time"], 10, 64)
+	latest, err := strconv.ParseInt(search["latest_time"], 10, 64)
+	if err != nil {
+		latest = time.Now().Add(time.Hour).Unix()
+	}
+	encoder := json.NewEncoder(w)
+	for i, event := range m.events {
+		if at := event["_time"].(int64); at < earliest || at >= latest {
+			continue
+		}
+		_ = encoder.Encode(map[string]interface{}{"preview": false, "offset": i, "result": event})
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	tests := []struct {
+		config      string
+		expectedErr string
+	}{
+		{
+			config:      `foobar: asd`,
+			expectedErr: "field foobar not found in type splunkacquisition.SplunkConfiguration",
+		},
+		{
+			config:      `index: main`,
+			expectedErr: "url is mandatory",
+		},
+		{
+			config:      `url: https://localhost:8089`,
+			expectedErr: "index or query is mandatory",
+		},
+		{
+			config: `
+url: https://localhost:8089
+index: main
+until: 1h`,
+			expectedErr: "until is only supported in cat mode",
+		},
+		{
+			config: `
+url: https://localhost:8089
+index: main
+index_delay: -1s`,
+			expectedErr: "index_delay can't be negative",
+		},
+		{
+			config: `
+url: https://localhost:8089
+index: main
+token: abcd
+username: admin`,
+			expectedErr: "token and username/password are mutually exclusive",
+		},
+		{
+			config: `
+url: https://localhost:8089
+index: main
+username: admin
+password: env://CROWDSEC_TEST_UNSET_PASSWORD`,
+			expectedErr: "invalid password",
+		},
+		{
+			config: `
+url: https://localhost:8089
+index: main
+sourcetype: access_combined
+since: 1h`,
+			expectedErr: "",
+		},
+	}
+	subLogger := log.WithFields(log.Fields{
+		"type": "splunk",
+	})
+	for _, test := range tests {
+		s := SplunkSource{}
+		err := s.Configure([]byte(test.config), subLogger)
+		cstest.AssertErrorContains(t, err, test.expectedErr)
+	}
+}
+
+func TestBuildSearch(t *testing.T) {
+	tests := []struct {
+		config   SplunkConfiguration
+		expected string
+	}{
+		{
+			config:   SplunkConfiguration{Index: "main"},
+			expected: `search index="main" | sort 0 _time`,
+		},
+		{
+			config:   SplunkConfiguration{Index: "main", SourceType: "access_combined", Query: "status>=400"},
+			expected: `search index="main" sourcetype="access_combined" status>=400 | sort 0 _time`,
+		},
+		{
+			config:   SplunkConfiguration{Query: "search index=web | where status>=400"},
+			expected: `search index=web | where status>=400 | sort 0 _time`,
+		},
+		{
+			config:   SplunkConfiguration{Index: "main", Query: "| inputlookup blocked.csv"},
+			expected: `| inputlookup blocked.csv | sort 0 _time`,
+		},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, buildSearch(test.config))
+	}
+}
+
+func TestConfigureDSN(t *testing.T) {
+	tests := []struct {
+		dsn         string
+		expectedErr string
+		expectedURL string
+	}{
+		{
+			dsn:         "asd://",
+			expectedErr: "invalid DSN asd:// for splunk source, must start with splunk://",
+		},
+		{
+			dsn:         "splunk://",
+			expectedErr: "empty splunk:// DSN",
+		},
+		{
+			dsn:         "splunk://localhost:8089?index=main&foobar=42",
+			expectedErr: "unsupported key foobar in splunk DSN",
+		},
+		{
+			dsn:         "splunk://localhost:8089?index=main&insecure_skip_verify=maybe",
+			expectedErr: "parsing 'insecure_skip_verify' parameters",
+		},
+		{
+			dsn:         "splunk://localhost:8089?index=main&sourcetype=syslog&since=24h&log_level=info",
+			expectedURL: "https://localhost:8089",
+		},
+		{
+			dsn:         "splunk://localhost:8089?query=error&scheme=http",
+			expectedURL: "http://localhost:8089",
+		},
+	}
+	subLogger := log.WithFields(log.Fields{
+		"type": "splunk",
+	})
+	for _, test := range tests {
+		s := SplunkSource{}
+		err := s.ConfigureByDSN(test.dsn, map[string]string{"type": "testtype"}, subLogger)
+		cstest.AssertErrorContains(t, err, test.expectedErr)
+		if test.expectedErr == "" {
+			assert.Equal(t, test.expectedURL, s.config.URL)
+			assert.Equal(t, "cat", s.GetMode())
+		}
+	}
+}
+
+func readLines(out chan types.Event, n int, timeout time.Duration) []string {
+	ret := []string{}
+	for len(ret) < n {
+		select {
+		case evt := <-out:
+			ret = append(ret, evt.Line.Raw)
+		case <-time.After(timeout):
+			return ret
+		}
+	}
+	return ret
+}
+
+func TestOneShot(t *testing.T) {
+	server := &mockSplunk{token: "secret"}
+	start := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 4; i++ {
+		server.add(start.Add(time.Duration(i)*time.Hour), fmt.Sprintf("line %d", i))
+	}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	s := SplunkSource{}
+	err := s.Configure([]byte(fmt.Sprintf(`
+url: %s
+mode: cat
+index: main
+token: secret
+since: 2022-06-01T01:00:00Z
+until: 2022-06-01T03:00:00Z`, ts.URL)), log.WithField("type", "splunk"))
+	require.NoError(t, err)
+
+	out := make(chan types.Event, 10)
+	tmb := tomb.Tomb{}
+	require.NoError(t, s.OneShotAcquisition(out, &tmb))
+	assert.Equal(t, []string{"line 1", "line 2"}, readLines(out, 2, time.Second))
+
+	require.Len(t, server.searches, 1)
+	assert.Equal(t, `search index="main" | sort 0 _time`, server.searches[0]["search"])
+	assert.Equal(t, "json", server.searches[0]["output_mode"])
+
+	//the other fields can hold the line, multivalued ones give their first value
+	s = SplunkSource{}
+	require.NoError(t, s.Configure([]byte(fmt.Sprintf("url: %s\nmode: cat\nindex: main\ntoken: secret\nmessage_field: host", ts.URL)), log.WithField("type", "splunk")))
+	require.NoError(t, s.OneShotAcquisition(out, &tomb.Tomb{}))
+	assert.Equal(t, []string{"web1", "web1", "web1", "web1"}, readLines(out, 4, time.Second))
+
+	//a bad token is not retried
+	s = SplunkSource{}
+	require.NoError(t, s.Configure([]byte(fmt.Sprintf("url: %s\nmode: cat\nindex: main\ntoken: wrong", ts.URL)), log.WithField("type", "splunk")))
+	err = s.OneShotAcquisition(out, &tomb.Tomb{})
+	cstest.AssertErrorContains(t, err, "request failed with status 401")
+}
+
+func TestStreaming(t *testing.T) {
+	dir, err := ioutil.TempDir("", "splunk-cursors")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store, err := cursors.NewFileStore(filepath.Join(dir, "cursors.json"))
+	require.NoError(t, err)
+	cursors.SetStore(store)
+	defer cursors.SetStore(nil)
+
+	server := &mockSplunk{token: "secret"}
+	start := time.Now().Add(-time.Minute).Truncate(time.Second)
+	server.add(start.Add(-time.Second), "line 1")
+	server.add(start, "line 2")
+	server.add(start.Add(time.Second), "line 3")
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	s := SplunkSource{}
+	require.NoError(t, s.Configure([]byte(fmt.Sprintf(`
+url: %s
+index: main
+token: secret
+poll_interval: 50ms
+index_delay: 0s`, ts.URL)), log.WithField("type", "splunk")))
+	//fake a previous run that searched up to the second line
+	require.NoError(t, cursors.SaveCursor("splunk", s.cursorId, strconv.FormatInt(start.Unix(), 10)))
+	out := make(chan types.Event, 10)
+	tmb := tomb.Tomb{}
+	require.NoError(t, s.StreamingAcquisition(out, &tmb))
+	assert.Equal(t, []string{"line 2", "line 3"}, readLines(out, 2, 2*time.Second))
+	//found once its second is over
+	server.add(time.Now(), "line 4")
+	assert.Equal(t, []string{"line 4"}, readLines(out, 1, 3*time.Second))
+	assert.Empty(t, readLines(out, 1, 200*time.Millisecond))
+	tmb.Kill(nil)
+	require.NoError(t, tmb.Wait())
+
+	cursor, err := cursors.LoadCursor("splunk", s.cursorId)
+	require.NoError(t, err)
+	at, err := strconv.ParseInt(cursor, 10, 64)
+	require.NoError(t, err)
+	assert.Greater(t, at, time.Now().Add(-time.Second).Unix()-1)
+}
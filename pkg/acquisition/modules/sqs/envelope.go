@@ -0,0 +1,71 @@
+package sqsacquisition
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// snsNotification is the body of the messages delivered by a SNS subscription, without raw message delivery
+// (https://docs.aws.amazon.com/sns/latest/dg/sns-message-and-json-formats.html)
+type snsNotification struct {
+	Type      string `json:"Type"`
+	MessageID string `json:"MessageId"`
+	TopicArn  string `json:"TopicArn"`
+	Subject   string `json:"Subject"`
+	Message   string `json:"Message"`
+	Timestamp string `json:"Timestamp"`
+}
+
+// s3Notification is the body of the event notifications of a S3 bucket, each record is an object created, deleted...
+// (https://docs.aws.amazon.com/AmazonS3/latest/userguide/notification-content-structure.html)
+type s3Notification struct {
+	Records []json.RawMessage `json:"Records"`
+	Event   string            `json:"Event"` //s3:TestEvent, sent when the notifications are configured
+}
+
+type s3Record struct {
+	EventSource string `json:"eventSource"`
+}
+
+// unwrap returns the lines of the body of a message : the message of a SNS notification, and each record of a S3
+// notification. The other bodies are a single line
+func unwrap(body string) ([]string, map[string]string) {
+	meta := map[string]string{}
+	if !strings.HasPrefix(strings.TrimSpace(body), "{") {
+		return []string{body}, meta
+	}
+	notification := snsNotification{}
+	if err := json.Unmarshal([]byte(body), &notification); err == nil && notification.Type == "Notification" && notification.TopicArn != "" {
+		body = notification.Message
+		meta[notificationMetaPrefix+"topic_arn"] = notification.TopicArn
+		meta[notificationMetaPrefix+"message_id"] = notification.MessageID
+		meta[notificationMetaPrefix+"timestamp"] = notification.Timestamp
+		if notification.Subject != "" {
+			meta[notificationMetaPrefix+"subject"] = notification.Subject
+		}
+	}
+	s3 := s3Notification{}
+	if err := json.Unmarshal([]byte(body), &s3); err != nil {
+		return []string{body}, meta
+	}
+	if s3.Event == "s3:TestEvent" {
+		return []string{}, meta
+	}
+	if len(s3.Records) == 0 {
+		return []string{body}, meta
+	}
+	record := s3Record{}
+	if err := json.Unmarshal(s3.Records[0], &record); err != nil || record.EventSource != "aws:s3" {
+		return []string{body}, meta
+	}
+	lines := make([]string, 0, len(s3.Records))
+	for _, record := range s3.Records {
+		buf := bytes.Buffer{}
+		if err := json.Compact(&buf, record); err != nil {
+			return []string{body}, meta
+		}
+		lines = append(lines, buf.String())
+	}
+	return lines, meta
+}
@@ -0,0 +1,475 @@
+package sqsacquisition
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/retry"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/secrets"
+	leaky "github.com/crowdsecurity/crowdsec/pkg/leakybucket"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/tomb.v2"
+	"gopkg.in/yaml.v2"
+)
+
+var linesRead = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cs_sqssource_hits_total",
+		Help: "Total lines that were read from SQS messages.",
+	},
+	[]string{"queue"})
+
+var (
+	defaultWaitTime          = 20 * time.Second
+	defaultVisibilityTimeout = time.Minute
+)
+
+const (
+	//limits of the ReceiveMessage calls
+	maxMessagesLimit       = 10
+	maxWaitTime            = 20 * time.Second
+	maxVisibilityTimeout   = 12 * time.Hour
+	messageMetaPrefix      = "sqs_"
+	notificationMetaPrefix = "sns_"
+)
+
+type SQSConfiguration struct {
+	configuration.DataSourceCommonCfg `yaml:",inline"`
+	QueueURL                          string         `yaml:"queue_url"`
+	QueueName                         string         `yaml:"queue_name"`  //instead of queue_url, the url is looked up at startup
+	QueueOwner                        string         `yaml:"queue_owner"` //account id of the owner of queue_name, if it's not the one of the credentials
+	MaxMessages                       int64          `yaml:"max_messages"`
+	WaitTime                          *time.Duration `yaml:"wait_time"`          //of the long polling
+	VisibilityTimeout                 *time.Duration `yaml:"visibility_timeout"` //of the messages received, they are deleted or extended before it expires
+	Unwrap                            *bool          `yaml:"unwrap"`             //read the SNS notifications, and the records of the S3 notifications
+	AwsProfile                        *string        `yaml:"aws_profile"`
+	AwsRegion                         string         `yaml:"aws_region"`
+	AwsEndpoint                       string         `yaml:"aws_endpoint"`
+	AwsAccessKeyID                    string         `yaml:"aws_access_key_id"` //static keys, instead of the profile : can be env://, file:// or vault:// references
+	AwsSecretAccessKey                string         `yaml:"aws_secret_access_key"`
+	AwsSessionToken                   string         `yaml:"aws_session_token"`
+}
+
+// sqsClient is the part of the sqs api used by the datasource
+type sqsClient interface {
+	GetQueueUrl(input *sqs.GetQueueUrlInput) (*sqs.GetQueueUrlOutput, error)
+	ReceiveMessageWithContext(ctx aws.Context, input *sqs.ReceiveMessageInput, opts ...request.Option) (*sqs.ReceiveMessageOutput, error)
+	DeleteMessageBatch(input *sqs.DeleteMessageBatchInput) (*sqs.DeleteMessageBatchOutput, error)
+	ChangeMessageVisibilityBatch(input *sqs.ChangeMessageVisibilityBatchInput) (*sqs.ChangeMessageVisibilityBatchOutput, error)
+}
+
+// SQSSource receives the messages of a queue with long polling. Each message is deleted once its lines are sent,
+// and the visibility of the messages which wait to be sent is extended before it expires
+type SQSSource struct {
+	configuration.HealthTracker
+	config   SQSConfiguration
+	logger   *log.Entry
+	client   sqsClient
+	retrier  *retry.Retrier
+	queueURL string
+	name     string //of the queue, the source of the lines
+}
+
+func (s *SQSSource) GetMetrics() []prometheus.Collector {
+	return []prometheus.Collector{linesRead}
+}
+
+func (s *SQSSource) GetAggregMetrics() []prometheus.Collector {
+	return []prometheus.Collector{linesRead}
+}
+
+func (s *SQSSource) newClient() error {
+	options := session.Options{SharedConfigState: session.SharedConfigEnable}
+	if s.config.AwsProfile != nil {
+		options.Profile = *s.config.AwsProfile
+	}
+	sess, err := session.NewSessionWithOptions(options)
+	if err != nil {
+		return errors.Wrap(err, "failed to create aws session")
+	}
+	config := aws.NewConfig()
+	if s.config.AwsRegion != "" {
+		config = config.WithRegion(s.config.AwsRegion)
+	}
+	if s.config.AwsEndpoint != "" {
+		config = config.WithEndpoint(s.config.AwsEndpoint)
+	}
+	if s.config.AwsAccessKeyID != "" || s.config.AwsSecretAccessKey != "" {
+		creds, err := secrets.NewAWSCredentials(s.config.AwsAccessKeyID, s.config.AwsSecretAccessKey, s.config.AwsSessionToken)
+		if err != nil {
+			return errors.Wrap(err, "invalid aws credentials")
+		}
+		config = config.WithCredentials(creds)
+	}
+	s.client = sqs.New(sess, config)
+	return nil
+}
+
+func (s *SQSSource) Configure(yamlConfig []byte, logger *log.Entry) error {
+	s.logger = logger
+	config := SQSConfiguration{}
+	if err := yaml.UnmarshalStrict(yamlConfig, &config); err != nil {
+		return errors.Wrap(err, "Cannot parse sqs datasource configuration")
+	}
+	if config.Mode == "" {
+		config.Mode = configuration.TAIL_MODE
+	}
+	if config.Mode != configuration.TAIL_MODE {
+		return fmt.Errorf("unsupported mode %s for sqs datasource", config.Mode)
+	}
+	if config.QueueURL == "" && config.QueueName == "" {
+		return fmt.Errorf("queue_url or queue_name is mandatory")
+	}
+	if config.QueueURL != "" && config.QueueName != "" {
+		return fmt.Errorf("queue_url and queue_name are mutually exclusive")
+	}
+	if config.QueueOwner != "" && config.QueueName == "" {
+		return fmt.Errorf("queue_owner is only used with queue_name")
+	}
+	s.name = config.QueueName
+	if config.QueueURL != "" {
+		parsed, err := url.Parse(config.QueueURL)
+		if err != nil {
+			return errors.Wrapf(err, "invalid queue_url %s", config.QueueURL)
+		}
+		//https://sqs.<region>.amazonaws.com/<account>/<name>
+		s.name = parsed.Path[strings.LastIndex(parsed.Path, "/")+1:]
+		if parsed.Host == "" || s.name == "" {
+			return fmt.Errorf("invalid queue_url %s", config.QueueURL)
+		}
+	}
+	s.queueURL = config.QueueURL
+	if config.MaxMessages == 0 {
+		config.MaxMessages = maxMessagesLimit
+	}
+	if config.MaxMessages < 1 || config.MaxMessages > maxMessagesLimit {
+		return fmt.Errorf("max_messages must be between 1 and %d", maxMessagesLimit)
+	}
+	if config.WaitTime == nil {
+		config.WaitTime = &defaultWaitTime
+	}
+	if *config.WaitTime < 0 || *config.WaitTime > maxWaitTime {
+		return fmt.Errorf("wait_time must be between 0s and %s", maxWaitTime)
+	}
+	if config.VisibilityTimeout == nil {
+		config.VisibilityTimeout = &defaultVisibilityTimeout
+	}
+	if *config.VisibilityTimeout < time.Second || *config.VisibilityTimeout > maxVisibilityTimeout {
+		return fmt.Errorf("visibility_timeout must be between 1s and %s", maxVisibilityTimeout)
+	}
+	if config.Unwrap == nil {
+		unwrap := true
+		config.Unwrap = &unwrap
+	}
+	s.config = config
+	if err := s.newClient(); err != nil {
+		return errors.Wrap(err, "Cannot create sqs client")
+	}
+	var err error
+	s.retrier, err = retry.New(config.Retry, s.logger)
+	if err != nil {
+		return err
+	}
+	s.retrier.Notify = s.notifyRetry
+	return nil
+}
+
+// notifyRetry reports the failing calls to the sqs api in the health of the datasource
+func (s *SQSSource) notifyRetry(err error) {
+	if err != nil {
+		s.SetState(configuration.STATUS_RECONNECTING, err)
+	} else {
+		s.SetState(configuration.STATUS_RUNNING, nil)
+	}
+}
+
+func (s *SQSSource) ConfigureByDSN(dsn string, labels map[string]string, logger *log.Entry) error {
+	return fmt.Errorf("sqs datasource does not support one shot acquisition")
+}
+
+func (s *SQSSource) GetMode() string {
+	return s.config.Mode
+}
+
+func (s *SQSSource) GetName() string {
+	return "sqs"
+}
+
+func (s *SQSSource) GetUuid() string {
+	return s.config.UniqueId
+}
+
+func (s *SQSSource) OneShotAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	return fmt.Errorf("sqs datasource does not support one shot acquisition")
+}
+
+func (s *SQSSource) CanRun() error {
+	return nil
+}
+
+func (s *SQSSource) Dump() interface{} {
+	return s
+}
+
+// permanentCodes are the errors caused by the configuration, which are not retried
+var permanentCodes = map[string]bool{
+	sqs.ErrCodeQueueDoesNotExist:  true,
+	"AccessDenied":                true,
+	"AccessDeniedException":       true,
+	"InvalidClientTokenId":        true,
+	"UnrecognizedClientException": true,
+	"SignatureDoesNotMatch":       true,
+}
+
+// wrapError returns the error of a call to hand to the retrier, its code (eg. ThrottlingException) can be matched
+// in retry_on
+func wrapError(err error) error {
+	if aerr, ok := err.(awserr.Error); ok && permanentCodes[aerr.Code()] {
+		return retry.Permanent(err)
+	}
+	return err
+}
+
+// resolveQueue looks up the url of queue_name
+func (s *SQSSource) resolveQueue(dying <-chan struct{}) error {
+	if s.queueURL != "" {
+		return nil
+	}
+	return s.retrier.Do(dying, func() error {
+		input := &sqs.GetQueueUrlInput{QueueName: aws.String(s.config.QueueName)}
+		if s.config.QueueOwner != "" {
+			input.QueueOwnerAWSAccountId = aws.String(s.config.QueueOwner)
+		}
+		output, err := s.client.GetQueueUrl(input)
+		if err != nil {
+			return wrapError(err)
+		}
+		s.queueURL = aws.StringValue(output.QueueUrl)
+		return nil
+	})
+}
+
+// receive waits for the next messages
+func (s *SQSSource) receive(ctx context.Context, dying <-chan struct{}) ([]*sqs.Message, error) {
+	var messages []*sqs.Message
+	err := s.retrier.Do(dying, func() error {
+		output, err := s.client.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:              aws.String(s.queueURL),
+			MaxNumberOfMessages:   aws.Int64(s.config.MaxMessages),
+			WaitTimeSeconds:       aws.Int64(int64(*s.config.WaitTime / time.Second)),
+			VisibilityTimeout:     aws.Int64(int64(*s.config.VisibilityTimeout / time.Second)),
+			AttributeNames:        aws.StringSlice([]string{sqs.MessageSystemAttributeNameSentTimestamp, sqs.MessageSystemAttributeNameApproximateReceiveCount}),
+			MessageAttributeNames: aws.StringSlice([]string{"All"}),
+		})
+		if ctx.Err() != nil {
+			return retry.Permanent(retry.ErrDying)
+		}
+		if err != nil {
+			return wrapError(err)
+		}
+		messages = output.Messages
+		return nil
+	})
+	return messages, err
+}
+
+// deleteMessages deletes the messages whose lines were sent. It is tried once more if the datasource is stopping
+func (s *SQSSource) deleteMessages(dying <-chan struct{}, messages []*sqs.Message) {
+	if len(messages) == 0 {
+		return
+	}
+	entries := make([]*sqs.DeleteMessageBatchRequestEntry, 0, len(messages))
+	for i, msg := range messages {
+		entries = append(entries, &sqs.DeleteMessageBatchRequestEntry{Id: aws.String(strconv.Itoa(i)), ReceiptHandle: msg.ReceiptHandle})
+	}
+	var failed []*sqs.BatchResultErrorEntry
+	err := s.retrier.Do(dying, func() error {
+		output, err := s.client.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{QueueUrl: aws.String(s.queueURL), Entries: entries})
+		if err != nil {
+			return wrapError(err)
+		}
+		failed = output.Failed
+		return nil
+	})
+	//the messages not deleted are received again once their visibility timeout expires
+	if err != nil && err != retry.ErrDying {
+		s.logger.Warningf("unable to delete %d messages : %s", len(messages), err)
+	}
+	for _, entry := range failed {
+		s.logger.Warningf("unable to delete message : %s (%s)", aws.StringValue(entry.Message), aws.StringValue(entry.Code))
+	}
+}
+
+// changeVisibility sets the visibility timeout of the messages, 0 makes them available again immediately
+func (s *SQSSource) changeVisibility(dying <-chan struct{}, messages []*sqs.Message, timeout time.Duration) {
+	if len(messages) == 0 {
+		return
+	}
+	entries := make([]*sqs.ChangeMessageVisibilityBatchRequestEntry, 0, len(messages))
+	for i, msg := range messages {
+		entries = append(entries, &sqs.ChangeMessageVisibilityBatchRequestEntry{
+			Id:                aws.String(strconv.Itoa(i)),
+			ReceiptHandle:     msg.ReceiptHandle,
+			VisibilityTimeout: aws.Int64(int64(timeout / time.Second)),
+		})
+	}
+	var failed []*sqs.BatchResultErrorEntry
+	err := s.retrier.Do(dying, func() error {
+		output, err := s.client.ChangeMessageVisibilityBatch(&sqs.ChangeMessageVisibilityBatchInput{QueueUrl: aws.String(s.queueURL), Entries: entries})
+		if err != nil {
+			return wrapError(err)
+		}
+		failed = output.Failed
+		return nil
+	})
+	if err != nil && err != retry.ErrDying {
+		s.logger.Warningf("unable to change the visibility of %d messages : %s", len(messages), err)
+	}
+	for _, entry := range failed {
+		s.logger.Warningf("unable to change the visibility of message : %s (%s)", aws.StringValue(entry.Message), aws.StringValue(entry.Code))
+	}
+}
+
+// extensionMargin is how long before their visibility timeout expires the messages are deleted or extended
+func (s *SQSSource) extensionMargin() time.Duration {
+	margin := *s.config.VisibilityTimeout / 2
+	if margin > 10*time.Second {
+		margin = 10 * time.Second
+	}
+	return margin
+}
+
+// dispatch sends the lines of the messages, and deletes them. It returns false if the datasource was stopped
+// meanwhile : the messages not sent yet are made available again
+func (s *SQSSource) dispatch(out chan types.Event, dying <-chan struct{}, messages []*sqs.Message, expectMode int) bool {
+	deadline := time.Now().Add(*s.config.VisibilityTimeout - s.extensionMargin())
+	done := 0
+	for i, msg := range messages {
+		for _, evt := range s.events(msg, expectMode) {
+			s.EventSeen(&evt.Line)
+			for sent := false; !sent; {
+				timer := time.NewTimer(time.Until(deadline))
+				select {
+				case out <- evt:
+					linesRead.With(prometheus.Labels{"queue": s.name}).Inc()
+					sent = true
+				case <-dying:
+					timer.Stop()
+					s.deleteMessages(dying, messages[done:i])
+					s.changeVisibility(dying, messages[i:], 0)
+					return false
+				case <-timer.C:
+					//the messages already sent are deleted, and the others wait longer
+					s.logger.Debugf("extending the visibility of %d messages", len(messages)-i)
+					s.deleteMessages(dying, messages[done:i])
+					done = i
+					s.changeVisibility(dying, messages[i:], *s.config.VisibilityTimeout)
+					deadline = time.Now().Add(*s.config.VisibilityTimeout - s.extensionMargin())
+				}
+				timer.Stop()
+			}
+		}
+	}
+	s.deleteMessages(dying, messages[done:])
+	return true
+}
+
+// events returns the events of the lines of a message
+func (s *SQSSource) events(msg *sqs.Message, expectMode int) []types.Event {
+	body := aws.StringValue(msg.Body)
+	lines, meta := []string{body}, map[string]string{}
+	if *s.config.Unwrap {
+		lines, meta = unwrap(body)
+		if len(lines) == 0 {
+			s.logger.Debugf("ignoring message %s without records", aws.StringValue(msg.MessageId))
+		}
+	}
+	meta[messageMetaPrefix+"message_id"] = aws.StringValue(msg.MessageId)
+	if sent, err := strconv.ParseInt(aws.StringValue(msg.Attributes[sqs.MessageSystemAttributeNameSentTimestamp]), 10, 64); err == nil {
+		meta[messageMetaPrefix+"sent_timestamp"] = time.Unix(0, sent*int64(time.Millisecond)).UTC().Format(time.RFC3339Nano)
+	}
+	if count, ok := msg.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]; ok {
+		meta[messageMetaPrefix+"receive_count"] = aws.StringValue(count)
+	}
+	for key, value := range msg.MessageAttributes {
+		if value != nil && value.StringValue != nil {
+			meta[messageMetaPrefix+"attribute_"+key] = *value.StringValue
+		}
+	}
+	ret := make([]types.Event, 0, len(lines))
+	for _, line := range lines {
+		l := types.Line{}
+		l.Raw = line
+		l.Src = s.name
+		l.Time = time.Now().UTC()
+		l.Labels = s.config.Labels
+		l.Process = true
+		l.Module = s.GetName()
+		eventMeta := make(map[string]string, len(meta))
+		for key, value := range meta {
+			eventMeta[key] = value
+		}
+		ret = append(ret, types.Event{Line: l, Process: true, Type: types.LOG, ExpectMode: expectMode, Meta: eventMeta})
+	}
+	return ret
+}
+
+func (s *SQSSource) StreamingAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	expectMode := leaky.LIVE
+	if s.config.UseTimeMachine {
+		expectMode = leaky.TIMEMACHINE
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Go(func() error {
+		defer types.CatchPanic("crowdsec/acquis/sqs/live")
+		defer cancel()
+		go func() {
+			select {
+			case <-t.Dying():
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		err := s.resolveQueue(t.Dying())
+		if err == retry.ErrDying {
+			return nil
+		}
+		if err != nil {
+			err = errors.Wrapf(err, "while looking up queue %s", s.config.QueueName)
+			s.SetState(configuration.STATUS_ERRORED, err)
+			return err
+		}
+		s.logger.Infof("receiving messages from %s", s.queueURL)
+		for {
+			messages, err := s.receive(ctx, t.Dying())
+			if err == retry.ErrDying {
+				s.logger.Infof("sqs datasource stopping")
+				return nil
+			}
+			if err != nil {
+				err = errors.Wrapf(err, "while receiving messages from %s", s.queueURL)
+				s.SetState(configuration.STATUS_ERRORED, err)
+				return err
+			}
+			s.SetState(configuration.STATUS_RUNNING, nil)
+			if !s.dispatch(out, t.Dying(), messages, expectMode) {
+				s.logger.Infof("sqs datasource stopping")
+				return nil
+			}
+		}
+	})
+	return nil
+}
@@ -0,0 +1,357 @@
+package sqsacquisition
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/crowdsecurity/crowdsec/pkg/cstest"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/tomb.v2"
+)
+
+func TestConfigure(t *testing.T) {
+	tests := []struct {
+		config      string
+		expectedErr string
+	}{
+		{
+			config:      `foobar: bla`,
+			expectedErr: "field foobar not found in type sqsacquisition.SQSConfiguration",
+		},
+		{
+			config:      `aws_region: eu-west-1`,
+			expectedErr: "queue_url or queue_name is mandatory",
+		},
+		{
+			config: `
+queue_name: logs
+queue_url: https://sqs.eu-west-1.amazonaws.com/123456789012/logs`,
+			expectedErr: "queue_url and queue_name are mutually exclusive",
+		},
+		{
+			config: `
+queue_url: https://sqs.eu-west-1.amazonaws.com/123456789012/logs
+queue_owner: "123456789012"`,
+			expectedErr: "queue_owner is only used with queue_name",
+		},
+		{
+			config: `
+queue_url: https://sqs.eu-west-1.amazonaws.com/123456789012/
+aws_region: eu-west-1`,
+			expectedErr: "invalid queue_url https://sqs.eu-west-1.amazonaws.com/123456789012/",
+		},
+		{
+			config: `
+queue_name: logs
+mode: cat`,
+			expectedErr: "unsupported mode cat for sqs datasource",
+		},
+		{
+			config: `
+queue_name: logs
+max_messages: 11`,
+			expectedErr: "max_messages must be between 1 and 10",
+		},
+		{
+			config: `
+queue_name: logs
+wait_time: 30s`,
+			expectedErr: "wait_time must be between 0s and 20s",
+		},
+		{
+			config: `
+queue_name: logs
+visibility_timeout: 500ms`,
+			expectedErr: "visibility_timeout must be between 1s and 12h0m0s",
+		},
+		{
+			config: `
+queue_name: logs
+aws_region: eu-west-1
+aws_access_key_id: AKID`,
+			expectedErr: "both the access key id and the secret access key are needed",
+		},
+		{
+			config: `
+source: sqs
+queue_url: https://sqs.eu-west-1.amazonaws.com/123456789012/cloudtrail-logs
+aws_region: eu-west-1
+unwrap: false`,
+			expectedErr: "",
+		},
+	}
+	subLogger := log.WithField("type", "sqs")
+	for _, test := range tests {
+		s := SQSSource{}
+		err := s.Configure([]byte(test.config), subLogger)
+		cstest.AssertErrorContains(t, err, test.expectedErr)
+	}
+	s := SQSSource{}
+	require.NoError(t, s.Configure([]byte(`
+queue_url: https://sqs.eu-west-1.amazonaws.com/123456789012/cloudtrail-logs
+aws_region: eu-west-1`), subLogger))
+	assert.Equal(t, "cloudtrail-logs", s.name)
+	assert.Equal(t, int64(10), s.config.MaxMessages)
+	assert.Equal(t, 20*time.Second, *s.config.WaitTime)
+	assert.True(t, *s.config.Unwrap)
+}
+
+const s3Event = `{"Records": [
+	{"eventVersion": "2.1", "eventSource": "aws:s3", "eventName": "ObjectCreated:Put", "s3": {"object": {"key": "a.log"}}},
+	{"eventVersion": "2.1", "eventSource": "aws:s3", "eventName": "ObjectRemoved:Delete", "s3": {"object": {"key": "b.log"}}}
+]}`
+
+func snsEnvelope(message string) string {
+	content, err := json.Marshal(snsNotification{
+		Type:      "Notification",
+		MessageID: "22b80b92-fdea-4c2c-8f9d-bdfb0c7bf324",
+		TopicArn:  "arn:aws:sns:eu-west-1:123456789012:notifications",
+		Subject:   "Amazon S3 Notification",
+		Message:   message,
+		Timestamp: "2022-06-01T00:00:00.000Z",
+	})
+	if err != nil {
+		panic(err)
+	}
+	return string(content)
+}
+
+func TestUnwrap(t *testing.T) {
+	tests := []struct {
+		body     string
+		expected []string
+		topic    string
+	}{
+		{
+			body:     `plain line`,
+			expected: []string{`plain line`},
+		},
+		{
+			body:     `{"level": "info", "msg": "json line"}`,
+			expected: []string{`{"level": "info", "msg": "json line"}`},
+		},
+		{
+			body:     `{"Records": [{"eventSource": "aws:dynamodb"}]}`,
+			expected: []string{`{"Records": [{"eventSource": "aws:dynamodb"}]}`},
+		},
+		{
+			body:     s3Event,
+			expected: []string{`{"eventVersion":"2.1","eventSource":"aws:s3","eventName":"ObjectCreated:Put","s3":{"object":{"key":"a.log"}}}`, `{"eventVersion":"2.1","eventSource":"aws:s3","eventName":"ObjectRemoved:Delete","s3":{"object":{"key":"b.log"}}}`},
+		},
+		{
+			body:     `{"Service": "Amazon S3", "Event": "s3:TestEvent", "Bucket": "logs"}`,
+			expected: []string{},
+		},
+		{
+			body:     snsEnvelope("plain message"),
+			expected: []string{"plain message"},
+			topic:    "arn:aws:sns:eu-west-1:123456789012:notifications",
+		},
+		{
+			body:     snsEnvelope(s3Event),
+			expected: []string{`{"eventVersion":"2.1","eventSource":"aws:s3","eventName":"ObjectCreated:Put","s3":{"object":{"key":"a.log"}}}`, `{"eventVersion":"2.1","eventSource":"aws:s3","eventName":"ObjectRemoved:Delete","s3":{"object":{"key":"b.log"}}}`},
+			topic:    "arn:aws:sns:eu-west-1:123456789012:notifications",
+		},
+	}
+	for _, test := range tests {
+		lines, meta := unwrap(test.body)
+		assert.Equal(t, test.expected, lines, test.body)
+		if test.topic == "" {
+			assert.Empty(t, meta)
+		} else {
+			assert.Equal(t, test.topic, meta["sns_topic_arn"])
+			assert.Equal(t, "Amazon S3 Notification", meta["sns_subject"])
+		}
+	}
+}
+
+// fakeQueue is a queue whose batches are received in order
+type fakeQueue struct {
+	lock       sync.Mutex
+	batches    [][]*sqs.Message
+	receives   []sqs.ReceiveMessageInput
+	deleted    []string
+	visibility []string
+}
+
+func (q *fakeQueue) push(messages ...*sqs.Message) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.batches = append(q.batches, messages)
+}
+
+func (q *fakeQueue) GetQueueUrl(input *sqs.GetQueueUrlInput) (*sqs.GetQueueUrlOutput, error) {
+	if aws.StringValue(input.QueueName) != "logs" {
+		return nil, awserr.New(sqs.ErrCodeQueueDoesNotExist, "The specified queue does not exist for this wsdl version.", nil)
+	}
+	return &sqs.GetQueueUrlOutput{QueueUrl: aws.String("https://sqs.eu-west-1.amazonaws.com/123456789012/logs")}, nil
+}
+
+func (q *fakeQueue) ReceiveMessageWithContext(ctx aws.Context, input *sqs.ReceiveMessageInput, opts ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	q.lock.Lock()
+	q.receives = append(q.receives, *input)
+	if len(q.batches) == 0 {
+		q.lock.Unlock()
+		select {
+		case <-ctx.Done():
+			return nil, awserr.New(request.CanceledErrorCode, "request context canceled", ctx.Err())
+		case <-time.After(10 * time.Millisecond):
+		}
+		return &sqs.ReceiveMessageOutput{}, nil
+	}
+	defer q.lock.Unlock()
+	batch := q.batches[0]
+	q.batches = q.batches[1:]
+	return &sqs.ReceiveMessageOutput{Messages: batch}, nil
+}
+
+func (q *fakeQueue) DeleteMessageBatch(input *sqs.DeleteMessageBatchInput) (*sqs.DeleteMessageBatchOutput, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for _, entry := range input.Entries {
+		q.deleted = append(q.deleted, aws.StringValue(entry.ReceiptHandle))
+	}
+	return &sqs.DeleteMessageBatchOutput{}, nil
+}
+
+func (q *fakeQueue) ChangeMessageVisibilityBatch(input *sqs.ChangeMessageVisibilityBatchInput) (*sqs.ChangeMessageVisibilityBatchOutput, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for _, entry := range input.Entries {
+		q.visibility = append(q.visibility, fmt.Sprintf("%s:%d", aws.StringValue(entry.ReceiptHandle), aws.Int64Value(entry.VisibilityTimeout)))
+	}
+	return &sqs.ChangeMessageVisibilityBatchOutput{}, nil
+}
+
+// state returns the receipt handles of the messages deleted, and the visibility changes
+func (q *fakeQueue) state() ([]string, []string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return append([]string{}, q.deleted...), append([]string{}, q.visibility...)
+}
+
+// waitDeleted waits until count messages are deleted
+func (q *fakeQueue) waitDeleted(t *testing.T, count int) {
+	for i := 0; i < 200; i++ {
+		if deleted, _ := q.state(); len(deleted) >= count {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timeout waiting for %d deleted messages", count)
+}
+
+func message(id string, body string) *sqs.Message {
+	return &sqs.Message{
+		MessageId:     aws.String(id),
+		ReceiptHandle: aws.String("rh-" + id),
+		Body:          aws.String(body),
+		Attributes: map[string]*string{
+			sqs.MessageSystemAttributeNameSentTimestamp:           aws.String(strconv.FormatInt(time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC).UnixNano()/int64(time.Millisecond), 10)),
+			sqs.MessageSystemAttributeNameApproximateReceiveCount: aws.String("1"),
+		},
+		MessageAttributes: map[string]*sqs.MessageAttributeValue{
+			"env": {DataType: aws.String("String"), StringValue: aws.String("prod")},
+		},
+	}
+}
+
+func readEvents(t *testing.T, out chan types.Event, expected []string) []types.Event {
+	ret := []types.Event{}
+	for _, line := range expected {
+		select {
+		case evt := <-out:
+			assert.Equal(t, line, evt.Line.Raw)
+			ret = append(ret, evt)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout waiting for %s", line)
+		}
+	}
+	return ret
+}
+
+func TestStreamingAcquisition(t *testing.T) {
+	s := SQSSource{}
+	require.NoError(t, s.Configure([]byte(`
+queue_name: logs
+aws_region: eu-west-1
+visibility_timeout: 2s
+labels:
+  type: cloudtrail`), log.WithField("type", "sqs")))
+	queue := &fakeQueue{}
+	s.client = queue
+	queue.push(message("1", "line 1"), message("2", snsEnvelope(s3Event)))
+	queue.push(message("3", `{"Service": "Amazon S3", "Event": "s3:TestEvent"}`))
+
+	out := make(chan types.Event)
+	tmb := tomb.Tomb{}
+	require.NoError(t, s.StreamingAcquisition(out, &tmb))
+	events := readEvents(t, out, []string{
+		"line 1",
+		`{"eventVersion":"2.1","eventSource":"aws:s3","eventName":"ObjectCreated:Put","s3":{"object":{"key":"a.log"}}}`,
+		`{"eventVersion":"2.1","eventSource":"aws:s3","eventName":"ObjectRemoved:Delete","s3":{"object":{"key":"b.log"}}}`,
+	})
+	assert.Equal(t, "logs", events[0].Line.Src)
+	assert.Equal(t, "cloudtrail", events[0].Line.Labels["type"])
+	assert.Equal(t, map[string]string{
+		"sqs_message_id":     "1",
+		"sqs_sent_timestamp": "2022-06-01T00:00:00Z",
+		"sqs_receive_count":  "1",
+		"sqs_attribute_env":  "prod",
+	}, events[0].Meta)
+	assert.Equal(t, "arn:aws:sns:eu-west-1:123456789012:notifications", events[1].Meta["sns_topic_arn"])
+	assert.Equal(t, "2", events[2].Meta["sqs_message_id"])
+	//the test event of the notifications has no record, it is only deleted
+	queue.waitDeleted(t, 3)
+	deleted, _ := queue.state()
+	assert.Equal(t, []string{"rh-1", "rh-2", "rh-3"}, deleted)
+
+	//the messages sent are deleted before the visibility timeout expires, the others are extended
+	queue.push(message("4", "line 4"), message("5", "line 5"))
+	readEvents(t, out, []string{"line 4"})
+	time.Sleep(1500 * time.Millisecond)
+	readEvents(t, out, []string{"line 5"})
+	queue.waitDeleted(t, 5)
+	deleted, visibility := queue.state()
+	assert.Equal(t, []string{"rh-1", "rh-2", "rh-3", "rh-4", "rh-5"}, deleted)
+	assert.Equal(t, []string{"rh-5:2"}, visibility)
+
+	//the messages not sent when stopping are available again
+	queue.push(message("6", "line 6"), message("7", "line 7"))
+	time.Sleep(100 * time.Millisecond)
+	tmb.Kill(nil)
+	require.NoError(t, tmb.Wait())
+	deleted, visibility = queue.state()
+	assert.Len(t, deleted, 5)
+	assert.Equal(t, []string{"rh-5:2", "rh-6:0", "rh-7:0"}, visibility)
+
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	input := queue.receives[0]
+	assert.Equal(t, "https://sqs.eu-west-1.amazonaws.com/123456789012/logs", aws.StringValue(input.QueueUrl))
+	assert.Equal(t, int64(10), aws.Int64Value(input.MaxNumberOfMessages))
+	assert.Equal(t, int64(20), aws.Int64Value(input.WaitTimeSeconds))
+	assert.Equal(t, int64(2), aws.Int64Value(input.VisibilityTimeout))
+}
+
+func TestUnknownQueue(t *testing.T) {
+	s := SQSSource{}
+	require.NoError(t, s.Configure([]byte(`
+queue_name: unknown
+aws_region: eu-west-1`), log.WithField("type", "sqs")))
+	s.client = &fakeQueue{}
+	tmb := tomb.Tomb{}
+	require.NoError(t, s.StreamingAcquisition(make(chan types.Event), &tmb))
+	cstest.AssertErrorContains(t, tmb.Wait(), "while looking up queue unknown: AWS.SimpleQueueService.NonExistentQueue")
+}
@@ -1,8 +1,14 @@
 package syslogserver
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
+	"strconv"
 	"strings"
 	"time"
 
@@ -16,6 +22,7 @@ type SyslogServer struct {
 	port          int
 	channel       chan SyslogMessage
 	udpConn       *net.UDPConn
+	tlsListener   net.Listener
 	Logger        *log.Entry
 	MaxMessageLen int
 }
@@ -23,6 +30,7 @@ type SyslogServer struct {
 type SyslogMessage struct {
 	Message []byte
 	Client  string
+	Peer    string //common name of the client certificate (TLS)
 }
 
 func (s *SyslogServer) Listen(listenAddr string, port int) error {
@@ -50,6 +58,19 @@ func (s *SyslogServer) Listen(listenAddr string, port int) error {
 	return nil
 }
 
+// ListenTLS listens for syslog over TLS (RFC5425) connections
+func (s *SyslogServer) ListenTLS(listenAddr string, port int, config *tls.Config) error {
+	s.listenAddr = listenAddr
+	s.port = port
+	listener, err := tls.Listen("tcp", net.JoinHostPort(s.listenAddr, strconv.Itoa(s.port)), config)
+	if err != nil {
+		return errors.Wrapf(err, "could not listen on port %d", s.port)
+	}
+	s.Logger.Debugf("listening on %s:%d (tls)", s.listenAddr, s.port)
+	s.tlsListener = listener
+	return nil
+}
+
 func (s *SyslogServer) SetChannel(c chan SyslogMessage) {
 	s.channel = c
 }
@@ -57,6 +78,13 @@ func (s *SyslogServer) SetChannel(c chan SyslogMessage) {
 func (s *SyslogServer) StartServer() *tomb.Tomb {
 	t := tomb.Tomb{}
 
+	if s.tlsListener != nil {
+		t.Go(func() error {
+			return s.serveTLS(&t)
+		})
+		return &t
+	}
+
 	t.Go(func() error {
 		for {
 			select {
@@ -87,7 +115,123 @@ func (s *SyslogServer) StartServer() *tomb.Tomb {
 	return &t
 }
 
+func (s *SyslogServer) serveTLS(t *tomb.Tomb) error {
+	t.Go(func() error {
+		<-t.Dying()
+		s.Logger.Info("Syslog server tomb is dying")
+		return s.KillServer()
+	})
+	for {
+		conn, err := s.tlsListener.Accept()
+		if err != nil {
+			select {
+			case <-t.Dying():
+				return nil
+			default:
+			}
+			s.Logger.Errorf("error while accepting connection : %s", err)
+			return err
+		}
+		t.Go(func() error {
+			s.handleTLSConn(conn.(*tls.Conn), t)
+			return nil
+		})
+	}
+}
+
+func (s *SyslogServer) handleTLSConn(conn *tls.Conn, t *tomb.Tomb) {
+	done := make(chan struct{})
+	defer close(done)
+	//unblock the reads when the server stops
+	go func() {
+		select {
+		case <-t.Dying():
+		case <-done:
+		}
+		conn.Close()
+	}()
+	client, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		client = conn.RemoteAddr().String()
+	}
+	logger := s.Logger.WithField("client", client)
+	if err := conn.Handshake(); err != nil {
+		logger.Warningf("TLS handshake failed : %s", err)
+		return
+	}
+	peer := ""
+	if certs := conn.ConnectionState().PeerCertificates; len(certs) > 0 {
+		peer = certs[0].Subject.CommonName
+	}
+	logger.Debugf("new connection (peer: '%s')", peer)
+	reader := bufio.NewReader(conn)
+	for {
+		msg, err := readFrame(reader, s.MaxMessageLen)
+		if err != nil {
+			if err != io.EOF {
+				logger.Debugf("closing connection : %s", err)
+			}
+			return
+		}
+		if len(msg) == 0 {
+			continue
+		}
+		select {
+		case s.channel <- SyslogMessage{Message: msg, Client: client, Peer: peer}:
+		case <-t.Dying():
+			return
+		}
+	}
+}
+
+// readFrame reads a message framed with octet counting ("MSG-LEN SP SYSLOG-MSG", RFC5425), or terminated by a
+// newline (non-transparent framing, RFC6587) if it doesn't start with a digit. Messages are truncated to maxLen
+func readFrame(reader *bufio.Reader, maxLen int) ([]byte, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] < '1' || first[0] > '9' {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && len(line) == 0 {
+			return nil, err
+		}
+		line = bytes.TrimRight(line, "\r\n")
+		if len(line) > maxLen {
+			line = line[:maxLen]
+		}
+		return line, nil
+	}
+	header, err := reader.ReadString(' ')
+	if err != nil {
+		return nil, err
+	}
+	msgLen, err := strconv.Atoi(strings.TrimSuffix(header, " "))
+	if err != nil || msgLen <= 0 {
+		return nil, fmt.Errorf("invalid message length '%s'", strings.TrimSuffix(header, " "))
+	}
+	readLen := msgLen
+	if readLen > maxLen {
+		readLen = maxLen
+	}
+	msg := make([]byte, readLen)
+	if _, err := io.ReadFull(reader, msg); err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(ioutil.Discard, reader, int64(msgLen-readLen)); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
 func (s *SyslogServer) KillServer() error {
+	if s.tlsListener != nil {
+		//the connections may still be sending, the channel is left open
+		if err := s.tlsListener.Close(); err != nil {
+			return errors.Wrap(err, "could not close TLS listener")
+		}
+		return nil
+	}
 	err := s.udpConn.Close()
 	if err != nil {
 		return errors.Wrap(err, "could not close UDP connection")
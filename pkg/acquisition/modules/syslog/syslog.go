@@ -1,7 +1,10 @@
 package syslogacquisition
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"strconv"
 	"time"
@@ -20,19 +23,41 @@ import (
 	"gopkg.in/yaml.v2"
 )
 
+const (
+	SYSLOG_PROTO_UDP = "udp"
+	SYSLOG_PROTO_TLS = "tls"
+
+	SYSLOG_CLIENT_AUTH_NONE     = "none"
+	SYSLOG_CLIENT_AUTH_OPTIONAL = "optional"
+	SYSLOG_CLIENT_AUTH_REQUIRED = "required"
+)
+
+type SyslogTLSConfiguration struct {
+	CertFile   string `yaml:"cert_file"`
+	KeyFile    string `yaml:"key_file"`
+	CAFile     string `yaml:"ca_file"`
+	ClientAuth string `yaml:"client_auth"`
+	//labels added to the lines sent by a peer, by common name of the client certificate
+	PeerLabels map[string]map[string]string `yaml:"peer_labels"`
+}
+
 type SyslogConfiguration struct {
-	Proto                             string `yaml:"protocol,omitempty"`
-	Port                              int    `yaml:"listen_port,omitempty"`
-	Addr                              string `yaml:"listen_addr,omitempty"`
-	MaxMessageLen                     int    `yaml:"max_message_len,omitempty"`
+	Proto                             string                  `yaml:"protocol,omitempty"`
+	Port                              int                     `yaml:"listen_port,omitempty"`
+	Addr                              string                  `yaml:"listen_addr,omitempty"`
+	MaxMessageLen                     int                     `yaml:"max_message_len,omitempty"`
+	TLS                               *SyslogTLSConfiguration `yaml:"tls,omitempty"`
 	configuration.DataSourceCommonCfg `yaml:",inline"`
 }
 
 type SyslogSource struct {
+	configuration.HealthTracker
 	config     SyslogConfiguration
 	logger     *log.Entry
 	server     *syslogserver.SyslogServer
 	serverTomb *tomb.Tomb
+	tlsConfig  *tls.Config
+	peerLabels map[string]map[string]string
 }
 
 var linesReceived = prometheus.NewCounterVec(
@@ -53,6 +78,10 @@ func (s *SyslogSource) GetName() string {
 	return "syslog"
 }
 
+func (s *SyslogSource) GetUuid() string {
+	return s.config.UniqueId
+}
+
 func (s *SyslogSource) GetMode() string {
 	return s.config.Mode
 }
@@ -101,8 +130,14 @@ func (s *SyslogSource) Configure(yamlConfig []byte, logger *log.Entry) error {
 	if syslogConfig.Addr == "" {
 		syslogConfig.Addr = "127.0.0.1" //do we want a usable or secure default ?
 	}
+	if syslogConfig.Proto == "" {
+		syslogConfig.Proto = SYSLOG_PROTO_UDP
+	}
 	if syslogConfig.Port == 0 {
 		syslogConfig.Port = 514
+		if syslogConfig.Proto == SYSLOG_PROTO_TLS {
+			syslogConfig.Port = 6514
+		}
 	}
 	if syslogConfig.MaxMessageLen == 0 {
 		syslogConfig.MaxMessageLen = 2048
@@ -113,15 +148,92 @@ func (s *SyslogSource) Configure(yamlConfig []byte, logger *log.Entry) error {
 	if !validateAddr(syslogConfig.Addr) {
 		return fmt.Errorf("invalid listen IP %s", syslogConfig.Addr)
 	}
+	switch syslogConfig.Proto {
+	case SYSLOG_PROTO_UDP:
+		if syslogConfig.TLS != nil {
+			return fmt.Errorf("tls configuration requires protocol: %s", SYSLOG_PROTO_TLS)
+		}
+	case SYSLOG_PROTO_TLS:
+		if err := s.configureTLS(syslogConfig.TLS, syslogConfig.Labels); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid protocol %s (must be %s or %s)", syslogConfig.Proto, SYSLOG_PROTO_UDP, SYSLOG_PROTO_TLS)
+	}
 	s.config = syslogConfig
 	return nil
 }
 
+func (s *SyslogSource) configureTLS(config *SyslogTLSConfiguration, labels map[string]string) error {
+	if config == nil || config.CertFile == "" || config.KeyFile == "" {
+		return fmt.Errorf("tls.cert_file and tls.key_file are required with protocol: %s", SYSLOG_PROTO_TLS)
+	}
+	cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return errors.Wrap(err, "could not load server certificate")
+	}
+	s.tlsConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if config.ClientAuth == "" {
+		config.ClientAuth = SYSLOG_CLIENT_AUTH_NONE
+		if config.CAFile != "" {
+			config.ClientAuth = SYSLOG_CLIENT_AUTH_REQUIRED
+		}
+	}
+	switch config.ClientAuth {
+	case SYSLOG_CLIENT_AUTH_NONE:
+		s.tlsConfig.ClientAuth = tls.NoClientCert
+	case SYSLOG_CLIENT_AUTH_OPTIONAL:
+		s.tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case SYSLOG_CLIENT_AUTH_REQUIRED:
+		s.tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return fmt.Errorf("invalid tls.client_auth %s (must be %s, %s or %s)", config.ClientAuth,
+			SYSLOG_CLIENT_AUTH_NONE, SYSLOG_CLIENT_AUTH_OPTIONAL, SYSLOG_CLIENT_AUTH_REQUIRED)
+	}
+	if s.tlsConfig.ClientAuth != tls.NoClientCert {
+		if config.CAFile == "" {
+			return fmt.Errorf("tls.ca_file is required to verify client certificates")
+		}
+		caCert, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return errors.Wrap(err, "could not read CA file")
+		}
+		caPool := x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(caCert) {
+			return fmt.Errorf("no certificate found in %s", config.CAFile)
+		}
+		s.tlsConfig.ClientCAs = caPool
+	} else if len(config.PeerLabels) > 0 {
+		return fmt.Errorf("tls.peer_labels requires client certificates")
+	}
+	//merge the labels once, the peer labels take precedence
+	s.peerLabels = make(map[string]map[string]string, len(config.PeerLabels))
+	for peer, peerLabels := range config.PeerLabels {
+		merged := make(map[string]string, len(labels)+len(peerLabels))
+		for k, v := range labels {
+			merged[k] = v
+		}
+		for k, v := range peerLabels {
+			merged[k] = v
+		}
+		s.peerLabels[peer] = merged
+	}
+	return nil
+}
+
 func (s *SyslogSource) StreamingAcquisition(out chan types.Event, t *tomb.Tomb) error {
 	c := make(chan syslogserver.SyslogMessage)
 	s.server = &syslogserver.SyslogServer{Logger: s.logger.WithField("syslog", "internal"), MaxMessageLen: s.config.MaxMessageLen}
 	s.server.SetChannel(c)
-	err := s.server.Listen(s.config.Addr, s.config.Port)
+	var err error
+	if s.config.Proto == SYSLOG_PROTO_TLS {
+		err = s.server.ListenTLS(s.config.Addr, s.config.Port, s.tlsConfig)
+	} else {
+		err = s.server.Listen(s.config.Addr, s.config.Port)
+	}
 	if err != nil {
 		return errors.Wrap(err, "could not start syslog server")
 	}
@@ -191,6 +303,9 @@ func (s *SyslogSource) handleSyslogMsg(out chan types.Event, t *tomb.Tomb, c cha
 			}
 		case <-s.serverTomb.Dead():
 			s.logger.Info("Syslog server has exited")
+			if !killed {
+				s.SetState(configuration.STATUS_ERRORED, fmt.Errorf("syslog server has exited"))
+			}
 			return nil
 		case syslogLine := <-c:
 			var line string
@@ -235,9 +350,13 @@ func (s *SyslogSource) handleSyslogMsg(out chan types.Event, t *tomb.Tomb, c cha
 			l.Raw = line
 			l.Module = s.GetName()
 			l.Labels = s.config.Labels
+			if labels, ok := s.peerLabels[syslogLine.Peer]; ok {
+				l.Labels = labels
+			}
 			l.Time = ts
 			l.Src = syslogLine.Client
 			l.Process = true
+			s.EventSeen(&l)
 			if !s.config.UseTimeMachine {
 				out <- types.Event{Line: l, Process: true, Type: types.LOG, ExpectMode: leaky.LIVE}
 			} else {
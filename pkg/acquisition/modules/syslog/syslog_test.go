@@ -1,8 +1,17 @@
 package syslogacquisition
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
+	"io/ioutil"
+	"math/big"
 	"net"
+	"path/filepath"
 	"runtime"
 	"testing"
 	"time"
@@ -48,6 +57,34 @@ source: syslog
 listen_addr: 10.0.0`,
 			expectedErr: "invalid listen IP 10.0.0",
 		},
+		{
+			config: `
+source: syslog
+protocol: tcp`,
+			expectedErr: "invalid protocol tcp",
+		},
+		{
+			config: `
+source: syslog
+tls:
+  cert_file: server.crt`,
+			expectedErr: "tls configuration requires protocol: tls",
+		},
+		{
+			config: `
+source: syslog
+protocol: tls`,
+			expectedErr: "tls.cert_file and tls.key_file are required",
+		},
+		{
+			config: `
+source: syslog
+protocol: tls
+tls:
+  cert_file: /does/not/exist.crt
+  key_file: /does/not/exist.key`,
+			expectedErr: "could not load server certificate",
+		},
 	}
 
 	subLogger := log.WithFields(log.Fields{
@@ -148,3 +185,121 @@ listen_addr: 127.0.0.1`,
 		tomb.Wait()
 	}
 }
+
+func writeCert(t *testing.T, dir string, name string, template *x509.Certificate, parent *x509.Certificate, parentKey *rsa.PrivateKey) (*x509.Certificate, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestTLSAcquisition(t *testing.T) {
+	dir := t.TempDir()
+	notAfter := time.Now().Add(time.Hour)
+	ca, caKey := writeCert(t, dir, "ca", &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "syslog-ca"},
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	writeCert(t, dir, "server", &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	writeCert(t, dir, "client", &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "web01"},
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	config := fmt.Sprintf(`
+source: syslog
+protocol: tls
+listen_port: 4243
+listen_addr: 127.0.0.1
+labels:
+  type: syslog
+  env: prod
+tls:
+  cert_file: %[1]s/server.crt
+  key_file: %[1]s/server.key
+  ca_file: %[1]s/ca.crt
+  peer_labels:
+    web01:
+      env: staging`, dir)
+	subLogger := log.WithFields(log.Fields{
+		"type": "syslog",
+	})
+	s := SyslogSource{}
+	err := s.Configure([]byte(config), subLogger)
+	if err != nil {
+		t.Fatalf("unexpected error : %s", err)
+	}
+	tomb := tomb.Tomb{}
+	out := make(chan types.Event)
+	err = s.StreamingAcquisition(out, &tomb)
+	if err != nil {
+		t.Fatalf("unexpected error : %s", err)
+	}
+
+	caPool := x509.NewCertPool()
+	caPool.AddCert(ca)
+	clientCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	//a client without certificate is rejected
+	conn, err := tls.Dial("tcp", "127.0.0.1:4243", &tls.Config{RootCAs: caPool})
+	if err == nil {
+		fmt.Fprint(conn, "13 <13>May 18 12:37:56 mantis sshd: rejected\n")
+		conn.Close()
+	}
+
+	conn, err = tls.Dial("tcp", "127.0.0.1:4243", &tls.Config{RootCAs: caPool, Certificates: []tls.Certificate{clientCert}})
+	if err != nil {
+		t.Fatalf("unexpected error : %s", err)
+	}
+	msgs := []string{`<13>May 18 12:37:56 mantis sshd[49340]: octet counted`, `<13>May 18 12:37:56 mantis sshd[49340]: with a newline`}
+	fmt.Fprintf(conn, "%d %s", len(msgs[0]), msgs[0])
+	fmt.Fprintf(conn, "%s\n", msgs[1])
+
+	for _, expected := range []string{"octet counted", "with a newline"} {
+		select {
+		case evt := <-out:
+			assert.Contains(t, evt.Line.Raw, expected)
+			assert.Equal(t, "127.0.0.1", evt.Line.Src)
+			assert.Equal(t, map[string]string{"type": "syslog", "env": "staging"}, evt.Line.Labels)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout waiting for '%s'", expected)
+		}
+	}
+	conn.Close()
+	tomb.Kill(nil)
+	tomb.Wait()
+}
@@ -0,0 +1,463 @@
+package victorialogsacquisition
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/cursors"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/retry"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/secrets"
+	leaky "github.com/crowdsecurity/crowdsec/pkg/leakybucket"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/tomb.v2"
+	"gopkg.in/yaml.v2"
+)
+
+var linesRead = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cs_victorialogs_hits_total",
+		Help: "Total log entries that were read from VictoriaLogs.",
+	},
+	[]string{"url"})
+
+var defaultTimeout = 30 * time.Second
+
+const (
+	defaultMessageField = "_msg"
+	maxEntrySize        = 1024 * 1024
+)
+
+type VictoriaLogsConfiguration struct {
+	configuration.DataSourceCommonCfg `yaml:",inline"`
+	URL                               string         `yaml:"url"`           //eg. http://localhost:9428
+	Query                             string         `yaml:"query"`         //LogsQL query, eg. _stream:{app="nginx"}, all the logs if empty
+	MessageField                      string         `yaml:"message_field"` //field holding the log line, _msg by default
+	Since                             string         `yaml:"since"`         //RFC3339 date, or duration before now (eg. 1h). Tail mode starts now by default
+	Until                             string         `yaml:"until"`         //cat mode only
+	Timeout                           *time.Duration `yaml:"timeout"`       //how long to wait for the server to answer
+	AccountID                         string         `yaml:"account_id"`    //tenant of the logs, in multi-tenant setups
+	ProjectID                         string         `yaml:"project_id"`
+	Username                          string         `yaml:"username"`
+	Password                          string         `yaml:"password"`     //can be env://, file:// or vault:// references, like bearer_token
+	BearerToken                       string         `yaml:"bearer_token"` //when VictoriaLogs is behind an authenticating proxy (ie. vmauth)
+	CACert                            string         `yaml:"ca_cert"`
+	InsecureSkipVerify                bool           `yaml:"insecure_skip_verify"`
+}
+
+// VictoriaLogsSource runs a LogsQL query (cat mode) or follows its results with the tail endpoint (tail mode). The
+// time of the last entry read is saved as a cursor, and the tail restarts from it after a disconnection or a restart
+type VictoriaLogsSource struct {
+	configuration.HealthTracker
+	config   VictoriaLogsConfiguration
+	logger   *log.Entry
+	client   *http.Client
+	retrier  *retry.Retrier
+	auth     func(*http.Request)
+	from     time.Time
+	until    time.Time
+	last     time.Time //time of the last entry read
+	cursorId string
+}
+
+func (v *VictoriaLogsSource) GetMetrics() []prometheus.Collector {
+	return []prometheus.Collector{linesRead}
+}
+
+func (v *VictoriaLogsSource) GetAggregMetrics() []prometheus.Collector {
+	return []prometheus.Collector{linesRead}
+}
+
+func (v *VictoriaLogsSource) Configure(yamlConfig []byte, logger *log.Entry) error {
+	v.logger = logger
+	config := VictoriaLogsConfiguration{}
+	if err := yaml.UnmarshalStrict(yamlConfig, &config); err != nil {
+		return errors.Wrap(err, "Cannot parse victorialogs datasource configuration")
+	}
+	if config.Mode == "" {
+		config.Mode = configuration.TAIL_MODE
+	}
+	return v.configure(config)
+}
+
+// configure checks the configuration and sets the defaults, for Configure and ConfigureByDSN
+func (v *VictoriaLogsSource) configure(config VictoriaLogsConfiguration) error {
+	if config.Mode != configuration.CAT_MODE && config.Mode != configuration.TAIL_MODE {
+		return fmt.Errorf("unsupported mode %s for victorialogs datasource", config.Mode)
+	}
+	if config.URL == "" {
+		return fmt.Errorf("url is mandatory")
+	}
+	if _, err := url.Parse(config.URL); err != nil {
+		return errors.Wrapf(err, "invalid url %s", config.URL)
+	}
+	config.URL = strings.TrimSuffix(config.URL, "/")
+	if config.Query == "" {
+		config.Query = "*"
+	}
+	if config.MessageField == "" {
+		config.MessageField = defaultMessageField
+	}
+	if config.Timeout == nil {
+		config.Timeout = &defaultTimeout
+	}
+	var err error
+	if v.from, err = configuration.ParseTime(config.Since); err != nil {
+		return errors.Wrap(err, "invalid since")
+	}
+	if v.until, err = configuration.ParseTime(config.Until); err != nil {
+		return errors.Wrap(err, "invalid until")
+	}
+	if !v.until.IsZero() && config.Mode == configuration.TAIL_MODE {
+		return fmt.Errorf("until is only supported in %s mode", configuration.CAT_MODE)
+	}
+	if err := v.configureAuth(config); err != nil {
+		return err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	//the responses are streamed : only the wait for the server is bounded
+	transport.ResponseHeaderTimeout = *config.Timeout
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify}
+	if config.CACert != "" {
+		pem, err := ioutil.ReadFile(config.CACert)
+		if err != nil {
+			return errors.Wrapf(err, "while reading ca_cert %s", config.CACert)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in ca_cert %s", config.CACert)
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+	v.client = &http.Client{Transport: transport}
+	v.retrier, err = retry.New(config.Retry, v.logger)
+	if err != nil {
+		return err
+	}
+	v.retrier.Notify = v.notifyRetry
+	v.cursorId = config.URL + "?" + config.Query
+	v.config = config
+	return nil
+}
+
+func (v *VictoriaLogsSource) configureAuth(config VictoriaLogsConfiguration) error {
+	if config.BearerToken != "" && (config.Username != "" || config.Password != "") {
+		return fmt.Errorf("bearer_token and username/password are mutually exclusive")
+	}
+	if config.BearerToken != "" {
+		token, err := secrets.NewSecret(config.BearerToken, v.logger)
+		if err != nil {
+			return errors.Wrap(err, "invalid bearer_token")
+		}
+		v.auth = func(req *http.Request) {
+			req.Header.Set("Authorization", "Bearer "+token.Get())
+		}
+	}
+	if config.Username != "" {
+		password, err := secrets.NewSecret(config.Password, v.logger)
+		if err != nil {
+			return errors.Wrap(err, "invalid password")
+		}
+		v.auth = func(req *http.Request) {
+			req.SetBasicAuth(config.Username, password.Get())
+		}
+	}
+	return nil
+}
+
+// notifyRetry reports the failing queries in the health of the datasource
+func (v *VictoriaLogsSource) notifyRetry(err error) {
+	if err != nil {
+		v.SetState(configuration.STATUS_RECONNECTING, err)
+	} else {
+		v.SetState(configuration.STATUS_RUNNING, nil)
+	}
+}
+
+func (v *VictoriaLogsSource) ConfigureByDSN(dsn string, labels map[string]string, logger *log.Entry) error {
+	v.logger = logger
+	//format for the DSN is : victorialogs://host:port?query=...&since=...&until=...
+	parsed, err := configuration.ParseDSN(dsn, "victorialogs")
+	if err != nil {
+		return err
+	}
+	if parsed.Target == "" {
+		return fmt.Errorf("empty victorialogs:// DSN")
+	}
+	if err := parsed.CheckParams("scheme", "query", "since", "until", "message_field", "account_id", "project_id",
+		"username", "password", "bearer_token", "insecure_skip_verify"); err != nil {
+		return err
+	}
+	if err := parsed.SetLogLevel(v.logger); err != nil {
+		return err
+	}
+	config := VictoriaLogsConfiguration{}
+	config.Mode = configuration.CAT_MODE
+	config.Labels = labels
+	scheme := "http"
+	for key, value := range map[string]*string{
+		"scheme":        &scheme,
+		"query":         &config.Query,
+		"since":         &config.Since,
+		"until":         &config.Until,
+		"message_field": &config.MessageField,
+		"account_id":    &config.AccountID,
+		"project_id":    &config.ProjectID,
+		"username":      &config.Username,
+		"password":      &config.Password,
+		"bearer_token":  &config.BearerToken,
+	} {
+		param, err := parsed.Param(key)
+		if err != nil {
+			return err
+		}
+		if param != "" {
+			*value = param
+		}
+	}
+	if insecure, err := parsed.Param("insecure_skip_verify"); err != nil {
+		return err
+	} else if insecure != "" {
+		if config.InsecureSkipVerify, err = strconv.ParseBool(insecure); err != nil {
+			return fmt.Errorf("parsing 'insecure_skip_verify' parameters: %s", err)
+		}
+	}
+	config.URL = scheme + "://" + parsed.Target
+	return v.configure(config)
+}
+
+func (v *VictoriaLogsSource) GetMode() string {
+	return v.config.Mode
+}
+
+func (v *VictoriaLogsSource) GetName() string {
+	return "victorialogs"
+}
+
+func (v *VictoriaLogsSource) GetUuid() string {
+	return v.config.UniqueId
+}
+
+func (v *VictoriaLogsSource) CanRun() error {
+	return nil
+}
+
+func (v *VictoriaLogsSource) Dump() interface{} {
+	return v
+}
+
+// request calls an endpoint of the LogsQL api, and returns the response if it succeeded
+func (v *VictoriaLogsSource) request(ctx context.Context, path string, params url.Values) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.config.URL+path, strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, retry.Permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if v.config.AccountID != "" {
+		req.Header.Set("AccountID", v.config.AccountID)
+	}
+	if v.config.ProjectID != "" {
+		req.Header.Set("ProjectID", v.config.ProjectID)
+	}
+	if v.auth != nil {
+		v.auth(req)
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := retry.CheckResponse(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+// readEntries sends the entries of a response, one json object per line. The entries up to skipUntil were
+// already read before a reconnection, and are skipped
+func (v *VictoriaLogsSource) readEntries(body io.Reader, out chan types.Event, dying <-chan struct{}, expectMode int, skipUntil time.Time) error {
+	hits := linesRead.With(prometheus.Labels{"url": v.config.URL})
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), maxEntrySize)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		entry := map[string]string{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			v.logger.Warningf("skipping invalid entry : %s", err)
+			continue
+		}
+		entryTime, err := time.Parse(time.RFC3339Nano, entry["_time"])
+		if err == nil && !skipUntil.IsZero() && !entryTime.After(skipUntil) {
+			continue
+		}
+		msg, ok := entry[v.config.MessageField]
+		if !ok {
+			v.logger.Debugf("skipping entry without %s field", v.config.MessageField)
+			continue
+		}
+		l := types.Line{}
+		l.Raw = msg
+		l.Src = entry["_stream"]
+		if l.Src == "" {
+			l.Src = v.config.URL
+		}
+		l.Time = time.Now().UTC()
+		l.Labels = v.config.Labels
+		l.Process = true
+		l.Module = v.GetName()
+		hits.Inc()
+		v.EventSeen(&l)
+		select {
+		case out <- types.Event{Line: l, Process: true, Type: types.LOG, ExpectMode: expectMode}:
+		case <-dying:
+			return nil
+		}
+		if entryTime.After(v.last) {
+			v.last = entryTime
+		}
+	}
+	return scanner.Err()
+}
+
+func (v *VictoriaLogsSource) OneShotAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-t.Dying():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	params := url.Values{"query": {v.config.Query + " | sort by (_time)"}}
+	if !v.from.IsZero() {
+		params.Set("start", v.from.Format(time.RFC3339Nano))
+	}
+	if !v.until.IsZero() {
+		params.Set("end", v.until.Format(time.RFC3339Nano))
+	}
+	v.logger.Infof("running query %s on %s", v.config.Query, v.config.URL)
+	var resp *http.Response
+	err := v.retrier.Do(t.Dying(), func() error {
+		var err error
+		resp, err = v.request(ctx, "/select/logsql/query", params)
+		return err
+	})
+	if err == retry.ErrDying {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "while querying %s", v.config.URL)
+	}
+	defer resp.Body.Close()
+	if err := v.readEntries(resp.Body, out, t.Dying(), leaky.TIMEMACHINE, time.Time{}); err != nil && ctx.Err() == nil {
+		return errors.Wrap(err, "while reading query results")
+	}
+	t.Kill(nil)
+	return nil
+}
+
+// loadCursor resumes after the last entry read before a restart, or starts now (or since)
+func (v *VictoriaLogsSource) loadCursor() {
+	value, err := cursors.LoadCursor(v.GetName(), v.cursorId)
+	if err != nil {
+		v.logger.Warningf("unable to load cursor of %s : %s", v.cursorId, err)
+	}
+	if value != "" {
+		if v.last, err = time.Parse(time.RFC3339Nano, value); err != nil {
+			v.logger.Warningf("invalid cursor %s for %s : %s", value, v.cursorId, err)
+		} else {
+			v.logger.Infof("resuming %s after %s", v.cursorId, value)
+			return
+		}
+	}
+	v.last = v.from
+}
+
+func (v *VictoriaLogsSource) saveCursor() {
+	if v.last.IsZero() {
+		return
+	}
+	if err := cursors.SaveCursor(v.GetName(), v.cursorId, v.last.Format(time.RFC3339Nano)); err != nil {
+		v.logger.Warningf("unable to save cursor of %s : %s", v.cursorId, err)
+	}
+}
+
+// follow tails the query until the server closes the connection. The tail starts far enough in the past to
+// include the entries that followed the last one read
+func (v *VictoriaLogsSource) follow(ctx context.Context, out chan types.Event, dying <-chan struct{}, expectMode int) error {
+	params := url.Values{"query": {v.config.Query}}
+	resumeAfter := v.last
+	if !resumeAfter.IsZero() {
+		params.Set("start_offset", fmt.Sprintf("%ds", int(time.Since(resumeAfter).Seconds())+1))
+	}
+	resp, err := v.request(ctx, "/select/logsql/tail", params)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	v.SetState(configuration.STATUS_RUNNING, nil)
+	err = v.readEntries(resp.Body, out, dying, expectMode, resumeAfter)
+	v.saveCursor()
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+func (v *VictoriaLogsSource) StreamingAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	v.loadCursor()
+	expectMode := leaky.LIVE
+	if v.config.UseTimeMachine {
+		expectMode = leaky.TIMEMACHINE
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Go(func() error {
+		defer types.CatchPanic("crowdsec/acquis/victorialogs/live")
+		defer cancel()
+		go func() {
+			<-t.Dying()
+			cancel()
+		}()
+		v.logger.Infof("following query %s on %s", v.config.Query, v.config.URL)
+		for {
+			err := v.retrier.Do(t.Dying(), func() error {
+				return v.follow(ctx, out, t.Dying(), expectMode)
+			})
+			if err == retry.ErrDying || ctx.Err() != nil {
+				v.logger.Infof("victorialogs datasource stopping")
+				return nil
+			}
+			if err != nil {
+				err = errors.Wrapf(err, "while following %s", v.config.URL)
+				v.SetState(configuration.STATUS_ERRORED, err)
+				return err
+			}
+			//the server closed the tail (ie. restart) : reconnect
+			v.logger.Infof("tail closed by %s, reconnecting", v.config.URL)
+			v.SetState(configuration.STATUS_RECONNECTING, nil)
+			select {
+			case <-t.Dying():
+				return nil
+			case <-time.After(v.retrier.Delay(1)):
+			}
+		}
+	})
+	return nil
+}
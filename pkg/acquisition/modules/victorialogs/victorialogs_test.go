@@ -0,0 +1,279 @@
+package victorialogsacquisition
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/cursors"
+	"github.com/crowdsecurity/crowdsec/pkg/cstest"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/tomb.v2"
+)
+
+// mockServer answers the queries with all its entries, and closes the tails once they are sent
+type mockServer struct {
+	lock     sync.Mutex
+	entries  []map[string]string
+	requests []*http.Request
+	token    string
+}
+
+func (m *mockServer) add(at time.Time, msg string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.entries = append(m.entries, map[string]string{
+		"_time":   at.UTC().Format(time.RFC3339Nano),
+		"_stream": `{app="nginx"}`,
+		"_msg":    msg,
+	})
+}
+
+func (m *mockServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if r.URL.Path != "/select/logsql/query" && r.URL.Path != "/select/logsql/tail" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer "+m.token {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	m.requests = append(m.requests, r)
+	encoder := json.NewEncoder(w)
+	for _, entry := range m.entries {
+		_ = encoder.Encode(entry)
+	}
+}
+
+func (m *mockServer) requestCount() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.requests)
+}
+
+func TestConfigure(t *testing.T) {
+	tests := []struct {
+		config      string
+		expectedErr string
+	}{
+		{
+			config:      `foobar: asd`,
+			expectedErr: "field foobar not found in type victorialogsacquisition.VictoriaLogsConfiguration",
+		},
+		{
+			config:      `query: _stream:{app="nginx"}`,
+			expectedErr: "url is mandatory",
+		},
+		{
+			config: `
+url: http://localhost:9428
+mode: foobar`,
+			expectedErr: "unsupported mode foobar for victorialogs datasource",
+		},
+		{
+			config: `
+url: http://localhost:9428
+until: 1h`,
+			expectedErr: "until is only supported in cat mode",
+		},
+		{
+			config: `
+url: http://localhost:9428
+since: yesterday`,
+			expectedErr: "invalid since",
+		},
+		{
+			config: `
+url: http://localhost:9428
+bearer_token: abcd
+username: admin`,
+			expectedErr: "bearer_token and username/password are mutually exclusive",
+		},
+		{
+			config: `
+url: http://localhost:9428
+bearer_token: env://CROWDSEC_TEST_UNSET_TOKEN`,
+			expectedErr: "invalid bearer_token",
+		},
+		{
+			config: `
+url: http://localhost:9428/
+query: _stream:{app="nginx"}
+account_id: "12"
+since: 1h`,
+			expectedErr: "",
+		},
+	}
+	subLogger := log.WithFields(log.Fields{
+		"type": "victorialogs",
+	})
+	for _, test := range tests {
+		v := VictoriaLogsSource{}
+		err := v.Configure([]byte(test.config), subLogger)
+		cstest.AssertErrorContains(t, err, test.expectedErr)
+	}
+}
+
+func TestConfigureDSN(t *testing.T) {
+	tests := []struct {
+		dsn           string
+		expectedErr   string
+		expectedURL   string
+		expectedQuery string
+	}{
+		{
+			dsn:         "asd://",
+			expectedErr: "invalid DSN asd:// for victorialogs source, must start with victorialogs://",
+		},
+		{
+			dsn:         "victorialogs://",
+			expectedErr: "empty victorialogs:// DSN",
+		},
+		{
+			dsn:         "victorialogs://localhost:9428?foobar=42",
+			expectedErr: "unsupported key foobar in victorialogs DSN",
+		},
+		{
+			dsn:         "victorialogs://localhost:9428?insecure_skip_verify=maybe",
+			expectedErr: "parsing 'insecure_skip_verify' parameters",
+		},
+		{
+			dsn:           "victorialogs://localhost:9428",
+			expectedURL:   "http://localhost:9428",
+			expectedQuery: "*",
+		},
+		{
+			dsn:           "victorialogs://localhost:9428?scheme=https&query=error&since=24h&log_level=info",
+			expectedURL:   "https://localhost:9428",
+			expectedQuery: "error",
+		},
+	}
+	subLogger := log.WithFields(log.Fields{
+		"type": "victorialogs",
+	})
+	for _, test := range tests {
+		v := VictoriaLogsSource{}
+		err := v.ConfigureByDSN(test.dsn, map[string]string{"type": "testtype"}, subLogger)
+		cstest.AssertErrorContains(t, err, test.expectedErr)
+		if test.expectedErr == "" {
+			assert.Equal(t, test.expectedURL, v.config.URL)
+			assert.Equal(t, test.expectedQuery, v.config.Query)
+			assert.Equal(t, "cat", v.GetMode())
+		}
+	}
+}
+
+func readLines(out chan types.Event, n int, timeout time.Duration) []string {
+	ret := []string{}
+	for len(ret) < n {
+		select {
+		case evt := <-out:
+			ret = append(ret, evt.Line.Raw)
+		case <-time.After(timeout):
+			return ret
+		}
+	}
+	return ret
+}
+
+func TestOneShot(t *testing.T) {
+	server := &mockServer{token: "secret"}
+	start := time.Now().Add(-time.Hour)
+	for i := 1; i <= 3; i++ {
+		server.add(start.Add(time.Duration(i)*time.Second), fmt.Sprintf("line %d", i))
+	}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	v := VictoriaLogsSource{}
+	err := v.Configure([]byte(fmt.Sprintf(`
+url: %s
+mode: cat
+query: _stream:{app="nginx"}
+bearer_token: secret
+account_id: "12"
+since: 2022-06-01T00:00:00Z
+until: 2022-06-02T00:00:00Z`, ts.URL)), log.WithField("type", "victorialogs"))
+	require.NoError(t, err)
+
+	out := make(chan types.Event, 10)
+	tmb := tomb.Tomb{}
+	require.NoError(t, v.OneShotAcquisition(out, &tmb))
+	assert.Equal(t, []string{"line 1", "line 2", "line 3"}, readLines(out, 3, time.Second))
+
+	require.Len(t, server.requests, 1)
+	req := server.requests[0]
+	assert.Equal(t, "/select/logsql/query", req.URL.Path)
+	assert.Equal(t, `_stream:{app="nginx"} | sort by (_time)`, req.Form.Get("query"))
+	assert.Equal(t, "2022-06-01T00:00:00Z", req.Form.Get("start"))
+	assert.Equal(t, "2022-06-02T00:00:00Z", req.Form.Get("end"))
+	assert.Equal(t, "12", req.Header.Get("AccountID"))
+
+	//a bad token is not retried
+	v = VictoriaLogsSource{}
+	require.NoError(t, v.Configure([]byte(fmt.Sprintf("url: %s\nmode: cat\nbearer_token: wrong", ts.URL)), log.WithField("type", "victorialogs")))
+	err = v.OneShotAcquisition(out, &tomb.Tomb{})
+	cstest.AssertErrorContains(t, err, "request failed with status 401")
+}
+
+func TestStreaming(t *testing.T) {
+	dir, err := ioutil.TempDir("", "victorialogs-cursors")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store, err := cursors.NewFileStore(filepath.Join(dir, "cursors.json"))
+	require.NoError(t, err)
+	cursors.SetStore(store)
+	defer cursors.SetStore(nil)
+
+	server := &mockServer{token: "secret"}
+	start := time.Now().Add(-time.Minute).Truncate(time.Second)
+	server.add(start, "line 1")
+	server.add(start.Add(time.Second), "line 2")
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	v := VictoriaLogsSource{}
+	require.NoError(t, v.Configure([]byte(fmt.Sprintf(`
+url: %s
+bearer_token: secret
+retry:
+  base: 50ms`, ts.URL)), log.WithField("type", "victorialogs")))
+	//fake a previous run that read the first line
+	require.NoError(t, cursors.SaveCursor("victorialogs", ts.URL+"?*", start.UTC().Format(time.RFC3339Nano)))
+	out := make(chan types.Event, 10)
+	tmb := tomb.Tomb{}
+	require.NoError(t, v.StreamingAcquisition(out, &tmb))
+	assert.Equal(t, []string{"line 2"}, readLines(out, 1, 2*time.Second))
+	//the mock closes the tail after each batch : the source reconnects and only reads the new line
+	server.add(start.Add(2*time.Second), "line 3")
+	assert.Equal(t, []string{"line 3"}, readLines(out, 1, 2*time.Second))
+	assert.Empty(t, readLines(out, 1, 200*time.Millisecond))
+	tmb.Kill(nil)
+	require.NoError(t, tmb.Wait())
+
+	assert.GreaterOrEqual(t, server.requestCount(), 2)
+	server.lock.Lock()
+	assert.Equal(t, "/select/logsql/tail", server.requests[0].URL.Path)
+	assert.Equal(t, "61s", server.requests[0].Form.Get("start_offset"))
+	server.lock.Unlock()
+
+	cursor, err := cursors.LoadCursor("victorialogs", ts.URL+"?*")
+	require.NoError(t, err)
+	assert.Equal(t, start.Add(2*time.Second).UTC().Format(time.RFC3339Nano), cursor)
+}
@@ -0,0 +1,100 @@
+package wineventlogacquisition
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+)
+
+// xmlEvent is the part of the XML rendering of an event kept in the json lines
+type xmlEvent struct {
+	System struct {
+		Provider struct {
+			Name string `xml:"Name,attr"`
+		} `xml:"Provider"`
+		EventID     int    `xml:"EventID"`
+		Version     int    `xml:"Version"`
+		Level       int    `xml:"Level"`
+		Task        int    `xml:"Task"`
+		Opcode      int    `xml:"Opcode"`
+		Keywords    string `xml:"Keywords"`
+		TimeCreated struct {
+			SystemTime string `xml:"SystemTime,attr"`
+		} `xml:"TimeCreated"`
+		EventRecordID uint64 `xml:"EventRecordID"`
+		Execution     struct {
+			ProcessID uint32 `xml:"ProcessID,attr"`
+			ThreadID  uint32 `xml:"ThreadID,attr"`
+		} `xml:"Execution"`
+		Channel  string `xml:"Channel"`
+		Computer string `xml:"Computer"`
+		Security struct {
+			UserID string `xml:"UserID,attr"`
+		} `xml:"Security"`
+	} `xml:"System"`
+	EventData []struct {
+		Name  string `xml:"Name,attr"`
+		Value string `xml:",chardata"`
+	} `xml:"EventData>Data"`
+}
+
+// jsonEvent is an event rendered as a json line, with the fields of EventData flattened (eg. TargetUserName
+// and IpAddress of the failed logons)
+type jsonEvent struct {
+	Provider    string            `json:"provider"`
+	EventID     int               `json:"event_id"`
+	Version     int               `json:"version"`
+	Level       int               `json:"level"`
+	Task        int               `json:"task"`
+	Opcode      int               `json:"opcode"`
+	Keywords    string            `json:"keywords"`
+	TimeCreated string            `json:"time_created"`
+	RecordID    uint64            `json:"record_id"`
+	ProcessID   uint32            `json:"process_id"`
+	ThreadID    uint32            `json:"thread_id"`
+	Channel     string            `json:"channel"`
+	Computer    string            `json:"computer"`
+	UserID      string            `json:"user_id,omitempty"`
+	EventData   map[string]string `json:"event_data,omitempty"`
+}
+
+// renderJSON converts the XML rendering of an event to a json line. The data without name are numbered
+// param1, param2 ... as in the messages of the event
+func renderJSON(event string) (string, error) {
+	parsed := xmlEvent{}
+	if err := xml.Unmarshal([]byte(event), &parsed); err != nil {
+		return "", fmt.Errorf("unable to parse event: %v", err)
+	}
+	system := parsed.System
+	rendered := jsonEvent{
+		Provider:    system.Provider.Name,
+		EventID:     system.EventID,
+		Version:     system.Version,
+		Level:       system.Level,
+		Task:        system.Task,
+		Opcode:      system.Opcode,
+		Keywords:    system.Keywords,
+		TimeCreated: system.TimeCreated.SystemTime,
+		RecordID:    system.EventRecordID,
+		ProcessID:   system.Execution.ProcessID,
+		ThreadID:    system.Execution.ThreadID,
+		Channel:     system.Channel,
+		Computer:    system.Computer,
+		UserID:      system.Security.UserID,
+	}
+	if len(parsed.EventData) > 0 {
+		rendered.EventData = make(map[string]string, len(parsed.EventData))
+		for i, data := range parsed.EventData {
+			name := data.Name
+			if name == "" {
+				name = fmt.Sprintf("param%d", i+1)
+			}
+			rendered.EventData[name] = data.Value
+		}
+	}
+	line, err := json.Marshal(rendered)
+	if err != nil {
+		return "", err
+	}
+	return string(line), nil
+}
@@ -0,0 +1,41 @@
+package wineventlogacquisition
+
+import (
+	"testing"
+
+	"github.com/crowdsecurity/crowdsec/pkg/cstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderJSON(t *testing.T) {
+	failedLogon := `<Event xmlns='http://schemas.microsoft.com/win/2004/08/events/event'><System><Provider Name='Microsoft-Windows-Security-Auditing' Guid='{54849625-5478-4994-a5ba-3e3b0328c30d}'/><EventID>4625</EventID><Version>0</Version><Level>0</Level><Task>12544</Task><Opcode>0</Opcode><Keywords>0x8010000000000000</Keywords><TimeCreated SystemTime='2022-03-01T10:00:00.1234567Z'/><EventRecordID>42</EventRecordID><Correlation/><Execution ProcessID='644' ThreadID='4220'/><Channel>Security</Channel><Computer>DC01</Computer><Security/></System><EventData><Data Name='TargetUserName'>administrator</Data><Data Name='LogonType'>10</Data><Data Name='IpAddress'>192.168.1.42</Data></EventData></Event>`
+	line, err := renderJSON(failedLogon)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+	"provider": "Microsoft-Windows-Security-Auditing",
+	"event_id": 4625,
+	"version": 0,
+	"level": 0,
+	"task": 12544,
+	"opcode": 0,
+	"keywords": "0x8010000000000000",
+	"time_created": "2022-03-01T10:00:00.1234567Z",
+	"record_id": 42,
+	"process_id": 644,
+	"thread_id": 4220,
+	"channel": "Security",
+	"computer": "DC01",
+	"event_data": {"TargetUserName": "administrator", "LogonType": "10", "IpAddress": "192.168.1.42"}
+}`, line)
+
+	//the data without name are numbered
+	line, err = renderJSON(`<Event><System><Provider Name='test'/><EventID Qualifiers='0'>42</EventID><Channel>Application</Channel><Security UserID='S-1-5-18'/></System><EventData><Data>first</Data><Data>second</Data></EventData></Event>`)
+	require.NoError(t, err)
+	assert.Contains(t, line, `"event_id":42`)
+	assert.Contains(t, line, `"user_id":"S-1-5-18"`)
+	assert.Contains(t, line, `"event_data":{"param1":"first","param2":"second"}`)
+
+	_, err = renderJSON(`<Event><System>`)
+	cstest.AssertErrorContains(t, err, "unable to parse event")
+}
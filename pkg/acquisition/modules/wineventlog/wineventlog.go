@@ -12,7 +12,9 @@ import (
 	"gopkg.in/tomb.v2"
 )
 
-type WinEventLogSource struct{}
+type WinEventLogSource struct {
+	configuration.HealthTracker
+}
 
 func (w *WinEventLogSource) Configure(yamlConfig []byte, logger *log.Entry) error {
 	return nil
@@ -46,6 +48,10 @@ func (w *WinEventLogSource) GetName() string {
 	return "wineventlog"
 }
 
+func (w *WinEventLogSource) GetUuid() string {
+	return ""
+}
+
 func (w *WinEventLogSource) CanRun() error {
 	return errors.New("windows event log acquisition is only supported on Windows")
 }
@@ -4,14 +4,18 @@
 package wineventlogacquisition
 
 import (
+	"encoding/json"
+	"path/filepath"
 	"runtime"
 	"testing"
 	"time"
 
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/cursors"
 	"github.com/crowdsecurity/crowdsec/pkg/exprhelpers"
 	"github.com/crowdsecurity/crowdsec/pkg/types"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/sys/windows/svc/eventlog"
 	"gopkg.in/tomb.v2"
 )
@@ -51,6 +55,12 @@ event_channel: foo
 xpath_query: test`,
 			expectedErr: "event_channel and xpath_query are mutually exclusive",
 		},
+		{
+			config: `source: wineventlog
+event_channel: Security
+format: csv`,
+			expectedErr: "format must be xml or json",
+		},
 	}
 
 	subLogger := log.WithFields(log.Fields{
@@ -231,3 +241,57 @@ event_ids:
 		to.Wait()
 	}
 }
+
+func TestBookmark(t *testing.T) {
+	if runtime.GOOS != "windows" {
+		t.Skip("Skipping test on non-windows OS")
+	}
+	store, err := cursors.NewFileStore(filepath.Join(t.TempDir(), "cursors.json"))
+	require.NoError(t, err)
+	cursors.SetStore(store)
+	defer cursors.SetStore(nil)
+	bookmarkSaveInterval = 100 * time.Millisecond
+
+	evthandler, err := eventlog.Open("Application")
+	require.NoError(t, err)
+	config := `source: wineventlog
+event_channel: Application
+event_level: Information
+event_ids:
+ - 42
+format: json`
+	readMessage := func(c chan types.Event) string {
+		select {
+		case e := <-c:
+			evt := jsonEvent{}
+			require.NoError(t, json.Unmarshal([]byte(e.Line.Raw), &evt))
+			assert.Equal(t, 42, evt.EventID)
+			return evt.EventData["param1"]
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout")
+		}
+		return ""
+	}
+
+	to := &tomb.Tomb{}
+	c := make(chan types.Event)
+	f := WinEventLogSource{}
+	require.NoError(t, f.Configure([]byte(config), log.WithField("type", "windowseventlog")))
+	require.NoError(t, f.StreamingAcquisition(c, to))
+	time.Sleep(time.Second)
+	require.NoError(t, evthandler.Info(42, "before restart"))
+	assert.Equal(t, "before restart", readMessage(c))
+	time.Sleep(time.Second)
+	to.Kill(nil)
+	to.Wait()
+
+	//the event written while crowdsec is stopped is read after the restart
+	require.NoError(t, evthandler.Info(42, "while stopped"))
+	to = &tomb.Tomb{}
+	f = WinEventLogSource{}
+	require.NoError(t, f.Configure([]byte(config), log.WithField("type", "windowseventlog")))
+	require.NoError(t, f.StreamingAcquisition(c, to))
+	assert.Equal(t, "while stopped", readMessage(c))
+	to.Kill(nil)
+	to.Wait()
+}
@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/cursors"
 	leaky "github.com/crowdsecurity/crowdsec/pkg/leakybucket"
 	"github.com/crowdsecurity/crowdsec/pkg/types"
 	"github.com/google/winops/winlog"
@@ -29,14 +30,18 @@ type WinEventLogConfiguration struct {
 	XPathQuery                        string `yaml:"xpath_query"`
 	EventFile                         string `yaml:"event_file"`
 	PrettyName                        string `yaml:"pretty_name"`
+	Format                            string `yaml:"format"`           //xml (default) or json, with the fields of EventData flattened
+	PersistBookmark                   *bool  `yaml:"persist_bookmark"` //resume after the last event read on restart, true by default
 }
 
 type WinEventLogSource struct {
+	configuration.HealthTracker
 	config    WinEventLogConfiguration
 	logger    *log.Entry
 	evtConfig *winlog.SubscribeConfig
 	query     string
 	name      string
+	bookmark  windows.Handle //position of the subscription, only when persist_bookmark is enabled
 }
 
 type QueryList struct {
@@ -48,6 +53,9 @@ type Select struct {
 	Query string `xml:",chardata"`
 }
 
+// how often the bookmark of the subscription is saved
+var bookmarkSaveInterval = 5 * time.Second
+
 var linesRead = prometheus.NewCounterVec(
 	prometheus.CounterOpts{
 		Name: "cs_winevtlogsource_hits_total",
@@ -72,8 +80,9 @@ func logLevelToInt(logLevel string) ([]string, error) {
 	}
 }
 
-//This is lifted from winops/winlog, but we only want to render the basic XML string, we don't need the extra fluff
-func (w *WinEventLogSource) getXMLEvents(config *winlog.SubscribeConfig, publisherCache map[string]windows.Handle, resultSet windows.Handle, maxEvents int) ([]string, error) {
+//This is lifted from winops/winlog, but we only want to render the basic XML string, we don't need the extra fluff.
+//When the bookmark is enabled, it's moved to the last event and its XML is returned, to be saved once the events are sent
+func (w *WinEventLogSource) getXMLEvents(config *winlog.SubscribeConfig, publisherCache map[string]windows.Handle, resultSet windows.Handle, maxEvents int) ([]string, string, error) {
 	var events = make([]windows.Handle, maxEvents)
 	var returned uint32
 
@@ -86,9 +95,9 @@ func (w *WinEventLogSource) getXMLEvents(config *winlog.SubscribeConfig, publish
 		0,                   // Reserved. Must be zero.
 		&returned)           // The number of handles in the array that are set by the API.
 	if err == windows.ERROR_NO_MORE_ITEMS {
-		return nil, err
+		return nil, "", err
 	} else if err != nil {
-		return nil, fmt.Errorf("wevtapi.EvtNext failed: %v", err)
+		return nil, "", fmt.Errorf("wevtapi.EvtNext failed: %v", err)
 	}
 
 	// Event handles must be closed after they are returned by EvtNext whether or not we use them.
@@ -110,7 +119,53 @@ func (w *WinEventLogSource) getXMLEvents(config *winlog.SubscribeConfig, publish
 		w.logger.Tracef("Rendered event: %s", fragment)
 		renderedEvents = append(renderedEvents, fragment)
 	}
-	return renderedEvents, err
+	bookmark := ""
+	if w.bookmark != 0 && returned > 0 {
+		//the events are sent anyway, the bookmark is only behind
+		if err := wevtapi.EvtUpdateBookmark(w.bookmark, events[returned-1]); err != nil {
+			w.logger.Warningf("wevtapi.EvtUpdateBookmark failed: %v", err)
+		} else if bookmark, err = winlog.RenderFragment(w.bookmark, wevtapi.EvtRenderBookmark); err != nil {
+			w.logger.Warningf("Failed to render bookmark: %v", err)
+			bookmark = ""
+		}
+	}
+	return renderedEvents, bookmark, nil
+}
+
+//openBookmark creates the bookmark of the subscription, from the saved one if any : the subscription then
+//starts after the last event read before the restart instead of only reading the future events
+func (w *WinEventLogSource) openBookmark() error {
+	saved, err := cursors.LoadCursor(w.GetName(), w.query)
+	if err != nil {
+		w.logger.Warningf("unable to load bookmark of %s : %s", w.name, err)
+	}
+	var bookmarkXML *uint16
+	if saved != "" {
+		if bookmarkXML, err = syscall.UTF16PtrFromString(saved); err != nil {
+			return fmt.Errorf("syscall.UTF16PtrFromString failed: %v", err)
+		}
+	}
+	w.bookmark, err = wevtapi.EvtCreateBookmark(bookmarkXML)
+	if err != nil && saved != "" {
+		w.logger.Warningf("invalid bookmark for %s, reading only the new events : %s", w.name, err)
+		saved = ""
+		w.bookmark, err = wevtapi.EvtCreateBookmark(nil)
+	}
+	if err != nil {
+		return fmt.Errorf("wevtapi.EvtCreateBookmark failed: %v", err)
+	}
+	if saved != "" {
+		w.logger.Infof("resuming %s after bookmark %s", w.name, saved)
+		w.evtConfig.Bookmark = w.bookmark
+		w.evtConfig.Flags = wevtapi.EvtSubscribeStartAfterBookmark
+	}
+	return nil
+}
+
+func (w *WinEventLogSource) saveBookmark(bookmark string) {
+	if err := cursors.SaveCursor(w.GetName(), w.query, bookmark); err != nil {
+		w.logger.Warningf("unable to save bookmark of %s : %s", w.name, err)
+	}
 }
 
 func (w *WinEventLogSource) buildXpathQuery() (string, error) {
@@ -154,6 +209,15 @@ func (w *WinEventLogSource) buildXpathQuery() (string, error) {
 }
 
 func (w *WinEventLogSource) getEvents(out chan types.Event, t *tomb.Tomb) error {
+	if w.persistBookmark() {
+		if err := w.openBookmark(); err != nil {
+			return err
+		}
+		defer func() {
+			winlog.Close(w.bookmark)
+			w.bookmark = 0
+		}()
+	}
 	subscription, err := winlog.Subscribe(w.evtConfig)
 	if err != nil {
 		w.logger.Errorf("Failed to subscribe to event log: %s", err)
@@ -166,11 +230,25 @@ func (w *WinEventLogSource) getEvents(out chan types.Event, t *tomb.Tomb) error
 			winlog.Close(h)
 		}
 	}()
+	//the bookmark is saved periodically rather than after every batch of events
+	var bookmark, savedBookmark string
+	bookmarkTicker := time.NewTicker(bookmarkSaveInterval)
+	defer bookmarkTicker.Stop()
+	defer func() {
+		if bookmark != savedBookmark {
+			w.saveBookmark(bookmark)
+		}
+	}()
 	for {
 		select {
 		case <-t.Dying():
 			w.logger.Infof("wineventlog is dying")
 			return nil
+		case <-bookmarkTicker.C:
+			if bookmark != savedBookmark {
+				w.saveBookmark(bookmark)
+				savedBookmark = bookmark
+			}
 		default:
 			status, err := windows.WaitForSingleObject(w.evtConfig.SignalEvent, 1000)
 			if err != nil {
@@ -178,7 +256,7 @@ func (w *WinEventLogSource) getEvents(out chan types.Event, t *tomb.Tomb) error
 				return err
 			}
 			if status == syscall.WAIT_OBJECT_0 {
-				renderedEvents, err := w.getXMLEvents(w.evtConfig, publisherCache, subscription, 500)
+				renderedEvents, renderedBookmark, err := w.getXMLEvents(w.evtConfig, publisherCache, subscription, 500)
 				if err == windows.ERROR_NO_MORE_ITEMS {
 					windows.ResetEvent(w.evtConfig.SignalEvent)
 				} else if err != nil {
@@ -186,6 +264,12 @@ func (w *WinEventLogSource) getEvents(out chan types.Event, t *tomb.Tomb) error
 					continue
 				}
 				for _, event := range renderedEvents {
+					if w.config.Format == "json" {
+						if event, err = renderJSON(event); err != nil {
+							w.logger.Errorf("Failed to render event as json, skipping: %v", err)
+							continue
+						}
+					}
 					linesRead.With(prometheus.Labels{"source": w.name}).Inc()
 					l := types.Line{}
 					l.Raw = event
@@ -194,12 +278,21 @@ func (w *WinEventLogSource) getEvents(out chan types.Event, t *tomb.Tomb) error
 					l.Time = time.Now()
 					l.Src = w.name
 					l.Process = true
-					if !w.config.UseTimeMachine {
-						out <- types.Event{Line: l, Process: true, Type: types.LOG, ExpectMode: leaky.LIVE}
-					} else {
-						out <- types.Event{Line: l, Process: true, Type: types.LOG, ExpectMode: leaky.TIMEMACHINE}
+					w.EventSeen(&l)
+					evt := types.Event{Line: l, Process: true, Type: types.LOG, ExpectMode: leaky.LIVE}
+					if w.config.UseTimeMachine {
+						evt.ExpectMode = leaky.TIMEMACHINE
+					}
+					select {
+					case out <- evt:
+					case <-t.Dying():
+						//the bookmark of the batch is not saved, its events are read again on restart
+						return nil
 					}
 				}
+				if renderedBookmark != "" {
+					bookmark = renderedBookmark
+				}
 			}
 
 		}
@@ -246,6 +339,14 @@ func (w *WinEventLogSource) Configure(yamlConfig []byte, logger *log.Entry) erro
 		return fmt.Errorf("event_channel or xpath_query must be set")
 	}
 
+	switch config.Format {
+	case "":
+		config.Format = "xml"
+	case "xml", "json":
+	default:
+		return fmt.Errorf("format must be xml or json")
+	}
+
 	config.Mode = configuration.TAIL_MODE
 	w.config = config
 
@@ -272,6 +373,10 @@ func (w *WinEventLogSource) Configure(yamlConfig []byte, logger *log.Entry) erro
 	return nil
 }
 
+func (w *WinEventLogSource) persistBookmark() bool {
+	return w.config.PersistBookmark == nil || *w.config.PersistBookmark
+}
+
 func (w *WinEventLogSource) ConfigureByDSN(dsn string, labels map[string]string, logger *log.Entry) error {
 	return nil
 }
@@ -300,6 +405,10 @@ func (w *WinEventLogSource) GetName() string {
 	return "wineventlog"
 }
 
+func (w *WinEventLogSource) GetUuid() string {
+	return w.config.UniqueId
+}
+
 func (w *WinEventLogSource) CanRun() error {
 	if runtime.GOOS != "windows" {
 		return errors.New("windows event log acquisition is only supported on Windows")
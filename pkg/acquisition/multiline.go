@@ -0,0 +1,160 @@
+package acquisition
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	tomb "gopkg.in/tomb.v2"
+)
+
+const (
+	DEFAULT_MULTILINE_MAX_LINES     = 500
+	DEFAULT_MULTILINE_FLUSH_TIMEOUT = 1 * time.Second
+
+	MULTILINE_PRESET_STACKTRACE = "stacktrace"
+)
+
+// stacktraceContinuation matches the lines that continue a Java exception, a Python traceback or a Go panic
+var stacktraceContinuation = regexp.MustCompile(strings.Join([]string{
+	`^\s`,           //indented : java frames (\tat ...), python frames and code, go frames
+	`^$`,            //go panics are split by blank lines
+	`^Caused by: `,  //java chained exception
+	`^Suppressed: `, //java suppressed exception
+	`^Traceback \(most recent call last\):$`,
+	`^During handling of the above exception, another exception occurred:$`,
+	`^The above exception was the direct cause of the following exception:$`,
+	`^[\w.$]+(Error|Exception|Exit|Interrupt|Warning)(: .*)?$`, //java exception or python exception after its traceback
+	`^goroutine \d+ \[.*\]:$`,
+	`^[\w./*()\[\]{}-]+\(.*\)$`, //go function call
+	`^created by `,
+	`^\[signal `,
+	`^exit status \d+$`,
+}, "|"))
+
+// multilineAggregators holds the multiline configuration of the datasources, by datasource unique id
+var multilineAggregators = map[string]*multilineAggregator{}
+
+// multilineAggregator concatenates continuation lines to the line that started them (eg. java stack traces).
+// A line is a continuation if it doesn't match startPattern, or if it matches continuationPattern (presets).
+// A datasource can read from several sources (ie. files) at once, so lines are grouped by Line.Src
+type multilineAggregator struct {
+	startPattern        *regexp.Regexp
+	continuationPattern *regexp.Regexp
+	maxLines            int
+	flushTimeout        time.Duration
+}
+
+type multilinePending struct {
+	evt      types.Event
+	lines    []string
+	lastSeen time.Time
+}
+
+func newMultilineAggregator(config *configuration.MultilineCfg) (*multilineAggregator, error) {
+	m := &multilineAggregator{
+		maxLines:     DEFAULT_MULTILINE_MAX_LINES,
+		flushTimeout: DEFAULT_MULTILINE_FLUSH_TIMEOUT,
+	}
+	switch {
+	case config.Preset != "" && config.StartPattern != "":
+		return nil, fmt.Errorf("multiline: preset and start_pattern are mutually exclusive")
+	case config.Preset == MULTILINE_PRESET_STACKTRACE:
+		m.continuationPattern = stacktraceContinuation
+	case config.Preset != "":
+		return nil, fmt.Errorf("multiline: unknown preset '%s' (must be %s)", config.Preset, MULTILINE_PRESET_STACKTRACE)
+	case config.StartPattern == "":
+		return nil, fmt.Errorf("multiline: start_pattern is required")
+	default:
+		startPattern, err := regexp.Compile(config.StartPattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "multiline: invalid start_pattern '%s'", config.StartPattern)
+		}
+		m.startPattern = startPattern
+	}
+	if config.MaxLines < 0 {
+		return nil, fmt.Errorf("multiline: max_lines must be positive")
+	}
+	if config.MaxLines > 0 {
+		m.maxLines = config.MaxLines
+	}
+	if config.FlushTimeout != nil {
+		if *config.FlushTimeout <= 0 {
+			return nil, fmt.Errorf("multiline: flush_timeout must be positive")
+		}
+		m.flushTimeout = *config.FlushTimeout
+	}
+	return m, nil
+}
+
+// run aggregates the events read from input until it is closed (cat mode) or the tomb is dead.
+// Pending events are flushed when input is closed, so nothing is lost at the end of a one shot acquisition.
+func (m *multilineAggregator) run(input chan types.Event, output chan types.Event, AcquisTomb *tomb.Tomb, logger *log.Entry) {
+	defer types.CatchPanic("crowdsec/acquis/multiline")
+	pending := make(map[string]*multilinePending)
+	ticker := time.NewTicker(m.flushTimeout / 2)
+	defer ticker.Stop()
+	logger.Infof("multiline aggregator started")
+	for {
+		select {
+		case <-AcquisTomb.Dead():
+			logger.Debugf("multiline aggregator is dead")
+			return
+		case evt, ok := <-input:
+			if !ok {
+				for src := range pending {
+					m.flush(pending, src, output, AcquisTomb)
+				}
+				return
+			}
+			m.add(pending, evt, output, AcquisTomb)
+		case now := <-ticker.C:
+			for src, p := range pending {
+				if now.Sub(p.lastSeen) >= m.flushTimeout {
+					logger.Tracef("flushing %s after timeout", src)
+					m.flush(pending, src, output, AcquisTomb)
+				}
+			}
+		}
+	}
+}
+
+func (m *multilineAggregator) add(pending map[string]*multilinePending, evt types.Event, output chan types.Event, AcquisTomb *tomb.Tomb) {
+	src := evt.Line.Src
+	p, ok := pending[src]
+	if ok && m.startsEvent(evt.Line.Raw) {
+		m.flush(pending, src, output, AcquisTomb)
+		ok = false
+	}
+	if !ok {
+		p = &multilinePending{evt: evt}
+		pending[src] = p
+	}
+	p.lines = append(p.lines, evt.Line.Raw)
+	p.lastSeen = time.Now()
+	if len(p.lines) >= m.maxLines {
+		m.flush(pending, src, output, AcquisTomb)
+	}
+}
+
+func (m *multilineAggregator) startsEvent(line string) bool {
+	if m.continuationPattern != nil {
+		return !m.continuationPattern.MatchString(line)
+	}
+	return m.startPattern.MatchString(line)
+}
+
+func (m *multilineAggregator) flush(pending map[string]*multilinePending, src string, output chan types.Event, AcquisTomb *tomb.Tomb) {
+	p, ok := pending[src]
+	if !ok {
+		return
+	}
+	delete(pending, src)
+	p.evt.Line.Raw = strings.Join(p.lines, "\n")
+	sendEvent(output, p.evt, AcquisTomb)
+}
@@ -0,0 +1,298 @@
+package acquisition
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	log "github.com/sirupsen/logrus"
+	tomb "gopkg.in/tomb.v2"
+	"gopkg.in/yaml.v2"
+	"gotest.tools/v3/assert"
+)
+
+type multilineInput struct {
+	src  string
+	line string
+}
+
+func TestMultilineConfig(t *testing.T) {
+	negative := -1 * time.Second
+	tests := []struct {
+		TestName      string
+		Config        configuration.MultilineCfg
+		ExpectedError string
+	}{
+		{
+			TestName:      "missing start_pattern",
+			Config:        configuration.MultilineCfg{},
+			ExpectedError: "multiline: start_pattern is required",
+		},
+		{
+			TestName:      "invalid start_pattern",
+			Config:        configuration.MultilineCfg{StartPattern: "^[0-9"},
+			ExpectedError: "multiline: invalid start_pattern '^[0-9': error parsing regexp: missing closing ]: `[0-9`",
+		},
+		{
+			TestName:      "negative flush_timeout",
+			Config:        configuration.MultilineCfg{StartPattern: "^[0-9]", FlushTimeout: &negative},
+			ExpectedError: "multiline: flush_timeout must be positive",
+		},
+		{
+			TestName:      "unknown preset",
+			Config:        configuration.MultilineCfg{Preset: "xml"},
+			ExpectedError: "multiline: unknown preset 'xml' (must be stacktrace)",
+		},
+		{
+			TestName:      "preset and start_pattern",
+			Config:        configuration.MultilineCfg{Preset: MULTILINE_PRESET_STACKTRACE, StartPattern: "^[0-9]"},
+			ExpectedError: "multiline: preset and start_pattern are mutually exclusive",
+		},
+		{
+			TestName: "valid",
+			Config:   configuration.MultilineCfg{StartPattern: "^[0-9]"},
+		},
+		{
+			TestName: "valid preset",
+			Config:   configuration.MultilineCfg{Preset: MULTILINE_PRESET_STACKTRACE},
+		},
+	}
+	for _, test := range tests {
+		m, err := newMultilineAggregator(&test.Config)
+		if test.ExpectedError != "" {
+			assert.Error(t, err, test.ExpectedError, test.TestName)
+			continue
+		}
+		assert.NilError(t, err, test.TestName)
+		assert.Equal(t, DEFAULT_MULTILINE_MAX_LINES, m.maxLines)
+		assert.Equal(t, DEFAULT_MULTILINE_FLUSH_TIMEOUT, m.flushTimeout)
+	}
+}
+
+func TestMultiline(t *testing.T) {
+	tests := []struct {
+		TestName string
+		MaxLines int
+		Input    []multilineInput
+		Expected []string
+		//events still pending when input is closed are flushed in no particular order
+		ExpectedUnordered []string
+	}{
+		{
+			TestName: "stack trace",
+			Input: []multilineInput{
+				{"a", "2021-01-01 Exception in thread main"},
+				{"a", "\tat com.foo.Bar(Bar.java:42)"},
+				{"a", "\tat com.foo.Baz(Baz.java:12)"},
+				{"a", "2021-01-01 something else"},
+			},
+			Expected: []string{
+				"2021-01-01 Exception in thread main\n\tat com.foo.Bar(Bar.java:42)\n\tat com.foo.Baz(Baz.java:12)",
+				"2021-01-01 something else",
+			},
+		},
+		{
+			TestName: "max lines",
+			MaxLines: 2,
+			Input: []multilineInput{
+				{"a", "2021-01-01 start"},
+				{"a", "one"},
+				{"a", "two"},
+			},
+			Expected: []string{
+				"2021-01-01 start\none",
+				"two",
+			},
+		},
+		{
+			TestName: "interleaved sources",
+			Input: []multilineInput{
+				{"a", "2021-01-01 from a"},
+				{"b", "2021-01-01 from b"},
+				{"a", "continuation of a"},
+				{"b", "2021-01-01 again from b"},
+			},
+			Expected: []string{
+				"2021-01-01 from b",
+			},
+			ExpectedUnordered: []string{
+				"2021-01-01 from a\ncontinuation of a",
+				"2021-01-01 again from b",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		m, err := newMultilineAggregator(&configuration.MultilineCfg{StartPattern: `^\d{4}-\d{2}-\d{2} `, MaxLines: test.MaxLines})
+		assert.NilError(t, err, test.TestName)
+		in := make(chan types.Event)
+		out := make(chan types.Event, len(test.Expected)+len(test.ExpectedUnordered))
+		acquisTomb := tomb.Tomb{}
+		done := make(chan bool)
+		go func() {
+			m.run(in, out, &acquisTomb, log.WithField("test", test.TestName))
+			close(done)
+		}()
+		for _, input := range test.Input {
+			evt := types.Event{}
+			evt.Line.Src = input.src
+			evt.Line.Raw = input.line
+			in <- evt
+		}
+		//a closed input flushes the pending events
+		close(in)
+		<-done
+		close(out)
+		lines := []string{}
+		for evt := range out {
+			lines = append(lines, evt.Line.Raw)
+		}
+		assert.Equal(t, len(test.Expected)+len(test.ExpectedUnordered), len(lines), test.TestName)
+		assert.DeepEqual(t, test.Expected, lines[:len(test.Expected)])
+		if len(test.ExpectedUnordered) > 0 {
+			unordered := lines[len(test.Expected):]
+			sort.Strings(unordered)
+			sort.Strings(test.ExpectedUnordered)
+			assert.DeepEqual(t, test.ExpectedUnordered, unordered)
+		}
+	}
+}
+
+func TestMultilineFlushTimeout(t *testing.T) {
+	flushTimeout := 100 * time.Millisecond
+	m, err := newMultilineAggregator(&configuration.MultilineCfg{StartPattern: "^start", FlushTimeout: &flushTimeout})
+	assert.NilError(t, err)
+	in := make(chan types.Event)
+	out := make(chan types.Event)
+	acquisTomb := tomb.Tomb{}
+	go m.run(in, out, &acquisTomb, log.WithField("test", "flush_timeout"))
+	for _, line := range []string{"start", "continuation"} {
+		evt := types.Event{}
+		evt.Line.Raw = line
+		in <- evt
+	}
+	select {
+	case evt := <-out:
+		assert.Equal(t, "start\ncontinuation", evt.Line.Raw)
+	case <-time.After(1 * time.Second):
+		t.Fatalf("timeout waiting for the pending event to be flushed")
+	}
+	acquisTomb.Kill(nil)
+}
+
+func TestMultilinePresetYAML(t *testing.T) {
+	cfg := configuration.DataSourceCommonCfg{}
+	err := yaml.Unmarshal([]byte("multiline: stacktrace"), &cfg)
+	assert.NilError(t, err)
+	assert.Equal(t, MULTILINE_PRESET_STACKTRACE, cfg.Multiline.Preset)
+
+	cfg = configuration.DataSourceCommonCfg{}
+	err = yaml.Unmarshal([]byte("multiline:\n  start_pattern: ^start\n  max_lines: 10"), &cfg)
+	assert.NilError(t, err)
+	assert.Equal(t, "^start", cfg.Multiline.StartPattern)
+	assert.Equal(t, 10, cfg.Multiline.MaxLines)
+}
+
+func TestMultilineStacktrace(t *testing.T) {
+	traces := []string{
+		//java
+		"2021-01-01 12:00:00 ERROR request failed\n" +
+			"java.lang.IllegalStateException: boom\n" +
+			"\tat com.foo.Bar.run(Bar.java:42)\n" +
+			"\t... 3 more\n" +
+			"Caused by: java.io.IOException: broken pipe\n" +
+			"\tat com.foo.Baz.write(Baz.java:12)",
+		//python
+		"ERROR:root:request failed\n" +
+			"Traceback (most recent call last):\n" +
+			"  File \"app.py\", line 3, in <module>\n" +
+			"    main()\n" +
+			"ValueError: invalid literal",
+		//go
+		"panic: runtime error: invalid memory address or nil pointer dereference\n" +
+			"[signal SIGSEGV: segmentation violation code=0x1 addr=0x0 pc=0x4553a6]\n" +
+			"\n" +
+			"goroutine 1 [running]:\n" +
+			"main.(*Server).handle(0x0, 0xc000010000)\n" +
+			"\t/src/main.go:12 +0x26\n" +
+			"created by main.main\n" +
+			"\t/src/main.go:20 +0x5d\n" +
+			"exit status 2",
+		"2021-01-01 12:00:01 INFO back to normal",
+	}
+	m, err := newMultilineAggregator(&configuration.MultilineCfg{Preset: MULTILINE_PRESET_STACKTRACE})
+	assert.NilError(t, err)
+	in := make(chan types.Event)
+	out := make(chan types.Event, len(traces))
+	acquisTomb := tomb.Tomb{}
+	done := make(chan bool)
+	go func() {
+		m.run(in, out, &acquisTomb, log.WithField("test", "stacktrace"))
+		close(done)
+	}()
+	for _, trace := range traces {
+		for _, line := range strings.Split(trace, "\n") {
+			evt := types.Event{}
+			evt.Line.Raw = line
+			in <- evt
+		}
+	}
+	close(in)
+	<-done
+	close(out)
+	lines := []string{}
+	for evt := range out {
+		lines = append(lines, evt.Line.Raw)
+	}
+	assert.DeepEqual(t, traces, lines)
+}
+
+// MockCatLines sends its lines, then is over
+type MockCatLines struct {
+	MockCat
+	lines []string
+}
+
+func (f *MockCatLines) OneShotAcquisition(out chan types.Event, t *tomb.Tomb) error {
+	for _, line := range f.lines {
+		evt := types.Event{}
+		evt.Line.Src = "test"
+		evt.Line.Raw = line
+		out <- evt
+	}
+	return nil
+}
+
+func TestMultilineBeforeLineSize(t *testing.T) {
+	cat := &MockCatLines{lines: []string{"start 1", "continuation", "start 2"}}
+	cat.UniqueId = "multiline-cat"
+	aggregator, err := newMultilineAggregator(&configuration.MultilineCfg{StartPattern: "^start"})
+	assert.NilError(t, err)
+	multilineAggregators[cat.UniqueId] = aggregator
+	limiter, err := newLineSizeLimiter("multiline_cat", &configuration.MaxLineSizeCfg{Size: 15})
+	assert.NilError(t, err)
+	lineSizeLimiters[cat.UniqueId] = limiter
+	defer forgetSource(cat.UniqueId)
+
+	out := make(chan types.Event)
+	acquisTomb := tomb.Tomb{}
+	startSource(cat, out, &acquisTomb)
+	lines := []string{}
+	timeout := time.After(5 * time.Second)
+READLOOP:
+	for {
+		select {
+		case evt := <-out:
+			lines = append(lines, evt.Line.Raw)
+		case <-acquisTomb.Dead():
+			break READLOOP
+		case <-timeout:
+			t.Fatalf("acquisition did not stop")
+		}
+	}
+	//the size limit applies to the whole multiline event
+	assert.DeepEqual(t, []string{"start 1\ncontinu", "start 2"}, lines)
+}
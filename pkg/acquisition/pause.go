@@ -0,0 +1,203 @@
+package acquisition
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	tomb "gopkg.in/tomb.v2"
+)
+
+// pauseControl is set when the datasources can be paused : the pause gates are only started then
+var pauseControl bool
+
+// SetPauseControl enables the pause gates of the datasources started afterwards
+func SetPauseControl(enabled bool) {
+	pauseControl = enabled
+}
+
+// pauseGate sits right after a datasource : while it is paused, it stops reading the events of the datasource, which
+// blocks it where it is. Datasources reading at their own pace (ie. file) resume from there, without losing lines
+type pauseGate struct {
+	lock    sync.Mutex
+	paused  bool
+	resumed chan struct{} //closed on resume
+}
+
+func newPauseGate() *pauseGate {
+	return &pauseGate{}
+}
+
+func (g *pauseGate) pause() bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.paused {
+		return false
+	}
+	g.paused = true
+	g.resumed = make(chan struct{})
+	return true
+}
+
+func (g *pauseGate) resume() bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if !g.paused {
+		return false
+	}
+	g.paused = false
+	close(g.resumed)
+	return true
+}
+
+func (g *pauseGate) isPaused() bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.paused
+}
+
+// wait returns a channel closed once the gate is open, nil if it already is
+func (g *pauseGate) wait() chan struct{} {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if !g.paused {
+		return nil
+	}
+	return g.resumed
+}
+
+// run forwards the events from input to output while the gate is open, until input is closed (cat mode) or the tomb is dead
+func (g *pauseGate) run(input chan types.Event, output chan types.Event, AcquisTomb *tomb.Tomb, logger *log.Entry) {
+	defer types.CatchPanic("crowdsec/acquis/pause")
+	for {
+		if resumed := g.wait(); resumed != nil {
+			logger.Infof("datasource is paused")
+			select {
+			case <-AcquisTomb.Dying():
+				//the datasource must not stay blocked while stopping
+				g.resume()
+			case <-resumed:
+				logger.Infof("datasource is resumed")
+			}
+		}
+		select {
+		case <-AcquisTomb.Dead():
+			logger.Debugf("pause gate is dead")
+			return
+		case evt, ok := <-input:
+			if !ok {
+				return
+			}
+			sendEvent(output, evt, AcquisTomb)
+		}
+	}
+}
+
+// setPaused pauses or resumes the started datasources called name, and returns how many of them changed
+func setPaused(name string, paused bool) (int, error) {
+	startedSourcesLock.Lock()
+	defer startedSourcesLock.Unlock()
+	found, changed := 0, 0
+	for _, started := range startedSources {
+		if started.name != name || started.gate == nil {
+			continue
+		}
+		found++
+		if paused && started.gate.pause() || !paused && started.gate.resume() {
+			changed++
+		}
+	}
+	if found == 0 {
+		return 0, fmt.Errorf("no running datasource named '%s'", name)
+	}
+	return changed, nil
+}
+
+// PauseSource pauses the started datasources called name, until ResumeSource is called
+func PauseSource(name string) (int, error) {
+	return setPaused(name, true)
+}
+
+// ResumeSource resumes the paused datasources called name
+func ResumeSource(name string) (int, error) {
+	return setPaused(name, false)
+}
+
+// ListenControl serves AdminHandler on the unix socket path, which only the user running crowdsec can use. The
+// socket is removed when the listener is closed
+func ListenControl(path string) (net.Listener, error) {
+	//left by a crowdsec that didn't stop cleanly
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "while removing %s", path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, errors.Wrapf(err, "while restricting %s", path)
+	}
+	go func() {
+		defer types.CatchPanic("crowdsec/acquis/control")
+		if err := http.Serve(listener, AdminHandler()); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Errorf("acquisition control: %s", err)
+		}
+	}()
+	return listener, nil
+}
+
+// AdminHandler serves the control of the datasources :
+// GET /acquisition/sources lists them, POST /acquisition/{pause,resume}?name=<name> pauses or resumes them
+func AdminHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		action := strings.TrimPrefix(r.URL.Path, "/acquisition/")
+		if action == "sources" {
+			if r.Method != http.MethodGet {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(GetHealth()); err != nil {
+				log.Errorf("while sending datasources: %s", err)
+			}
+			return
+		}
+		var f func(string) (int, error)
+		switch action {
+		case "pause":
+			f = PauseSource
+		case "resume":
+			f = ResumeSource
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			http.Error(w, "name is required", http.StatusBadRequest)
+			return
+		}
+		changed, err := f(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		log.Infof("%s of datasource '%s' requested (%d changed)", action, name, changed)
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string]int{"changed": changed}); err != nil {
+			log.Errorf("while sending %s result: %s", action, err)
+		}
+	})
+}
@@ -0,0 +1,153 @@
+package acquisition
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	tomb "gopkg.in/tomb.v2"
+	"gotest.tools/v3/assert"
+)
+
+func TestPauseSource(t *testing.T) {
+	tail := &MockTail{}
+	tail.UniqueId = "pause-tail"
+	sourceNames[tail.UniqueId] = "pause_tail"
+	defer forgetSource(tail.UniqueId)
+
+	_, err := PauseSource("pause_tail")
+	assert.ErrorContains(t, err, "no running datasource named 'pause_tail'")
+
+	//without pause control, the datasources have no gate
+	out := make(chan types.Event)
+	acquisTomb := tomb.Tomb{}
+	startSource(tail, out, &acquisTomb)
+	<-out
+	_, err = PauseSource("pause_tail")
+	assert.ErrorContains(t, err, "no running datasource named 'pause_tail'")
+	acquisTomb.Kill(nil)
+	for i := 1; i < 10; i++ {
+		<-out
+	}
+	assert.NilError(t, acquisTomb.Wait())
+
+	SetPauseControl(true)
+	defer SetPauseControl(false)
+	out = make(chan types.Event)
+	acquisTomb = tomb.Tomb{}
+	startSource(tail, out, &acquisTomb)
+	<-out
+
+	changed, err := PauseSource("pause_tail")
+	assert.NilError(t, err)
+	assert.Equal(t, 1, changed)
+	changed, err = PauseSource("pause_tail")
+	assert.NilError(t, err)
+	assert.Equal(t, 0, changed)
+	assert.Equal(t, configuration.STATUS_PAUSED, findHealth("pause_tail").State)
+
+	//the events already through the gate when it was paused are still delivered
+	received := 0
+READLOOP:
+	for {
+		select {
+		case <-out:
+			received++
+		case <-time.After(100 * time.Millisecond):
+			break READLOOP
+		}
+	}
+	assert.Assert(t, received <= 2)
+
+	changed, err = ResumeSource("pause_tail")
+	assert.NilError(t, err)
+	assert.Equal(t, 1, changed)
+	assert.Equal(t, configuration.STATUS_RUNNING, findHealth("pause_tail").State)
+	//nothing was lost while paused
+	for i := received + 1; i < 10; i++ {
+		<-out
+	}
+	acquisTomb.Kill(nil)
+	assert.NilError(t, acquisTomb.Wait())
+}
+
+func TestAdminHandler(t *testing.T) {
+	tail := &MockTail{}
+	tail.UniqueId = "admin-tail"
+	sourceNames[tail.UniqueId] = "admin_tail"
+	defer forgetSource(tail.UniqueId)
+	SetPauseControl(true)
+	defer SetPauseControl(false)
+	out := make(chan types.Event)
+	acquisTomb := tomb.Tomb{}
+	startSource(tail, out, &acquisTomb)
+	for i := 0; i < 10; i++ {
+		<-out
+	}
+	defer func() {
+		acquisTomb.Kill(nil)
+		acquisTomb.Wait()
+	}()
+
+	tests := []struct {
+		method   string
+		target   string
+		code     int
+		expected string
+	}{
+		{http.MethodPost, "/acquisition/pause?name=admin_tail", http.StatusOK, "{\"changed\":1}\n"},
+		{http.MethodPost, "/acquisition/pause?name=admin_tail", http.StatusOK, "{\"changed\":0}\n"},
+		{http.MethodPost, "/acquisition/resume?name=admin_tail", http.StatusOK, "{\"changed\":1}\n"},
+		{http.MethodPost, "/acquisition/resume?name=unknown", http.StatusNotFound, "no running datasource named 'unknown'\n"},
+		{http.MethodPost, "/acquisition/pause", http.StatusBadRequest, "name is required\n"},
+		{http.MethodGet, "/acquisition/pause?name=admin_tail", http.StatusMethodNotAllowed, "method not allowed\n"},
+		{http.MethodPost, "/acquisition/stop?name=admin_tail", http.StatusNotFound, "404 page not found\n"},
+	}
+	handler := AdminHandler()
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(test.method, test.target, nil))
+		assert.Equal(t, test.code, w.Code, test.target)
+		assert.Equal(t, test.expected, w.Body.String(), test.target)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/acquisition/sources", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Assert(t, len(w.Body.String()) > 0)
+}
+
+func TestListenControl(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acquisition.sock")
+	//a stale socket is replaced
+	assert.NilError(t, ioutil.WriteFile(path, nil, 0644))
+	listener, err := ListenControl(path)
+	assert.NilError(t, err)
+	info, err := os.Stat(path)
+	assert.NilError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", path)
+			},
+		},
+	}
+	resp, err := client.Post("http://crowdsec/acquisition/pause?name=unknown", "application/json", nil)
+	assert.NilError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	assert.NilError(t, listener.Close())
+	_, err = os.Stat(path)
+	assert.Assert(t, os.IsNotExist(err))
+}
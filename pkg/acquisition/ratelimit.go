@@ -0,0 +1,130 @@
+package acquisition
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/limits"
+	"github.com/crowdsecurity/crowdsec/pkg/time/rate"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	tomb "gopkg.in/tomb.v2"
+)
+
+const (
+	RATE_LIMIT_POLICY_THROTTLE = "throttle"
+	RATE_LIMIT_POLICY_DROP     = "drop"
+)
+
+var RateLimited = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cs_acquisition_rate_limited_total",
+		Help: "Total lines delayed (throttle) or dropped (drop) by the rate limit of a datasource.",
+	},
+	[]string{"datasource", "name", "policy"},
+)
+
+var GlobalRateLimited = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cs_acquisition_global_rate_limited_total",
+		Help: "Total lines delayed by the read rate shared by all the datasources.",
+	},
+	[]string{"datasource", "name"},
+)
+
+// rateLimiters holds the rate limit configuration of the datasources, by datasource unique id
+var rateLimiters = map[string]*rateLimiter{}
+
+// rateLimiter is a token bucket that keeps a chatty datasource from starving the parser routines shared with the others
+type rateLimiter struct {
+	name   string
+	rate   rate.Limit
+	burst  int
+	policy string
+}
+
+func newRateLimiter(name string, config *configuration.RateLimitCfg) (*rateLimiter, error) {
+	if config.Rate <= 0 {
+		return nil, fmt.Errorf("rate_limit: rate must be positive")
+	}
+	if config.Burst < 0 {
+		return nil, fmt.Errorf("rate_limit: burst must be positive")
+	}
+	r := &rateLimiter{
+		name:   name,
+		rate:   rate.Limit(config.Rate),
+		burst:  config.Burst,
+		policy: config.Policy,
+	}
+	//a bucket needs room for at least one token
+	if r.burst == 0 {
+		r.burst = 1
+	}
+	switch r.policy {
+	case "":
+		r.policy = RATE_LIMIT_POLICY_THROTTLE
+	case RATE_LIMIT_POLICY_THROTTLE, RATE_LIMIT_POLICY_DROP:
+	default:
+		return nil, fmt.Errorf("rate_limit: unknown policy '%s' (must be %s or %s)", r.policy, RATE_LIMIT_POLICY_THROTTLE, RATE_LIMIT_POLICY_DROP)
+	}
+	return r, nil
+}
+
+// run forwards the events from input to output at the configured rate : with the throttle policy, the events above
+// the rate wait for their turn (and the datasource with them), with the drop policy they are discarded
+func (r *rateLimiter) run(input chan types.Event, output chan types.Event, AcquisTomb *tomb.Tomb, datasource string, logger *log.Entry) {
+	defer types.CatchPanic("crowdsec/acquis/ratelimit")
+	limiter := rate.NewLimiter(r.rate, r.burst)
+	limited := RateLimited.WithLabelValues(datasource, r.name, r.policy)
+	logger.Infof("rate limit started (rate: %v/s, burst: %d, policy: %s)", float64(r.rate), r.burst, r.policy)
+	for {
+		select {
+		case <-AcquisTomb.Dead():
+			logger.Debugf("rate limit is dead")
+			return
+		case evt, ok := <-input:
+			if !ok {
+				return
+			}
+			if r.policy == RATE_LIMIT_POLICY_DROP {
+				if !limiter.Allow() {
+					limited.Inc()
+					continue
+				}
+			} else if delay := limiter.Reserve().Delay(); delay > 0 {
+				limited.Inc()
+				select {
+				case <-time.After(delay):
+				case <-AcquisTomb.Dying():
+					//don't hold the datasource while stopping
+				}
+			}
+			sendEvent(output, evt, AcquisTomb)
+		}
+	}
+}
+
+// globalRateLimit forwards the events from input to output under the read rate shared by all the datasources
+// (cf. limits.SetMaxReadRate), until input is closed (cat mode) or the tomb is dead
+func globalRateLimit(input chan types.Event, output chan types.Event, AcquisTomb *tomb.Tomb, datasource string, name string, logger *log.Entry) {
+	defer types.CatchPanic("crowdsec/acquis/globalratelimit")
+	limited := GlobalRateLimited.WithLabelValues(datasource, name)
+	for {
+		select {
+		case <-AcquisTomb.Dead():
+			logger.Debugf("global rate limit is dead")
+			return
+		case evt, ok := <-input:
+			if !ok {
+				return
+			}
+			//while stopping, the events are not held anymore
+			if delay, _ := limits.WaitRead(AcquisTomb.Dying()); delay > 0 {
+				limited.Inc()
+			}
+			sendEvent(output, evt, AcquisTomb)
+		}
+	}
+}
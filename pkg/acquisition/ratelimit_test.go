@@ -0,0 +1,75 @@
+package acquisition
+
+import (
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	log "github.com/sirupsen/logrus"
+	tomb "gopkg.in/tomb.v2"
+	"gotest.tools/v3/assert"
+)
+
+func TestRateLimitConfig(t *testing.T) {
+	tests := []struct {
+		TestName      string
+		Config        configuration.RateLimitCfg
+		ExpectedError string
+	}{
+		{
+			TestName:      "missing rate",
+			Config:        configuration.RateLimitCfg{},
+			ExpectedError: "rate_limit: rate must be positive",
+		},
+		{
+			TestName:      "unknown policy",
+			Config:        configuration.RateLimitCfg{Rate: 10, Policy: "foobar"},
+			ExpectedError: "rate_limit: unknown policy 'foobar' (must be throttle or drop)",
+		},
+		{
+			TestName: "defaults",
+			Config:   configuration.RateLimitCfg{Rate: 10},
+		},
+	}
+	for _, test := range tests {
+		r, err := newRateLimiter("test", &test.Config)
+		if test.ExpectedError != "" {
+			assert.Error(t, err, test.ExpectedError, test.TestName)
+			continue
+		}
+		assert.NilError(t, err, test.TestName)
+		assert.Equal(t, RATE_LIMIT_POLICY_THROTTLE, r.policy)
+		assert.Equal(t, 1, r.burst)
+	}
+}
+
+// pushRateLimited sends count events through the rate limiter and returns how many reached output
+func pushRateLimited(t *testing.T, config configuration.RateLimitCfg, count int) int {
+	r, err := newRateLimiter("test", &config)
+	assert.NilError(t, err)
+	in := make(chan types.Event)
+	out := make(chan types.Event, count)
+	acquisTomb := tomb.Tomb{}
+	done := make(chan bool)
+	go func() {
+		r.run(in, out, &acquisTomb, "test", log.WithField("test", config.Policy))
+		close(done)
+	}()
+	for i := 0; i < count; i++ {
+		in <- types.Event{}
+	}
+	close(in)
+	<-done
+	return len(out)
+}
+
+func TestRateLimit(t *testing.T) {
+	//drop : only the burst goes through
+	assert.Equal(t, 2, pushRateLimited(t, configuration.RateLimitCfg{Rate: 1, Burst: 2, Policy: RATE_LIMIT_POLICY_DROP}, 5))
+
+	//throttle : everything goes through, at the configured rate
+	start := time.Now()
+	assert.Equal(t, 5, pushRateLimited(t, configuration.RateLimitCfg{Rate: 50, Policy: RATE_LIMIT_POLICY_THROTTLE}, 5))
+	assert.Assert(t, time.Since(start) >= 70*time.Millisecond, "throttling took %s", time.Since(start))
+}
@@ -0,0 +1,141 @@
+package acquisition
+
+import (
+	"container/heap"
+	"fmt"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	tomb "gopkg.in/tomb.v2"
+)
+
+const (
+	DEFAULT_REORDER_WINDOW     = 2 * time.Second
+	DEFAULT_REORDER_MAX_EVENTS = 10000
+)
+
+var ReorderLate = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cs_acquisition_reorder_late_total",
+		Help: "Total lines that arrived after the reorder window of a datasource, and were delivered out of order.",
+	},
+	[]string{"datasource", "name"},
+)
+
+// reorderBuffers holds the reorder configuration of the datasources, by datasource unique id
+var reorderBuffers = map[string]*reorderBuffer{}
+
+// reorderBuffer holds the events of a datasource for a time window, and delivers them sorted by Line.Time (then
+// Line.Seq) : an event is delivered once the datasource read an event more recent than it by at least the window,
+// or once the datasource stayed idle for the window
+type reorderBuffer struct {
+	name      string
+	window    time.Duration
+	maxEvents int
+}
+
+func newReorderBuffer(name string, config *configuration.ReorderCfg) (*reorderBuffer, error) {
+	r := &reorderBuffer{
+		name:      name,
+		window:    DEFAULT_REORDER_WINDOW,
+		maxEvents: DEFAULT_REORDER_MAX_EVENTS,
+	}
+	if config.Window != nil {
+		if *config.Window <= 0 {
+			return nil, fmt.Errorf("reorder: window must be positive")
+		}
+		r.window = *config.Window
+	}
+	if config.MaxEvents < 0 {
+		return nil, fmt.Errorf("reorder: max_events must be positive")
+	}
+	if config.MaxEvents > 0 {
+		r.maxEvents = config.MaxEvents
+	}
+	return r, nil
+}
+
+// reorderHeap is a min-heap of events, by time then sequence number
+type reorderHeap []types.Event
+
+func (h reorderHeap) Len() int { return len(h) }
+
+func (h reorderHeap) Less(i, j int) bool {
+	if h[i].Line.Time.Equal(h[j].Line.Time) {
+		return h[i].Line.Seq < h[j].Line.Seq
+	}
+	return h[i].Line.Time.Before(h[j].Line.Time)
+}
+
+func (h reorderHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *reorderHeap) Push(x interface{}) { *h = append(*h, x.(types.Event)) }
+
+func (h *reorderHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	evt := old[n-1]
+	*h = old[:n-1]
+	return evt
+}
+
+// run reorders the events read from input until it is closed (cat mode) or the tomb is dead.
+// The events still held are flushed in order when input is closed, so nothing is lost at the end of a one shot acquisition.
+func (r *reorderBuffer) run(input chan types.Event, output chan types.Event, AcquisTomb *tomb.Tomb, datasource string, logger *log.Entry) {
+	defer types.CatchPanic("crowdsec/acquis/reorder")
+	late := ReorderLate.WithLabelValues(datasource, r.name)
+	held := &reorderHeap{}
+	var newest, lastSent time.Time
+	lastSeen := time.Now()
+	ticker := time.NewTicker(r.window / 2)
+	defer ticker.Stop()
+	release := func(until time.Time) {
+		for held.Len() > 0 && !(*held)[0].Line.Time.After(until) {
+			evt := heap.Pop(held).(types.Event)
+			lastSent = evt.Line.Time
+			sendEvent(output, evt, AcquisTomb)
+		}
+	}
+	logger.Infof("reorder buffer started (window: %s, max events: %d)", r.window, r.maxEvents)
+	for {
+		select {
+		case <-AcquisTomb.Dead():
+			logger.Debugf("reorder buffer is dead")
+			return
+		case evt, ok := <-input:
+			if !ok {
+				release(newest)
+				return
+			}
+			lastSeen = time.Now()
+			//the events without a timestamp are ordered by arrival
+			if evt.Line.Time.IsZero() {
+				evt.Line.Time = lastSeen
+			}
+			if evt.Line.Time.Before(lastSent) {
+				logger.Debugf("line %d is late by %s, delivering it out of order", evt.Line.Seq, lastSent.Sub(evt.Line.Time))
+				late.Inc()
+				sendEvent(output, evt, AcquisTomb)
+				continue
+			}
+			heap.Push(held, evt)
+			if evt.Line.Time.After(newest) {
+				newest = evt.Line.Time
+			}
+			release(newest.Add(-r.window))
+			//bounded memory : the oldest events are delivered early rather than held
+			for held.Len() > r.maxEvents {
+				evt := heap.Pop(held).(types.Event)
+				lastSent = evt.Line.Time
+				sendEvent(output, evt, AcquisTomb)
+			}
+		case now := <-ticker.C:
+			if now.Sub(lastSeen) >= r.window {
+				release(newest)
+			}
+		}
+	}
+}
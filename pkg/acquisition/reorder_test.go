@@ -0,0 +1,92 @@
+package acquisition
+
+import (
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	log "github.com/sirupsen/logrus"
+	tomb "gopkg.in/tomb.v2"
+	"gotest.tools/v3/assert"
+)
+
+func TestReorderConfig(t *testing.T) {
+	negative := -1 * time.Second
+	_, err := newReorderBuffer("test", &configuration.ReorderCfg{Window: &negative})
+	assert.ErrorContains(t, err, "window must be positive")
+	_, err = newReorderBuffer("test", &configuration.ReorderCfg{MaxEvents: -1})
+	assert.ErrorContains(t, err, "max_events must be positive")
+	r, err := newReorderBuffer("test", &configuration.ReorderCfg{})
+	assert.NilError(t, err)
+	assert.Equal(t, DEFAULT_REORDER_WINDOW, r.window)
+	assert.Equal(t, DEFAULT_REORDER_MAX_EVENTS, r.maxEvents)
+}
+
+func runReorder(t *testing.T, r *reorderBuffer, lines []types.Line) []types.Line {
+	in := make(chan types.Event)
+	out := make(chan types.Event, len(lines))
+	acquisTomb := tomb.Tomb{}
+	done := make(chan bool)
+	go func() {
+		r.run(in, out, &acquisTomb, "mock", log.WithField("test", "reorder"))
+		close(done)
+	}()
+	for _, line := range lines {
+		in <- types.Event{Line: line}
+	}
+	close(in)
+	<-done
+	close(out)
+	ret := []types.Line{}
+	for evt := range out {
+		ret = append(ret, evt.Line)
+	}
+	return ret
+}
+
+func TestReorder(t *testing.T) {
+	base := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+	window := 10 * time.Second
+	r, err := newReorderBuffer("test", &configuration.ReorderCfg{Window: &window})
+	assert.NilError(t, err)
+
+	//out of order lines within the window are sorted, the ties are broken by sequence number
+	lines := runReorder(t, r, []types.Line{
+		{Seq: 1, Time: base.Add(2 * time.Second)},
+		{Seq: 2, Time: base},
+		{Seq: 3, Time: base.Add(1 * time.Second)},
+		{Seq: 4, Time: base},
+	})
+	seqs := []uint64{}
+	for _, line := range lines {
+		seqs = append(seqs, line.Seq)
+	}
+	assert.DeepEqual(t, []uint64{2, 4, 3, 1}, seqs)
+
+	//a line older than what was already delivered is delivered right away
+	lines = runReorder(t, r, []types.Line{
+		{Seq: 1, Time: base},
+		{Seq: 2, Time: base.Add(20 * time.Second)},
+		{Seq: 3, Time: base.Add(-5 * time.Second)},
+	})
+	seqs = []uint64{}
+	for _, line := range lines {
+		seqs = append(seqs, line.Seq)
+	}
+	assert.DeepEqual(t, []uint64{1, 3, 2}, seqs)
+
+	//max_events bounds the held lines
+	r, err = newReorderBuffer("test", &configuration.ReorderCfg{Window: &window, MaxEvents: 1})
+	assert.NilError(t, err)
+	lines = runReorder(t, r, []types.Line{
+		{Seq: 1, Time: base.Add(2 * time.Second)},
+		{Seq: 2, Time: base.Add(1 * time.Second)},
+		{Seq: 3, Time: base},
+	})
+	seqs = []uint64{}
+	for _, line := range lines {
+		seqs = append(seqs, line.Seq)
+	}
+	assert.DeepEqual(t, []uint64{2, 3, 1}, seqs)
+}
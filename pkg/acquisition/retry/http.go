@@ -0,0 +1,38 @@
+package retry
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// StatusError is a request to the backend of a datasource that failed with an HTTP error, its status code can be
+// matched in retry_on
+type StatusError struct {
+	Status int
+	Body   string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("request failed with status %d : %s", e.Status, e.Body)
+}
+
+func (e *StatusError) StatusCode() int {
+	return e.Status
+}
+
+// CheckResponse returns nil if the request succeeded, or else the error to hand to Do : the client errors (bad query,
+// bad credentials ...) won't fix themselves and are permanent, except timeouts and throttling
+func CheckResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	err := &StatusError{Status: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return Permanent(err)
+	}
+	return err
+}
@@ -0,0 +1,180 @@
+package retry
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DEFAULT_MAX_ATTEMPTS = 0 //the datasources keep retrying until they are stopped
+	DEFAULT_BACKOFF      = 2.0
+	DEFAULT_JITTER       = 0.1
+)
+
+var (
+	DefaultBase     = 1 * time.Second
+	DefaultMaxDelay = 1 * time.Minute
+)
+
+// ErrDying is returned by Do when it stopped retrying because the datasource is stopping
+var ErrDying = errors.New("stopped while retrying")
+
+// permanentError is an error returned by a call that must not be retried, whatever the configuration
+type permanentError struct {
+	err error
+}
+
+func (p *permanentError) Error() string {
+	return p.err.Error()
+}
+
+// Permanent wraps an error so that Do returns it right away : the datasources use it for the errors that
+// can't go away by themselves (eg. a log group that does not exist)
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// Retrier retries the calls of a datasource to its backend, with an exponential backoff
+type Retrier struct {
+	maxAttempts int
+	base        time.Duration
+	backoff     float64
+	maxDelay    time.Duration
+	jitter      float64
+	retryOn     map[string]bool
+	logger      *log.Entry
+	//Notify is called with the error when a call is going to be retried, and with nil when a call succeeded after retries
+	Notify func(err error)
+}
+
+// New checks the retry configuration of a datasource (nil for the defaults) and returns its retrier
+func New(config *configuration.RetryCfg, logger *log.Entry) (*Retrier, error) {
+	r := &Retrier{
+		maxAttempts: DEFAULT_MAX_ATTEMPTS,
+		base:        DefaultBase,
+		backoff:     DEFAULT_BACKOFF,
+		maxDelay:    DefaultMaxDelay,
+		jitter:      DEFAULT_JITTER,
+		retryOn:     make(map[string]bool),
+		logger:      logger,
+	}
+	if config == nil {
+		return r, nil
+	}
+	if config.MaxAttempts < 0 {
+		return nil, fmt.Errorf("retry: max_attempts must be positive")
+	}
+	r.maxAttempts = config.MaxAttempts
+	if config.Base != nil {
+		if *config.Base <= 0 {
+			return nil, fmt.Errorf("retry: base must be positive")
+		}
+		r.base = *config.Base
+	}
+	if config.Backoff != 0 {
+		if config.Backoff < 1 {
+			return nil, fmt.Errorf("retry: backoff must be at least 1")
+		}
+		r.backoff = config.Backoff
+	}
+	if config.MaxDelay != nil {
+		if *config.MaxDelay < r.base {
+			return nil, fmt.Errorf("retry: max_delay must be greater than base")
+		}
+		r.maxDelay = *config.MaxDelay
+	}
+	if config.Jitter != nil {
+		if *config.Jitter < 0 || *config.Jitter > 1 {
+			return nil, fmt.Errorf("retry: jitter must be between 0 and 1")
+		}
+		r.jitter = *config.Jitter
+	}
+	for _, code := range config.RetryOn {
+		r.retryOn[code] = true
+	}
+	return r, nil
+}
+
+// Delay returns how long to wait before the given retry (starting at 1)
+func (r *Retrier) Delay(retry int) time.Duration {
+	delay := float64(r.base) * math.Pow(r.backoff, float64(retry-1))
+	if delay > float64(r.maxDelay) {
+		delay = float64(r.maxDelay)
+	}
+	if r.jitter > 0 {
+		delay += delay * r.jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(delay)
+}
+
+// errorCodes returns the codes an error can be matched with in retry_on : the code of the AWS errors,
+// and the HTTP status code of the failed requests
+func errorCodes(err error) []string {
+	var codes []string
+	var coder interface{ Code() string }
+	if errors.As(err, &coder) {
+		codes = append(codes, coder.Code())
+	}
+	var statusCoder interface{ StatusCode() int }
+	if errors.As(err, &statusCoder) {
+		codes = append(codes, strconv.Itoa(statusCoder.StatusCode()))
+	}
+	return codes
+}
+
+// Retryable tells if an error is worth retrying : all errors are, unless retry_on lists the codes to retry
+func (r *Retrier) Retryable(err error) bool {
+	if len(r.retryOn) == 0 {
+		return true
+	}
+	for _, code := range errorCodes(err) {
+		if r.retryOn[code] {
+			return true
+		}
+	}
+	return false
+}
+
+// Do calls fn until it succeeds, returns an error that can't be retried, or the attempts are exhausted (the last
+// error is then returned). It returns ErrDying if dying is closed while waiting for the next attempt
+func (r *Retrier) Do(dying <-chan struct{}, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			if attempt > 1 && r.Notify != nil {
+				r.Notify(nil)
+			}
+			return nil
+		}
+		var permanent *permanentError
+		if errors.As(err, &permanent) {
+			return permanent.err
+		}
+		if !r.Retryable(err) {
+			return err
+		}
+		if r.maxAttempts != 0 && attempt >= r.maxAttempts {
+			return errors.Wrapf(err, "giving up after %d attempts", attempt)
+		}
+		delay := r.Delay(attempt)
+		r.logger.Warningf("%s, retrying in %s (attempt %d)", err, delay.Round(time.Millisecond), attempt)
+		if r.Notify != nil {
+			r.Notify(err)
+		}
+		select {
+		case <-dying:
+			return ErrDying
+		case <-time.After(delay):
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package retry
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/cstest"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type codeError struct {
+	code string
+}
+
+func (e *codeError) Error() string {
+	return "failed with " + e.code
+}
+
+func (e *codeError) Code() string {
+	return e.code
+}
+
+type statusError struct {
+	status int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("status %d", e.status)
+}
+
+func (e *statusError) StatusCode() int {
+	return e.status
+}
+
+func durationPtr(d time.Duration) *time.Duration {
+	return &d
+}
+
+func floatPtr(f float64) *float64 {
+	return &f
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		config      *configuration.RetryCfg
+		expectedErr string
+	}{
+		{
+			config: nil,
+		},
+		{
+			config: &configuration.RetryCfg{MaxAttempts: 3, Base: durationPtr(time.Second), Backoff: 1.5, MaxDelay: durationPtr(time.Minute), Jitter: floatPtr(0.5)},
+		},
+		{
+			config:      &configuration.RetryCfg{MaxAttempts: -1},
+			expectedErr: "max_attempts must be positive",
+		},
+		{
+			config:      &configuration.RetryCfg{Base: durationPtr(0)},
+			expectedErr: "base must be positive",
+		},
+		{
+			config:      &configuration.RetryCfg{Backoff: 0.5},
+			expectedErr: "backoff must be at least 1",
+		},
+		{
+			config:      &configuration.RetryCfg{Base: durationPtr(time.Minute), MaxDelay: durationPtr(time.Second)},
+			expectedErr: "max_delay must be greater than base",
+		},
+		{
+			config:      &configuration.RetryCfg{Jitter: floatPtr(2)},
+			expectedErr: "jitter must be between 0 and 1",
+		},
+	}
+
+	for _, test := range tests {
+		_, err := New(test.config, log.WithField("test", "retry"))
+		cstest.AssertErrorContains(t, err, test.expectedErr)
+	}
+}
+
+func TestDelay(t *testing.T) {
+	r, err := New(&configuration.RetryCfg{Base: durationPtr(time.Second), Backoff: 2, MaxDelay: durationPtr(10 * time.Second), Jitter: floatPtr(0)}, log.WithField("test", "retry"))
+	require.NoError(t, err)
+	assert.Equal(t, time.Second, r.Delay(1))
+	assert.Equal(t, 2*time.Second, r.Delay(2))
+	assert.Equal(t, 8*time.Second, r.Delay(4))
+	assert.Equal(t, 10*time.Second, r.Delay(5))
+
+	r, err = New(&configuration.RetryCfg{Base: durationPtr(time.Second), Jitter: floatPtr(0.2)}, log.WithField("test", "retry"))
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		delay := r.Delay(1)
+		assert.GreaterOrEqual(t, delay, 800*time.Millisecond)
+		assert.LessOrEqual(t, delay, 1200*time.Millisecond)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	r, err := New(&configuration.RetryCfg{RetryOn: []string{"ThrottlingException", "503"}}, log.WithField("test", "retry"))
+	require.NoError(t, err)
+	assert.True(t, r.Retryable(&codeError{code: "ThrottlingException"}))
+	assert.True(t, r.Retryable(errors.Wrap(&codeError{code: "ThrottlingException"}, "while reading")))
+	assert.False(t, r.Retryable(&codeError{code: "AccessDeniedException"}))
+	assert.True(t, r.Retryable(&statusError{status: 503}))
+	assert.False(t, r.Retryable(&statusError{status: 404}))
+	assert.False(t, r.Retryable(fmt.Errorf("connection refused")))
+
+	//all errors are retried by default
+	r, err = New(nil, log.WithField("test", "retry"))
+	require.NoError(t, err)
+	assert.True(t, r.Retryable(fmt.Errorf("connection refused")))
+}
+
+func TestDo(t *testing.T) {
+	r, err := New(&configuration.RetryCfg{MaxAttempts: 3, Base: durationPtr(time.Millisecond), Jitter: floatPtr(0)}, log.WithField("test", "retry"))
+	require.NoError(t, err)
+	var notified []error
+	r.Notify = func(err error) {
+		notified = append(notified, err)
+	}
+
+	//succeeds on the third attempt
+	attempts := 0
+	err = r.Do(nil, func() error {
+		attempts++
+		if attempts < 3 {
+			return fmt.Errorf("attempt %d failed", attempts)
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, attempts)
+	assert.Len(t, notified, 3)
+	assert.Nil(t, notified[2])
+
+	//gives up after max_attempts
+	attempts = 0
+	err = r.Do(nil, func() error {
+		attempts++
+		return fmt.Errorf("attempt %d failed", attempts)
+	})
+	cstest.AssertErrorContains(t, err, "giving up after 3 attempts: attempt 3 failed")
+	assert.Equal(t, 3, attempts)
+
+	//permanent errors are not retried
+	attempts = 0
+	permanent := fmt.Errorf("does not exist")
+	err = r.Do(nil, func() error {
+		attempts++
+		return Permanent(permanent)
+	})
+	assert.Equal(t, permanent, err)
+	assert.Equal(t, 1, attempts)
+
+	//stops waiting when the datasource is dying
+	r, err = New(&configuration.RetryCfg{Base: durationPtr(time.Hour)}, log.WithField("test", "retry"))
+	require.NoError(t, err)
+	dying := make(chan struct{})
+	close(dying)
+	err = r.Do(dying, func() error {
+		return fmt.Errorf("failed")
+	})
+	assert.Equal(t, ErrDying, err)
+}
+
+func TestCheckResponse(t *testing.T) {
+	response := func(status int, body string) *http.Response {
+		return &http.Response{StatusCode: status, Body: ioutil.NopCloser(strings.NewReader(body))}
+	}
+	assert.NoError(t, CheckResponse(response(200, "")))
+
+	err := CheckResponse(response(503, "overloaded\n"))
+	assert.Equal(t, &StatusError{Status: 503, Body: "overloaded"}, err)
+
+	//client errors are permanent, except timeouts and throttling
+	r, err := New(&configuration.RetryCfg{MaxAttempts: 3, Base: durationPtr(time.Millisecond)}, log.WithField("test", "retry"))
+	require.NoError(t, err)
+	attempts := 0
+	err = r.Do(nil, func() error {
+		attempts++
+		return CheckResponse(response(401, "unauthorized"))
+	})
+	cstest.AssertErrorContains(t, err, "request failed with status 401 : unauthorized")
+	assert.Equal(t, 1, attempts)
+	attempts = 0
+	err = r.Do(nil, func() error {
+		attempts++
+		return CheckResponse(response(429, "slow down"))
+	})
+	cstest.AssertErrorContains(t, err, "giving up after 3 attempts: request failed with status 429 : slow down")
+	assert.Equal(t, 3, attempts)
+}
@@ -0,0 +1,35 @@
+package acquisition
+
+import (
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	log "github.com/sirupsen/logrus"
+	tomb "gopkg.in/tomb.v2"
+)
+
+// sourceParserRouting holds the parsers the events of a datasource are restricted to, by datasource unique id
+var sourceParserRouting = map[string][]string{}
+
+// GetParserRouting returns the parsers the events of a datasource are restricted to, if any
+func GetParserRouting(uniqueId string) []string {
+	return sourceParserRouting[uniqueId]
+}
+
+// setParserRouting tags the events with the parsers of their datasource : in the stages these parsers belong to,
+// the other parsers are skipped
+func setParserRouting(input chan types.Event, output chan types.Event, AcquisTomb *tomb.Tomb, parsers []string, logger *log.Entry) {
+	defer types.CatchPanic("crowdsec/acquis/routing")
+	logger.Debugf("events routed to %v", parsers)
+	for {
+		select {
+		case <-AcquisTomb.Dead():
+			logger.Debugf("routing is dead")
+			return
+		case evt, ok := <-input:
+			if !ok {
+				return
+			}
+			evt.Line.ParserRouting = parsers
+			sendEvent(output, evt, AcquisTomb)
+		}
+	}
+}
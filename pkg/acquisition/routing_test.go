@@ -0,0 +1,28 @@
+package acquisition
+
+import (
+	"testing"
+
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	log "github.com/sirupsen/logrus"
+	tomb "gopkg.in/tomb.v2"
+	"gotest.tools/v3/assert"
+)
+
+func TestParserRouting(t *testing.T) {
+	parsers := []string{"crowdsecurity/nginx-logs"}
+	in := make(chan types.Event)
+	out := make(chan types.Event, 1)
+	acquisTomb := tomb.Tomb{}
+	done := make(chan bool)
+	go func() {
+		setParserRouting(in, out, &acquisTomb, parsers, log.WithField("test", "routing"))
+		close(done)
+	}()
+	in <- types.Event{Line: types.Line{Raw: "GET / HTTP/1.1"}}
+	close(in)
+	<-done
+
+	evt := <-out
+	assert.DeepEqual(t, parsers, evt.Line.ParserRouting)
+}
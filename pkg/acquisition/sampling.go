@@ -0,0 +1,170 @@
+package acquisition
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	tomb "gopkg.in/tomb.v2"
+)
+
+const (
+	SAMPLING_MODE_FIXED    = "fixed"
+	SAMPLING_MODE_ADAPTIVE = "adaptive"
+
+	DEFAULT_SAMPLING_MAX_RATE      = 64
+	DEFAULT_SAMPLING_INTERVAL      = 1 * time.Second
+	DEFAULT_SAMPLING_HIGH_PRESSURE = 0.5
+	DEFAULT_SAMPLING_LOW_PRESSURE  = 0.1
+)
+
+var SampledOut = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cs_acquisition_sampled_out_total",
+		Help: "Total lines discarded by the sampling of a datasource.",
+	},
+	[]string{"datasource", "name"},
+)
+
+var SamplingRate = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "cs_acquisition_sampling_rate",
+		Help: "One line out of this many is kept by the sampling of a datasource, 1 means no sampling.",
+	},
+	[]string{"datasource", "name"},
+)
+
+// eventSamplers holds the sampling configuration of the datasources, by datasource unique id
+var eventSamplers = map[string]*eventSampler{}
+
+// eventSampler keeps one line out of N : with the fixed mode N never changes, with the adaptive mode N grows while
+// the next stages don't keep up (most of the lines have to wait to be sent) and shrinks back to 1 when they do
+type eventSampler struct {
+	name         string
+	mode         string
+	rate         int
+	interval     time.Duration
+	highPressure float64
+	lowPressure  float64
+}
+
+func newEventSampler(name string, config *configuration.SamplingCfg) (*eventSampler, error) {
+	s := &eventSampler{
+		name:         name,
+		mode:         config.Mode,
+		rate:         config.Rate,
+		interval:     DEFAULT_SAMPLING_INTERVAL,
+		highPressure: DEFAULT_SAMPLING_HIGH_PRESSURE,
+		lowPressure:  DEFAULT_SAMPLING_LOW_PRESSURE,
+	}
+	if config.Rate < 0 {
+		return nil, fmt.Errorf("sampling: rate must be positive")
+	}
+	switch s.mode {
+	case SAMPLING_MODE_FIXED:
+		if s.rate == 0 {
+			return nil, fmt.Errorf("sampling: rate is required with the %s mode", SAMPLING_MODE_FIXED)
+		}
+	case "", SAMPLING_MODE_ADAPTIVE:
+		s.mode = SAMPLING_MODE_ADAPTIVE
+		if s.rate == 0 {
+			s.rate = DEFAULT_SAMPLING_MAX_RATE
+		}
+	default:
+		return nil, fmt.Errorf("sampling: unknown mode '%s' (must be %s or %s)", s.mode, SAMPLING_MODE_FIXED, SAMPLING_MODE_ADAPTIVE)
+	}
+	if config.Interval != nil {
+		if *config.Interval <= 0 {
+			return nil, fmt.Errorf("sampling: interval must be positive")
+		}
+		s.interval = *config.Interval
+	}
+	if config.HighPressure != nil {
+		s.highPressure = *config.HighPressure
+	}
+	if config.LowPressure != nil {
+		s.lowPressure = *config.LowPressure
+	}
+	if s.highPressure <= 0 || s.highPressure > 1 || s.lowPressure < 0 || s.lowPressure >= s.highPressure {
+		return nil, fmt.Errorf("sampling: pressure thresholds must be 0 <= low_pressure < high_pressure <= 1")
+	}
+	return s, nil
+}
+
+// adjust returns the sampling rate to use after an interval during which blocked out of sent lines had to wait
+func (s *eventSampler) adjust(current int, sent int, blocked int) int {
+	if sent == 0 {
+		return current
+	}
+	pressure := float64(blocked) / float64(sent)
+	switch {
+	case pressure >= s.highPressure && current < s.rate:
+		current *= 2
+		if current > s.rate {
+			current = s.rate
+		}
+	case pressure <= s.lowPressure && current > 1:
+		current /= 2
+	}
+	return current
+}
+
+// run forwards one line out of the current rate from input to output, until input is closed (cat mode) or the tomb is dead
+func (s *eventSampler) run(input chan types.Event, output chan types.Event, AcquisTomb *tomb.Tomb, datasource string, logger *log.Entry) {
+	defer types.CatchPanic("crowdsec/acquis/sampling")
+	sampledOut := SampledOut.WithLabelValues(datasource, s.name)
+	rateGauge := SamplingRate.WithLabelValues(datasource, s.name)
+	current := 1
+	if s.mode == SAMPLING_MODE_FIXED {
+		current = s.rate
+	}
+	rateGauge.Set(float64(current))
+	//only the adaptive mode needs the ticker
+	var tick <-chan time.Time
+	if s.mode == SAMPLING_MODE_ADAPTIVE {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	seen, sent, blocked := 0, 0, 0
+	logger.Infof("sampling started (mode: %s, rate: %d)", s.mode, s.rate)
+	for {
+		select {
+		case <-AcquisTomb.Dead():
+			logger.Debugf("sampling is dead")
+			return
+		case <-tick:
+			next := s.adjust(current, sent, blocked)
+			if next != current {
+				if next == 1 {
+					logger.Infof("load dropped, back to full fidelity")
+				} else {
+					logger.Infof("keeping one line out of %d (was %d)", next, current)
+				}
+				current = next
+				rateGauge.Set(float64(current))
+			}
+			sent, blocked = 0, 0
+		case evt, ok := <-input:
+			if !ok {
+				return
+			}
+			seen++
+			if seen%current != 0 {
+				sampledOut.Inc()
+				continue
+			}
+			sent++
+			select {
+			case output <- evt:
+			default:
+				//the next stages are busy, this is what the adaptive mode measures
+				blocked++
+				sendEvent(output, evt, AcquisTomb)
+			}
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package acquisition
+
+import (
+	"testing"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	log "github.com/sirupsen/logrus"
+	tomb "gopkg.in/tomb.v2"
+	"gotest.tools/v3/assert"
+)
+
+func TestSamplingConfig(t *testing.T) {
+	_, err := newEventSampler("test", &configuration.SamplingCfg{Mode: "random"})
+	assert.ErrorContains(t, err, "unknown mode 'random'")
+	_, err = newEventSampler("test", &configuration.SamplingCfg{Mode: SAMPLING_MODE_FIXED})
+	assert.ErrorContains(t, err, "rate is required")
+	low := 0.8
+	_, err = newEventSampler("test", &configuration.SamplingCfg{LowPressure: &low})
+	assert.ErrorContains(t, err, "pressure thresholds")
+	s, err := newEventSampler("test", &configuration.SamplingCfg{})
+	assert.NilError(t, err)
+	assert.Equal(t, SAMPLING_MODE_ADAPTIVE, s.mode)
+	assert.Equal(t, DEFAULT_SAMPLING_MAX_RATE, s.rate)
+}
+
+func TestSamplingFixed(t *testing.T) {
+	s, err := newEventSampler("sampling_test", &configuration.SamplingCfg{Mode: SAMPLING_MODE_FIXED, Rate: 3})
+	assert.NilError(t, err)
+	in := make(chan types.Event)
+	out := make(chan types.Event, 10)
+	acquisTomb := tomb.Tomb{}
+	done := make(chan bool)
+	go func() {
+		s.run(in, out, &acquisTomb, "mock", log.WithField("test", "sampling"))
+		close(done)
+	}()
+	for i := 0; i < 10; i++ {
+		in <- types.Event{}
+	}
+	close(in)
+	<-done
+
+	assert.Equal(t, 3, len(out))
+	assert.Equal(t, float64(7), testutil.ToFloat64(SampledOut.WithLabelValues("mock", "sampling_test")))
+	assert.Equal(t, float64(3), testutil.ToFloat64(SamplingRate.WithLabelValues("mock", "sampling_test")))
+}
+
+func TestSamplingAdjust(t *testing.T) {
+	s, err := newEventSampler("test", &configuration.SamplingCfg{Rate: 8})
+	assert.NilError(t, err)
+	//under pressure, the rate doubles up to the configured one
+	assert.Equal(t, 2, s.adjust(1, 100, 90))
+	assert.Equal(t, 8, s.adjust(8, 100, 90))
+	//the rate doesn't move between the thresholds
+	assert.Equal(t, 4, s.adjust(4, 100, 30))
+	//once the load drops, the rate goes back to 1
+	assert.Equal(t, 2, s.adjust(4, 100, 0))
+	assert.Equal(t, 1, s.adjust(2, 100, 0))
+	assert.Equal(t, 1, s.adjust(1, 100, 0))
+	//nothing was sent, nothing to measure
+	assert.Equal(t, 4, s.adjust(4, 0, 0))
+}
@@ -0,0 +1,76 @@
+package secrets
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/pkg/errors"
+)
+
+const AWSProviderName = "CrowdsecSecretsProvider"
+
+// AWSProvider is an aws credentials provider for static keys configured in the acquisition, that can be
+// references : they are resolved again every refresh interval, so that rotated keys are picked up
+type AWSProvider struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Refresh         time.Duration
+	lock            sync.Mutex
+	retrieved       time.Time
+}
+
+// NewAWSCredentials checks the keys can be resolved, and returns the credentials to hand to the aws session
+func NewAWSCredentials(accessKeyID string, secretAccessKey string, sessionToken string) (*credentials.Credentials, error) {
+	provider := &AWSProvider{
+		AccessKeyID:     accessKeyID,
+		SecretAccessKey: secretAccessKey,
+		SessionToken:    sessionToken,
+		Refresh:         DefaultRefreshInterval,
+	}
+	if _, err := provider.resolve(); err != nil {
+		return nil, err
+	}
+	return credentials.NewCredentials(provider), nil
+}
+
+func (p *AWSProvider) resolve() (credentials.Value, error) {
+	value := credentials.Value{ProviderName: AWSProviderName}
+	var err error
+	if p.AccessKeyID == "" || p.SecretAccessKey == "" {
+		return value, fmt.Errorf("both the access key id and the secret access key are needed")
+	}
+	if value.AccessKeyID, err = Resolve(p.AccessKeyID); err != nil {
+		return value, errors.Wrap(err, "while resolving the access key id")
+	}
+	if value.SecretAccessKey, err = Resolve(p.SecretAccessKey); err != nil {
+		return value, errors.Wrap(err, "while resolving the secret access key")
+	}
+	if value.SessionToken, err = Resolve(p.SessionToken); err != nil {
+		return value, errors.Wrap(err, "while resolving the session token")
+	}
+	return value, nil
+}
+
+func (p *AWSProvider) Retrieve() (credentials.Value, error) {
+	value, err := p.resolve()
+	if err != nil {
+		return value, err
+	}
+	p.lock.Lock()
+	p.retrieved = time.Now()
+	p.lock.Unlock()
+	return value, nil
+}
+
+// IsExpired makes the sdk retrieve the keys again once the refresh interval has elapsed, plain keys never expire
+func (p *AWSProvider) IsExpired() bool {
+	if !IsRef(p.AccessKeyID) && !IsRef(p.SecretAccessKey) && !IsRef(p.SessionToken) {
+		return false
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return time.Since(p.retrieved) > p.Refresh
+}
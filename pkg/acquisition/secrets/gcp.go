@@ -0,0 +1,167 @@
+package secrets
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/retry"
+	"github.com/pkg/errors"
+)
+
+const (
+	gcpTokenLifetime = time.Hour
+	//the tokens are renewed a bit before they expire, so that a call doesn't fail with an expired one
+	gcpTokenRefreshMargin = 5 * time.Minute
+)
+
+// gcpMetadataHost is the metadata server of the GCE instances, GKE nodes and Cloud Run services
+func gcpMetadataHost() string {
+	if host := os.Getenv("GCE_METADATA_HOST"); host != "" {
+		return host
+	}
+	return "metadata.google.internal"
+}
+
+// GCPServiceAccountKey is the json key file of a service account
+type GCPServiceAccountKey struct {
+	Type         string `json:"type"`
+	ProjectID    string `json:"project_id"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	ClientEmail  string `json:"client_email"`
+	signer       *rsa.PrivateKey
+}
+
+func LoadGCPServiceAccountKey(path string) (*GCPServiceAccountKey, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "while reading credentials_file %s", path)
+	}
+	key := &GCPServiceAccountKey{}
+	if err := json.Unmarshal(content, key); err != nil {
+		return nil, errors.Wrapf(err, "invalid credentials_file %s", path)
+	}
+	if key.Type != "service_account" {
+		return nil, fmt.Errorf("invalid credentials_file %s : not a service account key", path)
+	}
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("invalid credentials_file %s : no private key", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid private key in credentials_file %s", path)
+	}
+	var ok bool
+	if key.signer, ok = parsed.(*rsa.PrivateKey); !ok {
+		return nil, fmt.Errorf("invalid private key in credentials_file %s : not a RSA key", path)
+	}
+	return key, nil
+}
+
+// selfSignedToken returns a JWT signed with the key of the service account, which Google APIs accept as an access
+// token for the audience (https://developers.google.com/identity/protocols/oauth2/service-account#jwt-auth)
+func (k *GCPServiceAccountKey) selfSignedToken(audience string, now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": k.PrivateKeyID})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss": k.ClientEmail,
+		"sub": k.ClientEmail,
+		"aud": audience,
+		"iat": now.Unix(),
+		"exp": now.Add(gcpTokenLifetime).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(payload))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, k.signer, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return payload + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// GCPTokenSource gives the access tokens of a Google API : self-signed with the key of a service account, or else the
+// ones of the service account of the instance, from the metadata server
+type GCPTokenSource struct {
+	client   *http.Client
+	key      *GCPServiceAccountKey //nil for the metadata server
+	audience string                //eg. https://pubsub.googleapis.com/
+	lock     sync.Mutex
+	token    string
+	expires  time.Time
+}
+
+// NewGCPTokenSource returns the tokens of the API of audience, signed with key, or from the metadata server if key is nil
+func NewGCPTokenSource(client *http.Client, key *GCPServiceAccountKey, audience string) *GCPTokenSource {
+	return &GCPTokenSource{client: client, key: key, audience: audience}
+}
+
+type gcpMetadataToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"` //seconds
+}
+
+func (t *GCPTokenSource) fetch() (string, time.Duration, error) {
+	if t.key != nil {
+		token, err := t.key.selfSignedToken(t.audience, time.Now())
+		return token, gcpTokenLifetime, err
+	}
+	req, err := http.NewRequest(http.MethodGet, "http://"+gcpMetadataHost()+"/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return "", 0, retry.Permanent(err)
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	if err := retry.CheckResponse(resp); err != nil {
+		return "", 0, err
+	}
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", 0, errors.Wrap(err, "while reading token response")
+	}
+	ret := gcpMetadataToken{}
+	if err := json.Unmarshal(content, &ret); err != nil {
+		return "", 0, errors.Wrap(err, "invalid token response")
+	}
+	if ret.AccessToken == "" {
+		return "", 0, fmt.Errorf("no access_token in token response")
+	}
+	return ret.AccessToken, time.Duration(ret.ExpiresIn) * time.Second, nil
+}
+
+// Token returns the current token, which is renewed when it is about to expire
+func (t *GCPTokenSource) Token() (string, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.token != "" && time.Now().Before(t.expires) {
+		return t.token, nil
+	}
+	token, lifetime, err := t.fetch()
+	if err != nil {
+		return "", err
+	}
+	t.token = token
+	t.expires = time.Now().Add(lifetime - gcpTokenRefreshMargin)
+	return t.token, nil
+}
@@ -0,0 +1,150 @@
+package secrets
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ENV_SCHEME   = "env://"
+	FILE_SCHEME  = "file://"
+	VAULT_SCHEME = "vault://"
+)
+
+// DefaultRefreshInterval is how often the credentials built from references are resolved again,
+// so that rotated secrets are picked up without restarting crowdsec
+var DefaultRefreshInterval = 5 * time.Minute
+
+var vaultClient = &http.Client{Timeout: 10 * time.Second}
+
+// IsRef tells if a configuration value is a reference to a secret rather than the secret itself
+func IsRef(value string) bool {
+	return strings.HasPrefix(value, ENV_SCHEME) || strings.HasPrefix(value, FILE_SCHEME) || strings.HasPrefix(value, VAULT_SCHEME)
+}
+
+// Resolve returns the secret a configuration value refers to :
+//   - env://VAR reads the environment variable VAR
+//   - file:///path reads the file /path (without its trailing newline)
+//   - vault://path#key reads key in the secret at path, from the vault at $VAULT_ADDR with the token $VAULT_TOKEN
+//
+// Any other value is a plain secret and is returned as is
+func Resolve(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, ENV_SCHEME):
+		name := strings.TrimPrefix(value, ENV_SCHEME)
+		secret, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return secret, nil
+	case strings.HasPrefix(value, FILE_SCHEME):
+		path := strings.TrimPrefix(value, FILE_SCHEME)
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", errors.Wrapf(err, "while reading secret file %s", path)
+		}
+		return strings.TrimRight(string(content), "\r\n"), nil
+	case strings.HasPrefix(value, VAULT_SCHEME):
+		return resolveVault(strings.TrimPrefix(value, VAULT_SCHEME))
+	}
+	return value, nil
+}
+
+// Secret is a credential of a datasource, that can be a reference : it is resolved again once the refresh interval
+// has elapsed, so that the connections and the requests made after a rotation use the new secret
+type Secret struct {
+	Ref      string
+	Refresh  time.Duration
+	logger   *log.Entry
+	lock     sync.Mutex
+	value    string
+	resolved time.Time
+}
+
+// NewSecret checks ref can be resolved, and returns the secret to read on each connection or request
+func NewSecret(ref string, logger *log.Entry) (*Secret, error) {
+	secret := &Secret{Ref: ref, Refresh: DefaultRefreshInterval, logger: logger}
+	value, err := Resolve(ref)
+	if err != nil {
+		return nil, err
+	}
+	secret.value, secret.resolved = value, time.Now()
+	return secret, nil
+}
+
+// Get returns the secret, resolved again if the refresh interval has elapsed. If it can't be resolved anymore, the
+// previous value is kept until the next refresh
+func (s *Secret) Get() string {
+	if !IsRef(s.Ref) {
+		return s.Ref
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if time.Since(s.resolved) < s.Refresh {
+		return s.value
+	}
+	s.resolved = time.Now()
+	value, err := Resolve(s.Ref)
+	if err != nil {
+		s.logger.Warningf("unable to resolve %s again, keeping the previous value : %s", s.Ref, err)
+		return s.value
+	}
+	s.value = value
+	return value
+}
+
+// resolveVault reads a key of a secret from vault, with the KV engine v1 (data.<key>) or v2 (data.data.<key>)
+func resolveVault(ref string) (string, error) {
+	idx := strings.LastIndex(ref, "#")
+	if idx <= 0 || idx == len(ref)-1 {
+		return "", fmt.Errorf("invalid vault reference %s, expected vault://path#key", ref)
+	}
+	path, key := ref[:idx], ref[idx+1:]
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return "", fmt.Errorf("VAULT_ADDR is not set, can't read vault secret %s", path)
+	}
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(addr, "/")+"/v1/"+strings.TrimLeft(path, "/"), nil)
+	if err != nil {
+		return "", errors.Wrapf(err, "while building vault request for %s", path)
+	}
+	req.Header.Set("X-Vault-Token", os.Getenv("VAULT_TOKEN"))
+	resp, err := vaultClient.Do(req)
+	if err != nil {
+		return "", errors.Wrapf(err, "while reading vault secret %s", path)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("while reading vault secret %s: unexpected status %s", path, resp.Status)
+	}
+	secret := struct {
+		Data map[string]interface{} `json:"data"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return "", errors.Wrapf(err, "while decoding vault secret %s", path)
+	}
+	data := secret.Data
+	if _, ok := data[key]; !ok {
+		if nested, ok := data["data"].(map[string]interface{}); ok {
+			data = nested
+		}
+	}
+	value, ok := data[key]
+	if !ok {
+		return "", fmt.Errorf("key %s not found in vault secret %s", key, path)
+	}
+	str, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("key %s of vault secret %s is not a string", key, path)
+	}
+	return str, nil
+}
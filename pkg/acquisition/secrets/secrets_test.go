@@ -0,0 +1,193 @@
+package secrets
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/cstest"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolve(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	secretFile := filepath.Join(dir, "password")
+	require.NoError(t, ioutil.WriteFile(secretFile, []byte("from_file\n"), 0600))
+
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "s3cr3t" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/kv/crowdsec":
+			w.Write([]byte(`{"data": {"password": "from_vault_v1"}}`))
+		case "/v1/secret/data/crowdsec":
+			w.Write([]byte(`{"data": {"data": {"password": "from_vault_v2"}, "metadata": {"version": 1}}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer vault.Close()
+
+	os.Setenv("CROWDSEC_TEST_SECRET", "from_env")
+	defer os.Unsetenv("CROWDSEC_TEST_SECRET")
+	os.Setenv("VAULT_ADDR", vault.URL)
+	defer os.Unsetenv("VAULT_ADDR")
+	os.Setenv("VAULT_TOKEN", "s3cr3t")
+	defer os.Unsetenv("VAULT_TOKEN")
+
+	tests := []struct {
+		value       string
+		expected    string
+		expectedErr string
+	}{
+		{
+			value:    "plain",
+			expected: "plain",
+		},
+		{
+			value:    "env://CROWDSEC_TEST_SECRET",
+			expected: "from_env",
+		},
+		{
+			value:       "env://CROWDSEC_TEST_MISSING",
+			expectedErr: "environment variable CROWDSEC_TEST_MISSING is not set",
+		},
+		{
+			value:    "file://" + secretFile,
+			expected: "from_file",
+		},
+		{
+			value:       "file://" + filepath.Join(dir, "missing"),
+			expectedErr: "while reading secret file",
+		},
+		{
+			value:    "vault://kv/crowdsec#password",
+			expected: "from_vault_v1",
+		},
+		{
+			value:    "vault://secret/data/crowdsec#password",
+			expected: "from_vault_v2",
+		},
+		{
+			value:       "vault://secret/data/crowdsec#user",
+			expectedErr: "key user not found in vault secret secret/data/crowdsec",
+		},
+		{
+			value:       "vault://secret/data/missing#password",
+			expectedErr: "unexpected status 404",
+		},
+		{
+			value:       "vault://secret/data/crowdsec",
+			expectedErr: "invalid vault reference",
+		},
+	}
+
+	for _, test := range tests {
+		secret, err := Resolve(test.value)
+		cstest.AssertErrorContains(t, err, test.expectedErr)
+		assert.Equal(t, test.expected, secret, test.value)
+	}
+}
+
+func TestAWSProvider(t *testing.T) {
+	os.Setenv("CROWDSEC_TEST_SECRET", "first")
+	defer os.Unsetenv("CROWDSEC_TEST_SECRET")
+
+	_, err := NewAWSCredentials("AKID", "", "")
+	cstest.AssertErrorContains(t, err, "both the access key id and the secret access key are needed")
+	_, err = NewAWSCredentials("AKID", "env://CROWDSEC_TEST_MISSING", "")
+	cstest.AssertErrorContains(t, err, "while resolving the secret access key")
+
+	provider := &AWSProvider{AccessKeyID: "AKID", SecretAccessKey: "env://CROWDSEC_TEST_SECRET", Refresh: time.Hour}
+	value, err := provider.Retrieve()
+	require.NoError(t, err)
+	assert.Equal(t, "AKID", value.AccessKeyID)
+	assert.Equal(t, "first", value.SecretAccessKey)
+	assert.False(t, provider.IsExpired())
+
+	//the rotated secret is picked up once the refresh interval has elapsed
+	os.Setenv("CROWDSEC_TEST_SECRET", "second")
+	provider.Refresh = 0
+	assert.True(t, provider.IsExpired())
+	value, err = provider.Retrieve()
+	require.NoError(t, err)
+	assert.Equal(t, "second", value.SecretAccessKey)
+
+	//plain keys never expire
+	provider = &AWSProvider{AccessKeyID: "AKID", SecretAccessKey: "SECRET"}
+	assert.False(t, provider.IsExpired())
+}
+
+func TestSecret(t *testing.T) {
+	os.Setenv("CROWDSEC_TEST_SECRET", "first")
+	defer os.Unsetenv("CROWDSEC_TEST_SECRET")
+	logger := log.WithField("test", "secret")
+
+	_, err := NewSecret("env://CROWDSEC_TEST_MISSING", logger)
+	cstest.AssertErrorContains(t, err, "environment variable CROWDSEC_TEST_MISSING is not set")
+
+	secret, err := NewSecret("env://CROWDSEC_TEST_SECRET", logger)
+	require.NoError(t, err)
+	assert.Equal(t, "first", secret.Get())
+
+	//the rotated secret is picked up once the refresh interval has elapsed
+	os.Setenv("CROWDSEC_TEST_SECRET", "second")
+	assert.Equal(t, "first", secret.Get())
+	secret.Refresh = 0
+	assert.Equal(t, "second", secret.Get())
+
+	//the previous value is kept if the secret can't be resolved anymore
+	os.Unsetenv("CROWDSEC_TEST_SECRET")
+	assert.Equal(t, "second", secret.Get())
+
+	plain, err := NewSecret("plain", logger)
+	require.NoError(t, err)
+	assert.Equal(t, "plain", plain.Get())
+}
+
+func TestGCPTokenSource(t *testing.T) {
+	calls := 0
+	metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.Header.Get("Metadata-Flavor") != "Google" || r.URL.Path != "/computeMetadata/v1/instance/service-accounts/default/token" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"access_token": "ya29.token", "expires_in": 3599, "token_type": "Bearer"}`))
+	}))
+	defer metadata.Close()
+	os.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(metadata.URL, "http://"))
+	defer os.Unsetenv("GCE_METADATA_HOST")
+
+	tokens := NewGCPTokenSource(metadata.Client(), nil, "https://storage.googleapis.com/")
+	token, err := tokens.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "ya29.token", token)
+	//the token is kept until it is about to expire
+	token, err = tokens.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "ya29.token", token)
+	assert.Equal(t, 1, calls)
+
+	dir, err := ioutil.TempDir("", "secrets")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "key.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"type": "authorized_user"}`), 0600))
+	_, err = LoadGCPServiceAccountKey(path)
+	cstest.AssertErrorContains(t, err, "not a service account key")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"type": "service_account", "private_key": "none"}`), 0600))
+	_, err = LoadGCPServiceAccountKey(path)
+	cstest.AssertErrorContains(t, err, "no private key")
+}
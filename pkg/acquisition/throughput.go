@@ -0,0 +1,97 @@
+package acquisition
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var LinesRead = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cs_acquisition_lines_read_total",
+		Help: "Total lines read by a datasource.",
+	},
+	[]string{"datasource", "name"},
+)
+
+var BytesRead = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cs_acquisition_bytes_read_total",
+		Help: "Total bytes read by a datasource.",
+	},
+	[]string{"datasource", "name"},
+)
+
+var eventsPerSecondDesc = prometheus.NewDesc(
+	"cs_acquisition_events_per_second",
+	"Events read per second by a datasource, averaged over the last throughput interval.",
+	[]string{"datasource", "name"},
+	nil,
+)
+
+// how often the events/sec gauge is updated
+var throughputInterval = 5 * time.Second
+
+// lineCounter is implemented by the datasources embedding configuration.HealthTracker : the lines are numbered
+// (Line.Seq) and counted with their bytes in EventSeen, as the datasource reads them
+type lineCounter interface {
+	CountLines(lines prometheus.Counter, bytes prometheus.Counter)
+	LinesSeen() uint64
+}
+
+func countLines(source DataSource, name string) {
+	if counter, ok := source.(lineCounter); ok {
+		counter.CountLines(LinesRead.WithLabelValues(source.GetName(), name), BytesRead.WithLabelValues(source.GetName(), name))
+	}
+}
+
+type throughputSample struct {
+	time  time.Time
+	lines uint64
+	rate  float64
+}
+
+// throughputCollector exposes the events/sec of the started datasources. The rate is computed when the metrics are
+// scraped, from the lines seen since the previous sample if it is older than throughputInterval
+type throughputCollector struct {
+	lock    sync.Mutex
+	samples map[string]*throughputSample //by datasource unique id
+}
+
+var ThroughputCollector prometheus.Collector = &throughputCollector{samples: map[string]*throughputSample{}}
+
+func (c *throughputCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- eventsPerSecondDesc
+}
+
+func (c *throughputCollector) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	startedSourcesLock.Lock()
+	defer startedSourcesLock.Unlock()
+	for uniqueId, started := range startedSources {
+		counter, ok := started.source.(lineCounter)
+		if !ok {
+			continue
+		}
+		lines := counter.LinesSeen()
+		sample, ok := c.samples[uniqueId]
+		if !ok {
+			sample = &throughputSample{time: started.since}
+			c.samples[uniqueId] = sample
+		}
+		if elapsed := now.Sub(sample.time); elapsed >= throughputInterval {
+			sample.rate = float64(lines-sample.lines) / elapsed.Seconds()
+			sample.time = now
+			sample.lines = lines
+		}
+		ch <- prometheus.MustNewConstMetric(eventsPerSecondDesc, prometheus.GaugeValue, sample.rate, started.source.GetName(), started.name)
+	}
+	for uniqueId := range c.samples {
+		if _, ok := startedSources[uniqueId]; !ok {
+			delete(c.samples, uniqueId)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package acquisition
+
+import (
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"gotest.tools/v3/assert"
+)
+
+// collectThroughput returns the events/sec of a datasource, -1 if it is not reported
+func collectThroughput(t *testing.T, name string) float64 {
+	ch := make(chan prometheus.Metric, 100)
+	ThroughputCollector.Collect(ch)
+	close(ch)
+	ret := -1.0
+	for metric := range ch {
+		m := dto.Metric{}
+		if err := metric.Write(&m); err != nil {
+			t.Fatalf("unexpected error : %s", err)
+		}
+		for _, label := range m.GetLabel() {
+			if label.GetName() == "name" && label.GetValue() == name {
+				ret = m.GetGauge().GetValue()
+			}
+		}
+	}
+	return ret
+}
+
+func TestThroughput(t *testing.T) {
+	tail := &MockTail{}
+	tail.UniqueId = "throughput-tail"
+	sourceNames[tail.UniqueId] = "throughput_test"
+	defer forgetSource(tail.UniqueId)
+
+	linesBefore := testutil.ToFloat64(LinesRead.WithLabelValues("mock_tail", "throughput_test"))
+	bytesBefore := testutil.ToFloat64(BytesRead.WithLabelValues("mock_tail", "throughput_test"))
+	countLines(tail, "throughput_test")
+	for seq, raw := range []string{"foo", "foobar", ""} {
+		line := types.Line{Raw: raw}
+		tail.EventSeen(&line)
+		assert.Equal(t, uint64(seq+1), line.Seq)
+	}
+	assert.Equal(t, linesBefore+3, testutil.ToFloat64(LinesRead.WithLabelValues("mock_tail", "throughput_test")))
+	assert.Equal(t, bytesBefore+9, testutil.ToFloat64(BytesRead.WithLabelValues("mock_tail", "throughput_test")))
+
+	//only the started datasources are reported
+	assert.Equal(t, -1.0, collectThroughput(t, "throughput_test"))
+	registerSourceHealth(tail, nil)
+	startedSourcesLock.Lock()
+	started := startedSources[tail.UniqueId]
+	started.since = time.Now().Add(-10 * time.Second)
+	startedSources[tail.UniqueId] = started
+	startedSourcesLock.Unlock()
+	rate := collectThroughput(t, "throughput_test")
+	assert.Assert(t, rate > 0.29 && rate <= 0.3, "rate is %f", rate)
+	//the rate is kept until the next interval
+	tail.EventSeen(&types.Line{})
+	assert.Equal(t, rate, collectThroughput(t, "throughput_test"))
+
+	forgetSource(tail.UniqueId)
+	assert.Equal(t, -1.0, collectThroughput(t, "throughput_test"))
+}
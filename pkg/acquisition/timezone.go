@@ -0,0 +1,44 @@
+package acquisition
+
+import (
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	tomb "gopkg.in/tomb.v2"
+)
+
+// sourceTimezones holds the timezone of the datasources that have one configured, by datasource unique id
+var sourceTimezones = map[string]*time.Location{}
+
+func loadTimezone(name string) (*time.Location, error) {
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid timezone %s", name)
+	}
+	return location, nil
+}
+
+// setTimezone tags the events with the timezone of their datasource, so that the parsers read the dates without
+// timezone in it, and expresses their acquisition time in it
+func setTimezone(input chan types.Event, output chan types.Event, AcquisTomb *tomb.Tomb, location *time.Location, logger *log.Entry) {
+	defer types.CatchPanic("crowdsec/acquis/timezone")
+	logger.Debugf("timezone set to %s", location)
+	for {
+		select {
+		case <-AcquisTomb.Dead():
+			logger.Debugf("timezone is dead")
+			return
+		case evt, ok := <-input:
+			if !ok {
+				return
+			}
+			evt.Line.Timezone = location.String()
+			if !evt.Line.Time.IsZero() {
+				evt.Line.Time = evt.Line.Time.In(location)
+			}
+			sendEvent(output, evt, AcquisTomb)
+		}
+	}
+}
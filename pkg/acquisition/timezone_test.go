@@ -0,0 +1,40 @@
+package acquisition
+
+import (
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	log "github.com/sirupsen/logrus"
+	tomb "gopkg.in/tomb.v2"
+	"gotest.tools/v3/assert"
+)
+
+func TestTimezone(t *testing.T) {
+	_, err := loadTimezone("Mars/Olympus_Mons")
+	assert.ErrorContains(t, err, "invalid timezone Mars/Olympus_Mons")
+
+	location, err := loadTimezone("Europe/Paris")
+	assert.NilError(t, err)
+	in := make(chan types.Event)
+	out := make(chan types.Event, 2)
+	acquisTomb := tomb.Tomb{}
+	done := make(chan bool)
+	go func() {
+		setTimezone(in, out, &acquisTomb, location, log.WithField("test", "timezone"))
+		close(done)
+	}()
+	acquisTime := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+	in <- types.Event{Line: types.Line{Raw: "with time", Time: acquisTime}}
+	in <- types.Event{Line: types.Line{Raw: "without time"}}
+	close(in)
+	<-done
+
+	evt := <-out
+	assert.Equal(t, "Europe/Paris", evt.Line.Timezone)
+	assert.Assert(t, evt.Line.Time.Equal(acquisTime))
+	assert.Equal(t, location, evt.Line.Time.Location())
+	evt = <-out
+	assert.Equal(t, "Europe/Paris", evt.Line.Timezone)
+	assert.Assert(t, evt.Line.Time.IsZero())
+}
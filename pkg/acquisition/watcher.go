@@ -0,0 +1,277 @@
+package acquisition
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/csconfig"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	tomb "gopkg.in/tomb.v2"
+)
+
+// how long to wait for the changes to settle before reloading (editors often write a file in several steps)
+var watcherSettleDelay = 1 * time.Second
+
+// acquisitionFile holds the datasources of an acquisition file : they share a tomb, so that they are stopped together
+type acquisitionFile struct {
+	sources  []DataSource
+	checksum [sha256.Size]byte
+	tomb     *tomb.Tomb
+}
+
+// AcquisitionWatcher runs the datasources of the acquisition files, and restarts the ones of a file when it
+// is created, modified or removed, without disturbing the other datasources nor the rest of the pipeline
+type AcquisitionWatcher struct {
+	config *csconfig.CrowdsecServiceCfg
+	files  map[string]*acquisitionFile
+	output chan types.Event
+	logger *log.Entry
+	//register the metrics of the datasources started by a reload
+	metrics    bool
+	aggregated bool
+}
+
+func NewAcquisitionWatcher(config *csconfig.CrowdsecServiceCfg, sources []DataSource) (*AcquisitionWatcher, error) {
+	w := &AcquisitionWatcher{
+		config: config,
+		files:  make(map[string]*acquisitionFile),
+		logger: log.WithField("component", "acquisition_watcher"),
+	}
+	for _, acquisFile := range config.AcquisitionFiles {
+		checksum, err := fileChecksum(acquisFile)
+		if err != nil {
+			return nil, err
+		}
+		w.files[acquisFile] = &acquisitionFile{checksum: checksum}
+	}
+	for _, source := range sources {
+		acquisFile, ok := sourceFiles[source.GetUuid()]
+		if !ok {
+			return nil, fmt.Errorf("datasource %s was not loaded from an acquisition file", source.GetName())
+		}
+		if source.GetMode() != configuration.TAIL_MODE {
+			return nil, fmt.Errorf("acquisition hot reload requires datasources in %s mode (%s is in %s mode in %s)", configuration.TAIL_MODE, source.GetName(), source.GetMode(), acquisFile)
+		}
+		if _, ok := w.files[acquisFile]; !ok {
+			return nil, fmt.Errorf("unknown acquisition file %s", acquisFile)
+		}
+		w.files[acquisFile].sources = append(w.files[acquisFile].sources, source)
+	}
+	return w, nil
+}
+
+// EnableMetrics registers the metrics of the datasources started by a reload, and unregisters the ones of the
+// datasources it stops. The metrics of the initial datasources are registered by GetMetrics
+func (w *AcquisitionWatcher) EnableMetrics(aggregated bool) {
+	w.metrics = true
+	w.aggregated = aggregated
+}
+
+func fileChecksum(path string) ([sha256.Size]byte, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return [sha256.Size]byte{}, errors.Wrapf(err, "while reading %s", path)
+	}
+	return sha256.Sum256(content), nil
+}
+
+// acquisitionFiles lists the acquisition files the same way the configuration does : acquisition_path and the yaml files of acquisition_dir
+func (w *AcquisitionWatcher) acquisitionFiles() ([]string, error) {
+	var files []string
+
+	if w.config.AcquisitionFilePath != "" {
+		files = append(files, w.config.AcquisitionFilePath)
+	}
+	if w.config.AcquisitionDirPath != "" {
+		for _, pattern := range []string{"*.yaml", "*.yml"} {
+			matches, err := filepath.Glob(filepath.Join(w.config.AcquisitionDirPath, pattern))
+			if err != nil {
+				return nil, errors.Wrap(err, "while globbing acquis_dir")
+			}
+			sort.Strings(matches)
+			files = append(files, matches...)
+		}
+	}
+	return files, nil
+}
+
+func (w *AcquisitionWatcher) isAcquisitionFile(path string) bool {
+	if path == w.config.AcquisitionFilePath {
+		return true
+	}
+	if w.config.AcquisitionDirPath == "" || filepath.Dir(path) != filepath.Clean(w.config.AcquisitionDirPath) {
+		return false
+	}
+	ext := filepath.Ext(path)
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// Run starts all the datasources and watches the acquisition files until AcquisTomb dies
+func (w *AcquisitionWatcher) Run(output chan types.Event, AcquisTomb *tomb.Tomb) error {
+	w.output = output
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.Wrap(err, "while creating acquisition watcher")
+	}
+	dirs := make(map[string]bool)
+	if w.config.AcquisitionFilePath != "" {
+		dirs[filepath.Dir(w.config.AcquisitionFilePath)] = true
+	}
+	if w.config.AcquisitionDirPath != "" {
+		dirs[filepath.Clean(w.config.AcquisitionDirPath)] = true
+	}
+	//watch the directories rather than the files, to catch files replaced by a rename
+	for dir := range dirs {
+		if err := fsw.Add(dir); err != nil {
+			fsw.Close()
+			return errors.Wrapf(err, "while watching %s", dir)
+		}
+	}
+	for _, af := range w.files {
+		w.start(af, AcquisTomb)
+	}
+	AcquisTomb.Go(func() error {
+		defer types.CatchPanic("crowdsec/acquis/watcher")
+		return w.watch(fsw, AcquisTomb)
+	})
+	return AcquisTomb.Wait()
+}
+
+func (w *AcquisitionWatcher) watch(fsw *fsnotify.Watcher, AcquisTomb *tomb.Tomb) error {
+	var settle <-chan time.Time
+
+	defer fsw.Close()
+	w.logger.Infof("watching acquisition files for changes")
+	for {
+		select {
+		case <-AcquisTomb.Dying():
+			return nil
+		case event, ok := <-fsw.Events:
+			if !ok {
+				return nil
+			}
+			if !w.isAcquisitionFile(event.Name) {
+				continue
+			}
+			w.logger.Debugf("acquisition file %s changed (%s)", event.Name, event.Op)
+			settle = time.After(watcherSettleDelay)
+		case err, ok := <-fsw.Errors:
+			if !ok {
+				return nil
+			}
+			w.logger.Errorf("acquisition watcher error : %s", err)
+		case <-settle:
+			settle = nil
+			w.reload(AcquisTomb)
+		}
+	}
+}
+
+// start runs the datasources of an acquisition file in their own tomb, that lives as long as AcquisTomb.
+// If a datasource fails, AcquisTomb is killed, as it would be without hot reload
+func (w *AcquisitionWatcher) start(af *acquisitionFile, AcquisTomb *tomb.Tomb) {
+	if len(af.sources) == 0 {
+		return
+	}
+	af.tomb = &tomb.Tomb{}
+	for _, source := range af.sources {
+		startSource(source, w.output, af.tomb)
+	}
+	sourcesTomb := af.tomb
+	AcquisTomb.Go(func() error {
+		select {
+		case <-AcquisTomb.Dying():
+			sourcesTomb.Kill(nil)
+			return sourcesTomb.Wait()
+		case <-sourcesTomb.Dying():
+			//either stopped by a reload (nil) or a datasource failed
+			return sourcesTomb.Wait()
+		}
+	})
+}
+
+func (w *AcquisitionWatcher) stop(af *acquisitionFile) {
+	if af.tomb == nil {
+		return
+	}
+	af.tomb.Kill(nil)
+	if err := af.tomb.Wait(); err != nil {
+		w.logger.Warningf("datasource returned error while stopping : %s", err)
+	}
+	for _, source := range af.sources {
+		if w.metrics {
+			unregisterSourceMetrics(source, w.aggregated)
+		}
+		forgetSource(source.GetUuid())
+	}
+}
+
+// reload compares the acquisition files with the running ones : new files are started, removed files are stopped and
+// modified files are restarted. A file that fails to load is reported, and its previous datasources are kept running
+func (w *AcquisitionWatcher) reload(AcquisTomb *tomb.Tomb) {
+	files, err := w.acquisitionFiles()
+	if err != nil {
+		w.logger.Errorf("unable to list acquisition files : %s", err)
+		return
+	}
+	seen := make(map[string]bool)
+	for _, path := range files {
+		seen[path] = true
+		checksum, err := fileChecksum(path)
+		if err != nil {
+			w.logger.Errorf("unable to reload acquisition file : %s", err)
+			continue
+		}
+		current, exists := w.files[path]
+		if exists && current.checksum == checksum {
+			continue
+		}
+		sources, err := loadAcquisitionFile(path)
+		if err == nil {
+			for _, source := range sources {
+				if source.GetMode() != configuration.TAIL_MODE {
+					err = fmt.Errorf("datasource %s is in %s mode, only %s mode is supported by hot reload", source.GetName(), source.GetMode(), configuration.TAIL_MODE)
+				}
+			}
+		}
+		if err != nil {
+			w.logger.Errorf("not reloading %s : %s", path, err)
+			for _, source := range sources {
+				forgetSource(source.GetUuid())
+			}
+			continue
+		}
+		if exists {
+			w.logger.Infof("acquisition file %s changed, restarting its %d datasource(s)", path, len(sources))
+			w.stop(current)
+		} else {
+			w.logger.Infof("new acquisition file %s, starting its %d datasource(s)", path, len(sources))
+		}
+		af := &acquisitionFile{sources: sources, checksum: checksum}
+		w.files[path] = af
+		if w.metrics {
+			for _, source := range sources {
+				if err := registerSourceMetrics(source, w.aggregated); err != nil {
+					w.logger.Warningf("%s", err)
+				}
+			}
+		}
+		w.start(af, AcquisTomb)
+	}
+	for path, af := range w.files {
+		if seen[path] {
+			continue
+		}
+		w.logger.Infof("acquisition file %s was removed, stopping its %d datasource(s)", path, len(af.sources))
+		w.stop(af)
+		delete(w.files, path)
+	}
+}
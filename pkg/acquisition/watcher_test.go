@@ -0,0 +1,215 @@
+package acquisition
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/acquisition/configuration"
+	"github.com/crowdsecurity/crowdsec/pkg/csconfig"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	tomb "gopkg.in/tomb.v2"
+	"gotest.tools/v3/assert"
+)
+
+const mockTailConfig = `source: mock
+mode: tail
+toto: foobar
+labels:
+  type: test
+`
+
+func writeAcquisitionFile(t *testing.T, path string, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("unable to write %s : %s", path, err)
+	}
+}
+
+func TestAcquisitionWatcherReload(t *testing.T) {
+	appendMockSource()
+	dir, err := ioutil.TempDir("", "acquis")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	fileA := filepath.Join(dir, "a.yaml")
+	fileB := filepath.Join(dir, "b.yaml")
+	writeAcquisitionFile(t, fileA, mockTailConfig)
+	config := &csconfig.CrowdsecServiceCfg{
+		AcquisitionDirPath: dir,
+		AcquisitionFiles:   []string{fileA},
+	}
+	sources, err := LoadAcquisitionFromFile(config)
+	assert.NilError(t, err)
+	w, err := NewAcquisitionWatcher(config, sources)
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(w.files[fileA].sources))
+
+	acquisTomb := tomb.Tomb{}
+	//the watch loop keeps the tomb alive in real life
+	acquisTomb.Go(func() error {
+		<-acquisTomb.Dying()
+		return nil
+	})
+	w.output = make(chan types.Event)
+
+	//unchanged file, nothing is restarted
+	previous := w.files[fileA]
+	w.reload(&acquisTomb)
+	assert.Equal(t, previous, w.files[fileA])
+
+	//modified file
+	writeAcquisitionFile(t, fileA, mockTailConfig+"---\n"+mockTailConfig)
+	w.reload(&acquisTomb)
+	assert.Equal(t, 2, len(w.files[fileA].sources))
+
+	//new file
+	writeAcquisitionFile(t, fileB, mockTailConfig)
+	w.reload(&acquisTomb)
+	assert.Equal(t, 2, len(w.files))
+	assert.Equal(t, 1, len(w.files[fileB].sources))
+
+	//invalid file, the previous datasources are kept
+	writeAcquisitionFile(t, fileA, "source: mock\nmode: tail\nlabels:\n  type: test\n")
+	w.reload(&acquisTomb)
+	assert.Equal(t, 2, len(w.files[fileA].sources))
+
+	//removed file
+	os.Remove(fileB)
+	w.reload(&acquisTomb)
+	assert.Equal(t, 1, len(w.files))
+
+	acquisTomb.Kill(nil)
+	assert.NilError(t, acquisTomb.Wait())
+}
+
+func TestAcquisitionWatcherCatMode(t *testing.T) {
+	appendMockSource()
+	dir, err := ioutil.TempDir("", "acquis")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	fileA := filepath.Join(dir, "a.yaml")
+	writeAcquisitionFile(t, fileA, "source: mock\nmode: cat\ntoto: foobar\nlabels:\n  type: test\n")
+	config := &csconfig.CrowdsecServiceCfg{
+		AcquisitionDirPath: dir,
+		AcquisitionFiles:   []string{fileA},
+	}
+	sources, err := LoadAcquisitionFromFile(config)
+	assert.NilError(t, err)
+	_, err = NewAcquisitionWatcher(config, sources)
+	assert.ErrorContains(t, err, "acquisition hot reload requires datasources in tail mode")
+}
+
+// isRegistered tells if c is registered, without changing it
+func isRegistered(c prometheus.Collector) bool {
+	if err := prometheus.Register(c); err == nil {
+		prometheus.Unregister(c)
+		return false
+	}
+	return true
+}
+
+func TestAcquisitionWatcherMetrics(t *testing.T) {
+	appendMockSource()
+	dir := t.TempDir()
+
+	fileA := filepath.Join(dir, "a.yaml")
+	fileB := filepath.Join(dir, "b.yaml")
+	writeAcquisitionFile(t, fileA, mockTailConfig)
+	config := &csconfig.CrowdsecServiceCfg{
+		AcquisitionDirPath: dir,
+		AcquisitionFiles:   []string{fileA},
+	}
+	sources, err := LoadAcquisitionFromFile(config)
+	assert.NilError(t, err)
+	assert.NilError(t, GetMetrics(sources, false))
+	assert.Equal(t, 1, registeredMetrics[mockSourceHits])
+	assert.Assert(t, isRegistered(mockSourceHits))
+	w, err := NewAcquisitionWatcher(config, sources)
+	assert.NilError(t, err)
+	w.EnableMetrics(false)
+
+	acquisTomb := tomb.Tomb{}
+	acquisTomb.Go(func() error {
+		<-acquisTomb.Dying()
+		return nil
+	})
+	w.output = make(chan types.Event)
+	w.start(w.files[fileA], &acquisTomb)
+
+	//the datasources of a new file share the collectors of the running ones
+	writeAcquisitionFile(t, fileB, mockTailConfig)
+	w.reload(&acquisTomb)
+	assert.Equal(t, 2, registeredMetrics[mockSourceHits])
+
+	//restarted datasources keep their collectors
+	writeAcquisitionFile(t, fileA, mockTailConfig+"---\n"+mockTailConfig)
+	w.reload(&acquisTomb)
+	assert.Equal(t, 3, registeredMetrics[mockSourceHits])
+	assert.Assert(t, isRegistered(mockSourceHits))
+
+	//the collectors are unregistered with the last datasource using them
+	os.Remove(fileB)
+	w.reload(&acquisTomb)
+	assert.Equal(t, 2, registeredMetrics[mockSourceHits])
+	assert.Assert(t, isRegistered(mockSourceHits))
+	os.Remove(fileA)
+	w.reload(&acquisTomb)
+	assert.Equal(t, 0, registeredMetrics[mockSourceHits])
+	assert.Assert(t, !isRegistered(mockSourceHits))
+
+	acquisTomb.Kill(nil)
+	assert.NilError(t, acquisTomb.Wait())
+}
+
+func TestAcquisitionWatcherStopBusySource(t *testing.T) {
+	busy := &MockBusyTail{}
+	busy.UniqueId = "watcher-busy-tail"
+	buffer, err := newEventBuffer("watcher_busy", &configuration.BufferCfg{Size: 5})
+	assert.NilError(t, err)
+	eventBuffers[busy.UniqueId] = buffer
+
+	w := &AcquisitionWatcher{
+		files:  map[string]*acquisitionFile{},
+		output: make(chan types.Event),
+		logger: log.WithField("component", "acquisition_watcher"),
+	}
+	af := &acquisitionFile{sources: []DataSource{busy}}
+	acquisTomb := tomb.Tomb{}
+	acquisTomb.Go(func() error {
+		<-acquisTomb.Dying()
+		return nil
+	})
+	w.start(af, &acquisTomb)
+	for i := 0; i < 100; i++ {
+		<-w.output
+	}
+	//a reload stops the datasources of a file while the parsers keep reading
+	stopped := make(chan struct{})
+	go func() {
+		w.stop(af)
+		close(stopped)
+	}()
+	received := int64(100)
+	timeout := time.After(5 * time.Second)
+READLOOP:
+	for {
+		select {
+		case <-w.output:
+			received++
+		case <-stopped:
+			break READLOOP
+		case <-timeout:
+			t.Fatalf("datasource did not stop")
+		}
+	}
+	assert.Equal(t, atomic.LoadInt64(&busy.sent), received)
+	assert.Assert(t, acquisTomb.Alive())
+	acquisTomb.Kill(nil)
+	assert.NilError(t, acquisTomb.Wait())
+}
@@ -500,43 +500,52 @@ func (a *apic) Pull() error {
 }
 
 func (a *apic) GetMetrics() (*models.Metrics, error) {
+	return BuildMetrics(a.dbClient, a.consoleConfig)
+}
+
+// BuildMetrics returns the usage metrics payload as it is sent to the central API, honoring the sharing options of consoleConfig
+func BuildMetrics(dbClient *database.Client, consoleConfig *csconfig.ConsoleConfig) (*models.Metrics, error) {
 	metric := &models.Metrics{
 		ApilVersion: types.StrPtr(cwversion.VersionStr()),
 		Machines:    make([]*models.MetricsAgentInfo, 0),
 		Bouncers:    make([]*models.MetricsBouncerInfo, 0),
 	}
-	machines, err := a.dbClient.ListMachines()
-	if err != nil {
-		return metric, err
-	}
-	bouncers, err := a.dbClient.ListBouncers()
-	if err != nil {
-		return metric, err
-	}
-	var lastpush string
-	for _, machine := range machines {
-		if machine.LastPush == nil {
-			lastpush = time.Time{}.String()
-		} else {
-			lastpush = machine.LastPush.String()
+	if consoleConfig == nil || consoleConfig.ShareMachinesMetrics == nil || *consoleConfig.ShareMachinesMetrics {
+		machines, err := dbClient.ListMachines()
+		if err != nil {
+			return metric, err
 		}
-		m := &models.MetricsAgentInfo{
-			Version:    machine.Version,
-			Name:       machine.MachineId,
-			LastUpdate: machine.UpdatedAt.String(),
-			LastPush:   lastpush,
+		var lastpush string
+		for _, machine := range machines {
+			if machine.LastPush == nil {
+				lastpush = time.Time{}.String()
+			} else {
+				lastpush = machine.LastPush.String()
+			}
+			m := &models.MetricsAgentInfo{
+				Version:    machine.Version,
+				Name:       machine.MachineId,
+				LastUpdate: machine.UpdatedAt.String(),
+				LastPush:   lastpush,
+			}
+			metric.Machines = append(metric.Machines, m)
 		}
-		metric.Machines = append(metric.Machines, m)
 	}
 
-	for _, bouncer := range bouncers {
-		m := &models.MetricsBouncerInfo{
-			Version:    bouncer.Version,
-			CustomName: bouncer.Name,
-			Name:       bouncer.Type,
-			LastPull:   bouncer.LastPull.String(),
+	if consoleConfig == nil || consoleConfig.ShareBouncersMetrics == nil || *consoleConfig.ShareBouncersMetrics {
+		bouncers, err := dbClient.ListBouncers()
+		if err != nil {
+			return metric, err
+		}
+		for _, bouncer := range bouncers {
+			m := &models.MetricsBouncerInfo{
+				Version:    bouncer.Version,
+				CustomName: bouncer.Name,
+				Name:       bouncer.Type,
+				LastPull:   bouncer.LastPull.String(),
+			}
+			metric.Bouncers = append(metric.Bouncers, m)
 		}
-		metric.Bouncers = append(metric.Bouncers, m)
 	}
 	return metric, nil
 }
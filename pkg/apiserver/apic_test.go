@@ -357,6 +357,65 @@ func TestAPICGetMetrics(t *testing.T) {
 	}
 }
 
+func TestBuildMetricsSharingOptions(t *testing.T) {
+	dbClient := getDBClient(t)
+	dbClient.Ent.Machine.Create().
+		SetMachineId("a").
+		SetPassword(testPassword.String()).
+		SetIpAddress("1.2.3.4").
+		SetScenarios("crowdsecurity/test").
+		ExecX(context.Background())
+	dbClient.Ent.Bouncer.Create().
+		SetIPAddress("1.2.3.4").
+		SetName("1").
+		SetAPIKey("foobar").
+		SetRevoked(false).
+		SetLastPull(time.Time{}).
+		ExecX(context.Background())
+
+	testCases := []struct {
+		name             string
+		consoleConfig    *csconfig.ConsoleConfig
+		expectedMachines int
+		expectedBouncers int
+	}{
+		{
+			name:             "no console config",
+			consoleConfig:    nil,
+			expectedMachines: 1,
+			expectedBouncers: 1,
+		},
+		{
+			name: "no machines",
+			consoleConfig: &csconfig.ConsoleConfig{
+				ShareMachinesMetrics: types.BoolPtr(false),
+				ShareBouncersMetrics: types.BoolPtr(true),
+			},
+			expectedMachines: 0,
+			expectedBouncers: 1,
+		},
+		{
+			name: "no bouncers",
+			consoleConfig: &csconfig.ConsoleConfig{
+				ShareMachinesMetrics: types.BoolPtr(true),
+				ShareBouncersMetrics: types.BoolPtr(false),
+			},
+			expectedMachines: 1,
+			expectedBouncers: 0,
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			metrics, err := BuildMetrics(dbClient, testCase.consoleConfig)
+			assert.NoError(t, err)
+			assert.Len(t, metrics.Machines, testCase.expectedMachines)
+			assert.Len(t, metrics.Bouncers, testCase.expectedBouncers)
+			assert.NotNil(t, metrics.Machines)
+			assert.NotNil(t, metrics.Bouncers)
+		})
+	}
+}
+
 func TestCreateAlertsForDecision(t *testing.T) {
 
 	httpBfDecisionList := &models.Decision{
@@ -194,12 +194,13 @@ func NewServer(config *csconfig.LocalApiServerCfg) (*APIServer, error) {
 	router.Use(CustomRecoveryWithWriter())
 
 	controller := &controllers.Controller{
-		DBClient:      dbClient,
-		Ectx:          context.Background(),
-		Router:        router,
-		Profiles:      config.Profiles,
-		Log:           clog,
-		ConsoleConfig: config.ConsoleConfig,
+		DBClient:             dbClient,
+		Ectx:                 context.Background(),
+		Router:               router,
+		Profiles:             config.Profiles,
+		Log:                  clog,
+		ConsoleConfig:        config.ConsoleConfig,
+		DecisionsStreamCache: config.DecisionsStreamCache,
 	}
 
 	var apiClient *apic
@@ -16,15 +16,16 @@ import (
 )
 
 type Controller struct {
-	Ectx          context.Context
-	DBClient      *database.Client
-	Router        *gin.Engine
-	Profiles      []*csconfig.ProfileCfg
-	CAPIChan      chan []*models.Alert
-	PluginChannel chan csplugin.ProfileAlert
-	Log           *log.Logger
-	ConsoleConfig *csconfig.ConsoleConfig
-	TrustedIPs    []net.IPNet
+	Ectx                 context.Context
+	DBClient             *database.Client
+	Router               *gin.Engine
+	Profiles             []*csconfig.ProfileCfg
+	CAPIChan             chan []*models.Alert
+	PluginChannel        chan csplugin.ProfileAlert
+	Log                  *log.Logger
+	ConsoleConfig        *csconfig.ConsoleConfig
+	TrustedIPs           []net.IPNet
+	DecisionsStreamCache *csconfig.DecisionsStreamCacheCfg
 }
 
 func (c *Controller) Init() error {
@@ -56,7 +57,7 @@ func serveHealth() http.HandlerFunc {
 
 func (c *Controller) NewV1() error {
 
-	handlerV1, err := v1.New(c.DBClient, c.Ectx, c.Profiles, c.CAPIChan, c.PluginChannel, *c.ConsoleConfig, c.TrustedIPs)
+	handlerV1, err := v1.New(c.DBClient, c.Ectx, c.Profiles, c.CAPIChan, c.PluginChannel, *c.ConsoleConfig, c.TrustedIPs, c.DecisionsStreamCache)
 	if err != nil {
 		return err
 	}
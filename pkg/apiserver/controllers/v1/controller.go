@@ -21,9 +21,10 @@ type Controller struct {
 	PluginChannel chan csplugin.ProfileAlert
 	ConsoleConfig csconfig.ConsoleConfig
 	TrustedIPs    []net.IPNet
+	streamCache   *decisionsStreamCache
 }
 
-func New(dbClient *database.Client, ctx context.Context, profiles []*csconfig.ProfileCfg, capiChan chan []*models.Alert, pluginChannel chan csplugin.ProfileAlert, consoleConfig csconfig.ConsoleConfig, trustedIPs []net.IPNet) (*Controller, error) {
+func New(dbClient *database.Client, ctx context.Context, profiles []*csconfig.ProfileCfg, capiChan chan []*models.Alert, pluginChannel chan csplugin.ProfileAlert, consoleConfig csconfig.ConsoleConfig, trustedIPs []net.IPNet, streamCacheCfg *csconfig.DecisionsStreamCacheCfg) (*Controller, error) {
 	var err error
 	v1 := &Controller{
 		Ectx:          ctx,
@@ -35,6 +36,10 @@ func New(dbClient *database.Client, ctx context.Context, profiles []*csconfig.Pr
 		ConsoleConfig: consoleConfig,
 		TrustedIPs:    trustedIPs,
 	}
+	v1.streamCache, err = newDecisionsStreamCache(dbClient, streamCacheCfg)
+	if err != nil {
+		return v1, err
+	}
 	v1.Middlewares, err = middlewares.NewMiddlewares(dbClient)
 	if err != nil {
 		return v1, err
@@ -1,6 +1,7 @@
 package v1
 
 import (
+	"encoding/json"
 	"net/http"
 	"strconv"
 	"time"
@@ -129,9 +130,33 @@ func (c *Controller) StreamDecision(gctx *gin.Context) {
 		filters["scopes"] = []string{"ip,range"}
 	}
 
+	var etag string
+	if c.streamCache != nil {
+		etag, err = c.streamCache.ETag(filters)
+		if err != nil {
+			log.Errorf("unable to compute decisions stream state for '%s' : %v", bouncerInfo.Name, err)
+			gctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+			return
+		}
+		gctx.Header("ETag", etag)
+	}
+
 	// if the blocker just start, return all decisions
 	if val, ok := gctx.Request.URL.Query()["startup"]; ok {
 		if val[0] == "true" {
+			if body, ok := c.streamCache.get(etag); ok {
+				if err := c.DBClient.UpdateBouncerLastPull(streamStartTime, bouncerInfo.ID); err != nil {
+					log.Errorf("unable to update bouncer '%s' pull: %v", bouncerInfo.Name, err)
+					gctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+					return
+				}
+				if gctx.Request.Method == "HEAD" {
+					gctx.String(http.StatusOK, "")
+					return
+				}
+				gctx.Data(http.StatusOK, "application/json; charset=utf-8", body)
+				return
+			}
 			data, err := c.DBClient.QueryAllDecisionsWithFilters(filters)
 			if err != nil {
 				log.Errorf("failed querying decisions: %v", err)
@@ -168,11 +193,33 @@ func (c *Controller) StreamDecision(gctx *gin.Context) {
 				gctx.String(http.StatusOK, "")
 				return
 			}
+			if c.streamCache != nil {
+				body, err := json.Marshal(ret)
+				if err != nil {
+					log.Errorf("unable to serialize decisions for '%s' : %v", bouncerInfo.Name, err)
+					gctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+					return
+				}
+				c.streamCache.set(etag, body)
+				gctx.Data(http.StatusOK, "application/json; charset=utf-8", body)
+				return
+			}
 			gctx.JSON(http.StatusOK, ret)
 			return
 		}
 	}
 
+	// the bouncer already has the current state : nothing changed since its last pull
+	if etag != "" && gctx.GetHeader("If-None-Match") == etag {
+		if err := c.DBClient.UpdateBouncerLastPull(streamStartTime, bouncerInfo.ID); err != nil {
+			log.Errorf("unable to update bouncer '%s' pull: %v", bouncerInfo.Name, err)
+			gctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+			return
+		}
+		gctx.Status(http.StatusNotModified)
+		return
+	}
+
 	// getting new decisions
 	data, err = c.DBClient.QueryNewDecisionsSinceWithFilters(bouncerInfo.LastPull, filters)
 	if err != nil {
@@ -0,0 +1,122 @@
+package v1
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/csconfig"
+	"github.com/crowdsecurity/crowdsec/pkg/database"
+)
+
+/*
+The decisions stream state is identified by a generation, that changes whenever :
+  - decisions are written through our database client
+  - the first active decision expires (expired decisions are part of the delta)
+  - max_age elapsed, to pick up writes made by other processes sharing the database
+
+A bouncer presenting the ETag of the current generation has nothing new to fetch.
+*/
+type decisionsStreamCache struct {
+	sync.Mutex
+	dbClient   *database.Client
+	maxAge     time.Duration
+	maxEntries int
+	// instance makes sure ETags issued by a previous run never match
+	instance   string
+	dbVersion  uint64
+	generation uint64
+	validUntil time.Time
+	// startup streams, keyed by ETag
+	entries map[string][]byte
+}
+
+func newDecisionsStreamCache(dbClient *database.Client, config *csconfig.DecisionsStreamCacheCfg) (*decisionsStreamCache, error) {
+	if config == nil || !config.Enabled {
+		return nil, nil
+	}
+	instance := make([]byte, 4)
+	if _, err := rand.Read(instance); err != nil {
+		return nil, fmt.Errorf("unable to generate stream cache instance id: %s", err)
+	}
+	cache := &decisionsStreamCache{
+		dbClient:   dbClient,
+		maxAge:     csconfig.DEFAULT_STREAM_CACHE_MAX_AGE,
+		maxEntries: csconfig.DEFAULT_STREAM_CACHE_MAX_ENTRIES,
+		instance:   hex.EncodeToString(instance),
+		entries:    make(map[string][]byte),
+	}
+	if config.MaxAge != nil {
+		cache.maxAge = *config.MaxAge
+	}
+	if config.MaxEntries > 0 {
+		cache.maxEntries = config.MaxEntries
+	}
+	return cache, nil
+}
+
+// currentGeneration must be called before querying the decisions, so that any write happening
+// during the query is reflected in the next generation
+func (s *decisionsStreamCache) currentGeneration() (uint64, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now().UTC()
+	version := s.dbClient.DecisionsVersion()
+	if s.generation != 0 && version == s.dbVersion && now.Before(s.validUntil) {
+		return s.generation, nil
+	}
+	next, err := s.dbClient.NextDecisionExpiration()
+	if err != nil {
+		return 0, err
+	}
+	s.generation++
+	s.dbVersion = version
+	s.validUntil = now.Add(s.maxAge)
+	if !next.IsZero() && next.Before(s.validUntil) {
+		s.validUntil = next
+	}
+	s.entries = make(map[string][]byte)
+	return s.generation, nil
+}
+
+// ETag identifies the state of the decisions stream for a given set of filters
+func (s *decisionsStreamCache) ETag(filters url.Values) (string, error) {
+	generation, err := s.currentGeneration()
+	if err != nil {
+		return "", err
+	}
+	key := url.Values{}
+	for k, v := range filters {
+		if k == "startup" {
+			continue
+		}
+		key[k] = v
+	}
+	h := fnv.New64a()
+	h.Write([]byte(key.Encode()))
+	return fmt.Sprintf(`"%s-%d-%x"`, s.instance, generation, h.Sum64()), nil
+}
+
+func (s *decisionsStreamCache) get(etag string) ([]byte, bool) {
+	if s == nil {
+		return nil, false
+	}
+	s.Lock()
+	defer s.Unlock()
+	body, ok := s.entries[etag]
+	return body, ok
+}
+
+func (s *decisionsStreamCache) set(etag string, body []byte) {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.entries) >= s.maxEntries {
+		return
+	}
+	s.entries[etag] = body
+}
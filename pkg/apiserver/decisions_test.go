@@ -1,10 +1,14 @@
 package apiserver
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
+	"github.com/crowdsecurity/crowdsec/pkg/csconfig"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestDeleteDecisionRange(t *testing.T) {
@@ -429,3 +433,71 @@ func TestStreamDecisionFilters(t *testing.T) {
 	assert.Equal(t, decisions["new"][0].ID, int64(1))
 	assert.Equal(t, decisions["new"][1].ID, int64(2))
 }
+
+func TestStreamDecisionETag(t *testing.T) {
+	config := LoadTestConfig()
+	maxAge := time.Hour
+	config.API.Server.DecisionsStreamCache = &csconfig.DecisionsStreamCacheCfg{
+		Enabled:    true,
+		MaxAge:     &maxAge,
+		MaxEntries: 10,
+	}
+	apiServer, err := NewServer(config.API.Server)
+	require.NoError(t, err)
+	require.NoError(t, apiServer.InitController())
+	router, err := apiServer.Router()
+	require.NoError(t, err)
+	loginResp, err := LoginToTestAPI(router, config)
+	require.NoError(t, err)
+	APIKey, err := CreateTestBouncer(config.API.Server.DbConfig)
+	require.NoError(t, err)
+	lapi := LAPI{router: router, loginResp: loginResp, bouncerKey: APIKey, t: t}
+
+	conditionalStream := func(etag string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/v1/decisions/stream", nil)
+		require.NoError(t, err)
+		req.Header.Add("X-Api-Key", APIKey)
+		req.Header.Add("If-None-Match", etag)
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	lapi.InsertAlertFromFile("./tests/alert_stream_fixture.json")
+
+	w := lapi.RecordResponse("GET", "/v1/decisions/stream?startup=true", emptyBody)
+	decisions, code, err := readDecisionsStreamResp(w)
+	require.NoError(t, err)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, 3, len(decisions["new"]))
+	etag := w.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	// startup stream is served from the cache, with the same content
+	w = lapi.RecordResponse("GET", "/v1/decisions/stream?startup=true", emptyBody)
+	decisions, code, err = readDecisionsStreamResp(w)
+	require.NoError(t, err)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, 3, len(decisions["new"]))
+	assert.Equal(t, etag, w.Header().Get("ETag"))
+
+	// nothing changed
+	w = conditionalStream(etag)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Equal(t, 0, w.Body.Len())
+
+	// another filter set has another state
+	w = lapi.RecordResponse("GET", "/v1/decisions/stream?scenarios_containing=http", emptyBody)
+	assert.Equal(t, 200, w.Code)
+	assert.NotEqual(t, etag, w.Header().Get("ETag"))
+
+	// a deletion invalidates the state
+	w = lapi.RecordResponse("DELETE", "/v1/decisions", emptyBody)
+	assert.Equal(t, 200, w.Code)
+	w = conditionalStream(etag)
+	decisions, code, err = readDecisionsStreamResp(w)
+	require.NoError(t, err)
+	assert.Equal(t, 200, code)
+	assert.NotEqual(t, etag, w.Header().Get("ETag"))
+	assert.NotEmpty(t, decisions["deleted"])
+}
@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"net"
 	"strings"
+	"time"
 
 	"github.com/crowdsecurity/crowdsec/pkg/apiclient"
 	"github.com/crowdsecurity/crowdsec/pkg/yamlpatch"
@@ -107,24 +108,39 @@ func toValidCIDR(ip string) string {
 
 /*local api service configuration*/
 type LocalApiServerCfg struct {
-	ListenURI              string              `yaml:"listen_uri,omitempty"` //127.0.0.1:8080
-	TLS                    *TLSCfg             `yaml:"tls"`
-	DbConfig               *DatabaseCfg        `yaml:"-"`
-	LogDir                 string              `yaml:"-"`
-	LogMedia               string              `yaml:"-"`
-	OnlineClient           *OnlineApiClientCfg `yaml:"online_client"`
-	ProfilesPath           string              `yaml:"profiles_path,omitempty"`
-	ConsoleConfigPath      string              `yaml:"console_path,omitempty"`
-	ConsoleConfig          *ConsoleConfig      `yaml:"-"`
-	Profiles               []*ProfileCfg       `yaml:"-"`
-	LogLevel               *log.Level          `yaml:"log_level"`
-	UseForwardedForHeaders bool                `yaml:"use_forwarded_for_headers,omitempty"`
-	TrustedProxies         *[]string           `yaml:"trusted_proxies,omitempty"`
-	CompressLogs           *bool               `yaml:"-"`
-	LogMaxSize             int                 `yaml:"-"`
-	LogMaxAge              int                 `yaml:"-"`
-	LogMaxFiles            int                 `yaml:"-"`
-	TrustedIPs             []string            `yaml:"trusted_ips,omitempty"`
+	ListenURI              string                   `yaml:"listen_uri,omitempty"` //127.0.0.1:8080
+	TLS                    *TLSCfg                  `yaml:"tls"`
+	DbConfig               *DatabaseCfg             `yaml:"-"`
+	LogDir                 string                   `yaml:"-"`
+	LogMedia               string                   `yaml:"-"`
+	OnlineClient           *OnlineApiClientCfg      `yaml:"online_client"`
+	ProfilesPath           string                   `yaml:"profiles_path,omitempty"`
+	ConsoleConfigPath      string                   `yaml:"console_path,omitempty"`
+	ConsoleConfig          *ConsoleConfig           `yaml:"-"`
+	Profiles               []*ProfileCfg            `yaml:"-"`
+	LogLevel               *log.Level               `yaml:"log_level"`
+	UseForwardedForHeaders bool                     `yaml:"use_forwarded_for_headers,omitempty"`
+	TrustedProxies         *[]string                `yaml:"trusted_proxies,omitempty"`
+	CompressLogs           *bool                    `yaml:"-"`
+	LogMaxSize             int                      `yaml:"-"`
+	LogMaxAge              int                      `yaml:"-"`
+	LogMaxFiles            int                      `yaml:"-"`
+	TrustedIPs             []string                 `yaml:"trusted_ips,omitempty"`
+	DecisionsStreamCache   *DecisionsStreamCacheCfg `yaml:"decisions_stream_cache,omitempty"`
+}
+
+const (
+	DEFAULT_STREAM_CACHE_MAX_AGE     = 10 * time.Second
+	DEFAULT_STREAM_CACHE_MAX_ENTRIES = 100
+)
+
+// DecisionsStreamCacheCfg allows LAPI to answer 304 to bouncers polling the decisions stream when nothing changed,
+// and to serve startup streams from memory
+type DecisionsStreamCacheCfg struct {
+	Enabled bool `yaml:"enabled"`
+	// MaxAge bounds how long a state is trusted : decisions written by another process (ie. cscli) are only seen after it
+	MaxAge     *time.Duration `yaml:"max_age,omitempty"`
+	MaxEntries int            `yaml:"max_entries,omitempty"`
 }
 
 type TLSCfg struct {
@@ -149,6 +165,15 @@ func (c *Config) LoadAPIServer() error {
 		if c.API.Server.TrustedProxies != nil {
 			c.API.Server.UseForwardedForHeaders = true
 		}
+		if cache := c.API.Server.DecisionsStreamCache; cache != nil && cache.Enabled {
+			if cache.MaxAge == nil {
+				maxAge := DEFAULT_STREAM_CACHE_MAX_AGE
+				cache.MaxAge = &maxAge
+			}
+			if cache.MaxEntries <= 0 {
+				cache.MaxEntries = DEFAULT_STREAM_CACHE_MAX_ENTRIES
+			}
+		}
 		if err := c.API.Server.LoadProfiles(); err != nil {
 			return errors.Wrap(err, "while loading profiles for LAPI")
 		}
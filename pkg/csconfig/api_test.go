@@ -213,6 +213,8 @@ func TestLoadAPIServer(t *testing.T) {
 					ShareManualDecisions:  types.BoolPtr(false),
 					ShareTaintedScenarios: types.BoolPtr(true),
 					ShareCustomScenarios:  types.BoolPtr(true),
+					ShareMachinesMetrics:  types.BoolPtr(true),
+					ShareBouncersMetrics:  types.BoolPtr(true),
 				},
 				LogDir:   LogDirFullPath,
 				LogMedia: "stdout",
@@ -15,16 +15,23 @@ const (
 	SEND_CUSTOM_SCENARIOS  = "custom"
 	SEND_TAINTED_SCENARIOS = "tainted"
 	SEND_MANUAL_SCENARIOS  = "manual"
+	SEND_MACHINES_METRICS  = "machines_metrics"
+	SEND_BOUNCERS_METRICS  = "bouncers_metrics"
 )
 
 var CONSOLE_CONFIGS = []string{SEND_CUSTOM_SCENARIOS, SEND_MANUAL_SCENARIOS, SEND_TAINTED_SCENARIOS}
 
+// METRICS_CONFIGS are the usage metrics categories that can be individually sent or withheld
+var METRICS_CONFIGS = []string{SEND_MACHINES_METRICS, SEND_BOUNCERS_METRICS}
+
 var DefaultConsoleConfigFilePath = DefaultConfigPath("console.yaml")
 
 type ConsoleConfig struct {
 	ShareManualDecisions  *bool `yaml:"share_manual_decisions"`
 	ShareTaintedScenarios *bool `yaml:"share_tainted"`
 	ShareCustomScenarios  *bool `yaml:"share_custom"`
+	ShareMachinesMetrics  *bool `yaml:"share_machines_metrics"`
+	ShareBouncersMetrics  *bool `yaml:"share_bouncers_metrics"`
 }
 
 func (c *LocalApiServerCfg) LoadConsoleConfig() error {
@@ -34,6 +41,8 @@ func (c *LocalApiServerCfg) LoadConsoleConfig() error {
 		c.ConsoleConfig.ShareCustomScenarios = types.BoolPtr(true)
 		c.ConsoleConfig.ShareTaintedScenarios = types.BoolPtr(true)
 		c.ConsoleConfig.ShareManualDecisions = types.BoolPtr(false)
+		c.ConsoleConfig.ShareMachinesMetrics = types.BoolPtr(true)
+		c.ConsoleConfig.ShareBouncersMetrics = types.BoolPtr(true)
 		return nil
 	}
 
@@ -58,6 +67,14 @@ func (c *LocalApiServerCfg) LoadConsoleConfig() error {
 		log.Debugf("no share_manual scenarios found, setting to false")
 		c.ConsoleConfig.ShareManualDecisions = types.BoolPtr(false)
 	}
+	if c.ConsoleConfig.ShareMachinesMetrics == nil {
+		log.Debugf("no share_machines_metrics found, setting to true")
+		c.ConsoleConfig.ShareMachinesMetrics = types.BoolPtr(true)
+	}
+	if c.ConsoleConfig.ShareBouncersMetrics == nil {
+		log.Debugf("no share_bouncers_metrics found, setting to true")
+		c.ConsoleConfig.ShareBouncersMetrics = types.BoolPtr(true)
+	}
 	log.Debugf("Console configuration '%s' loaded successfully", c.ConsoleConfigPath)
 
 	return nil
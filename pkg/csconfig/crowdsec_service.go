@@ -4,25 +4,58 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
+const DEFAULT_ACQUISITION_CURSORS_FILE = "acquisition_cursors.json"
+
+const (
+	DEFAULT_DEAD_LETTER_QUEUE_FILE      = "dead_letter_queue.log"
+	DEFAULT_DEAD_LETTER_QUEUE_MAX_SIZE  = 10 //in megabytes
+	DEFAULT_DEAD_LETTER_QUEUE_MAX_FILES = 3
+)
+
+// DeadLetterQueueCfg configures the file where the lines that exit the parsers unparsed are written
+type DeadLetterQueueCfg struct {
+	Enabled  bool     `yaml:"enabled"`
+	Path     string   `yaml:"path,omitempty"`
+	MaxSize  int      `yaml:"max_size,omitempty"`  //in megabytes, the file is rotated when it reaches this size
+	MaxFiles int      `yaml:"max_files,omitempty"` //number of rotated files to keep
+	Types    []string `yaml:"types,omitempty"`     //only capture the lines of these log types (the 'type' label of the datasource)
+}
+
+// AcquisitionLimitsCfg bounds the resources used by all the datasources together
+type AcquisitionLimitsCfg struct {
+	MaxActiveTailers int            `yaml:"max_active_tailers,omitempty"` //files or containers read at the same time, the others wait for their turn
+	TailerQuantum    *time.Duration `yaml:"tailer_quantum,omitempty"`     //how long a tailer keeps its slot when others are waiting
+	MaxReadRate      float64        `yaml:"max_read_rate,omitempty"`      //lines per second, shared fairly by the datasources
+	ReadBurst        int            `yaml:"read_burst,omitempty"`
+}
+
 /*Configurations needed for crowdsec to load parser/scenarios/... + acquisition*/
 type CrowdsecServiceCfg struct {
-	AcquisitionFilePath string `yaml:"acquisition_path,omitempty"`
-	AcquisitionDirPath  string `yaml:"acquisition_dir,omitempty"`
-
-	AcquisitionFiles     []string          `yaml:"-"`
-	ParserRoutinesCount  int               `yaml:"parser_routines"`
-	BucketsRoutinesCount int               `yaml:"buckets_routines"`
-	OutputRoutinesCount  int               `yaml:"output_routines"`
-	SimulationConfig     *SimulationConfig `yaml:"-"`
-	LintOnly             bool              `yaml:"-"`                          //if set to true, exit after loading configs
-	BucketStateFile      string            `yaml:"state_input_file,omitempty"` //if we need to unserialize buckets at start
-	BucketStateDumpDir   string            `yaml:"state_output_dir,omitempty"` //if we need to unserialize buckets on shutdown
-	BucketsGCEnabled     bool              `yaml:"-"`                          //we need to garbage collect buckets when in forensic mode
+	AcquisitionFilePath  string `yaml:"acquisition_path,omitempty"`
+	AcquisitionDirPath   string `yaml:"acquisition_dir,omitempty"`
+	AcquisitionHotReload bool   `yaml:"acquisition_hot_reload,omitempty"` //restart the datasources of an acquisition file when it changes
+
+	AcquisitionFiles       []string              `yaml:"-"`
+	ParserRoutinesCount    int                   `yaml:"parser_routines"`
+	ParserSharding         bool                  `yaml:"parser_sharding,omitempty"` //dispatch events to parser routines by source, to keep per-source ordering
+	BucketsRoutinesCount   int                   `yaml:"buckets_routines"`
+	OutputRoutinesCount    int                   `yaml:"output_routines"`
+	SimulationConfig       *SimulationConfig     `yaml:"-"`
+	LintOnly               bool                  `yaml:"-"`                                  //if set to true, exit after loading configs
+	BucketStateFile        string                `yaml:"state_input_file,omitempty"`         //if we need to unserialize buckets at start
+	BucketStateDumpDir     string                `yaml:"state_output_dir,omitempty"`         //if we need to unserialize buckets on shutdown
+	BucketsGCEnabled       bool                  `yaml:"-"`                                  //we need to garbage collect buckets when in forensic mode
+	AcquisitionCursorsPath string                `yaml:"acquisition_cursors_path,omitempty"` //where the datasources save their position
+	DeadLetterQueue        *DeadLetterQueueCfg   `yaml:"dead_letter_queue,omitempty"`        //capture the lines that were not parsed
+	AcquisitionLimits      *AcquisitionLimitsCfg `yaml:"acquisition_limits,omitempty"`       //bound the tailers and the read rate of all the datasources
+	//unix socket to pause and resume the datasources (cscli acquisition pause/resume), disabled if empty
+	AcquisitionControlSocket string `yaml:"acquisition_control_socket,omitempty"`
 
 	HubDir             string `yaml:"-"`
 	DataDir            string `yaml:"-"`
@@ -78,6 +111,32 @@ func (c *Config) LoadCrowdsec() error {
 	c.Crowdsec.DataDir = c.ConfigPaths.DataDir
 	c.Crowdsec.HubDir = c.ConfigPaths.HubDir
 	c.Crowdsec.HubIndexFile = c.ConfigPaths.HubIndexFile
+	if c.Crowdsec.AcquisitionCursorsPath == "" {
+		c.Crowdsec.AcquisitionCursorsPath = filepath.Join(c.Crowdsec.DataDir, DEFAULT_ACQUISITION_CURSORS_FILE)
+	}
+	if c.Crowdsec.DeadLetterQueue != nil && c.Crowdsec.DeadLetterQueue.Enabled {
+		if c.Crowdsec.DeadLetterQueue.Path == "" {
+			c.Crowdsec.DeadLetterQueue.Path = filepath.Join(c.Crowdsec.DataDir, DEFAULT_DEAD_LETTER_QUEUE_FILE)
+		}
+		if c.Crowdsec.DeadLetterQueue.MaxSize <= 0 {
+			c.Crowdsec.DeadLetterQueue.MaxSize = DEFAULT_DEAD_LETTER_QUEUE_MAX_SIZE
+		}
+		if c.Crowdsec.DeadLetterQueue.MaxFiles <= 0 {
+			c.Crowdsec.DeadLetterQueue.MaxFiles = DEFAULT_DEAD_LETTER_QUEUE_MAX_FILES
+		}
+	}
+	if c.Crowdsec.AcquisitionLimits != nil {
+		limits := c.Crowdsec.AcquisitionLimits
+		if limits.MaxActiveTailers < 0 {
+			return fmt.Errorf("acquisition_limits.max_active_tailers must be positive")
+		}
+		if limits.TailerQuantum != nil && *limits.TailerQuantum <= 0 {
+			return fmt.Errorf("acquisition_limits.tailer_quantum must be positive")
+		}
+		if limits.MaxReadRate < 0 || limits.ReadBurst < 0 {
+			return fmt.Errorf("acquisition_limits.max_read_rate and read_burst must be positive")
+		}
+	}
 	if c.Crowdsec.ParserRoutinesCount <= 0 {
 		c.Crowdsec.ParserRoutinesCount = 1
 	}
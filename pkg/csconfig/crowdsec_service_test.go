@@ -36,6 +36,8 @@ func TestLoadCrowdsec(t *testing.T) {
 		t.Fatalf(err.Error())
 	}
 
+	cursorsFullPath := filepath.Join(dataFullPath, DEFAULT_ACQUISITION_CURSORS_FILE)
+
 	configDirFullPath, err := filepath.Abs("./tests")
 	if err != nil {
 		t.Fatalf(err.Error())
@@ -71,17 +73,18 @@ func TestLoadCrowdsec(t *testing.T) {
 				},
 			},
 			expectedResult: &CrowdsecServiceCfg{
-				AcquisitionDirPath:   "",
-				AcquisitionFilePath:  acquisFullPath,
-				ConfigDir:            configDirFullPath,
-				DataDir:              dataFullPath,
-				HubDir:               hubFullPath,
-				HubIndexFile:         hubIndexFileFullPath,
-				BucketsRoutinesCount: 1,
-				ParserRoutinesCount:  1,
-				OutputRoutinesCount:  1,
-				AcquisitionFiles:     []string{acquisFullPath},
-				SimulationFilePath:   "./tests/simulation.yaml",
+				AcquisitionDirPath:     "",
+				AcquisitionFilePath:    acquisFullPath,
+				ConfigDir:              configDirFullPath,
+				DataDir:                dataFullPath,
+				HubDir:                 hubFullPath,
+				AcquisitionCursorsPath: cursorsFullPath,
+				HubIndexFile:           hubIndexFileFullPath,
+				BucketsRoutinesCount:   1,
+				ParserRoutinesCount:    1,
+				OutputRoutinesCount:    1,
+				AcquisitionFiles:       []string{acquisFullPath},
+				SimulationFilePath:     "./tests/simulation.yaml",
 				SimulationConfig: &SimulationConfig{
 					Simulation: &falseBoolPtr,
 				},
@@ -107,20 +110,68 @@ func TestLoadCrowdsec(t *testing.T) {
 				},
 			},
 			expectedResult: &CrowdsecServiceCfg{
-				AcquisitionDirPath:   acquisDirFullPath,
-				AcquisitionFilePath:  acquisFullPath,
-				ConfigDir:            configDirFullPath,
-				HubIndexFile:         hubIndexFileFullPath,
-				DataDir:              dataFullPath,
-				HubDir:               hubFullPath,
-				BucketsRoutinesCount: 1,
-				ParserRoutinesCount:  1,
-				OutputRoutinesCount:  1,
-				AcquisitionFiles:     []string{acquisFullPath, acquisInDirFullPath},
-				SimulationFilePath:   "./tests/simulation.yaml",
+				AcquisitionDirPath:     acquisDirFullPath,
+				AcquisitionFilePath:    acquisFullPath,
+				ConfigDir:              configDirFullPath,
+				HubIndexFile:           hubIndexFileFullPath,
+				DataDir:                dataFullPath,
+				HubDir:                 hubFullPath,
+				AcquisitionCursorsPath: cursorsFullPath,
+				BucketsRoutinesCount:   1,
+				ParserRoutinesCount:    1,
+				OutputRoutinesCount:    1,
+				AcquisitionFiles:       []string{acquisFullPath, acquisInDirFullPath},
+				SimulationFilePath:     "./tests/simulation.yaml",
+				SimulationConfig: &SimulationConfig{
+					Simulation: &falseBoolPtr,
+				},
+			},
+		},
+		{
+			name: "dead letter queue defaults",
+			Input: &Config{
+				ConfigPaths: &ConfigurationPaths{
+					ConfigDir: "./tests",
+					DataDir:   "./data",
+					HubDir:    "./hub",
+				},
+				API: &APICfg{
+					Client: &LocalApiClientCfg{
+						CredentialsFilePath: "./tests/lapi-secrets.yaml",
+					},
+				},
+				Crowdsec: &CrowdsecServiceCfg{
+					AcquisitionFilePath: "./tests/acquis.yaml",
+					SimulationFilePath:  "./tests/simulation.yaml",
+					DeadLetterQueue: &DeadLetterQueueCfg{
+						Enabled: true,
+						Types:   []string{"nginx"},
+					},
+				},
+			},
+			expectedResult: &CrowdsecServiceCfg{
+				AcquisitionDirPath:     "",
+				AcquisitionFilePath:    acquisFullPath,
+				ConfigDir:              configDirFullPath,
+				DataDir:                dataFullPath,
+				HubDir:                 hubFullPath,
+				AcquisitionCursorsPath: cursorsFullPath,
+				HubIndexFile:           hubIndexFileFullPath,
+				BucketsRoutinesCount:   1,
+				ParserRoutinesCount:    1,
+				OutputRoutinesCount:    1,
+				AcquisitionFiles:       []string{acquisFullPath},
+				SimulationFilePath:     "./tests/simulation.yaml",
 				SimulationConfig: &SimulationConfig{
 					Simulation: &falseBoolPtr,
 				},
+				DeadLetterQueue: &DeadLetterQueueCfg{
+					Enabled:  true,
+					Path:     filepath.Join(dataFullPath, DEFAULT_DEAD_LETTER_QUEUE_FILE),
+					MaxSize:  DEFAULT_DEAD_LETTER_QUEUE_MAX_SIZE,
+					MaxFiles: DEFAULT_DEAD_LETTER_QUEUE_MAX_FILES,
+					Types:    []string{"nginx"},
+				},
 			},
 		},
 		{
@@ -139,13 +190,14 @@ func TestLoadCrowdsec(t *testing.T) {
 				Crowdsec: &CrowdsecServiceCfg{},
 			},
 			expectedResult: &CrowdsecServiceCfg{
-				BucketsRoutinesCount: 1,
-				ParserRoutinesCount:  1,
-				OutputRoutinesCount:  1,
-				ConfigDir:            configDirFullPath,
-				HubIndexFile:         hubIndexFileFullPath,
-				DataDir:              dataFullPath,
-				HubDir:               hubFullPath,
+				BucketsRoutinesCount:   1,
+				ParserRoutinesCount:    1,
+				OutputRoutinesCount:    1,
+				ConfigDir:              configDirFullPath,
+				HubIndexFile:           hubIndexFileFullPath,
+				DataDir:                dataFullPath,
+				HubDir:                 hubFullPath,
+				AcquisitionCursorsPath: cursorsFullPath,
 				SimulationConfig: &SimulationConfig{
 					Simulation: &falseBoolPtr,
 				},
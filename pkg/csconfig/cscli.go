@@ -4,6 +4,7 @@ package csconfig
 type CscliCfg struct {
 	Output             string            `yaml:"output,omitempty"`
 	HubBranch          string            `yaml:"hub_branch"`
+	HubSignature       *HubSignatureCfg  `yaml:"hub_signature,omitempty"`
 	SimulationConfig   *SimulationConfig `yaml:"-"`
 	DbConfig           *DatabaseCfg      `yaml:"-"`
 	HubDir             string            `yaml:"-"`
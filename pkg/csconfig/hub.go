@@ -1,11 +1,25 @@
 package csconfig
 
+import (
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/pkg/errors"
+)
+
 /*cscli specific config, such as hub directory*/
 type Hub struct {
-	HubDir       string `yaml:"-"`
-	ConfigDir    string `yaml:"-"`
-	HubIndexFile string `yaml:"-"`
-	DataDir      string `yaml:"-"`
+	HubDir       string                   `yaml:"-"`
+	ConfigDir    string                   `yaml:"-"`
+	HubIndexFile string                   `yaml:"-"`
+	DataDir      string                   `yaml:"-"`
+	Verifier     *types.SignatureVerifier `yaml:"-"`
+}
+
+/*detached signature verification of hub index, items and data files*/
+type HubSignatureCfg struct {
+	Enabled         bool     `yaml:"enabled"`
+	Policy          string   `yaml:"policy,omitempty"` //hard_fail|soft_fail
+	TrustedKeys     []string `yaml:"trusted_keys,omitempty"`
+	TrustedKeyFiles []string `yaml:"trusted_key_files,omitempty"`
 }
 
 func (c *Config) LoadHub() error {
@@ -20,5 +34,14 @@ func (c *Config) LoadHub() error {
 		DataDir:      c.ConfigPaths.DataDir,
 	}
 
+	if c.Cscli != nil && c.Cscli.HubSignature != nil && c.Cscli.HubSignature.Enabled {
+		sigCfg := c.Cscli.HubSignature
+		verifier, err := types.NewSignatureVerifier(sigCfg.TrustedKeys, sigCfg.TrustedKeyFiles, sigCfg.Policy)
+		if err != nil {
+			return errors.Wrap(err, "while loading hub signature configuration")
+		}
+		c.Hub.Verifier = verifier
+	}
+
 	return nil
 }
@@ -1,6 +1,9 @@
 package csconfig
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 /**/
 type PrometheusCfg struct {
@@ -8,6 +11,19 @@ type PrometheusCfg struct {
 	Level      string `yaml:"level"` //aggregated|full
 	ListenAddr string `yaml:"listen_addr"`
 	ListenPort int    `yaml:"listen_port"`
+	//pprof and runtime trace endpoints on the metrics listener, disabled by default
+	Profiling *ProfilingCfg `yaml:"profiling,omitempty"`
+}
+
+type ProfilingCfg struct {
+	Enabled bool `yaml:"enabled"`
+	//if set, profiles are dumped in this directory when the process is under high load
+	SnapshotDir         string         `yaml:"snapshot_dir,omitempty"`
+	SnapshotInterval    *time.Duration `yaml:"snapshot_interval,omitempty"`
+	SnapshotCPUDuration *time.Duration `yaml:"snapshot_cpu_duration,omitempty"`
+	GoroutinesThreshold int            `yaml:"goroutines_threshold,omitempty"`
+	HeapThresholdMB     uint64         `yaml:"heap_threshold_mb,omitempty"`
+	MaxSnapshots        int            `yaml:"max_snapshots,omitempty"`
 }
 
 func (c *Config) LoadPrometheus() error {
@@ -17,5 +33,29 @@ func (c *Config) LoadPrometheus() error {
 		}
 	}
 
+	if c.Prometheus != nil && c.Prometheus.Profiling != nil {
+		p := c.Prometheus.Profiling
+		if p.SnapshotInterval == nil {
+			d := time.Minute
+			p.SnapshotInterval = &d
+		}
+		if p.SnapshotCPUDuration == nil {
+			d := 10 * time.Second
+			p.SnapshotCPUDuration = &d
+		}
+		if *p.SnapshotCPUDuration >= *p.SnapshotInterval {
+			return fmt.Errorf("profiling snapshot_cpu_duration (%s) must be lower than snapshot_interval (%s)", *p.SnapshotCPUDuration, *p.SnapshotInterval)
+		}
+		if p.GoroutinesThreshold == 0 {
+			p.GoroutinesThreshold = 10000
+		}
+		if p.HeapThresholdMB == 0 {
+			p.HeapThresholdMB = 1024
+		}
+		if p.MaxSnapshots == 0 {
+			p.MaxSnapshots = 10
+		}
+	}
+
 	return nil
 }
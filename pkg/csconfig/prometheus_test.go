@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -53,3 +54,24 @@ func TestLoadPrometheus(t *testing.T) {
 		}
 	}
 }
+
+func TestLoadPrometheusProfiling(t *testing.T) {
+	cfg := &Config{
+		Prometheus: &PrometheusCfg{
+			Enabled:    true,
+			ListenAddr: "127.0.0.1",
+			ListenPort: 6060,
+			Profiling:  &ProfilingCfg{Enabled: true},
+		},
+	}
+	err := cfg.LoadPrometheus()
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, *cfg.Prometheus.Profiling.SnapshotInterval)
+	assert.Equal(t, 10*time.Second, *cfg.Prometheus.Profiling.SnapshotCPUDuration)
+	assert.Equal(t, 10, cfg.Prometheus.Profiling.MaxSnapshots)
+
+	interval := 5 * time.Second
+	cfg.Prometheus.Profiling = &ProfilingCfg{Enabled: true, SnapshotInterval: &interval}
+	err = cfg.LoadPrometheus()
+	assert.Error(t, err)
+}
@@ -0,0 +1,85 @@
+package csplugin
+
+import (
+	"path/filepath"
+	"runtime"
+
+	"github.com/crowdsecurity/crowdsec/pkg/csconfig"
+	"github.com/crowdsecurity/crowdsec/pkg/protobufs"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	plugin "github.com/hashicorp/go-plugin"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const DataSourcePluginType = "datasource"
+
+// DataSourcePluginClient talks to a running datasource plugin
+type DataSourcePluginClient struct {
+	protobufs.DataSourceClient
+	client *plugin.Client
+}
+
+func (c *DataSourcePluginClient) Kill() {
+	c.client.Kill()
+}
+
+// DataSourcePluginPath returns the path of the binary of a datasource plugin : <plugin_dir>/datasource-<name>
+func DataSourcePluginPath(pluginDir string, name string) string {
+	binaryPath := filepath.Join(pluginDir, DataSourcePluginType+"-"+name)
+	if runtime.GOOS == "windows" {
+		binaryPath += ".exe"
+	}
+	return binaryPath
+}
+
+// CheckDataSourcePlugin checks the binary of a datasource plugin can be run (ownership and permissions)
+func CheckDataSourcePlugin(binaryPath string) error {
+	return pluginIsValid(binaryPath)
+}
+
+// StartDataSourcePlugin runs the binary of a datasource plugin, with the same handshake and process
+// attributes as the notification plugins
+func StartDataSourcePlugin(name string, binaryPath string, procConfig *csconfig.PluginCfg) (*DataSourcePluginClient, error) {
+	handshake, err := getHandshake()
+	if err != nil {
+		return nil, err
+	}
+	if procConfig == nil {
+		procConfig = &csconfig.PluginCfg{}
+	}
+	pb := PluginBroker{pluginProcConfig: procConfig}
+	log.Debugf("Executing plugin %s", binaryPath)
+	cmd, err := pb.CreateCmd(binaryPath)
+	if err != nil {
+		return nil, err
+	}
+	l := log.New()
+	err = types.ConfigureLogger(l)
+	if err != nil {
+		return nil, err
+	}
+	// We set the highest level to permit plugins to set their own log level
+	l.SetLevel(log.TraceLevel)
+	c := plugin.NewClient(&plugin.ClientConfig{
+		HandshakeConfig:  handshake,
+		Plugins:          map[string]plugin.Plugin{name: &protobufs.DataSourcePlugin{}},
+		Cmd:              cmd,
+		AllowedProtocols: []plugin.Protocol{plugin.ProtocolGRPC},
+		Logger:           NewHCLogAdapter(l, ""),
+	})
+	protocol, err := c.Client()
+	if err != nil {
+		c.Kill()
+		return nil, errors.Wrapf(err, "while starting plugin %s", name)
+	}
+	raw, err := protocol.Dispense(name)
+	if err != nil {
+		c.Kill()
+		return nil, errors.Wrapf(err, "while dispensing plugin %s", name)
+	}
+	return &DataSourcePluginClient{
+		DataSourceClient: raw.(protobufs.DataSourceClient),
+		client:           c,
+	}, nil
+}
@@ -56,6 +56,11 @@ func DownloadHubIdx(hub *csconfig.Hub) ([]byte, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to read request answer for hub index")
 	}
+	if hub.Verifier != nil {
+		if err := hub.Verifier.VerifyFromURL(req.URL.String(), body); err != nil {
+			return nil, err
+		}
+	}
 	file, err := os.OpenFile(hub.HubIndexFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 
 	if err != nil {
@@ -170,6 +175,11 @@ func DownloadItem(hub *csconfig.Hub, target Item, overwrite bool) (Item, error)
 		log.Debugf("got %s, expected %s", meow, target.Versions[target.Version].Digest)
 		return target, fmt.Errorf("invalid download hash for %s", target.Name)
 	}
+	if hub.Verifier != nil {
+		if err := hub.Verifier.VerifyFromURL(req.URL.String(), body); err != nil {
+			return target, err
+		}
+	}
 	//all good, install
 	//check if parent dir exists
 	tmpdirs := strings.Split(tdir+"/"+target.RemotePath, "/")
@@ -211,7 +221,7 @@ func DownloadItem(hub *csconfig.Hub, target Item, overwrite bool) (Item, error)
 	target.Tainted = false
 	target.UpToDate = true
 
-	if err = downloadData(dataFolder, overwrite, bytes.NewReader(body)); err != nil {
+	if err = downloadData(dataFolder, overwrite, bytes.NewReader(body), hub.Verifier); err != nil {
 		return target, errors.Wrapf(err, "while downloading data for %s", target.FileName)
 	}
 
@@ -230,13 +240,13 @@ func DownloadDataIfNeeded(hub *csconfig.Hub, target Item, force bool) error {
 		return errors.Wrapf(err, "while opening %s", itemFilePath)
 	}
 	defer itemFile.Close()
-	if err = downloadData(dataFolder, force, itemFile); err != nil {
+	if err = downloadData(dataFolder, force, itemFile, hub.Verifier); err != nil {
 		return errors.Wrapf(err, "while downloading data for %s", itemFilePath)
 	}
 	return nil
 }
 
-func downloadData(dataFolder string, force bool, reader io.Reader) error {
+func downloadData(dataFolder string, force bool, reader io.Reader, verifier *types.SignatureVerifier) error {
 	var err error
 	dec := yaml.NewDecoder(reader)
 
@@ -257,7 +267,7 @@ func downloadData(dataFolder string, force bool, reader io.Reader) error {
 			}
 		}
 		if download || force {
-			err = types.GetData(data.Data, dataFolder)
+			err = types.GetDataVerified(data.Data, dataFolder, verifier)
 			if err != nil {
 				return errors.Wrap(err, "while getting data")
 			}
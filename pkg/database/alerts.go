@@ -92,6 +92,7 @@ func formatAlertAsString(machineId string, alert *models.Alert) []string {
 }
 
 func (c *Client) CreateAlert(machineID string, alertList []*models.Alert) ([]string, error) {
+	defer c.decisionsChanged()
 	pageStart := 0
 	pageEnd := bulkSize
 	ret := []string{}
@@ -117,6 +118,7 @@ func (c *Client) CreateAlert(machineID string, alertList []*models.Alert) ([]str
 
 /*We can't bulk both the alert and the decision at the same time. With new consensus, we want to bulk a single alert with a lot of decisions.*/
 func (c *Client) UpdateCommunityBlocklist(alertItem *models.Alert) (int, int, int, error) {
+	defer c.decisionsChanged()
 
 	var err error
 	var deleted, inserted int
@@ -794,6 +796,7 @@ func (c *Client) QueryAlertWithFilter(filter map[string][]string) ([]*ent.Alert,
 }
 
 func (c *Client) DeleteAlertGraphBatch(alertItems []*ent.Alert) (int, error) {
+	defer c.decisionsChanged()
 	idList := make([]int, 0)
 	for _, alert := range alertItems {
 		idList = append(idList, int(alert.ID))
@@ -812,6 +815,7 @@ func (c *Client) DeleteAlertGraphBatch(alertItems []*ent.Alert) (int, error) {
 }
 
 func (c *Client) DeleteAlertGraph(alertItem *ent.Alert) error {
+	defer c.decisionsChanged()
 	// delete the associated events
 	_, err := c.Ent.Event.Delete().
 		Where(event.HasOwnerWith(alert.IDEQ(alertItem.ID))).Exec(c.CTX)
@@ -866,6 +870,7 @@ func (c *Client) DeleteAlertWithFilter(filter map[string][]string) (int, error)
 }
 
 func (c *Client) FlushOrphans() {
+	defer c.decisionsChanged()
 	/* While it has only been linked to some very corner-case bug : https://github.com/crowdsecurity/crowdsec/issues/778 */
 	/* We want to take care of orphaned events for which the parent alert/decision has been deleted */
 
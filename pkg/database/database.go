@@ -22,10 +22,13 @@ import (
 )
 
 type Client struct {
-	Ent      *ent.Client
-	CTX      context.Context
-	Log      *log.Logger
-	CanFlush bool
+	// decisionsVersion is bumped each time decisions are written through this client.
+	// It must stay first in the struct to be 64-bit aligned for atomic operations on 32-bit platforms
+	decisionsVersion uint64
+	Ent              *ent.Client
+	CTX              context.Context
+	Log              *log.Logger
+	CanFlush         bool
 }
 
 func getEntDriver(dbtype string, dbdialect string, dsn string, config *csconfig.DatabaseCfg) (*entsql.Driver, error) {
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"strconv"
+	"sync/atomic"
 
 	"entgo.io/ent/dialect/sql"
 	"github.com/crowdsecurity/crowdsec/pkg/database/ent"
@@ -292,7 +293,34 @@ func (c *Client) QueryNewDecisionsSinceWithFilters(since time.Time, filters map[
 	return data, nil
 }
 
+// NextDecisionExpiration returns the expiration of the first active decision to expire, or a zero time if there is none
+func (c *Client) NextDecisionExpiration() (time.Time, error) {
+	next, err := c.Ent.Decision.Query().
+		Where(decision.UntilGT(time.Now().UTC())).
+		Order(ent.Asc(decision.FieldUntil)).
+		First(c.CTX)
+	if ent.IsNotFound(err) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		c.Log.Warningf("NextDecisionExpiration : %s", err)
+		return time.Time{}, errors.Wrap(QueryFail, "next decision expiration")
+	}
+	return next.Until, nil
+}
+
+// DecisionsVersion returns a counter that changes every time decisions are created, deleted or expired
+// through this client. Writes made by other processes sharing the same database are not accounted for.
+func (c *Client) DecisionsVersion() uint64 {
+	return atomic.LoadUint64(&c.decisionsVersion)
+}
+
+func (c *Client) decisionsChanged() {
+	atomic.AddUint64(&c.decisionsVersion, 1)
+}
+
 func (c *Client) DeleteDecisionById(decisionId int) error {
+	defer c.decisionsChanged()
 	err := c.Ent.Decision.DeleteOneID(decisionId).Exec(c.CTX)
 	if err != nil {
 		c.Log.Warningf("DeleteDecisionById : %s", err)
@@ -302,6 +330,7 @@ func (c *Client) DeleteDecisionById(decisionId int) error {
 }
 
 func (c *Client) DeleteDecisionsWithFilter(filter map[string][]string) (string, error) {
+	defer c.decisionsChanged()
 	var err error
 	var start_ip, start_sfx, end_ip, end_sfx int64
 	var ip_sz int
@@ -410,6 +439,7 @@ func (c *Client) DeleteDecisionsWithFilter(filter map[string][]string) (string,
 
 // SoftDeleteDecisionsWithFilter updates the expiration time to now() for the decisions matching the filter
 func (c *Client) SoftDeleteDecisionsWithFilter(filter map[string][]string) (string, error) {
+	defer c.decisionsChanged()
 	var err error
 	var start_ip, start_sfx, end_ip, end_sfx int64
 	var ip_sz int
@@ -522,6 +552,7 @@ func (c *Client) SoftDeleteDecisionsWithFilter(filter map[string][]string) (stri
 
 //SoftDeleteDecisionByID set the expiration of a decision to now()
 func (c *Client) SoftDeleteDecisionByID(decisionID int) error {
+	defer c.decisionsChanged()
 	nbUpdated, err := c.Ent.Decision.Update().Where(decision.IDEQ(decisionID)).SetUntil(time.Now().UTC()).Save(c.CTX)
 	if err != nil || nbUpdated == 0 {
 		c.Log.Warningf("SoftDeleteDecisionByID : %v (nb soft deleted: %d)", err, nbUpdated)
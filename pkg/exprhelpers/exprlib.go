@@ -10,6 +10,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/c-robinson/iplib"
@@ -21,6 +22,9 @@ import (
 var dataFile map[string][]string
 var dataFileRegex map[string][]*regexp.Regexp
 
+// dataFileLock protects the data files maps while parsers and scenarios are loaded concurrently
+var dataFileLock sync.Mutex
+
 func Atof(x string) float64 {
 	log.Debugf("debug atof %s", x)
 	ret, err := strconv.ParseFloat(x, 64)
@@ -59,6 +63,11 @@ func GetExprEnv(ctx map[string]interface{}) map[string]interface{} {
 		"XMLGetNodeValue":      XMLGetNodeValue,
 		"IpToRange":            IpToRange,
 		"IsIPV6":               IsIPV6,
+		"Trim":                 strings.Trim,
+		"TrimSpace":            strings.TrimSpace,
+		"TrimPrefix":           strings.TrimPrefix,
+		"TrimSuffix":           strings.TrimSuffix,
+		"Split":                strings.Split,
 	}
 	for k, v := range ctx {
 		ExprLib[k] = v
@@ -85,6 +94,8 @@ func FileInit(fileFolder string, filename string, fileType string) error {
 		log.Debugf("ignored file %s%s because no type specified", fileFolder, filename)
 		return nil
 	}
+	dataFileLock.Lock()
+	defer dataFileLock.Unlock()
 	if _, ok := dataFile[filename]; !ok {
 		dataFile[filename] = []string{}
 	}
@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"sync"
 	"time"
@@ -216,18 +217,42 @@ func LoadBuckets(cscfg *csconfig.CrowdsecServiceCfg, files []string, tomb *tomb.
 
 			bucketFactory.wgDumpState = buckets.wgDumpState
 			bucketFactory.wgPour = buckets.wgPour
-			err = LoadBucket(&bucketFactory, tomb)
-			if err != nil {
-				log.Errorf("Failed to load bucket %s : %v", bucketFactory.Name, err)
-				return nil, nil, fmt.Errorf("loading of %s failed : %v", bucketFactory.Name, err)
-			}
 			ret = append(ret, bucketFactory)
 		}
 	}
+	if err := loadBucketsConcurrently(ret, tomb); err != nil {
+		return nil, nil, err
+	}
 	log.Warningf("Loaded %d scenarios", len(ret))
 	return ret, response, nil
 }
 
+// loadBucketsConcurrently compiles the bucket factories in parallel, as expressions compilation dominates the startup time
+func loadBucketsConcurrently(bucketFactories []BucketFactory, tomb *tomb.Tomb) error {
+	errs := make([]error, len(bucketFactories))
+	sem := make(chan struct{}, runtime.NumCPU())
+	wg := sync.WaitGroup{}
+	for idx := range bucketFactories {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(idx int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			errs[idx] = LoadBucket(&bucketFactories[idx], tomb)
+		}(idx)
+	}
+	wg.Wait()
+	for idx, err := range errs {
+		if err != nil {
+			log.Errorf("Failed to load bucket %s : %v", bucketFactories[idx].Name, err)
+			return fmt.Errorf("loading of %s failed : %v", bucketFactories[idx].Name, err)
+		}
+	}
+	return nil
+}
+
 /* Init recursively process yaml files from a directory and loads them as BucketFactory */
 func LoadBucket(bucketFactory *BucketFactory, tomb *tomb.Tomb) error {
 	var err error
@@ -2,6 +2,7 @@ package leakybucket
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 
 	"gopkg.in/tomb.v2"
@@ -119,3 +120,46 @@ func TestCounterBucketsConfig(t *testing.T) {
 	}
 
 }
+
+func concurrentBuckets(count int, invalid ...int) []BucketFactory {
+	ret := make([]BucketFactory, count)
+	for idx := range ret {
+		ret[idx] = BucketFactory{Name: fmt.Sprintf("test-%d", idx), Description: "test", Type: "leaky", Capacity: 1, LeakSpeed: "1s", Filter: "true"}
+	}
+	for _, idx := range invalid {
+		ret[idx].Filter = "xu"
+	}
+	return ret
+}
+
+func TestLoadBucketsConcurrently(t *testing.T) {
+	var tomb *tomb.Tomb = &tomb.Tomb{}
+
+	//the factories are loaded in place, as they would be one after the other
+	factories := concurrentBuckets(50)
+	if err := loadBucketsConcurrently(factories, tomb); err != nil {
+		t.Fatalf("unexpected error : %s", err)
+	}
+	sequential := concurrentBuckets(50)
+	for idx := range sequential {
+		if err := LoadBucket(&sequential[idx], tomb); err != nil {
+			t.Fatalf("unexpected error : %s", err)
+		}
+	}
+	for idx := range factories {
+		if factories[idx].Name != sequential[idx].Name {
+			t.Fatalf("factory %d is %s, expected %s", idx, factories[idx].Name, sequential[idx].Name)
+		}
+		if factories[idx].RunTimeFilter == nil || factories[idx].leakspeed != sequential[idx].leakspeed {
+			t.Fatalf("factory %s is not loaded", factories[idx].Name)
+		}
+	}
+
+	//the reported error is the one of the first broken factory, whichever fails first
+	for i := 0; i < 10; i++ {
+		err := loadBucketsConcurrently(concurrentBuckets(50, 42, 7), tomb)
+		if err == nil || !strings.HasPrefix(err.Error(), "loading of test-7 failed") {
+			t.Fatalf("expected test-7 to fail, got %v", err)
+		}
+	}
+}
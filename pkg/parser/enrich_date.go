@@ -1,13 +1,22 @@
 package parser
 
 import (
+	"sync"
 	"time"
 
 	"github.com/crowdsecurity/crowdsec/pkg/types"
 	log "github.com/sirupsen/logrus"
 )
 
+//timezones caches the locations of the datasources timezones, to avoid loading them for each event
+var timezones sync.Map
+
 func GenDateParse(date string) (string, time.Time) {
+	return GenDateParseIn(date, time.UTC)
+}
+
+//GenDateParseIn parses a date, and interprets it in location when it doesn't have a timezone
+func GenDateParseIn(date string, location *time.Location) (string, time.Time) {
 	var (
 		layouts = [...]string{
 			time.RFC3339,
@@ -29,7 +38,7 @@ func GenDateParse(date string) (string, time.Time) {
 	)
 
 	for _, dateFormat := range layouts {
-		t, err := time.Parse(dateFormat, date)
+		t, err := time.ParseInLocation(dateFormat, date, location)
 		if err == nil && !t.IsZero() {
 			//if the year isn't set, set it to current date :)
 			if t.Year() == 0 {
@@ -56,7 +65,11 @@ func GenDateParse(date string) (string, time.Time) {
 func ParseDate(in string, p *types.Event, x interface{}) (map[string]string, error) {
 
 	var ret map[string]string = make(map[string]string)
-	tstr, tbin := GenDateParse(in)
+	location := time.UTC
+	if p.Line.Timezone != "" {
+		location = getTimezone(p.Line.Timezone)
+	}
+	tstr, tbin := GenDateParseIn(in, location)
 	if !tbin.IsZero() {
 		ret["MarshaledTime"] = string(tstr)
 		return ret, nil
@@ -65,6 +78,20 @@ func ParseDate(in string, p *types.Event, x interface{}) (map[string]string, err
 	return nil, nil
 }
 
+func getTimezone(name string) *time.Location {
+	if location, ok := timezones.Load(name); ok {
+		return location.(*time.Location)
+	}
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		//the timezones are checked when the acquisition is loaded
+		log.Warningf("unknown timezone %s, using UTC", name)
+		location = time.UTC
+	}
+	timezones.Store(name, location)
+	return location
+}
+
 func parseDateInit(cfg map[string]string) (interface{}, error) {
 	return nil, nil
 }
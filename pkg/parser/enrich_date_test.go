@@ -0,0 +1,51 @@
+package parser
+
+import (
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDateTimezone(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	require.NoError(t, err)
+
+	tests := []struct {
+		date     string
+		timezone string
+		expected time.Time
+	}{
+		{
+			date:     "2022-01-02 03:04:05",
+			expected: time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC),
+		},
+		{
+			date:     "2022-01-02 03:04:05",
+			timezone: "Europe/Paris",
+			expected: time.Date(2022, 1, 2, 3, 4, 5, 0, paris),
+		},
+		//dates with a timezone are not affected
+		{
+			date:     "2022-01-02T03:04:05Z",
+			timezone: "Europe/Paris",
+			expected: time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC),
+		},
+		{
+			date:     "02/Jan/2022:03:04:05 -0700",
+			timezone: "Europe/Paris",
+			expected: time.Date(2022, 1, 2, 10, 4, 5, 0, time.UTC),
+		},
+	}
+
+	for _, test := range tests {
+		evt := types.Event{Line: types.Line{Timezone: test.timezone}}
+		ret, err := ParseDate(test.date, &evt, nil)
+		require.NoError(t, err)
+		parsed, err := time.Parse(time.RFC3339, ret["MarshaledTime"])
+		require.NoError(t, err)
+		assert.True(t, test.expected.Equal(parsed), "%s (%s): expected %s, got %s", test.date, test.timezone, test.expected, parsed)
+	}
+}
@@ -52,6 +52,8 @@ type Node struct {
 	/* If the node is actually a leaf, it can have : grok, enrich, statics */
 	//pattern_syntax are named grok patterns that are re-utilised over several grok patterns
 	SubGroks yaml.MapSlice `yaml:"pattern_syntax,omitempty"`
+	//set once SubGroks are registered in the grok host, so that compile doesn't add them again
+	subGroksAdded bool
 
 	//Holds a grok pattern
 	Grok types.GrokPattern `yaml:"grok,omitempty"`
@@ -365,6 +367,29 @@ func (n *Node) process(p *types.Event, ctx UnixParserCtx, expressionEnv map[stri
 	return NodeState, nil
 }
 
+// addSubGroks registers the pattern_syntax of the node and of its leaves in the shared grok host.
+// It must be called sequentially, before compiling nodes concurrently : the grok host isn't safe for concurrent writes
+func (n *Node) addSubGroks(pctx *UnixParserCtx, logger *log.Entry) error {
+	for _, pattern := range n.SubGroks {
+		logger.Tracef("Adding subpattern '%s' : '%s'", pattern.Key, pattern.Value)
+		if err := pctx.Grok.Add(pattern.Key.(string), pattern.Value.(string)); err != nil {
+			if err == grokky.ErrAlreadyExist {
+				logger.Warningf("grok '%s' already registred", pattern.Key)
+				continue
+			}
+			logger.Errorf("Unable to compile subpattern %s : %v", pattern.Key, err)
+			return err
+		}
+	}
+	n.subGroksAdded = true
+	for idx := range n.LeavesNodes {
+		if err := n.LeavesNodes[idx].addSubGroks(pctx, logger); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (n *Node) compile(pctx *UnixParserCtx, ectx EnricherCtx) error {
 	var err error
 	var valid bool
@@ -372,7 +397,7 @@ func (n *Node) compile(pctx *UnixParserCtx, ectx EnricherCtx) error {
 	valid = false
 
 	dumpr := spew.ConfigState{MaxDepth: 1, DisablePointerAddresses: true}
-	n.rn = seed.Generate()
+	n.rn = generateName()
 
 	n.EnrichFunctions = ectx
 	log.Tracef("compile, node is %s", n.Stage)
@@ -417,14 +442,8 @@ func (n *Node) compile(pctx *UnixParserCtx, ectx EnricherCtx) error {
 	}
 
 	/* handle pattern_syntax and groks */
-	for _, pattern := range n.SubGroks {
-		n.Logger.Tracef("Adding subpattern '%s' : '%s'", pattern.Key, pattern.Value)
-		if err := pctx.Grok.Add(pattern.Key.(string), pattern.Value.(string)); err != nil {
-			if err == grokky.ErrAlreadyExist {
-				n.Logger.Warningf("grok '%s' already registred", pattern.Key)
-				continue
-			}
-			n.Logger.Errorf("Unable to compile subpattern %s : %v", pattern.Key, err)
+	if !n.subGroksAdded {
+		if err := n.addSubGroks(pctx, n.Logger); err != nil {
 			return err
 		}
 	}
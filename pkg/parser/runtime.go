@@ -236,6 +236,19 @@ var ParseDump bool
 var DumpFolder string
 var StageParseCache map[string]map[string][]ParserResult
 
+// routedStage tells if some of the parsers an event is routed to belong to stage : the other parsers of the stage are skipped
+func routedStage(routing map[string]bool, stage string, nodes []Node) bool {
+	if len(routing) == 0 {
+		return false
+	}
+	for _, node := range nodes {
+		if node.Stage == stage && routing[node.Name] {
+			return true
+		}
+	}
+	return false
+}
+
 func Parse(ctx UnixParserCtx, xp types.Event, nodes []Node) (types.Event, error) {
 	var event types.Event = xp
 
@@ -250,13 +263,13 @@ func Parse(ctx UnixParserCtx, xp types.Event, nodes []Node) (types.Event, error)
 	}
 
 	if event.Parsed == nil {
-		event.Parsed = make(map[string]string)
+		event.Parsed = types.NewStringMap()
 	}
 	if event.Enriched == nil {
-		event.Enriched = make(map[string]string)
+		event.Enriched = types.NewStringMap()
 	}
 	if event.Meta == nil {
-		event.Meta = make(map[string]string)
+		event.Meta = types.NewStringMap()
 	}
 	if event.Type == types.LOG {
 		log.Tracef("INPUT '%s'", event.Line.Raw)
@@ -264,6 +277,14 @@ func Parse(ctx UnixParserCtx, xp types.Event, nodes []Node) (types.Event, error)
 
 	cachedExprEnv := exprhelpers.GetExprEnv(map[string]interface{}{"evt": &event})
 
+	var routing map[string]bool
+	if len(event.Line.ParserRouting) > 0 {
+		routing = make(map[string]bool, len(event.Line.ParserRouting))
+		for _, name := range event.Line.ParserRouting {
+			routing[name] = true
+		}
+	}
+
 	if ParseDump {
 		if StageParseCache == nil {
 			StageParseCache = make(map[string]map[string][]ParserResult)
@@ -294,11 +315,16 @@ func Parse(ctx UnixParserCtx, xp types.Event, nodes []Node) (types.Event, error)
 		}
 
 		isStageOK := false
+		routed := routedStage(routing, stage, nodes)
 		for idx, node := range nodes {
 			//Only process current stage's nodes
 			if event.Stage != node.Stage {
 				continue
 			}
+			//the datasource of the event restricts it to some parsers of this stage
+			if routed && !routing[node.Name] {
+				continue
+			}
 			clog := log.WithFields(log.Fields{
 				"node-name": node.rn,
 				"stage":     event.Stage,
@@ -0,0 +1,33 @@
+package parser
+
+import (
+	"testing"
+)
+
+func TestRoutedStage(t *testing.T) {
+	nodes := []Node{
+		{Name: "crowdsecurity/syslog-logs", Stage: "s00-raw"},
+		{Name: "crowdsecurity/non-syslog", Stage: "s00-raw"},
+		{Name: "crowdsecurity/nginx-logs", Stage: "s01-parse"},
+		{Name: "crowdsecurity/sshd-logs", Stage: "s01-parse"},
+		{Name: "crowdsecurity/dateparse-enrich", Stage: "s02-enrich"},
+	}
+	routing := map[string]bool{"crowdsecurity/nginx-logs": true}
+
+	tests := []struct {
+		routing  map[string]bool
+		stage    string
+		expected bool
+	}{
+		{routing: nil, stage: "s01-parse", expected: false},
+		{routing: routing, stage: "s00-raw", expected: false},
+		{routing: routing, stage: "s01-parse", expected: true},
+		{routing: routing, stage: "s02-enrich", expected: false},
+		{routing: map[string]bool{"crowdsecurity/not-installed": true}, stage: "s01-parse", expected: false},
+	}
+	for _, test := range tests {
+		if got := routedStage(test.routing, test.stage, nodes); got != test.expected {
+			t.Errorf("routedStage(%v, %s) : expected %t, got %t", test.routing, test.stage, test.expected, got)
+		}
+	}
+}
@@ -11,10 +11,11 @@ import (
 
 	"fmt"
 	"io"
-	_ "net/http/pprof"
 	"os"
+	"runtime"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/crowdsecurity/crowdsec/pkg/cwversion"
@@ -27,6 +28,14 @@ import (
 )
 
 var seed namegenerator.Generator = namegenerator.NewNameGenerator(time.Now().UTC().UnixNano())
+var seedLock sync.Mutex
+
+// generateName is safe for concurrent use, unlike the underlying generator
+func generateName() string {
+	seedLock.Lock()
+	defer seedLock.Unlock()
+	return seed.Generate()
+}
 
 /*
  identify generic component to alter maps, smartfilters ? (static, conditional static etc.)
@@ -37,8 +46,44 @@ type Stagefile struct {
 	Stage    string `yaml:"stage"`
 }
 
+type stageNode struct {
+	node     Node
+	filename string
+}
+
+// compileNodes compiles nodes concurrently, as regexps and expressions compilation dominates the startup time.
+// Subgroks must have been registered beforehand.
+func compileNodes(nodes []stageNode, pctx *UnixParserCtx, ectx EnricherCtx) error {
+	errs := make([]error, len(nodes))
+	sem := make(chan struct{}, runtime.NumCPU())
+	wg := sync.WaitGroup{}
+	for idx := range nodes {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(idx int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			errs[idx] = nodes[idx].node.compile(pctx, ectx)
+		}(idx)
+	}
+	wg.Wait()
+	for idx, err := range errs {
+		if err == nil {
+			continue
+		}
+		if nodes[idx].node.Name != "" {
+			return fmt.Errorf("failed to compile node '%s' in '%s' : %s", nodes[idx].node.Name, nodes[idx].filename, err.Error())
+		}
+		return fmt.Errorf("failed to compile node in '%s' : %s", nodes[idx].filename, err.Error())
+	}
+	return nil
+}
+
 func LoadStages(stageFiles []Stagefile, pctx *UnixParserCtx, ectx EnricherCtx) ([]Node, error) {
 	var nodes []Node
+	var pending []stageNode
 	tmpstages := make(map[string]bool)
 	pctx.Stages = []string{}
 
@@ -62,7 +107,6 @@ func LoadStages(stageFiles []Stagefile, pctx *UnixParserCtx, ectx EnricherCtx) (
 		//process the yaml
 		dec := yaml.NewDecoder(yamlFile)
 		dec.SetStrict(true)
-		nodesCount := 0
 		for {
 			node := Node{}
 			node.OnSuccess = "continue" //default behaviour is to continue
@@ -98,31 +142,43 @@ func LoadStages(stageFiles []Stagefile, pctx *UnixParserCtx, ectx EnricherCtx) (
 			if _, ok := tmpstages[stageFile.Stage]; !ok {
 				tmpstages[stageFile.Stage] = true
 			}
-			//compile the node : grok pattern and expression
-			err = node.compile(pctx, ectx)
-			if err != nil {
-				if node.Name != "" {
-					return nil, fmt.Errorf("failed to compile node '%s' in '%s' : %s", node.Name, stageFile.Filename, err.Error())
-				}
-				return nil, fmt.Errorf("failed to compile node in '%s' : %s", stageFile.Filename, err.Error())
-			}
-			/* if the stage is empty, the node is empty, it's a trailing entry in users yaml file */
-			if node.Stage == "" {
-				continue
+			//subgroks are shared between nodes : register them in order, before compiling nodes concurrently
+			if err := node.addSubGroks(pctx, log.WithFields(log.Fields{"stage": node.Stage, "name": node.Name})); err != nil {
+				return nil, fmt.Errorf("failed to compile node '%s' in '%s' : %s", node.Name, stageFile.Filename, err.Error())
 			}
+			pending = append(pending, stageNode{node: node, filename: stageFile.Filename})
+		}
+		yamlFile.Close()
+	}
+
+	//compile the nodes : grok pattern and expression
+	if err := compileNodes(pending, pctx, ectx); err != nil {
+		return nil, err
+	}
 
-			if len(node.Data) > 0 {
-				for _, data := range node.Data {
-					err = exprhelpers.FileInit(pctx.DataFolder, data.DestPath, data.Type)
-					if err != nil {
-						log.Errorf(err.Error())
-					}
+	nodesCount := make(map[string]int)
+	for _, pendingNode := range pending {
+		node := pendingNode.node
+		/* if the stage is empty, the node is empty, it's a trailing entry in users yaml file */
+		if node.Stage == "" {
+			continue
+		}
+
+		if len(node.Data) > 0 {
+			for _, data := range node.Data {
+				err := exprhelpers.FileInit(pctx.DataFolder, data.DestPath, data.Type)
+				if err != nil {
+					log.Errorf(err.Error())
 				}
 			}
-			nodes = append(nodes, node)
-			nodesCount++
 		}
-		log.WithFields(log.Fields{"file": stageFile.Filename}).Infof("Loaded %d parser nodes", nodesCount)
+		nodes = append(nodes, node)
+		nodesCount[pendingNode.filename]++
+	}
+	for _, stageFile := range stageFiles {
+		if count, ok := nodesCount[stageFile.Filename]; ok {
+			log.WithFields(log.Fields{"file": stageFile.Filename}).Infof("Loaded %d parser nodes", count)
+		}
 	}
 
 	for k := range tmpstages {
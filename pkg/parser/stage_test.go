@@ -0,0 +1,58 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+)
+
+func stageNodes(count int, invalid ...int) []stageNode {
+	ret := make([]stageNode, count)
+	for idx := range ret {
+		ret[idx] = stageNode{
+			node:     Node{Name: fmt.Sprintf("node-%d", idx), Stage: "s00", Grok: types.GrokPattern{RegexpValue: "^x%{DATA:extr}$", TargetField: "t"}},
+			filename: fmt.Sprintf("file-%d.yaml", idx),
+		}
+	}
+	for _, idx := range invalid {
+		ret[idx].node.Filter = "ratata"
+	}
+	return ret
+}
+
+func TestCompileNodes(t *testing.T) {
+	pctx, err := Init(map[string]interface{}{"patterns": "../../config/patterns/", "data": "./tests/"})
+	if err != nil {
+		t.Fatalf("unable to load patterns : %s", err)
+	}
+
+	//the nodes are compiled in place, as they would be one after the other
+	nodes := stageNodes(50)
+	if err := compileNodes(nodes, pctx, EnricherCtx{}); err != nil {
+		t.Fatalf("unexpected error : %s", err)
+	}
+	sequential := stageNodes(50)
+	for idx := range sequential {
+		if err := sequential[idx].node.compile(pctx, EnricherCtx{}); err != nil {
+			t.Fatalf("unexpected error : %s", err)
+		}
+	}
+	for idx := range nodes {
+		if nodes[idx].node.Name != sequential[idx].node.Name || nodes[idx].filename != sequential[idx].filename {
+			t.Fatalf("node %d is %s, expected %s", idx, nodes[idx].node.Name, sequential[idx].node.Name)
+		}
+		if nodes[idx].node.Grok.RunTimeRegexp == nil {
+			t.Fatalf("node %s is not compiled", nodes[idx].node.Name)
+		}
+	}
+
+	//the reported error is the one of the first broken node, whichever fails first
+	for i := 0; i < 10; i++ {
+		err := compileNodes(stageNodes(50, 42, 7), pctx, EnricherCtx{})
+		if err == nil || !strings.HasPrefix(err.Error(), "failed to compile node 'node-7' in 'file-7.yaml'") {
+			t.Fatalf("expected node-7 to fail, got %v", err)
+		}
+	}
+}
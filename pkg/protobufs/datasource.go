@@ -0,0 +1,23 @@
+package protobufs
+
+import (
+	"context"
+
+	plugin "github.com/hashicorp/go-plugin"
+	"google.golang.org/grpc"
+)
+
+// DataSourcePlugin implements plugin.GRPCPlugin : plugins serve it with their Impl, crowdsec dispenses the client
+type DataSourcePlugin struct {
+	plugin.Plugin
+	Impl DataSourceServer
+}
+
+func (p *DataSourcePlugin) GRPCServer(broker *plugin.GRPCBroker, s *grpc.Server) error {
+	RegisterDataSourceServer(s, p.Impl)
+	return nil
+}
+
+func (p *DataSourcePlugin) GRPCClient(ctx context.Context, broker *plugin.GRPCBroker, c *grpc.ClientConn) (interface{}, error) {
+	return NewDataSourceClient(c), nil
+}
@@ -0,0 +1,669 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.27.1
+// 	protoc        (unknown)
+// source: datasource.proto
+
+package protobufs
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type DataSourceHealth_State int32
+
+const (
+	DataSourceHealth_RUNNING      DataSourceHealth_State = 0
+	DataSourceHealth_RECONNECTING DataSourceHealth_State = 1
+	DataSourceHealth_ERRORED      DataSourceHealth_State = 2
+)
+
+// Enum value maps for DataSourceHealth_State.
+var (
+	DataSourceHealth_State_name = map[int32]string{
+		0: "RUNNING",
+		1: "RECONNECTING",
+		2: "ERRORED",
+	}
+	DataSourceHealth_State_value = map[string]int32{
+		"RUNNING":      0,
+		"RECONNECTING": 1,
+		"ERRORED":      2,
+	}
+)
+
+func (x DataSourceHealth_State) Enum() *DataSourceHealth_State {
+	p := new(DataSourceHealth_State)
+	*p = x
+	return p
+}
+
+func (x DataSourceHealth_State) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (DataSourceHealth_State) Descriptor() protoreflect.EnumDescriptor {
+	return file_datasource_proto_enumTypes[0].Descriptor()
+}
+
+func (DataSourceHealth_State) Type() protoreflect.EnumType {
+	return &file_datasource_proto_enumTypes[0]
+}
+
+func (x DataSourceHealth_State) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use DataSourceHealth_State.Descriptor instead.
+func (DataSourceHealth_State) EnumDescriptor() ([]byte, []int) {
+	return file_datasource_proto_rawDescGZIP(), []int{2, 0}
+}
+
+// DataSourceConfig is the yaml configuration of the datasource, as written in the acquisition file
+type DataSourceConfig struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Config []byte `protobuf:"bytes,1,opt,name=config,proto3" json:"config,omitempty"`
+}
+
+func (x *DataSourceConfig) Reset() {
+	*x = DataSourceConfig{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_datasource_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *DataSourceConfig) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DataSourceConfig) ProtoMessage() {}
+
+func (x *DataSourceConfig) ProtoReflect() protoreflect.Message {
+	mi := &file_datasource_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DataSourceConfig.ProtoReflect.Descriptor instead.
+func (*DataSourceConfig) Descriptor() ([]byte, []int) {
+	return file_datasource_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *DataSourceConfig) GetConfig() []byte {
+	if x != nil {
+		return x.Config
+	}
+	return nil
+}
+
+// DataSourceEvent is a line read by the plugin
+type DataSourceEvent struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Raw string `protobuf:"bytes,1,opt,name=raw,proto3" json:"raw,omitempty"`
+	// src defaults to the name of the plugin
+	Src string `protobuf:"bytes,2,opt,name=src,proto3" json:"src,omitempty"`
+	// time defaults to the time crowdsec received the event
+	Time *timestamppb.Timestamp `protobuf:"bytes,3,opt,name=time,proto3" json:"time,omitempty"`
+}
+
+func (x *DataSourceEvent) Reset() {
+	*x = DataSourceEvent{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_datasource_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *DataSourceEvent) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DataSourceEvent) ProtoMessage() {}
+
+func (x *DataSourceEvent) ProtoReflect() protoreflect.Message {
+	mi := &file_datasource_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DataSourceEvent.ProtoReflect.Descriptor instead.
+func (*DataSourceEvent) Descriptor() ([]byte, []int) {
+	return file_datasource_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *DataSourceEvent) GetRaw() string {
+	if x != nil {
+		return x.Raw
+	}
+	return ""
+}
+
+func (x *DataSourceEvent) GetSrc() string {
+	if x != nil {
+		return x.Src
+	}
+	return ""
+}
+
+func (x *DataSourceEvent) GetTime() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Time
+	}
+	return nil
+}
+
+// DataSourceHealth is the status of the plugin, reported in the datasource health and metrics
+type DataSourceHealth struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	State DataSourceHealth_State `protobuf:"varint,1,opt,name=state,proto3,enum=proto.DataSourceHealth_State" json:"state,omitempty"`
+	// error holds the details of the RECONNECTING and ERRORED states
+	Error string `protobuf:"bytes,2,opt,name=error,proto3" json:"error,omitempty"`
+	// metrics are exposed as cs_pluginsource_metric{plugin="<plugin>", metric="<key>"}
+	Metrics map[string]float64 `protobuf:"bytes,3,rep,name=metrics,proto3" json:"metrics,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"fixed64,2,opt,name=value,proto3"`
+}
+
+func (x *DataSourceHealth) Reset() {
+	*x = DataSourceHealth{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_datasource_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *DataSourceHealth) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DataSourceHealth) ProtoMessage() {}
+
+func (x *DataSourceHealth) ProtoReflect() protoreflect.Message {
+	mi := &file_datasource_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DataSourceHealth.ProtoReflect.Descriptor instead.
+func (*DataSourceHealth) Descriptor() ([]byte, []int) {
+	return file_datasource_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *DataSourceHealth) GetState() DataSourceHealth_State {
+	if x != nil {
+		return x.State
+	}
+	return DataSourceHealth_RUNNING
+}
+
+func (x *DataSourceHealth) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+func (x *DataSourceHealth) GetMetrics() map[string]float64 {
+	if x != nil {
+		return x.Metrics
+	}
+	return nil
+}
+
+var File_datasource_proto protoreflect.FileDescriptor
+
+var file_datasource_proto_rawDesc = []byte{
+	0x0a, 0x10, 0x64, 0x61, 0x74, 0x61, 0x73, 0x6f, 0x75, 0x72, 0x63, 0x65, 0x2e, 0x70, 0x72, 0x6f,
+	0x74, 0x6f, 0x12, 0x05, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x1a, 0x1b, 0x67, 0x6f, 0x6f, 0x67, 0x6c,
+	0x65, 0x2f, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2f, 0x65, 0x6d, 0x70, 0x74, 0x79,
+	0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x1a, 0x1f, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2f, 0x70,
+	0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2f, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d,
+	0x70, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22, 0x2a, 0x0a, 0x10, 0x44, 0x61, 0x74, 0x61, 0x53,
+	0x6f, 0x75, 0x72, 0x63, 0x65, 0x43, 0x6f, 0x6e, 0x66, 0x69, 0x67, 0x12, 0x16, 0x0a, 0x06, 0x63,
+	0x6f, 0x6e, 0x66, 0x69, 0x67, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x06, 0x63, 0x6f, 0x6e,
+	0x66, 0x69, 0x67, 0x22, 0x65, 0x0a, 0x0f, 0x44, 0x61, 0x74, 0x61, 0x53, 0x6f, 0x75, 0x72, 0x63,
+	0x65, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x12, 0x10, 0x0a, 0x03, 0x72, 0x61, 0x77, 0x18, 0x01, 0x20,
+	0x01, 0x28, 0x09, 0x52, 0x03, 0x72, 0x61, 0x77, 0x12, 0x10, 0x0a, 0x03, 0x73, 0x72, 0x63, 0x18,
+	0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x73, 0x72, 0x63, 0x12, 0x2e, 0x0a, 0x04, 0x74, 0x69,
+	0x6d, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c,
+	0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x54, 0x69, 0x6d, 0x65, 0x73,
+	0x74, 0x61, 0x6d, 0x70, 0x52, 0x04, 0x74, 0x69, 0x6d, 0x65, 0x22, 0x8e, 0x02, 0x0a, 0x10, 0x44,
+	0x61, 0x74, 0x61, 0x53, 0x6f, 0x75, 0x72, 0x63, 0x65, 0x48, 0x65, 0x61, 0x6c, 0x74, 0x68, 0x12,
+	0x33, 0x0a, 0x05, 0x73, 0x74, 0x61, 0x74, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x1d,
+	0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x2e, 0x44, 0x61, 0x74, 0x61, 0x53, 0x6f, 0x75, 0x72, 0x63,
+	0x65, 0x48, 0x65, 0x61, 0x6c, 0x74, 0x68, 0x2e, 0x53, 0x74, 0x61, 0x74, 0x65, 0x52, 0x05, 0x73,
+	0x74, 0x61, 0x74, 0x65, 0x12, 0x14, 0x0a, 0x05, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x18, 0x02, 0x20,
+	0x01, 0x28, 0x09, 0x52, 0x05, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x12, 0x3e, 0x0a, 0x07, 0x6d, 0x65,
+	0x74, 0x72, 0x69, 0x63, 0x73, 0x18, 0x03, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x24, 0x2e, 0x70, 0x72,
+	0x6f, 0x74, 0x6f, 0x2e, 0x44, 0x61, 0x74, 0x61, 0x53, 0x6f, 0x75, 0x72, 0x63, 0x65, 0x48, 0x65,
+	0x61, 0x6c, 0x74, 0x68, 0x2e, 0x4d, 0x65, 0x74, 0x72, 0x69, 0x63, 0x73, 0x45, 0x6e, 0x74, 0x72,
+	0x79, 0x52, 0x07, 0x6d, 0x65, 0x74, 0x72, 0x69, 0x63, 0x73, 0x1a, 0x3a, 0x0a, 0x0c, 0x4d, 0x65,
+	0x74, 0x72, 0x69, 0x63, 0x73, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x12, 0x10, 0x0a, 0x03, 0x6b, 0x65,
+	0x79, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x6b, 0x65, 0x79, 0x12, 0x14, 0x0a, 0x05,
+	0x76, 0x61, 0x6c, 0x75, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x01, 0x52, 0x05, 0x76, 0x61, 0x6c,
+	0x75, 0x65, 0x3a, 0x02, 0x38, 0x01, 0x22, 0x33, 0x0a, 0x05, 0x53, 0x74, 0x61, 0x74, 0x65, 0x12,
+	0x0b, 0x0a, 0x07, 0x52, 0x55, 0x4e, 0x4e, 0x49, 0x4e, 0x47, 0x10, 0x00, 0x12, 0x10, 0x0a, 0x0c,
+	0x52, 0x45, 0x43, 0x4f, 0x4e, 0x4e, 0x45, 0x43, 0x54, 0x49, 0x4e, 0x47, 0x10, 0x01, 0x12, 0x0b,
+	0x0a, 0x07, 0x45, 0x52, 0x52, 0x4f, 0x52, 0x45, 0x44, 0x10, 0x02, 0x32, 0x97, 0x02, 0x0a, 0x0a,
+	0x44, 0x61, 0x74, 0x61, 0x53, 0x6f, 0x75, 0x72, 0x63, 0x65, 0x12, 0x3c, 0x0a, 0x09, 0x43, 0x6f,
+	0x6e, 0x66, 0x69, 0x67, 0x75, 0x72, 0x65, 0x12, 0x17, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x2e,
+	0x44, 0x61, 0x74, 0x61, 0x53, 0x6f, 0x75, 0x72, 0x63, 0x65, 0x43, 0x6f, 0x6e, 0x66, 0x69, 0x67,
+	0x1a, 0x16, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62,
+	0x75, 0x66, 0x2e, 0x45, 0x6d, 0x70, 0x74, 0x79, 0x12, 0x46, 0x0a, 0x12, 0x4f, 0x6e, 0x65, 0x53,
+	0x68, 0x6f, 0x74, 0x41, 0x63, 0x71, 0x75, 0x69, 0x73, 0x69, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x16,
+	0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66,
+	0x2e, 0x45, 0x6d, 0x70, 0x74, 0x79, 0x1a, 0x16, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x2e, 0x44,
+	0x61, 0x74, 0x61, 0x53, 0x6f, 0x75, 0x72, 0x63, 0x65, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x30, 0x01,
+	0x12, 0x48, 0x0a, 0x14, 0x53, 0x74, 0x72, 0x65, 0x61, 0x6d, 0x69, 0x6e, 0x67, 0x41, 0x63, 0x71,
+	0x75, 0x69, 0x73, 0x69, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x16, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c,
+	0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x45, 0x6d, 0x70, 0x74, 0x79,
+	0x1a, 0x16, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x2e, 0x44, 0x61, 0x74, 0x61, 0x53, 0x6f, 0x75,
+	0x72, 0x63, 0x65, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x30, 0x01, 0x12, 0x39, 0x0a, 0x06, 0x48, 0x65,
+	0x61, 0x6c, 0x74, 0x68, 0x12, 0x16, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72,
+	0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x45, 0x6d, 0x70, 0x74, 0x79, 0x1a, 0x17, 0x2e, 0x70,
+	0x72, 0x6f, 0x74, 0x6f, 0x2e, 0x44, 0x61, 0x74, 0x61, 0x53, 0x6f, 0x75, 0x72, 0x63, 0x65, 0x48,
+	0x65, 0x61, 0x6c, 0x74, 0x68, 0x42, 0x0d, 0x5a, 0x0b, 0x2e, 0x3b, 0x70, 0x72, 0x6f, 0x74, 0x6f,
+	0x62, 0x75, 0x66, 0x73, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_datasource_proto_rawDescOnce sync.Once
+	file_datasource_proto_rawDescData = file_datasource_proto_rawDesc
+)
+
+func file_datasource_proto_rawDescGZIP() []byte {
+	file_datasource_proto_rawDescOnce.Do(func() {
+		file_datasource_proto_rawDescData = protoimpl.X.CompressGZIP(file_datasource_proto_rawDescData)
+	})
+	return file_datasource_proto_rawDescData
+}
+
+var file_datasource_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_datasource_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
+var file_datasource_proto_goTypes = []interface{}{
+	(DataSourceHealth_State)(0),   // 0: proto.DataSourceHealth.State
+	(*DataSourceConfig)(nil),      // 1: proto.DataSourceConfig
+	(*DataSourceEvent)(nil),       // 2: proto.DataSourceEvent
+	(*DataSourceHealth)(nil),      // 3: proto.DataSourceHealth
+	nil,                           // 4: proto.DataSourceHealth.MetricsEntry
+	(*timestamppb.Timestamp)(nil), // 5: google.protobuf.Timestamp
+	(*emptypb.Empty)(nil),         // 6: google.protobuf.Empty
+}
+var file_datasource_proto_depIdxs = []int32{
+	5, // 0: proto.DataSourceEvent.time:type_name -> google.protobuf.Timestamp
+	0, // 1: proto.DataSourceHealth.state:type_name -> proto.DataSourceHealth.State
+	4, // 2: proto.DataSourceHealth.metrics:type_name -> proto.DataSourceHealth.MetricsEntry
+	1, // 3: proto.DataSource.Configure:input_type -> proto.DataSourceConfig
+	6, // 4: proto.DataSource.OneShotAcquisition:input_type -> google.protobuf.Empty
+	6, // 5: proto.DataSource.StreamingAcquisition:input_type -> google.protobuf.Empty
+	6, // 6: proto.DataSource.Health:input_type -> google.protobuf.Empty
+	6, // 7: proto.DataSource.Configure:output_type -> google.protobuf.Empty
+	2, // 8: proto.DataSource.OneShotAcquisition:output_type -> proto.DataSourceEvent
+	2, // 9: proto.DataSource.StreamingAcquisition:output_type -> proto.DataSourceEvent
+	3, // 10: proto.DataSource.Health:output_type -> proto.DataSourceHealth
+	7, // [7:11] is the sub-list for method output_type
+	3, // [3:7] is the sub-list for method input_type
+	3, // [3:3] is the sub-list for extension type_name
+	3, // [3:3] is the sub-list for extension extendee
+	0, // [0:3] is the sub-list for field type_name
+}
+
+func init() { file_datasource_proto_init() }
+func file_datasource_proto_init() {
+	if File_datasource_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_datasource_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*DataSourceConfig); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_datasource_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*DataSourceEvent); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_datasource_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*DataSourceHealth); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_datasource_proto_rawDesc,
+			NumEnums:      1,
+			NumMessages:   4,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_datasource_proto_goTypes,
+		DependencyIndexes: file_datasource_proto_depIdxs,
+		EnumInfos:         file_datasource_proto_enumTypes,
+		MessageInfos:      file_datasource_proto_msgTypes,
+	}.Build()
+	File_datasource_proto = out.File
+	file_datasource_proto_rawDesc = nil
+	file_datasource_proto_goTypes = nil
+	file_datasource_proto_depIdxs = nil
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConnInterface
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion6
+
+// DataSourceClient is the client API for DataSource service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type DataSourceClient interface {
+	// Configure receives the configuration, before the acquisition starts
+	Configure(ctx context.Context, in *DataSourceConfig, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	// OneShotAcquisition streams the events, and returns once everything was read
+	OneShotAcquisition(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (DataSource_OneShotAcquisitionClient, error)
+	// StreamingAcquisition streams the events until crowdsec cancels the call
+	StreamingAcquisition(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (DataSource_StreamingAcquisitionClient, error)
+	// Health is called every health_check_interval during the streaming acquisition
+	Health(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*DataSourceHealth, error)
+}
+
+type dataSourceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewDataSourceClient(cc grpc.ClientConnInterface) DataSourceClient {
+	return &dataSourceClient{cc}
+}
+
+func (c *dataSourceClient) Configure(ctx context.Context, in *DataSourceConfig, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/proto.DataSource/Configure", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dataSourceClient) OneShotAcquisition(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (DataSource_OneShotAcquisitionClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_DataSource_serviceDesc.Streams[0], "/proto.DataSource/OneShotAcquisition", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &dataSourceOneShotAcquisitionClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type DataSource_OneShotAcquisitionClient interface {
+	Recv() (*DataSourceEvent, error)
+	grpc.ClientStream
+}
+
+type dataSourceOneShotAcquisitionClient struct {
+	grpc.ClientStream
+}
+
+func (x *dataSourceOneShotAcquisitionClient) Recv() (*DataSourceEvent, error) {
+	m := new(DataSourceEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *dataSourceClient) StreamingAcquisition(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (DataSource_StreamingAcquisitionClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_DataSource_serviceDesc.Streams[1], "/proto.DataSource/StreamingAcquisition", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &dataSourceStreamingAcquisitionClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type DataSource_StreamingAcquisitionClient interface {
+	Recv() (*DataSourceEvent, error)
+	grpc.ClientStream
+}
+
+type dataSourceStreamingAcquisitionClient struct {
+	grpc.ClientStream
+}
+
+func (x *dataSourceStreamingAcquisitionClient) Recv() (*DataSourceEvent, error) {
+	m := new(DataSourceEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *dataSourceClient) Health(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*DataSourceHealth, error) {
+	out := new(DataSourceHealth)
+	err := c.cc.Invoke(ctx, "/proto.DataSource/Health", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DataSourceServer is the server API for DataSource service.
+type DataSourceServer interface {
+	// Configure receives the configuration, before the acquisition starts
+	Configure(context.Context, *DataSourceConfig) (*emptypb.Empty, error)
+	// OneShotAcquisition streams the events, and returns once everything was read
+	OneShotAcquisition(*emptypb.Empty, DataSource_OneShotAcquisitionServer) error
+	// StreamingAcquisition streams the events until crowdsec cancels the call
+	StreamingAcquisition(*emptypb.Empty, DataSource_StreamingAcquisitionServer) error
+	// Health is called every health_check_interval during the streaming acquisition
+	Health(context.Context, *emptypb.Empty) (*DataSourceHealth, error)
+}
+
+// UnimplementedDataSourceServer can be embedded to have forward compatible implementations.
+type UnimplementedDataSourceServer struct {
+}
+
+func (*UnimplementedDataSourceServer) Configure(context.Context, *DataSourceConfig) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Configure not implemented")
+}
+func (*UnimplementedDataSourceServer) OneShotAcquisition(*emptypb.Empty, DataSource_OneShotAcquisitionServer) error {
+	return status.Errorf(codes.Unimplemented, "method OneShotAcquisition not implemented")
+}
+func (*UnimplementedDataSourceServer) StreamingAcquisition(*emptypb.Empty, DataSource_StreamingAcquisitionServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamingAcquisition not implemented")
+}
+func (*UnimplementedDataSourceServer) Health(context.Context, *emptypb.Empty) (*DataSourceHealth, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Health not implemented")
+}
+
+func RegisterDataSourceServer(s *grpc.Server, srv DataSourceServer) {
+	s.RegisterService(&_DataSource_serviceDesc, srv)
+}
+
+func _DataSource_Configure_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DataSourceConfig)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DataSourceServer).Configure(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/proto.DataSource/Configure",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DataSourceServer).Configure(ctx, req.(*DataSourceConfig))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DataSource_OneShotAcquisition_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(emptypb.Empty)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(DataSourceServer).OneShotAcquisition(m, &dataSourceOneShotAcquisitionServer{stream})
+}
+
+type DataSource_OneShotAcquisitionServer interface {
+	Send(*DataSourceEvent) error
+	grpc.ServerStream
+}
+
+type dataSourceOneShotAcquisitionServer struct {
+	grpc.ServerStream
+}
+
+func (x *dataSourceOneShotAcquisitionServer) Send(m *DataSourceEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _DataSource_StreamingAcquisition_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(emptypb.Empty)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(DataSourceServer).StreamingAcquisition(m, &dataSourceStreamingAcquisitionServer{stream})
+}
+
+type DataSource_StreamingAcquisitionServer interface {
+	Send(*DataSourceEvent) error
+	grpc.ServerStream
+}
+
+type dataSourceStreamingAcquisitionServer struct {
+	grpc.ServerStream
+}
+
+func (x *dataSourceStreamingAcquisitionServer) Send(m *DataSourceEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _DataSource_Health_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DataSourceServer).Health(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/proto.DataSource/Health",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DataSourceServer).Health(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _DataSource_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "proto.DataSource",
+	HandlerType: (*DataSourceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Configure",
+			Handler:    _DataSource_Configure_Handler,
+		},
+		{
+			MethodName: "Health",
+			Handler:    _DataSource_Health_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "OneShotAcquisition",
+			Handler:       _DataSource_OneShotAcquisition_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "StreamingAcquisition",
+			Handler:       _DataSource_StreamingAcquisition_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "datasource.proto",
+}
@@ -21,6 +21,10 @@ type DataSet struct {
 }
 
 func downloadFile(url string, destPath string) error {
+	return downloadFileVerified(url, destPath, nil)
+}
+
+func downloadFileVerified(url string, destPath string, verifier *SignatureVerifier) error {
 	log.Debugf("downloading %s in %s", url, destPath)
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
@@ -42,6 +46,12 @@ func downloadFile(url string, destPath string) error {
 		return fmt.Errorf("download response 'HTTP %d' : %s", resp.StatusCode, string(body))
 	}
 
+	if verifier != nil {
+		if err := verifier.VerifyFromURL(url, body); err != nil {
+			return err
+		}
+	}
+
 	file, err := os.OpenFile(destPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
@@ -61,10 +71,15 @@ func downloadFile(url string, destPath string) error {
 }
 
 func GetData(data []*DataSource, dataDir string) error {
+	return GetDataVerified(data, dataDir, nil)
+}
+
+// GetDataVerified downloads the data files, checking their detached signature if verifier is not nil
+func GetDataVerified(data []*DataSource, dataDir string, verifier *SignatureVerifier) error {
 	for _, dataS := range data {
 		destPath := path.Join(dataDir, dataS.DestPath)
 		log.Infof("downloading data '%s' in '%s'", dataS.SourceURL, destPath)
-		err := downloadFile(dataS.SourceURL, destPath)
+		err := downloadFileVerified(dataS.SourceURL, destPath, verifier)
 		if err != nil {
 			return err
 		}
@@ -3,10 +3,13 @@ package types
 import "time"
 
 type Line struct {
-	Raw     string            `yaml:"Raw,omitempty"`
-	Src     string            `yaml:"Src,omitempty"`
-	Time    time.Time         //acquis time
-	Labels  map[string]string `yaml:"Labels,omitempty"`
-	Process bool
-	Module  string `yaml:"Module,omitempty"`
+	Raw           string            `yaml:"Raw,omitempty"`
+	Src           string            `yaml:"Src,omitempty"`
+	Time          time.Time         //acquis time
+	Labels        map[string]string `yaml:"Labels,omitempty"`
+	Process       bool
+	Module        string   `yaml:"Module,omitempty"`
+	Timezone      string   `yaml:"Timezone,omitempty"`      //timezone of the datasource, for the dates without one
+	ParserRouting []string `yaml:"ParserRouting,omitempty"` //parsers the line is restricted to, in the stages they belong to
+	Seq           uint64   `yaml:"Seq,omitempty"`           //position of the line in its datasource, starting at 1
 }
@@ -0,0 +1,50 @@
+package types
+
+import "sync"
+
+/*
+The Parsed, Enriched and Meta maps of log events are taken from a pool to reduce the pressure on the GC.
+
+Ownership rules :
+  - the parser is the one allocating those maps (with NewStringMap), when the event enters the first stage
+  - an event that is sent to the buckets is owned by the buckets (queue, overflow, alert) and is never released
+  - the maps go back to the pool (with ReleaseEvent) only when the event is dropped : discarded or
+    whitelisted by the parser, or not poured in any bucket
+  - once released, neither the event nor its maps can be used
+
+The Event and Line structs themselves are not pooled : they go through the acquisition, the parsers and the buckets
+by value (chan types.Event), so they are copied on the stack or in the channel buffers rather than allocated one by
+one. Pooling them would mean passing pointers through every datasource and stage, for the maps that are the actual
+per-event allocations.
+*/
+var stringMapPool = sync.Pool{
+	New: func() interface{} {
+		return make(map[string]string)
+	},
+}
+
+// NewStringMap returns an empty map, reusing a released one if possible
+func NewStringMap() map[string]string {
+	return stringMapPool.Get().(map[string]string)
+}
+
+func releaseStringMap(m map[string]string) {
+	if m == nil {
+		return
+	}
+	for k := range m {
+		delete(m, k)
+	}
+	stringMapPool.Put(m)
+}
+
+// ReleaseEvent gives the maps of a dropped log event back to the pool, and resets the event
+func ReleaseEvent(evt *Event) {
+	if evt.Type != LOG {
+		return
+	}
+	releaseStringMap(evt.Parsed)
+	releaseStringMap(evt.Enriched)
+	releaseStringMap(evt.Meta)
+	*evt = Event{}
+}
@@ -0,0 +1,64 @@
+package types
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReleaseEvent(t *testing.T) {
+	evt := Event{
+		Type:     LOG,
+		Parsed:   NewStringMap(),
+		Enriched: NewStringMap(),
+		Meta:     NewStringMap(),
+	}
+	evt.Parsed["program"] = "sshd"
+	evt.Meta["source_ip"] = "1.2.3.4"
+	parsed := evt.Parsed
+
+	ReleaseEvent(&evt)
+	assert.Nil(t, evt.Parsed)
+	assert.Nil(t, evt.Meta)
+	assert.Empty(t, parsed)
+
+	// overflows are never released
+	ovflw := Event{Type: OVFLW, Meta: map[string]string{"foo": "bar"}}
+	ReleaseEvent(&ovflw)
+	assert.Equal(t, "bar", ovflw.Meta["foo"])
+}
+
+func fillEvent(evt *Event) {
+	evt.Parsed["program"] = "sshd"
+	evt.Parsed["message"] = "Failed password for root from 1.2.3.4 port 22 ssh2"
+	evt.Enriched["IsoCode"] = "FR"
+	evt.Meta["source_ip"] = "1.2.3.4"
+	evt.Meta["log_type"] = "ssh_failed-auth"
+}
+
+func BenchmarkEventMapsMake(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		evt := Event{
+			Type:     LOG,
+			Parsed:   make(map[string]string),
+			Enriched: make(map[string]string),
+			Meta:     make(map[string]string),
+		}
+		fillEvent(&evt)
+	}
+}
+
+func BenchmarkEventMapsPooled(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		evt := Event{
+			Type:     LOG,
+			Parsed:   NewStringMap(),
+			Enriched: NewStringMap(),
+			Meta:     NewStringMap(),
+		}
+		fillEvent(&evt)
+		ReleaseEvent(&evt)
+	}
+}
@@ -0,0 +1,270 @@
+package types
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	SIGNATURE_HARD_FAIL = "hard_fail"
+	SIGNATURE_SOFT_FAIL = "soft_fail"
+)
+
+// SignatureSuffix is appended to the url of a downloaded resource to fetch its detached signature
+var SignatureSuffix = ".minisig"
+
+// CosignSignatureSuffix is appended to the url of a downloaded resource to fetch its detached cosign signature
+// (as made by cosign sign-blob)
+var CosignSignatureSuffix = ".sig"
+
+const (
+	minisignPureAlgo   = "Ed"
+	minisignHashedAlgo = "ED"
+)
+
+type minisignPublicKey struct {
+	keyID [8]byte
+	key   ed25519.PublicKey
+}
+
+// SignatureVerifier checks detached minisign or cosign signatures against a set of trusted public keys
+type SignatureVerifier struct {
+	keys       map[[8]byte]ed25519.PublicKey //minisign keys, by key id
+	cosignKeys []*ecdsa.PublicKey
+	SoftFail   bool
+}
+
+// parseMinisignPublicKey accepts either the raw base64 key or the content of a minisign .pub file
+func parseMinisignPublicKey(in string) (minisignPublicKey, error) {
+	var ret minisignPublicKey
+	var b64 string
+
+	for _, line := range strings.Split(strings.TrimSpace(in), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "untrusted comment:") {
+			continue
+		}
+		b64 = line
+		break
+	}
+	raw, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return ret, errors.Wrap(err, "invalid base64 in public key")
+	}
+	if len(raw) != 2+8+ed25519.PublicKeySize {
+		return ret, fmt.Errorf("invalid public key length %d", len(raw))
+	}
+	if string(raw[:2]) != minisignPureAlgo {
+		return ret, fmt.Errorf("unsupported public key algorithm '%s'", string(raw[:2]))
+	}
+	copy(ret.keyID[:], raw[2:10])
+	ret.key = ed25519.PublicKey(raw[10:])
+	return ret, nil
+}
+
+// parseCosignPublicKey accepts the PEM encoded public key generated by cosign generate-key-pair
+func parseCosignPublicKey(in string) (*ecdsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(strings.TrimSpace(in)))
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("invalid PEM public key")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid public key")
+	}
+	ret, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported public key type %T, only ECDSA cosign keys are supported", pub)
+	}
+	return ret, nil
+}
+
+// NewSignatureVerifier builds a verifier from inline keys and key files, either minisign keys or PEM cosign keys.
+// policy is either hard_fail (default) or soft_fail
+func NewSignatureVerifier(keys []string, keyFiles []string, policy string) (*SignatureVerifier, error) {
+	v := &SignatureVerifier{
+		keys: make(map[[8]byte]ed25519.PublicKey),
+	}
+	switch policy {
+	case "", SIGNATURE_HARD_FAIL:
+		v.SoftFail = false
+	case SIGNATURE_SOFT_FAIL:
+		v.SoftFail = true
+	default:
+		return nil, fmt.Errorf("unknown signature policy '%s' (must be %s or %s)", policy, SIGNATURE_HARD_FAIL, SIGNATURE_SOFT_FAIL)
+	}
+	for _, keyFile := range keyFiles {
+		content, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "while reading trusted key %s", keyFile)
+		}
+		keys = append(keys, string(content))
+	}
+	for _, k := range keys {
+		if strings.Contains(k, "-----BEGIN") {
+			pk, err := parseCosignPublicKey(k)
+			if err != nil {
+				return nil, errors.Wrap(err, "while loading trusted cosign key")
+			}
+			v.cosignKeys = append(v.cosignKeys, pk)
+			continue
+		}
+		pk, err := parseMinisignPublicKey(k)
+		if err != nil {
+			return nil, errors.Wrap(err, "while loading trusted key")
+		}
+		v.keys[pk.keyID] = pk.key
+	}
+	if len(v.keys) == 0 && len(v.cosignKeys) == 0 {
+		return nil, fmt.Errorf("signature verification is enabled but no trusted key is configured")
+	}
+	return v, nil
+}
+
+// Verify checks that sig is a valid minisign or cosign signature of content made by one of the trusted keys
+func (v *SignatureVerifier) Verify(content []byte, sig []byte) error {
+	if bytes.HasPrefix(sig, []byte("untrusted comment:")) {
+		return v.verifyMinisign(content, sig)
+	}
+	return v.verifyCosign(content, sig)
+}
+
+// verifyCosign checks a cosign sign-blob signature : the base64 ASN.1 ECDSA signature of the sha256 of content
+func (v *SignatureVerifier) verifyCosign(content []byte, sig []byte) error {
+	if len(v.cosignKeys) == 0 {
+		return fmt.Errorf("malformed signature : not a minisign signature and no cosign key is trusted")
+	}
+	rawSig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+	if err != nil {
+		return errors.Wrap(err, "malformed signature")
+	}
+	digest := sha256.Sum256(content)
+	for _, pk := range v.cosignKeys {
+		if ecdsa.VerifyASN1(pk, digest[:], rawSig) {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid signature or untrusted key")
+}
+
+func (v *SignatureVerifier) verifyMinisign(content []byte, sig []byte) error {
+	var lines []string
+
+	scanner := bufio.NewScanner(bytes.NewReader(sig))
+	for scanner.Scan() {
+		lines = append(lines, strings.TrimRight(scanner.Text(), "\r"))
+	}
+	if len(lines) < 4 {
+		return fmt.Errorf("malformed signature : expected 4 lines, got %d", len(lines))
+	}
+	if !strings.HasPrefix(lines[0], "untrusted comment:") {
+		return fmt.Errorf("malformed signature : missing untrusted comment")
+	}
+	rawSig, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil {
+		return errors.Wrap(err, "malformed signature")
+	}
+	if len(rawSig) != 2+8+ed25519.SignatureSize {
+		return fmt.Errorf("malformed signature : invalid length %d", len(rawSig))
+	}
+	if !strings.HasPrefix(lines[2], "trusted comment: ") {
+		return fmt.Errorf("malformed signature : missing trusted comment")
+	}
+	trustedComment := strings.TrimPrefix(lines[2], "trusted comment: ")
+	globalSig, err := base64.StdEncoding.DecodeString(lines[3])
+	if err != nil {
+		return errors.Wrap(err, "malformed global signature")
+	}
+
+	var keyID [8]byte
+	copy(keyID[:], rawSig[2:10])
+	pk, ok := v.keys[keyID]
+	if !ok {
+		return fmt.Errorf("signature made by untrusted key %X", keyID)
+	}
+
+	message := content
+	switch string(rawSig[:2]) {
+	case minisignPureAlgo:
+	case minisignHashedAlgo:
+		h := blake2b.Sum512(content)
+		message = h[:]
+	default:
+		return fmt.Errorf("unsupported signature algorithm '%s'", string(rawSig[:2]))
+	}
+	if !ed25519.Verify(pk, message, rawSig[10:]) {
+		return fmt.Errorf("invalid signature")
+	}
+	if !ed25519.Verify(pk, append(append([]byte{}, rawSig[10:]...), []byte(trustedComment)...), globalSig) {
+		return fmt.Errorf("invalid trusted comment signature")
+	}
+	return nil
+}
+
+// VerifyFromURL fetches the detached signature of url and checks content against it.
+// In soft_fail mode, failures are only logged and nil is returned.
+func (v *SignatureVerifier) VerifyFromURL(url string, content []byte) error {
+	err := v.verifyFromURL(url, content)
+	if err == nil {
+		log.Debugf("valid signature for %s", url)
+		return nil
+	}
+	if v.SoftFail {
+		log.Warningf("signature verification failed for %s : %s", url, err)
+		return nil
+	}
+	return errors.Wrapf(err, "signature verification failed for %s", url)
+}
+
+// verifyFromURL checks the minisign signature, then the cosign one, of the formats there are trusted keys for.
+// The first signature found is the one that decides
+func (v *SignatureVerifier) verifyFromURL(url string, content []byte) error {
+	var suffixes []string
+	var err error
+
+	if len(v.keys) > 0 {
+		suffixes = append(suffixes, SignatureSuffix)
+	}
+	if len(v.cosignKeys) > 0 {
+		suffixes = append(suffixes, CosignSignatureSuffix)
+	}
+	for _, suffix := range suffixes {
+		var sig []byte
+		sig, err = fetchSignature(url + suffix)
+		if err != nil {
+			continue
+		}
+		return v.Verify(content, sig)
+	}
+	return err
+}
+
+func fetchSignature(url string) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("bad http code %d while requesting %s", resp.StatusCode, req.URL.String())
+	}
+	return ioutil.ReadAll(resp.Body)
+}
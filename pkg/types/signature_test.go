@@ -0,0 +1,254 @@
+package types
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/blake2b"
+)
+
+type testSigner struct {
+	keyID [8]byte
+	pub   ed25519.PublicKey
+	priv  ed25519.PrivateKey
+}
+
+func newTestSigner(t *testing.T) testSigner {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	s := testSigner{pub: pub, priv: priv}
+	_, err = rand.Read(s.keyID[:])
+	require.NoError(t, err)
+	return s
+}
+
+func (s testSigner) publicKey() string {
+	raw := append([]byte(minisignPureAlgo), s.keyID[:]...)
+	raw = append(raw, s.pub...)
+	return "untrusted comment: minisign public key\n" + base64.StdEncoding.EncodeToString(raw) + "\n"
+}
+
+func (s testSigner) sign(content []byte, algo string) []byte {
+	message := content
+	if algo == minisignHashedAlgo {
+		h := blake2b.Sum512(content)
+		message = h[:]
+	}
+	sig := ed25519.Sign(s.priv, message)
+	raw := append([]byte(algo), s.keyID[:]...)
+	raw = append(raw, sig...)
+	trustedComment := "timestamp:1556193335\tfile:test"
+	globalSig := ed25519.Sign(s.priv, append(append([]byte{}, sig...), []byte(trustedComment)...))
+	return []byte(fmt.Sprintf("untrusted comment: signature from minisign secret key\n%s\ntrusted comment: %s\n%s\n",
+		base64.StdEncoding.EncodeToString(raw), trustedComment, base64.StdEncoding.EncodeToString(globalSig)))
+}
+
+type testCosignSigner struct {
+	priv *ecdsa.PrivateKey
+}
+
+func newTestCosignSigner(t *testing.T) testCosignSigner {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	return testCosignSigner{priv: priv}
+}
+
+func (s testCosignSigner) publicKey(t *testing.T) string {
+	der, err := x509.MarshalPKIXPublicKey(&s.priv.PublicKey)
+	require.NoError(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func (s testCosignSigner) sign(t *testing.T, content []byte) []byte {
+	digest := sha256.Sum256(content)
+	sig, err := ecdsa.SignASN1(rand.Reader, s.priv, digest[:])
+	require.NoError(t, err)
+	return []byte(base64.StdEncoding.EncodeToString(sig))
+}
+
+func TestSignatureVerify(t *testing.T) {
+	signer := newTestSigner(t)
+	other := newTestSigner(t)
+	content := []byte("some hub item content")
+
+	verifier, err := NewSignatureVerifier([]string{signer.publicKey()}, nil, "")
+	require.NoError(t, err)
+	assert.False(t, verifier.SoftFail)
+
+	tests := []struct {
+		name    string
+		content []byte
+		sig     []byte
+		err     string
+	}{
+		{
+			name:    "valid pure signature",
+			content: content,
+			sig:     signer.sign(content, minisignPureAlgo),
+		},
+		{
+			name:    "valid prehashed signature",
+			content: content,
+			sig:     signer.sign(content, minisignHashedAlgo),
+		},
+		{
+			name:    "tampered content",
+			content: []byte("some tampered content"),
+			sig:     signer.sign(content, minisignPureAlgo),
+			err:     "invalid signature",
+		},
+		{
+			name:    "untrusted key",
+			content: content,
+			sig:     other.sign(content, minisignPureAlgo),
+			err:     "signature made by untrusted key",
+		},
+		{
+			name:    "malformed signature",
+			content: content,
+			sig:     []byte("untrusted comment: foo\n"),
+			err:     "malformed signature",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := verifier.Verify(test.content, test.sig)
+			if test.err == "" {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), test.err)
+		})
+	}
+}
+
+func TestSignatureVerifyCosign(t *testing.T) {
+	signer := newTestCosignSigner(t)
+	other := newTestCosignSigner(t)
+	minisigner := newTestSigner(t)
+	content := []byte("some blocklist content")
+
+	verifier, err := NewSignatureVerifier([]string{signer.publicKey(t), minisigner.publicKey()}, nil, "")
+	require.NoError(t, err)
+
+	assert.NoError(t, verifier.Verify(content, signer.sign(t, content)))
+	//both formats can be trusted at the same time
+	assert.NoError(t, verifier.Verify(content, minisigner.sign(content, minisignPureAlgo)))
+
+	err = verifier.Verify([]byte("some tampered content"), signer.sign(t, content))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid signature")
+
+	err = verifier.Verify(content, other.sign(t, content))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "untrusted key")
+
+	err = verifier.Verify(content, []byte("not base64 !"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "malformed signature")
+
+	minisignOnly, err := NewSignatureVerifier([]string{minisigner.publicKey()}, nil, "")
+	require.NoError(t, err)
+	err = minisignOnly.Verify(content, signer.sign(t, content))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no cosign key is trusted")
+}
+
+func TestNewSignatureVerifier(t *testing.T) {
+	signer := newTestSigner(t)
+
+	_, err := NewSignatureVerifier(nil, nil, "")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no trusted key")
+
+	_, err = NewSignatureVerifier([]string{signer.publicKey()}, nil, "whatever")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown signature policy")
+
+	_, err = NewSignatureVerifier([]string{"not a key"}, nil, "")
+	assert.Error(t, err)
+
+	_, err = NewSignatureVerifier(nil, []string{"/does/not/exist.pub"}, "")
+	assert.Error(t, err)
+
+	_, err = NewSignatureVerifier([]string{"-----BEGIN PUBLIC KEY-----\nnot a key\n-----END PUBLIC KEY-----\n"}, nil, "")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cosign key")
+
+	cosignKeyFile := filepath.Join(t.TempDir(), "cosign.pub")
+	require.NoError(t, os.WriteFile(cosignKeyFile, []byte(newTestCosignSigner(t).publicKey(t)), 0644))
+	_, err = NewSignatureVerifier(nil, []string{cosignKeyFile}, "")
+	assert.NoError(t, err)
+
+	verifier, err := NewSignatureVerifier([]string{signer.publicKey()}, nil, SIGNATURE_SOFT_FAIL)
+	require.NoError(t, err)
+	assert.True(t, verifier.SoftFail)
+}
+
+func TestDownloadFileVerified(t *testing.T) {
+	examplePath := "./example_signed.txt"
+	defer os.Remove(examplePath)
+	signer := newTestSigner(t)
+	content := []byte("example content oneoneone")
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	httpmock.RegisterResponder("GET", "https://example.com/signed", httpmock.NewBytesResponder(200, content))
+	httpmock.RegisterResponder("GET", "https://example.com/signed"+SignatureSuffix, httpmock.NewBytesResponder(200, signer.sign(content, minisignPureAlgo)))
+	httpmock.RegisterResponder("GET", "https://example.com/unsigned", httpmock.NewBytesResponder(200, content))
+	httpmock.RegisterResponder("GET", "https://example.com/unsigned"+SignatureSuffix, httpmock.NewStringResponder(404, "not found"))
+
+	hardFail, err := NewSignatureVerifier([]string{signer.publicKey()}, nil, SIGNATURE_HARD_FAIL)
+	require.NoError(t, err)
+	softFail, err := NewSignatureVerifier([]string{signer.publicKey()}, nil, SIGNATURE_SOFT_FAIL)
+	require.NoError(t, err)
+
+	err = downloadFileVerified("https://example.com/signed", examplePath, hardFail)
+	assert.NoError(t, err)
+	err = downloadFileVerified("https://example.com/unsigned", examplePath, hardFail)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "signature verification failed")
+	err = downloadFileVerified("https://example.com/unsigned", examplePath, softFail)
+	assert.NoError(t, err)
+}
+
+func TestDownloadFileVerifiedCosign(t *testing.T) {
+	examplePath := filepath.Join(t.TempDir(), "example_signed.txt")
+	signer := newTestCosignSigner(t)
+	minisigner := newTestSigner(t)
+	content := []byte("example content twotwotwo")
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	httpmock.RegisterResponder("GET", "https://example.com/signed", httpmock.NewBytesResponder(200, content))
+	httpmock.RegisterResponder("GET", "https://example.com/signed"+SignatureSuffix, httpmock.NewStringResponder(404, "not found"))
+	httpmock.RegisterResponder("GET", "https://example.com/signed"+CosignSignatureSuffix, httpmock.NewBytesResponder(200, signer.sign(t, content)))
+	httpmock.RegisterResponder("GET", "https://example.com/tampered", httpmock.NewBytesResponder(200, []byte("tampered content")))
+	httpmock.RegisterResponder("GET", "https://example.com/tampered"+SignatureSuffix, httpmock.NewBytesResponder(200, minisigner.sign(content, minisignPureAlgo)))
+	httpmock.RegisterResponder("GET", "https://example.com/tampered"+CosignSignatureSuffix, httpmock.NewBytesResponder(200, signer.sign(t, []byte("tampered content"))))
+
+	verifier, err := NewSignatureVerifier([]string{minisigner.publicKey(), signer.publicKey(t)}, nil, SIGNATURE_HARD_FAIL)
+	require.NoError(t, err)
+
+	//no minisign signature, the cosign one is used
+	assert.NoError(t, downloadFileVerified("https://example.com/signed", examplePath, verifier))
+	//an invalid minisign signature is not rescued by a valid cosign one
+	err = downloadFileVerified("https://example.com/tampered", examplePath, verifier)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid signature")
+}